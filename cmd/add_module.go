@@ -0,0 +1,118 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulereader"
+	"hpc-toolkit/pkg/sourcereader"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	addModuleCmd.Flags().StringVarP(&addModuleBlueprint, "blueprint", "b", "", "Blueprint to add the module to.")
+	addModuleCmd.MarkFlagRequired("blueprint")
+	addModuleCmd.MarkFlagFilename("blueprint", "yaml", "yml")
+	addModuleCmd.Flags().StringVarP(&addModuleGroup, "group", "g", "", "Deployment group to add the module to.")
+	addModuleCmd.MarkFlagRequired("group")
+	addModuleCmd.Flags().StringVar(&addModuleID, "id", "",
+		"ID of the module, defaults to the last element of the source with underscores instead of dashes.")
+	addModuleCmd.Flags().StringSliceVar(&addModuleUse, "use", nil, "Modules used by the module.")
+	rootCmd.AddCommand(addModuleCmd)
+}
+
+var (
+	addModuleBlueprint string
+	addModuleGroup     string
+	addModuleID        string
+	addModuleUse       []string
+	addModuleCmd       = &cobra.Command{
+		Use:   "add-module SOURCE",
+		Short: "Add a module to the blueprint.",
+		Long: "Add a module to a deployment group of the blueprint. Sources of modules embedded in ghpc " +
+			"are completed by the shell completion, with their descriptions. Comments and formatting of the blueprint are preserved.",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeModuleSources,
+		RunE:              runAddModuleCmd,
+	}
+)
+
+func runAddModuleCmd(cmd *cobra.Command, args []string) error {
+	source := args[0]
+	id := config.ModuleID(addModuleID)
+	if id == "" {
+		id = config.ModuleID(strings.ReplaceAll(path.Base(source), "-", "_"))
+	}
+	use := []config.ModuleID{}
+	for _, u := range addModuleUse {
+		use = append(use, config.ModuleID(u))
+	}
+
+	info, err := os.Stat(addModuleBlueprint)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(addModuleBlueprint)
+	if err != nil {
+		return err
+	}
+	added, err := config.AddModule(data, addModuleGroup, id, source, use)
+	if err != nil {
+		return fmt.Errorf("failed to add module %q to %s: %w", id, addModuleBlueprint, err)
+	}
+	if err := os.WriteFile(addModuleBlueprint, added, info.Mode().Perm()); err != nil {
+		return err
+	}
+	logging.Info(boldGreen("Module %s was added to group %s of %s"), id, addModuleGroup, addModuleBlueprint)
+	return nil
+}
+
+// completeModuleSources completes sources of embedded modules, described as in
+// the modules index, and directories of local modules
+func completeModuleSources(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) != 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	if sourcereader.IsLocalPath(toComplete) {
+		return nil, cobra.ShellCompDirectiveFilterDirs
+	}
+	catalog, err := modulereader.EmbeddedCatalog()
+	if err != nil {
+		cobra.CompDebugln(err.Error(), false)
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return moduleSourceCompletions(catalog, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+func moduleSourceCompletions(catalog []modulereader.CatalogEntry, toComplete string) []string {
+	res := []string{}
+	for _, e := range catalog {
+		if !strings.HasPrefix(e.Source, toComplete) {
+			continue
+		}
+		if e.Description == "" {
+			res = append(res, e.Source)
+		} else {
+			res = append(res, e.Source+"\t"+e.Description)
+		}
+	}
+	return res
+}
@@ -0,0 +1,35 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"hpc-toolkit/pkg/modulereader"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestModuleSourceCompletions(c *C) {
+	catalog := []modulereader.CatalogEntry{
+		{Source: "community/modules/project/new-project", Description: "Creates a Google Cloud Project."},
+		{Source: "modules/network/pre-existing-vpc"},
+		{Source: "modules/network/vpc", Description: "Creates a VPC network."},
+	}
+	c.Check(moduleSourceCompletions(catalog, "modules/net"), DeepEquals, []string{
+		"modules/network/pre-existing-vpc",
+		"modules/network/vpc\tCreates a VPC network.",
+	})
+	c.Check(moduleSourceCompletions(catalog, ""), HasLen, 3)
+	c.Check(moduleSourceCompletions(catalog, "nope"), HasLen, 0)
+}
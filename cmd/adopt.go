@@ -0,0 +1,67 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	deploymentFileFlag := "deployment-file"
+	adoptCmd.Flags().StringVarP(&deploymentFile, deploymentFileFlag, "d", "",
+		"Toolkit Deployment File.")
+	adoptCmd.Flags().MarkHidden(deploymentFileFlag)
+	adoptCmd.MarkFlagFilename(deploymentFileFlag, "yaml", "yml")
+	adoptCmd.Flags().StringVarP(&outputDir, "out", "o", "",
+		"Sets the output directory that holds the existing deployment directory.")
+	adoptCmd.Flags().StringSliceVar(&cliVariables, "vars", nil, msgCLIVars)
+	adoptCmd.Flags().StringArrayVar(&cliVars, "var", nil, msgCLIVar)
+	adoptCmd.Flags().StringArrayVar(&cliVarFiles, "var-json", nil, msgCLIVarJSON)
+	adoptCmd.Flags().StringSliceVar(&cliBEConfigVars, "backend-config", nil, msgCLIBackendConfig)
+	adoptCmd.Flags().StringVarP(&validationLevel, "validation-level", "l", "WARNING", validationLevelDesc)
+	adoptCmd.Flags().StringSliceVar(&validatorsToSkip, "skip-validators", nil, skipValidatorsDesc)
+	rootCmd.AddCommand(adoptCmd)
+}
+
+var (
+	adoptCmd = &cobra.Command{
+		Use:   "adopt BLUEPRINT_NAME [BLUEPRINT_NAME...]",
+		Short: "Adopt an existing deployment directory.",
+		Long: "Writes toolkit metadata to an existing deployment directory that was produced by an older version of ghpc or modified by hand, " +
+			"so it can be updated with `create -w`, deployed and destroyed. Deployment groups are not modified.",
+		Run:               runAdoptCmd,
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: filterYamls,
+	}
+)
+
+func runAdoptCmd(cmd *cobra.Command, args []string) {
+	bp, ctx := expandOrDie(args, deploymentFile)
+	deplDir := filepath.Join(outputDir, bp.DeploymentName())
+	checkErr(modulewriter.AdoptDeployment(bp, deplDir))
+
+	logging.Info(boldGreen("Deployment %s was adopted."), deplDir)
+	logging.Info("To update deployment groups to the blueprint please run:")
+	logging.Info("")
+	logging.Info(boldGreen("%s create -w %s"), execPath(), strings.Join(args, " "))
+	logging.Info("")
+	reportWarnings(bp, ctx)
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"hpc-toolkit/pkg/shell"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cleanCmd.Flags().BoolVar(&cleanDryRun, "dry-run", false, "List files that would be removed without removing them")
+	cleanCmd.Flags().Int64Var(&maxLogSizeMiB, "max-log-size", 10, "Remove logs in deployment groups larger than this size, in MiB")
+	rootCmd.AddCommand(cleanCmd)
+}
+
+var (
+	cleanDryRun   bool
+	maxLogSizeMiB int64
+
+	cleanCmd = &cobra.Command{
+		Use:               "clean DEPLOYMENT_DIRECTORY",
+		Short:             "Remove stale files from a deployment directory.",
+		Long:              "Remove backups of deployment groups removed from the blueprint, terraform working directories of backups, plan files and oversized logs.",
+		Args:              cobra.MatchAll(cobra.ExactArgs(1), checkDir),
+		ValidArgsFunction: matchDirs,
+		RunE:              runCleanCmd,
+		SilenceUsage:      true,
+	}
+)
+
+func runCleanCmd(cmd *cobra.Command, args []string) error {
+	deplDir := args[0]
+	artifacts := modulewriter.ArtifactsDir(deplDir)
+	if err := modulewriter.CheckManifest(artifacts); err != nil {
+		return err
+	}
+	bp, _, err := config.NewBlueprint(filepath.Join(artifacts, modulewriter.ExpandedBlueprintName))
+	if err != nil {
+		return err
+	}
+	if err := shell.ValidateDeploymentDirectory(bp, deplDir); err != nil {
+		return err
+	}
+
+	stale, kept, err := modulewriter.StaleFiles(bp, deplDir, maxLogSizeMiB*1024*1024)
+	if err != nil {
+		return err
+	}
+	for _, f := range kept {
+		logging.Info("%s %s: %s", boldYellow("Keeping"), f.Path, f.Reason)
+	}
+	if len(stale) == 0 {
+		logging.Info("Nothing to clean in %s", deplDir)
+		return nil
+	}
+	for _, f := range stale {
+		if cleanDryRun {
+			logging.Info("Would remove %s: %s", f.Path, f.Reason)
+			continue
+		}
+		if err := os.RemoveAll(f.Path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", f.Path, err)
+		}
+		logging.Info("Removed %s: %s", f.Path, f.Reason)
+	}
+	return nil
+}
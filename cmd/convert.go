@@ -0,0 +1,111 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	toTerraformCmd.Flags().StringVarP(&tfRootDir, "out", "o", "",
+		"Output directory of the terraform root module (<deployment_name>-terraform if unset)")
+	toTerraformCmd.Flags().StringVarP(&deploymentFile, "deployment-file", "d", "", "Toolkit Deployment File.")
+	toTerraformCmd.Flags().MarkHidden("deployment-file")
+	toTerraformCmd.Flags().StringSliceVar(&cliVariables, "vars", nil, msgCLIVars)
+	toTerraformCmd.Flags().StringArrayVar(&cliVars, "var", nil, msgCLIVar)
+	toTerraformCmd.Flags().StringArrayVar(&cliVarFiles, "var-json", nil, msgCLIVarJSON)
+	toTerraformCmd.Flags().StringSliceVar(&cliBEConfigVars, "backend-config", nil, msgCLIBackendConfig)
+	toTerraformCmd.Flags().StringVarP(&validationLevel, "validation-level", "l", "WARNING", validationLevelDesc)
+	toTerraformCmd.Flags().StringSliceVar(&validatorsToSkip, "skip-validators", nil, skipValidatorsDesc)
+
+	fromTerraformCmd.Flags().StringVarP(&importedBlueprint, "out", "o", "blueprint.yaml", "Output file of the blueprint")
+
+	convertCmd.AddCommand(toTerraformCmd, fromTerraformCmd)
+	rootCmd.AddCommand(convertCmd)
+}
+
+var (
+	tfRootDir         string
+	importedBlueprint string
+	convertCmd        = &cobra.Command{
+		Use:   "convert",
+		Short: "Convert blueprints to and from plain terraform root modules.",
+	}
+	toTerraformCmd = &cobra.Command{
+		Use:   "to-terraform BLUEPRINT_NAME [BLUEPRINT_NAME...]",
+		Short: "Write the blueprint as a standalone terraform root module.",
+		Long: "Write terraform modules of the expanded blueprint as a standalone terraform root module, " +
+			"that is deployed with terraform alone. Terraform modules of all deployment groups are merged into the root module, " +
+			"Packer modules are left out.",
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: filterYamls,
+		Run:               runToTerraformCmd,
+	}
+	fromTerraformCmd = &cobra.Command{
+		Use:   "from-terraform TERRAFORM_DIRECTORY",
+		Short: "Write a blueprint skeleton out of a terraform root module.",
+		Long: "Write a blueprint skeleton out of a terraform root module, on a best-effort basis. Module blocks become " +
+			"blueprint modules and variables become deployment variables, parts of the root module that " +
+			"blueprints can not express are reported and have to be converted by hand.",
+		Args:              cobra.MatchAll(cobra.ExactArgs(1), checkDir),
+		ValidArgsFunction: matchDirs,
+		RunE:              runFromTerraformCmd,
+		SilenceUsage:      true,
+	}
+)
+
+func runToTerraformCmd(cmd *cobra.Command, args []string) {
+	bp, _ := expandOrDie(args, deploymentFile)
+	dir := tfRootDir
+	if dir == "" {
+		dir = bp.DeploymentName() + "-terraform"
+	}
+	skipped, err := modulewriter.WriteTerraformRoot(bp, dir)
+	checkErr(err)
+	for _, m := range skipped {
+		logging.Info(boldYellow("Packer module %s was left out of the terraform root module"), m)
+	}
+	logging.Info(boldGreen("Terraform root module written to %s"), dir)
+	logging.Info("To deploy it, run:")
+	logging.Info("")
+	logging.Info("terraform -chdir=%s init", dir)
+	logging.Info("terraform -chdir=%s apply", dir)
+}
+
+func runFromTerraformCmd(cmd *cobra.Command, args []string) error {
+	if _, err := os.Stat(importedBlueprint); err == nil {
+		return fmt.Errorf("%s already exists, choose another output file", importedBlueprint)
+	}
+	bp, skipped, err := config.ImportTerraformRoot(args[0], filepath.Dir(importedBlueprint))
+	if err != nil {
+		return err
+	}
+	if err := bp.Export(importedBlueprint); err != nil {
+		return err
+	}
+	for _, s := range skipped {
+		logging.Info(boldYellow("not converted: %s"), s)
+	}
+	logging.Info(boldGreen("Blueprint skeleton written to %s"), importedBlueprint)
+	return nil
+}
@@ -18,11 +18,17 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/expandhooks"
+	"hpc-toolkit/pkg/healthchecks"
 	"hpc-toolkit/pkg/logging"
 	"hpc-toolkit/pkg/modulewriter"
+	"hpc-toolkit/pkg/notifications"
+	"hpc-toolkit/pkg/remote"
 	"hpc-toolkit/pkg/validators"
 	"os"
 	"path/filepath"
@@ -30,11 +36,16 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/term"
 	"gopkg.in/yaml.v3"
 )
 
 const msgCLIVars = "Comma-separated list of name=value variables to override YAML configuration. Can be used multiple times."
+const msgCLIVar = "A name=value variable to override YAML configuration, name:=JSON for a value of explicit type. Can be used multiple times."
+const msgCLIVarJSON = "JSON file holding an object of variables to override YAML configuration. Can be used multiple times."
+const msgWarningsJSON = "If specified, warnings found in the blueprint are also written to this file as a JSON list."
 const msgCLIBackendConfig = "Comma-separated list of name=value variables to set Terraform backend configuration. Can be used multiple times."
+const msgRequireDigest = "If specified, blueprints read from standard input, https:// or gs:// must be given a digest as LOCATION#sha256=HEX."
 
 func init() {
 	createCmd.Flags().StringVarP(&bpFilenameDeprecated, "config", "c", "", "")
@@ -49,14 +60,20 @@ func init() {
 	createCmd.Flags().StringVarP(&outputDir, "out", "o", "",
 		"Sets the output directory where the HPC deployment directory will be created.")
 	createCmd.Flags().StringSliceVar(&cliVariables, "vars", nil, msgCLIVars)
+	createCmd.Flags().StringArrayVar(&cliVars, "var", nil, msgCLIVar)
+	createCmd.Flags().StringArrayVar(&cliVarFiles, "var-json", nil, msgCLIVarJSON)
 	createCmd.Flags().StringSliceVar(&cliBEConfigVars, "backend-config", nil, msgCLIBackendConfig)
 	createCmd.Flags().StringVarP(&validationLevel, "validation-level", "l", "WARNING", validationLevelDesc)
 	createCmd.Flags().StringSliceVar(&validatorsToSkip, "skip-validators", nil, skipValidatorsDesc)
+	createCmd.Flags().StringSliceVar(&expansionsToSkip, "skip-expansions", nil, skipExpansionsDesc)
+	createCmd.Flags().StringVar(&warningsJSON, "warnings-json", "", msgWarningsJSON)
+	createCmd.Flags().BoolVar(&requireDigest, "require-blueprint-digest", false, msgRequireDigest)
 	createCmd.Flags().BoolVarP(&overwriteDeployment, "overwrite-deployment", "w", false,
 		"If specified, an existing deployment directory is overwritten by the new deployment. \n"+
 			"Note: Terraform state IS preserved. \n"+
 			"Note: Terraform workspaces are NOT supported (behavior undefined). \n"+
-			"Note: Packer is NOT supported.")
+			"Note: Packer is NOT supported. \n"+
+			"Note: removing modules or groups and changing backends require --force.")
 	createCmd.Flags().BoolVar(&forceOverwrite, "force", false,
 		"Forces overwrite of existing deployment directory. \n"+
 			"If set, --overwrite-deployment is implied. \n"+
@@ -69,6 +86,8 @@ var (
 	deploymentFile       string
 	outputDir            string
 	cliVariables         []string
+	cliVars              []string
+	cliVarFiles          []string
 
 	cliBEConfigVars     []string
 	overwriteDeployment bool
@@ -76,23 +95,29 @@ var (
 	validationLevel     string
 	validationLevelDesc = "Set validation level to one of (\"ERROR\", \"WARNING\", \"IGNORE\")"
 	validatorsToSkip    []string
+	warningsJSON        string
+	requireDigest       bool
 	skipValidatorsDesc  = "Validators to skip"
+	expansionsToSkip    []string
+	skipExpansionsDesc  = "Implicit expansions to skip for all modules: \"labels\", \"vars\", \"use\", \"vars.SETTING\" or \"use.SETTING\""
 
 	createCmd = &cobra.Command{
-		Use:               "create BLUEPRINT_NAME",
+		Use:               "create BLUEPRINT_NAME [BLUEPRINT_NAME...]",
 		Short:             "Create a new deployment.",
-		Long:              "Create a new deployment based on a provided blueprint.",
+		Long:              "Create a new deployment based on a provided blueprint.\nBlueprints are local files, \"-\" for standard input, https:// URLs or gs://BUCKET/OBJECT.",
 		Run:               runCreateCmd,
-		Args:              cobra.ExactArgs(1),
-		ValidArgsFunction: filterYaml,
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: filterYamls,
 	}
 )
 
 func runCreateCmd(cmd *cobra.Command, args []string) {
-	bp := expandOrDie(args[0], deploymentFile)
+	bp, ctx := expandOrDie(args, deploymentFile)
 	deplDir := filepath.Join(outputDir, bp.DeploymentName())
 	checkErr(checkOverwriteAllowed(deplDir, bp, overwriteDeployment, forceOverwrite))
 	checkErr(modulewriter.WriteDeployment(bp, deplDir))
+	notify(notifications.DeploymentCreated, bp, "", nil)
+	reportWarnings(bp, ctx)
 
 	logging.Info("To deploy your infrastructure please run:")
 	logging.Info("")
@@ -108,52 +133,139 @@ func printAdvancedInstructionsMessage(deplDir string) {
 	logging.Info(modulewriter.InstructionsPath(deplDir))
 }
 
-func expandOrDie(path string, dPath string) config.Blueprint {
-	bp, ctx, err := config.NewBlueprint(path)
-	if err != nil {
-		logging.Fatal(renderError(err, ctx))
-	}
+func expandOrDie(paths []string, dPath string) (config.Blueprint, config.YamlCtx) {
+	bp, ctx := loadBlueprintsOrDie(paths)
+
+	// user defaults rank below deployment file and command line
+	mergeDeploymentSettings(&bp, userConfig.DeploymentSettings)
 
 	var ds config.DeploymentSettings
-	var dCtx config.YamlCtx
 	if dPath != "" {
+		var dCtx config.YamlCtx
+		var err error
 		ds, dCtx, err = config.NewDeploymentSettings(dPath)
 		if err != nil {
 			logging.Fatal(renderError(err, dCtx))
 		}
 	}
-	if err := setCLIVariables(&ds, cliVariables); err != nil {
+	// later flags take precedence: files, then --vars, then --var
+	var cli config.DeploymentSettings
+	if err := setCLIVarFiles(&cli, cliVarFiles); err != nil {
 		logging.Fatal("Failed to set the variables at CLI: %v", err)
 	}
+	for _, vs := range [][]string{cliVariables, cliVars} {
+		if err := setCLIVariables(&cli, vs); err != nil {
+			logging.Fatal("Failed to set the variables at CLI: %v", err)
+		}
+	}
+	for k, v := range cli.Vars.Items() {
+		ds.Vars.Set(k, v)
+		bp.MarkCommandLineVars(k)
+	}
 	if err := setBackendConfig(&ds, cliBEConfigVars); err != nil {
 		logging.Fatal("Failed to set the backend config at CLI: %v", err)
 	}
 
 	mergeDeploymentSettings(&bp, ds)
+	checkErr(promptSecretVars(&bp))
 
 	checkErr(setValidationLevel(&bp, validationLevel))
 	skipValidators(&bp)
-
-	if bp.GhpcVersion != "" {
-		logging.Info("ghpc_version setting is ignored.")
+	for _, e := range expansionsToSkip {
+		bp.SkipExpansion(e)
 	}
+
+	bp.WarnDeprecations()
 	bp.GhpcVersion = GitCommitInfo
 
 	// Expand the blueprint
 	if err := bp.Expand(); err != nil {
 		logging.Fatal(renderError(err, ctx))
 	}
+	if err := expandhooks.Apply(&bp, userConfig.ExpandHooks); err != nil {
+		logging.Fatal(renderError(err, ctx))
+	}
+	if err := healthchecks.Validate(bp); err != nil {
+		logging.Fatal(renderError(err, ctx))
+	}
+	if err := remote.Validate(bp); err != nil {
+		logging.Fatal(renderError(err, ctx))
+	}
 
 	validateMaybeDie(bp, ctx)
-	return bp
+	return bp, ctx
+}
+
+// loadBlueprintsOrDie reads the blueprints, several blueprints are stacked
+// into one deployment. Errors are rendered in context of the base blueprint,
+// the first one.
+func loadBlueprintsOrDie(args []string) (config.Blueprint, config.YamlCtx) {
+	locs, err := parseBlueprintLocations(args, requireDigest)
+	checkErr(err)
+	bps := []config.Blueprint{}
+	var baseCtx config.YamlCtx
+	for i, l := range locs {
+		bp, ctx, err := config.LoadBlueprint(context.Background(), l)
+		if err != nil {
+			logging.Fatal(renderError(err, ctx))
+		}
+		if i == 0 {
+			baseCtx = ctx
+		}
+		bps = append(bps, bp)
+	}
+	if len(bps) == 1 {
+		return bps[0], baseCtx
+	}
+	bp, err := config.StackBlueprints(bps)
+	if err != nil {
+		logging.Fatal(renderError(err, baseCtx))
+	}
+	return bp, config.StackedYamlCtx(baseCtx)
+}
+
+// parseBlueprintLocations parses blueprints given on the command line, standard
+// input can only be read once
+func parseBlueprintLocations(args []string, requireDigest bool) ([]config.BlueprintLocation, error) {
+	locs := []config.BlueprintLocation{}
+	stdin := false
+	for _, a := range args {
+		l, err := config.ParseBlueprintLocation(a)
+		if err != nil {
+			return nil, err
+		}
+		if l.Kind == config.Stdin {
+			if stdin {
+				return nil, errors.New("standard input can only be given as one blueprint")
+			}
+			stdin = true
+		}
+		if requireDigest && l.Remote() && l.SHA256 == "" {
+			return nil, fmt.Errorf("%s: %w", l, config.ErrNoDigest)
+		}
+		locs = append(locs, l)
+	}
+	return locs, nil
 }
 
 func validateMaybeDie(bp config.Blueprint, ctx config.YamlCtx) {
-	err := validators.Execute(bp)
-	if err == nil {
+	failed, warned := validators.Execute(context.Background(), bp)
+	if failed == nil && warned == nil {
 		return
 	}
-	logging.Error(renderError(err, ctx))
+	all := config.Errors{}
+	for _, err := range []error{warned, failed} {
+		if err == nil {
+			continue
+		}
+		logging.Error(renderError(err, ctx))
+		if errs, ok := err.(config.Errors); ok {
+			all.Errors = append(all.Errors, errs.Errors...)
+		} else {
+			all.Add(err)
+		}
+	}
+	notify(notifications.ValidationFailed, bp, "", all.OrNil())
 
 	logging.Error("One or more blueprint validators has failed. See messages above for suggested")
 	logging.Error("actions. General troubleshooting guidance and instructions for configuring")
@@ -167,18 +279,11 @@ func validateMaybeDie(bp config.Blueprint, ctx config.YamlCtx) {
 	logging.Error("- https://goo.gle/hpc-toolkit-validation-levels")
 	logging.Error("")
 
-	switch bp.ValidationLevel {
-	case config.ValidationWarning:
-		{
-			logging.Error(boldYellow("Validation failures were treated as a warning, continuing to create blueprint."))
-			logging.Error("")
-		}
-	case config.ValidationError:
-		{
-			logging.Fatal(boldRed("validation failed due to the issues listed above"))
-		}
+	if failed != nil {
+		logging.Fatal(boldRed("validation failed due to the issues listed above"))
 	}
-
+	logging.Error(boldYellow("Validation failures were treated as a warning, continuing to create blueprint."))
+	logging.Error("")
 }
 
 func setCLIVariables(ds *config.DeploymentSettings, s []string) error {
@@ -188,6 +293,15 @@ func setCLIVariables(ds *config.DeploymentSettings, s []string) error {
 		if len(arr) != 2 {
 			return fmt.Errorf("invalid format: '%s' should follow the 'name=value' format", cliVar)
 		}
+		// name:=value gives the value as JSON, of explicit type
+		if key, typed := strings.CutSuffix(arr[0], ":"); typed {
+			v, err := jsonVarValue([]byte(arr[1]))
+			if err != nil {
+				return fmt.Errorf("invalid input: '%s' value '%s' is not valid JSON: %w", key, arr[1], err)
+			}
+			ds.Vars.Set(key, v)
+			continue
+		}
 		// Convert the variable's string literal to its equivalent default type.
 		key := arr[0]
 		var v config.YamlValue
@@ -199,6 +313,42 @@ func setCLIVariables(ds *config.DeploymentSettings, s []string) error {
 	return nil
 }
 
+// setCLIVarFiles sets variables from JSON files holding an object of them
+func setCLIVarFiles(ds *config.DeploymentSettings, files []string) error {
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		v, err := jsonVarValue(data)
+		if err != nil {
+			return fmt.Errorf("invalid JSON in %s: %w", f, err)
+		}
+		if !v.Type().IsObjectType() {
+			return fmt.Errorf("%s must hold a JSON object of variables, got %s", f, v.Type().FriendlyName())
+		}
+		for k, iv := range v.AsValueMap() {
+			ds.Vars.Set(k, iv)
+		}
+	}
+	return nil
+}
+
+// jsonVarValue converts JSON to a value of the type it gives explicitly. Once
+// validated, JSON is decoded as the YAML it is a subset of, so that values are
+// the same as if given in the blueprint.
+func jsonVarValue(data []byte) (cty.Value, error) {
+	var i interface{}
+	if err := json.Unmarshal(data, &i); err != nil {
+		return cty.NilVal, err
+	}
+	var v config.YamlValue
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return cty.NilVal, err
+	}
+	return v.Unwrap(), nil
+}
+
 func setBackendConfig(ds *config.DeploymentSettings, s []string) error {
 	if len(s) == 0 {
 		return nil // no op
@@ -233,6 +383,28 @@ func mergeDeploymentSettings(bp *config.Blueprint, ds config.DeploymentSettings)
 	return nil
 }
 
+// promptSecretVars asks user to enter values of secret variables that are not set,
+// the input is not echoed to the terminal
+func promptSecretVars(bp *config.Blueprint) error {
+	for _, n := range bp.SecretVars() {
+		if bp.Vars.Has(n) && !bp.Vars.Get(n).IsNull() {
+			continue
+		}
+		fd := int(os.Stdin.Fd())
+		if !term.IsTerminal(fd) {
+			return fmt.Errorf("secret variable %q is not set, use --vars or deployment file to set it", n)
+		}
+		fmt.Fprintf(os.Stderr, "Enter value of secret variable %q: ", n)
+		s, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return fmt.Errorf("failed to read secret variable %q: %w", n, err)
+		}
+		bp.Vars.Set(n, cty.StringVal(string(s)))
+	}
+	return nil
+}
+
 // SetValidationLevel allows command-line tools to set the validation level
 func setValidationLevel(bp *config.Blueprint, s string) error {
 	switch s {
@@ -258,7 +430,12 @@ func filterYaml(cmd *cobra.Command, args []string, toComplete string) ([]string,
 	if len(args) != 0 {
 		return nil, cobra.ShellCompDirectiveNoFileComp
 	}
-	return []string{"yaml", "yml"}, cobra.ShellCompDirectiveFilterFileExt
+	return []string{"yaml", "yml", "hcl", "cue", "jsonnet"}, cobra.ShellCompDirectiveFilterFileExt
+}
+
+// filterYamls completes blueprint files, any number of them can be given
+func filterYamls(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return []string{"yaml", "yml", "hcl", "cue", "jsonnet"}, cobra.ShellCompDirectiveFilterFileExt
 }
 
 func forceErr(err error) error {
@@ -275,7 +452,13 @@ func checkOverwriteAllowed(depDir string, bp config.Blueprint, overwriteFlag boo
 
 	if _, err := os.Stat(modulewriter.HiddenGhpcDir(depDir)); os.IsNotExist(err) {
 		// hidden ghpc dir does not exist
-		return forceErr(fmt.Errorf("folder %q already exists, and it is not a valid GHPC deployment folder", depDir))
+		return config.HintError{
+			Err:  fmt.Errorf("folder %q already exists, and it is not a valid GHPC deployment folder", depDir),
+			Hint: "Use `ghpc adopt` to take over an existing deployment, or `--force` to overwrite it anyway. Proceed at your own risk."}
+	}
+
+	if err := modulewriter.CheckManifest(modulewriter.ArtifactsDir(depDir)); err != nil {
+		return forceErr(err)
 	}
 
 	// try to get previous deployment
@@ -288,26 +471,68 @@ func checkOverwriteAllowed(depDir string, bp config.Blueprint, overwriteFlag boo
 		return forceErr(err)
 	}
 
-	if prev.GhpcVersion != bp.GhpcVersion {
-		return forceErr(fmt.Errorf(
-			"ghpc_version has changed from %q to %q, using different versions of GHPC to update a live deployment is not officially supported",
-			prev.GhpcVersion, bp.GhpcVersion))
-	}
-
 	if !overwriteFlag {
 		return fmt.Errorf("deployment folder %q already exists, use -w to overwrite", depDir)
 	}
 
-	newGroups := map[config.GroupName]bool{}
+	if changes := destructiveChanges(prev, bp); len(changes) > 0 {
+		return forceErr(fmt.Errorf("deploying the new blueprint would destroy resources of the deployment:\n  %s",
+			strings.Join(changes, "\n  ")))
+	}
+	return nil
+}
+
+// destructiveChanges describes changes of deployment groups that destroy
+// resources once deployed: removed groups, terraform modules removed from the
+// deployment, as opposed to moved to another group or renamed, and moved group
+// directories and changed terraform backends, which leave the existing state
+// behind. Changes of settings are left to the plan of terraform.
+func destructiveChanges(prev config.Blueprint, bp config.Blueprint) []string {
+	kept := map[config.ModuleID]bool{}
 	for _, g := range bp.DeploymentGroups {
-		newGroups[g.Name] = true
+		for _, m := range g.Modules {
+			kept[m.ID] = true
+			if m.RenamedFrom != "" {
+				kept[m.RenamedFrom] = true
+			}
+		}
 	}
 
-	for _, g := range prev.DeploymentGroups {
-		if !newGroups[g.Name] {
-			return forceErr(fmt.Errorf("you are attempting to remove a deployment group %q, which is not supported", g.Name))
+	res := []string{}
+	for _, pg := range prev.DeploymentGroups {
+		g, err := bp.Group(pg.Name)
+		if err != nil {
+			res = append(res, fmt.Sprintf("you are attempting to remove a deployment group %q, which is not supported", pg.Name))
+			continue
+		}
+		if prev.GroupDirName(pg.Name) != bp.GroupDirName(pg.Name) {
+			res = append(res, fmt.Sprintf("you are attempting to move deployment group %q from directory %q to %q, which is not supported",
+				pg.Name, prev.GroupDirName(pg.Name), bp.GroupDirName(pg.Name)))
+		}
+		for _, m := range pg.Modules {
+			if m.Kind == config.TerraformKind && !kept[m.ID] {
+				res = append(res, fmt.Sprintf("deployment group %q: module %q is removed", pg.Name, m.ID))
+			}
+		}
+		if pg.Kind() == config.TerraformKind && g.Kind() == config.TerraformKind && !sameBackend(prev, pg.TerraformBackend, bp, g.TerraformBackend) {
+			res = append(res, fmt.Sprintf("deployment group %q: terraform backend has changed", pg.Name))
 		}
 	}
+	return res
+}
 
-	return nil
+// sameBackend compares backends by their evaluated configuration
+func sameBackend(prev config.Blueprint, pb config.TerraformBackend, bp config.Blueprint, b config.TerraformBackend) bool {
+	if pb.Type != b.Type {
+		return false
+	}
+	pc, err := pb.Configuration.Eval(prev)
+	if err != nil {
+		pc = pb.Configuration
+	}
+	c, err := b.Configuration.Eval(bp)
+	if err != nil {
+		c = b.Configuration
+	}
+	return pc.AsObject().RawEquals(c.AsObject())
 }
@@ -15,6 +15,7 @@
 package cmd
 
 import (
+	"errors"
 	"hpc-toolkit/pkg/config"
 	"hpc-toolkit/pkg/modulewriter"
 	"os"
@@ -82,6 +83,52 @@ func (s *MySuite) TestSetCLIVariables(c *C) {
 	c.Check(setCLIVariables(&ds, inv), ErrorMatches, ".*unable to convert.*pyrite.*gold.*")
 }
 
+func (s *MySuite) TestSetCLIVariablesTyped(c *C) {
+	ds := config.DeploymentSettings{}
+	vars := []string{
+		`exp:="1e5"`,
+		`zone:="us-central1-a"`,
+		`yes:="yes"`,
+		`count:=3`,
+		`zones:=["a", "b"]`,
+		`labels:={"team": "hpc", "n": 1}`,
+		`off:=false`,
+	}
+	c.Assert(setCLIVariables(&ds, vars), IsNil)
+	c.Check(ds.Vars.Items(), DeepEquals, map[string]cty.Value{
+		"exp":   cty.StringVal("1e5"),
+		"zone":  cty.StringVal("us-central1-a"),
+		"yes":   cty.StringVal("yes"),
+		"count": cty.NumberIntVal(3),
+		"zones": cty.TupleVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b")}),
+		"labels": cty.ObjectVal(map[string]cty.Value{
+			"team": cty.StringVal("hpc"),
+			"n":    cty.NumberIntVal(1)}),
+		"off": cty.False,
+	})
+
+	c.Check(setCLIVariables(&ds, []string{`bad:=[1,`}), ErrorMatches, ".*'bad'.*not valid JSON.*")
+}
+
+func (s *MySuite) TestSetCLIVarFiles(c *C) {
+	dir := c.MkDir()
+	good := filepath.Join(dir, "vars.json")
+	c.Assert(os.WriteFile(good, []byte(`{"project_id": "p", "exp": "1e5", "node_count": 4}`), 0644), IsNil)
+	notObject := filepath.Join(dir, "list.json")
+	c.Assert(os.WriteFile(notObject, []byte(`["p"]`), 0644), IsNil)
+
+	ds := config.DeploymentSettings{}
+	c.Assert(setCLIVarFiles(&ds, []string{good}), IsNil)
+	c.Check(ds.Vars.Items(), DeepEquals, map[string]cty.Value{
+		"project_id": cty.StringVal("p"),
+		"exp":        cty.StringVal("1e5"),
+		"node_count": cty.NumberIntVal(4),
+	})
+
+	c.Check(setCLIVarFiles(&ds, []string{notObject}), ErrorMatches, ".*must hold a JSON object.*")
+	c.Check(setCLIVarFiles(&ds, []string{filepath.Join(dir, "missing.json")}), NotNil)
+}
+
 func (s *MySuite) TestSetBackendConfig(c *C) {
 	// Success
 	vars := []string{
@@ -292,14 +339,21 @@ func (s *MySuite) TestIsOverwriteAllowed_Present(c *C) {
 		c.Check(checkOverwriteAllowed(p, bp, yesW, noForce), IsNil)
 	}
 
-	{ // Version mismatch
+	{ // Version mismatch, left to the manifest
 		bp := config.Blueprint{
 			GhpcVersion: "TheAlloyOfLaw",
 			DeploymentGroups: []config.DeploymentGroup{
 				{Name: "isildur"}}}
-		c.Check(checkOverwriteAllowed(p, bp, noW, noForce), ErrorMatches, ".*ghpc_version has changed.*")
-		c.Check(checkOverwriteAllowed(p, bp, yesW, noForce), ErrorMatches, ".*ghpc_version has changed.*")
-		c.Check(checkOverwriteAllowed(p, bp, noW, yesForce), IsNil)
+		c.Check(checkOverwriteAllowed(p, bp, noW, noForce), ErrorMatches, ".* already exists, use -w to overwrite")
+		c.Check(checkOverwriteAllowed(p, bp, yesW, noForce), IsNil)
+
+		manifest := filepath.Join(artDir, modulewriter.ManifestName)
+		if err := os.WriteFile(manifest, []byte("schema_version: 1\nfeatures: [teleportation]\n"), 0644); err != nil {
+			c.Fatal(err)
+		}
+		c.Check(checkOverwriteAllowed(p, bp, yesW, noForce), ErrorMatches, ".*not supported by this ghpc: teleportation.*")
+		c.Check(checkOverwriteAllowed(p, bp, yesW, yesForce), IsNil)
+		c.Assert(os.Remove(manifest), IsNil)
 	}
 
 	{ // Subset
@@ -308,7 +362,76 @@ func (s *MySuite) TestIsOverwriteAllowed_Present(c *C) {
 			DeploymentGroups: []config.DeploymentGroup{
 				{Name: "aragorn"}}}
 		c.Check(checkOverwriteAllowed(p, bp, noW, noForce), ErrorMatches, `.* already exists, use -w to overwrite`)
-		c.Check(checkOverwriteAllowed(p, bp, yesW, noForce), ErrorMatches, `.*remove a deployment group "isildur".*`)
+		c.Check(checkOverwriteAllowed(p, bp, yesW, noForce), ErrorMatches, `(?s).*remove a deployment group "isildur".*`)
 		c.Check(checkOverwriteAllowed(p, bp, noW, yesForce), IsNil)
 	}
 }
+
+func (s *MySuite) TestIsOverwriteAllowed_DestructiveChanges(c *C) {
+	p := c.MkDir()
+	artDir := modulewriter.ArtifactsDir(p)
+	if err := os.MkdirAll(artDir, 0755); err != nil {
+		c.Fatal(err)
+	}
+	gcs := func(bucket string) config.TerraformBackend {
+		return config.TerraformBackend{Type: "gcs", Configuration: config.NewDict(map[string]cty.Value{"bucket": cty.StringVal(bucket)})}
+	}
+	mod := func(id string, settings map[string]cty.Value) config.Module {
+		return config.Module{ID: config.ModuleID(id), Kind: config.TerraformKind, Source: "./" + id, Settings: config.NewDict(settings)}
+	}
+	blueprint := func(backend config.TerraformBackend, gondor []config.Module, arnor []config.Module) config.Blueprint {
+		return config.Blueprint{
+			GhpcVersion: "TaleOfBygoneYears",
+			DeploymentGroups: []config.DeploymentGroup{
+				{Name: "gondor", TerraformBackend: backend, Modules: gondor},
+				{Name: "arnor", TerraformBackend: backend, Modules: arnor}}}
+	}
+	minas, annuminas := mod("minas", nil), mod("annuminas", nil)
+	prev := blueprint(gcs("numenor"), []config.Module{minas}, []config.Module{annuminas})
+	if err := prev.Export(filepath.Join(artDir, "expanded_blueprint.yaml")); err != nil {
+		c.Fatal(err)
+	}
+	yesW, noForce, yesForce := true, false, true
+
+	{ // changed settings
+		bp := blueprint(gcs("numenor"), []config.Module{mod("minas", map[string]cty.Value{"tirith": cty.True})}, []config.Module{annuminas})
+		c.Check(checkOverwriteAllowed(p, bp, yesW, noForce), IsNil)
+	}
+	{ // moved and renamed modules
+		renamed := mod("fornost", nil)
+		renamed.RenamedFrom = "annuminas"
+		bp := blueprint(gcs("numenor"), []config.Module{}, []config.Module{minas, renamed})
+		c.Check(checkOverwriteAllowed(p, bp, yesW, noForce), IsNil)
+	}
+	{ // removed module
+		bp := blueprint(gcs("numenor"), []config.Module{minas}, []config.Module{})
+		c.Check(checkOverwriteAllowed(p, bp, yesW, noForce), ErrorMatches, `(?s).*deployment group "arnor": module "annuminas" is removed.*`)
+		c.Check(checkOverwriteAllowed(p, bp, yesW, yesForce), IsNil)
+	}
+	{ // changed backend
+		bp := blueprint(gcs("eriador"), []config.Module{minas}, []config.Module{annuminas})
+		err := checkOverwriteAllowed(p, bp, yesW, noForce)
+		c.Check(err, ErrorMatches, `(?s).*deployment group "gondor": terraform backend has changed.*deployment group "arnor": terraform backend has changed.*`)
+		c.Check(checkOverwriteAllowed(p, bp, yesW, yesForce), IsNil)
+	}
+}
+
+func (s *MySuite) TestParseBlueprintLocations(c *C) {
+	sum := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	locs, err := parseBlueprintLocations([]string{"base.yaml", "-", "gs://bucket/extra.yaml#sha256=" + sum}, false)
+	c.Assert(err, IsNil)
+	c.Check(locs, DeepEquals, []config.BlueprintLocation{
+		{Kind: config.LocalFile, Path: "base.yaml"},
+		{Kind: config.Stdin, Path: "-"},
+		{Kind: config.GCS, Path: "gs://bucket/extra.yaml", SHA256: sum},
+	})
+
+	_, err = parseBlueprintLocations([]string{"-", "-"}, false)
+	c.Check(err, ErrorMatches, ".*standard input can only be given as one blueprint.*")
+
+	_, err = parseBlueprintLocations([]string{"base.yaml", "https://example.com/bp.yaml#sha256=" + sum}, true)
+	c.Check(err, IsNil)
+	_, err = parseBlueprintLocations([]string{"https://example.com/bp.yaml"}, true)
+	c.Check(errors.Is(err, config.ErrNoDigest), Equals, true)
+}
@@ -16,14 +16,23 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/healthchecks"
 	"hpc-toolkit/pkg/logging"
 	"hpc-toolkit/pkg/modulewriter"
+	"hpc-toolkit/pkg/notifications"
+	"hpc-toolkit/pkg/remote"
 	"hpc-toolkit/pkg/shell"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/slices"
 )
 
 func init() {
@@ -34,15 +43,37 @@ func init() {
 
 	autoApproveFlag := "auto-approve"
 	deployCmd.Flags().BoolVarP(&autoApprove, autoApproveFlag, "", false, "Automatically approve proposed changes")
+	deployCmd.Flags().BoolVar(&skipHealthChecks, "skip-health-checks", false, "Do not run health checks defined in the blueprint after deployment")
+	deployCmd.Flags().BoolVar(&skipPostDeploy, "skip-post-deploy", false, "Do not run post_deploy commands of deployment groups")
+	deployCmd.Flags().BoolVar(&useSavedPlans, "use-saved-plans", false, "Apply plans saved by \"ghpc plan --save\" instead of planning again")
+	deployCmd.Flags().BoolVar(&refreshOnly, "refresh-only", false,
+		"Update terraform state to match the cloud infrastructure, without changing it, and report resources changed outside of terraform")
+	deployCmd.Flags().BoolVar(&retryFailed, "retry-failed", false,
+		"Resume a failed deployment from the deployment group that failed, applying the resources that failed first")
+	deployCmd.Flags().StringVar(&deployFrom, "from", "",
+		"Deploy groups starting from this deployment group, earlier groups must have been deployed")
+	deployCmd.Flags().StringVar(&deployUntil, "until", "", "Deploy groups up to and including this deployment group")
+	addSupportBundleFlag(deployCmd)
+	addRecordReplayFlags(deployCmd)
 
 	rootCmd.AddCommand(deployCmd)
 }
 
 var (
-	deploymentRoot string
-	autoApprove    bool
-	applyBehavior  shell.ApplyBehavior
-	deployCmd      = &cobra.Command{
+	deploymentRoot   string
+	autoApprove      bool
+	skipHealthChecks bool
+	skipPostDeploy   bool
+	useSavedPlans    bool
+	refreshOnly      bool
+	retryFailed      bool
+	deployFrom       string        // first group deployed, if set
+	deployUntil      string        // last group deployed, if set
+	drifted          []shell.Drift // resources changed outside of terraform, found by --refresh-only
+	applyBehavior    shell.ApplyBehavior
+	savedPlans       *shell.SavedPlans // applied instead of new plans, if set
+	retried          *shell.Checkpoint // failed deployment resumed by --retry-failed, if set
+	deployCmd        = &cobra.Command{
 		Use:               "deploy DEPLOYMENT_DIRECTORY",
 		Short:             "deploy all resources in a Toolkit deployment directory.",
 		Long:              "deploy all resources in a Toolkit deployment directory.",
@@ -57,13 +88,26 @@ var (
 func parseDeployArgs(cmd *cobra.Command, args []string) error {
 	applyBehavior = getApplyBehavior(autoApprove)
 
+	if refreshOnly && useSavedPlans {
+		return errors.New("--refresh-only and --use-saved-plans can not be used together")
+	}
+	if retryFailed && (refreshOnly || useSavedPlans) {
+		return errors.New("--retry-failed can not be used with --refresh-only or --use-saved-plans")
+	}
+	if retryFailed && (deployFrom != "" || deployUntil != "") {
+		return errors.New("--retry-failed can not be used with --from or --until")
+	}
+
 	deploymentRoot = args[0]
 	artifactsDir = getArtifactsDir(deploymentRoot)
 	if err := shell.CheckWritableDir(artifactsDir); err != nil {
 		return err
 	}
 
-	return nil
+	if err := startSupportBundle(); err != nil {
+		return err
+	}
+	return startRecordOrReplay()
 }
 
 func getApplyBehavior(autoApprove bool) shell.ApplyBehavior {
@@ -74,54 +118,404 @@ func getApplyBehavior(autoApprove bool) shell.ApplyBehavior {
 }
 
 func runDeployCmd(cmd *cobra.Command, args []string) {
+	ctx := interruptContext()
+	checkErr(modulewriter.CheckManifest(artifactsDir))
 	expandedBlueprintFile := filepath.Join(artifactsDir, modulewriter.ExpandedBlueprintName)
 	bp, _, err := config.NewBlueprint(expandedBlueprintFile)
 	checkErr(err)
-	groups := bp.DeploymentGroups
-	checkErr(validateRuntimeDependencies(groups))
-	checkErr(shell.ValidateDeploymentDirectory(groups, deploymentRoot))
+	checkErr(validateRuntimeDependencies(bp))
+	checkErr(shell.ValidateDeploymentDirectory(bp, deploymentRoot))
 
-	for _, group := range groups {
-		groupDir := filepath.Join(deploymentRoot, string(group.Name))
-		checkErr(shell.ImportInputs(groupDir, artifactsDir, expandedBlueprintFile))
+	hash, err := shell.BlueprintHash(expandedBlueprintFile)
+	checkErr(err)
+	resumed := loadDeployState(bp, hash)
+	d := &deployment{
+		ctx: ctx, cmd: cmd, bp: bp, blueprintFile: expandedBlueprintFile, report: newRunReport(),
+		progress: shell.Checkpoint{BlueprintHash: hash, Completed: []config.GroupName{}},
+	}
 
-		switch group.Kind() {
-		case config.PackerKind:
-			// Packer groups are enforced to have length 1
-			subPath, e := modulewriter.DeploymentSource(group.Modules[0])
-			checkErr(e)
-			moduleDir := filepath.Join(groupDir, subPath)
-			checkErr(deployPackerGroup(moduleDir))
-		case config.TerraformKind:
-			checkErr(deployTerraformGroup(groupDir))
-		default:
-			checkErr(fmt.Errorf("group %s is an unsupported kind %s", groupDir, group.Kind().String()))
+	order := bp.DeployOrder()
+	first, last, err := deployRange(bp, order)
+	checkErr(err)
+	for i, group := range order {
+		if why := skipReason(i, group.Name, first, last, resumed); why != "" {
+			logging.Info("Skipping deployment group %s, %s", group.Name, why)
+			d.report.group(group.Name, notifications.GroupStatusSkipped, time.Time{})
+			if i > last {
+				continue
+			}
+		} else {
+			d.deploy(group)
 		}
+		d.progress.Completed = append(d.progress.Completed, group.Name)
+	}
+	checkErr(shell.RemoveCheckpoint(artifactsDir))
+	complete := last == len(order)-1 // health checks need all groups deployed
+	if useSavedPlans && first == 0 && complete {
+		checkErr(shell.RemoveSavedPlans(artifactsDir))
+	}
+	if refreshOnly {
+		reportDrift(drifted)
+	}
+
+	if !skipHealthChecks && complete {
+		d.fail(runHealthChecks(ctx, bp))
+	}
+	if !refreshOnly {
+		d.report.notify(notifications.DeployCompleted, bp, nil)
 	}
 	logging.Info("\n###############################")
 	printAdvancedInstructionsMessage(deploymentRoot)
 }
 
-func validateRuntimeDependencies(groups []config.DeploymentGroup) error {
-	for _, group := range groups {
-		var err error
-		switch group.Kind() {
+// loadDeployState loads saved plans applied by --use-saved-plans and the
+// failed deployment resumed by --retry-failed, it returns groups completed
+// before the deployment was stopped
+func loadDeployState(bp config.Blueprint, hash string) []config.GroupName {
+	if useSavedPlans {
+		sp, err := loadSavedPlans(bp, hash)
+		checkErr(err)
+		savedPlans = &sp
+	}
+	if retryFailed {
+		cp, err := failedDeployment(hash)
+		checkErr(err)
+		retried = &cp
+		return cp.Completed
+	}
+	return resumableGroups(hash)
+}
+
+// skipReason tells why the group at index i of the deploy order is not
+// deployed, it returns an empty string if it is
+func skipReason(i int, group config.GroupName, first int, last int, resumed []config.GroupName) string {
+	switch {
+	case i > last:
+		return fmt.Sprintf("it is deployed after %s given to --until", deployUntil)
+	case i < first:
+		return fmt.Sprintf("it is deployed before %s given to --from", deployFrom)
+	case slices.Contains(resumed, group):
+		return "it was deployed before the deployment was stopped"
+	}
+	return ""
+}
+
+// deployment is a run of the deploy command
+type deployment struct {
+	ctx           context.Context
+	cmd           *cobra.Command
+	bp            config.Blueprint
+	blueprintFile string
+	report        *runReport
+	progress      shell.Checkpoint
+}
+
+// fail notifies of the failure before exiting
+func (d *deployment) fail(err error) {
+	if err != nil {
+		d.report.notify(notifications.DeployFailed, d.bp, err)
+		reportFailure(d.ctx, d.cmd, d.bp, err)
+		checkErr(err)
+	}
+}
+
+// deploy deploys the group and runs its post-deploy commands, it exits on
+// failure once progress of the deployment is saved
+func (d *deployment) deploy(group config.DeploymentGroup) {
+	start := time.Now()
+	if err := deployGroup(d.ctx, d.bp, group, d.blueprintFile); err != nil {
+		d.report.group(group.Name, notifications.GroupStatusFailed, start)
+		d.saveProgress(group.Name, err)
+		d.fail(err)
+	} else if !refreshOnly {
+		d.report.group(group.Name, notifications.GroupStatusApplied, start)
+		notify(notifications.GroupApplied, d.bp, group.Name, nil)
+		if !skipPostDeploy {
+			d.fail(runPostDeploy(d.ctx, d.bp, group))
+		}
+	}
+}
+
+// saveProgress saves progress of the deployment if the group was interrupted
+// or resources failed to apply, so it can be resumed
+func (d *deployment) saveProgress(group config.GroupName, err error) {
+	var applyErr *shell.ApplyError
+	if d.ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) {
+		d.progress.Interrupted = group
+		checkErr(shell.WriteCheckpoint(artifactsDir, d.progress))
+		logging.Error("Progress of the deployment was saved, run %s to resume it from deployment group %s",
+			boldGreen(fmt.Sprintf("%s deploy %s", execPath(), deploymentRoot)), group)
+	} else if errors.As(err, &applyErr) {
+		d.progress.Interrupted, d.progress.FailedResources = group, applyErr.Resources
+		checkErr(shell.WriteCheckpoint(artifactsDir, d.progress))
+		logging.Error("%d resources of deployment group %s failed to apply, once the cause is fixed run %s to retry them",
+			len(applyErr.Resources), group, boldGreen(fmt.Sprintf("%s deploy --retry-failed %s", execPath(), deploymentRoot)))
+	}
+}
+
+// deployRange returns indices in the deploy order of the groups given to
+// --from and --until, or of the first and last groups. Groups before the first
+// one are not deployed, so those whose outputs later groups use must have
+// exported them already.
+func deployRange(bp config.Blueprint, order []config.DeploymentGroup) (int, int, error) {
+	index := func(flag string, name string, def int) (int, error) {
+		if name == "" {
+			return def, nil
+		}
+		if _, err := bp.Group(config.GroupName(name)); err != nil {
+			return 0, fmt.Errorf("--%s: %w", flag, err)
+		}
+		return slices.IndexFunc(order, func(g config.DeploymentGroup) bool { return string(g.Name) == name }), nil
+	}
+	first, err := index("from", deployFrom, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	last, err := index("until", deployUntil, len(order)-1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if first > last {
+		return 0, 0, fmt.Errorf("deployment group %s given to --from is deployed after %s given to --until", deployFrom, deployUntil)
+	}
+
+	for _, g := range order[first : last+1] {
+		used, err := config.OutputNamesByGroup(g, bp)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, pg := range order[:first] {
+			if len(used[pg.Name]) > 0 && !shell.HasOutputs(bp, artifactsDir, pg.Name) {
+				return 0, 0, fmt.Errorf("deployment group %s uses outputs of deployment group %s, which is not deployed with --from %s "+
+					"and has no outputs in %s; deploy it first, or run \"ghpc export-outputs %s\"",
+					g.Name, pg.Name, deployFrom, artifactsDir, modulewriter.GroupDir(deploymentRoot, bp, pg.Name))
+			}
+		}
+	}
+	return first, last, nil
+}
+
+// resumableGroups returns deployment groups completed before the previous
+// deployment was interrupted, if the blueprint has not changed since
+func resumableGroups(blueprintHash string) []config.GroupName {
+	c, found, err := shell.ReadCheckpoint(artifactsDir)
+	if err != nil || !found || len(c.FailedResources) > 0 {
+		return nil // failed deployments are only resumed with --retry-failed
+	}
+	if c.BlueprintHash != blueprintHash {
+		logging.Info("Blueprint has changed since the deployment was interrupted, deploying all groups")
+		return nil
+	}
+	logging.Info("Resuming interrupted deployment from deployment group %s", c.Interrupted)
+	return c.Completed
+}
+
+// failedDeployment returns the checkpoint of the failed deployment retried by
+// --retry-failed, it fails unless the blueprint has not changed since
+func failedDeployment(blueprintHash string) (shell.Checkpoint, error) {
+	c, found, err := shell.ReadCheckpoint(artifactsDir)
+	if err != nil {
+		return shell.Checkpoint{}, err
+	}
+	if !found || len(c.FailedResources) == 0 {
+		return shell.Checkpoint{}, fmt.Errorf("no failed deployment to retry in %s", artifactsDir)
+	}
+	if c.BlueprintHash != blueprintHash {
+		return shell.Checkpoint{}, errors.New("blueprint has changed since the deployment failed; run \"ghpc deploy\" without --retry-failed")
+	}
+	logging.Info("Retrying failed deployment from deployment group %s", c.Interrupted)
+	return c, nil
+}
+
+// retriedResources returns resources of the group that failed to apply in
+// the deployment retried by --retry-failed
+func retriedResources(group config.GroupName) []string {
+	if retried == nil || retried.Interrupted != group {
+		return nil
+	}
+	return retried.FailedResources
+}
+
+// loadSavedPlans returns plans saved by `ghpc plan --save`, it fails unless
+// they were made for the current blueprint and cover all terraform groups
+func loadSavedPlans(bp config.Blueprint, blueprintHash string) (shell.SavedPlans, error) {
+	sp, found, err := shell.ReadSavedPlans(artifactsDir)
+	if err != nil {
+		return shell.SavedPlans{}, err
+	}
+	if !found {
+		return shell.SavedPlans{}, fmt.Errorf("no saved plans found in %s; run \"ghpc plan --save %s\" first", artifactsDir, deploymentRoot)
+	}
+	if sp.BlueprintHash != blueprintHash {
+		return shell.SavedPlans{}, errors.New("blueprint has changed since the plans were saved; run \"ghpc plan --save\" again")
+	}
+	for _, g := range bp.DeploymentGroups {
+		if _, ok := sp.Plan(g.Name); g.Kind() == config.TerraformKind && !ok {
+			return shell.SavedPlans{}, fmt.Errorf("no saved plan for deployment group %s; run \"ghpc plan --save\" again", g.Name)
+		}
+	}
+	return sp, nil
+}
+
+// groupContext returns context limited by the timeout of the deployment group
+func groupContext(ctx context.Context, group config.DeploymentGroup) (context.Context, context.CancelFunc, error) {
+	timeout, err := group.TimeoutDuration()
+	if err != nil {
+		return nil, nil, err
+	}
+	if timeout == 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, cancel, nil
+}
+
+// timeoutErr replaces err caused by expiration of the group timeout with a
+// more helpful one
+func timeoutErr(ctx context.Context, group config.DeploymentGroup, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("deployment group %s did not complete within timeout of %s: %w", group.Name, group.Timeout, context.DeadlineExceeded)
+	}
+	return err
+}
+
+func deployGroup(ctx context.Context, bp config.Blueprint, group config.DeploymentGroup, expandedBlueprintFile string) error {
+	ctx, cancel, err := groupContext(ctx, group)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	if err := setCredentials(ctx, bp); err != nil {
+		return err
+	}
+
+	groupDir := modulewriter.GroupDir(deploymentRoot, bp, group.Name)
+	// stages import their inputs once earlier stages of the group, whose
+	// outputs they may use, are deployed
+	stages := group.Stages()
+	lastTf := -1
+	for i, s := range stages {
+		if s.Kind() == config.TerraformKind {
+			lastTf = i
+		}
+	}
+	for i, stage := range stages {
+		removeInputs, e := shell.ImportStageInputs(ctx, groupDir, artifactsDir, expandedBlueprintFile, i)
+		if e != nil {
+			return e
+		}
+		defer removeInputs()
+
+		switch stage.Kind() {
 		case config.PackerKind:
-			err = shell.ConfigurePacker()
+			if refreshOnly {
+				logging.Info("Skipping Packer module %s of deployment group %s, it has no terraform state to refresh", stage.Modules[0].ID, group.Name)
+				continue
+			}
+			if len(retriedResources(group.Name)) > 0 {
+				logging.Info("Skipping Packer module %s of deployment group %s, it was built before terraform failed", stage.Modules[0].ID, group.Name)
+				continue
+			}
+			// Packer stages are made of a single module
+			subPath, e := modulewriter.DeploymentSource(stage.Modules[0])
+			if e != nil {
+				return e
+			}
+			err = deployPackerGroup(ctx, bp, group.Name, stage.Modules[0], filepath.Join(groupDir, subPath))
 		case config.TerraformKind:
-			groupDir := filepath.Join(deploymentRoot, string(group.Name))
-			_, err = shell.ConfigureTerraform(groupDir)
+			if i == lastTf {
+				err = deployTerraformGroup(ctx, bp, groupDir, group.Name)
+			} else {
+				err = deployTerraformStage(ctx, bp, groupDir, stage)
+			}
 		default:
-			err = fmt.Errorf("group %s is an unsupported kind %q", group.Name, group.Kind().String())
+			err = fmt.Errorf("group %s is an unsupported kind %s", groupDir, stage.Kind().String())
 		}
 		if err != nil {
-			return err
+			break
+		}
+	}
+	return timeoutErr(ctx, group, err)
+}
+
+// runPostDeploy runs post_deploy commands of the deployed group, in order, on
+// VMs given by outputs of deployed modules
+func runPostDeploy(ctx context.Context, bp config.Blueprint, group config.DeploymentGroup) error {
+	if len(group.PostDeploy) == 0 {
+		return nil
+	}
+	outputs, err := shell.DeployedOutputs(ctx, bp, artifactsDir)
+	if err != nil {
+		return err
+	}
+	for _, rc := range group.PostDeploy {
+		name := rc.Name
+		if name == "" {
+			name = rc.Command
+		}
+		t, err := remote.EvalTarget(bp, rc.Target, outputs)
+		if err != nil {
+			return fmt.Errorf("post_deploy %q of deployment group %s: %w", name, group.Name, err)
+		}
+		logging.Info("Running post_deploy %q of deployment group %s on %s", name, group.Name, t)
+		out, err := t.Run(ctx, rc.Command)
+		if out != "" {
+			logging.Info("%s", strings.TrimRight(out, "\n"))
+		}
+		if err != nil {
+			return fmt.Errorf("post_deploy %q of deployment group %s failed: %w", name, group.Name, err)
 		}
 	}
 	return nil
 }
 
-func deployPackerGroup(moduleDir string) error {
+func runHealthChecks(ctx context.Context, bp config.Blueprint) error {
+	if len(bp.HealthChecks) == 0 {
+		return nil
+	}
+	outputs, err := shell.DeployedOutputs(ctx, bp, artifactsDir)
+	if err != nil {
+		return err
+	}
+	logging.Info("running health checks")
+	failed := 0
+	for _, o := range healthchecks.Execute(ctx, bp, outputs) {
+		if o.Passed() {
+			logging.Info("%s %s", boldGreen("PASS"), o.Name)
+		} else {
+			logging.Error("%s %s: %v", boldRed("FAIL"), o.Name, o.Err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d health checks failed", failed, len(bp.HealthChecks))
+	}
+	return nil
+}
+
+func validateRuntimeDependencies(bp config.Blueprint) error {
+	for _, group := range bp.DeploymentGroups {
+		for _, stage := range group.Stages() {
+			var err error
+			switch stage.Kind() {
+			case config.PackerKind:
+				err = shell.ConfigurePacker()
+			case config.TerraformKind:
+				groupDir := modulewriter.GroupDir(deploymentRoot, bp, group.Name)
+				_, err = shell.ConfigureTerraform(groupDir)
+			default:
+				err = fmt.Errorf("group %s is an unsupported kind %q", group.Name, stage.Kind().String())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func deployPackerGroup(ctx context.Context, bp config.Blueprint, group config.GroupName, mod config.Module, moduleDir string) error {
 	if err := shell.ConfigurePacker(); err != nil {
 		return err
 	}
@@ -131,26 +525,150 @@ func deployPackerGroup(moduleDir string) error {
 	}
 	buildImage := applyBehavior == shell.AutomaticApply || shell.ApplyChangesChoice(c)
 	if buildImage {
-		logging.Info("initializing packer module at %s", moduleDir)
-		if err := shell.ExecPackerCmd(moduleDir, false, "init", "."); err != nil {
+		if err := installPackerPlugins(ctx, moduleDir); err != nil {
 			return err
 		}
 		logging.Info("validating packer module at %s", moduleDir)
-		if err := shell.ExecPackerCmd(moduleDir, false, "validate", "."); err != nil {
+		if err := shell.ExecPackerCmd(ctx, moduleDir, false, "validate", "."); err != nil {
 			return err
 		}
 		logging.Info("building image using packer module at %s", moduleDir)
-		if err := shell.ExecPackerCmd(moduleDir, true, "build", "."); err != nil {
+		logPath := shell.PackerLogPath(artifactsDir, group, mod.ID, time.Now())
+		summary, err := shell.PackerBuild(ctx, moduleDir, logPath)
+		printPackerSummary(bp, mod, summary, logPath)
+		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func deployTerraformGroup(groupDir string) error {
+// printPackerSummary reports what the build of the packer module created, so
+// that the image is not lost in the output of packer
+func printPackerSummary(bp config.Blueprint, mod config.Module, s shell.PackerBuildSummary, logPath string) {
+	logging.Info("\nSummary of packer build of module %s:", mod.ID)
+	for _, im := range s.Images {
+		logging.Info("  image: %s", boldGreen(im.Name))
+		if im.Project != "" {
+			logging.Info("  project: %s", im.Project)
+		}
+	}
+	if mod.Settings.Has("image_family") {
+		if v, err := bp.Eval(mod.Settings.Get("image_family")); err == nil && v.Type() == cty.String && v.IsKnown() && !v.IsNull() {
+			logging.Info("  family: %s", v.AsString())
+		}
+	}
+	for _, a := range s.Artifacts {
+		logging.Info("  artifact: %s", a)
+	}
+	for _, e := range s.Errors {
+		logging.Error("  error: %s", e)
+	}
+	logging.Info("  log: %s\n", logPath)
+}
+
+// installPackerPlugins runs packer init when plugins required by the module are
+// not installed, asking first unless changes are applied automatically
+func installPackerPlugins(ctx context.Context, moduleDir string) error {
+	missing, err := shell.CheckPackerRequirements(ctx, moduleDir)
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+	names := []string{}
+	for _, p := range missing {
+		names = append(names, p.String())
+	}
+	c := shell.ProposedChanges{
+		Summary: fmt.Sprintf("Proposed change: run packer init to install %d missing plugins of %s", len(missing), moduleDir),
+		Full:    fmt.Sprintf("Proposed change: run packer init in %s to install plugins:\n  %s", moduleDir, strings.Join(names, "\n  ")),
+	}
+	if applyBehavior != shell.AutomaticApply && !shell.ApplyChangesChoice(c) {
+		return shell.MissingPackerPluginsError(moduleDir, missing)
+	}
+	logging.Info("initializing packer module at %s", moduleDir)
+	if err := shell.ExecPackerCmd(ctx, moduleDir, false, "init", "."); err != nil {
+		return err
+	}
+	if missing, err = shell.CheckPackerRequirements(ctx, moduleDir); err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return shell.MissingPackerPluginsError(moduleDir, missing)
+	}
+	return nil
+}
+
+func deployTerraformGroup(ctx context.Context, bp config.Blueprint, groupDir string, group config.GroupName) error {
 	tf, err := shell.ConfigureTerraform(groupDir)
 	if err != nil {
 		return err
 	}
-	return shell.ExportOutputs(tf, artifactsDir, applyBehavior)
+	seal, err := shell.OpenLocalState(ctx, tf)
+	if err != nil {
+		return err
+	}
+	defer seal()
+	if err := shell.BackupState(ctx, tf, group, artifactsDir); err != nil {
+		return err
+	}
+	if refreshOnly {
+		d, err := shell.RefreshOnly(ctx, tf, group, artifactsDir, bp.ArtifactsEncryption, applyBehavior)
+		drifted = append(drifted, d...)
+		return err
+	}
+	if failed := retriedResources(group); len(failed) > 0 {
+		logging.Info("Retrying %d resources of deployment group %s that failed to apply", len(failed), group)
+		if err := shell.ApplyTargets(ctx, tf, applyBehavior, failed); err != nil {
+			return err
+		}
+		logging.Info("Applying remaining changes of deployment group %s", group)
+	}
+	if savedPlans != nil {
+		p, _ := savedPlans.Plan(group) // presence is checked by loadSavedPlans
+		logging.Info("Applying saved plan of deployment group %s", group)
+		return shell.ApplySavedPlan(ctx, tf, p, artifactsDir, bp.ArtifactsEncryption)
+	}
+	return shell.ExportOutputs(ctx, tf, group, artifactsDir, bp.ArtifactsEncryption, applyBehavior)
+}
+
+// deployTerraformStage applies terraform modules of a stage of the group
+// followed by other stages, e.g. Packer modules using their outputs. The whole
+// group is applied by its last terraform stage; refreshing the group, applying
+// its saved plan or retrying its failed resources is left to it.
+func deployTerraformStage(ctx context.Context, bp config.Blueprint, groupDir string, stage config.DeploymentGroup) error {
+	if refreshOnly || savedPlans != nil || len(retriedResources(stage.Name)) > 0 {
+		return nil
+	}
+	tf, err := shell.ConfigureTerraform(groupDir)
+	if err != nil {
+		return err
+	}
+	seal, err := shell.OpenLocalState(ctx, tf)
+	if err != nil {
+		return err
+	}
+	defer seal()
+	if err := shell.BackupState(ctx, tf, stage.Name, artifactsDir); err != nil {
+		return err
+	}
+	ids := make([]config.ModuleID, len(stage.Modules))
+	for i, m := range stage.Modules {
+		ids[i] = m.ID
+	}
+	logging.Info("Applying modules %v of deployment group %s, used by its later stages", ids, stage.Name)
+	return shell.ExportStageOutputs(ctx, tf, stage.Name, ids, artifactsDir, bp.ArtifactsEncryption, applyBehavior)
+}
+
+// reportDrift summarizes resources found changed outside of terraform by a
+// refresh-only deployment
+func reportDrift(drift []shell.Drift) {
+	logging.Info("\n###############################")
+	if len(drift) == 0 {
+		logging.Info("No resources changed outside of terraform")
+		return
+	}
+	logging.Info(boldYellow("%d resources changed outside of terraform:"), len(drift))
+	for _, d := range drift {
+		logging.Info("%s", d)
+	}
 }
@@ -17,9 +17,16 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"errors"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/modulereader"
+	"hpc-toolkit/pkg/modulewriter"
 	"hpc-toolkit/pkg/shell"
 	"os"
+	"path/filepath"
 
+	"github.com/zclconf/go-cty/cty"
 	. "gopkg.in/check.v1"
 )
 
@@ -28,9 +35,163 @@ func (s *MySuite) TestDeployGroups(c *C) {
 	var err error
 	pathEnv := os.Getenv("PATH")
 	os.Setenv("PATH", "")
-	err = deployTerraformGroup(".")
+	err = deployTerraformGroup(context.Background(), config.Blueprint{}, ".", "zero")
 	c.Assert(err, NotNil)
-	err = deployPackerGroup(".")
+	err = deployPackerGroup(context.Background(), config.Blueprint{}, "zero", config.Module{ID: "image"}, ".")
 	c.Assert(err, NotNil)
 	os.Setenv("PATH", pathEnv)
 }
+
+func (s *MySuite) TestGroupContext(c *C) {
+	{ // No timeout
+		ctx, cancel, err := groupContext(context.Background(), config.DeploymentGroup{Name: "zero"})
+		c.Assert(err, IsNil)
+		_, hasDeadline := ctx.Deadline()
+		c.Check(hasDeadline, Equals, false)
+		cancel()
+	}
+
+	{ // Timeout expires
+		g := config.DeploymentGroup{Name: "zero", Timeout: "1ms"}
+		ctx, cancel, err := groupContext(context.Background(), g)
+		c.Assert(err, IsNil)
+		defer cancel()
+		<-ctx.Done()
+		err = timeoutErr(ctx, g, errors.New("signal: interrupt"))
+		c.Check(err, ErrorMatches, "deployment group zero did not complete within timeout of 1ms.*")
+		c.Check(errors.Is(err, context.DeadlineExceeded), Equals, true)
+		c.Check(timeoutErr(ctx, g, nil), IsNil)
+	}
+}
+
+func (s *MySuite) TestResumableGroups(c *C) {
+	artifactsDir = c.MkDir()
+	defer func() { artifactsDir = "" }()
+
+	c.Check(resumableGroups("abc"), IsNil)
+
+	cp := shell.Checkpoint{BlueprintHash: "abc", Completed: []config.GroupName{"zero"}, Interrupted: "one"}
+	c.Assert(shell.WriteCheckpoint(artifactsDir, cp), IsNil)
+	c.Check(resumableGroups("abc"), DeepEquals, []config.GroupName{"zero"})
+	c.Check(resumableGroups("def"), IsNil) // blueprint has changed
+
+	c.Assert(shell.RemoveCheckpoint(artifactsDir), IsNil)
+	c.Check(resumableGroups("abc"), IsNil)
+}
+
+func (s *MySuite) TestFailedDeployment(c *C) {
+	artifactsDir = c.MkDir()
+	defer func() { artifactsDir, retried = "", nil }()
+
+	_, err := failedDeployment("abc")
+	c.Check(err, ErrorMatches, "no failed deployment to retry.*")
+
+	cp := shell.Checkpoint{
+		BlueprintHash:   "abc",
+		Completed:       []config.GroupName{"zero"},
+		Interrupted:     "one",
+		FailedResources: []string{"module.vm.google_compute_instance.i[0]"}}
+	c.Assert(shell.WriteCheckpoint(artifactsDir, cp), IsNil)
+	c.Check(resumableGroups("abc"), IsNil) // only resumed with --retry-failed
+
+	got, err := failedDeployment("abc")
+	c.Assert(err, IsNil)
+	c.Check(got, DeepEquals, cp)
+	_, err = failedDeployment("def")
+	c.Check(err, ErrorMatches, "blueprint has changed since the deployment failed.*")
+
+	c.Check(retriedResources("one"), IsNil)
+	retried = &got
+	c.Check(retriedResources("one"), DeepEquals, cp.FailedResources)
+	c.Check(retriedResources("zero"), IsNil)
+}
+
+func (s *MySuite) TestLoadSavedPlans(c *C) {
+	artifactsDir, deploymentRoot = c.MkDir(), "golf"
+	defer func() { artifactsDir, deploymentRoot = "", "" }()
+
+	bp := config.Blueprint{DeploymentGroups: []config.DeploymentGroup{
+		{Name: "zero", Modules: []config.Module{{Kind: config.TerraformKind}}},
+		{Name: "one", Modules: []config.Module{{Kind: config.PackerKind}}},
+	}}
+
+	_, err := loadSavedPlans(bp, "abc")
+	c.Check(err, ErrorMatches, "no saved plans found.*")
+
+	sp := shell.SavedPlans{BlueprintHash: "abc", Plans: []shell.SavedPlan{}}
+	c.Assert(shell.WriteSavedPlans(artifactsDir, sp), IsNil)
+	_, err = loadSavedPlans(bp, "abc")
+	c.Check(err, ErrorMatches, "no saved plan for deployment group zero.*")
+
+	sp.Plans = append(sp.Plans, shell.SavedPlan{Group: "zero", File: "zero.tfplan"})
+	c.Assert(shell.WriteSavedPlans(artifactsDir, sp), IsNil)
+	got, err := loadSavedPlans(bp, "abc")
+	c.Check(err, IsNil)
+	c.Check(got, DeepEquals, sp)
+
+	_, err = loadSavedPlans(bp, "def")
+	c.Check(err, ErrorMatches, "blueprint has changed since the plans were saved.*")
+}
+
+func (s *MySuite) TestParseDeployArgsRefreshOnly(c *C) {
+	defer func() { refreshOnly, useSavedPlans, artifactsDir = false, false, "" }()
+	refreshOnly, useSavedPlans = true, true
+	c.Check(parseDeployArgs(deployCmd, []string{c.MkDir()}), ErrorMatches, ".*can not be used together")
+
+	dir := c.MkDir()
+	c.Assert(os.MkdirAll(modulewriter.ArtifactsDir(dir), 0755), IsNil)
+	useSavedPlans = false
+	c.Check(parseDeployArgs(deployCmd, []string{dir}), IsNil)
+}
+
+func (s *MySuite) TestDeployRange(c *C) {
+	artifactsDir, deploymentRoot = c.MkDir(), "golf"
+	defer func() { artifactsDir, deploymentRoot, deployFrom, deployUntil = "", "", "", "" }()
+
+	net := config.Module{ID: "net", Kind: config.TerraformKind, Outputs: []modulereader.OutputInfo{{Name: "id"}}}
+	vm := config.Module{ID: "vm", Kind: config.TerraformKind, Settings: config.NewDict(map[string]cty.Value{
+		"network": config.ModuleRef("net", "id").AsValue()})}
+	bp := config.Blueprint{DeploymentGroups: []config.DeploymentGroup{
+		{Name: "zero", Modules: []config.Module{net}},
+		{Name: "one", Modules: []config.Module{{ID: "fs", Kind: config.TerraformKind}}},
+		{Name: "two", Modules: []config.Module{vm}},
+	}}
+	order := bp.DeployOrder()
+
+	check := func(from string, until string) (int, int, error) {
+		deployFrom, deployUntil = from, until
+		return deployRange(bp, order)
+	}
+
+	first, last, err := check("", "")
+	c.Assert(err, IsNil)
+	c.Check([]int{first, last}, DeepEquals, []int{0, 2})
+
+	first, last, err = check("", "one")
+	c.Assert(err, IsNil)
+	c.Check([]int{first, last}, DeepEquals, []int{0, 1})
+
+	first, last, err = check("one", "one") // group one uses no outputs of group zero
+	c.Assert(err, IsNil)
+	c.Check([]int{first, last}, DeepEquals, []int{1, 1})
+
+	_, _, err = check("two", "")
+	c.Check(err, ErrorMatches, `deployment group two uses outputs of deployment group zero, which is not deployed with --from two.*`)
+
+	c.Assert(os.WriteFile(filepath.Join(artifactsDir, "zero_outputs.tfvars"), []byte("net_id = \"n\"\n"), 0644), IsNil)
+	first, last, err = check("two", "")
+	c.Assert(err, IsNil)
+	c.Check([]int{first, last}, DeepEquals, []int{2, 2})
+
+	_, _, err = check("two", "one")
+	c.Check(err, ErrorMatches, `deployment group two given to --from is deployed after one given to --until`)
+
+	_, _, err = check("", "three")
+	c.Check(err, ErrorMatches, `--until: could not find group three in blueprint`)
+}
+
+func (s *MySuite) TestParseDeployArgsRange(c *C) {
+	defer func() { retryFailed, deployFrom, artifactsDir = false, "", "" }()
+	retryFailed, deployFrom = true, "one"
+	c.Check(parseDeployArgs(deployCmd, []string{c.MkDir()}), ErrorMatches, "--retry-failed can not be used with --from or --until")
+}
@@ -16,14 +16,24 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
 	"hpc-toolkit/pkg/modulewriter"
+	"hpc-toolkit/pkg/notifications"
 	"hpc-toolkit/pkg/shell"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/exp/slices"
 )
 
 func init() {
@@ -32,12 +42,29 @@ func init() {
 	destroyCmd.MarkFlagDirname(artifactsFlag)
 
 	destroyCmd.Flags().BoolVar(&autoApprove, "auto-approve", false, "Automatically approve proposed changes")
+	destroyCmd.Flags().StringVar(&orphansBehavior, "orphans", orphansReport,
+		"Handling of resources left by modules and groups removed from the blueprint, one of (\"report\", \"destroy\", \"ignore\").\n"+
+			"report: report orphaned resources, resources of removed modules are destroyed together with their group.\n"+
+			"destroy: also destroy deployment groups removed from the blueprint.\n"+
+			"ignore: keep resources of removed modules in place.")
+	destroyCmd.Flags().IntVar(&destroyParallelism, "parallelism", 1,
+		"Number of deployment groups destroyed at once, groups that do not use outputs of each other are destroyed in parallel. Requires --auto-approve if above 1.")
+	addSupportBundleFlag(destroyCmd)
+	addRecordReplayFlags(destroyCmd)
 
 	rootCmd.AddCommand(destroyCmd)
 }
 
+const (
+	orphansReport  = "report"
+	orphansDestroy = "destroy"
+	orphansIgnore  = "ignore"
+)
+
 var (
-	destroyCmd = &cobra.Command{
+	orphansBehavior    string
+	destroyParallelism int
+	destroyCmd         = &cobra.Command{
 		Use:               "destroy DEPLOYMENT_DIRECTORY",
 		Short:             "destroy all resources in a Toolkit deployment directory.",
 		Long:              "destroy all resources in a Toolkit deployment directory.",
@@ -59,52 +86,411 @@ func parseDestroyArgs(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("artifacts path %s is not a directory", artifactsDir)
 	}
 
-	return nil
+	if destroyParallelism < 1 {
+		return fmt.Errorf("--parallelism must be at least 1, got %d", destroyParallelism)
+	}
+	if destroyParallelism > 1 && !autoApprove { // prompts of groups would be interleaved
+		return errors.New("--parallelism above 1 requires --auto-approve")
+	}
+
+	switch orphansBehavior {
+	case orphansReport, orphansDestroy, orphansIgnore:
+	default:
+		return fmt.Errorf("invalid value of --orphans %q, must be one of (%q, %q, %q)",
+			orphansBehavior, orphansReport, orphansDestroy, orphansIgnore)
+	}
+
+	if err := startSupportBundle(); err != nil {
+		return err
+	}
+	return startRecordOrReplay()
 }
 
 func runDestroyCmd(cmd *cobra.Command, args []string) error {
+	ctx := interruptContext()
+	if err := modulewriter.CheckManifest(artifactsDir); err != nil {
+		return err
+	}
 	expandedBlueprintFile := filepath.Join(artifactsDir, modulewriter.ExpandedBlueprintName)
 	bp, _, err := config.NewBlueprint(expandedBlueprintFile)
 	if err != nil {
 		return err
 	}
 
-	if err := shell.ValidateDeploymentDirectory(bp.DeploymentGroups, deploymentRoot); err != nil {
+	if err := shell.ValidateDeploymentDirectory(bp, deploymentRoot); err != nil {
 		return err
 	}
 
-	// destroy in reverse order of creation!
-	packerManifests := []string{}
-	for i := len(bp.DeploymentGroups) - 1; i >= 0; i-- {
-		group := bp.DeploymentGroups[i]
-		groupDir := filepath.Join(deploymentRoot, string(group.Name))
-
-		var err error
-		switch group.Kind() {
-		case config.PackerKind:
-			// Packer groups are enforced to have length 1
-			// TODO: destroyPackerGroup(moduleDir)
-			moduleDir := filepath.Join(groupDir, string(group.Modules[0].ID))
-			packerManifests = append(packerManifests, filepath.Join(moduleDir, "packer-manifest.json"))
-		case config.TerraformKind:
-			err = destroyTerraformGroup(groupDir)
-		default:
-			err = fmt.Errorf("group %s is an unsupported kind %s", groupDir, group.Kind().String())
-		}
+	if err := setCredentials(ctx, bp); err != nil {
+		return err
+	}
+	if applyBehavior == shell.PromptBeforeApply {
+		groups, err := destroyedResources(ctx, bp)
 		if err != nil {
 			return err
 		}
+		fmt.Fprint(os.Stdout, destroySummary(bp.DeploymentName(), groups))
+		if err := confirmDestroy(os.Stdin, os.Stdout, bp.DeploymentName()); err != nil {
+			return err
+		}
 	}
 
+	report := newRunReport()
+	packerManifests, err := destroyGroups(ctx, bp, report)
+	if err != nil {
+		report.notify(notifications.DestroyFailed, bp, err)
+		reportFailure(ctx, cmd, bp, err)
+		return err
+	}
+
+	if err := shell.RemoveZoneSelection(artifactsDir); err != nil {
+		return err
+	}
+	report.notify(notifications.DestroyCompleted, bp, nil)
 	modulewriter.WritePackerDestroyInstructions(os.Stdout, packerManifests)
 	return nil
 }
 
-func destroyTerraformGroup(groupDir string) error {
+// destroyGroups destroys orphaned groups, then groups of the deployment once
+// groups using their outputs are destroyed. It returns manifests of packer
+// images, which are not destroyed.
+func destroyGroups(ctx context.Context, bp config.Blueprint, report *runReport) ([]string, error) {
+	if err := destroyOrphanedGroups(ctx, bp); err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex // groups are destroyed concurrently with --parallelism
+	packerManifests := []string{}
+	err := inDestroyOrder(bp, destroyParallelism, func(group config.DeploymentGroup) error {
+		groupDir := modulewriter.GroupDir(deploymentRoot, bp, group.Name)
+		mu.Lock()
+		err := setCredentials(ctx, bp)
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		status := notifications.GroupStatusDestroyed
+		defer func() {
+			mu.Lock()
+			report.group(group.Name, status, start)
+			mu.Unlock()
+		}()
+		stages := group.Stages()
+		destroyed := false // terraform stages share the root module of the group
+		for j := len(stages) - 1; j >= 0; j-- {
+			stage := stages[j]
+			var err error
+			switch stage.Kind() {
+			case config.PackerKind:
+				// Packer stages are made of a single module
+				// TODO: destroyPackerGroup(moduleDir)
+				moduleDir := filepath.Join(groupDir, string(stage.Modules[0].ID))
+				mu.Lock()
+				packerManifests = append(packerManifests, filepath.Join(moduleDir, "packer-manifest.json"))
+				mu.Unlock()
+			case config.TerraformKind:
+				if !destroyed {
+					err, destroyed = destroyTerraformGroup(ctx, groupDir, group), true
+				}
+			default:
+				err = fmt.Errorf("group %s is an unsupported kind %s", groupDir, stage.Kind().String())
+			}
+			if err != nil {
+				status = notifications.GroupStatusFailed
+				return err
+			}
+		}
+		return nil
+	})
+	return packerManifests, err
+}
+
+// inDestroyOrder calls destroy for each group once no remaining group depends
+// on it, for at most parallelism groups at once. Groups of higher priority,
+// then later groups are started first, so groups of the same priority are
+// destroyed in reverse order of creation when parallelism is 1. Once
+// destroying a group fails, no more groups are started.
+func inDestroyOrder(bp config.Blueprint, parallelism int, destroy func(config.DeploymentGroup) error) error {
+	deps := bp.GroupDependencies()
+	dependents := map[config.GroupName]int{}
+	for _, ds := range deps {
+		for _, d := range ds {
+			dependents[d]++
+		}
+	}
+
+	type result struct {
+		group config.GroupName
+		err   error
+	}
+	done := make(chan result)
+	remaining := slices.Clone(bp.DeploymentGroups)
+	running := 0
+	var errs []error
+	for {
+		for running < parallelism && len(errs) == 0 {
+			next := nextDestroyed(remaining, dependents)
+			if next < 0 {
+				break
+			}
+			g := remaining[next]
+			remaining = slices.Delete(remaining, next, next+1)
+			running++
+			go func() { done <- result{g.Name, destroy(g)} }()
+		}
+		if running == 0 {
+			break
+		}
+		r := <-done
+		running--
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		for _, d := range deps[r.group] {
+			dependents[d]--
+		}
+	}
+	if len(errs) == 0 && len(remaining) > 0 { // should never happen, references only go to earlier groups
+		names := []config.GroupName{}
+		for _, g := range remaining {
+			names = append(names, g.Name)
+		}
+		return fmt.Errorf("deployment groups %v depend on each other", names)
+	}
+	return errors.Join(errs...)
+}
+
+// nextDestroyed returns the index of the group to destroy next among groups
+// no remaining group depends on, -1 if there is none
+func nextDestroyed(remaining []config.DeploymentGroup, dependents map[config.GroupName]int) int {
+	next := -1
+	for i := len(remaining) - 1; i >= 0; i-- {
+		if dependents[remaining[i].Name] == 0 && (next < 0 || remaining[i].Priority > remaining[next].Priority) {
+			next = i
+		}
+	}
+	return next
+}
+
+// groupResources are resources in the terraform state of a deployment group
+type groupResources struct {
+	Group     config.GroupName
+	Resources []shell.StateResource
+}
+
+// destroyedResources returns resources of terraform groups of the deployment,
+// in order of creation
+func destroyedResources(ctx context.Context, bp config.Blueprint) ([]groupResources, error) {
+	res := []groupResources{}
+	for _, g := range bp.DeploymentGroups {
+		if g.Kind() == config.PackerKind {
+			continue
+		}
+		tf, err := shell.ConfigureTerraform(modulewriter.GroupDir(deploymentRoot, bp, g.Name))
+		if err != nil {
+			return nil, err
+		}
+		seal, err := shell.OpenLocalState(ctx, tf)
+		if err != nil {
+			return nil, err
+		}
+		rs, err := shell.StateResources(ctx, tf)
+		seal()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, groupResources{Group: g.Name, Resources: rs})
+	}
+	return res, nil
+}
+
+// destroySummary lists the number of resources of every group, resources
+// holding data, and groups with protected resources terraform fails to destroy
+func destroySummary(deployment string, groups []groupResources) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Destroying deployment %s removes:\n", deployment)
+	protected := []string{}
+	for _, g := range groups {
+		fmt.Fprintf(&sb, "  group %s: %d resources\n", g.Group, len(g.Resources))
+		for _, r := range g.Resources {
+			if r.Stateful() {
+				fmt.Fprintf(&sb, "    %s (holds data)\n", r.Address)
+			}
+			if r.Protected {
+				protected = append(protected, fmt.Sprintf("  group %s: %s", g.Group, r.Address))
+			}
+		}
+	}
+	if len(protected) > 0 {
+		sb.WriteString(boldYellow("Protected groups, destroying them fails until deletion_protection of these resources is disabled:") + "\n")
+		sb.WriteString(strings.Join(protected, "\n") + "\n")
+	}
+	return sb.String()
+}
+
+// confirmDestroy requires the user to type the name of the deployment
+func confirmDestroy(in io.Reader, out io.Writer, deployment string) error {
+	fmt.Fprintf(out, "Type the deployment name %q to confirm: ", deployment)
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return fmt.Errorf("failed to read confirmation: %w", err)
+	}
+	if strings.TrimSpace(line) != deployment {
+		return fmt.Errorf("destroy cancelled, %q does not match the deployment name %q", strings.TrimSpace(line), deployment)
+	}
+	return nil
+}
+
+func destroyTerraformGroup(ctx context.Context, groupDir string, group config.DeploymentGroup) error {
+	ctx, cancel, err := groupContext(ctx, group)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	return timeoutErr(ctx, group, destroyTerraformModules(ctx, groupDir, group))
+}
+
+func destroyTerraformModules(ctx context.Context, groupDir string, group config.DeploymentGroup) error {
 	tf, err := shell.ConfigureTerraform(groupDir)
 	if err != nil {
 		return err
 	}
+	seal, err := shell.OpenLocalState(ctx, tf)
+	if err != nil {
+		return err
+	}
+	defer seal()
+
+	if err := shell.BackupState(ctx, tf, group.Name, artifactsDir); err != nil {
+		return err
+	}
+
+	inState, err := shell.StateModules(ctx, tf)
+	if err != nil {
+		return err
+	}
+	orphans := shell.OrphanedModules(inState, group)
+	if len(orphans) == 0 {
+		return shell.Destroy(ctx, tf, applyBehavior)
+	}
+
+	logging.Error(boldYellow("Deployment group %s has resources of modules that are not part of the blueprint: %v"), group.Name, orphans)
+	if orphansBehavior != orphansIgnore {
+		logging.Error("These resources will be destroyed together with the group; use `--orphans=ignore` to keep them.")
+		return shell.Destroy(ctx, tf, applyBehavior)
+	}
+
+	logging.Error("These resources will be kept in place, they can be destroyed manually by running:")
+	for _, o := range orphans {
+		logging.Error("terraform -chdir=%s destroy -target=module.%s", groupDir, o)
+	}
+	toDestroy := []config.ModuleID{}
+	for _, m := range inState {
+		if !slices.Contains(orphans, m) {
+			toDestroy = append(toDestroy, m)
+		}
+	}
+	return shell.DestroyModules(ctx, tf, applyBehavior, toDestroy)
+}
+
+// groupStateResources returns resources in the terraform state of the group
+// directory, read from the backend the group was deployed with; replaced in
+// tests
+var groupStateResources = func(ctx context.Context, dir string) ([]shell.StateResource, error) {
+	tf, err := shell.ConfigureTerraform(dir)
+	if err != nil {
+		return nil, err
+	}
+	seal, err := shell.OpenLocalState(ctx, tf)
+	if err != nil {
+		return nil, err
+	}
+	defer seal()
+	return shell.StateResources(ctx, tf)
+}
+
+// orphanedGroups returns directories of deployment groups that were removed
+// from the blueprint, but still have resources in their terraform state, local
+// or in a remote backend. Directories of removed groups are kept among previous
+// deployment groups until they are destroyed.
+func orphanedGroups(ctx context.Context, bp config.Blueprint) ([]string, error) {
+	prevDir := modulewriter.PrevDeploymentGroupsDir(deploymentRoot)
+	entries, err := os.ReadDir(prevDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	current := map[string]bool{}
+	for _, g := range bp.DeploymentGroups {
+		current[modulewriter.PrevGroupDir(deploymentRoot, bp, g.Name)] = true
+	}
+
+	res := []string{}
+	for _, e := range entries {
+		dir := filepath.Join(prevDir, e.Name())
+		if !e.IsDir() || current[dir] {
+			continue
+		}
+		if tfs, _ := filepath.Glob(filepath.Join(dir, "*.tf")); len(tfs) == 0 {
+			continue // not a terraform group
+		}
+		rs, err := groupStateResources(ctx, dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read terraform state of removed deployment group %s: %w", dir, err)
+		}
+		if len(rs) > 0 {
+			res = append(res, dir)
+		}
+	}
+	return res, nil
+}
+
+func destroyOrphanedGroups(ctx context.Context, bp config.Blueprint) error {
+	dirs, err := orphanedGroups(ctx, bp)
+	if err != nil || len(dirs) == 0 {
+		return err
+	}
+
+	logging.Error(boldYellow("Found terraform state of deployment groups that are not part of the blueprint:"))
+	for _, d := range dirs {
+		logging.Error("%s", d)
+	}
+	if orphansBehavior != orphansDestroy {
+		logging.Error("These groups will not be destroyed; use `--orphans=destroy` to destroy them.")
+		return nil
+	}
 
-	return shell.Destroy(tf, applyBehavior)
+	for _, d := range dirs {
+		tf, err := shell.ConfigureTerraform(d)
+		if err != nil {
+			return err
+		}
+		seal, err := shell.OpenLocalState(ctx, tf)
+		if err != nil {
+			return err
+		}
+		// the group is no longer in the blueprint, its snapshots are kept under the name of its directory
+		err = shell.BackupState(ctx, tf, config.GroupName(filepath.Base(d)), artifactsDir)
+		if err == nil {
+			err = shell.Destroy(ctx, tf, applyBehavior)
+		}
+		seal()
+		if err != nil {
+			return err
+		}
+		if rs, err := groupStateResources(ctx, d); err != nil || len(rs) > 0 {
+			continue // destroy was declined, keep the group
+		}
+		logging.Info("Removing %s, the deployment group is destroyed", d)
+		if err := os.RemoveAll(d); err != nil {
+			return err
+		}
+	}
+	return nil
 }
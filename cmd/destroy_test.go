@@ -0,0 +1,186 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/modulewriter"
+	"hpc-toolkit/pkg/shell"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/slices"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestOrphanedGroups(c *C) {
+	deploymentRoot = c.MkDir()
+	bp := config.Blueprint{DeploymentGroups: []config.DeploymentGroup{{Name: "kept"}}}
+	ctx := context.Background()
+
+	{ // no previous groups
+		got, err := orphanedGroups(ctx, bp)
+		c.Check(err, IsNil)
+		c.Check(got, HasLen, 0)
+	}
+
+	prev := modulewriter.PrevDeploymentGroupsDir(deploymentRoot)
+	for _, g := range []string{"kept", "removed_local", "removed_gcs", "stateless"} {
+		c.Assert(os.MkdirAll(filepath.Join(prev, g), 0755), IsNil)
+		c.Assert(os.WriteFile(filepath.Join(prev, g, "main.tf"), []byte{}, 0644), IsNil)
+	}
+	c.Assert(os.MkdirAll(filepath.Join(prev, "packer"), 0755), IsNil)
+
+	// state is read from the backend of the group, local or not
+	defer func(f func(context.Context, string) ([]shell.StateResource, error)) { groupStateResources = f }(groupStateResources)
+	read := []string{}
+	groupStateResources = func(_ context.Context, dir string) ([]shell.StateResource, error) {
+		read = append(read, filepath.Base(dir))
+		if filepath.Base(dir) == "stateless" {
+			return nil, nil
+		}
+		return []shell.StateResource{{Address: "module.net.google_compute_network.vpc"}}, nil
+	}
+
+	got, err := orphanedGroups(ctx, bp)
+	c.Check(err, IsNil)
+	c.Check(got, DeepEquals, []string{filepath.Join(prev, "removed_gcs"), filepath.Join(prev, "removed_local")})
+	c.Check(read, DeepEquals, []string{"removed_gcs", "removed_local", "stateless"})
+
+	groupStateResources = func(context.Context, string) ([]shell.StateResource, error) {
+		return nil, errors.New("bucket not found")
+	}
+	_, err = orphanedGroups(ctx, bp)
+	c.Check(err, ErrorMatches, ".*removed deployment group.*bucket not found")
+}
+
+func (s *MySuite) TestDestroySummary(c *C) {
+	groups := []groupResources{
+		{Group: "primary", Resources: []shell.StateResource{
+			{Address: "module.network.google_compute_network.vpc", Type: "google_compute_network", Module: "network"},
+			{Address: "module.homefs.google_filestore_instance.fs", Type: "google_filestore_instance", Module: "homefs"},
+		}},
+		{Group: "db", Resources: []shell.StateResource{
+			{Address: "module.sql.google_sql_database_instance.db", Type: "google_sql_database_instance", Module: "sql", Protected: true},
+		}},
+		{Group: "empty", Resources: []shell.StateResource{}},
+	}
+	got := destroySummary("golf", groups)
+	c.Check(got, Matches, `(?s)Destroying deployment golf removes:
+  group primary: 2 resources
+    module.homefs.google_filestore_instance.fs \(holds data\)
+  group db: 1 resources
+    module.sql.google_sql_database_instance.db \(holds data\)
+  group empty: 0 resources
+.*Protected groups.*
+  group db: module.sql.google_sql_database_instance.db
+`)
+
+	c.Check(destroySummary("golf", groups[:1]), Not(Matches), "(?s).*Protected.*")
+}
+
+func (s *MySuite) TestConfirmDestroy(c *C) {
+	var out bytes.Buffer
+	c.Check(confirmDestroy(strings.NewReader("golf\n"), &out, "golf"), IsNil)
+	c.Check(out.String(), Equals, `Type the deployment name "golf" to confirm: `)
+
+	c.Check(confirmDestroy(strings.NewReader("  golf  "), &out, "golf"), IsNil)
+	c.Check(confirmDestroy(strings.NewReader("yes\n"), &out, "golf"), ErrorMatches, `destroy cancelled, "yes" does not match.*`)
+	c.Check(confirmDestroy(strings.NewReader(""), &out, "golf"), ErrorMatches, "failed to read confirmation.*")
+}
+
+func (s *MySuite) TestInDestroyOrder(c *C) {
+	mod := func(id config.ModuleID, uses ...config.ModuleID) config.Module {
+		settings := map[string]cty.Value{}
+		for _, u := range uses {
+			settings[string(u)] = config.ModuleRef(u, "id").AsValue()
+		}
+		return config.Module{ID: id, Settings: config.NewDict(settings)}
+	}
+	bp := config.Blueprint{DeploymentGroups: []config.DeploymentGroup{
+		{Name: "net", Modules: []config.Module{mod("vpc")}},
+		{Name: "fs", Modules: []config.Module{mod("nfs", "vpc")}},
+		{Name: "cluster", Modules: []config.Module{mod("slurm", "vpc", "nfs")}},
+		{Name: "images", Modules: []config.Module{mod("image")}},
+	}}
+
+	{ // reverse order of creation without parallelism
+		order := []config.GroupName{}
+		err := inDestroyOrder(bp, 1, func(g config.DeploymentGroup) error {
+			order = append(order, g.Name)
+			return nil
+		})
+		c.Check(err, IsNil)
+		c.Check(order, DeepEquals, []config.GroupName{"images", "cluster", "fs", "net"})
+	}
+
+	{ // groups are destroyed once their dependents are
+		var mu sync.Mutex
+		destroyed := map[config.GroupName]bool{}
+		err := inDestroyOrder(bp, 4, func(g config.DeploymentGroup) error {
+			mu.Lock()
+			defer mu.Unlock()
+			for dependent, deps := range bp.GroupDependencies() {
+				if slices.Contains(deps, g.Name) && !destroyed[dependent] {
+					c.Errorf("%s destroyed before %s", g.Name, dependent)
+				}
+			}
+			destroyed[g.Name] = true
+			return nil
+		})
+		c.Check(err, IsNil)
+		c.Check(destroyed, HasLen, 4)
+	}
+
+	{ // groups of higher priority are started first
+		bp := bp
+		bp.DeploymentGroups = slices.Clone(bp.DeploymentGroups)
+		bp.DeploymentGroups[1].Priority = 1 // fs
+		order := []config.GroupName{}
+		err := inDestroyOrder(bp, 1, func(g config.DeploymentGroup) error {
+			order = append(order, g.Name)
+			return nil
+		})
+		c.Check(err, IsNil)
+		c.Check(order, DeepEquals, []config.GroupName{"images", "cluster", "fs", "net"}) // fs waits for cluster
+
+		bp.DeploymentGroups[2].Priority = 1 // cluster
+		order = []config.GroupName{}
+		c.Check(inDestroyOrder(bp, 1, func(g config.DeploymentGroup) error {
+			order = append(order, g.Name)
+			return nil
+		}), IsNil)
+		c.Check(order, DeepEquals, []config.GroupName{"cluster", "fs", "images", "net"})
+	}
+
+	{ // Fail: no group is started after a failure
+		order := []config.GroupName{}
+		err := inDestroyOrder(bp, 1, func(g config.DeploymentGroup) error {
+			order = append(order, g.Name)
+			if g.Name == "cluster" {
+				return errors.New("deletion protection")
+			}
+			return nil
+		})
+		c.Check(err, ErrorMatches, "deletion protection")
+		c.Check(order, DeepEquals, []config.GroupName{"images", "cluster"})
+	}
+}
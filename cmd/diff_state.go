@@ -0,0 +1,196 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"hpc-toolkit/pkg/shell"
+	"math/big"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func init() {
+	artifactsFlag := "artifacts"
+	diffStateCmd.Flags().StringVarP(&artifactsDir, artifactsFlag, "a", "", "Artifacts output directory (automatically configured if unset)")
+	diffStateCmd.MarkFlagDirname(artifactsFlag)
+	rootCmd.AddCommand(diffStateCmd)
+}
+
+var (
+	diffStateCmd = &cobra.Command{
+		Use:               "diff-state DEPLOYMENT_DIRECTORY",
+		Short:             "Compare the deployment with its terraform state.",
+		Long:              "Compare modules of the expanded blueprint with resources in terraform state of each deployment group.",
+		Args:              cobra.MatchAll(cobra.ExactArgs(1), checkDir),
+		ValidArgsFunction: matchDirs,
+		PreRunE:           parseDiffStateArgs,
+		RunE:              runDiffStateCmd,
+		SilenceUsage:      true,
+	}
+)
+
+// countedResources maps settings controlling the number of instances created
+// by a module to the type of resource they count
+var countedResources = map[string]string{
+	"instance_count": "google_compute_instance",
+}
+
+func parseDiffStateArgs(cmd *cobra.Command, args []string) error {
+	deploymentRoot = args[0]
+	artifactsDir = getArtifactsDir(deploymentRoot)
+	if isDir, _ := shell.DirInfo(artifactsDir); !isDir {
+		return fmt.Errorf("artifacts path %s is not a directory", artifactsDir)
+	}
+	return nil
+}
+
+func runDiffStateCmd(cmd *cobra.Command, args []string) error {
+	ctx := interruptContext()
+	if err := modulewriter.CheckManifest(artifactsDir); err != nil {
+		return err
+	}
+	bp, _, err := config.NewBlueprint(filepath.Join(artifactsDir, modulewriter.ExpandedBlueprintName))
+	if err != nil {
+		return err
+	}
+	if err := shell.ValidateDeploymentDirectory(bp, deploymentRoot); err != nil {
+		return err
+	}
+
+	if err := setCredentials(ctx, bp); err != nil {
+		return err
+	}
+
+	clean := true
+	for _, g := range bp.DeploymentGroups {
+		if g.Kind() != config.TerraformKind {
+			logging.Info("Skipping deployment group %s, only terraform groups have state", g.Name)
+			continue
+		}
+		tf, err := shell.ConfigureTerraform(modulewriter.GroupDir(deploymentRoot, bp, g.Name))
+		if err != nil {
+			return err
+		}
+		seal, err := shell.OpenLocalState(ctx, tf)
+		if err != nil {
+			return err
+		}
+		resources, err := shell.StateResources(ctx, tf)
+		seal()
+		if err != nil {
+			return err
+		}
+		d := diffGroupState(bp, g, resources)
+		clean = clean && d.empty()
+		logging.Info("%s", d.render())
+	}
+	if clean {
+		logging.Info(boldGreen("Terraform state matches the blueprint."))
+	}
+	return nil
+}
+
+type groupStateDiff struct {
+	Group           config.GroupName
+	NotApplied      []config.ModuleID // modules without resources in state
+	Unowned         []string          // resources not belonging to any module of the group
+	CountMismatches []string
+}
+
+func (d groupStateDiff) empty() bool {
+	return len(d.NotApplied) == 0 && len(d.Unowned) == 0 && len(d.CountMismatches) == 0
+}
+
+func diffGroupState(bp config.Blueprint, g config.DeploymentGroup, resources []shell.StateResource) groupStateDiff {
+	d := groupStateDiff{Group: g.Name}
+	byModule := map[config.ModuleID][]shell.StateResource{}
+	for _, r := range resources {
+		byModule[r.Module] = append(byModule[r.Module], r)
+	}
+
+	inGroup := map[config.ModuleID]bool{}
+	for _, m := range g.Modules {
+		inGroup[m.ID] = true
+		owned := byModule[m.ID]
+		if len(owned) == 0 {
+			d.NotApplied = append(d.NotApplied, m.ID)
+			continue
+		}
+		for setting, ty := range countedResources {
+			want, ok := knownCount(bp, m, setting)
+			if !ok {
+				continue
+			}
+			got := 0
+			for _, r := range owned {
+				if r.Type == ty {
+					got++
+				}
+			}
+			if got != want {
+				d.CountMismatches = append(d.CountMismatches, fmt.Sprintf(
+					"module %s sets %s to %d, but state has %d %s resources", m.ID, setting, want, got, ty))
+			}
+		}
+	}
+
+	for _, r := range resources {
+		if !inGroup[r.Module] {
+			d.Unowned = append(d.Unowned, r.Address)
+		}
+	}
+	return d
+}
+
+// knownCount evaluates the setting of the module, if it is a number known
+// before deployment
+func knownCount(bp config.Blueprint, m config.Module, setting string) (int, bool) {
+	if !m.Settings.Has(setting) {
+		return 0, false
+	}
+	v, err := bp.Eval(m.Settings.Get(setting))
+	if err != nil || v.IsNull() || !v.IsKnown() || v.Type() != cty.Number {
+		return 0, false
+	}
+	i, acc := v.AsBigFloat().Int64()
+	if acc != big.Exact {
+		return 0, false
+	}
+	return int(i), true
+}
+
+func (d groupStateDiff) render() string {
+	if d.empty() {
+		return fmt.Sprintf("Deployment group %s: state matches the blueprint", d.Group)
+	}
+	s := fmt.Sprintf("Deployment group %s:", d.Group)
+	for _, m := range d.NotApplied {
+		s += fmt.Sprintf("\n  module %s has no resources in state, it was never applied or only reads data sources", m)
+	}
+	for _, a := range d.Unowned {
+		s += fmt.Sprintf("\n  resource %s does not belong to any module of the blueprint", a)
+	}
+	for _, c := range d.CountMismatches {
+		s += "\n  " + c
+	}
+	return s
+}
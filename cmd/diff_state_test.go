@@ -0,0 +1,61 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/shell"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestDiffGroupState(c *C) {
+	bp := config.Blueprint{Vars: config.NewDict(map[string]cty.Value{"nodes": cty.NumberIntVal(3)})}
+	g := config.DeploymentGroup{Name: "primary", Modules: []config.Module{
+		{ID: "network"},
+		{ID: "homefs"},
+		{ID: "vms", Settings: config.NewDict(map[string]cty.Value{
+			"instance_count": config.GlobalRef("nodes").AsValue()})},
+	}}
+
+	{ // state matches
+		d := diffGroupState(bp, g, []shell.StateResource{
+			{Address: "module.network.google_compute_network.vpc", Module: "network"},
+			{Address: "module.homefs.google_filestore_instance.fs", Module: "homefs"},
+			{Address: "module.vms.google_compute_instance.vm[0]", Type: "google_compute_instance", Module: "vms"},
+			{Address: "module.vms.google_compute_instance.vm[1]", Type: "google_compute_instance", Module: "vms"},
+			{Address: "module.vms.google_compute_instance.vm[2]", Type: "google_compute_instance", Module: "vms"},
+		})
+		c.Check(d.empty(), Equals, true)
+		c.Check(d.render(), Equals, "Deployment group primary: state matches the blueprint")
+	}
+
+	{ // differences
+		d := diffGroupState(bp, g, []shell.StateResource{
+			{Address: "module.network.google_compute_network.vpc", Module: "network"},
+			{Address: "module.old_fs.google_filestore_instance.fs", Module: "old_fs"},
+			{Address: "google_storage_bucket.manual"},
+			{Address: "module.vms.google_compute_instance.vm[0]", Type: "google_compute_instance", Module: "vms"},
+		})
+		c.Check(d, DeepEquals, groupStateDiff{
+			Group:      "primary",
+			NotApplied: []config.ModuleID{"homefs"},
+			Unowned:    []string{"module.old_fs.google_filestore_instance.fs", "google_storage_bucket.manual"},
+			CountMismatches: []string{
+				"module vms sets instance_count to 3, but state has 1 google_compute_instance resources"},
+		})
+	}
+}
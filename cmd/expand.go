@@ -16,7 +16,12 @@
 package cmd
 
 import (
+	"fmt"
+	"hpc-toolkit/pkg/config"
 	"hpc-toolkit/pkg/logging"
+	"io"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/spf13/cobra"
 )
@@ -33,26 +38,78 @@ func init() {
 	expandCmd.Flags().StringVarP(&outputFilename, "out", "o", "expanded.yaml",
 		"Output file for the expanded HPC Environment Definition.")
 	expandCmd.Flags().StringSliceVar(&cliVariables, "vars", nil, msgCLIVars)
+	expandCmd.Flags().StringArrayVar(&cliVars, "var", nil, msgCLIVar)
+	expandCmd.Flags().StringArrayVar(&cliVarFiles, "var-json", nil, msgCLIVarJSON)
 	expandCmd.Flags().StringSliceVar(&cliBEConfigVars, "backend-config", nil, msgCLIBackendConfig)
 	expandCmd.Flags().StringVarP(&validationLevel, "validation-level", "l", "WARNING", validationLevelDesc)
 	expandCmd.Flags().StringSliceVar(&validatorsToSkip, "skip-validators", nil, skipValidatorsDesc)
+	expandCmd.Flags().StringSliceVar(&expansionsToSkip, "skip-expansions", nil, skipExpansionsDesc)
+	expandCmd.Flags().StringVar(&warningsJSON, "warnings-json", "", msgWarningsJSON)
+	expandCmd.Flags().BoolVar(&requireDigest, "require-blueprint-digest", false, msgRequireDigest)
+	expandCmd.Flags().BoolVar(&resolveSettings, "resolve", false,
+		"Write values of module settings that only refer to deployment variables, instead of their $(...) expressions")
+	expandCmd.Flags().BoolVar(&explainUse, "explain-use", false,
+		"Report, per module, the settings set by each module of its \"use\" field and those overridden by explicit settings")
 	rootCmd.AddCommand(expandCmd)
 }
 
 var (
-	outputFilename string
-	expandCmd      = &cobra.Command{
-		Use:               "expand BLUEPRINT_NAME",
+	outputFilename  string
+	resolveSettings bool
+	explainUse      bool
+	expandCmd       = &cobra.Command{
+		Use:               "expand BLUEPRINT_NAME [BLUEPRINT_NAME...]",
 		Short:             "Expand the Environment Blueprint.",
 		Long:              "Updates the Environment Blueprint in the same way as create, but without writing the deployment.",
 		Run:               runExpandCmd,
-		Args:              cobra.ExactArgs(1),
-		ValidArgsFunction: filterYaml,
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: filterYamls,
 	}
 )
 
 func runExpandCmd(cmd *cobra.Command, args []string) {
-	bp := expandOrDie(args[0], deploymentFile)
-	checkErr(bp.Export(outputFilename))
+	bp, ctx := expandOrDie(args, deploymentFile)
+	if resolveSettings {
+		checkErr(bp.ExportResolved(outputFilename))
+	} else {
+		checkErr(bp.Export(outputFilename))
+	}
 	logging.Info(boldGreen("Expanded Environment Definition created successfully, saved as %s."), outputFilename)
+	reportWarnings(bp, ctx)
+	if explainUse {
+		writeUseReport(cmd.OutOrStdout(), bp)
+	}
+}
+
+var useOutcomeDesc = map[config.UseOutcome]string{
+	config.UseInjected:   "set",
+	config.UseAppended:   "appended to list",
+	config.UseOverridden: "ignored, overridden by explicit setting",
+	config.UseShadowed:   "ignored, already set by an earlier used module",
+	config.UseSkipped:    "ignored, listed by skip_expansions",
+}
+
+// writeUseReport writes a table per module with "use" of the settings
+// matching outputs of the used modules, and what happened to them
+func writeUseReport(w io.Writer, bp config.Blueprint) {
+	bp.WalkModulesSafe(func(_ config.ModulePath, m *config.Module) {
+		if len(m.Use) == 0 {
+			return
+		}
+		used := make([]string, len(m.Use))
+		for i, u := range m.Use {
+			used[i] = string(u)
+		}
+		fmt.Fprintf(w, "\nModule %s uses %s:\n", m.ID, strings.Join(used, ", "))
+		if len(m.UseReport()) == 0 {
+			fmt.Fprintln(w, "  no outputs of used modules match its inputs")
+			return
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  SETTING\tFROM\tRESULT")
+		for _, u := range m.UseReport() {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", u.Setting, u.Used, useOutcomeDesc[u.Outcome])
+		}
+		tw.Flush()
+	})
 }
@@ -63,7 +63,12 @@ func matchDirs(cmd *cobra.Command, args []string, toComplete string) ([]string,
 }
 
 func parseExportImportArgs(cmd *cobra.Command, args []string) {
-	deploymentRoot = filepath.Join(filepath.Clean(args[0]), "..")
+	groupDir := filepath.Clean(args[0])
+	deploymentRoot = filepath.Join(groupDir, "..")
+	// with flat layout deployment group is written to the deployment directory
+	if isDir, _ := shell.DirInfo(modulewriter.ArtifactsDir(groupDir)); isDir {
+		deploymentRoot = groupDir
+	}
 	artifactsDir = getArtifactsDir(deploymentRoot)
 }
 
@@ -76,23 +81,26 @@ func getArtifactsDir(deploymentRoot string) string {
 
 func runExportCmd(cmd *cobra.Command, args []string) error {
 	groupDir := filepath.Clean(args[0])
-	deploymentGroup := config.GroupName(filepath.Base(args[0]))
 
 	if err := shell.CheckWritableDir(artifactsDir); err != nil {
 		return err
 	}
 
+	if err := modulewriter.CheckManifest(artifactsDir); err != nil {
+		return err
+	}
+
 	expandedBlueprintFile := filepath.Join(artifactsDir, modulewriter.ExpandedBlueprintName)
 	bp, _, err := config.NewBlueprint(expandedBlueprintFile)
 	if err != nil {
 		return err
 	}
 
-	if err := shell.ValidateDeploymentDirectory(bp.DeploymentGroups, deploymentRoot); err != nil {
+	if err := shell.ValidateDeploymentDirectory(bp, deploymentRoot); err != nil {
 		return err
 	}
 
-	group, err := bp.Group(deploymentGroup)
+	group, _, err := modulewriter.DeploymentGroupOfDir(bp, groupDir)
 	if err != nil {
 		return err
 	}
@@ -103,11 +111,20 @@ func runExportCmd(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("export command is supported for Terraform modules only")
 	}
 
+	ctx := interruptContext()
+	if err := setCredentials(ctx, bp); err != nil {
+		return err
+	}
 	tf, err := shell.ConfigureTerraform(groupDir)
 	if err != nil {
 		return err
 	}
-	if err = shell.ExportOutputs(tf, artifactsDir, shell.NeverApply); err != nil {
+	seal, err := shell.OpenLocalState(ctx, tf)
+	if err != nil {
+		return err
+	}
+	defer seal()
+	if err = shell.ExportOutputs(ctx, tf, group.Name, artifactsDir, bp.ArtifactsEncryption, shell.NeverApply); err != nil {
 		return err
 	}
 	return nil
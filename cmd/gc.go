@@ -0,0 +1,199 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/gc"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"hpc-toolkit/pkg/shell"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func init() {
+	artifactsFlag := "artifacts"
+	gcCmd.Flags().StringVarP(&artifactsDir, artifactsFlag, "a", "", "Artifacts output directory (automatically configured if unset)")
+	gcCmd.MarkFlagDirname(artifactsFlag)
+	gcCmd.Flags().StringVar(&gcDeployment, "deployment", "",
+		"Value of the ghpc_deployment label of resources to collect, defaults to deployment_name of the deployment")
+	gcCmd.Flags().BoolVar(&gcDelete, "delete", false, "Delete the resources found, after confirmation")
+	gcCmd.Flags().BoolVar(&autoApprove, "auto-approve", false, "Delete the resources without asking for confirmation")
+	rootCmd.AddCommand(gcCmd)
+}
+
+var (
+	gcDeployment string
+	gcDelete     bool
+	gcCmd        = &cobra.Command{
+		Use:   "gc DEPLOYMENT_DIRECTORY",
+		Short: "Find cloud resources of the deployment that are not in terraform state.",
+		Long: "Find Compute Engine instances and disks labeled with the labels of the deployment, " +
+			"but not in terraform state of any of its groups, e.g. created by an autoscaler, and optionally delete them.",
+		Args:              cobra.MatchAll(cobra.ExactArgs(1), checkDir),
+		ValidArgsFunction: matchDirs,
+		PreRunE:           parseGcArgs,
+		RunE:              runGcCmd,
+		SilenceUsage:      true,
+	}
+)
+
+func parseGcArgs(cmd *cobra.Command, args []string) error {
+	if autoApprove && !gcDelete {
+		return errors.New("--auto-approve can only be used with --delete")
+	}
+	deploymentRoot = args[0]
+	artifactsDir = getArtifactsDir(deploymentRoot)
+	if isDir, _ := shell.DirInfo(artifactsDir); !isDir {
+		return fmt.Errorf("artifacts path %s is not a directory", artifactsDir)
+	}
+	return nil
+}
+
+// deploymentLabels returns labels of the deployment that are known before
+// deployment; ghpc_deployment is set to deployment, if given
+func deploymentLabels(bp config.Blueprint, deployment string) map[string]string {
+	res := map[string]string{}
+	if bp.Vars.Has("labels") {
+		v, err := bp.Eval(bp.Vars.Get("labels"))
+		if err == nil && v.IsWhollyKnown() && !v.IsNull() && (v.Type().IsObjectType() || v.Type().IsMapType()) {
+			for k, l := range v.AsValueMap() {
+				if !l.IsNull() && l.Type() == cty.String {
+					res[k] = l.AsString()
+				}
+			}
+		}
+	}
+	if deployment != "" {
+		res[gc.DeploymentLabel] = deployment
+	}
+	return res
+}
+
+func runGcCmd(cmd *cobra.Command, args []string) error {
+	ctx := interruptContext()
+	if err := modulewriter.CheckManifest(artifactsDir); err != nil {
+		return err
+	}
+	bp, _, err := config.NewBlueprint(filepath.Join(artifactsDir, modulewriter.ExpandedBlueprintName))
+	if err != nil {
+		return err
+	}
+	if err := shell.ValidateDeploymentDirectory(bp, deploymentRoot); err != nil {
+		return err
+	}
+	project, err := bp.ProjectID()
+	if err != nil {
+		return err
+	}
+	if err := setCredentials(ctx, bp); err != nil {
+		return err
+	}
+
+	managed, err := managedSelfLinks(ctx, bp)
+	if err != nil {
+		return err
+	}
+
+	c, err := gc.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	found, err := gc.Find(ctx, c, project, deploymentLabels(bp, gcDeployment), managed)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		logging.Info(boldGreen("No resources of the deployment outside of terraform state"))
+		return nil
+	}
+
+	var sb strings.Builder
+	writeGcResources(&sb, found)
+	logging.Info("%s", sb.String())
+	if !gcDelete {
+		logging.Info("Run with --delete to delete these resources")
+		return nil
+	}
+	return deleteGcResources(ctx, c, found, sb.String())
+}
+
+// managedSelfLinks returns self links of resources in terraform state of
+// terraform groups of the deployment
+func managedSelfLinks(ctx context.Context, bp config.Blueprint) ([]string, error) {
+	managed := []string{}
+	for _, g := range bp.DeploymentGroups {
+		if g.Kind() != config.TerraformKind {
+			continue
+		}
+		tf, err := shell.ConfigureTerraform(modulewriter.GroupDir(deploymentRoot, bp, g.Name))
+		if err != nil {
+			return nil, err
+		}
+		seal, err := shell.OpenLocalState(ctx, tf)
+		if err != nil {
+			return nil, err
+		}
+		resources, err := shell.StateResources(ctx, tf)
+		seal()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read terraform state of deployment group %s: %w", g.Name, err)
+		}
+		for _, r := range resources {
+			if r.SelfLink != "" {
+				managed = append(managed, r.SelfLink)
+			}
+		}
+	}
+	return managed, nil
+}
+
+// deleteGcResources deletes the resources listed, once confirmed unless
+// --auto-approve is given
+func deleteGcResources(ctx context.Context, c gc.Client, found []gc.Resource, listing string) error {
+	if !autoApprove {
+		pc := shell.ProposedChanges{
+			Summary: fmt.Sprintf("Proposed change: delete %d resources", len(found)),
+			Full:    listing,
+		}
+		if !shell.ApplyChangesChoice(pc) {
+			return nil
+		}
+	}
+	if err := gc.Delete(ctx, c, found); err != nil {
+		return err
+	}
+	logging.Info(boldGreen("Deleted %d resources"), len(found))
+	return nil
+}
+
+func writeGcResources(w io.Writer, rs []gc.Resource) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tLOCATION\tNAME\tCREATED")
+	for _, r := range rs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Kind, r.Location, r.Name, r.Created)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,49 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/gc"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestDeploymentLabels(c *C) {
+	bp := config.Blueprint{Vars: config.NewDict(map[string]cty.Value{
+		"deployment_name": cty.StringVal("dep"),
+		"labels": cty.ObjectVal(map[string]cty.Value{
+			"ghpc_deployment": config.GlobalRef("deployment_name").AsValue(),
+			"owner":           cty.StringVal("me"),
+		}),
+	})}
+	c.Check(deploymentLabels(bp, ""), DeepEquals, map[string]string{"ghpc_deployment": "dep", "owner": "me"})
+	c.Check(deploymentLabels(bp, "old"), DeepEquals, map[string]string{"ghpc_deployment": "old", "owner": "me"})
+	c.Check(deploymentLabels(config.Blueprint{}, ""), DeepEquals, map[string]string{})
+}
+
+func (s *MySuite) TestParseGcArgs(c *C) {
+	defer func() { autoApprove, artifactsDir, deploymentRoot = false, "", "" }()
+	autoApprove = true
+	c.Check(parseGcArgs(gcCmd, []string{c.MkDir()}), ErrorMatches, "--auto-approve can only be used with --delete")
+}
+
+func (s *MySuite) TestWriteGcResources(c *C) {
+	var sb strings.Builder
+	writeGcResources(&sb, []gc.Resource{{Kind: gc.Instance, Location: "us-central1-a", Name: "node-0", Created: "2024-01-02T03:04:05Z"}})
+	c.Check(sb.String(), Equals, "KIND      LOCATION       NAME    CREATED\ninstance  us-central1-a  node-0  2024-01-02T03:04:05Z\n")
+}
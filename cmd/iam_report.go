@@ -0,0 +1,210 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/spf13/cobra"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func init() {
+	iamReportCmd.Flags().StringVarP(&deploymentFile, "deployment-file", "d", "", "Toolkit Deployment File.")
+	iamReportCmd.Flags().StringSliceVar(&cliVariables, "vars", nil, msgCLIVars)
+	iamReportCmd.Flags().StringArrayVar(&cliVars, "var", nil, msgCLIVar)
+	iamReportCmd.Flags().StringArrayVar(&cliVarFiles, "var-json", nil, msgCLIVarJSON)
+	iamReportCmd.Flags().StringVarP(&validationLevel, "validation-level", "l", "WARNING", validationLevelDesc)
+	iamReportCmd.Flags().StringSliceVar(&validatorsToSkip, "skip-validators", nil, skipValidatorsDesc)
+	iamReportCmd.Flags().StringVarP(&iamReportFormat, "format", "f", "gcloud", "Output format, one of: gcloud, terraform")
+	iamReportCmd.Flags().StringVar(&iamServiceAccount, "service-account", "",
+		"Email of the service account deploying the blueprint, defaults to ghpc-deployer@PROJECT_ID.iam.gserviceaccount.com")
+	rootCmd.AddCommand(iamReportCmd)
+}
+
+var (
+	iamReportFormat   string
+	iamServiceAccount string
+	iamReportCmd      = &cobra.Command{
+		Use:   "iam-report BLUEPRINT_NAME [BLUEPRINT_NAME...]",
+		Short: "Report IAM roles required to deploy the blueprint.",
+		Long: "Report IAM roles that modules of the blueprint declare they need in their metadata, " +
+			"as gcloud commands or terraform resources granting them to the service account deploying it.",
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: filterYamls,
+		RunE:              runIamReportCmd,
+		SilenceUsage:      true,
+	}
+)
+
+// iamGrant is a role required at a level, e.g. in a project, by modules
+type iamGrant struct {
+	Level    string
+	Resource string // e.g. the project ID, for roles at project level
+	Role     string
+	Modules  []config.ModuleID
+}
+
+// moduleProject returns the project_id setting of the module if it is known
+// before deployment, or the project of the deployment
+func moduleProject(bp config.Blueprint, m config.Module, deploymentProject string) string {
+	if !m.Settings.Has("project_id") {
+		return deploymentProject
+	}
+	v, err := bp.Eval(m.Settings.Get("project_id"))
+	if err != nil || v.IsNull() || v.Type() != cty.String {
+		return deploymentProject
+	}
+	return v.AsString()
+}
+
+// iamGrants aggregates roles declared by modules of the blueprint, sorted by
+// level, project level first, resource and role. It also returns modules
+// declaring no roles.
+func iamGrants(bp config.Blueprint) ([]iamGrant, []config.ModuleID, error) {
+	project, err := bp.ProjectID()
+	if err != nil {
+		return nil, nil, err
+	}
+	type key struct{ level, resource, role string }
+	grants := map[key]*iamGrant{}
+	undeclared := []config.ModuleID{}
+	bp.WalkModulesSafe(func(_ config.ModulePath, m *config.Module) {
+		declared := m.InfoOrDie().Metadata.Spec.Requirements.Roles
+		if len(declared) == 0 {
+			undeclared = append(undeclared, m.ID)
+		}
+		for _, rs := range declared {
+			res := ""
+			if rs.Level == "Project" {
+				res = moduleProject(bp, *m, project)
+			}
+			for _, r := range rs.Roles {
+				k := key{rs.Level, res, r}
+				if _, ok := grants[k]; !ok {
+					grants[k] = &iamGrant{Level: rs.Level, Resource: res, Role: r}
+				}
+				grants[k].Modules = append(grants[k].Modules, m.ID)
+			}
+		}
+	})
+
+	res := []iamGrant{}
+	for _, g := range grants {
+		res = append(res, *g)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if (a.Level == "Project") != (b.Level == "Project") {
+			return a.Level == "Project"
+		}
+		if a.Level != b.Level {
+			return a.Level < b.Level
+		}
+		if a.Resource != b.Resource {
+			return a.Resource < b.Resource
+		}
+		return a.Role < b.Role
+	})
+	return res, undeclared, nil
+}
+
+func moduleList(ms []config.ModuleID) string {
+	s := []string{}
+	for _, m := range ms {
+		s = append(s, string(m))
+	}
+	return strings.Join(s, ", ")
+}
+
+// writeIamGcloud writes gcloud commands granting the roles at project level,
+// roles at other levels are listed in comments
+func writeIamGcloud(w io.Writer, grants []iamGrant, member string) {
+	for _, g := range grants {
+		fmt.Fprintf(w, "# %s: %s\n", g.Role, moduleList(g.Modules))
+		if g.Level != "Project" {
+			fmt.Fprintf(w, "# grant %s to %s at %s level\n", g.Role, member, g.Level)
+			continue
+		}
+		fmt.Fprintf(w, "gcloud projects add-iam-policy-binding %s --member=%s --role=%s --condition=None\n",
+			g.Resource, member, g.Role)
+	}
+}
+
+// writeIamTerraform writes a google_project_iam_member resource per project
+// granting the roles, roles at other levels are listed in comments
+func writeIamTerraform(w io.Writer, grants []iamGrant, member string) {
+	projects := []string{}
+	roles := map[string][]cty.Value{}
+	for _, g := range grants {
+		fmt.Fprintf(w, "# %s: %s\n", g.Role, moduleList(g.Modules))
+		if g.Level != "Project" {
+			fmt.Fprintf(w, "# grant %s to %s at %s level\n", g.Role, member, g.Level)
+			continue
+		}
+		if _, ok := roles[g.Resource]; !ok {
+			projects = append(projects, g.Resource)
+		}
+		roles[g.Resource] = append(roles[g.Resource], cty.StringVal(g.Role))
+	}
+
+	f := hclwrite.NewEmptyFile()
+	for i, p := range projects {
+		name := "ghpc_deployer"
+		if i > 0 {
+			name = fmt.Sprintf("ghpc_deployer_%d", i)
+		}
+		body := f.Body().AppendNewBlock("resource", []string{"google_project_iam_member", name}).Body()
+		body.SetAttributeRaw("for_each", hclwrite.TokensForFunctionCall("toset", hclwrite.TokensForValue(cty.ListVal(roles[p]))))
+		body.SetAttributeValue("project", cty.StringVal(p))
+		body.SetAttributeTraversal("role", hcl.Traversal{hcl.TraverseRoot{Name: "each"}, hcl.TraverseAttr{Name: "value"}})
+		body.SetAttributeValue("member", cty.StringVal(member))
+		f.Body().AppendNewline()
+	}
+	w.Write(hclwrite.Format(f.Bytes()))
+}
+
+func runIamReportCmd(cmd *cobra.Command, args []string) error {
+	if iamReportFormat != "gcloud" && iamReportFormat != "terraform" {
+		return fmt.Errorf("unsupported format %q, expected one of: gcloud, terraform", iamReportFormat)
+	}
+	bp, _ := expandOrDie(args, deploymentFile)
+	grants, undeclared, err := iamGrants(bp)
+	if err != nil {
+		return err
+	}
+	sa := iamServiceAccount
+	if sa == "" {
+		project, _ := bp.ProjectID()
+		sa = fmt.Sprintf("ghpc-deployer@%s.iam.gserviceaccount.com", project)
+	}
+	member := "serviceAccount:" + sa
+	if len(undeclared) > 0 {
+		fmt.Fprintf(cmd.OutOrStdout(), "# modules declaring no roles in their metadata: %s\n", moduleList(undeclared))
+	}
+	if iamReportFormat == "terraform" {
+		writeIamTerraform(cmd.OutOrStdout(), grants, member)
+	} else {
+		writeIamGcloud(cmd.OutOrStdout(), grants, member)
+	}
+	return nil
+}
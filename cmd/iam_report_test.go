@@ -0,0 +1,90 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/modulereader"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestIamGrants(c *C) {
+	roles := func(rs ...string) modulereader.ModuleInfo {
+		info := modulereader.ModuleInfo{}
+		info.Metadata.Spec.Requirements.Roles = []modulereader.MetadataRoles{{Level: "Project", Roles: rs}}
+		return info
+	}
+	modulereader.SetModuleInfo(c.TestName()+"/vpc", "terraform", roles("roles/compute.networkAdmin", "roles/compute.securityAdmin"))
+	modulereader.SetModuleInfo(c.TestName()+"/firewall", "terraform", roles("roles/compute.securityAdmin"))
+	modulereader.SetModuleInfo(c.TestName()+"/fs", "terraform", modulereader.ModuleInfo{})
+
+	bp := config.Blueprint{
+		Vars: config.NewDict(map[string]cty.Value{"project_id": cty.StringVal("p")}),
+		DeploymentGroups: []config.DeploymentGroup{{Name: "g", Modules: []config.Module{
+			{ID: "net", Source: c.TestName() + "/vpc", Kind: config.TerraformKind, Settings: config.NewDict(map[string]cty.Value{
+				"project_id": config.GlobalRef("project_id").AsValue()})},
+			{ID: "host", Source: c.TestName() + "/firewall", Kind: config.TerraformKind, Settings: config.NewDict(map[string]cty.Value{
+				"project_id": cty.StringVal("host-project")})},
+			{ID: "fs", Source: c.TestName() + "/fs", Kind: config.TerraformKind},
+		}}},
+	}
+
+	grants, undeclared, err := iamGrants(bp)
+	c.Assert(err, IsNil)
+	c.Check(undeclared, DeepEquals, []config.ModuleID{"fs"})
+	c.Check(grants, DeepEquals, []iamGrant{
+		{Level: "Project", Resource: "host-project", Role: "roles/compute.securityAdmin", Modules: []config.ModuleID{"host"}},
+		{Level: "Project", Resource: "p", Role: "roles/compute.networkAdmin", Modules: []config.ModuleID{"net"}},
+		{Level: "Project", Resource: "p", Role: "roles/compute.securityAdmin", Modules: []config.ModuleID{"net"}},
+	})
+
+	_, _, err = iamGrants(config.Blueprint{})
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestWriteIamReport(c *C) {
+	grants := []iamGrant{
+		{Level: "Project", Resource: "p", Role: "roles/file.editor", Modules: []config.ModuleID{"fs"}},
+		{Level: "Project", Resource: "p", Role: "roles/iam.serviceAccountUser", Modules: []config.ModuleID{"vm", "login"}},
+		{Level: "Organization", Role: "roles/compute.xpnAdmin", Modules: []config.ModuleID{"shared"}},
+	}
+	member := "serviceAccount:sa@p.iam.gserviceaccount.com"
+
+	var sb strings.Builder
+	writeIamGcloud(&sb, grants, member)
+	c.Check(sb.String(), Equals, `# roles/file.editor: fs
+gcloud projects add-iam-policy-binding p --member=serviceAccount:sa@p.iam.gserviceaccount.com --role=roles/file.editor --condition=None
+# roles/iam.serviceAccountUser: vm, login
+gcloud projects add-iam-policy-binding p --member=serviceAccount:sa@p.iam.gserviceaccount.com --role=roles/iam.serviceAccountUser --condition=None
+# roles/compute.xpnAdmin: shared
+# grant roles/compute.xpnAdmin to serviceAccount:sa@p.iam.gserviceaccount.com at Organization level
+`)
+
+	sb.Reset()
+	writeIamTerraform(&sb, grants[:2], member)
+	c.Check(sb.String(), Equals, `# roles/file.editor: fs
+# roles/iam.serviceAccountUser: vm, login
+resource "google_project_iam_member" "ghpc_deployer" {
+  for_each = toset(["roles/file.editor", "roles/iam.serviceAccountUser"])
+  project  = "p"
+  role     = each.value
+  member   = "serviceAccount:sa@p.iam.gserviceaccount.com"
+}
+
+`)
+}
@@ -0,0 +1,171 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/images"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"hpc-toolkit/pkg/shell"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	imagesPruneCmd.Flags().IntVar(&pruneKeep, "keep", 3, "Number of newest images of each family to keep")
+	imagesPruneCmd.Flags().DurationVar(&pruneOlderThan, "older-than", 0, "Only delete images older than this, e.g. \"720h\"")
+	imagesPruneCmd.Flags().BoolVar(&autoApprove, "auto-approve", false, "Delete the images without asking for confirmation")
+	imagesCmd.AddCommand(imagesListCmd, imagesPruneCmd)
+	rootCmd.AddCommand(imagesCmd)
+}
+
+var (
+	pruneKeep      int
+	pruneOlderThan time.Duration
+	imagesCmd      = &cobra.Command{
+		Use:   "images",
+		Short: "Manage VM images built by Packer deployment groups.",
+		Long: "Manage VM images built by Packer deployment groups. Images are found in Packer build manifests " +
+			"of the deployments and in their image families with the Compute Engine API.",
+	}
+	imagesListCmd = &cobra.Command{
+		Use:               "list DEPLOYMENT_DIRECTORY [DEPLOYMENT_DIRECTORY...]",
+		Short:             "List images built by the deployments and the deployments using them.",
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: matchDirs,
+		RunE:              runImagesListCmd,
+		SilenceUsage:      true,
+	}
+	imagesPruneCmd = &cobra.Command{
+		Use:   "prune DEPLOYMENT_DIRECTORY [DEPLOYMENT_DIRECTORY...]",
+		Short: "Delete old images built by the deployments that are not used.",
+		Long: "Delete old images built by the deployments. The newest images of each family and images " +
+			"used by any of the given deployments are kept.",
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: matchDirs,
+		PreRunE:           parseImagesPruneArgs,
+		RunE:              runImagesPruneCmd,
+		SilenceUsage:      true,
+	}
+)
+
+func parseImagesPruneArgs(cmd *cobra.Command, args []string) error {
+	if pruneKeep < 1 {
+		return fmt.Errorf("--keep must be at least 1, got %d", pruneKeep)
+	}
+	if pruneOlderThan < 0 {
+		return fmt.Errorf("--older-than must not be negative, got %s", pruneOlderThan)
+	}
+	return nil
+}
+
+// loadDeployments reads expanded blueprints of the deployment directories
+func loadDeployments(dirs []string) ([]images.Deployment, error) {
+	res := []images.Deployment{}
+	for _, d := range dirs {
+		if err := checkDir(nil, []string{d}); err != nil {
+			return nil, err
+		}
+		bp, _, err := config.NewBlueprint(filepath.Join(modulewriter.ArtifactsDir(d), modulewriter.ExpandedBlueprintName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read deployment %s: %w", d, err)
+		}
+		res = append(res, images.Deployment{Dir: d, Blueprint: bp})
+	}
+	return res, nil
+}
+
+func listImages(ctx context.Context, dirs []string) ([]images.Image, images.Client, error) {
+	ds, err := loadDeployments(dirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := images.NewClient(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	imgs, err := images.Find(ctx, c, ds)
+	return imgs, c, err
+}
+
+func runImagesListCmd(cmd *cobra.Command, args []string) error {
+	imgs, _, err := listImages(interruptContext(), args)
+	if err != nil {
+		return err
+	}
+	if len(imgs) == 0 {
+		logging.Info("No images built by Packer groups of the deployments")
+		return nil
+	}
+	writeImages(cmd.OutOrStdout(), imgs)
+	return nil
+}
+
+func runImagesPruneCmd(cmd *cobra.Command, args []string) error {
+	ctx := interruptContext()
+	imgs, c, err := listImages(ctx, args)
+	if err != nil {
+		return err
+	}
+	prune := images.PrunePolicy{Keep: pruneKeep, OlderThan: pruneOlderThan}.Select(imgs, time.Now())
+	if len(prune) == 0 {
+		logging.Info("No images to delete")
+		return nil
+	}
+
+	var sb strings.Builder
+	writeImages(&sb, prune)
+	logging.Info("%s", sb.String())
+	if !autoApprove {
+		pc := shell.ProposedChanges{
+			Summary: fmt.Sprintf("Proposed change: delete %d images", len(prune)),
+			Full:    sb.String(),
+		}
+		if !shell.ApplyChangesChoice(pc) {
+			return nil
+		}
+	}
+	if err := images.Delete(ctx, c, prune); err != nil {
+		return err
+	}
+	logging.Info(boldGreen("Deleted %d images"), len(prune))
+	return nil
+}
+
+func writeImages(w io.Writer, imgs []images.Image) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tFAMILY\tNAME\tCREATED\tBUILT BY\tUSED BY")
+	for _, img := range imgs {
+		name := img.Name
+		if img.Deprecated {
+			name += " (deprecated)"
+		}
+		usedBy := strings.Join(img.UsedBy, ",")
+		if usedBy == "" {
+			usedBy = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", img.Project, img.Family, name, img.Created.Format(time.RFC3339), img.BuiltBy, usedBy)
+	}
+	tw.Flush()
+}
@@ -35,7 +35,7 @@ var (
 	importCmd = &cobra.Command{
 		Use:               "import-inputs DEPLOYMENT_GROUP_DIRECTORY",
 		Short:             "Import input values from previous deployment groups.",
-		Long:              "Import input values from previous deployment groups upon which this group depends.",
+		Long:              "Import input values from previous deployment groups upon which this group depends, and runtime values the group refers to as $(runtime.NAME).",
 		Args:              cobra.MatchAll(cobra.ExactArgs(1), checkDir),
 		ValidArgsFunction: matchDirs,
 		PreRun:            parseExportImportArgs,
@@ -45,23 +45,29 @@ var (
 )
 
 func runImportCmd(cmd *cobra.Command, args []string) error {
+	ctx := interruptContext()
 	groupDir := filepath.Clean(args[0])
 
 	if err := shell.CheckWritableDir(groupDir); err != nil {
 		return err
 	}
 
+	if err := modulewriter.CheckManifest(artifactsDir); err != nil {
+		return err
+	}
+
 	expandedBlueprintFile := filepath.Join(artifactsDir, modulewriter.ExpandedBlueprintName)
 	bp, _, err := config.NewBlueprint(expandedBlueprintFile)
 	if err != nil {
 		return err
 	}
 
-	if err := shell.ValidateDeploymentDirectory(bp.DeploymentGroups, deploymentRoot); err != nil {
+	if err := shell.ValidateDeploymentDirectory(bp, deploymentRoot); err != nil {
 		return err
 	}
 
-	if err := shell.ImportInputs(groupDir, artifactsDir, expandedBlueprintFile); err != nil {
+	// inputs are kept for the user to run terraform or packer
+	if _, err := shell.ImportInputs(ctx, groupDir, artifactsDir, expandedBlueprintFile); err != nil {
 		return err
 	}
 
@@ -0,0 +1,138 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/zclconf/go-cty/cty"
+	ctyJson "github.com/zclconf/go-cty/cty/json"
+)
+
+func init() {
+	inputsCmd.Flags().StringVarP(&inputsFormat, "format", "f", "json", "Output format, one of: json, md")
+	rootCmd.AddCommand(inputsCmd)
+}
+
+var (
+	inputsFormat string
+	inputsCmd    = &cobra.Command{
+		Use:               "inputs BLUEPRINT_NAME",
+		Short:             "List deployment variables consumed by the blueprint.",
+		Long:              "List deployment variables consumed by the blueprint with their types, defaults, descriptions and modules using them.",
+		Run:               runInputsCmd,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: filterYaml,
+	}
+)
+
+func runInputsCmd(cmd *cobra.Command, args []string) {
+	inputs, ctx, err := config.BlueprintInputs(args[0])
+	if err != nil {
+		logging.Fatal(renderError(err, ctx))
+	}
+	out, err := renderInputs(inputs, inputsFormat)
+	checkErr(err)
+	fmt.Fprint(cmd.OutOrStdout(), out)
+}
+
+type inputJSON struct {
+	Name        string          `json:"name"`
+	Type        string          `json:"type"`
+	Default     json.RawMessage `json:"default,omitempty"`
+	Required    bool            `json:"required"`
+	Secret      bool            `json:"secret"`
+	Description string          `json:"description,omitempty"`
+	Modules     []string        `json:"modules"`
+}
+
+func renderInputs(inputs []config.Input, format string) (string, error) {
+	switch format {
+	case "json":
+		return renderInputsJSON(inputs)
+	case "md":
+		return renderInputsMarkdown(inputs), nil
+	default:
+		return "", fmt.Errorf("unsupported format %q, expected one of: json, md", format)
+	}
+}
+
+// inputDefault renders the value as JSON, values containing expressions are
+// rendered as a string in HCL syntax
+func inputDefault(v cty.Value) (json.RawMessage, error) {
+	if b, err := ctyJson.Marshal(v, v.Type()); err == nil {
+		return b, nil
+	}
+	return json.Marshal(string(config.TokensForValue(v).Bytes()))
+}
+
+func renderInputsJSON(inputs []config.Input) (string, error) {
+	res := []inputJSON{}
+	for _, in := range inputs {
+		j := inputJSON{
+			Name:        in.Name,
+			Type:        in.Type,
+			Required:    in.Default == cty.NilVal,
+			Secret:      in.Secret,
+			Description: in.Description,
+			Modules:     []string{},
+		}
+		if !j.Required {
+			d, err := inputDefault(in.Default)
+			if err != nil {
+				return "", err
+			}
+			j.Default = d
+		}
+		for _, m := range in.Modules {
+			j.Modules = append(j.Modules, string(m))
+		}
+		res = append(res, j)
+	}
+	b, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
+
+func renderInputsMarkdown(inputs []config.Input) string {
+	var sb strings.Builder
+	sb.WriteString("| Name | Type | Default | Description | Modules |\n")
+	sb.WriteString("|------|------|---------|-------------|---------|\n")
+	for _, in := range inputs {
+		def := "n/a"
+		if in.Default != cty.NilVal {
+			def = "`" + string(config.TokensForValue(in.Default).Bytes()) + "`"
+		}
+		typ := "`" + in.Type + "`"
+		if in.Secret {
+			typ += " (secret)"
+		}
+		mods := []string{}
+		for _, m := range in.Modules {
+			mods = append(mods, string(m))
+		}
+		desc := strings.ReplaceAll(in.Description, "\n", " ")
+		fmt.Fprintf(&sb, "| %s | %s | %s | %s | %s |\n", in.Name, typ, def, desc, strings.Join(mods, ", "))
+	}
+	return sb.String()
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"hpc-toolkit/pkg/config"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestRenderInputs(c *C) {
+	inputs := []config.Input{
+		{Name: "project_id", Type: "any", Default: cty.NilVal, Description: "GCP project", Modules: []config.ModuleID{"network", "cluster"}},
+		{Name: "zones", Type: "tuple([string])", Default: cty.TupleVal([]cty.Value{cty.StringVal("us-central1-a")})},
+		{Name: "name", Type: "any", Default: config.GlobalRef("deployment_name").AsValue()},
+	}
+
+	got, err := renderInputs(inputs, "json")
+	c.Assert(err, IsNil)
+	c.Check(got, Equals, `[
+  {
+    "name": "project_id",
+    "type": "any",
+    "required": true,
+    "secret": false,
+    "description": "GCP project",
+    "modules": [
+      "network",
+      "cluster"
+    ]
+  },
+  {
+    "name": "zones",
+    "type": "tuple([string])",
+    "default": [
+      "us-central1-a"
+    ],
+    "required": false,
+    "secret": false,
+    "modules": []
+  },
+  {
+    "name": "name",
+    "type": "any",
+    "default": "var.deployment_name",
+    "required": false,
+    "secret": false,
+    "modules": []
+  }
+]
+`)
+
+	got, err = renderInputs(inputs, "md")
+	c.Assert(err, IsNil)
+	c.Check(got, Equals, "| Name | Type | Default | Description | Modules |\n"+
+		"|------|------|---------|-------------|---------|\n"+
+		"| project_id | `any` | n/a | GCP project | network, cluster |\n"+
+		"| zones | `tuple([string])` | `[\"us-central1-a\"]` |  |  |\n"+
+		"| name | `any` | `var.deployment_name` |  |  |\n")
+
+	_, err = renderInputs(inputs, "xml")
+	c.Check(err, ErrorMatches, ".*unsupported format.*")
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	lintCmd.Flags().BoolVar(&lintFix, "fix", false, "Rewrite the blueprint to upgrade deprecated fields.")
+	rootCmd.AddCommand(lintCmd)
+}
+
+var (
+	lintFix bool
+	lintCmd = &cobra.Command{
+		Use:   "lint BLUEPRINT_NAME",
+		Short: "Report deprecated fields of the blueprint.",
+		Long: "Report deprecated fields and moved module sources of the blueprint, with their position and the release " +
+			"they are removed in. With --fix, the blueprint is upgraded in place, its comments and formatting are preserved.",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: filterYaml,
+		RunE:              runLintCmd,
+		SilenceUsage:      true,
+	}
+)
+
+func runLintCmd(cmd *cobra.Command, args []string) error {
+	path := args[0]
+	bp, ctx, err := config.NewBlueprint(path)
+	if err != nil {
+		logging.Fatal(renderError(err, ctx))
+	}
+	ws := bp.Deprecations()
+	if len(ws) == 0 {
+		logging.Info("No deprecated fields found in %s", path)
+		return nil
+	}
+	writeDeprecations(cmd.OutOrStdout(), path, ws, ctx)
+	if !lintFix {
+		return fmt.Errorf("%d deprecation(s) found in %s, run with --fix to upgrade the blueprint", len(ws), path)
+	}
+
+	if ext := filepath.Ext(path); ext == ".hcl" || ext == ".cue" || ext == ".jsonnet" {
+		return errors.New("--fix only upgrades YAML blueprints")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	upgraded, err := config.ApplyUpgrades(data, ws)
+	if err != nil {
+		return fmt.Errorf("failed to upgrade %s: %w", path, err)
+	}
+	if err := os.WriteFile(path, upgraded, info.Mode().Perm()); err != nil {
+		return err
+	}
+	logging.Info(boldGreen("%d deprecation(s) fixed in %s"), len(ws), path)
+	return nil
+}
+
+// writeDeprecations prints a line per deprecation, prefixed with its position
+// in the blueprint as compilers do, so that editors can jump to it
+func writeDeprecations(w io.Writer, path string, ws []config.Warning, ctx config.YamlCtx) {
+	for _, d := range ws {
+		pos := path
+		if d.Path != nil {
+			if p, ok := ctx.Pos(d.Path); ok {
+				pos = fmt.Sprintf("%s:%d:%d", path, p.Line, p.Column)
+			}
+		}
+		msg := d.Message
+		if d.Removal != "" {
+			msg += fmt.Sprintf(", to be removed in %s", d.Removal)
+		}
+		if d.Upgrade != nil {
+			msg += fmt.Sprintf(" (fix: %s)", describeUpgrade(d))
+		}
+		fmt.Fprintf(w, "%s: %s\n", pos, msg)
+	}
+}
+
+func describeUpgrade(w config.Warning) string {
+	switch w.Upgrade.Action {
+	case config.UpgradeRemove:
+		return "remove " + w.Path.String()
+	case config.UpgradeReplace:
+		return fmt.Sprintf("set %s to %q", w.Path.String(), w.Upgrade.Value)
+	default:
+		return string(w.Upgrade.Action)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"hpc-toolkit/pkg/config"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestWriteDeprecations(c *C) {
+	ctx, err := config.NewYamlCtx([]byte(`blueprint_name: green
+ghpc_version: v1
+deployment_groups:
+- group: zero
+  modules:
+  - id: job
+    source: community/modules/scheduler/cloud-batch-job
+`))
+	c.Assert(err, IsNil)
+	ws := []config.Warning{
+		{Path: config.Root.GhpcVersion, Message: "ghpc_version setting is ignored",
+			Upgrade: &config.Upgrade{Action: config.UpgradeRemove}},
+		{Path: config.Root.Groups.At(0).Modules.At(0).Source, Message: "moved",
+			Upgrade: &config.Upgrade{Action: config.UpgradeReplace, Value: "modules/scheduler/batch-job-template"}},
+		{Path: config.Root.Groups.At(0).Kind, Message: "kind is deprecated", Removal: "v2.0.0"},
+	}
+	var buf bytes.Buffer
+	writeDeprecations(&buf, "bp.yaml", ws, ctx)
+	c.Check(buf.String(), Equals, `bp.yaml:2:1: ghpc_version setting is ignored (fix: remove ghpc_version)
+bp.yaml:7:5: moved (fix: set deployment_groups[0].modules[0].source to "modules/scheduler/batch-job-template")
+bp.yaml: kind is deprecated, to be removed in v2.0.0
+`)
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	mergeCmd.Flags().StringVarP(&mergeOutput, "out", "o", "", "File to write the merged blueprint to, defaults to standard output.")
+	rootCmd.AddCommand(mergeCmd)
+}
+
+var (
+	mergeOutput string
+	mergeCmd    = &cobra.Command{
+		Use:   "merge BASE OURS THEIRS",
+		Short: "Three-way merge of blueprints.",
+		Long: "Merge changes made to blueprint BASE by THEIRS into OURS, matching deployment groups and modules by name " +
+			"and ID rather than by line. Values changed differently by both sides are kept as in OURS, marked with a " +
+			"comment and reported as conflicts, as are references to modules or variables removed by the merge. " +
+			"It can be used as a git merge driver, see cmd/README.md.",
+		Args:         cobra.ExactArgs(3),
+		RunE:         runMergeCmd,
+		SilenceUsage: true,
+	}
+)
+
+func runMergeCmd(cmd *cobra.Command, args []string) error {
+	data := make([][]byte, 3)
+	for i, f := range args {
+		var err error
+		if data[i], err = os.ReadFile(f); err != nil {
+			return err
+		}
+	}
+	merged, conflicts, err := config.MergeBlueprints(data[0], data[1], data[2])
+	if err != nil {
+		return err
+	}
+
+	if mergeOutput == "" {
+		cmd.OutOrStdout().Write(merged)
+	} else if err := os.WriteFile(mergeOutput, merged, 0644); err != nil {
+		return err
+	}
+	for _, c := range conflicts {
+		logging.Error("%s: %s", c.Path, c.Reason)
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%d merge conflict(s) to resolve", len(conflicts))
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"hpc-toolkit/pkg/modulereader"
+	"hpc-toolkit/pkg/sourcereader"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/ext/typeexpr"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	modulesListCmd.Flags().StringVarP(&modulesListFormat, "format", "f", "md", "Output format, one of: json, md")
+	modulesInfoCmd.Flags().StringVarP(&modulesInfoFormat, "format", "f", "json", "Output format, one of: json, md")
+	modulesCmd.AddCommand(modulesListCmd, modulesInfoCmd)
+	rootCmd.AddCommand(modulesCmd)
+}
+
+var (
+	modulesListFormat string
+	modulesInfoFormat string
+	modulesCmd        = &cobra.Command{
+		Use:   "modules",
+		Short: "Describe modules embedded in ghpc.",
+	}
+	modulesListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List modules embedded in ghpc by category.",
+		Long:  "List modules embedded in ghpc with their descriptions, grouped by the category set by their metadata or the directory they are in.",
+		Args:  cobra.NoArgs,
+		RunE:  runModulesListCmd,
+	}
+	modulesInfoCmd = &cobra.Command{
+		Use:   "info SOURCE",
+		Short: "Describe a module for front-ends.",
+		Long: "Describe an embedded or local module with its category, icon, settings grouped as set by its metadata, " +
+			"and outputs, e.g. to render catalogs of modules.",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeModuleSources,
+		RunE:              runModulesInfoCmd,
+	}
+)
+
+type moduleEntryJSON struct {
+	Source      string `json:"source"`
+	Kind        string `json:"kind"`
+	Description string `json:"description,omitempty"`
+	Category    string `json:"category"`
+	Icon        string `json:"icon,omitempty"`
+}
+
+func newModuleEntryJSON(e modulereader.CatalogEntry) moduleEntryJSON {
+	return moduleEntryJSON{Source: e.Source, Kind: e.Kind, Description: e.Description, Category: e.Category, Icon: e.Icon}
+}
+
+type settingJSON struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type"`
+	Description string      `json:"description,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+	Required    bool        `json:"required"`
+	Sensitive   bool        `json:"sensitive,omitempty"`
+}
+
+type settingGroupJSON struct {
+	Title    string        `json:"title"`
+	Settings []settingJSON `json:"settings"`
+}
+
+type moduleOutputJSON struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Sensitive   bool   `json:"sensitive,omitempty"`
+}
+
+type moduleInfoJSON struct {
+	moduleEntryJSON
+	Services      []string           `json:"services"`
+	SettingGroups []settingGroupJSON `json:"setting_groups"`
+	Outputs       []moduleOutputJSON `json:"outputs"`
+}
+
+func runModulesListCmd(cmd *cobra.Command, args []string) error {
+	catalog, err := modulereader.EmbeddedCatalog()
+	if err != nil {
+		return err
+	}
+	out, err := renderModulesList(catalog, modulesListFormat)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(cmd.OutOrStdout(), out)
+	return nil
+}
+
+func renderModulesList(catalog []modulereader.CatalogEntry, format string) (string, error) {
+	switch format {
+	case "json":
+		res := []moduleEntryJSON{}
+		for _, e := range catalog {
+			res = append(res, newModuleEntryJSON(e))
+		}
+		return marshalIndent(res)
+	case "md":
+		return renderModulesListMarkdown(catalog), nil
+	default:
+		return "", fmt.Errorf("unsupported format %q, expected one of: json, md", format)
+	}
+}
+
+// renderModulesListMarkdown lists modules under a heading per category, sorted
+// by category then source
+func renderModulesListMarkdown(catalog []modulereader.CatalogEntry) string {
+	byCat := map[string][]modulereader.CatalogEntry{}
+	for _, e := range catalog {
+		byCat[e.Category] = append(byCat[e.Category], e)
+	}
+	cats := []string{}
+	for c := range byCat {
+		cats = append(cats, c)
+	}
+	sort.Strings(cats)
+
+	var sb strings.Builder
+	for i, c := range cats {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "## %s\n\n", c)
+		for _, e := range byCat[c] {
+			fmt.Fprintf(&sb, "* `%s`", e.Source)
+			if e.Description != "" {
+				fmt.Fprintf(&sb, ": %s", e.Description)
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+func runModulesInfoCmd(cmd *cobra.Command, args []string) error {
+	entry, err := moduleEntry(args[0])
+	if err != nil {
+		return err
+	}
+	info, err := modulereader.GetModuleInfo(entry.Source, entry.Kind)
+	if err != nil {
+		return err
+	}
+	out, err := renderModuleInfo(entry, info, modulesInfoFormat)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(cmd.OutOrStdout(), out)
+	return nil
+}
+
+// moduleEntry describes an embedded module as in the catalog, or a local one
+func moduleEntry(source string) (modulereader.CatalogEntry, error) {
+	if sourcereader.IsLocalPath(source) {
+		kind := "terraform"
+		if pkr, _ := filepath.Glob(filepath.Join(source, "*.pkr.hcl")); len(pkr) > 0 {
+			kind = "packer"
+		}
+		mtd := modulereader.GetMetadataSafe(source)
+		return modulereader.CatalogEntry{
+			Source:   source,
+			Kind:     kind,
+			Category: modulereader.ModuleCategory(source, mtd),
+			Icon:     mtd.Ghpc.Display.Icon,
+		}, nil
+	}
+	catalog, err := modulereader.EmbeddedCatalog()
+	if err != nil {
+		return modulereader.CatalogEntry{}, err
+	}
+	for _, e := range catalog {
+		if e.Source == strings.TrimSuffix(source, "/") {
+			return e, nil
+		}
+	}
+	return modulereader.CatalogEntry{}, fmt.Errorf("%q is neither a module embedded in ghpc nor a local path, see `ghpc modules list`", source)
+}
+
+func renderModuleInfo(entry modulereader.CatalogEntry, info modulereader.ModuleInfo, format string) (string, error) {
+	groups, err := info.SettingGroups()
+	if err != nil {
+		return "", fmt.Errorf("invalid metadata of module %s: %w", entry.Source, err)
+	}
+	switch format {
+	case "json":
+		return renderModuleInfoJSON(entry, info, groups)
+	case "md":
+		return renderModuleInfoMarkdown(entry, info, groups), nil
+	default:
+		return "", fmt.Errorf("unsupported format %q, expected one of: json, md", format)
+	}
+}
+
+func renderModuleInfoJSON(entry modulereader.CatalogEntry, info modulereader.ModuleInfo, groups []modulereader.SettingGroup) (string, error) {
+	res := moduleInfoJSON{
+		moduleEntryJSON: newModuleEntryJSON(entry),
+		Services:        info.Metadata.Spec.Requirements.Services,
+		SettingGroups:   []settingGroupJSON{},
+		Outputs:         []moduleOutputJSON{},
+	}
+	if res.Services == nil {
+		res.Services = []string{}
+	}
+	for _, g := range groups {
+		gj := settingGroupJSON{Title: g.Title, Settings: []settingJSON{}}
+		for _, in := range g.Inputs {
+			gj.Settings = append(gj.Settings, settingJSON{
+				Name:        in.Name,
+				Type:        typeexpr.TypeString(in.Type),
+				Description: in.Description,
+				Default:     in.Default,
+				Required:    in.Required,
+				Sensitive:   in.Sensitive,
+			})
+		}
+		res.SettingGroups = append(res.SettingGroups, gj)
+	}
+	for _, o := range info.Outputs {
+		res.Outputs = append(res.Outputs, moduleOutputJSON{Name: o.Name, Description: o.Description, Sensitive: o.Sensitive})
+	}
+	return marshalIndent(res)
+}
+
+func renderModuleInfoMarkdown(entry modulereader.CatalogEntry, info modulereader.ModuleInfo, groups []modulereader.SettingGroup) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# %s\n\n", entry.Source)
+	if entry.Description != "" {
+		fmt.Fprintf(&sb, "%s\n\n", entry.Description)
+	}
+	fmt.Fprintf(&sb, "Category: %s\n", entry.Category)
+	for _, g := range groups {
+		fmt.Fprintf(&sb, "\n## %s\n\n", g.Title)
+		sb.WriteString("| Name | Type | Required | Description |\n")
+		sb.WriteString("|------|------|----------|-------------|\n")
+		for _, in := range g.Inputs {
+			desc := strings.ReplaceAll(in.Description, "\n", " ")
+			fmt.Fprintf(&sb, "| %s | `%s` | %t | %s |\n", in.Name, typeexpr.TypeString(in.Type), in.Required, desc)
+		}
+	}
+	if len(info.Outputs) > 0 {
+		sb.WriteString("\n## Outputs\n\n")
+		for _, o := range info.Outputs {
+			fmt.Fprintf(&sb, "* `%s`", o.Name)
+			if o.Description != "" {
+				fmt.Fprintf(&sb, ": %s", strings.ReplaceAll(o.Description, "\n", " "))
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+func marshalIndent(v interface{}) (string, error) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"hpc-toolkit/pkg/modulereader"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestRenderModulesList(c *C) {
+	catalog := []modulereader.CatalogEntry{
+		{Source: "community/modules/project/new-project", Description: "Creates a Google Cloud Project.", Kind: "terraform", Category: "project"},
+		{Source: "modules/network/pre-existing-vpc", Kind: "terraform", Category: "network"},
+		{Source: "modules/network/vpc", Description: "Creates a VPC network.", Kind: "terraform", Category: "network", Icon: "lan"},
+	}
+
+	got, err := renderModulesList(catalog, "md")
+	c.Assert(err, IsNil)
+	c.Check(got, Equals, "## network\n\n"+
+		"* `modules/network/pre-existing-vpc`\n"+
+		"* `modules/network/vpc`: Creates a VPC network.\n"+
+		"\n## project\n\n"+
+		"* `community/modules/project/new-project`: Creates a Google Cloud Project.\n")
+
+	got, err = renderModulesList(catalog[2:], "json")
+	c.Assert(err, IsNil)
+	c.Check(got, Equals, `[
+  {
+    "source": "modules/network/vpc",
+    "kind": "terraform",
+    "description": "Creates a VPC network.",
+    "category": "network",
+    "icon": "lan"
+  }
+]
+`)
+
+	_, err = renderModulesList(catalog, "yaml")
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestRenderModuleInfo(c *C) {
+	entry := modulereader.CatalogEntry{Source: "modules/network/vpc", Kind: "terraform", Category: "network"}
+	info := modulereader.ModuleInfo{
+		Inputs: []modulereader.VarInfo{
+			{Name: "project_id", Type: cty.String, Description: "Project", Required: true},
+			{Name: "mtu", Type: cty.Number, Default: 1460},
+		},
+		Outputs: []modulereader.OutputInfo{{Name: "network_name", Description: "Name of the network"}},
+		Metadata: modulereader.Metadata{Ghpc: modulereader.MetadataGhpc{Display: modulereader.MetadataDisplay{
+			SettingGroups: []modulereader.MetadataSettingGroup{{Title: "Network", Settings: []string{"mtu"}}},
+		}}},
+	}
+
+	got, err := renderModuleInfo(entry, info, "json")
+	c.Assert(err, IsNil)
+	c.Check(got, Equals, `{
+  "source": "modules/network/vpc",
+  "kind": "terraform",
+  "category": "network",
+  "services": [],
+  "setting_groups": [
+    {
+      "title": "Network",
+      "settings": [
+        {
+          "name": "mtu",
+          "type": "number",
+          "default": 1460,
+          "required": false
+        }
+      ]
+    },
+    {
+      "title": "Other settings",
+      "settings": [
+        {
+          "name": "project_id",
+          "type": "string",
+          "description": "Project",
+          "required": true
+        }
+      ]
+    }
+  ],
+  "outputs": [
+    {
+      "name": "network_name",
+      "description": "Name of the network"
+    }
+  ]
+}
+`)
+
+	got, err = renderModuleInfo(entry, info, "md")
+	c.Assert(err, IsNil)
+	c.Check(got, Matches, "(?s)# modules/network/vpc\n\nCategory: network\n\n## Network\n.*\\| mtu \\| `number` \\| false \\|.*## Other settings\n.*## Outputs\n\n\\* `network_name`: Name of the network\n")
+
+	info.Metadata.Ghpc.Display.SettingGroups[0].Settings = []string{"zone"}
+	_, err = renderModuleInfo(entry, info, "json")
+	c.Check(err, ErrorMatches, ".*invalid metadata of module modules/network/vpc.*")
+}
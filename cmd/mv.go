@@ -0,0 +1,105 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	mvCmd.Flags().StringVarP(&mvBlueprint, "blueprint", "b", "", "Blueprint to rename the module in.")
+	mvCmd.MarkFlagRequired("blueprint")
+	mvCmd.MarkFlagFilename("blueprint", "yaml", "yml")
+	mvCmd.Flags().StringVar(&mvDeployment, "deployment", "",
+		"Existing deployment of the blueprint, print terraform commands moving the state of the module.")
+	mvCmd.MarkFlagDirname("deployment")
+	rootCmd.AddCommand(mvCmd)
+}
+
+var (
+	mvBlueprint  string
+	mvDeployment string
+	mvCmd        = &cobra.Command{
+		Use:   "mv OLD_ID NEW_ID",
+		Short: "Rename a module of the blueprint.",
+		Long: "Rename a module of the blueprint, rewriting its `use` entries and the expressions referencing it. " +
+			"Comments and formatting of the blueprint are preserved.",
+		Args: cobra.ExactArgs(2),
+		RunE: runMvCmd,
+	}
+)
+
+func runMvCmd(cmd *cobra.Command, args []string) error {
+	from, to := config.ModuleID(args[0]), config.ModuleID(args[1])
+
+	var bp config.Blueprint
+	if mvDeployment != "" { // read the deployment first, not to rename the module if it fails
+		var err error
+		if bp, _, err = config.NewBlueprint(filepath.Join(getArtifactsDir(mvDeployment), modulewriter.ExpandedBlueprintName)); err != nil {
+			return err
+		}
+	}
+
+	info, err := os.Stat(mvBlueprint)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(mvBlueprint)
+	if err != nil {
+		return err
+	}
+	renamed, err := config.RenameModule(data, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to rename module %q in %s: %w", from, mvBlueprint, err)
+	}
+	if err := os.WriteFile(mvBlueprint, renamed, info.Mode().Perm()); err != nil {
+		return err
+	}
+	logging.Info(boldGreen("Module %s was renamed to %s in %s"), from, to, mvBlueprint)
+
+	if mvDeployment != "" {
+		return writeStateMvCommands(cmd.OutOrStdout(), bp, mvDeployment, from, to)
+	}
+	return nil
+}
+
+// writeStateMvCommands explains how to move resources of the renamed module in
+// terraform state, otherwise they are destroyed and recreated on next deploy
+func writeStateMvCommands(w io.Writer, bp config.Blueprint, deplDir string, from config.ModuleID, to config.ModuleID) error {
+	g, err := bp.ModuleGroup(from)
+	if err != nil {
+		return fmt.Errorf("module %q is not part of deployment %s: %w", from, deplDir, err)
+	}
+	if g.Kind() != config.TerraformKind {
+		fmt.Fprintf(w, "Module %s is in %s deployment group %s, it has no terraform state to move.\n", from, g.Kind(), g.Name)
+		return nil
+	}
+	groupDir := modulewriter.GroupDir(deplDir, bp, g.Name)
+	fmt.Fprintln(w, "Run the following commands after updating the deployment with \"ghpc create -w\"")
+	fmt.Fprintln(w, "and before deploying, otherwise resources of the module are destroyed and recreated:")
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "terraform -chdir=%s init\n", groupDir)
+	fmt.Fprintf(w, "terraform -chdir=%s state mv module.%s module.%s\n", groupDir, from, to)
+	return nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"hpc-toolkit/pkg/config"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestWriteStateMvCommands(c *C) {
+	bp := config.Blueprint{DeploymentGroups: []config.DeploymentGroup{
+		{Name: "zero", Modules: []config.Module{{ID: "net", Kind: config.TerraformKind}}},
+		{Name: "one", Modules: []config.Module{{ID: "image", Kind: config.PackerKind}}},
+	}}
+
+	{
+		var buf bytes.Buffer
+		c.Check(writeStateMvCommands(&buf, bp, "dep", "net", "network1"), IsNil)
+		c.Check(buf.String(), Matches, `(?s).*terraform -chdir=dep/zero init\nterraform -chdir=dep/zero state mv module.net module.network1\n`)
+	}
+
+	{
+		var buf bytes.Buffer
+		c.Check(writeStateMvCommands(&buf, bp, "dep", "image", "img"), IsNil)
+		c.Check(buf.String(), Matches, "Module image is in packer deployment group one, it has no terraform state to move.\n")
+	}
+
+	{
+		var buf bytes.Buffer
+		c.Check(writeStateMvCommands(&buf, bp, "dep", "nope", "other"), ErrorMatches, `module "nope" is not part of deployment dep.*`)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"hpc-toolkit/pkg/shell"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	artifactsFlag := "artifacts"
+	planCmd.Flags().StringVarP(&artifactsDir, artifactsFlag, "a", "", "Artifacts output directory (automatically configured if unset)")
+	planCmd.MarkFlagDirname(artifactsFlag)
+	planCmd.Flags().BoolVar(&savePlans, "save", false, "Save plans to the artifacts directory, to be applied by \"ghpc deploy --use-saved-plans\"")
+	rootCmd.AddCommand(planCmd)
+}
+
+var (
+	savePlans bool
+	planCmd   = &cobra.Command{
+		Use:               "plan DEPLOYMENT_DIRECTORY",
+		Short:             "Plan changes to all terraform deployment groups.",
+		Long:              "Plan changes to all terraform deployment groups without applying them, optionally saving the plans for a later deploy.",
+		Args:              cobra.MatchAll(cobra.ExactArgs(1), checkDir),
+		ValidArgsFunction: matchDirs,
+		PreRunE:           parsePlanArgs,
+		RunE:              runPlanCmd,
+		SilenceUsage:      true,
+	}
+)
+
+func parsePlanArgs(cmd *cobra.Command, args []string) error {
+	deploymentRoot = args[0]
+	artifactsDir = getArtifactsDir(deploymentRoot)
+	return shell.CheckWritableDir(artifactsDir)
+}
+
+func runPlanCmd(cmd *cobra.Command, args []string) error {
+	ctx := interruptContext()
+	if err := modulewriter.CheckManifest(artifactsDir); err != nil {
+		return err
+	}
+	expandedBlueprintFile := filepath.Join(artifactsDir, modulewriter.ExpandedBlueprintName)
+	bp, _, err := config.NewBlueprint(expandedBlueprintFile)
+	if err != nil {
+		return err
+	}
+	if err := shell.ValidateDeploymentDirectory(bp, deploymentRoot); err != nil {
+		return err
+	}
+	hash, err := shell.BlueprintHash(expandedBlueprintFile)
+	if err != nil {
+		return err
+	}
+
+	planDir, cleanup, err := planDirectory()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	saved := shell.SavedPlans{BlueprintHash: hash, Plans: []shell.SavedPlan{}}
+	for _, g := range bp.DeploymentGroups {
+		if g.Kind() != config.TerraformKind {
+			logging.Info("Skipping %s deployment group %s, only terraform groups are planned", g.Kind(), g.Name)
+			continue
+		}
+		p, err := planGroup(ctx, bp, g, expandedBlueprintFile, planDir)
+		if err != nil {
+			return err
+		}
+		saved.Plans = append(saved.Plans, p)
+	}
+
+	logging.Info("\n###############################")
+	for _, p := range saved.Plans {
+		summary := p.Summary
+		if !p.Changes {
+			summary = "No changes."
+		}
+		logging.Info("%s: %s", p.Group, summary)
+	}
+	if !savePlans {
+		return nil
+	}
+	if err := shell.WriteSavedPlans(artifactsDir, saved); err != nil {
+		return err
+	}
+	logging.Info("Plans were saved to %s, once approved run %s to apply them",
+		planDir, boldGreen(fmt.Sprintf("%s deploy --use-saved-plans %s", execPath(), deploymentRoot)))
+	return nil
+}
+
+// planDirectory returns the directory plans are written to, a temporary one
+// removed by the returned function unless plans are saved. Plans are only
+// kept if they are saved, either way a previous set of saved plans is stale
+// once the deployment is planned again.
+func planDirectory() (string, func(), error) {
+	if err := shell.RemoveSavedPlans(artifactsDir); err != nil {
+		return "", nil, err
+	}
+	if savePlans {
+		planDir := shell.SavedPlansDir(artifactsDir)
+		return planDir, func() {}, os.MkdirAll(planDir, 0755)
+	}
+	planDir, err := os.MkdirTemp("", "ghpc-plans-")
+	if err != nil {
+		return "", nil, err
+	}
+	return planDir, func() { os.RemoveAll(planDir) }, nil
+}
+
+// planGroup plans changes to the terraform deployment group, writing the plan
+// to planDir
+func planGroup(ctx context.Context, bp config.Blueprint, g config.DeploymentGroup, expandedBlueprintFile string, planDir string) (shell.SavedPlan, error) {
+	groupDir := modulewriter.GroupDir(deploymentRoot, bp, g.Name)
+	if err := setCredentials(ctx, bp); err != nil {
+		return shell.SavedPlan{}, err
+	}
+	removeInputs, err := shell.ImportInputs(ctx, groupDir, artifactsDir, expandedBlueprintFile)
+	if err != nil {
+		return shell.SavedPlan{}, err
+	}
+	defer removeInputs()
+	tf, err := shell.ConfigureTerraform(groupDir)
+	if err != nil {
+		return shell.SavedPlan{}, err
+	}
+	seal, err := shell.OpenLocalState(ctx, tf)
+	if err != nil {
+		return shell.SavedPlan{}, err
+	}
+	defer seal()
+	return shell.SavePlan(ctx, tf, g.Name, planDir)
+}
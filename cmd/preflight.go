@@ -0,0 +1,83 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"hpc-toolkit/pkg/shell"
+	"hpc-toolkit/pkg/validators"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	preflightCmd.Flags().StringVarP(&artifactsDir, "artifacts", "a", "", "Artifacts directory (automatically configured if unset)")
+	preflightCmd.MarkFlagDirname("artifacts")
+	rootCmd.AddCommand(preflightCmd)
+}
+
+var preflightCmd = &cobra.Command{
+	Use:   "preflight DEPLOYMENT_DIRECTORY",
+	Short: "Check that the deployment can be deployed again.",
+	Long: "Run validators of the expanded blueprint of the deployment and check that resources it refers to, " +
+		"but does not create, still exist and can be used with the current credentials: pre-existing VPCs, " +
+		"networks and subnetworks named by self link, service accounts, and buckets named by gs:// URLs or in " +
+		"variables whose names end with \"bucket\" or \"bucket_name\".",
+	Args:              cobra.MatchAll(cobra.ExactArgs(1), checkDir),
+	ValidArgsFunction: matchDirs,
+	PreRunE:           parsePreflightArgs,
+	RunE:              runPreflightCmd,
+	SilenceUsage:      true,
+}
+
+func parsePreflightArgs(cmd *cobra.Command, args []string) error {
+	deploymentRoot = args[0]
+	artifactsDir = getArtifactsDir(deploymentRoot)
+	if isDir, _ := shell.DirInfo(artifactsDir); !isDir {
+		return fmt.Errorf("artifacts path %s is not a directory", artifactsDir)
+	}
+	return nil
+}
+
+func runPreflightCmd(cmd *cobra.Command, args []string) error {
+	if err := modulewriter.CheckManifest(artifactsDir); err != nil {
+		return err
+	}
+	bp, ctx, err := config.NewBlueprint(filepath.Join(artifactsDir, modulewriter.ExpandedBlueprintName))
+	if err != nil {
+		return err
+	}
+	if err := shell.ValidateDeploymentDirectory(bp, deploymentRoot); err != nil {
+		return err
+	}
+
+	failed, warned := validators.Preflight(interruptContext(), bp)
+	if warned != nil {
+		logging.Error(renderError(warned, ctx))
+		logging.Error(boldYellow("Validation failures above were treated as a warning"))
+	}
+	if failed != nil {
+		logging.Error(renderError(failed, ctx))
+		return errors.New("preflight checks failed due to the issues listed above, deploying again would likely fail")
+	}
+	logging.Info(boldGreen("Validators passed and %d external resources exist and can be used"), validators.CountExternalResources(bp))
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"hpc-toolkit/pkg/providers"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	providersCmd.Flags().StringVarP(&providersFormat, "format", "f", "table", "Output format, one of: json, table")
+	rootCmd.AddCommand(providersCmd)
+}
+
+var (
+	providersFormat string
+	providersCmd    = &cobra.Command{
+		Use:   "providers DEPLOYMENT_DIRECTORY",
+		Short: "List terraform providers required by the deployment groups.",
+		Long: "List terraform providers required by modules of the terraform deployment groups, with their version constraints " +
+			"and the versions locked by terraform init. Fails if the constraints of modules of a group can not be met at once.",
+		Args:              cobra.MatchAll(cobra.ExactArgs(1), checkDir),
+		ValidArgsFunction: matchDirs,
+		RunE:              runProvidersCmd,
+		SilenceUsage:      true,
+	}
+)
+
+type providerRequirementJSON struct {
+	Provider    string   `json:"provider"`
+	Group       string   `json:"group"`
+	Module      string   `json:"module"`
+	Constraints []string `json:"constraints"`
+	Locked      string   `json:"locked,omitempty"`
+}
+
+type providersJSON struct {
+	Requirements []providerRequirementJSON `json:"requirements"`
+	Conflicts    []string                  `json:"conflicts"`
+	Uninspected  []string                  `json:"uninspected"`
+}
+
+// terraformGroups returns root directories of groups with terraform modules
+func terraformGroups(deploymentDir string, bp config.Blueprint) []providers.Group {
+	res := []providers.Group{}
+	for _, g := range bp.DeploymentGroups {
+		for _, s := range g.Stages() {
+			if s.Kind() == config.TerraformKind {
+				res = append(res, providers.Group{Name: g.Name, Dir: modulewriter.GroupDir(deploymentDir, bp, g.Name)})
+				break
+			}
+		}
+	}
+	return res
+}
+
+func runProvidersCmd(cmd *cobra.Command, args []string) error {
+	expandedBlueprintFile := filepath.Join(modulewriter.ArtifactsDir(args[0]), modulewriter.ExpandedBlueprintName)
+	bp, _, err := config.NewBlueprint(expandedBlueprintFile)
+	if err != nil {
+		return err
+	}
+	r, err := providers.Find(terraformGroups(args[0], bp))
+	if err != nil {
+		return err
+	}
+
+	switch providersFormat {
+	case "json":
+		out, err := marshalIndent(newProvidersJSON(r))
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(cmd.OutOrStdout(), out)
+	case "table":
+		writeProviders(cmd.OutOrStdout(), r.Requirements)
+		if len(r.Uninspected) > 0 {
+			logging.Info("Modules not inspected, as they are not installed yet, run \"terraform init\" in their group: %s", strings.Join(r.Uninspected, ", "))
+		}
+	default:
+		return fmt.Errorf("unsupported format %q, expected one of: json, table", providersFormat)
+	}
+
+	errs := config.Errors{}
+	for _, c := range r.Conflicts {
+		errs.Add(c)
+	}
+	return errs.OrNil()
+}
+
+func newProvidersJSON(r providers.Report) providersJSON {
+	res := providersJSON{Requirements: []providerRequirementJSON{}, Conflicts: []string{}, Uninspected: r.Uninspected}
+	for _, req := range r.Requirements {
+		cs := req.Constraints
+		if cs == nil {
+			cs = []string{}
+		}
+		res.Requirements = append(res.Requirements, providerRequirementJSON{
+			Provider: req.Provider, Group: string(req.Group), Module: req.Module, Constraints: cs, Locked: req.Locked})
+	}
+	for _, c := range r.Conflicts {
+		res.Conflicts = append(res.Conflicts, c.Error())
+	}
+	if res.Uninspected == nil {
+		res.Uninspected = []string{}
+	}
+	return res
+}
+
+func writeProviders(w io.Writer, reqs []providers.Requirement) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROVIDER\tGROUP\tMODULE\tCONSTRAINTS\tLOCKED")
+	for _, r := range reqs {
+		cs := strings.Join(r.Constraints, ", ")
+		if cs == "" {
+			cs = "any"
+		}
+		locked := r.Locked
+		if locked == "" {
+			locked = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Provider, r.Group, providers.ModuleName(r.Module), cs, locked)
+	}
+	tw.Flush()
+}
@@ -15,9 +15,12 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
 	"hpc-toolkit/pkg/validators"
+	"os"
 	"strings"
 )
 
@@ -89,3 +92,61 @@ func renderPosError(err config.PosError, ctx config.YamlCtx) string {
 
 	return fmt.Sprintf("%s\n%s%s\n%s", renderError(err.Err, ctx), pref, ctx.Lines[line], arrow)
 }
+
+// renderWarnings summarizes warnings grouped by category, pointing to the
+// blueprint line of each one when it is present in the blueprint file
+func renderWarnings(ws []config.Warning, ctx config.YamlCtx) string {
+	if len(ws) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	fixable := false
+	sb.WriteString(boldYellow(fmt.Sprintf("%d warning(s):", len(ws))) + "\n")
+	for _, c := range config.WarningCategories {
+		header := false
+		for _, w := range ws {
+			if w.Category != c {
+				continue
+			}
+			if !header {
+				sb.WriteString(fmt.Sprintf("%s:\n", c))
+				header = true
+			}
+			sb.WriteString("  - " + w.Message)
+			if w.Path != nil {
+				if pos, ok := ctx.Pos(w.Path); ok {
+					sb.WriteString(fmt.Sprintf(" (line %d)", pos.Line))
+				}
+			}
+			if w.Removal != "" {
+				sb.WriteString(fmt.Sprintf(", to be removed in %s", w.Removal))
+			}
+			if w.Upgrade != nil {
+				fixable = true
+			}
+			sb.WriteString("\n")
+		}
+	}
+	if fixable {
+		sb.WriteString("Run \"ghpc lint --fix\" on the blueprint to upgrade deprecated fields.\n")
+	}
+	return sb.String()
+}
+
+// reportWarnings prints the summary of warnings at the end of a command and
+// writes them to the file given by --warnings-json, if any
+func reportWarnings(bp config.Blueprint, ctx config.YamlCtx) {
+	if s := renderWarnings(bp.Warnings(), ctx); s != "" {
+		logging.Error(s)
+	}
+	if warningsJSON == "" {
+		return
+	}
+	ws := bp.Warnings()
+	if ws == nil {
+		ws = []config.Warning{}
+	}
+	b, err := json.MarshalIndent(ws, "", "  ")
+	checkErr(err)
+	checkErr(os.WriteFile(warningsJSON, b, 0644))
+}
@@ -78,3 +78,44 @@ Hint: did you mean 'kale'?
 		})
 	}
 }
+
+func TestRenderWarnings(t *testing.T) {
+	ctx := makeCtx(`
+blueprint_name: green
+vars:
+  kale: dos`, t)
+	ws := []config.Warning{
+		{Category: config.WarningUnused, Path: config.Root.Vars.Dot("kale"), Message: "arbuz"},
+		{Category: config.WarningDeprecated, Path: config.Root.GhpcVersion, Message: "buz"},
+		{Category: config.WarningUnused, Message: "zebra"},
+	}
+	want := `3 warning(s):
+deprecated:
+  - buz
+unused:
+  - arbuz (line 4)
+  - zebra
+`
+	if diff := cmp.Diff(want, renderWarnings(ws, ctx)); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+	if got := renderWarnings(nil, ctx); got != "" {
+		t.Errorf("want no summary for no warnings, got %q", got)
+	}
+
+	ws = []config.Warning{{
+		Category: config.WarningDeprecated,
+		Path:     config.Root.Vars.Dot("kale"),
+		Message:  "kale is deprecated",
+		Removal:  "v2.0.0",
+		Upgrade:  &config.Upgrade{Action: config.UpgradeRemove},
+	}}
+	want = `1 warning(s):
+deprecated:
+  - kale is deprecated (line 4), to be removed in v2.0.0
+Run "ghpc lint --fix" on the blueprint to upgrade deprecated fields.
+`
+	if diff := cmp.Diff(want, renderWarnings(ws, ctx)); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/shell"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	recordFile string
+	replayFile string
+)
+
+func addRecordReplayFlags(c *cobra.Command) {
+	c.Flags().StringVar(&recordFile, "record", "",
+		"Record every terraform and packer command run, with its output, to the given file")
+	c.Flags().StringVar(&replayFile, "replay", "",
+		"Replay terraform and packer commands from a file written by --record instead of running them")
+	c.MarkFlagsMutuallyExclusive("record", "replay")
+}
+
+// startRecordOrReplay records or replays external commands of the deployment,
+// if requested
+func startRecordOrReplay() error {
+	var err error
+	switch {
+	case recordFile != "":
+		err = shell.StartRecording(recordFile, deploymentRoot)
+	case replayFile != "":
+		err = shell.StartReplay(replayFile, deploymentRoot)
+		if err == nil {
+			logging.Info("Replaying terraform and packer commands from %s, no cloud resources are changed", replayFile)
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set up recording or replay of commands: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/shell"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeTerraformScript plans changes to one resource, which it then applies
+// or destroys
+const fakeTerraformScript = `#!/bin/sh
+case "$1" in
+version) echo '{"terraform_version":"1.5.7","platform":"linux_amd64","provider_selections":{}}';;
+plan)
+  for a; do case "$a" in -out=*) echo plan > "${a#-out=}";; esac; done
+  exit 2;;
+apply) echo '{"@level":"info","@message":"null_resource.x: Creation complete","type":"apply_complete"}';;
+output) echo '{}';;
+show) echo '{"format_version":"1.0","terraform_version":"1.5.7","values":{"root_module":{}}}';;
+esac
+`
+
+func (s *MySuite) TestDeployDestroyReplay(c *C) {
+	bin := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(bin, "terraform"), []byte(fakeTerraformScript), 0755), IsNil)
+	pathEnv := os.Getenv("PATH")
+	defer os.Setenv("PATH", pathEnv)
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+pathEnv)
+
+	deploymentRoot, artifactsDir = c.MkDir(), c.MkDir()
+	applyBehavior = shell.AutomaticApply
+	defer func() {
+		deploymentRoot, artifactsDir, recordFile, replayFile = "", "", "", ""
+		applyBehavior = shell.PromptBeforeApply
+		shell.StopCommandShims()
+	}()
+	groupDir := filepath.Join(deploymentRoot, "primary")
+	c.Assert(os.Mkdir(groupDir, 0755), IsNil)
+	group := config.DeploymentGroup{Name: "primary"}
+	ctx := context.Background()
+
+	recordFile = filepath.Join(c.MkDir(), "deploy.jsonl")
+	c.Assert(startRecordOrReplay(), IsNil)
+	c.Assert(deployTerraformGroup(ctx, config.Blueprint{}, groupDir, group.Name), IsNil)
+	c.Assert(destroyTerraformGroup(ctx, groupDir, group), IsNil)
+	shell.StopCommandShims()
+
+	recorded, err := shell.ReadRecording(recordFile)
+	c.Assert(err, IsNil)
+	applies := 0
+	for _, rc := range recorded {
+		c.Check(rc.Dir, Equals, "primary")
+		if rc.Args[0] == "apply" {
+			applies++
+		}
+	}
+	c.Check(applies, Equals, 2) // deploy and destroy
+
+	// replayed without terraform, which is only in PATH while recording
+	os.Setenv("PATH", pathEnv)
+	recordFile, replayFile = "", recordFile
+	c.Assert(startRecordOrReplay(), IsNil)
+	c.Check(deployTerraformGroup(ctx, config.Blueprint{}, groupDir, group.Name), IsNil)
+	c.Check(destroyTerraformGroup(ctx, groupDir, group), IsNil)
+
+	// every recorded command was replayed
+	c.Check(destroyTerraformGroup(ctx, groupDir, group), ErrorMatches, "(?s).*no invocation in primary left to replay.*")
+}
@@ -18,17 +18,26 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"hpc-toolkit/pkg/config"
 	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/notifications"
+	"hpc-toolkit/pkg/shell"
+	"hpc-toolkit/pkg/userconfig"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/spf13/cobra"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 )
 
 // Git references when use Makefile
@@ -61,7 +70,52 @@ func init() {
 	addColorFlag(rootCmd.PersistentFlags())
 	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
 		initColor()
+		path := userconfig.ConfigPath()
+		uc, err := userconfig.LoadConfig(path)
+		if err != nil {
+			logging.Fatal("%v", err)
+		}
+		if err := applyFlagDefaults(cmd, uc); err != nil {
+			logging.Fatal("failed to apply user config %s: %v", path, err)
+		}
+		userConfig = uc
+	}
+}
+
+// userConfig holds defaults from the config file of the user
+var userConfig userconfig.Config
+
+// setCredentials mints short-lived credentials for terraform and packer to run
+// with, those of the user config replace those of the blueprint
+func setCredentials(ctx context.Context, bp config.Blueprint) error {
+	creds := bp.Credentials
+	if len(userConfig.Credentials) > 0 {
+		creds = userConfig.Credentials
 	}
+	return shell.SetCredentials(ctx, creds)
+}
+
+// applyFlagDefaults sets flags of the command that were not given on the
+// command line to the defaults from the user config
+func applyFlagDefaults(cmd *cobra.Command, uc userconfig.Config) error {
+	names := maps.Keys(uc.Flags)
+	slices.Sort(names)
+	for _, n := range names {
+		f := cmd.Flags().Lookup(n)
+		if f == nil || f.Changed {
+			continue
+		}
+		vals, err := uc.FlagValues(n)
+		if err != nil {
+			return err
+		}
+		for _, v := range vals {
+			if err := cmd.Flags().Set(n, v); err != nil {
+				return fmt.Errorf("invalid default of flag %q: %w", n, err)
+			}
+		}
+	}
+	return nil
 }
 
 // Execute the root command
@@ -88,9 +142,21 @@ Commit info: {{index .Annotations "commitInfo"}}
 `)
 	}
 
+	logging.AtExit(sealLocalStates)
+	defer sealLocalStates()
+	logging.AtExit(shell.StopCommandShims)
+	defer shell.StopCommandShims()
 	return rootCmd.Execute()
 }
 
+// sealLocalStates encrypts terraform states of local-encrypted backends that
+// were decrypted while running terraform
+func sealLocalStates() {
+	if err := shell.SealLocalStates(context.Background()); err != nil {
+		logging.Error("%s", err)
+	}
+}
+
 // checkGitHashMismatch will compare the hash of the git repository vs the git
 // hash the ghpc binary was compiled against, if the git repository if found and
 // a mismatch is identified, then the function returns a positive bool along with
@@ -246,6 +312,82 @@ func execPath() string {
 	return args0
 }
 
+// interruptContext returns a context that is cancelled on the first interrupt
+// or termination signal, so running terraform and packer commands can stop
+// gracefully; the next interrupt kills them and terminates ghpc immediately,
+// after encrypting terraform states they left decrypted
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ch
+		logging.Error(boldYellow("Interrupted, waiting for running commands to stop gracefully. Interrupt again to exit immediately."))
+		cancel()
+		<-ch
+		signal.Stop(ch)
+		shell.KillInterruptedCommands()
+		logging.Fatal("Interrupted again, running commands were killed")
+	}()
+	return ctx
+}
+
+// notify sends an event about the deployment to endpoints configured by the
+// user, if any
+func notify(eventType string, bp config.Blueprint, group config.GroupName, err error) {
+	notifications.Notify(userConfig.Notifications, newEvent(eventType, bp, group, err))
+}
+
+func newEvent(eventType string, bp config.Blueprint, group config.GroupName, err error) notifications.Event {
+	e := notifications.Event{
+		Type:        eventType,
+		Blueprint:   bp.BlueprintName,
+		GhpcVersion: bp.GhpcVersion,
+		Group:       string(group),
+	}
+	if bp.Vars.Has("deployment_name") { // absent in blueprints that were not expanded
+		e.Deployment = bp.DeploymentName()
+	}
+	var errs config.Errors
+	if errors.As(err, &errs) {
+		for _, e0 := range errs.Errors {
+			e.Errors = append(e.Errors, e0.Error())
+		}
+	} else if err != nil {
+		e.Errors = []string{err.Error()}
+	}
+	return e
+}
+
+// runReport records outcomes of deployment groups of a deploy or destroy, so
+// that operators of long runs are notified of how it went
+type runReport struct {
+	start  time.Time
+	groups []notifications.GroupSummary
+}
+
+func newRunReport() *runReport {
+	return &runReport{start: time.Now()}
+}
+
+// group records the outcome of the group, started at the given time; the
+// time is zero for groups that were not run
+func (r *runReport) group(name config.GroupName, status string, start time.Time) {
+	g := notifications.GroupSummary{Name: string(name), Status: status}
+	if !start.IsZero() {
+		g.Duration = time.Since(start).Round(time.Second).String()
+	}
+	r.groups = append(r.groups, g)
+}
+
+// notify sends the completion or failure of the run
+func (r *runReport) notify(eventType string, bp config.Blueprint, err error) {
+	e := newEvent(eventType, bp, "", err)
+	e.Duration = time.Since(r.start).Round(time.Second).String()
+	e.Groups = r.groups
+	notifications.Notify(userConfig.Notifications, e)
+}
+
 // checkErr is similar to cobra.CheckErr, but with renderError and logging.Fatal
 // NOTE: this function uses empty YamlCtx, so if you have one, use renderError directly.
 func checkErr(err error) {
@@ -17,6 +17,8 @@ limitations under the License.
 package cmd
 
 import (
+	"hpc-toolkit/pkg/shell"
+	"hpc-toolkit/pkg/userconfig"
 	"os"
 	"path/filepath"
 	"testing"
@@ -28,6 +30,7 @@ import (
 	"github.com/go-git/go-git/v5/plumbing/cache"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/spf13/cobra"
 	. "gopkg.in/check.v1"
 )
 
@@ -42,6 +45,10 @@ func Test(t *testing.T) {
 }
 
 func TestMain(m *testing.M) {
+	// the test binary stands for terraform when replaying commands, as ghpc does
+	if code, ok := shell.CommandShim(); ok {
+		os.Exit(code)
+	}
 	wd, _ := os.Getwd()
 	code := m.Run()
 	os.Chdir(wd)
@@ -247,3 +254,30 @@ func initTestRepo(path string) (repo *git.Repository, initHash plumbing.Hash, er
 	_, err = commit("Last")
 	return
 }
+
+func (s *MySuite) TestApplyFlagDefaults(c *C) {
+	var out, level string
+	var skip []string
+	cmd := &cobra.Command{}
+	cmd.Flags().StringVarP(&out, "out", "o", "", "")
+	cmd.Flags().StringVarP(&level, "validation-level", "l", "WARNING", "")
+	cmd.Flags().StringSliceVar(&skip, "skip-validators", nil, "")
+	c.Assert(cmd.Flags().Parse([]string{"-l", "IGNORE"}), IsNil)
+
+	uc := userconfig.Config{Flags: map[string]interface{}{
+		"out":              "/deployments",
+		"validation-level": "ERROR",
+		"skip-validators":  []interface{}{"test_apis_enabled", "test_region_exists"},
+		"auto-approve":     true, // not a flag of the command
+	}}
+	c.Assert(applyFlagDefaults(cmd, uc), IsNil)
+	c.Check(out, Equals, "/deployments")
+	c.Check(level, Equals, "IGNORE") // given on the command line
+	c.Check(skip, DeepEquals, []string{"test_apis_enabled", "test_region_exists"})
+
+	var count int
+	cmd = &cobra.Command{}
+	cmd.Flags().IntVar(&count, "count", 0, "")
+	uc = userconfig.Config{Flags: map[string]interface{}{"count": "many"}}
+	c.Check(applyFlagDefaults(cmd, uc), ErrorMatches, `invalid default of flag "count".*`)
+}
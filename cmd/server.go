@@ -0,0 +1,306 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/validators"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+func init() {
+	serverCmd.Flags().StringVar(&serverListen, "listen", "127.0.0.1:8080", "Address the server listens on")
+	serverCmd.Flags().StringVar(&serverDeploymentsDir, "deployments-dir", "",
+		"Directory of the deployment directories POST /deploy deploys, /deploy is disabled if not set")
+	rootCmd.AddCommand(serverCmd)
+}
+
+var (
+	serverListen         string
+	serverDeploymentsDir string
+	serverCmd            = &cobra.Command{
+		Use:   "server",
+		Short: "Serve blueprint expansion and deployments over HTTP.",
+		Long: "Serve POST /expand, expanding and validating the blueprint of the request body, and, with " +
+			"--deployments-dir, POST /deploy?deployment=NAME, deploying a deployment directory of it. " +
+			"Both require the bearer token of the " + ServerTokenEnvVar + " environment variable and are " +
+			"not served without it. /healthz and /readyz report liveness and readiness, /metrics exports " +
+			"Prometheus metrics.",
+		Args:         cobra.NoArgs,
+		RunE:         runServerCmd,
+		SilenceUsage: true,
+	}
+)
+
+// ServerTokenEnvVar is the environment variable with the bearer token clients
+// of POST /expand and POST /deploy must send
+const ServerTokenEnvVar = "GHPC_SERVER_TOKEN"
+
+// maxBlueprintSize is the largest blueprint POST /expand accepts
+const maxBlueprintSize = 10 << 20
+
+func runServerCmd(cmd *cobra.Command, args []string) error {
+	ctx := interruptContext()
+	s := newServer(serverDeploymentsDir, os.Getenv(ServerTokenEnvVar))
+	if s.token == "" {
+		logging.Error("%s is not set, only serving /healthz, /readyz and /metrics", ServerTokenEnvVar)
+	}
+	validators.ObserveLatency = s.metrics.observeValidator
+	srv := &http.Server{Addr: serverListen, Handler: s.handler()}
+
+	go func() {
+		<-ctx.Done()
+		// load balancers stop sending requests before the server stops
+		s.ready.Store(false)
+		sctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		srv.Shutdown(sctx)
+	}()
+	s.ready.Store(true)
+	logging.Info("Listening on %s", serverListen)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// server serves expansion and deployments of blueprints to clients sending
+// the token, probes and metrics are served to all
+type server struct {
+	deploymentsDir string
+	token          string
+	ready          atomic.Bool
+	metrics        *serverMetrics
+}
+
+func newServer(deploymentsDir string, token string) *server {
+	return &server{deploymentsDir: deploymentsDir, token: token, metrics: newServerMetrics()}
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.metrics.write(w)
+	})
+	if s.token == "" {
+		return mux
+	}
+	mux.HandleFunc("/expand", s.authorized(s.expand))
+	if s.deploymentsDir != "" {
+		mux.HandleFunc("/deploy", s.authorized(s.deploy))
+	}
+	return mux
+}
+
+// authorized serves requests with the bearer token of the server only
+func (s *server) authorized(h http.HandlerFunc) http.HandlerFunc {
+	want := []byte("Bearer " + s.token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// expand expands and validates the blueprint of the request body, it responds
+// with the expanded blueprint. Data sources are not fetched, not to give
+// clients what the credentials of the server can read.
+func (s *server) expand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dir, err := os.MkdirTemp("", "ghpc-server-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	bpFile := filepath.Join(dir, "blueprint.yaml")
+	if err := writeRequestBody(w, r, bpFile); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bp, ctx, err := config.NewBlueprint(bpFile)
+	if err == nil {
+		bp.GhpcVersion = GitCommitInfo
+		bp.DisableDataSources()
+		start := time.Now()
+		err = bp.Expand()
+		s.metrics.observeExpansion(time.Since(start))
+	}
+	if err == nil {
+		err, _ = validators.Execute(r.Context(), bp)
+	}
+	if err != nil {
+		http.Error(w, renderError(err, ctx), http.StatusUnprocessableEntity)
+		return
+	}
+
+	expanded := filepath.Join(dir, "expanded.yaml")
+	if err := bp.Export(expanded); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	http.ServeFile(w, r, expanded)
+}
+
+func writeRequestBody(w http.ResponseWriter, r *http.Request, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, http.MaxBytesReader(w, r.Body, maxBlueprintSize))
+	return err
+}
+
+// deploy deploys a deployment directory of the deployments directory with
+// "ghpc deploy --auto-approve", it responds with its output
+func (s *server) deploy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("deployment")
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		http.Error(w, "deployment must be the name of a deployment directory", http.StatusBadRequest)
+		return
+	}
+	dir := filepath.Join(s.deploymentsDir, name)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		http.Error(w, fmt.Sprintf("deployment %s not found", name), http.StatusNotFound)
+		return
+	}
+	ghpc, err := os.Executable()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer s.metrics.deployStarted()()
+	out, err := exec.CommandContext(r.Context(), ghpc, "deploy", dir, "--auto-approve").CombinedOutput()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write(out)
+}
+
+// summary is a Prometheus summary without quantiles
+type summary struct {
+	sum   float64
+	count uint64
+}
+
+func (s *summary) observe(d time.Duration) {
+	s.sum += d.Seconds()
+	s.count++
+}
+
+// serverMetrics are metrics of the server, exported in the Prometheus text
+// format
+type serverMetrics struct {
+	mu              sync.Mutex
+	expansion       summary
+	validators      map[string]*summary
+	deploysInFlight int
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{validators: map[string]*summary{}}
+}
+
+func (m *serverMetrics) observeExpansion(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expansion.observe(d)
+}
+
+func (m *serverMetrics) observeValidator(name string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.validators[name]; !ok {
+		m.validators[name] = &summary{}
+	}
+	m.validators[name].observe(d)
+}
+
+// deployStarted counts a deploy in flight, until the returned function is
+// called
+func (m *serverMetrics) deployStarted() func() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deploysInFlight++
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.deploysInFlight--
+	}
+}
+
+func (m *serverMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintln(w, "# HELP ghpc_expansion_duration_seconds Time spent expanding blueprints.")
+	fmt.Fprintln(w, "# TYPE ghpc_expansion_duration_seconds summary")
+	fmt.Fprintf(w, "ghpc_expansion_duration_seconds_sum %g\n", m.expansion.sum)
+	fmt.Fprintf(w, "ghpc_expansion_duration_seconds_count %d\n", m.expansion.count)
+
+	fmt.Fprintln(w, "# HELP ghpc_validator_duration_seconds Time spent running validators.")
+	fmt.Fprintln(w, "# TYPE ghpc_validator_duration_seconds summary")
+	names := maps.Keys(m.validators)
+	slices.Sort(names)
+	for _, n := range names {
+		fmt.Fprintf(w, "ghpc_validator_duration_seconds_sum{validator=%q} %g\n", n, m.validators[n].sum)
+		fmt.Fprintf(w, "ghpc_validator_duration_seconds_count{validator=%q} %d\n", n, m.validators[n].count)
+	}
+
+	fmt.Fprintln(w, "# HELP ghpc_deploys_in_flight Deployments being deployed.")
+	fmt.Fprintln(w, "# TYPE ghpc_deploys_in_flight gauge")
+	fmt.Fprintf(w, "ghpc_deploys_in_flight %d\n", m.deploysInFlight)
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"hpc-toolkit/pkg/validators"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+const testServerToken = "s3cr3t"
+
+func serve(c *C, h http.Handler, method string, path string, body string) (int, string) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testServerToken)
+	h.ServeHTTP(rec, req)
+	b, err := io.ReadAll(rec.Result().Body)
+	c.Assert(err, IsNil)
+	return rec.Code, string(b)
+}
+
+func (s *MySuite) TestServerHealth(c *C) {
+	srv := newServer("", testServerToken)
+	h := srv.handler()
+
+	code, _ := serve(c, h, http.MethodGet, "/healthz", "")
+	c.Check(code, Equals, http.StatusOK)
+	code, _ = serve(c, h, http.MethodGet, "/readyz", "")
+	c.Check(code, Equals, http.StatusServiceUnavailable)
+	srv.ready.Store(true)
+	code, _ = serve(c, h, http.MethodGet, "/readyz", "")
+	c.Check(code, Equals, http.StatusOK)
+
+	// deploys are only served with a deployments directory
+	code, _ = serve(c, h, http.MethodPost, "/deploy?deployment=d", "")
+	c.Check(code, Equals, http.StatusNotFound)
+	code, _ = serve(c, newServer(c.MkDir(), testServerToken).handler(), http.MethodPost, "/deploy?deployment=..", "")
+	c.Check(code, Equals, http.StatusBadRequest)
+}
+
+func (s *MySuite) TestServerAuthorization(c *C) {
+	bp := "blueprint_name: bp\nvars: {deployment_name: dep}\ndeployment_groups: []\n"
+	h := newServer(c.MkDir(), testServerToken).handler()
+	for _, auth := range []string{"", "Bearer wrong", testServerToken} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/expand", strings.NewReader(bp))
+		req.Header.Set("Authorization", auth)
+		h.ServeHTTP(rec, req)
+		c.Check(rec.Code, Equals, http.StatusUnauthorized, Commentf("%q", auth))
+	}
+
+	// without a token only probes and metrics are served
+	h = newServer(c.MkDir(), "").handler()
+	for _, p := range []string{"/expand", "/deploy?deployment=d"} {
+		code, _ := serve(c, h, http.MethodPost, p, bp)
+		c.Check(code, Equals, http.StatusNotFound, Commentf(p))
+	}
+	code, _ := serve(c, h, http.MethodGet, "/healthz", "")
+	c.Check(code, Equals, http.StatusOK)
+}
+
+func (s *MySuite) TestServerExpand(c *C) {
+	srv := newServer("", testServerToken)
+	validators.ObserveLatency = srv.metrics.observeValidator
+	defer func() { validators.ObserveLatency = nil }()
+	h := srv.handler()
+
+	mod := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(mod, "main.tf"), []byte(`variable "x" {}`), 0644), IsNil)
+
+	code, body := serve(c, h, http.MethodPost, "/expand", `
+blueprint_name: bp
+validation_level: 1 # project validators warn of the missing project_id
+vars:
+  deployment_name: dep
+deployment_groups:
+- group: zero
+  modules:
+  - id: m
+    source: `+mod+`
+    settings: {x: 1}
+`)
+	c.Assert(code, Equals, http.StatusOK, Commentf(body))
+	c.Check(body, Matches, "(?s).*blueprint_name: bp.*")
+
+	code, body = serve(c, h, http.MethodPost, "/expand", `
+blueprint_name: bp
+vars:
+  deployment_name: dep
+data_sources:
+- name: token
+  type: http_json
+  inputs: {url: "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"}
+deployment_groups: []
+`)
+	c.Check(code, Equals, http.StatusUnprocessableEntity)
+	c.Check(body, Matches, "(?s).*data sources are disabled.*")
+
+	code, _ = serve(c, h, http.MethodPost, "/expand", "blueprint_name: [")
+	c.Check(code, Equals, http.StatusUnprocessableEntity)
+	code, _ = serve(c, h, http.MethodGet, "/expand", "")
+	c.Check(code, Equals, http.StatusMethodNotAllowed)
+
+	_, metrics := serve(c, h, http.MethodGet, "/metrics", "")
+	c.Check(metrics, Matches, "(?s).*\nghpc_expansion_duration_seconds_count 2\n.*")
+	c.Check(metrics, Matches, `(?s).*\nghpc_validator_duration_seconds_count\{validator="test_module_not_used"\} 1\n.*`)
+	c.Check(metrics, Matches, "(?s).*\nghpc_deploys_in_flight 0\n.*")
+}
+
+func (s *MySuite) TestServerMetrics(c *C) {
+	m := newServerMetrics()
+	m.observeExpansion(2 * time.Second)
+	m.observeValidator("b", time.Second)
+	m.observeValidator("a", time.Second)
+	m.observeValidator("a", time.Second)
+	done := m.deployStarted()
+
+	var sb strings.Builder
+	m.write(&sb)
+	c.Check(sb.String(), Equals, `# HELP ghpc_expansion_duration_seconds Time spent expanding blueprints.
+# TYPE ghpc_expansion_duration_seconds summary
+ghpc_expansion_duration_seconds_sum 2
+ghpc_expansion_duration_seconds_count 1
+# HELP ghpc_validator_duration_seconds Time spent running validators.
+# TYPE ghpc_validator_duration_seconds summary
+ghpc_validator_duration_seconds_sum{validator="a"} 2
+ghpc_validator_duration_seconds_count{validator="a"} 2
+ghpc_validator_duration_seconds_sum{validator="b"} 1
+ghpc_validator_duration_seconds_count{validator="b"} 1
+# HELP ghpc_deploys_in_flight Deployments being deployed.
+# TYPE ghpc_deploys_in_flight gauge
+ghpc_deploys_in_flight 1
+`)
+
+	done()
+	sb.Reset()
+	m.write(&sb)
+	c.Check(sb.String(), Matches, "(?s).*\nghpc_deploys_in_flight 0\n")
+}
@@ -0,0 +1,170 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"hpc-toolkit/pkg/shell"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slices"
+)
+
+func init() {
+	for _, c := range []*cobra.Command{stateListCmd, stateRestoreCmd} {
+		c.Flags().StringVarP(&artifactsDir, "artifacts", "a", "", "Artifacts output directory (automatically configured if unset)")
+		c.MarkFlagDirname("artifacts")
+		stateCmd.AddCommand(c)
+	}
+	stateRestoreCmd.Flags().StringVar(&restoreSnapshot, "snapshot", "", "Name of the snapshot to restore, the latest one if unset")
+	stateRestoreCmd.Flags().BoolVar(&autoApprove, "auto-approve", false, "Restore the snapshot without asking for confirmation")
+	rootCmd.AddCommand(stateCmd)
+}
+
+var (
+	restoreSnapshot string
+	stateCmd        = &cobra.Command{
+		Use:   "state",
+		Short: "Manage snapshots of terraform state of deployment groups.",
+		Long: "Manage snapshots of terraform state of deployment groups. " +
+			"Snapshots are taken by deploy and destroy before deployment groups are changed.",
+	}
+	stateListCmd = &cobra.Command{
+		Use:               "list DEPLOYMENT_DIRECTORY GROUP",
+		Short:             "List state snapshots of the deployment group, oldest first.",
+		Args:              cobra.MatchAll(cobra.ExactArgs(2), checkDir),
+		ValidArgsFunction: matchDirs,
+		PreRunE:           parseStateArgs,
+		RunE:              runStateListCmd,
+		SilenceUsage:      true,
+	}
+	stateRestoreCmd = &cobra.Command{
+		Use:   "restore DEPLOYMENT_DIRECTORY GROUP",
+		Short: "Restore terraform state of the deployment group from a snapshot.",
+		Long: "Restore terraform state of the deployment group from a snapshot. " +
+			"The current state is backed up before it is replaced, so restoring can be undone.",
+		Args:              cobra.MatchAll(cobra.ExactArgs(2), checkDir),
+		ValidArgsFunction: matchDirs,
+		PreRunE:           parseStateArgs,
+		RunE:              runStateRestoreCmd,
+		SilenceUsage:      true,
+	}
+)
+
+func parseStateArgs(cmd *cobra.Command, args []string) error {
+	deploymentRoot = args[0]
+	artifactsDir = getArtifactsDir(deploymentRoot)
+	if isDir, _ := shell.DirInfo(artifactsDir); !isDir {
+		return fmt.Errorf("artifacts path %s is not a directory", artifactsDir)
+	}
+	return nil
+}
+
+// stateGroup returns the terraform deployment group named in args
+func stateGroup(args []string) (config.Blueprint, config.DeploymentGroup, error) {
+	bp, _, err := config.NewBlueprint(filepath.Join(artifactsDir, modulewriter.ExpandedBlueprintName))
+	if err != nil {
+		return config.Blueprint{}, config.DeploymentGroup{}, err
+	}
+	g, err := bp.Group(config.GroupName(args[1]))
+	if err != nil {
+		return config.Blueprint{}, config.DeploymentGroup{}, err
+	}
+	if g.Kind() != config.TerraformKind {
+		return config.Blueprint{}, config.DeploymentGroup{}, fmt.Errorf("deployment group %s is of kind %s, it has no terraform state", g.Name, g.Kind())
+	}
+	return bp, g, nil
+}
+
+func runStateListCmd(cmd *cobra.Command, args []string) error {
+	_, g, err := stateGroup(args)
+	if err != nil {
+		return err
+	}
+	names, err := shell.StateSnapshots(interruptContext(), g.Name, artifactsDir)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		logging.Info("No state snapshots of deployment group %s", g.Name)
+	}
+	for _, n := range names {
+		fmt.Fprintln(cmd.OutOrStdout(), n)
+	}
+	return nil
+}
+
+func runStateRestoreCmd(cmd *cobra.Command, args []string) error {
+	ctx := interruptContext()
+	bp, g, err := stateGroup(args)
+	if err != nil {
+		return err
+	}
+	names, err := shell.StateSnapshots(ctx, g.Name, artifactsDir)
+	if err != nil {
+		return err
+	}
+	name, err := pickSnapshot(names, restoreSnapshot)
+	if err != nil {
+		return fmt.Errorf("can not restore state of deployment group %s: %w", g.Name, err)
+	}
+
+	if !autoApprove {
+		c := shell.ProposedChanges{
+			Summary: fmt.Sprintf("Proposed change: replace terraform state of deployment group %s with snapshot %s", g.Name, name),
+			Full:    fmt.Sprintf("Proposed change: replace terraform state of deployment group %s with snapshot %s", g.Name, name),
+		}
+		if !shell.ApplyChangesChoice(c) {
+			return nil
+		}
+	}
+
+	if err := setCredentials(ctx, bp); err != nil {
+		return err
+	}
+	tf, err := shell.ConfigureTerraform(modulewriter.GroupDir(deploymentRoot, bp, g.Name))
+	if err != nil {
+		return err
+	}
+	seal, err := shell.OpenLocalState(ctx, tf)
+	if err != nil {
+		return err
+	}
+	defer seal()
+	if err := shell.RestoreState(ctx, tf, g.Name, artifactsDir, name); err != nil {
+		return err
+	}
+	logging.Info(boldGreen("Terraform state of deployment group %s was restored from snapshot %s"), g.Name, name)
+	return nil
+}
+
+// pickSnapshot returns the snapshot to restore, the latest one by default
+func pickSnapshot(names []string, want string) (string, error) {
+	if len(names) == 0 {
+		return "", fmt.Errorf("there are no state snapshots")
+	}
+	if want == "" {
+		return names[len(names)-1], nil
+	}
+	if !slices.Contains(names, want) {
+		return "", fmt.Errorf("snapshot %q does not exist, see \"ghpc state list\" for available snapshots", want)
+	}
+	return want, nil
+}
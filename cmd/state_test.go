@@ -0,0 +1,37 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestPickSnapshot(c *C) {
+	names := []string{"20241001T100000Z-aaaa0000.tfstate", "20241002T100000Z-bbbb0000.tfstate"}
+
+	got, err := pickSnapshot(names, "")
+	c.Check(err, IsNil)
+	c.Check(got, Equals, names[1])
+
+	got, err = pickSnapshot(names, names[0])
+	c.Check(err, IsNil)
+	c.Check(got, Equals, names[0])
+
+	_, err = pickSnapshot(names, "20241003T100000Z-cccc0000.tfstate")
+	c.Check(err, ErrorMatches, `snapshot ".*" does not exist.*`)
+
+	_, err = pickSnapshot(nil, "")
+	c.Check(err, ErrorMatches, "there are no state snapshots")
+}
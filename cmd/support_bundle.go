@@ -0,0 +1,72 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/shell"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const supportBundleDesc = "On failure, collect the redacted expanded blueprint, terraform and ghpc logs, " +
+	"provider versions and environment diagnostics into a tarball in the artifacts directory, to attach to bug reports"
+
+var (
+	supportBundle bool
+	supportLog    bytes.Buffer // output of ghpc, kept while --support-bundle is set
+)
+
+func addSupportBundleFlag(c *cobra.Command) {
+	c.Flags().BoolVar(&supportBundle, "support-bundle", false, supportBundleDesc)
+}
+
+// startSupportBundle keeps output of ghpc and terraform logs of the command,
+// if a support bundle is requested
+func startSupportBundle() error {
+	if !supportBundle {
+		return nil
+	}
+	logging.CopyTo(&supportLog)
+	return shell.EnableTerraformLogs(artifactsDir)
+}
+
+// reportFailure writes the support bundle of the failed command, or tells
+// how to get one
+func reportFailure(ctx context.Context, cmd *cobra.Command, bp config.Blueprint, err error) {
+	if !supportBundle {
+		logging.Error("To collect diagnostics of this failure for a bug report, run %s again with %s",
+			cmd.Name(), boldGreen("--support-bundle"))
+		return
+	}
+	// the bundle is still written if the command was interrupted
+	p, werr := shell.WriteSupportBundle(context.WithoutCancel(ctx), bp, deploymentRoot, artifactsDir, shell.SupportBundle{
+		Command:     strings.TrimSpace(fmt.Sprintf("%s %s", cmd.Name(), deploymentRoot)),
+		GhpcVersion: rootCmd.Version,
+		Err:         err,
+		Log:         supportLog.Bytes(),
+	})
+	if werr != nil {
+		logging.Error("Failed to write support bundle: %v", werr)
+		return
+	}
+	logging.Error("Support bundle written to %s, review it before attaching it to a bug report", boldGreen(p))
+}
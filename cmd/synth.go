@@ -0,0 +1,53 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	synthCmd.Flags().IntVar(&synthOpts.Groups, "groups", 3, "Number of deployment groups.")
+	synthCmd.Flags().IntVar(&synthOpts.Modules, "modules", 10, "Number of modules per deployment group.")
+	synthCmd.Flags().IntVar(&synthOpts.References, "references", 50, "Number of references to outputs of other modules.")
+	synthCmd.Flags().StringVarP(&synthOutput, "out", "o", "synth.yaml", "Output file for the synthetic blueprint.")
+	rootCmd.AddCommand(synthCmd)
+}
+
+var (
+	synthOpts   config.SynthOptions
+	synthOutput string
+	synthCmd    = &cobra.Command{
+		Use:   "synth",
+		Short: "Generate a synthetic blueprint of a given size.",
+		Long: "Generate a blueprint of a given number of deployment groups, modules and references between modules, " +
+			"to measure performance of ghpc on large deployments. Intended for development of ghpc.",
+		Args:   cobra.NoArgs,
+		Run:    runSynthCmd,
+		Hidden: true,
+	}
+)
+
+func runSynthCmd(cmd *cobra.Command, args []string) {
+	bp, err := config.SynthBlueprint(synthOpts)
+	checkErr(err)
+	checkErr(bp.Export(synthOutput))
+	logging.Info("Synthetic blueprint %s created with %d groups of %d modules and %d references.",
+		synthOutput, synthOpts.Groups, synthOpts.Modules, synthOpts.References)
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"hpc-toolkit/pkg/shell"
+	"hpc-toolkit/pkg/validators"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	verifyCmd.Flags().StringVarP(&artifactsDir, "artifacts", "a", "", "Artifacts directory (automatically configured if unset)")
+	verifyCmd.MarkFlagDirname("artifacts")
+	rootCmd.AddCommand(verifyCmd)
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify DEPLOYMENT_DIRECTORY",
+	Short: "Run post-deploy validators of the deployment.",
+	Long: "Run validators of the blueprint whose inputs refer to module outputs. Outputs are read from the " +
+		"artifacts exported by deploy, so the groups the validators depend on must be deployed.",
+	Args:              cobra.MatchAll(cobra.ExactArgs(1), checkDir),
+	ValidArgsFunction: matchDirs,
+	PreRunE:           parseVerifyArgs,
+	RunE:              runVerifyCmd,
+	SilenceUsage:      true,
+}
+
+func parseVerifyArgs(cmd *cobra.Command, args []string) error {
+	deploymentRoot = args[0]
+	artifactsDir = getArtifactsDir(deploymentRoot)
+	if isDir, _ := shell.DirInfo(artifactsDir); !isDir {
+		return fmt.Errorf("artifacts path %s is not a directory", artifactsDir)
+	}
+	return nil
+}
+
+func runVerifyCmd(cmd *cobra.Command, args []string) error {
+	if err := modulewriter.CheckManifest(artifactsDir); err != nil {
+		return err
+	}
+	bp, ctx, err := config.NewBlueprint(filepath.Join(artifactsDir, modulewriter.ExpandedBlueprintName))
+	if err != nil {
+		return err
+	}
+	if countPostDeploy(bp) == 0 {
+		logging.Info("No post-deploy validators to run, i.e. validators with inputs referring to module outputs")
+		return nil
+	}
+	runCtx := interruptContext()
+	outputs, err := shell.DeployedOutputs(runCtx, bp, artifactsDir)
+	if err != nil {
+		return err
+	}
+
+	failed, warned := validators.Verify(runCtx, bp, outputs)
+	if warned != nil {
+		logging.Error(renderError(warned, ctx))
+		logging.Error(boldYellow("Post-deploy validation failures above were treated as a warning"))
+	}
+	if failed != nil {
+		logging.Error(renderError(failed, ctx))
+		return errors.New("post-deploy validation failed due to the issues listed above")
+	}
+	if warned == nil {
+		logging.Info(boldGreen("All %d post-deploy validators passed"), countPostDeploy(bp))
+	}
+	return nil
+}
+
+func countPostDeploy(bp config.Blueprint) int {
+	n := 0
+	for _, v := range bp.Validators {
+		if v.PostDeploy() && !v.Skip && v.ValidationLevel(bp.ValidationLevel) != config.ValidationIgnore {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,351 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"hpc-toolkit/pkg/shell"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/exp/slices"
+)
+
+func init() {
+	watchCmd.Flags().StringVarP(&deploymentFile, "deployment-file", "d", "", "Toolkit Deployment File.")
+	watchCmd.Flags().MarkHidden("deployment-file")
+	watchCmd.Flags().StringVarP(&outputDir, "out", "o", "", "Sets the output directory where the HPC deployment directory will be created.")
+	watchCmd.Flags().StringSliceVar(&cliVariables, "vars", nil, msgCLIVars)
+	watchCmd.Flags().StringArrayVar(&cliVars, "var", nil, msgCLIVar)
+	watchCmd.Flags().StringArrayVar(&cliVarFiles, "var-json", nil, msgCLIVarJSON)
+	watchCmd.Flags().StringSliceVar(&cliBEConfigVars, "backend-config", nil, msgCLIBackendConfig)
+	watchCmd.Flags().StringVarP(&validationLevel, "validation-level", "l", "WARNING", validationLevelDesc)
+	watchCmd.Flags().StringSliceVar(&validatorsToSkip, "skip-validators", nil, skipValidatorsDesc)
+	watchCmd.Flags().StringSliceVar(&expansionsToSkip, "skip-expansions", nil, skipExpansionsDesc)
+	watchCmd.Flags().DurationVar(&watchInterval, "interval", 10*time.Minute, "Time between reconciliations")
+	watchCmd.Flags().BoolVar(&autoApprove, "auto-approve", false,
+		"Apply changes found by reconciliations; otherwise they are saved as plans for \"ghpc deploy --use-saved-plans\"")
+	rootCmd.AddCommand(watchCmd)
+}
+
+// watchPassedFlags are flags of watch given as is to expand and create
+var watchPassedFlags = []string{
+	"deployment-file", "vars", "var", "var-json", "backend-config", "validation-level", "skip-validators", "skip-expansions"}
+
+var (
+	watchInterval time.Duration
+	watchCmd      = &cobra.Command{
+		Use:   "watch BLUEPRINT_NAME [BLUEPRINT_NAME...]",
+		Short: "Continuously reconcile a deployment with its blueprint.",
+		Long: "Repeatedly expand the blueprint, update the deployment directory, plan changes against the deployed " +
+			"infrastructure and, with --auto-approve, apply them. Only one watcher reconciles a deployment at a " +
+			"time, the others wait for its lease, kept with the state of the gcs terraform backend, to expire.",
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: filterYamls,
+		PreRunE:           parseWatchArgs,
+		RunE:              runWatchCmd,
+		SilenceUsage:      true,
+	}
+)
+
+func parseWatchArgs(cmd *cobra.Command, args []string) error {
+	if watchInterval < time.Minute {
+		return fmt.Errorf("--interval must be at least 1m, got %s", watchInterval)
+	}
+	return nil
+}
+
+func runWatchCmd(cmd *cobra.Command, args []string) error {
+	ctx := interruptContext()
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	w := watcher{
+		blueprints: args,
+		flags:      passedFlags(cmd.Flags(), watchPassedFlags),
+		holder:     fmt.Sprintf("%s:%d", host, os.Getpid()),
+		// renewed while reconciling, the lease outlives the wait until the next one
+		ttl: 2 * watchInterval,
+	}
+	defer w.release()
+
+	for {
+		start := time.Now()
+		if err := w.reconcile(ctx); err != nil {
+			logging.Error("Reconciliation failed: %v", err)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		next := start.Add(watchInterval)
+		logging.Info("Next reconciliation at %s", next.Format(time.Kitchen))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// passedFlags returns the flags, among names, given on the command line, as
+// arguments of another ghpc command
+func passedFlags(fs *pflag.FlagSet, names []string) []string {
+	res := []string{}
+	fs.Visit(func(f *pflag.Flag) {
+		if !slices.Contains(names, f.Name) {
+			return
+		}
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			for _, v := range sv.GetSlice() {
+				res = append(res, fmt.Sprintf("--%s=%s", f.Name, v))
+			}
+			return
+		}
+		res = append(res, fmt.Sprintf("--%s=%s", f.Name, f.Value.String()))
+	})
+	return res
+}
+
+type watcher struct {
+	blueprints []string
+	flags      []string
+	holder     string
+	ttl        time.Duration
+	lock       *shell.WatchLock
+}
+
+// errLeaseLost cancels the reconciliation once another watcher took over the
+// lease, or it could not be renewed
+var errLeaseLost = errors.New("lease of the deployment was lost")
+
+// leaseLossGrace is how long a ghpc command is given to stop after each
+// signal, once the lease was lost
+const leaseLossGrace = 10 * time.Second
+
+// runGhpc runs another ghpc command, it is replaced in tests
+var runGhpc = func(ctx context.Context, args ...string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	logging.Info("Running %s %s", execPath(), strings.Join(args, " "))
+	if err := runChild(ctx, exec.Command(self, args...)); err != nil {
+		return fmt.Errorf("%s %s: %w", execPath(), args[0], err)
+	}
+	return nil
+}
+
+// runChild runs the ghpc command. Interrupts reach the child as well, it is
+// waited for to stop gracefully. If the lease is lost, it is stopped as by
+// interrupting it twice: it interrupts terraform and packer, then kills their
+// process groups and exits; it is killed if it does not.
+func runChild(ctx context.Context, c *exec.Cmd) error {
+	c.Stdin, c.Stdout, c.Stderr = nil, os.Stdout, os.Stderr
+	if err := c.Start(); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	defer close(exited)
+	stop := context.AfterFunc(ctx, func() {
+		if !errors.Is(context.Cause(ctx), errLeaseLost) {
+			return
+		}
+		for _, sig := range []os.Signal{syscall.SIGTERM, syscall.SIGTERM, os.Kill} {
+			if c.Process.Signal(sig) != nil {
+				return // exited
+			}
+			select {
+			case <-exited:
+				return
+			case <-time.After(leaseLossGrace):
+			}
+		}
+	})
+	defer stop()
+	return c.Wait()
+}
+
+// reconcile brings the deployment in line with the blueprint, if this watcher
+// holds the lease of the deployment. It is cancelled if the lease is lost.
+func (w *watcher) reconcile(ctx context.Context) error {
+	tmp, err := os.MkdirTemp("", "ghpc-watch-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	bp, err := w.expand(ctx, tmp)
+	if err != nil {
+		return err
+	}
+	held, err := w.lease(ctx, bp)
+	if err != nil || !held {
+		return err
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stop := w.renewLease(ctx, cancel)
+	defer stop()
+	err = w.apply(ctx, bp)
+	if cause := context.Cause(ctx); errors.Is(cause, errLeaseLost) {
+		return cause
+	}
+	return err
+}
+
+// expand expands the blueprints to the directory
+func (w *watcher) expand(ctx context.Context, dir string) (config.Blueprint, error) {
+	expanded := filepath.Join(dir, modulewriter.ExpandedBlueprintName)
+	if err := runGhpc(ctx, append(append([]string{"expand", "--out", expanded}, w.flags...), w.blueprints...)...); err != nil {
+		return config.Blueprint{}, err
+	}
+	bp, _, err := config.NewBlueprint(expanded)
+	return bp, err
+}
+
+// lease acquires the lease of the deployment, reports false if another
+// watcher holds it
+func (w *watcher) lease(ctx context.Context, bp config.Blueprint) (bool, error) {
+	lock, err := shell.NewWatchLock(bp, outputDir, w.holder, w.ttl)
+	if err != nil {
+		return false, err
+	}
+	if w.lock == nil || w.lock.Location() != lock.Location() {
+		w.release() // the backend changed, if a lease was held
+		w.lock = lock
+	}
+	held, lease, err := w.lock.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !held {
+		logging.Info("Deployment %s is reconciled by %s until %s, see %s",
+			bp.DeploymentName(), lease.Holder, lease.Expires.Format(time.RFC3339), w.lock.Location())
+	}
+	return held, nil
+}
+
+// apply creates and plans the deployment, then deploys changed groups if
+// changes are auto approved
+func (w *watcher) apply(ctx context.Context, bp config.Blueprint) error {
+	deplDir := filepath.Join(outputDir, bp.DeploymentName())
+	createArgs := []string{"create", "--overwrite-deployment"}
+	if outputDir != "" {
+		createArgs = append(createArgs, "--out", outputDir)
+	}
+	if err := runGhpc(ctx, append(append(createArgs, w.flags...), w.blueprints...)...); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := runGhpc(ctx, "plan", "--save", deplDir); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	changed, err := changedGroups(modulewriter.ArtifactsDir(deplDir))
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		logging.Info(boldGreen("Deployment %s is up to date"), bp.DeploymentName())
+		return shell.RemoveSavedPlans(modulewriter.ArtifactsDir(deplDir))
+	}
+	if !autoApprove {
+		logging.Info(boldYellow("Deployment groups %s of %s have changes, run %s to apply them"),
+			strings.Join(changed, ", "), bp.DeploymentName(),
+			boldGreen(fmt.Sprintf("%s deploy --use-saved-plans %s", execPath(), deplDir)))
+		return nil
+	}
+	return runGhpc(ctx, "deploy", "--use-saved-plans", "--auto-approve", deplDir)
+}
+
+// changedGroups returns deployment groups whose saved plans have changes
+func changedGroups(artifactsDir string) ([]string, error) {
+	sp, found, err := shell.ReadSavedPlans(artifactsDir)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("plans were not saved")
+	}
+	res := []string{}
+	for _, p := range sp.Plans {
+		if p.Changes {
+			res = append(res, string(p.Group))
+		}
+	}
+	return res, nil
+}
+
+// renewLease renews the lease while the deployment is reconciled, until the
+// returned function is called. If the lease can not be renewed, the
+// reconciliation is cancelled with errLeaseLost.
+func (w *watcher) renewLease(ctx context.Context, cancel context.CancelCauseFunc) func() {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(w.ttl / 4):
+			}
+			held, lease, err := w.lock.Acquire(ctx)
+			switch {
+			case ctx.Err() != nil:
+				return
+			case err != nil:
+				logging.Error("Failed to renew lease %s, stopping reconciliation: %v", w.lock.Location(), err)
+			case !held:
+				logging.Error("Lease %s was taken over by %s, stopping reconciliation", w.lock.Location(), lease.Holder)
+			default:
+				continue
+			}
+			cancel(errLeaseLost)
+			return
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (w *watcher) release() {
+	if w.lock == nil {
+		return
+	}
+	if err := w.lock.Release(context.Background()); err != nil {
+		logging.Error("Failed to release lease %s: %v", w.lock.Location(), err)
+	}
+	w.lock = nil
+}
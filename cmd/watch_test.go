@@ -0,0 +1,146 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"hpc-toolkit/pkg/modulewriter"
+	"hpc-toolkit/pkg/shell"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/pflag"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestPassedFlags(c *C) {
+	fs := pflag.NewFlagSet("watch", pflag.ContinueOnError)
+	fs.StringSlice("vars", nil, "")
+	fs.StringArray("var", nil, "")
+	fs.String("validation-level", "WARNING", "")
+	fs.Duration("interval", time.Minute, "")
+	c.Assert(fs.Parse([]string{"--vars", "a=1,b=2", "--var", "c=3", "--interval", "5m"}), IsNil)
+	c.Check(passedFlags(fs, []string{"vars", "var", "validation-level"}), DeepEquals,
+		[]string{"--var=c=3", "--vars=a=1", "--vars=b=2"})
+}
+
+func (s *MySuite) TestWatcherReconcile(c *C) {
+	defer func(f func(context.Context, ...string) error) { runGhpc = f }(runGhpc)
+	defer func(o string, a bool) { outputDir, autoApprove = o, a }(outputDir, autoApprove)
+	outputDir = c.MkDir()
+	deplDir := filepath.Join(outputDir, "dep")
+	changes := false
+	ran := []string{}
+	runGhpc = func(ctx context.Context, args ...string) error {
+		ran = append(ran, args[0])
+		switch args[0] {
+		case "expand":
+			return os.WriteFile(args[2], []byte("blueprint_name: bp\nvars:\n  deployment_name: dep\ndeployment_groups: []\n"), 0644)
+		case "plan":
+			return shell.WriteSavedPlans(modulewriter.ArtifactsDir(deplDir), shell.SavedPlans{
+				Plans: []shell.SavedPlan{{Group: "primary", Changes: changes}}})
+		}
+		return nil
+	}
+	c.Assert(os.MkdirAll(modulewriter.ArtifactsDir(deplDir), 0755), IsNil)
+	ctx := context.Background()
+	w := watcher{blueprints: []string{"bp.yaml"}, holder: "a", ttl: time.Hour}
+	defer w.release()
+
+	{ // up to date
+		c.Assert(w.reconcile(ctx), IsNil)
+		c.Check(ran, DeepEquals, []string{"expand", "create", "plan"})
+		_, found, _ := shell.ReadSavedPlans(modulewriter.ArtifactsDir(deplDir))
+		c.Check(found, Equals, false)
+	}
+
+	{ // changes are left to be approved
+		ran, changes, autoApprove = nil, true, false
+		c.Assert(w.reconcile(ctx), IsNil)
+		c.Check(ran, DeepEquals, []string{"expand", "create", "plan"})
+		_, found, _ := shell.ReadSavedPlans(modulewriter.ArtifactsDir(deplDir))
+		c.Check(found, Equals, true)
+	}
+
+	{ // changes are applied
+		ran, autoApprove = nil, true
+		c.Assert(w.reconcile(ctx), IsNil)
+		c.Check(ran, DeepEquals, []string{"expand", "create", "plan", "deploy"})
+	}
+
+	{ // another watcher waits for the lease
+		other := watcher{blueprints: []string{"bp.yaml"}, holder: "b", ttl: time.Hour}
+		ran = nil
+		c.Assert(other.reconcile(ctx), IsNil)
+		c.Check(ran, DeepEquals, []string{"expand"})
+	}
+}
+
+func (s *MySuite) TestWatcherLeaseTakeover(c *C) {
+	defer func(f func(context.Context, ...string) error) { runGhpc = f }(runGhpc)
+	defer func(o string, a bool) { outputDir, autoApprove = o, a }(outputDir, autoApprove)
+	outputDir, autoApprove = c.MkDir(), true
+	deplDir := filepath.Join(outputDir, "dep")
+	c.Assert(os.MkdirAll(modulewriter.ArtifactsDir(deplDir), 0755), IsNil)
+	runGhpc = func(ctx context.Context, args ...string) error {
+		switch args[0] {
+		case "expand":
+			return os.WriteFile(args[2], []byte("blueprint_name: bp\nvars:\n  deployment_name: dep\ndeployment_groups: []\n"), 0644)
+		case "plan":
+			return shell.WriteSavedPlans(modulewriter.ArtifactsDir(deplDir), shell.SavedPlans{
+				Plans: []shell.SavedPlan{{Group: "primary", Changes: true}}})
+		case "deploy":
+			// another watcher takes over the lease while deploying
+			lease := fmt.Sprintf(`{"holder": "b", "expires": %q}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+			matches, err := filepath.Glob(filepath.Join(outputDir, ".dep.*.lease"))
+			c.Assert(err, IsNil)
+			c.Assert(matches, HasLen, 1)
+			c.Assert(os.WriteFile(matches[0], []byte(lease), 0644), IsNil)
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}
+
+	w := watcher{blueprints: []string{"bp.yaml"}, holder: "a", ttl: 200 * time.Millisecond}
+	defer w.release()
+	done := make(chan error)
+	go func() { done <- w.reconcile(context.Background()) }()
+	select {
+	case err := <-done:
+		c.Check(err, Equals, errLeaseLost)
+	case <-time.After(10 * time.Second):
+		c.Fatal("reconciliation was not cancelled once the lease was lost")
+	}
+}
+
+func (s *MySuite) TestRunChildLeaseLost(c *C) {
+	{ // Success: interrupts are left to the child
+		ctx, cancel := context.WithCancelCause(context.Background())
+		cancel(nil)
+		c.Check(runChild(ctx, exec.Command("true")), IsNil)
+	}
+
+	{ // Fail: the child is stopped once the lease is lost
+		ctx, cancel := context.WithCancelCause(context.Background())
+		time.AfterFunc(100*time.Millisecond, func() { cancel(errLeaseLost) })
+		start := time.Now()
+		c.Check(runChild(ctx, exec.Command("sleep", "60")), ErrorMatches, ".*terminated.*")
+		c.Check(time.Since(start) < 10*time.Second, Equals, true)
+	}
+}
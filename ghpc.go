@@ -18,6 +18,7 @@ package main
 import (
 	"embed"
 	"hpc-toolkit/cmd"
+	"hpc-toolkit/pkg/shell"
 	"hpc-toolkit/pkg/sourcereader"
 	"os"
 )
@@ -33,6 +34,10 @@ var gitCommitHash string
 var gitInitialHash string
 
 func main() {
+	// ghpc runs recorded or replayed terraform and packer commands
+	if code, ok := shell.CommandShim(); ok {
+		os.Exit(code)
+	}
 	sourcereader.ModuleFS = moduleFS
 	cmd.GitTagVersion = gitTagVersion
 	cmd.GitBranch = gitBranch
@@ -0,0 +1,72 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+locals {
+  # This label allows for billing report tracking based on module.
+  labels = merge(var.labels, { ghpc_module = "alert-policy", ghpc_role = "monitoring" })
+}
+
+locals {
+  instance_filter = join(" AND ", compact([
+    "resource.type = \"gce_instance\"",
+    "metadata.user_labels.ghpc_deployment = \"${var.deployment_name}\"",
+    length(var.name) > 0 ? "metadata.system_labels.name = one_of(${join(", ", formatlist("\"%s\"", var.name))})" : "",
+  ]))
+}
+
+resource "google_monitoring_alert_policy" "instance_down" {
+  project      = var.project_id
+  display_name = "${var.deployment_name}: instance down"
+  combiner     = "OR"
+
+  conditions {
+    display_name = "Instance stopped reporting uptime"
+    condition_absent {
+      filter   = "metric.type = \"compute.googleapis.com/instance/uptime\" AND ${local.instance_filter}"
+      duration = var.instance_down_duration
+      aggregations {
+        alignment_period   = "60s"
+        per_series_aligner = "ALIGN_RATE"
+      }
+    }
+  }
+
+  notification_channels = var.notification_channels
+  user_labels           = local.labels
+}
+
+resource "google_monitoring_alert_policy" "disk_usage" {
+  project      = var.project_id
+  display_name = "${var.deployment_name}: disk usage above ${var.disk_usage_threshold}%"
+  combiner     = "OR"
+
+  conditions {
+    display_name = "Disk usage above threshold"
+    condition_threshold {
+      filter          = "metric.type = \"agent.googleapis.com/disk/percent_used\" AND metric.label.state = \"used\" AND ${local.instance_filter}"
+      comparison      = "COMPARISON_GT"
+      threshold_value = var.disk_usage_threshold
+      duration        = "300s"
+      aggregations {
+        alignment_period   = "300s"
+        per_series_aligner = "ALIGN_MEAN"
+      }
+    }
+  }
+
+  notification_channels = var.notification_channels
+  user_labels           = local.labels
+}
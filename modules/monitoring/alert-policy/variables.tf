@@ -0,0 +1,57 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+variable "project_id" {
+  description = "Project in which the HPC deployment will be created"
+  type        = string
+}
+
+variable "deployment_name" {
+  description = "The name of the current deployment"
+  type        = string
+}
+
+variable "labels" {
+  description = "Labels to add to the alert policies. Key-value pairs."
+  type        = map(string)
+}
+
+variable "name" {
+  description = <<-EOT
+    Names of the instances to alert on, set automatically when vm-instance
+    modules are used. If empty, all instances of the deployment are covered.
+    EOT
+  type        = list(string)
+  default     = []
+}
+
+variable "notification_channels" {
+  description = "Notification channels alerts are sent to, e.g. \"projects/my-project/notificationChannels/1234\""
+  type        = list(string)
+  default     = []
+}
+
+variable "instance_down_duration" {
+  description = "How long an instance may stop reporting uptime before an alert is raised"
+  type        = string
+  default     = "300s"
+}
+
+variable "disk_usage_threshold" {
+  description = "Percentage of disk usage above which an alert is raised, requires the Ops Agent"
+  type        = number
+  default     = 90
+}
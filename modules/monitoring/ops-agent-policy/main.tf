@@ -0,0 +1,61 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+locals {
+  instance_labels = length(var.instance_labels) > 0 ? var.instance_labels : { ghpc_deployment = var.deployment_name }
+}
+
+resource "google_os_config_os_policy_assignment" "ops_agent" {
+  project     = var.project_id
+  location    = var.zone
+  name        = "${var.deployment_name}-ops-agent"
+  description = "Installs the Ops Agent on instances of the ${var.deployment_name} deployment"
+
+  instance_filter {
+    all = false
+    inclusion_labels {
+      labels = local.instance_labels
+    }
+  }
+
+  os_policies {
+    id   = "ops-agent"
+    mode = "ENFORCEMENT"
+    resource_groups {
+      resources {
+        id = "install-ops-agent"
+        exec {
+          validate {
+            interpreter = "SHELL"
+            # exit code 100 means the resource is in the desired state
+            script = "if systemctl is-active --quiet google-cloud-ops-agent; then exit 100; else exit 101; fi"
+          }
+          enforce {
+            interpreter = "SHELL"
+            script      = "curl -sSO https://dl.google.com/cloudagents/add-google-cloud-ops-agent-repo.sh && bash add-google-cloud-ops-agent-repo.sh --also-install && exit 100"
+          }
+        }
+      }
+    }
+  }
+
+  rollout {
+    disruption_budget {
+      percent = 100
+    }
+    min_wait_duration = "0s"
+  }
+}
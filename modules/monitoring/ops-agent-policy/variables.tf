@@ -0,0 +1,39 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+variable "project_id" {
+  description = "Project in which the HPC deployment will be created"
+  type        = string
+}
+
+variable "deployment_name" {
+  description = "The name of the current deployment"
+  type        = string
+}
+
+variable "zone" {
+  description = "Zone of the instances the policy applies to"
+  type        = string
+}
+
+variable "instance_labels" {
+  description = <<-EOT
+    Labels selecting the instances the Ops Agent is installed on. If empty,
+    all instances labeled with the deployment name are selected.
+    EOT
+  type        = map(string)
+  default     = {}
+}
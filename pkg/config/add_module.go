@@ -0,0 +1,194 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/modulereader"
+	"hpc-toolkit/pkg/sourcereader"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// AddModule appends a module to the group of the blueprint YAML data. Lines
+// of the blueprint are kept as they are, the module is inserted after the last
+// module of the group with the same indentation.
+func AddModule(data []byte, group string, id ModuleID, source string, use []ModuleID) ([]byte, error) {
+	if err := checkAddedModule(id, source); err != nil {
+		return nil, err
+	}
+	var c nodeCapturer
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, parseYamlV3Error(err)
+	}
+	if err := checkAddedModuleUse(c.n, id, use); err != nil {
+		return nil, err
+	}
+	items, err := groupModuleNodes(c.n, group)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	first, last := items[0], items[len(items)-1]
+	keyIndent := columnOffset(lines[first.Line-1], first.Column)
+	dashIndent := strings.LastIndex(lines[first.Line-1][:keyIndent], "-")
+	if dashIndent < 0 {
+		dashIndent = max(keyIndent-2, 0)
+	}
+	// modules of the group are separated by blank lines
+	blank := last.Line > 1 && strings.TrimSpace(lines[last.Line-2]) == ""
+	entry := moduleEntry(id, source, use, dashIndent, keyIndent, blank)
+
+	at := nodeEndLine(lines, allNodeLines(c.n), last, dashIndent)
+	if at > 0 && !strings.HasSuffix(lines[at-1], "\n") {
+		lines[at-1] += "\n"
+	}
+	res := append(slices.Clone(lines[:at]), entry)
+	res = append(res, lines[at:]...)
+	return []byte(strings.Join(res, "")), nil
+}
+
+// checkAddedModule ensures that the source and the ID of the added module are
+// valid
+func checkAddedModule(id ModuleID, source string) error {
+	if source == "" {
+		return EmptyModuleSource
+	}
+	if err := checkEmbeddedSource(source); err != nil {
+		return err
+	}
+	if id == "" {
+		return EmptyModuleID
+	}
+	if id == "vars" || !hclsyntax.ValidIdentifier(string(id)) {
+		return fmt.Errorf("%q is not a valid module id", id)
+	}
+	return nil
+}
+
+// checkAddedModuleUse ensures that the ID of the added module is not taken
+// and that the modules it uses exist
+func checkAddedModuleUse(root *yaml.Node, id ModuleID, use []ModuleID) error {
+	idNodes, _ := moduleIDNodes(root)
+	ids := []string{}
+	for _, n := range idNodes {
+		ids = append(ids, n.Value)
+	}
+	if slices.Contains(ids, string(id)) {
+		return fmt.Errorf("module %q already exists", id)
+	}
+	for _, u := range use {
+		if !slices.Contains(ids, string(u)) {
+			return hintSpelling(string(u), ids, UnknownModuleError{u})
+		}
+	}
+	return nil
+}
+
+// groupModuleNodes returns nodes of modules of the group, which must be a
+// non-empty block sequence
+func groupModuleNodes(root *yaml.Node, group string) ([]*yaml.Node, error) {
+	var modules *yaml.Node
+	groups := []string{}
+	for _, g := range seqItems(mappingValue(root, "deployment_groups")) {
+		if n := mappingValue(g, "group"); n != nil {
+			groups = append(groups, n.Value)
+			if n.Value == group {
+				modules = mappingValue(g, "modules")
+			}
+		}
+	}
+	if !slices.Contains(groups, group) {
+		return nil, hintSpelling(group, groups, fmt.Errorf("deployment group %q does not exist", group))
+	}
+	items := seqItems(modules)
+	if len(items) == 0 || modules.Style&yaml.FlowStyle != 0 {
+		return nil, fmt.Errorf("modules of deployment group %q must be a non-empty block sequence to add a module", group)
+	}
+	return items, nil
+}
+
+// moduleEntry returns the YAML lines of the added module, preceded by a blank
+// line if blank is set
+func moduleEntry(id ModuleID, source string, use []ModuleID, dashIndent int, keyIndent int, blank bool) string {
+	var sb strings.Builder
+	if blank {
+		sb.WriteString("\n")
+	}
+	key := strings.Repeat(" ", keyIndent)
+	fmt.Fprintf(&sb, "%s- id: %s\n", strings.Repeat(" ", dashIndent), id)
+	fmt.Fprintf(&sb, "%ssource: %s\n", key, source)
+	if len(use) > 0 {
+		ul := []string{}
+		for _, u := range use {
+			ul = append(ul, string(u))
+		}
+		fmt.Fprintf(&sb, "%suse: [%s]\n", key, strings.Join(ul, ", "))
+	}
+	return sb.String()
+}
+
+// nodeEndLine returns the 0-based line following the node, blank lines and
+// comments not indented more than indent are left to what follows
+func nodeEndLine(lines []string, nodeLines []int, m *yaml.Node, indent int) int {
+	lastLine := 0
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		lastLine = max(lastLine, n.Line)
+		for _, c := range n.Content {
+			walk(c)
+		}
+	}
+	walk(m)
+
+	end := len(lines)
+	if i := sort.SearchInts(nodeLines, lastLine+1); i < len(nodeLines) {
+		end = nodeLines[i] - 1
+	}
+	for end > lastLine {
+		l := lines[end-1]
+		trimmed := strings.TrimSpace(l)
+		if trimmed != "" && !(strings.HasPrefix(trimmed, "#") && len(l)-len(strings.TrimLeft(l, " ")) <= indent) {
+			break
+		}
+		end--
+	}
+	return end
+}
+
+// checkEmbeddedSource ensures that embedded sources are modules of the catalog
+func checkEmbeddedSource(source string) error {
+	if !sourcereader.IsEmbeddedPath(source) || sourcereader.ModuleFS == nil {
+		return nil
+	}
+	catalog, err := modulereader.EmbeddedCatalog()
+	if err != nil {
+		return err
+	}
+	sources := []string{}
+	for _, e := range catalog {
+		sources = append(sources, e.Source)
+	}
+	if slices.Contains(sources, path.Clean(source)) {
+		return nil
+	}
+	return hintSpelling(source, sources, fmt.Errorf("%q is not a module embedded in ghpc", source))
+}
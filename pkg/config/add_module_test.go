@@ -0,0 +1,102 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestAddModule(c *C) {
+	bp := `blueprint_name: test # keep me
+
+deployment_groups:
+- group: primary
+  modules:
+  - id: net
+    source: modules/network/vpc
+
+  - id: script
+    source: modules/scripts/startup-script
+    settings:
+      runners:
+      - type: shell
+        content: |
+          echo hello
+          # end of script
+
+  # the cluster
+- group: secondary
+  modules:
+    - id: vm
+      source: modules/compute/vm-instance
+`
+	got, err := AddModule([]byte(bp), "primary", "homefs", "modules/file-system/filestore", []ModuleID{"net"})
+	c.Assert(err, IsNil)
+	c.Check(string(got), Equals, `blueprint_name: test # keep me
+
+deployment_groups:
+- group: primary
+  modules:
+  - id: net
+    source: modules/network/vpc
+
+  - id: script
+    source: modules/scripts/startup-script
+    settings:
+      runners:
+      - type: shell
+        content: |
+          echo hello
+          # end of script
+
+  - id: homefs
+    source: modules/file-system/filestore
+    use: [net]
+
+  # the cluster
+- group: secondary
+  modules:
+    - id: vm
+      source: modules/compute/vm-instance
+`)
+
+	got, err = AddModule([]byte(bp), "secondary", "login", "./login", nil)
+	c.Assert(err, IsNil)
+	c.Check(string(got), Matches, `(?s).*      source: modules/compute/vm-instance\n    - id: login\n      source: ./login\n$`)
+
+	{ // no trailing newline
+		got, err := AddModule([]byte("deployment_groups:\n- group: g\n  modules:\n  - id: a\n    source: ./a"), "g", "b", "./b", nil)
+		c.Assert(err, IsNil)
+		c.Check(string(got), Equals, "deployment_groups:\n- group: g\n  modules:\n  - id: a\n    source: ./a\n  - id: b\n    source: ./b\n")
+	}
+
+	_, err = AddModule([]byte(bp), "secondary", "net", "./net", nil)
+	c.Check(err, ErrorMatches, `module "net" already exists`)
+
+	_, err = AddModule([]byte(bp), "secondary", "2vm", "./vm", nil)
+	c.Check(err, ErrorMatches, `"2vm" is not a valid module id`)
+
+	_, err = AddModule([]byte(bp), "secondary", "login", "", nil)
+	c.Check(err, Equals, EmptyModuleSource)
+
+	_, err = AddModule([]byte(bp), "secondry", "login", "./login", nil)
+	c.Check(err, ErrorMatches, `.*deployment group "secondry" does not exist.*did you mean "secondary"\?`)
+
+	_, err = AddModule([]byte(bp), "secondary", "login", "./login", []ModuleID{"nett"})
+	c.Check(err, ErrorMatches, `.*did you mean "net"\?`)
+
+	_, err = AddModule([]byte("deployment_groups:\n- group: g\n  modules: []\n"), "g", "a", "./a", nil)
+	c.Check(err, ErrorMatches, `modules of deployment group "g" must be a non-empty block sequence.*`)
+}
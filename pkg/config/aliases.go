@@ -0,0 +1,63 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// applySettingAliases replaces settings given by a generic name, e.g.
+// `instance_type`, with the module input the alias table in the module
+// metadata maps it to, e.g. `machine_type`. Settings named after an actual
+// input of the module are never treated as aliases.
+func applySettingAliases(mp ModulePath, m *Module) error {
+	info := m.InfoOrDie()
+	aliases := info.Metadata.Ghpc.Aliases
+	if len(aliases) == 0 {
+		return nil
+	}
+	inputs := getModuleInputMap(info.Inputs)
+
+	errs := Errors{}
+	names := maps.Keys(aliases)
+	slices.Sort(names)
+	for _, alias := range names {
+		input := aliases[alias]
+		if _, isInput := inputs[alias]; isInput || !m.Settings.Has(alias) {
+			continue
+		}
+		if _, ok := inputs[input]; !ok {
+			errs.At(mp.Settings.Dot(alias), fmt.Errorf("metadata of module %q maps alias %q to %q, which is not an input of the module", m.Source, alias, input))
+			continue
+		}
+		if m.Settings.Has(input) {
+			errs.At(mp.Settings.Dot(alias), fmt.Errorf("setting %q is an alias of %q, they can not be set together", alias, input))
+			continue
+		}
+		settings := Dict{}
+		for k, v := range m.Settings.Items() {
+			if k == alias {
+				k = input
+			}
+			settings.Set(k, v)
+		}
+		m.Settings = settings
+		m.renameOrigin(alias, input)
+	}
+	return errs.OrNil()
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"hpc-toolkit/pkg/modulereader"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestApplySettingAliases(c *C) {
+	src := c.TestName() + "/vm"
+	setTestModuleInfo(Module{Source: src}, modulereader.ModuleInfo{
+		Inputs: []modulereader.VarInfo{
+			{Name: "machine_type"}, {Name: "instance_image"}, {Name: "network"}},
+		Metadata: modulereader.Metadata{Ghpc: modulereader.MetadataGhpc{
+			Aliases: map[string]string{
+				"instance_type": "machine_type",
+				"image":         "instance_image",
+				"network":       "network_self_link", // shadowed by the input
+				"zone_name":     "zone",              // not an input
+			}}}})
+	mp := Root.Groups.At(0).Modules.At(0)
+
+	{ // aliases are renamed
+		m := Module{Source: src, Settings: NewDict(map[string]cty.Value{
+			"instance_type": cty.StringVal("c2-standard-60"),
+			"image":         cty.StringVal("rocky"),
+			"network":       cty.StringVal("default"),
+		})}
+		c.Assert(applySettingAliases(mp, &m), IsNil)
+		c.Check(m.Settings.Items(), DeepEquals, map[string]cty.Value{
+			"machine_type":   cty.StringVal("c2-standard-60"),
+			"instance_image": cty.StringVal("rocky"),
+			"network":        cty.StringVal("default"),
+		})
+	}
+
+	{ // alias and input set together
+		m := Module{Source: src, Settings: NewDict(map[string]cty.Value{
+			"instance_type": cty.StringVal("c2-standard-60"),
+			"machine_type":  cty.StringVal("n2-standard-2"),
+		})}
+		err := applySettingAliases(mp, &m)
+		c.Check(err, ErrorMatches, `.*setting "instance_type" is an alias of "machine_type", they can not be set together`)
+		c.Check(err.(BpError).Path.String(), Equals, "deployment_groups[0].modules[0].settings.instance_type")
+	}
+
+	{ // alias mapped to a missing input
+		m := Module{Source: src, Settings: NewDict(map[string]cty.Value{
+			"zone_name": cty.StringVal("us-central1-a"),
+		})}
+		c.Check(applySettingAliases(mp, &m), ErrorMatches, `.*maps alias "zone_name" to "zone", which is not an input of the module`)
+	}
+
+	{ // modules without aliases are left alone
+		m := Module{Source: c.TestName() + "/other", Settings: NewDict(map[string]cty.Value{
+			"instance_type": cty.StringVal("c2-standard-60"),
+		})}
+		setTestModuleInfo(m, modulereader.ModuleInfo{})
+		c.Assert(applySettingAliases(mp, &m), IsNil)
+		c.Check(m.Settings.Has("instance_type"), Equals, true)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+// bootstrapOutput is the output of the module of the bootstrap group, and the
+// deployment variable of later groups bound to it
+const bootstrapOutput = "project_id"
+
+// BootstrapProject returns the reference to the project_id output of the
+// bootstrap group and the index of the group, if the blueprint has one
+func (bp Blueprint) BootstrapProject() (Reference, int, bool) {
+	for ig, g := range bp.DeploymentGroups {
+		if !g.Bootstrap {
+			continue
+		}
+		for _, m := range g.Modules {
+			if hasOutput(m, bootstrapOutput) {
+				return ModuleRef(m.ID, bootstrapOutput), ig, true
+			}
+		}
+	}
+	return Reference{}, 0, false
+}
+
+func hasOutput(m Module, name string) bool {
+	for _, o := range m.InfoOrDie().Outputs {
+		if o.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBootstrap ensures that the bootstrap group, if any, comes first and
+// has exactly one terraform module with a project_id output
+func validateBootstrap(bp Blueprint) error {
+	errs := Errors{}
+	for ig, g := range bp.DeploymentGroups {
+		if !g.Bootstrap {
+			continue
+		}
+		p := Root.Groups.At(ig)
+		if ig != 0 {
+			errs.At(p.Bootstrap, errors.New("bootstrap group must be the first deployment group"))
+			continue
+		}
+		if g.Kind() != TerraformKind {
+			errs.At(p.Bootstrap, errors.New("bootstrap group can only have terraform modules"))
+			continue
+		}
+		found := []ModuleID{}
+		for _, m := range g.Modules {
+			if hasOutput(m, bootstrapOutput) {
+				found = append(found, m.ID)
+			}
+		}
+		switch {
+		case len(found) == 0:
+			errs.At(p.Bootstrap, HintError{
+				Err:  fmt.Errorf("bootstrap group %q has no module with output %q", g.Name, bootstrapOutput),
+				Hint: "add a module creating the project, e.g. community/modules/project/new-project"})
+		case len(found) > 1:
+			errs.At(p.Bootstrap, fmt.Errorf("bootstrap group %q has several modules with output %q: %v, it must have one", g.Name, bootstrapOutput, found))
+		}
+	}
+	return errs.OrNil()
+}
+
+// bindBootstrapProject replaces references to the project_id deployment
+// variable in modules of groups following the bootstrap group with references
+// to the project_id output of the bootstrap group. The groups are deployed once
+// the project exists and use the project as created, e.g. with a random suffix.
+func (bp *Blueprint) bindBootstrapProject() error {
+	ref, ib, ok := bp.BootstrapProject()
+	if !ok {
+		return nil
+	}
+	errs := Errors{}
+	bp.WalkModulesSafe(func(mp ModulePath, m *Module) {
+		if bp.GroupIndex(bp.ModuleGroupOrDie(m.ID).Name) <= ib {
+			return
+		}
+		v, err := cty.Transform(m.Settings.AsObject(), func(_ cty.Path, v cty.Value) (cty.Value, error) {
+			e, is := IsExpressionValue(v)
+			if !is {
+				return v, nil
+			}
+			if _, refers := valueReferences(v)[GlobalRef(bootstrapOutput)]; !refers {
+				return v, nil
+			}
+			ne, err := ReplaceSubExpressions(e, GlobalRef(bootstrapOutput).AsExpression(), ref.AsExpression())
+			if err != nil {
+				return cty.NilVal, err
+			}
+			// keep marks other than the expression, e.g. of values set by `use`
+			marks := cty.NewValueMarks()
+			for mk := range v.Marks() {
+				if _, isExpr := mk.(expressionKey); !isExpr {
+					marks[mk] = struct{}{}
+				}
+			}
+			return ne.AsValue().WithMarks(marks), nil
+		})
+		if err != nil {
+			errs.At(mp.Settings, err)
+			return
+		}
+		m.Settings = NewDict(v.AsValueMap())
+	})
+	return errs.OrNil()
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"hpc-toolkit/pkg/modulereader"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func bootstrapBlueprint(c *C) Blueprint {
+	project := Module{ID: "project", Source: c.TestName() + "/new-project", Kind: TerraformKind,
+		Settings: NewDict(map[string]cty.Value{"project_id": GlobalRef("project_id").AsValue()})}
+	setTestModuleInfo(project, modulereader.ModuleInfo{Outputs: []modulereader.OutputInfo{{Name: "project_id"}}})
+	vpc := Module{ID: "vpc", Source: c.TestName() + "/vpc", Kind: TerraformKind,
+		Settings: NewDict(map[string]cty.Value{
+			"project_id": GlobalRef("project_id").AsValue(),
+			"name":       MustParseExpression(`"${var.project_id}-net"`).AsValue(),
+			"region":     GlobalRef("region").AsValue(),
+		})}
+	setTestModuleInfo(vpc, modulereader.ModuleInfo{Outputs: []modulereader.OutputInfo{{Name: "network_id"}}})
+	return Blueprint{
+		Vars: NewDict(map[string]cty.Value{"project_id": cty.StringVal("fresh"), "region": cty.StringVal("us-east4")}),
+		DeploymentGroups: []DeploymentGroup{
+			{Name: "setup", Bootstrap: true, Modules: []Module{project}},
+			{Name: "primary", Modules: []Module{vpc}},
+		}}
+}
+
+func (s *zeroSuite) TestBindBootstrapProject(c *C) {
+	bp := bootstrapBlueprint(c)
+	c.Assert(validateBootstrap(bp), IsNil)
+	ref, ig, ok := bp.BootstrapProject()
+	c.Check(ok, Equals, true)
+	c.Check(ig, Equals, 0)
+	c.Check(ref, Equals, ModuleRef("project", "project_id"))
+
+	c.Assert(bp.bindBootstrapProject(), IsNil)
+	// the bootstrap group keeps the deployment variable
+	c.Check(bp.DeploymentGroups[0].Modules[0].Settings.Get("project_id"), DeepEquals, GlobalRef("project_id").AsValue())
+	c.Check(bp.DeploymentGroups[1].Modules[0].Settings.Items(), DeepEquals, map[string]cty.Value{
+		"project_id": ModuleRef("project", "project_id").AsValue(),
+		"name":       MustParseExpression(`"${module.project.project_id}-net"`).AsValue(),
+		"region":     GlobalRef("region").AsValue(),
+	})
+
+	{ // no bootstrap group
+		bp := bootstrapBlueprint(c)
+		bp.DeploymentGroups[0].Bootstrap = false
+		_, _, ok := bp.BootstrapProject()
+		c.Check(ok, Equals, false)
+		c.Assert(bp.bindBootstrapProject(), IsNil)
+		c.Check(bp.DeploymentGroups[1].Modules[0].Settings.Get("project_id"), DeepEquals, GlobalRef("project_id").AsValue())
+	}
+}
+
+func (s *zeroSuite) TestValidateBootstrap(c *C) {
+	{ // Fail: not the first group
+		bp := bootstrapBlueprint(c)
+		bp.DeploymentGroups[0].Bootstrap, bp.DeploymentGroups[1].Bootstrap = false, true
+		c.Check(validateBootstrap(bp), ErrorMatches, `deployment_groups\[1\].bootstrap: bootstrap group must be the first deployment group`)
+	}
+	{ // Fail: no project_id output
+		bp := bootstrapBlueprint(c)
+		bp.DeploymentGroups[0].Modules = bp.DeploymentGroups[1].Modules
+		c.Check(validateBootstrap(bp), ErrorMatches, `.*bootstrap group "setup" has no module with output "project_id".*`)
+	}
+	{ // Fail: several project_id outputs
+		bp := bootstrapBlueprint(c)
+		other := bp.DeploymentGroups[0].Modules[0]
+		other.ID = "other"
+		bp.DeploymentGroups[0].Modules = append(bp.DeploymentGroups[0].Modules, other)
+		c.Check(validateBootstrap(bp), ErrorMatches, `.*has several modules with output "project_id": \[project other\].*`)
+	}
+}
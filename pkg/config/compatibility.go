@@ -0,0 +1,119 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/modulereader"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// validateUseCompatibility checks modules in the use list against use_rules
+// from metadata of the module
+func validateUseCompatibility(p ModulePath, m Module, info modulereader.ModuleInfo, bp Blueprint) error {
+	rules := info.Metadata.Ghpc.UseRules
+	if len(rules) == 0 {
+		return nil
+	}
+	errs := Errors{}
+	for iu, u := range m.Use {
+		used, err := bp.Module(u)
+		if err != nil {
+			continue // reported by validateModuleUseReferences
+		}
+		for _, r := range rules {
+			if !sourceMatches(used.Source, r.Source) {
+				continue
+			}
+			if err := checkUseRule(bp, *used, r); err != nil {
+				errs.At(p.Use.At(iu), HintError{
+					Err:  fmt.Errorf("module %q does not work with module %q: %w", m.ID, u, err),
+					Hint: r.Hint})
+			}
+		}
+	}
+	return errs.OrNil()
+}
+
+// sourceMatches tells if the module source refers to the rule source, either
+// embedded or as a subdirectory of a local or remote copy of the toolkit
+func sourceMatches(src string, rule string) bool {
+	src, _, _ = strings.Cut(src, "?")
+	src = strings.TrimSuffix(src, "/")
+	return src == rule || strings.HasSuffix(src, "/"+rule)
+}
+
+func checkUseRule(bp Blueprint, used Module, r modulereader.MetadataUseRule) error {
+	if r.Incompatible {
+		return fmt.Errorf("%s is not supported", r.Source)
+	}
+	keys := maps.Keys(r.Settings)
+	slices.Sort(keys)
+	for _, k := range keys {
+		got, ok := knownStringSetting(bp, used, k)
+		if ok && !slices.Contains(r.Settings[k], got) {
+			return fmt.Errorf("%s must be one of %q, got %q", k, r.Settings[k], got)
+		}
+	}
+	return nil
+}
+
+// knownStringSetting returns value of the setting, or attribute of an object
+// setting given as "setting.attribute", if it is a string known before
+// deployment. Defaults of module variables are used for unset settings.
+func knownStringSetting(bp Blueprint, m Module, key string) (string, bool) {
+	name, attr, nested := strings.Cut(key, ".")
+	if !m.Settings.Has(name) {
+		if nested {
+			return "", false
+		}
+		return stringDefault(m, name)
+	}
+	v, err := bp.Eval(m.Settings.Get(name))
+	if err != nil {
+		return "", false
+	}
+	if nested {
+		if v.IsNull() || !v.IsKnown() || !(v.Type().IsObjectType() || v.Type().IsMapType()) {
+			return "", false
+		}
+		av, ok := v.AsValueMap()[attr]
+		if !ok {
+			return "", false
+		}
+		v = av
+	}
+	if v.IsNull() || !v.IsKnown() || v.Type() != cty.String {
+		return "", false
+	}
+	return v.AsString(), true
+}
+
+func stringDefault(m Module, name string) (string, bool) {
+	info, err := modulereader.GetModuleInfo(m.Source, m.Kind.String())
+	if err != nil {
+		return "", false
+	}
+	for _, in := range info.Inputs {
+		if s, ok := in.Default.(string); ok && in.Name == name {
+			return s, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"hpc-toolkit/pkg/modulereader"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestSourceMatches(c *C) {
+	rule := "modules/file-system/filestore"
+	c.Check(sourceMatches("modules/file-system/filestore", rule), Equals, true)
+	c.Check(sourceMatches("../hpc-toolkit/modules/file-system/filestore/", rule), Equals, true)
+	c.Check(sourceMatches("github.com/GoogleCloudPlatform/hpc-toolkit//modules/file-system/filestore?ref=v1.28.1", rule), Equals, true)
+	c.Check(sourceMatches("community/modules/file-system/filestore-ha", rule), Equals, false)
+	c.Check(sourceMatches("./my-modules/file-system/filestore", rule), Equals, false)
+}
+
+func (s *zeroSuite) TestValidateUseCompatibility(c *C) {
+	fs := Module{ID: "scratch", Source: "modules/file-system/pre-existing-network-storage",
+		Settings: NewDict(map[string]cty.Value{"fs_type": GlobalRef("fs_type").AsValue()})}
+	img := Module{ID: "image", Source: "modules/compute/instance-template",
+		Settings: NewDict(map[string]cty.Value{"instance_image": cty.ObjectVal(map[string]cty.Value{
+			"family":  cty.StringVal("hpc-rocky-linux-8"),
+			"project": cty.StringVal("cloud-hpc-image-public")})})}
+	old := Module{ID: "legacy", Source: "community/modules/scheduler/legacy-controller"}
+	vm := Module{ID: "vm", Source: "modules/compute/vm", Use: ModuleIDs{"scratch", "image", "legacy"}}
+	setTestModuleInfo(fs, modulereader.ModuleInfo{})
+	setTestModuleInfo(img, modulereader.ModuleInfo{})
+	setTestModuleInfo(old, modulereader.ModuleInfo{})
+
+	bp := Blueprint{
+		Vars:             NewDict(map[string]cty.Value{"fs_type": cty.StringVal("nfs")}),
+		DeploymentGroups: []DeploymentGroup{{Name: "primary", Modules: []Module{fs, img, old, vm}}}}
+	mp := Root.Groups.At(0).Modules.At(3)
+	info := func(rules ...modulereader.MetadataUseRule) modulereader.ModuleInfo {
+		return modulereader.ModuleInfo{Metadata: modulereader.Metadata{Ghpc: modulereader.MetadataGhpc{UseRules: rules}}}
+	}
+	fsRule := modulereader.MetadataUseRule{
+		Source:   "modules/file-system/pre-existing-network-storage",
+		Settings: map[string][]string{"fs_type": {"nfs", "lustre", "gcsfuse"}}}
+	imgRule := modulereader.MetadataUseRule{
+		Source:   "modules/compute/instance-template",
+		Settings: map[string][]string{"instance_image.family": {"hpc-rocky-linux-8"}}}
+
+	{ // Success
+		c.Check(validateUseCompatibility(mp, vm, info(fsRule, imgRule), bp), IsNil)
+	}
+
+	{ // Fail: setting value, from deployment variable
+		bp.Vars.Set("fs_type", cty.StringVal("daos"))
+		err := validateUseCompatibility(mp, vm, info(fsRule, imgRule), bp)
+		c.Check(err, ErrorMatches, `(?s).*"vm" does not work with module "scratch".*fs_type must be one of.*"daos".*`)
+		bp.Vars.Set("fs_type", cty.StringVal("nfs"))
+	}
+
+	{ // Fail: attribute of object setting
+		imgRule.Settings["instance_image.family"] = []string{"hpc-centos-7"}
+		err := validateUseCompatibility(mp, vm, info(imgRule), bp)
+		c.Check(err, ErrorMatches, `(?s).*instance_image.family must be one of \["hpc-centos-7"\], got "hpc-rocky-linux-8".*`)
+	}
+
+	{ // Fail: incompatible module, with hint
+		rule := modulereader.MetadataUseRule{
+			Source:       "community/modules/scheduler/legacy-controller",
+			Incompatible: true,
+			Hint:         "use schedmd-slurm-gcp-v6-controller instead"}
+		err := validateUseCompatibility(mp, vm, info(rule), bp)
+		c.Check(err, ErrorMatches, `(?s).*"vm" does not work with module "legacy".*`)
+		var h HintError
+		c.Assert(errors.As(err, &h), Equals, true)
+		c.Check(h.Hint, Equals, "use schedmd-slurm-gcp-v6-controller instead")
+	}
+}
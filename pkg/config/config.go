@@ -17,16 +17,20 @@ package config
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/agext/levenshtein"
 	"github.com/hashicorp/hcl/v2"
 	"github.com/pkg/errors"
 	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 	"gopkg.in/yaml.v3"
 
 	"hpc-toolkit/pkg/modulereader"
@@ -68,37 +72,174 @@ type DeploymentGroup struct {
 	Name             GroupName        `yaml:"group"`
 	TerraformBackend TerraformBackend `yaml:"terraform_backend,omitempty"`
 	Modules          []Module         `yaml:"modules"`
-	// DEPRECATED fields
-	deprecatedKind interface{} `yaml:"kind,omitempty"` //lint:ignore U1000 keep in the struct for backwards compatibility
+	// Timeout limits duration of deploying or destroying the group, e.g. "45m"
+	Timeout string `yaml:"timeout,omitempty"`
+	// ForEach is an expression evaluating to a list of strings, the group is
+	// instantiated for each element, e.g. "$(vars.regions)"
+	ForEach string `yaml:"group_for_each,omitempty"`
+	// Bootstrap groups create the project of the deployment, later groups take
+	// the project ID from the project_id output of the group
+	Bootstrap bool `yaml:"bootstrap,omitempty"`
+	// PostDeploy are commands run on deployed VMs by `ghpc deploy` once the
+	// group is deployed, e.g. to finish configuring the cluster
+	PostDeploy []RemoteCommand `yaml:"post_deploy,omitempty"`
+	// Priority orders groups that do not use outputs of each other, groups of
+	// higher priority are deployed and destroyed first, e.g. slow ones
+	Priority int `yaml:"priority,omitempty"`
+	// DEPRECATED fields, keep in the struct for backwards compatibility
+	DeprecatedKind interface{} `yaml:"kind,omitempty"`
+}
+
+// TimeoutDuration returns the timeout of the group, zero if it is not set
+func (g DeploymentGroup) TimeoutDuration() (time.Duration, error) {
+	if g.Timeout == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(g.Timeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("timeout must be a positive duration, e.g. \"1h30m\", got %q", g.Timeout)
+	}
+	return d, nil
 }
 
 // Kind returns the kind of all the modules in the group.
-// If the group contains modules of different kinds, it returns UnknownKind
+// A group mixing Packer and terraform modules is of TerraformKind, as its
+// directory is a terraform root module; see Stages for how it is deployed.
+// Otherwise, if the group contains modules of different kinds, it returns UnknownKind
 func (g DeploymentGroup) Kind() ModuleKind {
 	if len(g.Modules) == 0 {
 		return UnknownKind
 	}
 	k := g.Modules[0].Kind
 	for _, m := range g.Modules {
-		if m.Kind != k {
-			return UnknownKind
+		if m.Kind == k {
+			continue
+		}
+		if g.Mixed() {
+			return TerraformKind
 		}
+		return UnknownKind
 	}
 	return k
 }
 
+// Mixed returns true if the group contains both Packer and terraform modules
+func (g DeploymentGroup) Mixed() bool {
+	hasPkr, hasTf := false, false
+	for _, m := range g.Modules {
+		hasPkr = hasPkr || m.Kind == PackerKind
+		hasTf = hasTf || m.Kind == TerraformKind
+	}
+	return hasPkr && hasTf
+}
+
+// Stages returns the order in which modules of the group are deployed, it
+// follows references between modules of the group. Each Packer module of a
+// mixed group is a stage of its own, built once the terraform modules it
+// refers to are applied. Terraform modules are applied once the Packer modules
+// listed before them in the group are built, as they may use their images,
+// and once the terraform modules they refer to are applied; terraform modules
+// applied at the same time make a stage, e.g. a network, an image using it,
+// then a cluster using the image. Stages share the name, backend and timeout
+// of the group. A group of a single kind is a single stage.
+func (g DeploymentGroup) Stages() []DeploymentGroup {
+	if !g.Mixed() {
+		return []DeploymentGroup{g}
+	}
+	// Packer modules are built at odd levels, terraform modules applied at even
+	// ones; Packer modules referring to no terraform module are built first
+	levels := map[ModuleID]int{}
+	var level func(m Module) int
+	level = func(m Module) int {
+		if l, ok := levels[m.ID]; ok {
+			return l
+		}
+		levels[m.ID] = 0 // breaks reference cycles, terraform rejects them
+		l := -1
+		for _, d := range g.moduleDependencies(m) {
+			l = max(l, level(d))
+		}
+		if (l%2 == 0) == (m.Kind == PackerKind) {
+			l++
+		}
+		levels[m.ID] = l
+		return l
+	}
+
+	byLevel := map[int][]Module{}
+	for _, m := range g.Modules {
+		l := level(m)
+		byLevel[l] = append(byLevel[l], m)
+	}
+	ls := maps.Keys(byLevel)
+	slices.Sort(ls)
+	res := []DeploymentGroup{}
+	for _, l := range ls {
+		s := g
+		if l%2 == 0 { // terraform modules of a level are applied together
+			s.Modules = byLevel[l]
+			res = append(res, s)
+			continue
+		}
+		for _, m := range byLevel[l] {
+			s.Modules = []Module{m}
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// moduleDependencies returns modules of the group the module has to be deployed
+// after: modules it refers to, and for terraform modules, Packer modules listed
+// before it that do not refer to it
+func (g DeploymentGroup) moduleDependencies(m Module) []Module {
+	res := []Module{}
+	before := true
+	for _, d := range g.Modules {
+		if d.ID == m.ID {
+			before = false
+			continue
+		}
+		implicit := before && m.Kind == TerraformKind && d.Kind == PackerKind && !g.refersTo(d, m.ID, map[ModuleID]bool{})
+		if implicit || g.refersTo(m, d.ID, nil) {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// refersTo tells whether the module refers to the module of the group with the
+// given ID, through other modules of the group if seen is not nil
+func (g DeploymentGroup) refersTo(m Module, id ModuleID, seen map[ModuleID]bool) bool {
+	for r := range valueReferences(m.Settings.AsObject()) {
+		if r.GlobalVar || seen[r.Module] {
+			continue
+		}
+		if r.Module == id {
+			return true
+		}
+		if seen == nil {
+			continue
+		}
+		seen[r.Module] = true
+		if i := slices.IndexFunc(g.Modules, func(o Module) bool { return o.ID == r.Module }); i >= 0 && g.refersTo(g.Modules[i], id, seen) {
+			return true
+		}
+	}
+	return false
+}
+
 // Module return the module with the given ID
 func (bp *Blueprint) Module(id ModuleID) (*Module, error) {
-	var mod *Module
-	bp.WalkModulesSafe(func(_ ModulePath, m *Module) {
-		if m.ID == id {
-			mod = m
+	for ig := range bp.DeploymentGroups {
+		g := &bp.DeploymentGroups[ig]
+		for im := range g.Modules {
+			if g.Modules[im].ID == id {
+				return &g.Modules[im], nil
+			}
 		}
-	})
-	if mod == nil {
-		return nil, UnknownModuleError{id}
 	}
-	return mod, nil
+	return nil, UnknownModuleError{id}
 }
 
 func hintSpelling(s string, dict []string, err error) error {
@@ -161,6 +302,134 @@ func (bp Blueprint) Group(n GroupName) (DeploymentGroup, error) {
 type TerraformBackend struct {
 	Type          string
 	Configuration Dict
+	StateAccess   StateAccess `yaml:"state_access,omitempty"`
+}
+
+// StateAccess configures credentials terraform accesses the state with,
+// apart from those it provisions resources with, e.g. to keep states of
+// deployments in a bucket of a central project
+type StateAccess struct {
+	// ImpersonateServiceAccount is the service account impersonated by the
+	// backend, to initialize it and to read and write the state
+	ImpersonateServiceAccount string `yaml:"impersonate_service_account,omitempty"`
+}
+
+// LocalEncryptedBackend is the type of terraform backend keeping the state in
+// the deployment group directory, encrypted whenever terraform is not running
+const LocalEncryptedBackend = "local-encrypted"
+
+// LocalStateEncryption configures a local-encrypted backend, exactly one of
+// the fields is set
+type LocalStateEncryption struct {
+	// KmsKey is the Cloud KMS key wrapping the key the state is encrypted with
+	KmsKey string `yaml:"kms_key,omitempty"`
+	// PassphraseEnv is the environment variable holding the passphrase the
+	// key the state is encrypted with is derived from
+	PassphraseEnv string `yaml:"passphrase_env,omitempty"`
+}
+
+// LocalStateEncryption returns the configuration of a local-encrypted backend
+func (be TerraformBackend) LocalStateEncryption() (LocalStateEncryption, bool) {
+	if be.Type != LocalEncryptedBackend {
+		return LocalStateEncryption{}, false
+	}
+	str := func(k string) string {
+		if v := be.Configuration.Get(k); be.Configuration.Has(k) && v.Type() == cty.String && v.IsKnown() && !v.IsNull() {
+			return v.AsString()
+		}
+		return ""
+	}
+	return LocalStateEncryption{KmsKey: str("kms_key"), PassphraseEnv: str("passphrase_env")}, true
+}
+
+// TerraformProviders configures installation of terraform providers in
+// deployment groups
+type TerraformProviders struct {
+	// LockPlatforms are platforms checksums are recorded for in the
+	// .terraform.lock.hcl of every group, e.g. "linux_amd64". Lock files are
+	// only generated if set.
+	LockPlatforms []string `yaml:"lock_platforms,omitempty"`
+	// NetworkMirror is the URL of a provider network mirror, providers are
+	// installed from it instead of their origin registries
+	NetworkMirror string `yaml:"network_mirror,omitempty"`
+}
+
+// ArtifactsEncryption configures encryption of deployment group outputs
+// exported to the artifacts directory, exactly one of the fields is set
+type ArtifactsEncryption struct {
+	// KmsKey is the Cloud KMS key outputs are encrypted with, in form
+	// projects/PROJECT/locations/LOCATION/keyRings/RING/cryptoKeys/KEY
+	KmsKey string `yaml:"kms_key,omitempty"`
+	// AgeRecipients are the public keys of age identities able to decrypt
+	// the outputs
+	AgeRecipients []string `yaml:"age_recipients,omitempty"`
+}
+
+// Enabled tells if outputs are encrypted
+func (ae ArtifactsEncryption) Enabled() bool {
+	return ae.KmsKey != "" || len(ae.AgeRecipients) > 0
+}
+
+// StateBackups configures snapshots of the terraform state of deployment
+// groups, taken by `ghpc deploy` and `ghpc destroy` before making changes
+type StateBackups struct {
+	// Disabled turns snapshots off, they are taken by default
+	Disabled bool `yaml:"disabled,omitempty"`
+	// Retain is the number of snapshots kept for each deployment group,
+	// DefaultStateBackupsRetain if unset
+	Retain int `yaml:"retain,omitempty"`
+	// GcsPrefix is a location in form gs://BUCKET/PREFIX snapshots are stored
+	// at instead of the artifacts directory
+	GcsPrefix string `yaml:"gcs_prefix,omitempty"`
+}
+
+// DefaultStateBackupsRetain is the number of state snapshots kept by default
+const DefaultStateBackupsRetain = 10
+
+// Retained returns the number of snapshots to keep for each deployment group
+func (sb StateBackups) Retained() int {
+	if sb.Retain == 0 {
+		return DefaultStateBackupsRetain
+	}
+	return sb.Retain
+}
+
+// Credentials configures short-lived credentials minted out of an OIDC token
+// of the CI system before terraform and packer run, so that deployments do not
+// need long-lived keys on disk
+type Credentials struct {
+	// Provider is "gcp" for workload identity federation or "aws" for STS
+	Provider string `yaml:"provider"`
+	// TokenFile is the file holding the OIDC token, TokenEnv the environment
+	// variable holding it; exactly one of them is set
+	TokenFile string `yaml:"token_file,omitempty"`
+	TokenEnv  string `yaml:"token_env,omitempty"`
+	// Audience is the workload identity pool provider, in form
+	// //iam.googleapis.com/projects/NUMBER/locations/global/workloadIdentityPools/POOL/providers/PROVIDER
+	Audience string `yaml:"audience,omitempty"`
+	// ServiceAccount is impersonated with the federated token, if set
+	ServiceAccount string `yaml:"service_account,omitempty"`
+	// RoleArn is the AWS role assumed with the OIDC token
+	RoleArn string `yaml:"role_arn,omitempty"`
+	// Lifetime of the minted credentials, DefaultCredentialsLifetime if unset
+	Lifetime string `yaml:"lifetime,omitempty"`
+	// Variable is the name of a terraform variable set to the GCP access token
+	Variable string `yaml:"variable,omitempty"`
+}
+
+// DefaultCredentialsLifetime is the lifetime of minted credentials by default
+const DefaultCredentialsLifetime = time.Hour
+
+// LifetimeDuration returns the lifetime of minted credentials
+func (c Credentials) LifetimeDuration() (time.Duration, error) {
+	if c.Lifetime == "" {
+		return DefaultCredentialsLifetime, nil
+	}
+	d, err := time.ParseDuration(c.Lifetime)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("lifetime must be a positive duration, e.g. \"30m\", got %q", c.Lifetime)
+	}
+	return d, nil
 }
 
 // ModuleKind abstracts Toolkit module kinds (presently: packer/terraform)
@@ -199,11 +468,66 @@ func isValidValidationLevel(level int) bool {
 	return !(level > ValidationIgnore || level < ValidationError)
 }
 
+// validatorLevels are values of the level of a validator
+var validatorLevels = map[string]int{
+	"error":   ValidationError,
+	"warning": ValidationWarning,
+	"ignore":  ValidationIgnore,
+}
+
 // Validator defines a validation step to be run on a blueprint
 type Validator struct {
 	Validator string
 	Inputs    Dict `yaml:"inputs,omitempty"`
 	Skip      bool `yaml:"skip,omitempty"`
+	// Level overrides the validation level of the blueprint for this
+	// validator, one of "error", "warning" or "ignore"
+	Level string `yaml:"level,omitempty"`
+}
+
+// ValidationLevel returns the level the validator runs at, the validation
+// level of the blueprint unless overridden by the validator
+func (v Validator) ValidationLevel(bpLevel int) int {
+	if l, ok := validatorLevels[strings.ToLower(v.Level)]; ok {
+		return l
+	}
+	return bpLevel
+}
+
+// PostDeploy tells whether the validator refers to outputs of modules, such
+// validators can only run once the deployment is deployed, by `ghpc verify`
+func (v Validator) PostDeploy() bool {
+	for r := range valueReferences(v.Inputs.AsObject()) {
+		if !r.GlobalVar {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoteCommand is a command run over SSH on a deployed VM
+type RemoteCommand struct {
+	Name    string `yaml:"name,omitempty"`
+	Command string
+	// Target is the VM to run the command on, given by project_id, zone and
+	// instance, optionally user and ssh_key_file; values may refer to outputs
+	// of modules deployed by the group or by previous groups
+	Target Dict `yaml:"target,omitempty"`
+}
+
+// HealthCheck defines a verification step to be run on a deployed cluster
+type HealthCheck struct {
+	Check  string
+	Name   string `yaml:"name,omitempty"`
+	Inputs Dict   `yaml:"inputs,omitempty"`
+}
+
+// StartupScriptPart is a fragment of the module startup script, either given
+// inline or contributed by the startup_script output of a used module
+type StartupScriptPart struct {
+	Content  string   `yaml:"content,omitempty"`
+	Module   ModuleID `yaml:"module,omitempty"`
+	Priority int      `yaml:"priority,omitempty"`
 }
 
 // ModuleID is a unique identifier for a module in a blueprint
@@ -220,9 +544,33 @@ type Module struct {
 	Use      ModuleIDs                 `yaml:"use,omitempty"`
 	Outputs  []modulereader.OutputInfo `yaml:"outputs,omitempty"`
 	Settings Dict                      `yaml:"settings,omitempty"`
+	// UseAliases maps names given to used modules by `use` entries written as
+	// `{id: ID, as: ALIAS}` to their IDs, settings may refer to outputs of
+	// the used module by its alias until the blueprint is expanded
+	UseAliases map[ModuleID]ModuleID `yaml:"-"`
+	// StartupScriptParts are assembled into the startup_script setting
+	StartupScriptParts []StartupScriptPart `yaml:"startup_script_parts,omitempty"`
+	// RenamedFrom is the ID the module had in the previous version of the
+	// blueprint, resources in terraform state are moved to the new ID
+	RenamedFrom ModuleID `yaml:"renamed_from,omitempty"`
+	// Import maps addresses of resources of the module to IDs of existing
+	// cloud resources that terraform adopts instead of creating them
+	Import Dict `yaml:"import,omitempty"`
+	// Distribute fans out blocks of a setting per zone or region, as described
+	// by the module metadata for this value, e.g. "per_zone"
+	Distribute string `yaml:"distribute,omitempty"`
+	// SkipExpansions lists implicit expansions not applied to the module,
+	// e.g. "labels" or "use.network_self_link"
+	SkipExpansions []string `yaml:"skip_expansions,omitempty"`
 	// DEPRECATED fields, keep in the struct for backwards compatibility
 	RequiredApis     interface{} `yaml:"required_apis,omitempty"`
 	WrapSettingsWith interface{} `yaml:"wrapsettingswith,omitempty"`
+	// expression Source was resolved from, if any; NilVal otherwise
+	sourceExpr cty.Value
+	// what `use` did with outputs of used modules, set by Expand
+	useReport []UseInjection
+	// origins of settings not set in the blueprint, set by Expand
+	provenance map[string]SettingProvenance
 }
 
 // InfoOrDie returns the ModuleInfo for the module or panics
@@ -234,6 +582,24 @@ func (m Module) InfoOrDie() modulereader.ModuleInfo {
 	return mi
 }
 
+// SecretVarType is the type of deployment variables holding sensitive values,
+// e.g. license keys. Such variables are never written to the expanded blueprint.
+const SecretVarType = "secret"
+
+// Values of source_base setting of the blueprint
+const (
+	// SourceBaseCwd resolves relative module sources against working directory
+	SourceBaseCwd = "cwd"
+	// SourceBaseBlueprint resolves relative module sources against directory of the blueprint
+	SourceBaseBlueprint = "blueprint"
+)
+
+// VarDeclaration declares properties of a deployment variable
+type VarDeclaration struct {
+	Type        string `yaml:"type,omitempty"`
+	Description string `yaml:"description,omitempty"`
+}
+
 // Blueprint stores the contents on the User YAML
 // omitempty on validation_level ensures that expand will not expose the setting
 // unless it has been set to a non-default value; the implementation as an
@@ -244,8 +610,40 @@ type Blueprint struct {
 	Validators               []Validator `yaml:"validators,omitempty"`
 	ValidationLevel          int         `yaml:"validation_level,omitempty"`
 	Vars                     Dict
-	DeploymentGroups         []DeploymentGroup `yaml:"deployment_groups"`
-	TerraformBackendDefaults TerraformBackend  `yaml:"terraform_backend_defaults,omitempty"`
+	VarDeclarations          map[string]VarDeclaration `yaml:"var_declarations,omitempty"`
+	DeprecatedVars           map[string]string         `yaml:"deprecated_vars,omitempty"`
+	DeploymentGroups         []DeploymentGroup         `yaml:"deployment_groups"`
+	TerraformBackendDefaults TerraformBackend          `yaml:"terraform_backend_defaults,omitempty"`
+	DeploymentLayout         DeploymentLayout          `yaml:"deployment_layout,omitempty"`
+	HealthChecks             []HealthCheck             `yaml:"health_checks,omitempty"`
+	SourceBase               string                    `yaml:"source_base,omitempty"`
+	SourceRoots              map[string]string         `yaml:"source_roots,omitempty"`
+	ModuleRegistry           string                    `yaml:"module_registry,omitempty"`
+	ModuleDefaults           map[string]Dict           `yaml:"module_defaults,omitempty"`
+	SkipExpansions           []string                  `yaml:"skip_expansions,omitempty"`
+	TerraformProviders       TerraformProviders        `yaml:"terraform_providers,omitempty"`
+	Monitoring               Monitoring                `yaml:"monitoring,omitempty"`
+	ArtifactsEncryption      ArtifactsEncryption       `yaml:"artifacts_encryption,omitempty"`
+	StateBackups             StateBackups              `yaml:"state_backups,omitempty"`
+	Credentials              []Credentials             `yaml:"credentials,omitempty"`
+	DataSources              []DataSource              `yaml:"data_sources,omitempty"`
+	CustomValidators         []CustomValidator         `yaml:"custom_validators,omitempty"`
+	ZonePolicy               map[string]ZonePolicy     `yaml:"zone_policy,omitempty"`
+	Images                   map[string]Image          `yaml:"images,omitempty"`
+	// Experimental lists experimental features enabled by the blueprint
+	Experimental []string `yaml:"experimental,omitempty"`
+
+	// absolute path of directory containing the blueprint file, if any
+	dir string
+	// non-fatal issues found while processing the blueprint
+	warnings []Warning
+	// memoized evaluation while groups are expanded, as deployment variables
+	// and identical expressions are evaluated for every module setting
+	memo *evalMemo
+	// deployment variables set on the command line
+	commandLineVars []string
+	// data sources are not fetched, e.g. for blueprints of untrusted users
+	dataSourcesDisabled bool
 }
 
 // DeploymentSettings are deployment-specific override settings
@@ -261,26 +659,95 @@ func (bp *Blueprint) Expand() error {
 	if err := bp.checkBlueprintName(); err != nil {
 		return err
 	}
+	if err := bp.expandDeprecatedVars(); err != nil {
+		return err
+	}
+	if err := bp.expandDataSources(); err != nil {
+		return err
+	}
 	if err := checkBackend(Root.Backend, bp.TerraformBackendDefaults); err != nil {
 		return err
 	}
+	if err := bp.checkExperimental(); err != nil {
+		return err
+	}
+	if err := bp.expandGroupForEach(); err != nil {
+		return err
+	}
+	if err := bp.expandMonitoring(); err != nil {
+		return err
+	}
+	if err := bp.expandUseAliases(); err != nil {
+		return err
+	}
+	if err := validateDeploymentLayout(*bp); err != nil {
+		return err
+	}
+	if err := validateHealthChecks(*bp); err != nil {
+		return err
+	}
+	if err := validatePostDeploy(*bp); err != nil {
+		return err
+	}
+	if err := validateValidators(*bp); err != nil {
+		return err
+	}
+	if err := validateCustomValidators(*bp); err != nil {
+		return err
+	}
+	if err := validateRenamedModules(*bp); err != nil {
+		return err
+	}
+	if err := validateImports(*bp); err != nil {
+		return err
+	}
+	if err := validateSourceResolution(*bp); err != nil {
+		return err
+	}
+	if err := validateModuleDefaults(*bp); err != nil {
+		return err
+	}
+	if err := validateSkipExpansions(*bp); err != nil {
+		return err
+	}
+	if err := validateTerraformProviders(bp.TerraformProviders); err != nil {
+		return err
+	}
+	if err := validateArtifactsEncryption(bp.ArtifactsEncryption); err != nil {
+		return err
+	}
+	if err := validateStateBackups(bp.StateBackups); err != nil {
+		return err
+	}
+	if err := ValidateCredentials(bp.Credentials); err != nil {
+		return err
+	}
+	if err := bp.expandZonePolicy(); err != nil {
+		return err
+	}
 	if err := bp.expandVars(); err != nil {
 		return err
 	}
-	return bp.expandGroups()
+	if err := bp.expandGroups(); err != nil {
+		return err
+	}
+	if err := validateBackendCollisions(*bp); err != nil {
+		return err
+	}
+	bp.collectWarnings()
+	return nil
 }
 
 // ListUnusedModules provides a list modules that are in the
 // "use" field, but not actually used.
 func (m Module) ListUnusedModules() ModuleIDs {
 	used := map[ModuleID]bool{}
-	// Recurse through objects/maps/lists checking each element for having `ProductOfModuleUse` mark.
-	cty.Walk(m.Settings.AsObject(), func(p cty.Path, v cty.Value) (bool, error) {
+	// `use` only marks settings themselves, not values nested in them
+	for _, v := range m.Settings.Items() {
 		for _, mod := range IsProductOfModuleUse(v) {
 			used[mod] = true
 		}
-		return true, nil
-	})
+	}
 
 	unused := ModuleIDs{}
 	for _, w := range m.Use {
@@ -310,10 +777,25 @@ func (bp Blueprint) ListUnusedVariables() []string {
 	}
 	bp.WalkModulesSafe(func(_ ModulePath, m *Module) {
 		ns["module_"+string(m.ID)] = m.Settings.AsObject()
+		ns["import_"+string(m.ID)] = m.Import.AsObject()
+		if m.sourceExpr != cty.NilVal {
+			ns["source_"+string(m.ID)] = m.sourceExpr
+		}
 	})
 	for _, v := range bp.Validators {
 		ns["validator_"+v.Validator] = v.Inputs.AsObject()
 	}
+	for i, h := range bp.HealthChecks {
+		ns[fmt.Sprintf("health_check_%d", i)] = h.Inputs.AsObject()
+	}
+	for ig, g := range bp.DeploymentGroups {
+		for ic, rc := range g.PostDeploy {
+			ns[fmt.Sprintf("post_deploy_%d_%d", ig, ic)] = rc.Target.AsObject()
+		}
+	}
+	for _, d := range bp.DataSources {
+		ns["data_source_"+d.Name] = d.Inputs.AsObject()
+	}
 
 	var used = map[string]bool{
 		"labels":          true, // automatically added
@@ -334,25 +816,18 @@ func (bp Blueprint) ListUnusedVariables() []string {
 
 func checkMovedModule(source string) error {
 	if replacement, ok := movedModules[strings.Trim(source, "./")]; ok {
-		return fmt.Errorf(
-			"a module has moved. %s has been replaced with %s. Please update the source in your blueprint and try again",
-			source, replacement)
+		return HintError{
+			Err: fmt.Errorf(
+				"a module has moved. %s has been replaced with %s. Please update the source in your blueprint and try again",
+				source, replacement),
+			Hint: "`ghpc lint --fix` updates sources of moved modules"}
 	}
 	return nil
 }
 
 // NewBlueprint is a constructor for Blueprint
 func NewBlueprint(configFilename string) (Blueprint, YamlCtx, error) {
-	bp, ctx, err := importBlueprint(configFilename)
-	if err != nil {
-		return Blueprint{}, ctx, err
-	}
-	// if the validation level has been explicitly set to an invalid value
-	// in YAML blueprint then silently default to validationError
-	if !isValidValidationLevel(bp.ValidationLevel) {
-		bp.ValidationLevel = ValidationError
-	}
-	return bp, ctx, nil
+	return LoadBlueprint(context.Background(), BlueprintLocation{Kind: LocalFile, Path: configFilename})
 }
 
 func NewDeploymentSettings(deploymentFilename string) (DeploymentSettings, YamlCtx, error) {
@@ -363,14 +838,40 @@ func NewDeploymentSettings(deploymentFilename string) (DeploymentSettings, YamlC
 	return depl, ctx, nil
 }
 
+// SecretVars returns sorted names of deployment variables declared as secret
+func (bp Blueprint) SecretVars() []string {
+	res := []string{}
+	for n, d := range bp.VarDeclarations {
+		if d.Type == SecretVarType {
+			res = append(res, n)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
 // Export exports the internal representation of a blueprint config
+// Values of secret variables are not exported.
 func (bp Blueprint) Export(outputFilename string) error {
+	bp.Vars = NewDict(bp.Vars.Items()) // clone to not modify original
+	for _, n := range bp.SecretVars() {
+		if bp.Vars.Has(n) {
+			bp.Vars.Set(n, cty.NullVal(cty.DynamicPseudoType))
+		}
+	}
+
 	var buf bytes.Buffer
 	buf.WriteString(YamlLicense)
 	buf.WriteString("\n")
+	var doc yaml.Node
+	if err := doc.Encode(&bp); err != nil {
+		return fmt.Errorf("%s: %w", errMsgYamlMarshalError, err)
+	}
+	bp.annotateRenamedVars(&doc)
+	bp.annotateSettingOrigins(&doc)
 	encoder := yaml.NewEncoder(&buf)
 	encoder.SetIndent(2)
-	err := encoder.Encode(&bp)
+	err := encoder.Encode(&doc)
 	encoder.Close()
 	d := buf.Bytes()
 
@@ -387,6 +888,56 @@ func (bp Blueprint) Export(outputFilename string) error {
 	return nil
 }
 
+// Resolved returns a copy of the blueprint where module settings that only
+// refer to deployment variables are replaced by their values. Settings
+// referring to module outputs, known only once deployed, or to secret
+// variables keep their expressions.
+func (bp Blueprint) Resolved() (Blueprint, error) {
+	secrets := bp.SecretVars()
+	resolvable := func(e Expression) bool {
+		for _, r := range e.References() {
+			if !r.GlobalVar || slices.Contains(secrets, r.Name) {
+				return false
+			}
+		}
+		return true
+	}
+
+	res := bp
+	res.DeploymentGroups = slices.Clone(bp.DeploymentGroups)
+	errs := Errors{}
+	for ig := range res.DeploymentGroups {
+		g := &res.DeploymentGroups[ig]
+		g.Modules = slices.Clone(g.Modules)
+		for im := range g.Modules {
+			m := &g.Modules[im]
+			settings := Dict{}
+			for k, v := range m.Settings.Items() {
+				rv, err := cty.Transform(v, func(_ cty.Path, v cty.Value) (cty.Value, error) {
+					if e, is := IsExpressionValue(v); is && resolvable(e) {
+						return bp.Eval(v)
+					}
+					return v, nil
+				})
+				errs.At(Root.Groups.At(ig).Modules.At(im).Settings.Dot(k), err)
+				settings.Set(k, rv)
+			}
+			m.Settings = settings
+		}
+	}
+	return res, errs.OrNil()
+}
+
+// ExportResolved exports the blueprint with module settings resolved as by
+// Resolved
+func (bp Blueprint) ExportResolved(outputFilename string) error {
+	res, err := bp.Resolved()
+	if err != nil {
+		return err
+	}
+	return res.Export(outputFilename)
+}
+
 // addKindToModules sets the kind to 'terraform' when empty.
 func (bp *Blueprint) addKindToModules() {
 	bp.WalkModulesSafe(func(_ ModulePath, m *Module) {
@@ -430,6 +981,9 @@ func checkModulesAndGroups(bp Blueprint) error {
 		}
 
 		errs.Add(checkBackend(pg.Backend, grp.TerraformBackend))
+		if _, err := grp.TimeoutDuration(); err != nil {
+			errs.At(pg.Timeout, err)
+		}
 	}
 	return errs.OrNil()
 }
@@ -449,6 +1003,40 @@ func checkBackend(bep backendPath, be TerraformBackend) error {
 	if _, is := IsExpressionValue(val); is || perr != nil {
 		return BpError{bep.Type, errors.New("can not use expression as a terraform_backend type")}
 	}
+	if sa := be.StateAccess.ImpersonateServiceAccount; sa != "" {
+		if be.Type != "gcs" {
+			return BpError{bep.StateAccess, errors.New("state_access can only be set for gcs backends")}
+		}
+		if !serviceAccountRegex.MatchString(sa) {
+			return BpError{bep.StateAccess.ImpersonateServiceAccount, fmt.Errorf("impersonate_service_account must be a service account email, got %q", sa)}
+		}
+	}
+	if be.Type == LocalEncryptedBackend {
+		return checkLocalEncryptedBackend(bep, be)
+	}
+	return nil
+}
+
+func checkLocalEncryptedBackend(bep backendPath, be TerraformBackend) error {
+	errs := Errors{}
+	for k, v := range be.Configuration.Items() {
+		switch {
+		case k != "kms_key" && k != "passphrase_env":
+			errs.At(bep.Configuration.Dot(k), fmt.Errorf("%s backend only accepts kms_key and passphrase_env, got %q", LocalEncryptedBackend, k))
+		case v.Type() != cty.String || v.IsNull():
+			errs.At(bep.Configuration.Dot(k), fmt.Errorf("%s must be a string literal", k))
+		}
+	}
+	if errs.Any() {
+		return errs
+	}
+	enc, _ := be.LocalStateEncryption()
+	if (enc.KmsKey == "") == (enc.PassphraseEnv == "") {
+		return BpError{bep.Configuration, fmt.Errorf("%s backend must set exactly one of kms_key and passphrase_env", LocalEncryptedBackend)}
+	}
+	if enc.KmsKey != "" && !kmsKeyRegex.MatchString(enc.KmsKey) {
+		return BpError{bep.Configuration.Dot("kms_key"), fmt.Errorf("kms_key must be in form projects/PROJECT/locations/LOCATION/keyRings/RING/cryptoKeys/KEY, got %q", enc.KmsKey)}
+	}
 	return nil
 }
 
@@ -686,7 +1274,12 @@ func varsTopologicalOrder(vars Dict) ([]string, error) {
 	return res, nil
 }
 
+// evalVars returns evaluated deployment variables, a copy the caller may
+// modify
 func (bp *Blueprint) evalVars() (Dict, error) {
+	if bp.memo != nil {
+		return NewDict(bp.memo.vars.Items()), nil
+	}
 	order, err := varsTopologicalOrder(bp.Vars)
 	if err != nil {
 		return Dict{}, err
@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"testing"
+	"time"
 
 	"hpc-toolkit/pkg/modulereader"
 
@@ -341,16 +342,89 @@ func (s *zeroSuite) TestCheckModulesAndGroups(c *C) {
 		err := checkModulesAndGroups(Blueprint{DeploymentGroups: []DeploymentGroup{ice, ice9}})
 		c.Check(err, ErrorMatches, ".*ice used more than once")
 	}
-	{ // Mixing module kinds
-		g := DeploymentGroup{Name: "ice", Modules: []Module{pony, zebra}}
+	{ // Mixing Packer and terraform modules
+		g := DeploymentGroup{Name: "ice", Modules: []Module{zebra, pony}}
+		c.Check(checkModulesAndGroups(Blueprint{DeploymentGroups: []DeploymentGroup{g}}), IsNil)
+	}
+	{ // Several Packer modules
+		g := DeploymentGroup{Name: "ice", Modules: []Module{zebra, {ID: "zebra2", Kind: PackerKind, Source: "./zebrashop"}}}
 		err := checkModulesAndGroups(Blueprint{DeploymentGroups: []DeploymentGroup{g}})
-		c.Check(err, NotNil)
+		c.Check(err, ErrorMatches, ".*more than 1 module.*")
 	}
 	{ // Empty group
 		g := DeploymentGroup{Name: "ice"}
 		err := checkModulesAndGroups(Blueprint{DeploymentGroups: []DeploymentGroup{g}})
 		c.Check(err, NotNil)
 	}
+	{ // Timeout
+		g := DeploymentGroup{Name: "ice", Modules: []Module{pony}, Timeout: "1h30m"}
+		c.Check(checkModulesAndGroups(Blueprint{DeploymentGroups: []DeploymentGroup{g}}), IsNil)
+		d, _ := g.TimeoutDuration()
+		c.Check(d, Equals, 90*time.Minute)
+	}
+	{ // Invalid timeout
+		g := DeploymentGroup{Name: "ice", Modules: []Module{pony}, Timeout: "forever"}
+		err := checkModulesAndGroups(Blueprint{DeploymentGroups: []DeploymentGroup{g}})
+		c.Check(err, ErrorMatches, ".*timeout must be a positive duration.*")
+	}
+}
+
+func (s *zeroSuite) TestStages(c *C) {
+	tf1 := Module{ID: "tf1", Kind: TerraformKind}
+	tf2 := Module{ID: "tf2", Kind: TerraformKind}
+	pkr1 := Module{ID: "pkr1", Kind: PackerKind}
+	pkr2 := Module{ID: "pkr2", Kind: PackerKind}
+
+	{ // single kind
+		g := DeploymentGroup{Name: "g", Modules: []Module{tf1, tf2}}
+		c.Check(g.Mixed(), Equals, false)
+		c.Check(g.Kind(), Equals, TerraformKind)
+		c.Check(g.Stages(), DeepEquals, []DeploymentGroup{g})
+	}
+	{ // Packer modules are built first
+		g := DeploymentGroup{Name: "g", Timeout: "1h", Modules: []Module{tf1, pkr1, tf2, pkr2}}
+		c.Check(g.Mixed(), Equals, true)
+		c.Check(g.Kind(), Equals, TerraformKind)
+		c.Check(g.Stages(), DeepEquals, []DeploymentGroup{
+			{Name: "g", Timeout: "1h", Modules: []Module{pkr1}},
+			{Name: "g", Timeout: "1h", Modules: []Module{pkr2}},
+			{Name: "g", Timeout: "1h", Modules: []Module{tf1, tf2}},
+		})
+	}
+
+	net := Module{ID: "net", Kind: TerraformKind}
+	img := Module{ID: "img", Kind: PackerKind, Settings: NewDict(map[string]cty.Value{
+		"subnetwork": ModuleRef("net", "subnetwork").AsValue()})}
+	cluster := Module{ID: "cluster", Kind: TerraformKind}
+	{ // Packer module built once terraform modules it refers to are applied
+		g := DeploymentGroup{Name: "g", Modules: []Module{net, img, cluster}}
+		c.Check(g.Stages(), DeepEquals, []DeploymentGroup{
+			{Name: "g", Modules: []Module{net}},
+			{Name: "g", Modules: []Module{img}},
+			{Name: "g", Modules: []Module{cluster}},
+		})
+	}
+	{ // Packer module listed before the terraform module it refers to
+		g := DeploymentGroup{Name: "g", Modules: []Module{img, net, pkr1, cluster}}
+		c.Check(g.Stages(), DeepEquals, []DeploymentGroup{
+			{Name: "g", Modules: []Module{pkr1}},
+			{Name: "g", Modules: []Module{net}},
+			{Name: "g", Modules: []Module{img}},
+			{Name: "g", Modules: []Module{cluster}},
+		})
+	}
+	{ // through terraform modules of the group
+		vpc := Module{ID: "vpc", Kind: TerraformKind, Settings: NewDict(map[string]cty.Value{
+			"network": ModuleRef("net", "network").AsValue()})}
+		img := Module{ID: "img", Kind: PackerKind, Settings: NewDict(map[string]cty.Value{
+			"subnetwork": ModuleRef("vpc", "subnetwork").AsValue()})}
+		g := DeploymentGroup{Name: "g", Modules: []Module{img, vpc, tf1, net}}
+		c.Check(g.Stages(), DeepEquals, []DeploymentGroup{
+			{Name: "g", Modules: []Module{vpc, net}},
+			{Name: "g", Modules: []Module{img}},
+			{Name: "g", Modules: []Module{tf1}},
+		})
+	}
 }
 
 func (s *zeroSuite) TestListUnusedModules(c *C) {
@@ -400,6 +474,37 @@ func (s *zeroSuite) TestListUnusedVariables(c *C) {
 	c.Check(bp.ListUnusedVariables(), DeepEquals, []string{"flathead_screw"})
 }
 
+func (s *zeroSuite) TestInputs(c *C) {
+	bp := Blueprint{
+		Vars: NewDict(map[string]cty.Value{
+			"deployment_name": cty.StringVal("green"),
+			"flathead_screw":  cty.NumberIntVal(1),
+			"pony":            cty.NumberIntVal(2),
+			"license":         cty.StringVal("s3cr3t"),
+		}),
+		VarDeclarations: map[string]VarDeclaration{
+			"license": {Type: SecretVarType},
+			"pony":    {Description: "number of ponies"},
+			"stripes": {Description: "set at create time"},
+		},
+		DeploymentGroups: []DeploymentGroup{{Modules: []Module{{
+			ID:         "circus",
+			Source:     "modules/big/tent",
+			sourceExpr: MustParseExpression(`"modules/${var.stripes}/tent"`).AsValue(),
+			Settings: NewDict(map[string]cty.Value{
+				"ponies": GlobalRef("pony").AsValue(),
+				"key":    GlobalRef("license").AsValue(),
+			}),
+		}}}}}
+
+	c.Check(bp.inputs(bp.Vars), DeepEquals, []Input{
+		{Name: "deployment_name", Type: "string", Default: cty.StringVal("green")},
+		{Name: "license", Type: "any", Default: cty.NilVal, Secret: true, Modules: []ModuleID{"circus"}},
+		{Name: "pony", Type: "number", Default: cty.NumberIntVal(2), Description: "number of ponies", Modules: []ModuleID{"circus"}},
+		{Name: "stripes", Type: "any", Default: cty.NilVal, Description: "set at create time", Modules: []ModuleID{"circus"}},
+	})
+}
+
 func (s *zeroSuite) TestAddKindToModules(c *C) {
 	bp := Blueprint{
 		DeploymentGroups: []DeploymentGroup{
@@ -517,6 +622,8 @@ func (s *MySuite) TestNewBlueprint(c *C) {
 	c.Assert(bp.Export(outFile), IsNil)
 	newBp, _, err := NewBlueprint(outFile)
 	c.Assert(err, IsNil)
+	c.Check(newBp.dir, Equals, s.tmpTestDir)
+	newBp.dir = "" // location is not a part of blueprint content
 	c.Assert(bp, DeepEquals, newBp)
 }
 
@@ -687,6 +794,67 @@ func (s *MySuite) TestExportBlueprint(c *C) {
 	c.Assert(fileInfo.IsDir(), Equals, false)
 }
 
+func (s *MySuite) TestExportBlueprintSecretVars(c *C) {
+	bp := Blueprint{
+		BlueprintName: "goo",
+		Vars: NewDict(map[string]cty.Value{
+			"license": cty.StringVal("s3cr3t"),
+			"zone":    cty.StringVal("danger"),
+		}),
+		VarDeclarations: map[string]VarDeclaration{"license": {Type: SecretVarType}},
+	}
+	outFile := filepath.Join(s.tmpTestDir, "out_TestExportBlueprintSecretVars.yaml")
+	c.Assert(bp.Export(outFile), IsNil)
+
+	got, _, err := NewBlueprint(outFile)
+	c.Assert(err, IsNil)
+	c.Check(got.Vars.Items(), DeepEquals, map[string]cty.Value{
+		"license": cty.NullVal(cty.DynamicPseudoType),
+		"zone":    cty.StringVal("danger"),
+	})
+	c.Check(got.SecretVars(), DeepEquals, []string{"license"})
+	c.Check(bp.Vars.Get("license"), DeepEquals, cty.StringVal("s3cr3t")) // no change
+}
+
+func (s *zeroSuite) TestResolved(c *C) {
+	mustParse := func(s string) cty.Value {
+		v, err := parseYamlString(s)
+		c.Assert(err, IsNil)
+		return v
+	}
+	bp := Blueprint{
+		Vars: NewDict(map[string]cty.Value{
+			"zone":    cty.StringVal("danger"),
+			"license": cty.StringVal("s3cr3t"),
+		}),
+		VarDeclarations: map[string]VarDeclaration{"license": {Type: SecretVarType}},
+		DeploymentGroups: []DeploymentGroup{{Name: "green", Modules: []Module{{
+			ID: "lime",
+			Settings: NewDict(map[string]cty.Value{
+				"zone":    mustParse("$(vars.zone)"),
+				"name":    mustParse("lime-$(vars.zone)"),
+				"zones":   cty.TupleVal([]cty.Value{mustParse("$(vars.zone)"), cty.StringVal("other")}),
+				"network": mustParse("$(net.network_id)"),
+				"license": mustParse("$(vars.license)"),
+				"size":    cty.NumberIntVal(3),
+			})}}}},
+	}
+	orig := bp.DeploymentGroups[0].Modules[0].Settings.Items()
+
+	got, err := bp.Resolved()
+	c.Assert(err, IsNil)
+	c.Check(got.DeploymentGroups[0].Modules[0].Settings.Items(), DeepEquals, map[string]cty.Value{
+		"zone":    cty.StringVal("danger"),
+		"name":    cty.StringVal("lime-danger"),
+		"zones":   cty.TupleVal([]cty.Value{cty.StringVal("danger"), cty.StringVal("other")}),
+		"network": orig["network"], // module outputs are not known
+		"license": orig["license"], // secrets are not revealed
+		"size":    cty.NumberIntVal(3),
+	})
+	// original blueprint is not modified
+	c.Check(bp.DeploymentGroups[0].Modules[0].Settings.Items(), DeepEquals, orig)
+}
+
 func (s *zeroSuite) TestValidationLevels(c *C) {
 	c.Check(isValidValidationLevel(0), Equals, true)
 	c.Check(isValidValidationLevel(1), Equals, true)
@@ -736,6 +904,54 @@ func (s *zeroSuite) TestCheckBackend(c *C) {
 		b := TerraformBackend{Type: "\\$(vartype)"}
 		c.Check(checkBackend(p, b), IsNil)
 	}
+
+	{ // OK. Local encrypted with a passphrase
+		b := TerraformBackend{Type: LocalEncryptedBackend}
+		b.Configuration.Set("passphrase_env", cty.StringVal("STATE_PASSPHRASE"))
+		c.Check(checkBackend(p, b), IsNil)
+		enc, ok := b.LocalStateEncryption()
+		c.Check(ok, Equals, true)
+		c.Check(enc, DeepEquals, LocalStateEncryption{PassphraseEnv: "STATE_PASSPHRASE"})
+	}
+
+	{ // FAIL. Local encrypted with both a key and a passphrase
+		b := TerraformBackend{Type: LocalEncryptedBackend}
+		b.Configuration.
+			Set("passphrase_env", cty.StringVal("STATE_PASSPHRASE")).
+			Set("kms_key", cty.StringVal("projects/p/locations/l/keyRings/r/cryptoKeys/k"))
+		c.Check(checkBackend(p, b), ErrorMatches, ".*must set exactly one of kms_key and passphrase_env")
+	}
+
+	{ // OK. State accessed with an impersonated service account
+		b := TerraformBackend{Type: "gcs", StateAccess: StateAccess{ImpersonateServiceAccount: "state@central.iam.gserviceaccount.com"}}
+		c.Check(checkBackend(p, b), IsNil)
+	}
+
+	{ // FAIL. State access of a non-gcs backend
+		b := TerraformBackend{Type: "local", StateAccess: StateAccess{ImpersonateServiceAccount: "state@central.iam.gserviceaccount.com"}}
+		c.Check(checkBackend(p, b), ErrorMatches, ".*state_access can only be set for gcs backends")
+	}
+
+	{ // FAIL. State access with an invalid service account
+		b := TerraformBackend{Type: "gcs", StateAccess: StateAccess{ImpersonateServiceAccount: "state"}}
+		c.Check(checkBackend(p, b), ErrorMatches, ".*impersonate_service_account must be a service account email.*")
+	}
+
+	{ // FAIL. Local encrypted with an invalid key
+		b := TerraformBackend{Type: LocalEncryptedBackend}
+		b.Configuration.Set("kms_key", cty.StringVal("my-key"))
+		c.Check(checkBackend(p, b), ErrorMatches, ".*kms_key must be in form .*")
+	}
+
+	{ // FAIL. Local encrypted with an unknown setting and an expression
+		b := TerraformBackend{Type: LocalEncryptedBackend}
+		b.Configuration.
+			Set("path", cty.StringVal("state")).
+			Set("passphrase_env", GlobalRef("env").AsValue())
+		err := checkBackend(p, b)
+		c.Check(err, ErrorMatches, `(?s).*only accepts kms_key and passphrase_env, got "path".*`)
+		c.Check(err, ErrorMatches, `(?s).*passphrase_env must be a string literal.*`)
+	}
 }
 
 func (s *zeroSuite) TestSkipValidator(c *C) {
@@ -843,7 +1059,23 @@ func (s *zeroSuite) TestValidateModuleSettingReference(c *C) {
 	c.Check(vld(bp, mod11, ModuleRef("mod21", "out21")), NotNil)
 
 	// FAIL. missing output
-	c.Check(vld(bp, mod22, ModuleRef("mod21", "kale")), NotNil)
+	err := vld(bp, mod22, ModuleRef("mod21", "kale"))
+	c.Check(errors.As(err, &UnknownOutputError{}), Equals, true)
+	c.Check(err, ErrorMatches, `module "mod21" does not have output "kale" - outputs of module "mod21" are: out21`)
+
+	// FAIL. misspelled output
+	c.Check(vld(bp, mod22, ModuleRef("mod21", "outt21")), ErrorMatches, `.* - did you mean "out21"\?`)
+
+	// FAIL. output of another module
+	c.Check(vld(bp, mod22, ModuleRef("mod21", "out11")), ErrorMatches,
+		`.* - output "out11" is provided by module "mod11", did you mean \$\(mod11.out11\)\?`)
+
+	// FAIL. similar output of another module
+	c.Check(vld(bp, mod22, ModuleRef("mod21", "oux11")), ErrorMatches, `.* - did you mean \$\(mod11.out11\)\?`)
+
+	// FAIL. output of a module of a later group
+	c.Check(vld(bp, mod11, ModuleRef("mod11", "out22")), ErrorMatches,
+		`.* - output "out22" is provided by \$\(mod22.out22\) of group "group2", deployed after module "mod11"; move it to an earlier group`)
 
 	// FAIL. packer module
 	c.Check(vld(bp, mod21, ModuleRef("pkr", "outPkr")), NotNil)
@@ -853,6 +1085,11 @@ func (s *zeroSuite) TestValidateModuleSettingReference(c *C) {
 	unkModErr := UnknownModuleError{mod}
 	c.Check(errors.Is(vld(bp, mod11, ModuleRef(mod, "kale")), HintError{`did you mean "vars"?`, unkModErr}), Equals, true)
 
+	// FAIL. get hint for terraform namespace
+	mod = ModuleID("module")
+	unkModErr = UnknownModuleError{mod}
+	c.Check(errors.Is(vld(bp, mod11, ModuleRef(mod, "mod11")), HintError{"module outputs are referred to as $(module_id.output_name)", unkModErr}), Equals, true)
+
 	// FAIL. get module ID hint
 	mod = ModuleID("pkp")
 	unkModErr = UnknownModuleError{mod}
@@ -0,0 +1,126 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// CustomValidator is a policy check of the blueprint, an HCL boolean
+// expression over the expanded blueprint that must hold, e.g.
+// `length(blueprint.deployment_groups) <= 3`. The expression refers to the
+// blueprint as `blueprint` and to deployment variables as `var`.
+type CustomValidator struct {
+	Name      string `yaml:"name,omitempty"`
+	Condition string `yaml:"condition"`
+	// Message explains the failure of the check to users
+	Message string `yaml:"message"`
+	// Level overrides the validation level of the blueprint for this
+	// validator, one of "error", "warning" or "ignore"
+	Level string `yaml:"level,omitempty"`
+}
+
+// ValidationLevel returns the level the validator runs at, the validation
+// level of the blueprint unless overridden by the validator
+func (v CustomValidator) ValidationLevel(bpLevel int) int {
+	if l, ok := validatorLevels[strings.ToLower(v.Level)]; ok {
+		return l
+	}
+	return bpLevel
+}
+
+// ParseCondition parses the condition of the validator
+func (v CustomValidator) ParseCondition() (hclsyntax.Expression, error) {
+	e, diags := hclsyntax.ParseExpression([]byte(v.Condition), "condition", hcl.Pos{Line: 1, Column: 1, Byte: 0})
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	return e, nil
+}
+
+func validateCustomValidators(bp Blueprint) error {
+	errs := Errors{}
+	for i, v := range bp.CustomValidators {
+		p := Root.CustomValidators.At(i)
+		if _, ok := validatorLevels[strings.ToLower(v.Level)]; v.Level != "" && !ok {
+			errs.At(p.Level, fmt.Errorf("level of validator must be one of \"error\", \"warning\" or \"ignore\", got %q", v.Level))
+		}
+		if v.Message == "" {
+			errs.At(p.Message, errors.New("custom validator must set a message"))
+		}
+		if strings.TrimSpace(v.Condition) == "" {
+			errs.At(p.Condition, errors.New("custom validator must set a condition"))
+			continue
+		}
+		e, err := v.ParseCondition()
+		if err != nil {
+			errs.At(p.Condition, err)
+			continue
+		}
+		for _, t := range e.Variables() {
+			if r := t.RootName(); r != "blueprint" && r != "var" {
+				errs.At(p.Condition, fmt.Errorf("condition can only refer to blueprint and var, got %q", r))
+			}
+		}
+	}
+	return errs.OrNil()
+}
+
+// AsValue returns the blueprint as an object for custom validators:
+// blueprint_name, vars, and deployment_groups with their name and modules,
+// each with id, source, kind, use and settings. Settings that refer to module
+// outputs are unknown.
+func (bp *Blueprint) AsValue() (cty.Value, error) {
+	vars, err := bp.evalVars()
+	if err != nil {
+		return cty.NilVal, err
+	}
+	groups := []cty.Value{}
+	for _, g := range bp.DeploymentGroups {
+		mods := []cty.Value{}
+		for _, m := range g.Modules {
+			set, err := bp.PartialEval(m.Settings.AsObject())
+			if err != nil {
+				set = cty.DynamicVal
+			}
+			use := []cty.Value{}
+			for _, u := range m.Use {
+				use = append(use, cty.StringVal(string(u)))
+			}
+			mods = append(mods, cty.ObjectVal(map[string]cty.Value{
+				"id":       cty.StringVal(string(m.ID)),
+				"source":   cty.StringVal(m.Source),
+				"kind":     cty.StringVal(m.Kind.String()),
+				"use":      cty.TupleVal(use),
+				"settings": set,
+			}))
+		}
+		groups = append(groups, cty.ObjectVal(map[string]cty.Value{
+			"name":    cty.StringVal(string(g.Name)),
+			"modules": cty.TupleVal(mods),
+		}))
+	}
+	return cty.ObjectVal(map[string]cty.Value{
+		"blueprint_name":    cty.StringVal(bp.BlueprintName),
+		"vars":              vars.AsObject(),
+		"deployment_groups": cty.TupleVal(groups),
+	}), nil
+}
@@ -0,0 +1,363 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+	ctyJson "github.com/zclconf/go-cty/cty/json"
+	"gopkg.in/yaml.v3"
+)
+
+// dataModuleID is the root of references to data sources, `$(data.net.name)`
+// parses to a reference to output "net" of module "data"
+const dataModuleID ModuleID = "data"
+
+// DataSource is a value fetched when the blueprint is expanded, referred to
+// as `$(data.NAME.FIELD)` in the blueprint. Inputs may refer to deployment
+// variables.
+type DataSource struct {
+	Name   string `yaml:"name"`
+	Type   string `yaml:"type"`
+	Inputs Dict   `yaml:"inputs,omitempty"`
+}
+
+// dataSourceFetcher fetches the value of a data source given its evaluated
+// inputs, it gives up once the context is done
+type dataSourceFetcher func(ctx context.Context, inputs Dict) (cty.Value, error)
+
+// dataSourceTimeout limits how long fetching a data source takes, so that an
+// unresponsive endpoint does not block expansion; replaced in tests
+var dataSourceTimeout = 2 * time.Minute
+
+// dataSourceFetchers by type of data source, replaced in tests
+var dataSourceFetchers = map[string]dataSourceFetcher{
+	"gcs_object": fetchGCSObject,
+	"http_json":  fetchHTTPJSON,
+	"gcloud":     fetchGcloud,
+}
+
+func validateDataSources(bp Blueprint) error {
+	errs := Errors{}
+	seen := map[string]bool{}
+	for i, ds := range bp.DataSources {
+		p := Root.DataSources.At(i)
+		if !hclsyntax.ValidIdentifier(ds.Name) {
+			errs.At(p.Name, fmt.Errorf("data source name must be a valid identifier, got %q", ds.Name))
+		} else if seen[ds.Name] {
+			errs.At(p.Name, fmt.Errorf("data source %q is defined more than once", ds.Name))
+		}
+		seen[ds.Name] = true
+		if _, ok := dataSourceFetchers[ds.Type]; !ok {
+			types := []string{}
+			for t := range dataSourceFetchers {
+				types = append(types, t)
+			}
+			sort.Strings(types)
+			errs.At(p.Type, fmt.Errorf("data source type must be one of %s, got %q", strings.Join(types, ", "), ds.Type))
+		}
+		for k, v := range ds.Inputs.Items() {
+			for r := range valueReferences(v) {
+				if !r.GlobalVar {
+					errs.At(p.Inputs.Dot(k), fmt.Errorf("data source inputs can only refer to deployment variables, got reference to module %q", r.Module))
+				}
+			}
+		}
+	}
+	if len(bp.DataSources) > 0 {
+		bp.WalkModulesSafe(func(mp ModulePath, m *Module) {
+			if m.ID == dataModuleID {
+				errs.At(mp.ID, fmt.Errorf("module id %q is reserved for references to data sources", dataModuleID))
+			}
+		})
+	}
+	return errs.OrNil()
+}
+
+// DisableDataSources makes expansion fail if the blueprint has data sources,
+// which are fetched with credentials of the process and given back in the
+// expanded blueprint
+func (bp *Blueprint) DisableDataSources() {
+	bp.dataSourcesDisabled = true
+}
+
+// expandDataSources fetches data sources and substitutes references to them
+// with their values. Inputs of data sources are evaluated without deployment
+// variables that refer to data sources themselves.
+func (bp *Blueprint) expandDataSources() error {
+	if len(bp.DataSources) == 0 {
+		return nil
+	}
+	if bp.dataSourcesDisabled {
+		return BpError{Root.DataSources, errors.New("data sources are disabled")}
+	}
+	if err := validateDataSources(*bp); err != nil {
+		return err
+	}
+
+	ibp := Blueprint{}
+	for k, v := range bp.Vars.Items() {
+		if !refersToDataSources(v) {
+			ibp.Vars.Set(k, v)
+		}
+	}
+	errs := Errors{}
+	data := map[string]cty.Value{}
+	for i, ds := range bp.DataSources {
+		p := Root.DataSources.At(i)
+		inputs, err := ds.Inputs.Eval(ibp)
+		if err != nil {
+			errs.At(p.Inputs, err)
+			continue
+		}
+		if data[ds.Name], err = fetchDataSource(ds, inputs); err != nil {
+			errs.At(p, fmt.Errorf("failed to fetch data source %q: %w", ds.Name, err))
+		}
+	}
+	if errs.Any() {
+		return errs
+	}
+	return bp.substituteDataSources(cty.ObjectVal(data))
+}
+
+// fetchDataSource fetches the data source within dataSourceTimeout
+func fetchDataSource(ds DataSource, inputs Dict) (cty.Value, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dataSourceTimeout)
+	defer cancel()
+	v, err := dataSourceFetchers[ds.Type](ctx, inputs)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return cty.NilVal, fmt.Errorf("timed out after %s: %w", dataSourceTimeout, err)
+	}
+	return v, err
+}
+
+func refersToDataSources(v cty.Value) bool {
+	for r := range valueReferences(v) {
+		if r.Module == dataModuleID {
+			return true
+		}
+	}
+	return false
+}
+
+// substituteDataSources replaces references to data sources in every part of
+// the blueprint that accepts expressions
+func (bp *Blueprint) substituteDataSources(data cty.Value) error {
+	errs := Errors{}
+	sub := func(p Path, d *Dict) {
+		nd, err := substituteDataRefs(*d, data)
+		if err != nil {
+			errs.At(p, err)
+			return
+		}
+		*d = nd
+	}
+	sub(Root.Vars, &bp.Vars)
+	sub(Root.Backend.Configuration, &bp.TerraformBackendDefaults.Configuration)
+	for ig := range bp.DeploymentGroups {
+		g := &bp.DeploymentGroups[ig]
+		sub(Root.Groups.At(ig).Backend.Configuration, &g.TerraformBackend.Configuration)
+		for ic := range g.PostDeploy {
+			sub(Root.Groups.At(ig).PostDeploy.At(ic).Target, &g.PostDeploy[ic].Target)
+		}
+	}
+	bp.WalkModulesSafe(func(p ModulePath, m *Module) {
+		sub(p.Settings, &m.Settings)
+		sub(p.Import, &m.Import)
+	})
+	for i := range bp.Validators {
+		sub(Root.Validators.At(i).Inputs, &bp.Validators[i].Inputs)
+	}
+	for i := range bp.HealthChecks {
+		sub(Root.HealthChecks.At(i).Inputs, &bp.HealthChecks[i].Inputs)
+	}
+	return errs.OrNil()
+}
+
+// substituteDataRefs returns a copy of the Dict with every traversal of a
+// data source, e.g. `module.data.net.subnets[0]`, replaced by the literal
+// value it points to; expressions left without any references are evaluated
+func substituteDataRefs(d Dict, data cty.Value) (Dict, error) {
+	if d.IsZero() {
+		return Dict{}, nil
+	}
+	ctx := hcl.EvalContext{
+		Variables: map[string]cty.Value{"module": cty.ObjectVal(map[string]cty.Value{string(dataModuleID): data})},
+		Functions: functions()}
+	v, err := cty.Transform(d.AsObject(), func(p cty.Path, v cty.Value) (cty.Value, error) {
+		e, is := IsExpressionValue(v)
+		if !is || !refersToDataSources(v) {
+			return v, nil
+		}
+		toks := e.Tokenize()
+		for _, t := range e.(BaseExpression).e.Variables() {
+			if r, err := TraversalToReference(t); err != nil || r.Module != dataModuleID {
+				continue
+			}
+			tv, diag := t.TraverseAbs(&ctx)
+			if diag.HasErrors() {
+				return cty.NilVal, diag.Errs()[0]
+			}
+			toks = replaceTokens(toks, hclwrite.TokensForTraversal(t), TokensForValue(tv))
+		}
+		ne, err := ParseExpression(string(toks.Bytes()))
+		if err != nil {
+			return cty.NilVal, err
+		}
+		if len(ne.References()) == 0 {
+			return ne.Eval(&hcl.EvalContext{Functions: functions()})
+		}
+		return ne.AsValue(), nil
+	})
+	if err != nil {
+		return Dict{}, err
+	}
+	return NewDict(v.AsValueMap()), nil
+}
+
+func stringInput(inputs Dict, name string) (string, error) {
+	v := inputs.Get(name)
+	if !inputs.Has(name) || v.IsNull() || v.Type() != cty.String || v.AsString() == "" {
+		return "", fmt.Errorf("input %q must be set to a string", name)
+	}
+	return v.AsString(), nil
+}
+
+// parseDataValue converts JSON or YAML content to a value
+func parseDataValue(b []byte) (cty.Value, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return cty.NilVal, err
+	}
+	j, err := json.Marshal(doc)
+	if err != nil {
+		return cty.NilVal, err
+	}
+	ty, err := ctyJson.ImpliedType(j)
+	if err != nil {
+		return cty.NilVal, err
+	}
+	return ctyJson.Unmarshal(j, ty)
+}
+
+// fetchGCSObject reads a JSON or YAML object of Cloud Storage, given by its
+// `url`, e.g. gs://bucket/network.json
+func fetchGCSObject(ctx context.Context, inputs Dict) (cty.Value, error) {
+	u, err := stringInput(inputs, "url")
+	if err != nil {
+		return cty.NilVal, err
+	}
+	b, err := readGCSObject(ctx, u)
+	if err != nil {
+		return cty.NilVal, err
+	}
+	return parseDataValue(b)
+}
+
+// fetchHTTPJSON gets a JSON document from `url`, sending `headers` if set
+func fetchHTTPJSON(ctx context.Context, inputs Dict) (cty.Value, error) {
+	u, err := stringInput(inputs, "url")
+	if err != nil {
+		return cty.NilVal, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return cty.NilVal, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if err := setHeaders(req, inputs); err != nil {
+		return cty.NilVal, err
+	}
+	resp, err := dataSourceHTTPClient.Do(req)
+	if err != nil {
+		return cty.NilVal, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return cty.NilVal, fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return cty.NilVal, err
+	}
+	if !json.Valid(b) {
+		return cty.NilVal, fmt.Errorf("%s did not return a JSON document", u)
+	}
+	return parseDataValue(b)
+}
+
+// dataSourceHTTPClient gets data sources over HTTP, requests are also bound to
+// the context of the fetch
+var dataSourceHTTPClient = &http.Client{Timeout: dataSourceTimeout}
+
+// setHeaders sets headers of the request from input `headers`, if set
+func setHeaders(req *http.Request, inputs Dict) error {
+	h := inputs.Get("headers")
+	if !inputs.Has("headers") || h.IsNull() {
+		return nil
+	}
+	if !h.Type().IsObjectType() && !h.Type().IsMapType() {
+		return errors.New("input \"headers\" must be a map of strings")
+	}
+	for k, v := range h.AsValueMap() {
+		if v.IsNull() || v.Type() != cty.String {
+			return errors.New("input \"headers\" must be a map of strings")
+		}
+		req.Header.Set(k, v.AsString())
+	}
+	return nil
+}
+
+// fetchGcloud runs gcloud with `args` and JSON output, e.g.
+// [compute, networks, describe, my-net, --project=my-project]
+func fetchGcloud(ctx context.Context, inputs Dict) (cty.Value, error) {
+	av := inputs.Get("args")
+	if !inputs.Has("args") || av.IsNull() || !(av.Type().IsListType() || av.Type().IsTupleType()) || av.LengthInt() == 0 {
+		return cty.NilVal, errors.New("input \"args\" must be a list of strings")
+	}
+	args := []string{}
+	for it := av.ElementIterator(); it.Next(); {
+		_, a := it.Element()
+		if a.IsNull() || a.Type() != cty.String {
+			return cty.NilVal, errors.New("input \"args\" must be a list of strings")
+		}
+		args = append(args, a.AsString())
+	}
+	if _, err := exec.LookPath("gcloud"); err != nil {
+		return cty.NilVal, HintError{Hint: "must have a copy of gcloud installed in PATH", Err: err}
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "gcloud", append(args, "--format=json")...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	cmd.WaitDelay = 5 * time.Second // children of gcloud may keep its output open
+	if err := cmd.Run(); err != nil {
+		return cty.NilVal, fmt.Errorf("gcloud %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return parseDataValue(stdout.Bytes())
+}
@@ -0,0 +1,180 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func dataSourcesBlueprint(c *C) Blueprint {
+	mustParse := func(s string) cty.Value {
+		v, err := parseYamlString(s)
+		c.Assert(err, IsNil)
+		return v
+	}
+	return Blueprint{
+		Vars: NewDict(map[string]cty.Value{
+			"project_id": cty.StringVal("apple"),
+			"network":    mustParse("$(data.net.name)"),
+		}),
+		DataSources: []DataSource{{
+			Name: "net",
+			Type: "fake",
+			Inputs: NewDict(map[string]cty.Value{
+				"project": mustParse("$(vars.project_id)"),
+			}),
+		}},
+		DeploymentGroups: []DeploymentGroup{{Name: "green", Modules: []Module{{
+			ID: "lime",
+			Settings: NewDict(map[string]cty.Value{
+				"subnet": mustParse("$(data.net.subnets[0])"),
+				"range":  mustParse(`$(data.net.ranges["10.0.0.0/8"])-$(vars.project_id)`),
+				"output": mustParse("$(data.net.name)-$(pear.id)"),
+			}),
+		}}}},
+	}
+}
+
+func (s *zeroSuite) TestExpandDataSources(c *C) {
+	defer func(f map[string]dataSourceFetcher) { dataSourceFetchers = f }(dataSourceFetchers)
+	dataSourceFetchers = map[string]dataSourceFetcher{
+		"fake": func(_ context.Context, inputs Dict) (cty.Value, error) {
+			if p := inputs.Get("project"); p.AsString() != "apple" {
+				return cty.NilVal, fmt.Errorf("unknown project %q", p.AsString())
+			}
+			return parseDataValue([]byte(`{"name": "net0", "subnets": ["sub0"], "ranges": {"10.0.0.0/8": "private"}}`))
+		},
+	}
+
+	{ // references are substituted, expressions left without references are evaluated
+		bp := dataSourcesBlueprint(c)
+		c.Assert(bp.expandDataSources(), IsNil)
+		c.Check(bp.Vars.Get("network"), Equals, cty.StringVal("net0"))
+		set := bp.DeploymentGroups[0].Modules[0].Settings
+		c.Check(set.Get("subnet"), Equals, cty.StringVal("sub0"))
+		c.Check(set.Get("range"), DeepEquals, MustParseExpression(`"${"private"}-${var.project_id}"`).AsValue())
+		c.Check(set.Get("output"), DeepEquals, MustParseExpression(`"${"net0"}-${module.pear.id}"`).AsValue())
+	}
+
+	{ // Fail: data sources are disabled
+		bp := dataSourcesBlueprint(c)
+		bp.DisableDataSources()
+		c.Check(bp.expandDataSources(), ErrorMatches, ".*data sources are disabled")
+	}
+
+	{ // Fail: fetch error
+		bp := dataSourcesBlueprint(c)
+		bp.Vars.Set("project_id", cty.StringVal("pear"))
+		c.Check(bp.expandDataSources(), ErrorMatches, `(?s).*failed to fetch data source "net": unknown project "pear".*`)
+	}
+
+	{ // Fail: fetch times out
+		defer func(t time.Duration) { dataSourceTimeout = t }(dataSourceTimeout)
+		dataSourceTimeout = 10 * time.Millisecond
+		dataSourceFetchers["fake"] = func(ctx context.Context, _ Dict) (cty.Value, error) {
+			<-ctx.Done()
+			return cty.NilVal, ctx.Err()
+		}
+		bp := dataSourcesBlueprint(c)
+		c.Check(bp.expandDataSources(), ErrorMatches, `(?s).*failed to fetch data source "net": timed out after 10ms.*`)
+	}
+
+	{ // Fail: inputs can not refer to vars that refer to data sources
+		bp := dataSourcesBlueprint(c)
+		bp.DataSources[0].Inputs.Set("project", MustParseExpression("var.network").AsValue())
+		c.Check(bp.expandDataSources(), NotNil)
+	}
+}
+
+func (s *zeroSuite) TestValidateDataSources(c *C) {
+	defer func(f map[string]dataSourceFetcher) { dataSourceFetchers = f }(dataSourceFetchers)
+	dataSourceFetchers = map[string]dataSourceFetcher{
+		"fake": func(context.Context, Dict) (cty.Value, error) { return cty.NilVal, errors.New("unreachable") },
+	}
+	c.Check(validateDataSources(dataSourcesBlueprint(c)), IsNil)
+
+	{
+		bp := dataSourcesBlueprint(c)
+		bp.DataSources = append(bp.DataSources, bp.DataSources[0])
+		c.Check(validateDataSources(bp), ErrorMatches, `.*data source "net" is defined more than once.*`)
+	}
+	{
+		bp := dataSourcesBlueprint(c)
+		bp.DataSources[0].Name = "1net"
+		c.Check(validateDataSources(bp), ErrorMatches, `.*must be a valid identifier.*`)
+	}
+	{
+		bp := dataSourcesBlueprint(c)
+		bp.DataSources[0].Type = "terraform"
+		c.Check(validateDataSources(bp), ErrorMatches, `.*data source type must be one of fake, got "terraform".*`)
+	}
+	{
+		bp := dataSourcesBlueprint(c)
+		bp.DataSources[0].Inputs.Set("project", ModuleRef("pear", "project").AsValue())
+		c.Check(validateDataSources(bp), ErrorMatches, `.*can only refer to deployment variables.*`)
+	}
+	{
+		bp := dataSourcesBlueprint(c)
+		bp.DeploymentGroups[0].Modules[0].ID = "data"
+		c.Check(validateDataSources(bp), ErrorMatches, `.*module id "data" is reserved.*`)
+	}
+}
+
+func (s *zeroSuite) TestFetchHTTPJSON(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("Authorization") != "Bearer t0ken":
+			w.WriteHeader(http.StatusForbidden)
+		case r.URL.Path == "/net":
+			fmt.Fprint(w, `{"name": "net0", "mtu": 1460}`)
+		default:
+			fmt.Fprint(w, `name: net0`)
+		}
+	}))
+	defer srv.Close()
+	headers := cty.ObjectVal(map[string]cty.Value{"Authorization": cty.StringVal("Bearer t0ken")})
+	ctx := context.Background()
+
+	v, err := fetchHTTPJSON(ctx, NewDict(map[string]cty.Value{"url": cty.StringVal(srv.URL + "/net"), "headers": headers}))
+	c.Assert(err, IsNil)
+	c.Check(v.GetAttr("name"), Equals, cty.StringVal("net0"))
+	c.Check(v.GetAttr("mtu").Equals(cty.NumberIntVal(1460)), Equals, cty.True)
+
+	_, err = fetchHTTPJSON(ctx, NewDict(map[string]cty.Value{"url": cty.StringVal(srv.URL + "/net")}))
+	c.Check(err, ErrorMatches, ".*returned 403 Forbidden")
+
+	_, err = fetchHTTPJSON(ctx, NewDict(map[string]cty.Value{"url": cty.StringVal(srv.URL + "/yaml"), "headers": headers}))
+	c.Check(err, ErrorMatches, ".*did not return a JSON document")
+
+	_, err = fetchHTTPJSON(ctx, Dict{})
+	c.Check(err, ErrorMatches, `input "url" must be set to a string`)
+}
+
+func (s *zeroSuite) TestFetchInputs(c *C) {
+	ctx := context.Background()
+	_, err := fetchGCSObject(ctx, NewDict(map[string]cty.Value{"url": cty.StringVal("https://bucket/object")}))
+	c.Check(err, ErrorMatches, "url must be in form gs://BUCKET/OBJECT.*")
+
+	_, err = fetchGcloud(ctx, NewDict(map[string]cty.Value{"args": cty.StringVal("compute networks list")}))
+	c.Check(err, ErrorMatches, `input "args" must be a list of strings`)
+}
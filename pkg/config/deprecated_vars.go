@@ -0,0 +1,197 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"gopkg.in/yaml.v3"
+)
+
+// deprecatedVar is an entry of deprecated_vars, the variable is either renamed
+// to another deployment variable or removed, with a message telling what to
+// do instead
+type deprecatedVar struct {
+	name    string
+	renamed string
+	message string
+}
+
+// deprecatedVars returns entries of deprecated_vars sorted by name. Values
+// that are names of variables are renames, any other value is a message.
+func (bp Blueprint) deprecatedVars() []deprecatedVar {
+	res := []deprecatedVar{}
+	for n, v := range bp.DeprecatedVars {
+		if hclsyntax.ValidIdentifier(v) {
+			res = append(res, deprecatedVar{name: n, renamed: v})
+		} else {
+			res = append(res, deprecatedVar{name: n, message: v})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+	return res
+}
+
+func validateDeprecatedVars(bp Blueprint) error {
+	errs := Errors{}
+	for _, d := range bp.deprecatedVars() {
+		p := Root.DeprecatedVars.Dot(d.name)
+		switch {
+		case d.renamed == "":
+		case d.renamed == d.name:
+			errs.At(p, fmt.Errorf("deployment variable %q can not be renamed to itself", d.name))
+		case bp.DeprecatedVars[d.renamed] != "":
+			errs.At(p, fmt.Errorf("deployment variable %q can not be renamed to %q, as it is deprecated as well", d.name, d.renamed))
+		case !bp.Vars.Has(d.renamed):
+			errs.At(p, fmt.Errorf("deployment variable %q is renamed to %q, which is not defined", d.name, d.renamed))
+		}
+	}
+	return errs.OrNil()
+}
+
+// expandDeprecatedVars moves values of renamed deployment variables to their
+// new names and rewrites references to them, a value set for the old name
+// replaces the one of the new name. Uses of removed variables are errors,
+// hinted with their message.
+func (bp *Blueprint) expandDeprecatedVars() error {
+	if err := validateDeprecatedVars(*bp); err != nil {
+		return err
+	}
+	errs := Errors{}
+	for _, d := range bp.deprecatedVars() {
+		p := Root.Vars.Dot(d.name)
+		if !bp.Vars.Has(d.name) {
+			continue
+		}
+		if d.renamed == "" {
+			errs.At(p, HintError{
+				Hint: d.message,
+				Err:  fmt.Errorf("deployment variable %q has been removed", d.name)})
+			continue
+		}
+		bp.Warn(WarningDeprecated, p, "deployment variable %q is deprecated, its value is used for %q", d.name, d.renamed)
+		vars := bp.Vars.Items()
+		vars[d.renamed] = vars[d.name]
+		delete(vars, d.name)
+		bp.Vars = NewDict(vars)
+		if decl, ok := bp.VarDeclarations[d.name]; ok {
+			if _, declared := bp.VarDeclarations[d.renamed]; !declared {
+				bp.VarDeclarations[d.renamed] = decl
+			}
+			delete(bp.VarDeclarations, d.name)
+		}
+	}
+	if errs.Any() {
+		return errs
+	}
+	return bp.renameDeprecatedVarRefs()
+}
+
+// renameDeprecatedVarRefs rewrites references to renamed deployment variables
+// in every part of the blueprint that accepts expressions
+func (bp *Blueprint) renameDeprecatedVarRefs() error {
+	r := varRenamer{bp: bp, warned: map[string]bool{}}
+	r.dict(Root.Vars, &bp.Vars)
+	r.dict(Root.Backend.Configuration, &bp.TerraformBackendDefaults.Configuration)
+	for i := range bp.DataSources {
+		r.dict(Root.DataSources.At(i).Inputs, &bp.DataSources[i].Inputs)
+	}
+	for n, d := range bp.ModuleDefaults {
+		r.dict(Root.ModuleDefaults.Dot(n), &d)
+		bp.ModuleDefaults[n] = d
+	}
+	for ig := range bp.DeploymentGroups {
+		g := &bp.DeploymentGroups[ig]
+		r.dict(Root.Groups.At(ig).Backend.Configuration, &g.TerraformBackend.Configuration)
+		for ic := range g.PostDeploy {
+			r.dict(Root.Groups.At(ig).PostDeploy.At(ic).Target, &g.PostDeploy[ic].Target)
+		}
+	}
+	bp.WalkModulesSafe(func(p ModulePath, m *Module) {
+		r.dict(p.Settings, &m.Settings)
+		r.dict(p.Import, &m.Import)
+	})
+	for i := range bp.Validators {
+		r.dict(Root.Validators.At(i).Inputs, &bp.Validators[i].Inputs)
+	}
+	for i := range bp.HealthChecks {
+		r.dict(Root.HealthChecks.At(i).Inputs, &bp.HealthChecks[i].Inputs)
+	}
+	return r.errs.OrNil()
+}
+
+// varRenamer rewrites references to renamed deployment variables, warning
+// once per variable
+type varRenamer struct {
+	bp     *Blueprint
+	errs   Errors
+	warned map[string]bool
+}
+
+func (r *varRenamer) dict(p Path, d *Dict) {
+	if d.IsZero() {
+		return
+	}
+	nd, err := cty.Transform(d.AsObject(), func(_ cty.Path, v cty.Value) (cty.Value, error) {
+		e, is := IsExpressionValue(v)
+		if !is {
+			return v, nil
+		}
+		return r.expression(p, e)
+	})
+	if err != nil {
+		r.errs.At(p, err)
+		return
+	}
+	*d = NewDict(nd.AsValueMap())
+}
+
+func (r *varRenamer) expression(p Path, e Expression) (cty.Value, error) {
+	for _, dv := range r.bp.deprecatedVars() {
+		ref := GlobalRef(dv.name)
+		if _, ok := valueReferences(e.AsValue())[ref]; !ok {
+			continue
+		}
+		if dv.renamed == "" {
+			return cty.NilVal, HintError{
+				Hint: dv.message,
+				Err:  fmt.Errorf("deployment variable %q has been removed", dv.name)}
+		}
+		if !r.warned[dv.name] {
+			r.bp.Warn(WarningDeprecated, p, "deployment variable %q is deprecated, references to it are rewritten to %q", dv.name, dv.renamed)
+			r.warned[dv.name] = true
+		}
+		ne, err := ReplaceSubExpressions(e, ref.AsExpression(), GlobalRef(dv.renamed).AsExpression())
+		if err != nil {
+			return cty.NilVal, err
+		}
+		e = ne
+	}
+	return e.AsValue(), nil
+}
+
+// annotateRenamedVars comments deployment variables of the exported blueprint
+// that deprecated variables are renamed to
+func (bp Blueprint) annotateRenamedVars(doc *yaml.Node) {
+	vars := mappingValue(doc, "vars")
+	for _, d := range bp.deprecatedVars() {
+		if k := mappingKey(vars, d.renamed); d.renamed != "" && k != nil {
+			k.LineComment = fmt.Sprintf("formerly %s, which is deprecated", d.name)
+		}
+	}
+}
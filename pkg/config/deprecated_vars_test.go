@@ -0,0 +1,105 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func deprecatedVarsBlueprint() Blueprint {
+	mod := Module{ID: "net", Source: "modules/network/vpc"}
+	mod.Settings.Set("name", MustParseExpression(`"${var.net_name}-${var.zone}"`).AsValue())
+	return Blueprint{
+		BlueprintName: "lime",
+		Vars: NewDict(map[string]cty.Value{
+			"network_name": cty.StringVal("net"),
+			"zone":         cty.StringVal("us-central1-a"),
+		}),
+		DeprecatedVars: map[string]string{
+			"net_name":  "network_name",
+			"subnet_ip": "subnetworks are now created by the network module",
+		},
+		DeploymentGroups: []DeploymentGroup{{Name: "green", Modules: []Module{mod}}},
+	}
+}
+
+func (s *zeroSuite) TestExpandDeprecatedVars(c *C) {
+	{ // references are rewritten to the new name
+		bp := deprecatedVarsBlueprint()
+		c.Assert(bp.expandDeprecatedVars(), IsNil)
+		c.Check(bp.Vars.Get("network_name"), Equals, cty.StringVal("net"))
+		c.Check(bp.DeploymentGroups[0].Modules[0].Settings.Get("name"), DeepEquals,
+			MustParseExpression(`"${var.network_name}-${var.zone}"`).AsValue())
+		c.Check(bp.Warnings(), HasLen, 1)
+	}
+
+	{ // value set for the old name is moved to the new name
+		bp := deprecatedVarsBlueprint()
+		bp.Vars.Set("net_name", cty.StringVal("legacy"))
+		bp.VarDeclarations = map[string]VarDeclaration{"net_name": {Description: "name of the network"}}
+		c.Assert(bp.expandDeprecatedVars(), IsNil)
+		c.Check(bp.Vars.Has("net_name"), Equals, false)
+		c.Check(bp.Vars.Get("network_name"), Equals, cty.StringVal("legacy"))
+		c.Check(bp.VarDeclarations, DeepEquals, map[string]VarDeclaration{"network_name": {Description: "name of the network"}})
+		c.Check(bp.Warnings(), HasLen, 2)
+	}
+
+	{ // FAIL: removed variable is set
+		bp := deprecatedVarsBlueprint()
+		bp.Vars.Set("subnet_ip", cty.StringVal("10.0.0.0/16"))
+		err := bp.expandDeprecatedVars()
+		c.Check(err, ErrorMatches, `(?s).*deployment variable "subnet_ip" has been removed.*`)
+		c.Check(err, ErrorMatches, `(?s).*subnetworks are now created by the network module.*`)
+	}
+
+	{ // FAIL: removed variable is referenced
+		bp := deprecatedVarsBlueprint()
+		bp.DeploymentGroups[0].Modules[0].Settings.Set("ip", MustParseExpression("var.subnet_ip").AsValue())
+		c.Check(bp.expandDeprecatedVars(), ErrorMatches, `(?s).*deployment variable "subnet_ip" has been removed.*`)
+	}
+}
+
+func (s *zeroSuite) TestValidateDeprecatedVars(c *C) {
+	c.Check(validateDeprecatedVars(deprecatedVarsBlueprint()), IsNil)
+
+	{ // FAIL: new name is not defined
+		bp := deprecatedVarsBlueprint()
+		bp.DeprecatedVars["net_name"] = "net_id"
+		c.Check(validateDeprecatedVars(bp), ErrorMatches, `(?s).*renamed to "net_id", which is not defined.*`)
+	}
+
+	{ // FAIL: new name is deprecated as well
+		bp := deprecatedVarsBlueprint()
+		bp.DeprecatedVars["network_name"] = "zone"
+		c.Check(validateDeprecatedVars(bp), ErrorMatches, `(?s).*as it is deprecated as well.*`)
+	}
+}
+
+func (s *zeroSuite) TestExportAnnotatesRenamedVars(c *C) {
+	bp := deprecatedVarsBlueprint()
+	out := filepath.Join(c.MkDir(), "expanded.yaml")
+	c.Assert(bp.Export(out), IsNil)
+	b, err := os.ReadFile(out)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Matches, `(?s).*\n  network_name: net # formerly net_name, which is deprecated\n.*`)
+
+	got, _, err := NewBlueprint(out)
+	c.Assert(err, IsNil)
+	c.Check(got.DeprecatedVars, DeepEquals, bp.DeprecatedVars)
+}
@@ -0,0 +1,220 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// deprecatedFieldsRemoval is the release deprecated fields of blueprints,
+// accepted and ignored so far, are removed in
+const deprecatedFieldsRemoval = "v2.0.0"
+
+// UpgradeAction is the kind of rewrite resolving a deprecation
+type UpgradeAction string
+
+const (
+	// UpgradeRemove deletes the deprecated field
+	UpgradeRemove UpgradeAction = "remove"
+	// UpgradeReplace replaces the value of the deprecated field
+	UpgradeReplace UpgradeAction = "replace"
+)
+
+// Upgrade is the rewrite of the blueprint `ghpc lint --fix` applies to
+// resolve a deprecation
+type Upgrade struct {
+	Action UpgradeAction `json:"action"`
+	// Value is the new value of the field, for UpgradeReplace
+	Value string `json:"value,omitempty"`
+}
+
+// Deprecations lists deprecated fields and moved module sources of the
+// blueprint as written, before it is expanded
+func (bp Blueprint) Deprecations() []Warning {
+	ws := []Warning{}
+	deprecate := func(p Path, removal string, u Upgrade, f string, a ...any) {
+		ws = append(ws, Warning{
+			Category: WarningDeprecated,
+			Path:     p,
+			Message:  fmt.Sprintf(f, a...),
+			Removal:  removal,
+			Upgrade:  &u})
+	}
+	remove := Upgrade{Action: UpgradeRemove}
+
+	if bp.GhpcVersion != "" {
+		deprecate(Root.GhpcVersion, "", remove, "ghpc_version setting is ignored")
+	}
+	for ig, g := range bp.DeploymentGroups {
+		gp := Root.Groups.At(ig)
+		if g.DeprecatedKind != nil {
+			deprecate(gp.Kind, deprecatedFieldsRemoval, remove,
+				"kind of deployment group %q is deprecated and ignored, it is inferred from its modules", g.Name)
+		}
+		for im, m := range g.Modules {
+			mp := gp.Modules.At(im)
+			if r, ok := movedModules[strings.Trim(m.Source, "./")]; ok {
+				deprecate(mp.Source, "", Upgrade{Action: UpgradeReplace, Value: r},
+					"module %q uses %s, it has been replaced with %s", m.ID, m.Source, r)
+			}
+			if m.RequiredApis != nil {
+				deprecate(mp.RequiredApis, deprecatedFieldsRemoval, remove, "required_apis of module %q is deprecated and ignored", m.ID)
+			}
+			if m.WrapSettingsWith != nil {
+				deprecate(mp.WrapSettingsWith, deprecatedFieldsRemoval, remove, "wrapsettingswith of module %q is deprecated and ignored", m.ID)
+			}
+		}
+	}
+	return ws
+}
+
+// WarnDeprecations records deprecations of the blueprint as warnings, it must
+// be called before the blueprint is altered, e.g. by setting ghpc_version
+func (bp *Blueprint) WarnDeprecations() {
+	bp.warnings = append(bp.warnings, bp.Deprecations()...)
+}
+
+// yamlField is a node of the blueprint document and the key it is the value
+// of, the key is nil for items of sequences
+type yamlField struct {
+	key   *yaml.Node
+	value *yaml.Node
+}
+
+func yamlFields(root *yaml.Node) map[yPath]yamlField {
+	m := map[yPath]yamlField{}
+	var walk func(n *yaml.Node, p yPath)
+	walk = func(n *yaml.Node, p yPath) {
+		switch n.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				cp := p.Dot(n.Content[i].Value)
+				m[cp] = yamlField{n.Content[i], n.Content[i+1]}
+				walk(n.Content[i+1], cp)
+			}
+		case yaml.SequenceNode:
+			for i, c := range n.Content {
+				m[p.At(i)] = yamlField{nil, c}
+				walk(c, p.At(i))
+			}
+		}
+	}
+	if root != nil {
+		walk(root, "")
+	}
+	return m
+}
+
+// lineEdit replaces lines [from, to) of the blueprint, 0-based
+type lineEdit struct {
+	from, to int
+	text     string
+}
+
+// ApplyUpgrades rewrites the blueprint YAML data to resolve warnings that
+// have an upgrade. Only the lines of the upgraded fields are changed, so
+// comments and formatting of the rest of the blueprint are kept.
+func ApplyUpgrades(data []byte, ws []Warning) ([]byte, error) {
+	var c nodeCapturer
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, parseYamlV3Error(err)
+	}
+	fields := yamlFields(c.n)
+	nodeLines := allNodeLines(c.n)
+	lines := strings.SplitAfter(string(data), "\n")
+
+	errs := Errors{}
+	edits := []lineEdit{}
+	for _, w := range ws {
+		if w.Upgrade == nil || w.Path == nil {
+			continue
+		}
+		f, ok := fields[yPath(w.Path.String())]
+		if !ok || f.key == nil {
+			errs.At(w.Path, errors.New("can not find the field to upgrade in the blueprint"))
+			continue
+		}
+		var e lineEdit
+		var err error
+		switch w.Upgrade.Action {
+		case UpgradeRemove:
+			e, err = removeFieldEdit(lines, nodeLines, f)
+		case UpgradeReplace:
+			e, err = replaceValueEdit(lines, f, w.Upgrade.Value)
+		default:
+			err = fmt.Errorf("unknown upgrade action %q", w.Upgrade.Action)
+		}
+		if err != nil {
+			errs.At(w.Path, err)
+			continue
+		}
+		edits = append(edits, e)
+	}
+	if err := errs.OrNil(); err != nil {
+		return nil, err
+	}
+
+	// apply edits from the end, so lines of other edits hold
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].from > edits[j].from })
+	for _, e := range edits {
+		lines = append(lines[:e.from], append([]string{e.text}, lines[e.to:]...)...)
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// removeFieldEdit removes lines of the key and value of the field, the key
+// must start its line
+func removeFieldEdit(lines []string, nodeLines []int, f yamlField) (lineEdit, error) {
+	from := f.key.Line - 1
+	indent := columnOffset(lines[from], f.key.Column)
+	if strings.TrimSpace(lines[from][:indent]) != "" {
+		return lineEdit{}, fmt.Errorf("can not remove %q, it does not start its line, e.g. it is the first field of a list item", f.key.Value)
+	}
+	return lineEdit{from, nodeEndLine(lines, nodeLines, f.value, indent), ""}, nil
+}
+
+// replaceValueEdit replaces the single line scalar value of the field, keeping
+// its quotes
+func replaceValueEdit(lines []string, f yamlField, value string) (lineEdit, error) {
+	v := f.value
+	if v.Kind != yaml.ScalarNode || strings.Contains(v.Value, "\n") {
+		return lineEdit{}, errors.New("only single line values can be replaced")
+	}
+	l := lines[v.Line-1]
+	start := columnOffset(l, v.Column)
+	end := start + len(v.Value)
+	switch v.Style {
+	case yaml.DoubleQuotedStyle, yaml.SingleQuotedStyle:
+		q := l[start : start+1]
+		n := strings.Index(l[start+1:], q)
+		if n < 0 {
+			return lineEdit{}, errors.New("can not find the end of the quoted value")
+		}
+		end = start + n + 2
+		value = q + value + q
+	case 0: // plain
+	default:
+		return lineEdit{}, errors.New("only plain or quoted values can be replaced")
+	}
+	if end > len(l) || (v.Style == 0 && l[start:end] != v.Value) {
+		return lineEdit{}, errors.New("can not find the value in the blueprint")
+	}
+	return lineEdit{v.Line - 1, v.Line, l[:start] + value + l[end:]}, nil
+}
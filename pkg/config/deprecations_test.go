@@ -0,0 +1,107 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestDeprecations(c *C) {
+	bp := Blueprint{
+		DeploymentGroups: []DeploymentGroup{
+			{Name: "zero", DeprecatedKind: "terraform", Modules: []Module{
+				{ID: "net", Source: "modules/network/vpc", RequiredApis: map[string]any{}},
+				{ID: "job", Source: "./community/modules/scheduler/cloud-batch-job", WrapSettingsWith: map[string]any{}},
+			}},
+		}}
+	remove := &Upgrade{Action: UpgradeRemove}
+	c.Check(bp.Deprecations(), DeepEquals, []Warning{
+		{
+			Category: WarningDeprecated,
+			Path:     Root.Groups.At(0).Kind,
+			Message:  `kind of deployment group "zero" is deprecated and ignored, it is inferred from its modules`,
+			Removal:  deprecatedFieldsRemoval,
+			Upgrade:  remove,
+		}, {
+			Category: WarningDeprecated,
+			Path:     Root.Groups.At(0).Modules.At(0).RequiredApis,
+			Message:  `required_apis of module "net" is deprecated and ignored`,
+			Removal:  deprecatedFieldsRemoval,
+			Upgrade:  remove,
+		}, {
+			Category: WarningDeprecated,
+			Path:     Root.Groups.At(0).Modules.At(1).Source,
+			Message:  `module "job" uses ./community/modules/scheduler/cloud-batch-job, it has been replaced with modules/scheduler/batch-job-template`,
+			Upgrade:  &Upgrade{Action: UpgradeReplace, Value: "modules/scheduler/batch-job-template"},
+		}, {
+			Category: WarningDeprecated,
+			Path:     Root.Groups.At(0).Modules.At(1).WrapSettingsWith,
+			Message:  `wrapsettingswith of module "job" is deprecated and ignored`,
+			Removal:  deprecatedFieldsRemoval,
+			Upgrade:  remove,
+		}})
+
+	c.Check(Blueprint{}.Deprecations(), HasLen, 0)
+}
+
+func (s *zeroSuite) TestApplyUpgrades(c *C) {
+	bp := `blueprint_name: test # keep me
+ghpc_version: v1.0.0
+deployment_groups:
+- group: zero
+  kind: terraform
+  modules:
+  - id: net
+    source: modules/network/vpc
+    required_apis:
+      $(vars.project_id):
+      - compute.googleapis.com
+
+    # the job
+  - id: job
+    source: 'community/modules/scheduler/cloud-batch-job' # moved
+    wrapsettingswith: {a: b}
+`
+	ws := []Warning{
+		{Path: Root.GhpcVersion, Upgrade: &Upgrade{Action: UpgradeRemove}},
+		{Path: Root.Groups.At(0).Kind, Upgrade: &Upgrade{Action: UpgradeRemove}},
+		{Path: Root.Groups.At(0).Modules.At(0).RequiredApis, Upgrade: &Upgrade{Action: UpgradeRemove}},
+		{Path: Root.Groups.At(0).Modules.At(1).Source, Upgrade: &Upgrade{Action: UpgradeReplace, Value: "modules/scheduler/batch-job-template"}},
+		{Path: Root.Groups.At(0).Modules.At(1).WrapSettingsWith, Upgrade: &Upgrade{Action: UpgradeRemove}},
+		{Path: Root.Vars, Message: "no upgrade"},
+	}
+	got, err := ApplyUpgrades([]byte(bp), ws)
+	c.Assert(err, IsNil)
+	c.Check(string(got), Equals, `blueprint_name: test # keep me
+deployment_groups:
+- group: zero
+  modules:
+  - id: net
+    source: modules/network/vpc
+
+    # the job
+  - id: job
+    source: 'modules/scheduler/batch-job-template' # moved
+`)
+
+	_, err = ApplyUpgrades([]byte(bp), []Warning{{Path: Root.Groups.At(0).Modules.At(0).ID, Upgrade: &Upgrade{Action: UpgradeRemove}}})
+	c.Check(err, ErrorMatches, `.*can not remove "id", it does not start its line.*`)
+
+	_, err = ApplyUpgrades([]byte(bp), []Warning{{Path: Root.Groups.At(0).Modules.At(0).RequiredApis, Upgrade: &Upgrade{Action: UpgradeReplace, Value: "x"}}})
+	c.Check(err, ErrorMatches, `.*only single line values can be replaced.*`)
+
+	_, err = ApplyUpgrades([]byte(bp), []Warning{{Path: Root.Vars, Upgrade: &Upgrade{Action: UpgradeRemove}}})
+	c.Check(err, ErrorMatches, `.*can not find the field to upgrade in the blueprint.*`)
+}
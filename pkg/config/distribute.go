@@ -0,0 +1,213 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/modulereader"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// applyDistribution fans out the blocks of a list setting of the module, e.g.
+// TPU nodesets, to every zone or region listed by another setting, as the
+// module metadata describes for the `distribute` value of the module. Blocks
+// that already set the zone or region are kept as they are. The module is
+// left without `distribute`, so that the expanded blueprint is explicit.
+func (bp Blueprint) applyDistribution(mp ModulePath, m *Module) error {
+	if m.Distribute == "" {
+		return nil
+	}
+	info := m.InfoOrDie()
+	d, err := distribution(mp, *m, info)
+	if err != nil {
+		return err
+	}
+	targets, err := bp.distributionOver(mp, *m, d)
+	if err != nil {
+		return err
+	}
+
+	res, err := distributeBlocks(mp, *m, d, targets)
+	if err != nil {
+		return err
+	}
+
+	inputs := getModuleInputMap(info.Inputs)
+	settings := Dict{}
+	for k, v := range m.Settings.Items() {
+		if _, isInput := inputs[k]; k == d.Over && !isInput {
+			continue
+		}
+		settings.Set(k, v)
+	}
+	settings.Set(d.Setting, cty.TupleVal(res))
+	m.Settings = settings
+	m.Distribute = ""
+	return nil
+}
+
+// distribution returns how the module metadata describes the `distribute`
+// value of the module
+func distribution(mp ModulePath, m Module, info modulereader.ModuleInfo) (modulereader.MetadataDistribution, error) {
+	d, ok := info.Metadata.Ghpc.Distribute[m.Distribute]
+	if !ok {
+		supported := maps.Keys(info.Metadata.Ghpc.Distribute)
+		slices.Sort(supported)
+		if len(supported) == 0 {
+			return d, BpError{mp.Distribute, fmt.Errorf("module %q does not support distribute", m.Source)}
+		}
+		return d, BpError{mp.Distribute, fmt.Errorf("module %q does not support distribute %q, it supports %s", m.Source, m.Distribute, strings.Join(supported, ", "))}
+	}
+	if d.Over == "" || d.Setting == "" || d.Field == "" {
+		return d, BpError{mp.Distribute, fmt.Errorf("metadata of module %q must set over, setting and field of distribute %q", m.Source, m.Distribute)}
+	}
+	return d, nil
+}
+
+// distributionOver returns the zones or regions blocks are distributed to, set
+// by the setting of the module or else the deployment variable of the same name
+func (bp Blueprint) distributionOver(mp ModulePath, m Module, d modulereader.MetadataDistribution) ([]string, error) {
+	var overPath Path = mp.Settings.Dot(d.Over)
+	over := m.Settings.Get(d.Over)
+	if !m.Settings.Has(d.Over) {
+		if !bp.Vars.Has(d.Over) {
+			return nil, BpError{mp.Distribute, fmt.Errorf("distribute %q requires setting %q or deployment variable %q", m.Distribute, d.Over, d.Over)}
+		}
+		over, overPath = GlobalRef(d.Over).AsValue(), mp.Distribute
+	}
+	targets, err := bp.distributionTargets(over)
+	if err != nil {
+		return nil, BpError{overPath, err}
+	}
+	return targets, nil
+}
+
+// distributeBlocks returns blocks of the setting of the module distributed to
+// the targets
+func distributeBlocks(mp ModulePath, m Module, d modulereader.MetadataDistribution, targets []string) ([]cty.Value, error) {
+	blocks := m.Settings.Get(d.Setting)
+	sp := mp.Settings.Dot(d.Setting)
+	if _, is := IsExpressionValue(blocks); is || !m.Settings.Has(d.Setting) || blocks.IsNull() || !(blocks.Type().IsTupleType() || blocks.Type().IsListType()) {
+		return nil, BpError{sp, fmt.Errorf("setting %q must be a list of blocks to distribute %q", d.Setting, m.Distribute)}
+	}
+	suffixes := distributionSuffixes(targets)
+	res := []cty.Value{}
+	for i, it := 0, blocks.ElementIterator(); it.Next(); i++ {
+		_, b := it.Element()
+		copies, err := distributeBlock(d, b, targets, suffixes)
+		if err != nil {
+			return nil, BpError{sp.Cty(cty.IndexIntPath(i)), err}
+		}
+		res = append(res, copies...)
+	}
+	return res, nil
+}
+
+// distributeBlock returns copies of the block for every target, with the
+// field set to the target and the name suffixed with it; blocks that already
+// set the field are kept as they are
+func distributeBlock(d modulereader.MetadataDistribution, b cty.Value, targets []string, suffixes []string) ([]cty.Value, error) {
+	if _, is := IsExpressionValue(b); is || b.IsNull() || !(b.Type().IsObjectType() || b.Type().IsMapType()) {
+		return nil, errors.New("blocks to distribute must be objects")
+	}
+	attrs := b.AsValueMap()
+	if _, pinned := attrs[d.Field]; pinned {
+		return []cty.Value{b}, nil
+	}
+	name, err := distributedName(d, attrs)
+	if err != nil {
+		return nil, err
+	}
+	res := []cty.Value{}
+	for j, t := range targets {
+		c := maps.Clone(attrs)
+		if c == nil {
+			c = map[string]cty.Value{}
+		}
+		c[d.Field] = cty.StringVal(t)
+		if d.NameField != "" {
+			c[d.NameField] = cty.StringVal(name + d.NameSeparator + suffixes[j])
+		}
+		res = append(res, cty.ObjectVal(c))
+	}
+	return res, nil
+}
+
+// distributedName returns the name of the block copies are named after, if
+// the module names them
+func distributedName(d modulereader.MetadataDistribution, attrs map[string]cty.Value) (string, error) {
+	if d.NameField == "" {
+		return "", nil
+	}
+	n, ok := attrs[d.NameField]
+	if _, is := IsExpressionValue(n); !ok || is || n.IsNull() || n.Type() != cty.String {
+		return "", fmt.Errorf("block must set %q to a string, it is suffixed with the zone or region of each copy", d.NameField)
+	}
+	return n.AsString(), nil
+}
+
+// distributionTargets evaluates the zones or regions blocks are distributed
+// to, a non-empty list of strings known before deployment
+func (bp Blueprint) distributionTargets(v cty.Value) ([]string, error) {
+	for r := range valueReferences(v) {
+		if !r.GlobalVar {
+			return nil, fmt.Errorf("zones or regions to distribute to can only refer to deployment variables, got reference to module %q", r.Module)
+		}
+	}
+	ev, err := bp.Eval(v)
+	if err != nil {
+		return nil, err
+	}
+	if ev.IsNull() || !(ev.Type().IsListType() || ev.Type().IsTupleType()) || ev.LengthInt() == 0 {
+		return nil, errors.New("zones or regions to distribute to must be a non-empty list of strings")
+	}
+	targets := []string{}
+	for it := ev.ElementIterator(); it.Next(); {
+		_, t := it.Element()
+		if t.IsNull() || t.Type() != cty.String || t.AsString() == "" {
+			return nil, errors.New("zones or regions to distribute to must be a non-empty list of strings")
+		}
+		if slices.Contains(targets, t.AsString()) {
+			return nil, fmt.Errorf("%q is listed more than once in zones or regions to distribute to", t.AsString())
+		}
+		targets = append(targets, t.AsString())
+	}
+	return targets, nil
+}
+
+// distributionSuffixes are the last labels of zones or regions, e.g. "a" of
+// "us-central1-a", unless two of them are the same, e.g. zones of different
+// regions; the whole names without dashes are used then
+func distributionSuffixes(targets []string) []string {
+	suffixes := []string{}
+	for _, t := range targets {
+		suffixes = append(suffixes, t[strings.LastIndex(t, "-")+1:])
+	}
+	for i, s := range suffixes {
+		if slices.Contains(suffixes[i+1:], s) {
+			names := []string{}
+			for _, t := range targets {
+				names = append(names, strings.ReplaceAll(t, "-", ""))
+			}
+			return names
+		}
+	}
+	return suffixes
+}
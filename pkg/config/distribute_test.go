@@ -0,0 +1,90 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"hpc-toolkit/pkg/modulereader"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestApplyDistribution(c *C) {
+	src := c.TestName() + "/partition"
+	setTestModuleInfo(Module{Source: src}, modulereader.ModuleInfo{
+		Inputs: []modulereader.VarInfo{{Name: "nodeset_tpu"}, {Name: "partition_name"}},
+		Metadata: modulereader.Metadata{Ghpc: modulereader.MetadataGhpc{
+			Distribute: map[string]modulereader.MetadataDistribution{
+				"per_zone": {Over: "zones", Setting: "nodeset_tpu", Field: "zone", NameField: "nodeset_name"},
+			}}}})
+	mp := Root.Groups.At(0).Modules.At(0)
+	bp := Blueprint{Vars: NewDict(map[string]cty.Value{
+		"zones": cty.TupleVal([]cty.Value{cty.StringVal("us-central1-a"), cty.StringVal("us-central1-b")}),
+	})}
+	tpu := func(name string, zone string) cty.Value {
+		attrs := map[string]cty.Value{"nodeset_name": cty.StringVal(name), "node_type": cty.StringVal("v3-8")}
+		if zone != "" {
+			attrs["zone"] = cty.StringVal(zone)
+		}
+		return cty.ObjectVal(attrs)
+	}
+	mod := func(settings map[string]cty.Value) Module {
+		return Module{Source: src, Distribute: "per_zone", Settings: NewDict(settings)}
+	}
+
+	{ // zones of deployment variable, blocks setting a zone are kept
+		m := mod(map[string]cty.Value{"nodeset_tpu": cty.TupleVal([]cty.Value{tpu("tpu", ""), tpu("pinned", "us-east1-d")})})
+		c.Assert(bp.applyDistribution(mp, &m), IsNil)
+		c.Check(m.Distribute, Equals, "")
+		c.Check(m.Settings.Items(), DeepEquals, map[string]cty.Value{
+			"nodeset_tpu": cty.TupleVal([]cty.Value{
+				tpu("tpua", "us-central1-a"), tpu("tpub", "us-central1-b"), tpu("pinned", "us-east1-d")}),
+		})
+	}
+
+	{ // zones set by the module, not an input, are removed; names of clashing zones
+		zones := cty.TupleVal([]cty.Value{cty.StringVal("us-central1-a"), cty.StringVal("us-east1-a")})
+		m := mod(map[string]cty.Value{"zones": zones, "nodeset_tpu": cty.TupleVal([]cty.Value{tpu("tpu", "")})})
+		c.Assert(bp.applyDistribution(mp, &m), IsNil)
+		c.Check(m.Settings.Items(), DeepEquals, map[string]cty.Value{
+			"nodeset_tpu": cty.TupleVal([]cty.Value{tpu("tpuuscentral1a", "us-central1-a"), tpu("tpuuseast1a", "us-east1-a")}),
+		})
+	}
+
+	{ // Fail: unsupported distribution
+		m := mod(map[string]cty.Value{"nodeset_tpu": cty.TupleVal([]cty.Value{tpu("tpu", "")})})
+		m.Distribute = "per_region"
+		c.Check(bp.applyDistribution(mp, &m), ErrorMatches, `.*does not support distribute "per_region", it supports per_zone`)
+	}
+
+	{ // Fail: zones refer to module
+		m := mod(map[string]cty.Value{"zones": ModuleRef("net", "zones").AsValue(), "nodeset_tpu": cty.TupleVal([]cty.Value{tpu("tpu", "")})})
+		err := bp.applyDistribution(mp, &m)
+		c.Check(err, ErrorMatches, `.*can only refer to deployment variables.*`)
+		c.Check(err.(BpError).Path.String(), Equals, "deployment_groups[0].modules[0].settings.zones")
+	}
+
+	{ // Fail: block without name
+		m := mod(map[string]cty.Value{"nodeset_tpu": cty.TupleVal([]cty.Value{cty.ObjectVal(map[string]cty.Value{"node_type": cty.StringVal("v3-8")})})})
+		err := bp.applyDistribution(mp, &m)
+		c.Check(err, ErrorMatches, `.*block must set "nodeset_name" to a string.*`)
+		c.Check(err.(BpError).Path.String(), Equals, "deployment_groups[0].modules[0].settings.nodeset_tpu[0]")
+	}
+
+	{ // Fail: no blocks
+		m := mod(map[string]cty.Value{})
+		c.Check(bp.applyDistribution(mp, &m), ErrorMatches, `.*setting "nodeset_tpu" must be a list of blocks.*`)
+	}
+}
@@ -85,6 +85,16 @@ func (e UnknownModuleError) Error() string {
 	return fmt.Sprintf("invalid module id: \"%s\"", e.ID)
 }
 
+// UnknownOutputError signifies a reference to an output the module does not have
+type UnknownOutputError struct {
+	Module ModuleID
+	Output string
+}
+
+func (e UnknownOutputError) Error() string {
+	return fmt.Sprintf("module %q does not have output %q", e.Module, e.Output)
+}
+
 // Errors is an error wrapper to combine multiple errors
 type Errors struct {
 	Errors []error
@@ -152,6 +162,7 @@ func (e *Errors) Any() bool {
 // Sentinel errors
 var EmptyModuleID = errors.New("a module id cannot be empty")
 var EmptyModuleSource = errors.New("a module source cannot be empty")
+var UnresolvedModuleSource = errors.New("module source expression has to be resolved before module can be read")
 var InvalidModuleKind = errors.New("a module kind is invalid")
 var UnknownModuleSetting = errors.New("a setting was added that is not found in the module")
 var ModuleSettingWithPeriod = errors.New("a setting name contains a period, which is not supported; variable subfields cannot be set independently in a blueprint.")
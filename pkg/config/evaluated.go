@@ -0,0 +1,129 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// blueprintEvaluators are commands evaluating blueprints written in
+// configuration languages to JSON, by file extension. The file to evaluate is
+// appended to the command, which runs in the directory of the file so that
+// imports relative to it resolve.
+var blueprintEvaluators = map[string][]string{
+	".cue":     {"cue", "export", "--out", "json"},
+	".jsonnet": {"jsonnet"},
+}
+
+// isEvaluatedBlueprint tells whether the blueprint file is written in a
+// configuration language evaluated to a blueprint, CUE or Jsonnet
+func isEvaluatedBlueprint(f string) bool {
+	_, ok := blueprintEvaluators[filepath.Ext(f)]
+	return ok
+}
+
+// evaluateBlueprint runs the evaluator on the file, it is replaced in tests
+var evaluateBlueprint = func(evaluator []string, dir string, file string) ([]byte, error) {
+	if _, err := exec.LookPath(evaluator[0]); err != nil {
+		return nil, HintError{
+			Hint: fmt.Sprintf("must have a copy of %s installed in PATH to read %s blueprints", evaluator[0], filepath.Ext(file)),
+			Err:  err}
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(evaluator[0], append(evaluator[1:], file)...)
+	cmd.Dir = dir
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", strings.Join(cmd.Args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// parseEvaluatedBlueprint evaluates a CUE or Jsonnet blueprint and parses
+// the result as a YAML blueprint. Errors point to the YAML equivalent of the
+// evaluated blueprint, as positions in the source are not known. Strings may
+// hold blueprint expressions, e.g. "$(vars.project_id)", as in YAML.
+func parseEvaluatedBlueprint(data []byte, f string) (Blueprint, YamlCtx, error) {
+	file, cleanup, err := evaluationSource(data, f)
+	if err != nil {
+		return Blueprint{}, YamlCtx{}, err
+	}
+	defer cleanup()
+
+	ext := filepath.Ext(f)
+	out, err := evaluateBlueprint(blueprintEvaluators[ext], filepath.Dir(file), filepath.Base(file))
+	if err != nil {
+		return Blueprint{}, YamlCtx{}, fmt.Errorf("failed to evaluate blueprint %s: %w", f, err)
+	}
+	doc, err := evaluatedYaml(out)
+	if err != nil {
+		return Blueprint{}, YamlCtx{}, fmt.Errorf("blueprint %s did not evaluate to a JSON object: %w", f, err)
+	}
+	return parseBlueprint(doc, strings.TrimSuffix(f, ext)+".yaml")
+}
+
+// evaluationSource returns the file to evaluate: the blueprint file itself if
+// it is local, or a temporary copy of blueprints read from elsewhere
+func evaluationSource(data []byte, f string) (string, func(), error) {
+	if local, err := os.ReadFile(f); err == nil && bytes.Equal(local, data) {
+		return f, func() {}, nil
+	}
+	dir, err := os.MkdirTemp("", "ghpc-blueprint-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	file := filepath.Join(dir, filepath.Base(f))
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return file, cleanup, nil
+}
+
+// evaluatedYaml converts the JSON output of an evaluator to block style YAML
+func evaluatedYaml(out []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(out, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("got %q", strings.TrimSpace(string(out)))
+	}
+	var unstyle func(n *yaml.Node)
+	unstyle = func(n *yaml.Node) {
+		n.Style = 0
+		for _, c := range n.Content {
+			unstyle(c)
+		}
+	}
+	unstyle(&doc)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	enc.Close()
+	return buf.Bytes(), nil
+}
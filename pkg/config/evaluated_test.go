@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestEvaluatedYaml(c *C) {
+	got, err := evaluatedYaml([]byte(`{"blueprint_name": "bp", "vars": {"zone": "$(vars.region)-a", "flag": "true", "n": 3}}`))
+	c.Assert(err, IsNil)
+	c.Check(string(got), Equals, `blueprint_name: bp
+vars:
+  zone: $(vars.region)-a
+  flag: "true"
+  n: 3
+`)
+
+	_, err = evaluatedYaml([]byte(`["not", "a", "blueprint"]`))
+	c.Check(err, ErrorMatches, `got .*`)
+}
+
+func (s *zeroSuite) TestParseEvaluatedBlueprint(c *C) {
+	defer func(f func([]string, string, string) ([]byte, error)) { evaluateBlueprint = f }(evaluateBlueprint)
+	var gotEvaluator []string
+	var gotDir, gotFile string
+	evaluateBlueprint = func(evaluator []string, dir string, file string) ([]byte, error) {
+		gotEvaluator, gotDir, gotFile = evaluator, dir, file
+		return []byte(`{
+  "blueprint_name": "evaluated",
+  "vars": {"project_id": "p", "deployment_name": "d", "zone": "$(vars.region)-a"},
+  "deployment_groups": [{"group": "primary", "modules": [{"id": "net", "source": "modules/network/vpc"}]}]
+}`), nil
+	}
+
+	dir := c.MkDir()
+	src := []byte(`{ blueprint_name: "evaluated" }`)
+	f := filepath.Join(dir, "bp.jsonnet")
+	c.Assert(os.WriteFile(f, src, 0644), IsNil)
+
+	{ // local file is evaluated in place
+		bp, _, err := parseBlueprint(src, f)
+		c.Assert(err, IsNil)
+		c.Check(gotEvaluator, DeepEquals, []string{"jsonnet"})
+		c.Check(gotDir, Equals, dir)
+		c.Check(gotFile, Equals, "bp.jsonnet")
+		c.Check(bp.BlueprintName, Equals, "evaluated")
+		c.Check(bp.DeploymentGroups[0].Modules[0].Source, Equals, "modules/network/vpc")
+		zone, _ := IsExpressionValue(bp.Vars.Get("zone"))
+		c.Check(zone, NotNil)
+		c.Check(bp.Vars.Get("project_id"), DeepEquals, cty.StringVal("p"))
+	}
+
+	{ // remote blueprint is evaluated from a temporary copy
+		_, _, err := parseBlueprint([]byte(`package bp`), "bp.cue")
+		c.Assert(err, IsNil)
+		c.Check(gotEvaluator, DeepEquals, []string{"cue", "export", "--out", "json"})
+		c.Check(gotDir, Not(Equals), dir)
+		c.Check(gotFile, Equals, "bp.cue")
+		_, err = os.Stat(gotDir)
+		c.Check(os.IsNotExist(err), Equals, true)
+	}
+
+	{ // evaluation fails
+		evaluateBlueprint = func([]string, string, string) ([]byte, error) {
+			return nil, errors.New("undefined field")
+		}
+		_, _, err := parseBlueprint(src, f)
+		c.Check(err, ErrorMatches, `failed to evaluate blueprint .*bp.jsonnet: undefined field`)
+	}
+}
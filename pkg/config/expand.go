@@ -17,9 +17,13 @@ package config
 import (
 	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
 
 	"hpc-toolkit/pkg/modulereader"
 
+	"github.com/agext/levenshtein"
+	"github.com/hashicorp/hcl/v2/ext/typeexpr"
 	"github.com/zclconf/go-cty/cty"
 	"github.com/zclconf/go-cty/cty/convert"
 	"golang.org/x/exp/maps"
@@ -50,11 +54,12 @@ func validateModuleInputs(mp ModulePath, m Module, bp Blueprint) error {
 }
 
 func attemptEvalModuleInput(val cty.Value, bp Blueprint) (cty.Value, bool) {
-	v, err := bp.Eval(val)
+	// module outputs are substituted with unknown values,
+	// the type check is deferred for parts of the value that depend on them
+	v, err := bp.PartialEval(val)
 	// there could be a legitimate reasons for it.
-	// e.g. use of modules output or unsupported (by ghpc) functions
+	// e.g. use of unsupported (by ghpc) functions
 	// TODO:
-	// * substitute module outputs with an UnknownValue
 	// * skip if uses functions with side-effects, e.g. `file`
 	// * add implementation of all pure terraform functions
 	// * add positive selection for eval-errors to bubble up
@@ -70,12 +75,84 @@ func checkInputValueMatchesType(val cty.Value, input modulereader.VarInfo, bp Bl
 	// we don't anticipate any of those, but just in case, catch panic and swallow it
 	defer func() { recover() }()
 	// TODO: consider returning error (not panic) or logging warning
-	if _, err := convert.Convert(v, input.Type); err != nil {
-		return fmt.Errorf("unsuitable value for %q: %w", input.Name, err)
+	if _, err := input.Coerce(v); err != nil {
+		msg := fmt.Sprintf("setting %q expects %s, got %s", input.Name, typeexpr.TypeString(input.Type), friendlyTypeName(v.Type()))
+		var pe cty.PathError
+		if errors.As(err, &pe) && len(pe.Path) > 0 { // point at the offending element
+			return fmt.Errorf("%s; %s%s: %s", msg, input.Name, formatCtyPath(pe.Path), pe.Error())
+		}
+		return errors.New(msg)
 	}
 	return nil
 }
 
+// friendlyTypeName names the type of a value the way it's written in a
+// blueprint, e.g. a YAML sequence is a list rather than a tuple
+func friendlyTypeName(ty cty.Type) string {
+	switch {
+	case ty.IsTupleType() || ty.IsListType():
+		return "list"
+	case ty.IsObjectType() || ty.IsMapType():
+		return "map"
+	case ty == cty.DynamicPseudoType:
+		return "null"
+	default:
+		return typeexpr.TypeString(ty)
+	}
+}
+
+func formatCtyPath(p cty.Path) string {
+	var sb strings.Builder
+	for _, s := range p {
+		switch ts := s.(type) {
+		case cty.GetAttrStep:
+			sb.WriteString("." + ts.Name)
+		case cty.IndexStep:
+			if ts.Key.Type() == cty.String {
+				sb.WriteString(fmt.Sprintf("[%q]", ts.Key.AsString()))
+			} else if ts.Key.Type() == cty.Number {
+				sb.WriteString(fmt.Sprintf("[%s]", ts.Key.AsBigFloat().Text('f', -1)))
+			}
+		}
+	}
+	return sb.String()
+}
+
+// coerceModuleInputs converts settings given as literals to the type of the
+// module input where it's safe, so that terraform gets the value it expects
+func coerceModuleInputs(m *Module) {
+	inputs := getModuleInputMap(m.InfoOrDie().Inputs)
+	for k, v := range m.Settings.Items() {
+		if ty, ok := inputs[k]; ok && ty != cty.NilType {
+			m.Settings.Set(k, coerceValue(v, ty))
+		}
+	}
+}
+
+// coerceValue converts a numeric string to a number and a single value to a
+// list of one element. Other values, including expressions, are returned as
+// is, mismatches are reported by validateModuleInputs.
+func coerceValue(v cty.Value, ty cty.Type) cty.Value {
+	if v.IsNull() || v.ContainsMarked() || !v.IsWhollyKnown() {
+		return v
+	}
+	if cv, err := convert.Convert(v, ty); err == nil {
+		if v.Type() == cty.String && ty == cty.Number {
+			return cv
+		}
+		return v
+	}
+	vt := v.Type()
+	isSeq := vt.IsTupleType() || vt.IsListType() || vt.IsSetType()
+	if (ty.IsListType() || ty.IsSetType()) && !isSeq {
+		el := coerceValue(v, ty.ElementType())
+		if _, err := convert.Convert(el, ty.ElementType()); err == nil {
+			return cty.TupleVal([]cty.Value{el})
+		}
+	}
+	return v
+}
+
 func validateModulesAreUsed(bp Blueprint) error {
 	used := map[ModuleID]bool{}
 	bp.WalkModulesSafe(func(_ ModulePath, m *Module) {
@@ -104,11 +181,28 @@ func (bp *Blueprint) expandVars() error {
 }
 
 func (bp *Blueprint) expandGroups() error {
+	// sources have to be resolved before any module info is read
+	if err := bp.expandModuleSources(); err != nil {
+		return err
+	}
 	bp.addKindToModules()
+	bp.applyModuleDefaults()
+	if err := bp.expandImages(); err != nil {
+		return err
+	}
 
 	if err := checkModulesAndGroups(*bp); err != nil {
 		return err
 	}
+	if err := validateBootstrap(*bp); err != nil {
+		return err
+	}
+
+	// deployment variables do not change while groups are expanded
+	if vars, err := bp.evalVars(); err == nil {
+		bp.memo = newEvalMemo(vars)
+		defer func() { bp.memo = nil }()
+	}
 
 	var errs Errors
 	for ig := range bp.DeploymentGroups {
@@ -118,6 +212,9 @@ func (bp *Blueprint) expandGroups() error {
 	if errs.Any() {
 		return errs
 	}
+	if err := bp.bindBootstrapProject(); err != nil {
+		return err
+	}
 
 	// Following actions depend on whole blueprint being expanded
 	// run it after all groups are expanded
@@ -128,9 +225,110 @@ func (bp *Blueprint) expandGroups() error {
 	return nil
 }
 
+// expandModuleSources resolves module sources given as expressions, e.g.
+// "modules/$(vars.flavor)/vpc", in the context of deployment variables,
+// then applies source_roots and source_base of the blueprint and resolves
+// registry sources against module_registry
+func (bp *Blueprint) expandModuleSources() error {
+	errs := Errors{}
+	var lock *modulereader.ModuleLock
+	bp.WalkModulesSafe(func(p ModulePath, m *Module) {
+		errs.At(p.Source, bp.expandModuleSource(m, &lock))
+	})
+	if lock != nil && !errs.Any() && bp.dir != "" {
+		errs.Add(lock.Write(bp.moduleLockPath()))
+	}
+	return errs.OrNil()
+}
+
+// expandModuleSource resolves the source of the module, the lock of registry
+// sources is read on first use
+func (bp *Blueprint) expandModuleSource(m *Module, lock **modulereader.ModuleLock) error {
+	v, err := parseYamlString(m.Source)
+	if err != nil {
+		return err
+	}
+	if _, is := IsExpressionValue(v); is {
+		src, err := bp.evalModuleSource(v)
+		if err != nil {
+			return err
+		}
+		m.Source, m.sourceExpr = src, v
+	}
+	m.Source = bp.resolveModuleSource(m.Source)
+	if !modulereader.IsRegistrySource(m.Source) {
+		return nil
+	}
+	if *lock == nil {
+		if *lock, err = modulereader.ReadModuleLock(bp.moduleLockPath()); err != nil {
+			return err
+		}
+	}
+	src, err := modulereader.ResolveRegistrySource(bp.moduleRegistry(), m.Source, *lock)
+	if err != nil {
+		return err
+	}
+	m.Source = src
+	return nil
+}
+
+func (bp Blueprint) moduleRegistry() string {
+	if bp.ModuleRegistry != "" {
+		return bp.ModuleRegistry
+	}
+	return modulereader.DefaultRegistry
+}
+
+// moduleLockPath is the path of the lock file of registry sources, kept next
+// to the blueprint file; empty for blueprints not read from a file
+func (bp Blueprint) moduleLockPath() string {
+	if bp.dir == "" {
+		return ""
+	}
+	return filepath.Join(bp.dir, modulereader.ModuleLockFileName)
+}
+
+// resolveModuleSource substitutes the longest matching prefix from
+// source_roots and, if source_base is "blueprint", makes relative local
+// sources relative to the directory of the blueprint file. Blueprints not read
+// from a local file have no directory, their relative sources are left as is.
+func (bp Blueprint) resolveModuleSource(src string) string {
+	prefix := ""
+	for p := range bp.SourceRoots {
+		if strings.HasPrefix(src, p) && len(p) > len(prefix) {
+			prefix = p
+		}
+	}
+	if prefix != "" {
+		src = bp.SourceRoots[prefix] + strings.TrimPrefix(src, prefix)
+	}
+
+	isRelative := strings.HasPrefix(src, "./") || strings.HasPrefix(src, "../")
+	if bp.SourceBase == SourceBaseBlueprint && isRelative && bp.dir != "" {
+		return filepath.Join(bp.dir, src)
+	}
+	return src
+}
+
+func (bp *Blueprint) evalModuleSource(v cty.Value) (string, error) {
+	for r := range valueReferences(v) {
+		if !r.GlobalVar {
+			return "", fmt.Errorf("module source can only refer to deployment variables, got reference to module %q", r.Module)
+		}
+	}
+	ev, err := bp.Eval(v)
+	if err != nil {
+		return "", err
+	}
+	if ev.IsNull() || ev.Type() != cty.String {
+		return "", fmt.Errorf("module source must evaluate to a string, got %s", ev.Type().FriendlyName())
+	}
+	return ev.AsString(), nil
+}
+
 func (bp Blueprint) expandGroup(gp groupPath, g *DeploymentGroup) error {
 	var errs Errors
-	bp.expandBackend(g)
+	errs.At(gp.Backend.Configuration, bp.expandBackend(g))
 	for im := range g.Modules {
 		errs.Add(bp.expandModule(gp.Modules.At(im), &g.Modules[im]))
 	}
@@ -138,32 +336,99 @@ func (bp Blueprint) expandGroup(gp groupPath, g *DeploymentGroup) error {
 }
 
 func (bp Blueprint) expandModule(mp ModulePath, m *Module) error {
+	if err := applySettingAliases(mp, m); err != nil {
+		return err
+	}
+	if err := bp.applyDistribution(mp, m); err != nil {
+		return err
+	}
+	coerceModuleInputs(m)
 	bp.applyUseModules(m)
+	if err := bp.applyStartupScriptParts(mp, m); err != nil {
+		return err
+	}
 	bp.applyGlobalVarsInModule(m)
 	return validateModuleInputs(mp, *m, bp)
 }
 
-func (bp Blueprint) expandBackend(grp *DeploymentGroup) {
+// AppendModule appends a module to a group of the expanded blueprint and expands
+// it the way modules of the blueprint are, so that site-specific transforms can
+// add modules, e.g. for auditing, to every group. Modules it uses must precede
+// it.
+func (bp *Blueprint) AppendModule(group GroupName, m Module) error {
+	ig := slices.IndexFunc(bp.DeploymentGroups, func(g DeploymentGroup) bool { return g.Name == group })
+	if ig < 0 {
+		return fmt.Errorf("deployment group %q does not exist", group)
+	}
+	g := &bp.DeploymentGroups[ig]
+	mp := Root.Groups.At(ig).Modules.At(len(g.Modules))
+	if _, err := bp.Module(m.ID); err == nil {
+		return BpError{mp.ID, fmt.Errorf("%s: %s used more than once", errMsgDuplicateID, m.ID)}
+	}
+
+	var lock *modulereader.ModuleLock
+	if err := bp.expandModuleSource(&m, &lock); err != nil {
+		return BpError{mp.Source, err}
+	}
+	if m.Kind == UnknownKind {
+		m.Kind = TerraformKind
+	}
+	if m.Kind != TerraformKind || g.Kind() != TerraformKind { // packer groups have a single module
+		return BpError{mp.Kind, fmt.Errorf("only terraform modules can be added, and only to terraform groups; got %s module for group %q", m.Kind, group)}
+	}
+
+	g.Modules = append(g.Modules, m)
+	added := &g.Modules[len(g.Modules)-1]
+	err := validateModule(mp, *added, *bp) // references are only found once added
+	if err == nil {
+		err = bp.expandModule(mp, added)
+	}
+	if err != nil {
+		g.Modules = g.Modules[:len(g.Modules)-1]
+		return err
+	}
+	if lock != nil && bp.dir != "" {
+		if err := lock.Write(bp.moduleLockPath()); err != nil {
+			return err
+		}
+	}
+	bp.populateOutputs()
+	return nil
+}
+
+// groupNameRef is the reference `$(group.name)` parses to in terraform backend
+// configurations, e.g. in a prefix shared by all groups
+var groupNameRef = ModuleRef("group", "name")
+
+func (bp Blueprint) expandBackend(grp *DeploymentGroup) error {
 	// 1. DEFAULT: use TerraformBackend configuration (if supplied)
 	// 2. If top-level TerraformBackendDefaults is defined, insert that
 	//    backend into resource groups which have no explicit
 	//    TerraformBackend
 	// 3. In all cases, add a prefix for GCS backends if one is not defined
+	// 4. Substitute $(group.name) with the name of the group
+	be := &grp.TerraformBackend
 	defaults := bp.TerraformBackendDefaults
-	if defaults.Type == "" {
-		return
+	if defaults.Type != "" {
+		if be.Type == "" {
+			be.Type = defaults.Type
+			be.Configuration = NewDict(defaults.Configuration.Items())
+			be.StateAccess = defaults.StateAccess
+		}
+		if be.Type == "gcs" && !be.Configuration.Has("prefix") {
+			prefix := MustParseExpression(
+				fmt.Sprintf(`"%s/${var.deployment_name}/%s"`, bp.BlueprintName, grp.Name))
+			be.Configuration.Set("prefix", prefix.AsValue())
+		}
 	}
-
-	be := &grp.TerraformBackend
-	if be.Type == "" {
-		be.Type = defaults.Type
-		be.Configuration = NewDict(defaults.Configuration.Items())
+	cfg, err := substituteReference(be.Configuration, groupNameRef, cty.StringVal(string(grp.Name)))
+	if err != nil {
+		return err
 	}
-	if be.Type == "gcs" && !be.Configuration.Has("prefix") {
-		prefix := MustParseExpression(
-			fmt.Sprintf(`"%s/${var.deployment_name}/%s"`, bp.BlueprintName, grp.Name))
-		be.Configuration.Set("prefix", prefix.AsValue())
+	if !cfg.IsZero() {
+		be.Configuration = cfg
 	}
+	return nil
 }
 
 func getModuleInputMap(inputs []modulereader.VarInfo) map[string]cty.Type {
@@ -196,16 +461,46 @@ func (mod *Module) addListValue(settingName string, value cty.Value) {
 	mod.Settings.Set(settingName, val)
 }
 
+// UseOutcome describes what `use` did with a setting matching an output of
+// a used module
+type UseOutcome string
+
+const (
+	// UseInjected means the setting was set to the output
+	UseInjected UseOutcome = "injected"
+	// UseAppended means the output was appended to the list setting
+	UseAppended UseOutcome = "appended"
+	// UseOverridden means the setting was set explicitly and the output ignored
+	UseOverridden UseOutcome = "overridden"
+	// UseShadowed means the setting was injected by an earlier used module
+	// and the output ignored
+	UseShadowed UseOutcome = "shadowed"
+	// UseSkipped means the setting was left alone as skip_expansions lists it
+	UseSkipped UseOutcome = "skipped"
+)
+
+// UseInjection records what `use` of a module did with one of its outputs
+type UseInjection struct {
+	Used    ModuleID
+	Setting string
+	Outcome UseOutcome
+}
+
 // useModule matches input variables in a "using" module to output values
 // from a "used" module. It may be used iteratively to successively apply used
 // modules in order of precedence. New input variables are added to the using
 // module as Toolkit variable references (in same format as a blueprint). If
 // the input variable already has a setting, it is ignored, unless the value is
 // a list, in which case output values are appended and flattened using HCL.
+// It returns what was done with every output matching an input.
 //
 //	mod: "using" module as defined above
 //	use: "used" module as defined above
-func useModule(mod *Module, use Module) {
+func useModule(mod *Module, use Module, skip func(setting string) bool) []UseInjection {
+	res := []UseInjection{}
+	record := func(setting string, o UseOutcome) {
+		res = append(res, UseInjection{Used: use.ID, Setting: setting, Outcome: o})
+	}
 	modInputsMap := getModuleInputMap(mod.InfoOrDie().Inputs)
 	for _, useOutput := range use.InfoOrDie().Outputs {
 		setting := useOutput.Name
@@ -215,9 +510,14 @@ func useModule(mod *Module, use Module) {
 		if !ok || setting == "labels" { // also do not "use" module labels
 			continue
 		}
+		if skip != nil && skip(setting) {
+			record(setting, UseSkipped)
+			continue
+		}
 
 		alreadySet := mod.Settings.Has(setting)
 		if alreadySet && len(IsProductOfModuleUse(mod.Settings.Get(setting))) == 0 {
+			record(setting, UseOverridden)
 			continue // set explicitly, skip
 		}
 
@@ -225,6 +525,7 @@ func useModule(mod *Module, use Module) {
 		// these were probably added by a previous call to this function
 		isList := inputType.IsListType()
 		if alreadySet && !isList {
+			record(setting, UseShadowed)
 			continue
 		}
 
@@ -232,27 +533,98 @@ func useModule(mod *Module, use Module) {
 
 		if !isList {
 			mod.Settings.Set(setting, v)
+			record(setting, UseInjected)
 		} else {
 			mod.addListValue(setting, v)
+			record(setting, UseAppended)
 		}
 	}
+	return res
+}
+
+// expandUseAliases replaces references to aliases of used modules in module
+// settings by references to the used modules
+func (bp *Blueprint) expandUseAliases() error {
+	errs := Errors{}
+	bp.WalkModulesSafe(func(p ModulePath, m *Module) {
+		aliases := maps.Keys(m.UseAliases)
+		slices.Sort(aliases)
+		for _, as := range aliases {
+			id := m.UseAliases[as]
+			if _, err := bp.Module(as); err == nil {
+				errs.At(p.Use.At(slices.Index(m.Use, id)), fmt.Errorf("alias %q of module %q is the ID of another module", as, id))
+			}
+		}
+		if errs.Any() || len(aliases) == 0 {
+			return
+		}
+		settings, err := substituteUseAliases(m.Settings, m.UseAliases)
+		if err != nil {
+			errs.At(p.Settings, err)
+			return
+		}
+		m.Settings = settings
+		m.UseAliases = nil
+	})
+	return errs.OrNil()
+}
+
+// substituteUseAliases returns a copy of the Dict where references to outputs
+// of aliased modules, e.g. `module.primary.subnetwork_self_link`, are replaced
+// by references to the modules
+func substituteUseAliases(d Dict, aliases map[ModuleID]ModuleID) (Dict, error) {
+	if d.IsZero() {
+		return Dict{}, nil
+	}
+	v, err := cty.Transform(d.AsObject(), func(p cty.Path, v cty.Value) (cty.Value, error) {
+		e, is := IsExpressionValue(v)
+		if !is {
+			return v, nil
+		}
+		for _, r := range e.References() {
+			id, ok := aliases[r.Module]
+			if r.GlobalVar || !ok {
+				continue
+			}
+			var err error
+			if e, err = ReplaceSubExpressions(e, r.AsExpression(), ModuleRef(id, r.Name).AsExpression()); err != nil {
+				return cty.NilVal, err
+			}
+		}
+		return e.AsValue(), nil
+	})
+	if err != nil {
+		return Dict{}, err
+	}
+	return NewDict(v.AsValueMap()), nil
 }
 
 // applyUseModules applies variables from modules listed in the "use" field
 // when/if applicable
 func (bp Blueprint) applyUseModules(m *Module) error {
+	m.useReport = []UseInjection{}
 	for _, u := range m.Use {
 		used, err := bp.Module(u)
 		if err != nil { // should never happen
 			panic(err)
 		}
-		useModule(m, *used)
+		skip := func(setting string) bool { return bp.skipsExpansion(*m, SkipUse, setting) }
+		m.useReport = append(m.useReport, useModule(m, *used, skip)...)
 	}
 	return nil
 }
 
+// UseReport returns what `use` did with outputs of the used modules, in order
+// of the "use" field; it is only set on expanded blueprints
+func (m Module) UseReport() []UseInjection {
+	return m.useReport
+}
+
 // expandGlobalLabels sets defaults for labels based on other variables.
 func (bp *Blueprint) expandGlobalLabels() {
+	if slices.Contains(bp.SkipExpansions, SkipLabels) {
+		return
+	}
 	vars := &bp.Vars
 	defaults := cty.ObjectVal(map[string]cty.Value{
 		blueprintLabel:  cty.StringVal(bp.BlueprintName),
@@ -283,8 +655,14 @@ func combineModuleLabels(mod Module) cty.Value {
 func (bp Blueprint) applyGlobalVarsInModule(mod *Module) {
 	mi := mod.InfoOrDie()
 	for _, input := range mi.Inputs {
+		if input.Name == "labels" && bp.skipsExpansion(*mod, SkipLabels, "") {
+			continue // neither merged with nor set to global labels
+		}
 		if input.Name == "labels" && bp.Vars.Has("labels") {
 			// labels are special case, always make use of global labels
+			if !mod.Settings.Has("labels") {
+				mod.recordOrigin("labels", bp.varOrigin("labels"), "labels")
+			}
 			mod.Settings.Set("labels", combineModuleLabels(*mod))
 		}
 
@@ -294,13 +672,15 @@ func (bp Blueprint) applyGlobalVarsInModule(mod *Module) {
 		}
 
 		// If it's not set, is there a global we can use?
-		if bp.Vars.Has(input.Name) {
+		if bp.Vars.Has(input.Name) && !bp.skipsExpansion(*mod, SkipVars, input.Name) {
 			mod.Settings.Set(input.Name, GlobalRef(input.Name).AsValue())
+			mod.recordOrigin(input.Name, bp.varOrigin(input.Name), input.Name)
 			continue
 		}
 
 		if input.Name == mi.Metadata.Ghpc.InjectModuleId {
 			mod.Settings.Set(input.Name, cty.StringVal(string(mod.ID)))
+			mod.recordOrigin(input.Name, OriginGhpc, "module id")
 		}
 	}
 }
@@ -310,6 +690,23 @@ func AutomaticOutputName(outputName string, moduleID ModuleID) string {
 	return outputName + "_" + string(moduleID)
 }
 
+// OutputValue returns expression for the deployment-group-level output, it is
+// either a reference to the module output or a custom value set in blueprint
+func OutputValue(moduleID ModuleID, output modulereader.OutputInfo) (Expression, error) {
+	if output.Value == "" {
+		return ModuleRef(moduleID, output.Name).AsExpression(), nil
+	}
+	v, err := parseYamlString(output.Value)
+	if err != nil {
+		return nil, err
+	}
+	e, is := IsExpressionValue(v)
+	if !is {
+		return nil, fmt.Errorf("output value must be an expression, got %#v", output.Value)
+	}
+	return e, nil
+}
+
 // Checks validity of reference to a module:
 // * module exists;
 // * module is not a Packer module;
@@ -338,11 +735,29 @@ func validateModuleReference(bp Blueprint, from Module, toID ModuleID) error {
 	return nil
 }
 
+// terraformNamespaceHints explain how to write references that users take
+// from terraform, as blueprint expressions only refer to deployment variables
+// and module outputs. A misspelled `var` is hinted as any other module ID.
+var terraformNamespaceHints = map[string]string{
+	"module":    "module outputs are referred to as $(module_id.output_name)",
+	"each":      "$(each.value) can only be used in groups with group_for_each",
+	"local":     "locals are not supported in blueprint expressions",
+	"data":      "data sources are not supported in blueprint expressions",
+	"count":     "count is not supported in blueprint expressions",
+	"path":      "path references are not supported in blueprint expressions",
+	"self":      "self references are not supported in blueprint expressions",
+	"terraform": "terraform references are not supported in blueprint expressions",
+}
+
 // Checks validity of reference to a module output:
 // * reference to an existing global variable;
+// * reference to a runtime value is valid;
 // * reference to a module is valid;
 // * referenced module output exists.
 func validateModuleSettingReference(bp Blueprint, mod Module, r Reference) error {
+	if r.IsRuntime() {
+		return validateRuntimeReference(bp, mod, r)
+	}
 	// simplest case to evaluate is a deployment variable's existence
 	if r.GlobalVar {
 		if !bp.Vars.Has(r.Name) {
@@ -355,6 +770,9 @@ func validateModuleSettingReference(bp Blueprint, mod Module, r Reference) error
 	if err := validateModuleReference(bp, mod, r.Module); err != nil {
 		var unkModErr UnknownModuleError
 		if errors.As(err, &unkModErr) {
+			if hint, ok := terraformNamespaceHints[string(unkModErr.ID)]; ok {
+				return HintError{Hint: hint, Err: unkModErr}
+			}
 			hints := []string{"vars"}
 			bp.WalkModulesSafe(func(_ ModulePath, m *Module) {
 				hints = append(hints, string(m.ID))
@@ -375,12 +793,86 @@ func validateModuleSettingReference(bp Blueprint, mod Module, r Reference) error
 	}
 
 	if !slices.Contains(outputs, r.Name) {
-		err := fmt.Errorf("module %q does not have output %q", tm.ID, r.Name)
-		return hintSpelling(r.Name, outputs, err)
+		return hintUnknownOutput(bp, mod, *tm, outputs, r.Name)
 	}
 	return nil
 }
 
+// hintUnknownOutput explains a reference to an output module `to` does not
+// have: the output is provided by another module, possibly of a later group,
+// is misspelled, or none of the modules has it.
+func hintUnknownOutput(bp Blueprint, from Module, to Module, outputs []string, name string) error {
+	err := UnknownOutputError{Module: to.ID, Output: name}
+
+	// closest output, of `to` first, as a hint
+	h := outputHint{name: name, minDist: maxHintDist + 1}
+	for _, o := range outputs {
+		h.closer(fmt.Sprintf("%q", o), o)
+	}
+
+	fg := bp.ModuleGroupOrDie(from.ID)
+	fgi := slices.IndexFunc(bp.DeploymentGroups, func(g DeploymentGroup) bool { return g.Name == fg.Name })
+	for ig, g := range bp.DeploymentGroups {
+		for _, m := range g.Modules {
+			if m.ID == to.ID || m.Kind == PackerKind {
+				continue
+			}
+			if ref := h.module(m, g.Name, ig > fgi); ref != "" {
+				return HintError{fmt.Sprintf("output %q is provided by module %q, did you mean %s?", name, m.ID, ref), err}
+			}
+		}
+	}
+
+	if len(h.later) > 0 {
+		return HintError{fmt.Sprintf("output %q is provided by %s, deployed after module %q; move it to an earlier group", name, strings.Join(h.later, ", "), from.ID), err}
+	}
+	if h.similar != "" {
+		return HintError{fmt.Sprintf("did you mean %s?", h.similar), err}
+	}
+	if len(outputs) == 0 {
+		return HintError{fmt.Sprintf("module %q has no outputs", to.ID), err}
+	}
+	slices.Sort(outputs)
+	return HintError{fmt.Sprintf("outputs of module %q are: %s", to.ID, strings.Join(outputs, ", ")), err}
+}
+
+// outputHint collects outputs of other modules that may have been meant by a
+// reference to an unknown output
+type outputHint struct {
+	name    string
+	similar string   // closest output, formatted as a hint
+	minDist int      // distance of the closest output
+	later   []string // references to modules of later groups
+}
+
+// closer records the output if it is closer to the name than the closest one
+func (h *outputHint) closer(hint string, output string) {
+	if d := levenshtein.Distance(h.name, output, nil); d < h.minDist {
+		h.similar, h.minDist = hint, d
+	}
+}
+
+// module returns a reference to the output of the module if it has the
+// output and is deployed before the referring module
+func (h *outputHint) module(m Module, g GroupName, later bool) string {
+	mi, e := modulereader.GetModuleInfo(m.Source, m.Kind.String())
+	if e != nil {
+		return ""
+	}
+	for _, o := range mi.Outputs {
+		ref := fmt.Sprintf("$(%s.%s)", m.ID, o.Name)
+		switch {
+		case o.Name == h.name && later:
+			h.later = append(h.later, fmt.Sprintf("%s of group %q", ref, g))
+		case o.Name == h.name:
+			return ref
+		case !later:
+			h.closer(ref, o.Name)
+		}
+	}
+	return ""
+}
+
 // FindAllIntergroupReferences finds all intergroup references within the group
 func (dg DeploymentGroup) FindAllIntergroupReferences(bp Blueprint) []Reference {
 	igcRefs := map[Reference]bool{}
@@ -392,19 +884,73 @@ func (dg DeploymentGroup) FindAllIntergroupReferences(bp Blueprint) []Reference
 	return maps.Keys(igcRefs)
 }
 
-// FindIntergroupReferences finds all references to other groups used in the given value
+// GroupDependencies returns, by group, the groups whose outputs it uses. Groups
+// following a bootstrap group depend on it, as they are deployed to the
+// project it creates.
+func (bp Blueprint) GroupDependencies() map[GroupName][]GroupName {
+	res := map[GroupName][]GroupName{}
+	bootstrap := []GroupName{}
+	for _, g := range bp.DeploymentGroups {
+		deps := slices.Clone(bootstrap)
+		for _, r := range g.FindAllIntergroupReferences(bp) {
+			if og := bp.ModuleGroupOrDie(r.Module).Name; og != g.Name && !slices.Contains(deps, og) {
+				deps = append(deps, og)
+			}
+		}
+		slices.SortFunc(deps, func(a, b GroupName) int { return bp.GroupIndex(a) - bp.GroupIndex(b) })
+		res[g.Name] = deps
+		if g.Bootstrap {
+			bootstrap = append(bootstrap, g.Name)
+		}
+	}
+	return res
+}
+
+// DeployOrder returns groups in the order they are deployed: a group follows
+// the groups it depends on, otherwise groups of higher priority come first and
+// groups of the same priority are in blueprint order
+func (bp Blueprint) DeployOrder() []DeploymentGroup {
+	deps := bp.GroupDependencies()
+	done := map[GroupName]bool{}
+	res := []DeploymentGroup{}
+	for len(res) < len(bp.DeploymentGroups) {
+		next := -1
+		for i, g := range bp.DeploymentGroups {
+			ready := !done[g.Name] && !slices.ContainsFunc(deps[g.Name], func(d GroupName) bool { return !done[d] })
+			if ready && (next < 0 || g.Priority > bp.DeploymentGroups[next].Priority) {
+				next = i
+			}
+		}
+		if next < 0 { // should never happen, references only go to earlier groups
+			break
+		}
+		g := bp.DeploymentGroups[next]
+		done[g.Name] = true
+		res = append(res, g)
+	}
+	return res
+}
+
+// FindIntergroupReferences finds all references to other groups used in the
+// given value. References of Packer modules to terraform modules of their group
+// are included, their outputs are passed between stages of the group as
+// between groups.
 func FindIntergroupReferences(v cty.Value, mod Module, bp Blueprint) []Reference {
 	g := bp.ModuleGroupOrDie(mod.ID)
 	res := []Reference{}
 	for r := range valueReferences(v) {
-		if !r.GlobalVar && bp.ModuleGroupOrDie(r.Module).Name != g.Name {
+		if r.GlobalVar || r.IsRuntime() {
+			continue
+		}
+		if mod.Kind == PackerKind || bp.ModuleGroupOrDie(r.Module).Name != g.Name {
 			res = append(res, r)
 		}
 	}
 	return res
 }
 
-// find all intergroup references and add them to source Module.Outputs
+// find all intergroup references and references of post-deploy validators,
+// health checks and post_deploy commands and add them to source Module.Outputs
 func (bp *Blueprint) populateOutputs() {
 	refs := map[Reference]bool{}
 	bp.WalkModulesSafe(func(_ ModulePath, m *Module) {
@@ -413,6 +959,25 @@ func (bp *Blueprint) populateOutputs() {
 			refs[r] = true
 		}
 	})
+	deployed := []Dict{}
+	for _, v := range bp.Validators {
+		deployed = append(deployed, v.Inputs)
+	}
+	for _, h := range bp.HealthChecks {
+		deployed = append(deployed, h.Inputs)
+	}
+	for _, g := range bp.DeploymentGroups {
+		for _, rc := range g.PostDeploy {
+			deployed = append(deployed, rc.Target)
+		}
+	}
+	for _, d := range deployed {
+		for r := range valueReferences(d.AsObject()) {
+			if !r.GlobalVar {
+				refs[r] = true
+			}
+		}
+	}
 
 	bp.WalkModulesSafe(func(_ ModulePath, m *Module) {
 		for r := range refs {
@@ -444,8 +1009,8 @@ func (dg DeploymentGroup) OutputNames() []string {
 	return outputs
 }
 
-// OutputNamesByGroup returns the outputs from prior groups that match input
-// names for this group as a map
+// OutputNamesByGroup returns the outputs from prior groups, and from the group
+// itself for its Packer stages, that match input names for this group as a map
 func OutputNamesByGroup(g DeploymentGroup, bp Blueprint) (map[GroupName][]string, error) {
 	refs := g.FindAllIntergroupReferences(bp)
 	inputs := make([]string, len(refs))
@@ -462,6 +1027,9 @@ func OutputNamesByGroup(g DeploymentGroup, bp Blueprint) (map[GroupName][]string
 	for _, pg := range bp.DeploymentGroups[:i] {
 		res[pg.Name] = intersection(inputs, pg.OutputNames())
 	}
+	if own := bp.DeploymentGroups[i]; own.Mixed() {
+		res[own.Name] = intersection(inputs, own.OutputNames())
+	}
 	return res, nil
 }
 
@@ -17,7 +17,11 @@ package config
 import (
 	"fmt"
 	"hpc-toolkit/pkg/modulereader"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 
+	"github.com/hashicorp/hcl/v2/ext/typeexpr"
 	"github.com/zclconf/go-cty/cty"
 	. "gopkg.in/check.v1"
 )
@@ -28,7 +32,7 @@ func (s *zeroSuite) TestExpandBackend(c *C) {
 
 	{ // no def BE, no group BE
 		g := DeploymentGroup{Name: "clown"}
-		noDefBe.expandBackend(&g)
+		c.Check(noDefBe.expandBackend(&g), IsNil)
 		c.Check(g.TerraformBackend, DeepEquals, BE{})
 	}
 
@@ -36,7 +40,7 @@ func (s *zeroSuite) TestExpandBackend(c *C) {
 		g := DeploymentGroup{
 			Name:             "clown",
 			TerraformBackend: BE{Type: "gcs"}}
-		noDefBe.expandBackend(&g)
+		c.Check(noDefBe.expandBackend(&g), IsNil)
 		c.Check(g.TerraformBackend, DeepEquals, BE{Type: "gcs"})
 	}
 
@@ -48,7 +52,7 @@ func (s *zeroSuite) TestExpandBackend(c *C) {
 
 	{ // def BE, no group BE
 		g := DeploymentGroup{Name: "clown"}
-		defBe.expandBackend(&g)
+		c.Check(defBe.expandBackend(&g), IsNil)
 
 		c.Check(g.TerraformBackend, DeepEquals, BE{ // no change
 			Type: "gcs",
@@ -64,13 +68,52 @@ func (s *zeroSuite) TestExpandBackend(c *C) {
 				Type: "pure_gold",
 				Configuration: NewDict(map[string]cty.Value{
 					"branch": cty.False})}}
-		defBe.expandBackend(&g)
+		c.Check(defBe.expandBackend(&g), IsNil)
 
 		c.Check(g.TerraformBackend, DeepEquals, BE{ // no change
 			Type: "pure_gold",
 			Configuration: NewDict(map[string]cty.Value{
 				"branch": cty.False})})
 	}
+
+	{ // def BE with state access, no group BE
+		saBe := defBe
+		saBe.TerraformBackendDefaults.StateAccess = StateAccess{ImpersonateServiceAccount: "state@central.iam.gserviceaccount.com"}
+		g := DeploymentGroup{Name: "clown"}
+		c.Check(saBe.expandBackend(&g), IsNil)
+		c.Check(g.TerraformBackend.StateAccess, DeepEquals, StateAccess{ImpersonateServiceAccount: "state@central.iam.gserviceaccount.com"})
+	}
+
+	mustParse := func(s string) cty.Value {
+		v, err := parseYamlString(s)
+		c.Assert(err, IsNil)
+		return v
+	}
+	tmplBe := noDefBe
+	tmplBe.TerraformBackendDefaults = BE{
+		Type: "gcs",
+		Configuration: NewDict(map[string]cty.Value{
+			"prefix": mustParse("$(vars.deployment_name)/$(group.name)")})}
+
+	{ // def BE with templated prefix
+		g := DeploymentGroup{Name: "clown"}
+		c.Check(tmplBe.expandBackend(&g), IsNil)
+		c.Check(g.TerraformBackend, DeepEquals, BE{
+			Type: "gcs",
+			Configuration: NewDict(map[string]cty.Value{
+				"prefix": MustParseExpression(`"${var.deployment_name}/${"clown"}"`).AsValue()})})
+	}
+
+	{ // group BE with templated prefix, no def BE
+		g := DeploymentGroup{
+			Name: "clown",
+			TerraformBackend: BE{
+				Type: "gcs",
+				Configuration: NewDict(map[string]cty.Value{
+					"prefix": mustParse("state/$(group.name)")})}}
+		c.Check(noDefBe.expandBackend(&g), IsNil)
+		c.Check(g.TerraformBackend.Configuration.Get("prefix"), DeepEquals, cty.StringVal("state/clown"))
+	}
 }
 
 func (s *zeroSuite) TestAddListValue(c *C) {
@@ -104,7 +147,7 @@ func (s *zeroSuite) TestUseModule(c *C) {
 		setTestModuleInfo(mod, modulereader.ModuleInfo{})
 		setTestModuleInfo(used, modulereader.ModuleInfo{})
 
-		useModule(&mod, used)
+		useModule(&mod, used, nil)
 		c.Check(mod.Settings, DeepEquals, Dict{})
 	}
 
@@ -115,7 +158,7 @@ func (s *zeroSuite) TestUseModule(c *C) {
 		setTestModuleInfo(used, modulereader.ModuleInfo{
 			Outputs: []modulereader.OutputInfo{{Name: "val1"}},
 		})
-		useModule(&mod, used)
+		c.Check(useModule(&mod, used, nil), HasLen, 0)
 		c.Check(mod.Settings, DeepEquals, Dict{})
 	}
 
@@ -128,7 +171,7 @@ func (s *zeroSuite) TestUseModule(c *C) {
 			Outputs: []modulereader.OutputInfo{{Name: "val1"}},
 		})
 
-		useModule(&mod, used)
+		c.Check(useModule(&mod, used, nil), DeepEquals, []UseInjection{{"UsedModule", "val1", UseInjected}})
 		c.Check(mod.Settings.Items(), DeepEquals, map[string]cty.Value{
 			"val1": AsProductOfModuleUse(ref, "UsedModule"),
 		})
@@ -144,7 +187,7 @@ func (s *zeroSuite) TestUseModule(c *C) {
 			Outputs: []modulereader.OutputInfo{{Name: "val1"}},
 		})
 
-		useModule(&mod, used)
+		c.Check(useModule(&mod, used, nil), DeepEquals, []UseInjection{{"UsedModule", "val1", UseOverridden}})
 		c.Check(mod.Settings.Items(), DeepEquals, map[string]cty.Value{"val1": ref})
 	}
 
@@ -159,7 +202,7 @@ func (s *zeroSuite) TestUseModule(c *C) {
 			Outputs: []modulereader.OutputInfo{{Name: "val1"}},
 		})
 
-		useModule(&mod, used)
+		c.Check(useModule(&mod, used, nil), DeepEquals, []UseInjection{{"UsedModule", "val1", UseShadowed}})
 		c.Check(mod.Settings.Items(), DeepEquals, map[string]cty.Value{
 			"val1": AsProductOfModuleUse(ref, "UsedModule")})
 	}
@@ -172,13 +215,26 @@ func (s *zeroSuite) TestUseModule(c *C) {
 		setTestModuleInfo(used, modulereader.ModuleInfo{
 			Outputs: []modulereader.OutputInfo{{Name: "val1"}},
 		})
-		useModule(&mod, used)
+		c.Check(useModule(&mod, used, nil), DeepEquals, []UseInjection{{"UsedModule", "val1", UseAppended}})
 		c.Check(mod.Settings.Items(), DeepEquals, map[string]cty.Value{
 			"val1": AsProductOfModuleUse(
 				MustParseExpression(`flatten([module.UsedModule.val1])`).AsValue(),
 				"UsedModule")})
 	}
 
+	{ // Pass: Single Input/Output match, skipped
+		mod := Module{ID: "lime", Source: "limeTree"}
+		setTestModuleInfo(mod, modulereader.ModuleInfo{
+			Inputs: []modulereader.VarInfo{varInfoNumber},
+		})
+		setTestModuleInfo(used, modulereader.ModuleInfo{
+			Outputs: []modulereader.OutputInfo{{Name: "val1"}},
+		})
+		skip := func(setting string) bool { return setting == "val1" }
+		c.Check(useModule(&mod, used, skip), DeepEquals, []UseInjection{{"UsedModule", "val1", UseSkipped}})
+		c.Check(mod.Settings, DeepEquals, Dict{})
+	}
+
 	{ // Pass: Setting exists, Input is List, Output is not a list
 		// Assume setting was not set in blueprint
 		mod := Module{ID: "lime", Source: "limeTree"}
@@ -190,7 +246,7 @@ func (s *zeroSuite) TestUseModule(c *C) {
 			Outputs: []modulereader.OutputInfo{{Name: "val1"}},
 		})
 
-		useModule(&mod, used)
+		useModule(&mod, used, nil)
 		c.Check(mod.Settings.Items(), DeepEquals, map[string]cty.Value{
 			"val1": AsProductOfModuleUse(
 				MustParseExpression(`flatten([module.UsedModule.val1,[module.UsedModule.val1]])`).AsValue(),
@@ -208,7 +264,7 @@ func (s *zeroSuite) TestUseModule(c *C) {
 			Outputs: []modulereader.OutputInfo{{Name: "val1"}},
 		})
 
-		useModule(&mod, used)
+		useModule(&mod, used, nil)
 		c.Check(mod.Settings.Items(), DeepEquals, map[string]cty.Value{
 			"val1": cty.TupleVal([]cty.Value{ref})})
 	}
@@ -265,6 +321,166 @@ func (s *zeroSuite) TestExpandModule(c *C) {
 	})
 }
 
+func (s *zeroSuite) TestExpandModuleSources(c *C) {
+	mkBp := func(src string) Blueprint {
+		return Blueprint{
+			Vars: NewDict(map[string]cty.Value{
+				"deployment_name": cty.StringVal("green"),
+				"flavor":          cty.StringVal("experimental"),
+				"number":          cty.NumberIntVal(7),
+			}),
+			DeploymentGroups: []DeploymentGroup{{Modules: []Module{{ID: "lime", Source: src}}}}}
+	}
+
+	{ // Plain source is left as is
+		bp := mkBp("modules/network/vpc")
+		c.Check(bp.expandModuleSources(), IsNil)
+		c.Check(bp.DeploymentGroups[0].Modules[0].Source, Equals, "modules/network/vpc")
+		c.Check(bp.ListUnusedVariables(), HasLen, 2)
+	}
+
+	{ // Expression is resolved, used variables are tracked
+		bp := mkBp("community/modules/$(vars.flavor)/vpc")
+		c.Check(bp.expandModuleSources(), IsNil)
+		c.Check(bp.DeploymentGroups[0].Modules[0].Source, Equals, "community/modules/experimental/vpc")
+		c.Check(bp.ListUnusedVariables(), DeepEquals, []string{"number"})
+	}
+
+	{ // Module references are not allowed
+		bp := mkBp("modules/$(apple.flavor)/vpc")
+		c.Check(bp.expandModuleSources(), ErrorMatches, ".*can only refer to deployment variables.*")
+	}
+
+	{ // Must evaluate to a string
+		bp := mkBp("$(vars.number > 5)")
+		c.Check(bp.expandModuleSources(), ErrorMatches, ".*must evaluate to a string.*")
+	}
+
+	{ // Registry source is resolved and locked next to the blueprint
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/.well-known/terraform.json":
+				fmt.Fprint(w, `{"modules.v1": "/v1/modules/"}`)
+			case "/v1/modules/hpc/lime/google/versions":
+				fmt.Fprint(w, `{"modules": [{"versions": [{"version": "1.2.0"}, {"version": "1.3.1"}]}]}`)
+			case "/v1/modules/hpc/lime/google/1.3.1/download":
+				w.Header().Set("X-Terraform-Get", "github.com/hpc/lime?ref=v1.3.1")
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer srv.Close()
+		bp := mkBp("registry://hpc/lime//vpc@~1.2")
+		bp.ModuleRegistry, bp.dir = srv.URL, c.MkDir()
+		c.Check(bp.expandModuleSources(), IsNil)
+		c.Check(bp.DeploymentGroups[0].Modules[0].Source, Equals, "github.com/hpc/lime//vpc?ref=v1.3.1")
+
+		lock, err := modulereader.ReadModuleLock(filepath.Join(bp.dir, modulereader.ModuleLockFileName))
+		c.Assert(err, IsNil)
+		c.Check(lock.Modules[srv.URL+"/hpc/lime/google"].Version, Equals, "1.3.1")
+	}
+
+	{ // Unresolved source can not be read
+		mod := Module{ID: "lime", Source: "modules/$(vars.flavor)/vpc", Kind: TerraformKind}
+		c.Check(validateModule(Root.Groups.At(0).Modules.At(0), mod, Blueprint{}), ErrorMatches, ".*has to be resolved.*")
+	}
+}
+
+func (s *zeroSuite) TestResolveModuleSource(c *C) {
+	bp := Blueprint{
+		SourceRoots: map[string]string{
+			"site://":      "github.com/example/modules//",
+			"site://beta/": "github.com/example/beta-modules//",
+			"local://":     "./vendor/",
+		},
+		dir: "/home/bp",
+	}
+	c.Check(bp.resolveModuleSource("modules/network/vpc"), Equals, "modules/network/vpc")
+	c.Check(bp.resolveModuleSource("./net/vpc"), Equals, "./net/vpc")
+	c.Check(bp.resolveModuleSource("site://net/vpc?ref=v1"), Equals, "github.com/example/modules//net/vpc?ref=v1")
+	c.Check(bp.resolveModuleSource("site://beta/net/vpc"), Equals, "github.com/example/beta-modules//net/vpc")
+	c.Check(bp.resolveModuleSource("local://vpc"), Equals, "./vendor/vpc")
+
+	bp.SourceBase = SourceBaseBlueprint
+	c.Check(bp.resolveModuleSource("./net/vpc"), Equals, "/home/bp/net/vpc")
+	c.Check(bp.resolveModuleSource("../net/vpc"), Equals, "/home/net/vpc")
+	c.Check(bp.resolveModuleSource("/opt/net/vpc"), Equals, "/opt/net/vpc")
+	c.Check(bp.resolveModuleSource("local://vpc"), Equals, "/home/bp/vendor/vpc")
+	c.Check(bp.resolveModuleSource("modules/network/vpc"), Equals, "modules/network/vpc")
+}
+
+func (s *zeroSuite) TestValidateSourceResolution(c *C) {
+	c.Check(validateSourceResolution(Blueprint{SourceBase: SourceBaseBlueprint, dir: "/home/bp"}), IsNil)
+	c.Check(validateSourceResolution(Blueprint{SourceBase: SourceBaseBlueprint}), ErrorMatches, ".*requires the blueprint to be read from a local file.*")
+	c.Check(validateSourceResolution(Blueprint{SourceBase: "home"}), ErrorMatches, ".*source_base must be either.*")
+	c.Check(validateSourceResolution(Blueprint{SourceRoots: map[string]string{"site://": ""}}), ErrorMatches, ".*must not be empty.*")
+	c.Check(validateSourceResolution(Blueprint{ModuleRegistry: "https://registry.example.com"}), IsNil)
+	c.Check(validateSourceResolution(Blueprint{ModuleRegistry: "registry.example.com"}), ErrorMatches, ".*must be an http\\(s\\) URL.*")
+}
+
+func (s *zeroSuite) TestCheckInputValueMatchesType(c *C) {
+	bp := Blueprint{Vars: NewDict(map[string]cty.Value{
+		"zone": cty.StringVal("us-central1-a"),
+	})}
+	num := modulereader.VarInfo{Name: "num", Type: cty.Number}
+	list := modulereader.VarInfo{Name: "list", Type: cty.List(cty.String)}
+
+	{ // reference to module output is not known until apply
+		v := ModuleRef("packer", "image").AsValue()
+		c.Check(checkInputValueMatchesType(v, num, bp), IsNil)
+		c.Check(checkInputValueMatchesType(v, list, bp), IsNil)
+	}
+
+	{ // partially known value is still type checked
+		v := MustParseExpression(`"${var.zone}-${module.packer.image}"`).AsValue()
+		c.Check(checkInputValueMatchesType(v, list, bp), NotNil)
+	}
+
+	{ // list with unknown element
+		v := MustParseExpression(`[var.zone, module.packer.image]`).AsValue()
+		c.Check(checkInputValueMatchesType(v, list, bp), IsNil)
+		c.Check(checkInputValueMatchesType(v, num, bp), NotNil)
+	}
+
+	{ // type of module output declared in metadata is checked
+		net := Module{ID: "net", Kind: TerraformKind, Source: c.TestName() + "/net"}
+		setTestModuleInfo(net, modulereader.ModuleInfo{Outputs: []modulereader.OutputInfo{
+			{Name: "subnets", Type: cty.List(cty.String)},
+			{Name: "name"}}})
+		bp := Blueprint{DeploymentGroups: []DeploymentGroup{{Modules: []Module{net}}}}
+
+		subnets := ModuleRef("net", "subnets").AsValue()
+		c.Check(checkInputValueMatchesType(subnets, list, bp), IsNil)
+		c.Check(checkInputValueMatchesType(subnets, num, bp), ErrorMatches, `setting "num" expects number, .*`)
+
+		name := ModuleRef("net", "name").AsValue() // type not declared
+		c.Check(checkInputValueMatchesType(name, num, bp), IsNil)
+	}
+
+	{ // error names expected and provided types
+		c.Check(checkInputValueMatchesType(cty.True, list, bp), ErrorMatches, `setting "list" expects list\(string\), got bool`)
+		obj := modulereader.VarInfo{Name: "obj", Type: cty.Object(map[string]cty.Type{"size": cty.Number})}
+		v := cty.ObjectVal(map[string]cty.Value{"size": cty.StringVal("big")})
+		c.Check(checkInputValueMatchesType(v, obj, bp), ErrorMatches, `setting "obj" expects object\({size=number}\), got map; obj.size: a number is required`)
+	}
+
+	{ // optional attributes may be omitted, nested ones are checked
+		disk := cty.ObjectWithOptionalAttrs(map[string]cty.Type{"size": cty.Number}, []string{"size"})
+		ty := cty.ObjectWithOptionalAttrs(map[string]cty.Type{"name": cty.String, "disk": disk}, []string{"disk"})
+		ns := modulereader.VarInfo{Name: "nodeset", Type: ty, TypeDefaults: &typeexpr.Defaults{
+			Type:          ty,
+			DefaultValues: map[string]cty.Value{"disk": cty.EmptyObjectVal},
+			Children: map[string]*typeexpr.Defaults{
+				"disk": {Type: disk, DefaultValues: map[string]cty.Value{"size": cty.NumberIntVal(50)}}},
+		}}
+		c.Check(checkInputValueMatchesType(cty.ObjectVal(map[string]cty.Value{"name": cty.StringVal("gpu")}), ns, bp), IsNil)
+		v := cty.ObjectVal(map[string]cty.Value{
+			"name": cty.StringVal("gpu"),
+			"disk": cty.ObjectVal(map[string]cty.Value{"size": cty.StringVal("big")})})
+		c.Check(checkInputValueMatchesType(v, ns, bp), ErrorMatches, `.*nodeset.disk.size: a number is required`)
+	}
+}
+
 func (s *zeroSuite) TestApplyGlobalVarsInModule(c *C) {
 	mod := Module{
 		ID:     "carrot",
@@ -331,6 +547,12 @@ func (s *zeroSuite) TestValidateModuleReference(c *C) {
 	// Reference packer module (bad)
 	c.Check(validateModuleReference(bp, y, pkr.ID), NotNil)
 
+	{ // Packer module refers to terraform module of its group (good)
+		bp.DeploymentGroups[0].Modules = append(bp.DeploymentGroups[0].Modules, pkr)
+		bp.DeploymentGroups[1].Modules = []Module{{ID: "modulePkr2", Kind: PackerKind}}
+		c.Check(validateModuleReference(bp, pkr, a.ID), IsNil)
+	}
+
 }
 
 func (s *zeroSuite) TestIntersection(c *C) {
@@ -374,3 +596,155 @@ func (s *MySuite) TestOutputNamesByGroup(c *C) {
 		group0.Name: {AutomaticOutputName("test_inter_0", mod0.ID)},
 	})
 }
+
+func (s *zeroSuite) TestOutputNamesByGroupMixed(c *C) {
+	net := Module{ID: "net", Kind: TerraformKind, Outputs: []modulereader.OutputInfo{{Name: "subnetwork"}}}
+	img := Module{ID: "img", Kind: PackerKind, Settings: NewDict(map[string]cty.Value{
+		"subnetwork": ModuleRef("net", "subnetwork").AsValue()})}
+	g := DeploymentGroup{Name: "g", Modules: []Module{net, img}}
+	bp := Blueprint{DeploymentGroups: []DeploymentGroup{g}}
+
+	// Packer stage uses outputs of the terraform stage of its group
+	got, err := OutputNamesByGroup(g.Stages()[1], bp)
+	c.Assert(err, IsNil)
+	c.Check(got, DeepEquals, map[GroupName][]string{"g": {AutomaticOutputName("subnetwork", "net")}})
+	// the group does not depend on itself
+	c.Check(bp.GroupDependencies(), DeepEquals, map[GroupName][]GroupName{"g": {}})
+}
+
+func (s *zeroSuite) TestCoerceValue(c *C) {
+	strList := cty.List(cty.String)
+	// numeric string to number
+	c.Check(coerceValue(cty.StringVal("10"), cty.Number), DeepEquals, cty.MustParseNumberVal("10"))
+	// single value to list
+	c.Check(coerceValue(cty.StringVal("a"), strList), DeepEquals, cty.TupleVal([]cty.Value{cty.StringVal("a")}))
+	c.Check(coerceValue(cty.StringVal("2"), cty.Set(cty.Number)), DeepEquals, cty.TupleVal([]cty.Value{cty.MustParseNumberVal("2")}))
+	// suitable values are kept as is
+	c.Check(coerceValue(cty.NumberIntVal(3), cty.String), DeepEquals, cty.NumberIntVal(3))
+	c.Check(coerceValue(cty.TupleVal([]cty.Value{cty.StringVal("a")}), strList), DeepEquals, cty.TupleVal([]cty.Value{cty.StringVal("a")}))
+	// unsafe coercions are not attempted
+	c.Check(coerceValue(cty.StringVal("ten"), cty.Number), DeepEquals, cty.StringVal("ten"))
+	c.Check(coerceValue(cty.StringVal("a"), cty.List(cty.Number)), DeepEquals, cty.StringVal("a"))
+	// expressions are kept as is
+	ref := GlobalRef("zone").AsValue()
+	c.Check(coerceValue(ref, strList), DeepEquals, ref)
+}
+
+func (s *zeroSuite) TestExpandUseAliases(c *C) {
+	link, err := parseYamlString("$(primary.subnetwork_self_link)")
+	c.Assert(err, IsNil)
+	names, err := parseYamlString("$(primary.subnetwork_name)-$(secondary.subnetwork_name)")
+	c.Assert(err, IsNil)
+	vm := Module{
+		ID:         "vm",
+		Use:        ModuleIDs{"net1", "net2"},
+		UseAliases: map[ModuleID]ModuleID{"primary": "net1", "secondary": "net2"},
+		Settings: NewDict(map[string]cty.Value{
+			"subnetwork_self_link": link,
+			"name":                 names,
+			"zone":                 GlobalRef("zone").AsValue()}),
+	}
+	bp := Blueprint{DeploymentGroups: []DeploymentGroup{{Name: "g", Modules: []Module{{ID: "net1"}, {ID: "net2"}, vm}}}}
+
+	c.Assert(bp.expandUseAliases(), IsNil)
+	got := bp.DeploymentGroups[0].Modules[2]
+	c.Check(got.UseAliases, IsNil)
+	c.Check(got.Settings.Items(), DeepEquals, map[string]cty.Value{
+		"subnetwork_self_link": ModuleRef("net1", "subnetwork_self_link").AsValue(),
+		"name":                 MustParseExpression(`"${module.net1.subnetwork_name}-${module.net2.subnetwork_name}"`).AsValue(),
+		"zone":                 GlobalRef("zone").AsValue()})
+
+	{ // alias is the ID of another module
+		vm.UseAliases = map[ModuleID]ModuleID{"net2": "net1"}
+		bp := Blueprint{DeploymentGroups: []DeploymentGroup{{Name: "g", Modules: []Module{{ID: "net1"}, {ID: "net2"}, vm}}}}
+		c.Check(bp.expandUseAliases(), ErrorMatches, `.*alias "net2" of module "net1" is the ID of another module`)
+	}
+}
+
+func (s *zeroSuite) TestAppendModule(c *C) {
+	net := Module{ID: "net", Kind: TerraformKind, Source: c.TestName() + "/net"}
+	setTestModuleInfo(net, modulereader.ModuleInfo{
+		Outputs: []modulereader.OutputInfo{{Name: "network_name"}}})
+	audit := Module{ID: "audit", Source: c.TestName() + "/audit", Use: ModuleIDs{"net"}}
+	setTestModuleInfo(Module{Source: audit.Source, Kind: TerraformKind}, modulereader.ModuleInfo{
+		Inputs: []modulereader.VarInfo{{Name: "network_name"}, {Name: "project_id"}}})
+
+	mkBp := func() Blueprint {
+		return Blueprint{
+			Vars:             NewDict(map[string]cty.Value{"project_id": cty.StringVal("green")}),
+			DeploymentGroups: []DeploymentGroup{{Name: "primary", Modules: []Module{net}}}}
+	}
+
+	{ // Success, module is expanded
+		bp := mkBp()
+		c.Assert(bp.AppendModule("primary", audit), IsNil)
+		got, err := bp.Module("audit")
+		c.Assert(err, IsNil)
+		c.Check(got.Kind, Equals, TerraformKind)
+		c.Check(got.Settings.Items(), DeepEquals, map[string]cty.Value{
+			"network_name": AsProductOfModuleUse(ModuleRef("net", "network_name").AsValue(), "net"),
+			"project_id":   GlobalRef("project_id").AsValue()})
+	}
+
+	{ // Fail: unknown group
+		bp := mkBp()
+		c.Check(bp.AppendModule("secondary", audit), ErrorMatches, `deployment group "secondary" does not exist`)
+	}
+
+	{ // Fail: duplicate ID
+		bp := mkBp()
+		c.Check(bp.AppendModule("primary", net), ErrorMatches, `.*net used more than once`)
+	}
+
+	{ // Fail: invalid module is not added
+		bp := mkBp()
+		bad := audit
+		bad.Use = ModuleIDs{"absent"}
+		c.Check(bp.AppendModule("primary", bad), NotNil)
+		c.Check(bp.DeploymentGroups[0].Modules, HasLen, 1)
+	}
+}
+
+func (s *zeroSuite) TestGroupDependencies(c *C) {
+	bp := Blueprint{DeploymentGroups: []DeploymentGroup{
+		{Name: "project", Bootstrap: true, Modules: []Module{{ID: "prj"}}},
+		{Name: "net", Modules: []Module{{ID: "vpc"}}},
+		{Name: "cluster", Modules: []Module{{ID: "slurm", Settings: NewDict(map[string]cty.Value{
+			"network":    ModuleRef("vpc", "network_name").AsValue(),
+			"subnetwork": ModuleRef("vpc", "subnetwork_name").AsValue(),
+		})}}},
+	}}
+	c.Check(bp.GroupDependencies(), DeepEquals, map[GroupName][]GroupName{
+		"project": {},
+		"net":     {"project"},
+		"cluster": {"project", "net"},
+	})
+}
+
+func (s *zeroSuite) TestDeployOrder(c *C) {
+	vpc := ModuleRef("vpc", "network_name").AsValue()
+	bp := Blueprint{DeploymentGroups: []DeploymentGroup{
+		{Name: "net", Modules: []Module{{ID: "vpc"}}},
+		{Name: "cluster", Modules: []Module{{ID: "slurm", Settings: NewDict(map[string]cty.Value{"network": vpc})}}},
+		{Name: "images", Modules: []Module{{ID: "image"}}},
+		{Name: "fs", Modules: []Module{{ID: "filestore", Settings: NewDict(map[string]cty.Value{"network": vpc})}}},
+	}}
+	names := func(gs []DeploymentGroup) []GroupName {
+		res := []GroupName{}
+		for _, g := range gs {
+			res = append(res, g.Name)
+		}
+		return res
+	}
+
+	// blueprint order without priorities
+	c.Check(names(bp.DeployOrder()), DeepEquals, []GroupName{"net", "cluster", "images", "fs"})
+
+	// fs is deployed as soon as the network it uses is
+	bp.DeploymentGroups[3].Priority = 10
+	c.Check(names(bp.DeployOrder()), DeepEquals, []GroupName{"net", "fs", "cluster", "images"})
+
+	// images do not wait for the network
+	bp.DeploymentGroups[2].Priority = 20
+	c.Check(names(bp.DeployOrder()), DeepEquals, []GroupName{"images", "net", "fs", "cluster"})
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Experimental features are expansion behaviors still in development, they
+// must be listed in `experimental` of the blueprint to be used. A feature
+// graduates by removing it from experimentalFeatures and its check.
+const (
+	// ExperimentGroupForEach enables group_for_each of deployment groups
+	ExperimentGroupForEach = "group_for_each"
+)
+
+// experimentalFeatures describes experimental features, keyed by name
+var experimentalFeatures = map[string]string{
+	ExperimentGroupForEach: "instantiate a deployment group per element of a list",
+}
+
+// ExperimentalFeatures returns names of all experimental features, sorted
+func ExperimentalFeatures() []string {
+	fs := maps.Keys(experimentalFeatures)
+	slices.Sort(fs)
+	return fs
+}
+
+// ExperimentEnabled tells whether the experimental feature is enabled by the
+// blueprint
+func (bp Blueprint) ExperimentEnabled(f string) bool {
+	return slices.Contains(bp.Experimental, f)
+}
+
+// checkExperimental ensures that only known experimental features are enabled
+func (bp Blueprint) checkExperimental() error {
+	errs := Errors{}
+	for i, f := range bp.Experimental {
+		if _, ok := experimentalFeatures[f]; !ok {
+			errs.At(Root.Experimental.At(i), HintError{
+				Hint: fmt.Sprintf("experimental features are: %s", strings.Join(ExperimentalFeatures(), ", ")),
+				Err:  fmt.Errorf("unknown experimental feature %q", f)})
+		}
+	}
+	return errs.OrNil()
+}
+
+// requireExperiment returns an error at path p if the experimental feature is
+// not enabled by the blueprint
+func (bp Blueprint) requireExperiment(p Path, f string) error {
+	if bp.ExperimentEnabled(f) {
+		return nil
+	}
+	return BpError{p, HintError{
+		Hint: fmt.Sprintf("add %q to `experimental` of the blueprint to use it, its behavior may change in future releases", f),
+		Err:  fmt.Errorf("%s is an experimental feature", f)}}
+}
@@ -0,0 +1,39 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestCheckExperimental(c *C) {
+	c.Check(Blueprint{}.checkExperimental(), IsNil)
+	c.Check(Blueprint{Experimental: []string{ExperimentGroupForEach}}.checkExperimental(), IsNil)
+
+	err := Blueprint{Experimental: []string{ExperimentGroupForEach, "time_travel"}}.checkExperimental()
+	c.Check(err, ErrorMatches, `.*unknown experimental feature "time_travel" - experimental features are: group_for_each`)
+	var be BpError
+	c.Assert(errors.As(err, &be), Equals, true)
+	c.Check(be.Path.String(), Equals, "experimental[1]")
+}
+
+func (s *zeroSuite) TestRequireExperiment(c *C) {
+	p := Root.Groups.At(0).ForEach
+	c.Check(Blueprint{Experimental: []string{ExperimentGroupForEach}}.requireExperiment(p, ExperimentGroupForEach), IsNil)
+	c.Check(Blueprint{}.requireExperiment(p, ExperimentGroupForEach), ErrorMatches,
+		`deployment_groups\[0\].group_for_each: group_for_each is an experimental feature - add "group_for_each" to .*`)
+}
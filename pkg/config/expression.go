@@ -20,6 +20,8 @@ import (
 	"regexp"
 	"strings"
 
+	"hpc-toolkit/pkg/modulereader"
+
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hclsyntax"
 	"github.com/hashicorp/hcl/v2/hclwrite"
@@ -165,9 +167,17 @@ func parseHcl(s string) (hclwrite.Tokens, error) {
 	if diag.HasErrors() {
 		return nil, diag
 	}
+	isWord := func(t hclsyntax.TokenType) bool {
+		return t == hclsyntax.TokenIdent || t == hclsyntax.TokenNumberLit
+	}
 	wToks := make(hclwrite.Tokens, len(sToks))
 	for i, st := range sToks {
 		wToks[i] = &hclwrite.Token{Type: st.Type, Bytes: st.Bytes}
+		// tokens are written without spaces, but adjacent words must stay
+		// apart, e.g. keywords of `[for x in var.xs : x]`
+		if i > 0 && isWord(st.Type) && isWord(sToks[i-1].Type) {
+			wToks[i].SpacesBefore = 1
+		}
 	}
 	return wToks, nil
 }
@@ -373,6 +383,7 @@ func FunctionCallExpression(n string, args ...cty.Value) Expression {
 func functions() map[string]function.Function {
 	return map[string]function.Function{
 		"flatten": stdlib.FlattenFunc,
+		"join":    stdlib.JoinFunc,
 		"merge":   stdlib.MergeFunc,
 	}
 }
@@ -380,33 +391,169 @@ func functions() map[string]function.Function {
 func valueReferences(v cty.Value) map[Reference]cty.Path {
 	r := map[Reference]cty.Path{}
 	cty.Walk(v, func(p cty.Path, v cty.Value) (bool, error) {
-		if e, is := IsExpressionValue(v); is {
-			for _, ref := range e.References() {
-				r[ref] = p
-			}
+		e, is := IsExpressionValue(v)
+		if !is {
+			return true, nil
 		}
-		return true, nil
+		for _, ref := range e.References() {
+			r[ref] = p
+		}
+		return false, nil // expressions are leaves
 	})
 	return r
 }
 
+// evalMemo memoizes evaluation while deployment variables do not change. The
+// evaluated variables are never modified, values of expressions are kept by
+// expression key, which identifies identical expressions.
+type evalMemo struct {
+	vars    Dict
+	varsObj cty.Value
+	full    map[expressionKey]cty.Value // by Eval
+	partial map[expressionKey]cty.Value // by PartialEval
+}
+
+func newEvalMemo(vars Dict) *evalMemo {
+	return &evalMemo{
+		vars:    vars,
+		varsObj: vars.AsObject(),
+		full:    map[expressionKey]cty.Value{},
+		partial: map[expressionKey]cty.Value{},
+	}
+}
+
+// varsObject returns evaluated deployment variables as an object, and the
+// memoized values of expressions evaluated with them, if memoized
+func (bp *Blueprint) varsObject(partial bool) (cty.Value, map[expressionKey]cty.Value, error) {
+	if bp.memo == nil {
+		vars, err := bp.evalVars()
+		return vars.AsObject(), nil, err
+	}
+	if partial {
+		return bp.memo.varsObj, bp.memo.partial, nil
+	}
+	return bp.memo.varsObj, bp.memo.full, nil
+}
+
 func (bp *Blueprint) Eval(v cty.Value) (cty.Value, error) {
+	vars, memo, err := bp.varsObject(false)
+	if err != nil {
+		return cty.NilVal, err
+	}
+	ctx := hcl.EvalContext{
+		Variables: map[string]cty.Value{"var": vars},
+		Functions: functions()}
+	return evalMemoized(v, &ctx, memo)
+}
+
+// PartialEval evaluates the value in the context of Blueprint.
+// Module outputs are not known until apply, references to them are
+// evaluated as unknown values of their declared types, of any type otherwise.
+func (bp *Blueprint) PartialEval(v cty.Value) (cty.Value, error) {
+	vars, memo, err := bp.varsObject(true)
+	if err != nil {
+		return cty.NilVal, err
+	}
+	ctx := hcl.EvalContext{
+		Variables: map[string]cty.Value{
+			"var":    vars,
+			"module": bp.unknownModuleOutputs(v)},
+		Functions: functions()}
+	return evalMemoized(v, &ctx, memo)
+}
+
+// EvalWithOutputs evaluates the value in the context of Blueprint and output
+// values of deployed modules, given by module ID and output name
+func (bp *Blueprint) EvalWithOutputs(v cty.Value, outputs map[ModuleID]map[string]cty.Value) (cty.Value, error) {
 	vars, err := bp.evalVars()
 	if err != nil {
 		return cty.NilVal, err
 	}
+	used := map[ModuleID]map[string]cty.Value{}
+	for r := range valueReferences(v) {
+		if r.GlobalVar {
+			continue
+		}
+		ov, ok := outputs[r.Module][r.Name]
+		if !ok {
+			return cty.NilVal, fmt.Errorf("output %q of module %q is not known, deploy its group first", r.Name, r.Module)
+		}
+		if _, ok := used[r.Module]; !ok {
+			used[r.Module] = map[string]cty.Value{}
+		}
+		used[r.Module][r.Name] = ov
+	}
+	mods := map[string]cty.Value{}
+	for m, outputs := range used {
+		mods[string(m)] = cty.ObjectVal(outputs)
+	}
 	ctx := hcl.EvalContext{
-		Variables: map[string]cty.Value{"var": vars.AsObject()},
+		Variables: map[string]cty.Value{
+			"var":    vars.AsObject(),
+			"module": cty.ObjectVal(mods)},
 		Functions: functions()}
 	return eval(v, &ctx)
 }
 
+// unknownModuleOutputs builds "module" namespace object for all module outputs
+// referenced in the given value, every output is set to an unknown value of
+// the type declared in the module metadata, or of any type if not declared.
+func (bp *Blueprint) unknownModuleOutputs(v cty.Value) cty.Value {
+	mods := map[ModuleID]map[string]cty.Value{}
+	for r := range valueReferences(v) {
+		if r.GlobalVar {
+			continue
+		}
+		if _, ok := mods[r.Module]; !ok {
+			mods[r.Module] = map[string]cty.Value{}
+		}
+		mods[r.Module][r.Name] = cty.UnknownVal(bp.outputType(r))
+	}
+	res := map[string]cty.Value{}
+	for m, outputs := range mods {
+		res[string(m)] = cty.ObjectVal(outputs)
+	}
+	return cty.ObjectVal(res)
+}
+
+// outputType returns the type of the referenced module output declared in the
+// module metadata, cty.DynamicPseudoType if not known
+func (bp *Blueprint) outputType(r Reference) cty.Type {
+	m, err := bp.Module(r.Module)
+	if err != nil || m.Kind != TerraformKind {
+		return cty.DynamicPseudoType
+	}
+	mi, err := modulereader.GetModuleInfo(m.Source, m.Kind.String())
+	if err != nil {
+		return cty.DynamicPseudoType
+	}
+	if o, ok := mi.GetOutputsAsMap()[r.Name]; ok && o.Type != cty.NilType {
+		return o.Type
+	}
+	return cty.DynamicPseudoType
+}
+
 func eval(v cty.Value, ctx *hcl.EvalContext) (cty.Value, error) {
+	return evalMemoized(v, ctx, nil)
+}
+
+// evalMemoized is eval reusing values of identical expressions evaluated in
+// the same context before, kept in memo unless it is nil
+func evalMemoized(v cty.Value, ctx *hcl.EvalContext, memo map[expressionKey]cty.Value) (cty.Value, error) {
 	return cty.Transform(v, func(p cty.Path, v cty.Value) (cty.Value, error) {
-		if e, is := IsExpressionValue(v); is {
-			return e.Eval(ctx)
+		e, is := IsExpressionValue(v)
+		if !is {
+			return v, nil
+		}
+		key, _ := HasMark[expressionKey](v)
+		if ev, ok := memo[key]; ok {
+			return ev, nil
+		}
+		ev, err := e.Eval(ctx)
+		if err == nil && memo != nil {
+			memo[key] = ev
 		}
-		return v, nil
+		return ev, err
 	})
 }
 
@@ -531,7 +678,7 @@ func parseBpLit(s string) (cty.Value, error) {
 // "var.hi) $(var.there)" -> "var.hi"
 // "try(var.this) + one(var.time)) tail" -> "try(var.this) + one(var.time)"
 func greedyParseHcl(s string) (Expression, string, error) {
-	err := errors.New("no closing parenthesis")
+	err := errors.New("no closing parenthesis, expressions must end on the line they start")
 	for i := 0; i < len(s); i++ {
 		if s[i] != ')' {
 			continue
@@ -598,13 +745,24 @@ func replaceTokens(body, old, new hclwrite.Tokens) hclwrite.Tokens {
 			p = hclwrite.Tokens{}
 		}
 		if len(p) == len(old) { // gathered enough tokens
+			r = append(r, withSpacesBefore(new, p[0].SpacesBefore)...)
 			p = hclwrite.Tokens{}
-			r = append(r, new...)
 		}
 	}
 	return append(r, p...)
 }
 
+// withSpacesBefore returns copy of tokens, with the spaces before the first one
+// set, so the replacement keeps separation from the preceding token
+func withSpacesBefore(ts hclwrite.Tokens, spaces int) hclwrite.Tokens {
+	if len(ts) == 0 {
+		return ts
+	}
+	first := *ts[0]
+	first.SpacesBefore = spaces
+	return append(hclwrite.Tokens{&first}, ts[1:]...)
+}
+
 func ReplaceSubExpressions(body, old, new Expression) (Expression, error) {
 	r := replaceTokens(body.Tokenize(), old.Tokenize(), new.Tokenize())
 	return ParseExpression(string(r.Bytes()))
@@ -127,6 +127,16 @@ echo "Hello $(vars.project_id)"
 		{`$("${vars.green}_${vars.sleeve}")`, `"${var.green}_${var.sleeve}"`, false},
 		{"$(fun(vars.green))", "fun(var.green)", false},
 
+		// Conditionals, for expressions and splats
+		{`$(vars.green ? "sleeve" : box.blue)`, `var.green?"sleeve":module.box.blue`, false},
+		{`$([for s in vars.green : upper(s)])`, `[for s in var.green:upper(s)]`, false},
+		{`$([for s in box.green : s.name if s.on])`, `[for s in module.box.green:s.name if s.on]`, false},
+		{`$({for k, v in vars.green : k => v})`, `{for k,v in var.green:k=>v}`, false},
+		{`$([for green in vars.green : green])`, `[for green in var.green:green]`, false},
+		{"$(vars.green[*].sleeve)", "var.green[*].sleeve", false},
+		{"$(box.green.*.sleeve)", "module.box.green.*.sleeve", false},
+		{`x$(vars.green ? "a" : "b")`, `"x${var.green?"a":"b"}"`, false},
+
 		// Untranslatable expressions
 		{"$(vars)", "", true},
 		{"$(sleeve)", "", true},
@@ -235,6 +245,97 @@ func TestMergeFunctionCallExpression(t *testing.T) {
 	}
 }
 
+func TestPartialEval(t *testing.T) {
+	bp := Blueprint{Vars: NewDict(map[string]cty.Value{
+		"zone": cty.StringVal("us-central1-a"),
+	})}
+	val := cty.ObjectVal(map[string]cty.Value{
+		"zone":  GlobalRef("zone").AsValue(),
+		"image": ModuleRef("packer", "image_name").AsValue(),
+		"name":  MustParseExpression(`"${var.zone}-${module.packer.image_name}"`).AsValue(),
+	})
+
+	got, err := bp.PartialEval(val)
+	if err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	if diff := cmp.Diff(cty.StringVal("us-central1-a"), got.GetAttr("zone"), ctydebug.CmpOptions); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(cty.DynamicVal, got.GetAttr("image"), ctydebug.CmpOptions); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+	if name := got.GetAttr("name"); name.IsKnown() || name.Type() != cty.String {
+		t.Errorf("expected unknown string, got %#v", name)
+	}
+
+	if _, err := bp.Eval(val); err == nil {
+		t.Errorf("expected Eval to fail on reference to module output")
+	}
+}
+
+func TestEvalMemo(t *testing.T) {
+	bp := Blueprint{Vars: NewDict(map[string]cty.Value{"zone": cty.StringVal("us-central1-a")})}
+	vars, err := bp.evalVars()
+	if err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	bp.memo = newEvalMemo(vars)
+	expr := MustParseExpression(`"${var.zone}-x"`).AsValue()
+
+	for i := 0; i < 2; i++ {
+		got, err := bp.Eval(expr)
+		if err != nil {
+			t.Fatalf("got unexpected error: %s", err)
+		}
+		if diff := cmp.Diff(cty.StringVal("us-central1-a-x"), got, ctydebug.CmpOptions); diff != "" {
+			t.Errorf("diff (-want +got):\n%s", diff)
+		}
+	}
+	if len(bp.memo.full) != 1 || len(bp.memo.partial) != 0 {
+		t.Errorf("expected one memoized value, got %d and %d", len(bp.memo.full), len(bp.memo.partial))
+	}
+
+	// evaluated variables are copied, the memoized ones are never modified
+	vars, _ = bp.evalVars()
+	vars.Set("zone", cty.StringVal("europe-west1-b"))
+	if got, _ := bp.evalVars(); !got.Get("zone").RawEquals(cty.StringVal("us-central1-a")) {
+		t.Errorf("memoized variables were modified, got %#v", got.Get("zone"))
+	}
+}
+
+func BenchmarkEval(b *testing.B) {
+	vars := map[string]cty.Value{}
+	for i := 0; i < 50; i++ {
+		vars[fmt.Sprintf("v%d", i)] = cty.StringVal(fmt.Sprintf("value-%d", i))
+	}
+	// settings of many modules repeat the same expressions
+	settings := map[string]cty.Value{}
+	for i := 0; i < 500; i++ {
+		settings[fmt.Sprintf("s%d", i)] = MustParseExpression(
+			fmt.Sprintf(`join("-", [var.v%d, var.v%d])`, i%10, (i+1)%10)).AsValue()
+	}
+	val := cty.ObjectVal(settings)
+
+	for _, memoize := range []bool{false, true} {
+		b.Run(fmt.Sprintf("memoize=%t", memoize), func(b *testing.B) {
+			bp := Blueprint{Vars: NewDict(vars)}
+			if memoize {
+				ev, err := bp.evalVars()
+				if err != nil {
+					b.Fatal(err)
+				}
+				bp.memo = newEvalMemo(ev)
+			}
+			for i := 0; i < b.N; i++ {
+				if _, err := bp.Eval(val); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func TestReplaceTokens(t *testing.T) {
 	type test struct {
 		body string
@@ -270,3 +371,35 @@ func TestReplaceTokens(t *testing.T) {
 		})
 	}
 }
+
+func TestEvalConditionalAndForExpressions(t *testing.T) {
+	bp := Blueprint{Vars: NewDict(map[string]cty.Value{
+		"zones":  cty.TupleVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b")}),
+		"gpus":   cty.True,
+		"shapes": cty.TupleVal([]cty.Value{cty.ObjectVal(map[string]cty.Value{"name": cty.StringVal("c2")})}),
+	})}
+	tests := []struct {
+		input string
+		want  cty.Value
+	}{
+		{`$(vars.gpus ? "a2" : "c2")`, cty.StringVal("a2")},
+		{`$([for z in vars.zones : "us-central1-${z}" if z != "b"])`, cty.TupleVal([]cty.Value{cty.StringVal("us-central1-a")})},
+		{`$({for z in vars.zones : z => vars.gpus})`, cty.ObjectVal(map[string]cty.Value{"a": cty.True, "b": cty.True})},
+		{`$(vars.shapes[*].name)`, cty.TupleVal([]cty.Value{cty.StringVal("c2")})},
+	}
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			v, err := parseYamlString(tc.input)
+			if err != nil {
+				t.Fatalf("got unexpected error: %s", err)
+			}
+			got, err := bp.Eval(v)
+			if err != nil {
+				t.Fatalf("got unexpected error: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, got, ctydebug.CmpOptions); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
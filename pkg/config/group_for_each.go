@@ -0,0 +1,189 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// eachValuePlaceholder is substituted with the element of group_for_each in
+// names and IDs of the templated group
+const eachValuePlaceholder = "$(each.value)"
+
+// eachValueRef is the reference `$(each.value)` parses to in settings
+var eachValueRef = ModuleRef("each", "value")
+
+// expandGroupForEach replaces every group with group_for_each by a group per
+// element of the list, in place of the templated group
+func (bp *Blueprint) expandGroupForEach() error {
+	errs := Errors{}
+	groups := []DeploymentGroup{}
+	for ig, g := range bp.DeploymentGroups {
+		if g.ForEach == "" {
+			groups = append(groups, g)
+			continue
+		}
+		pg := Root.Groups.At(ig)
+		if err := bp.requireExperiment(pg.ForEach, ExperimentGroupForEach); err != nil {
+			errs.Add(err)
+			continue
+		}
+		elems, err := bp.evalGroupForEach(g.ForEach)
+		if err != nil {
+			errs.At(pg.ForEach, err)
+			continue
+		}
+		if !strings.Contains(string(g.Name), eachValuePlaceholder) {
+			errs.At(pg.Name, fmt.Errorf("name of group with group_for_each must contain %q", eachValuePlaceholder))
+			continue
+		}
+		for _, e := range elems {
+			ng, err := instantiateGroup(g, e)
+			if err != nil {
+				errs.At(pg, err)
+				break
+			}
+			groups = append(groups, ng)
+		}
+	}
+	if errs.Any() {
+		return errs
+	}
+	bp.DeploymentGroups = groups
+	return nil
+}
+
+// evalGroupForEach evaluates the group_for_each expression to a list of
+// strings, it may only refer to deployment variables
+func (bp *Blueprint) evalGroupForEach(s string) ([]string, error) {
+	v, err := parseYamlString(s)
+	if err != nil {
+		return nil, err
+	}
+	for r := range valueReferences(v) {
+		if !r.GlobalVar {
+			return nil, fmt.Errorf("group_for_each can only refer to deployment variables, got reference to module %q", r.Module)
+		}
+	}
+	ev, err := bp.Eval(v)
+	if err != nil {
+		return nil, err
+	}
+	ty := ev.Type()
+	if ev.IsNull() || !(ty.IsListType() || ty.IsTupleType() || ty.IsSetType()) {
+		return nil, fmt.Errorf("group_for_each must evaluate to a list of strings, got %s", ty.FriendlyName())
+	}
+	elems := []string{}
+	for it := ev.ElementIterator(); it.Next(); {
+		_, e := it.Element()
+		if e.IsNull() || e.Type() != cty.String {
+			return nil, fmt.Errorf("group_for_each must evaluate to a list of strings, got element of type %s", e.Type().FriendlyName())
+		}
+		elems = append(elems, e.AsString())
+	}
+	if len(elems) == 0 {
+		return nil, errors.New("group_for_each must not be empty")
+	}
+	return elems, nil
+}
+
+// instantiateGroup returns a copy of the templated group with $(each.value)
+// substituted by the element
+func instantiateGroup(g DeploymentGroup, elem string) (DeploymentGroup, error) {
+	sub := func(s string) string { return strings.ReplaceAll(s, eachValuePlaceholder, elem) }
+	ng := g
+	ng.ForEach = ""
+	ng.Name = GroupName(sub(string(g.Name)))
+
+	cfg, err := substituteEachValue(g.TerraformBackend.Configuration, elem)
+	if err != nil {
+		return DeploymentGroup{}, err
+	}
+	ng.TerraformBackend.Configuration = cfg
+
+	ng.Modules = make([]Module, len(g.Modules))
+	for im, m := range g.Modules {
+		nm := m
+		nm.ID = ModuleID(sub(string(m.ID)))
+		nm.Source = sub(m.Source)
+		nm.RenamedFrom = ModuleID(sub(string(m.RenamedFrom)))
+		nm.Use = make(ModuleIDs, len(m.Use))
+		for iu, u := range m.Use {
+			nm.Use[iu] = ModuleID(sub(string(u)))
+		}
+		if m.UseAliases != nil {
+			nm.UseAliases = map[ModuleID]ModuleID{}
+			for as, u := range m.UseAliases {
+				nm.UseAliases[as] = ModuleID(sub(string(u)))
+			}
+		}
+		nm.StartupScriptParts = make([]StartupScriptPart, len(m.StartupScriptParts))
+		for ip, p := range m.StartupScriptParts {
+			p.Module = ModuleID(sub(string(p.Module)))
+			p.Content = sub(p.Content)
+			nm.StartupScriptParts[ip] = p
+		}
+		if nm.Settings, err = substituteEachValue(m.Settings, elem); err != nil {
+			return DeploymentGroup{}, err
+		}
+		if nm.Import, err = substituteEachValue(m.Import, elem); err != nil {
+			return DeploymentGroup{}, err
+		}
+		ng.Modules[im] = nm
+	}
+	return ng, nil
+}
+
+// substituteEachValue returns a copy of the Dict with references to
+// $(each.value) replaced by the element
+func substituteEachValue(d Dict, elem string) (Dict, error) {
+	return substituteReference(d, eachValueRef, cty.StringVal(elem))
+}
+
+// substituteReference returns a copy of the Dict with the reference replaced
+// by the value, expressions left without any references are evaluated
+func substituteReference(d Dict, ref Reference, val cty.Value) (Dict, error) {
+	if d.IsZero() {
+		return Dict{}, nil
+	}
+	lit := MustParseExpression(string(hclwrite.TokensForValue(val).Bytes()))
+	v, err := cty.Transform(d.AsObject(), func(p cty.Path, v cty.Value) (cty.Value, error) {
+		e, is := IsExpressionValue(v)
+		if !is {
+			return v, nil
+		}
+		if _, ok := valueReferences(v)[ref]; !ok {
+			return v, nil
+		}
+		ne, err := ReplaceSubExpressions(e, ref.AsExpression(), lit)
+		if err != nil {
+			return cty.NilVal, err
+		}
+		if len(ne.References()) == 0 {
+			return ne.Eval(&hcl.EvalContext{Functions: functions()})
+		}
+		return ne.AsValue(), nil
+	})
+	if err != nil {
+		return Dict{}, err
+	}
+	return NewDict(v.AsValueMap()), nil
+}
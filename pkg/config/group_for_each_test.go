@@ -0,0 +1,98 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func forEachBlueprint(c *C, forEach string) Blueprint {
+	mustParse := func(s string) cty.Value {
+		v, err := parseYamlString(s)
+		c.Assert(err, IsNil)
+		return v
+	}
+	return Blueprint{
+		Experimental: []string{ExperimentGroupForEach},
+		Vars: NewDict(map[string]cty.Value{
+			"regions": cty.TupleVal([]cty.Value{cty.StringVal("us-east1"), cty.StringVal("europe-west4")}),
+			"zone":    cty.StringVal("us-central1-a")}),
+		DeploymentGroups: []DeploymentGroup{
+			{Name: "primary", Modules: []Module{{ID: "network", Source: "modules/net"}}},
+			{
+				Name:    "compute-$(each.value)",
+				ForEach: forEach,
+				TerraformBackend: TerraformBackend{Type: "gcs", Configuration: NewDict(map[string]cty.Value{
+					"prefix": mustParse("tf/$(each.value)")})},
+				Modules: []Module{
+					{ID: "net-$(each.value)", Source: "modules/net"},
+					{ID: "vm-$(each.value)", Source: "modules/vm", Use: ModuleIDs{"net-$(each.value)"},
+						Settings: NewDict(map[string]cty.Value{
+							"region": mustParse("$(each.value)"),
+							"zone":   mustParse("$(vars.zone)"),
+							"name":   mustParse("vm-$(each.value)-$(vars.zone)")})},
+				}},
+		}}
+}
+
+func (s *zeroSuite) TestExpandGroupForEach(c *C) {
+	{ // Success
+		bp := forEachBlueprint(c, "$(vars.regions)")
+		c.Assert(bp.expandGroupForEach(), IsNil)
+		c.Assert(bp.DeploymentGroups, HasLen, 3)
+		c.Check(bp.DeploymentGroups[0].Name, Equals, GroupName("primary"))
+
+		g := bp.DeploymentGroups[2]
+		c.Check(g.Name, Equals, GroupName("compute-europe-west4"))
+		c.Check(g.ForEach, Equals, "")
+		c.Check(g.TerraformBackend.Configuration.Get("prefix"), DeepEquals, cty.StringVal("tf/europe-west4"))
+		c.Check(g.Modules[0].ID, Equals, ModuleID("net-europe-west4"))
+
+		vm := g.Modules[1]
+		c.Check(vm.ID, Equals, ModuleID("vm-europe-west4"))
+		c.Check(vm.Use, DeepEquals, ModuleIDs{"net-europe-west4"})
+		c.Check(vm.Settings.Get("region"), DeepEquals, cty.StringVal("europe-west4"))
+		c.Check(vm.Settings.Get("zone"), DeepEquals, GlobalRef("zone").AsValue())
+		name, err := bp.Eval(vm.Settings.Get("name"))
+		c.Assert(err, IsNil)
+		c.Check(name, DeepEquals, cty.StringVal("vm-europe-west4-us-central1-a"))
+
+		// templated group is not modified
+		c.Check(bp.DeploymentGroups[1].Modules[1].Settings.Get("region"), DeepEquals, cty.StringVal("us-east1"))
+	}
+
+	{ // Fail: experimental feature not enabled
+		bp := forEachBlueprint(c, "$(vars.regions)")
+		bp.Experimental = nil
+		c.Check(bp.expandGroupForEach(), ErrorMatches, `(?s).*group_for_each is an experimental feature.*`)
+	}
+
+	{ // Fail: not a list of strings
+		bp := forEachBlueprint(c, "$(vars.zone)")
+		c.Check(bp.expandGroupForEach(), ErrorMatches, "(?s).*must evaluate to a list of strings.*")
+	}
+
+	{ // Fail: reference to module
+		bp := forEachBlueprint(c, "$(network.regions)")
+		c.Check(bp.expandGroupForEach(), ErrorMatches, "(?s).*can only refer to deployment variables.*")
+	}
+
+	{ // Fail: group name without placeholder
+		bp := forEachBlueprint(c, "$(vars.regions)")
+		bp.DeploymentGroups[1].Name = "compute"
+		c.Check(bp.expandGroupForEach(), ErrorMatches, `(?s).*must contain "\$\(each.value\)".*`)
+	}
+}
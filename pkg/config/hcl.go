@@ -0,0 +1,417 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+	"gopkg.in/yaml.v3"
+)
+
+// literalStringTag marks YAML strings that are taken as is, without looking
+// for blueprint expressions in them. Strings of HCL blueprints are literal,
+// expressions are written in plain HCL there.
+const literalStringTag = "!literal"
+
+// isHCLBlueprint tells whether the blueprint file is written in HCL
+func isHCLBlueprint(f string) bool {
+	return filepath.Ext(f) == ".hcl"
+}
+
+// parseHCLBlueprint parses a blueprint written in HCL. The file is translated
+// to the YAML document it is equivalent to, so both formats share the same
+// decoding and error positions point to the HCL file.
+// ```
+// blueprint_name = "hpc-small"
+// vars = { project_id = "my-project", deployment_name = "hpc-small" }
+//
+//	deployment_group "primary" {
+//	  module "network" { source = "modules/network/vpc" }
+//	  module "homefs" {
+//	    source   = "modules/file-system/filestore"
+//	    use      = [network]
+//	    settings = { name = "${var.deployment_name}-home" }
+//	  }
+//	}
+//
+// ```
+func parseHCLBlueprint(data []byte, f string) (Blueprint, YamlCtx, error) {
+	ctx := YamlCtx{map[yPath]Pos{}, splitLines(data)}
+
+	file, diags := hclsyntax.ParseConfig(data, f, hcl.InitialPos)
+	if diags.HasErrors() {
+		return Blueprint{}, ctx, diagsToErrors(diags)
+	}
+	conv := hclConverter{src: data}
+	n, err := conv.blueprint(file.Body.(*hclsyntax.Body))
+	if err != nil {
+		return Blueprint{}, ctx, err
+	}
+	ctx = newYamlCtx(n, ctx.Lines)
+
+	var bp Blueprint
+	if err := n.Decode(&bp); err != nil {
+		return Blueprint{}, ctx, parseYamlV3Error(err)
+	}
+	if err := checkKnownFields(n); err != nil {
+		return Blueprint{}, ctx, err
+	}
+	if err := bp.setUseAliases(n); err != nil {
+		return Blueprint{}, ctx, err
+	}
+	return bp, ctx, nil
+}
+
+// checkKnownFields reports attributes that do not belong to the blueprint,
+// decoding of yaml.Node can't be made strict, so the node is decoded again
+func checkKnownFields(n *yaml.Node) error {
+	out, err := yaml.Marshal(n)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(out))
+	decoder.KnownFields(true)
+	var bp Blueprint
+	if err := decoder.Decode(&bp); err != nil {
+		// positions refer to the intermediate YAML, drop them
+		errs := Errors{}
+		for _, e := range parseYamlV3Error(err).(Errors).Errors {
+			var pe PosError
+			if errors.As(e, &pe) {
+				e = pe.Err
+			}
+			errs.Add(e)
+		}
+		return errs
+	}
+	return nil
+}
+
+func diagsToErrors(diags hcl.Diagnostics) error {
+	errs := Errors{}
+	for _, d := range diags.Errs() {
+		diag, ok := d.(*hcl.Diagnostic)
+		if !ok || diag.Subject == nil {
+			errs.Add(d)
+			continue
+		}
+		msg := diag.Summary
+		if diag.Detail != "" {
+			msg = fmt.Sprintf("%s; %s", diag.Summary, diag.Detail)
+		}
+		errs.Add(PosError{rangePos(*diag.Subject), errors.New(msg)})
+	}
+	return errs.OrNil()
+}
+
+func rangePos(r hcl.Range) Pos {
+	return Pos{Line: r.Start.Line, Column: r.Start.Column}
+}
+
+func rangeError(r hcl.Range, f string, a ...any) error {
+	return PosError{rangePos(r), fmt.Errorf(f, a...)}
+}
+
+type hclConverter struct {
+	src []byte
+}
+
+type hclItem struct {
+	key  string
+	at   hcl.Range
+	node *yaml.Node
+}
+
+func scalarNode(tag string, v string, r hcl.Range) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: v, Line: r.Start.Line, Column: r.Start.Column}
+}
+
+func mappingNode(items []hclItem, r hcl.Range) *yaml.Node {
+	n := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: r.Start.Line, Column: r.Start.Column}
+	for _, it := range items {
+		n.Content = append(n.Content, scalarNode("!!str", it.key, it.at), it.node)
+	}
+	return n
+}
+
+func sequenceNode(items []*yaml.Node, r hcl.Range) *yaml.Node {
+	return &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: items, Line: r.Start.Line, Column: r.Start.Column}
+}
+
+// sortedAttributes returns attributes in order of appearance
+func sortedAttributes(b *hclsyntax.Body) []*hclsyntax.Attribute {
+	attrs := []*hclsyntax.Attribute{}
+	for _, a := range b.Attributes {
+		attrs = append(attrs, a)
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		return attrs[i].SrcRange.Start.Byte < attrs[j].SrcRange.Start.Byte
+	})
+	return attrs
+}
+
+func (c hclConverter) blueprint(b *hclsyntax.Body) (*yaml.Node, error) {
+	items := []hclItem{}
+	for _, a := range sortedAttributes(b) {
+		if a.Name == "deployment_groups" {
+			return nil, rangeError(a.NameRange, `groups are defined with "deployment_group" blocks`)
+		}
+		v, err := c.value(a.Expr)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, hclItem{a.Name, a.NameRange, v})
+	}
+
+	groups := []*yaml.Node{}
+	var groupsAt hcl.Range
+	for _, blk := range b.Blocks {
+		if blk.Type != "deployment_group" {
+			return nil, rangeError(blk.TypeRange, "unexpected block %q, only \"deployment_group\" blocks are allowed at the top level", blk.Type)
+		}
+		if len(groups) == 0 {
+			groupsAt = blk.TypeRange
+		}
+		g, err := c.group(blk)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	items = append(items, hclItem{"deployment_groups", groupsAt, sequenceNode(groups, groupsAt)})
+	return mappingNode(items, b.SrcRange), nil
+}
+
+func (c hclConverter) group(blk *hclsyntax.Block) (*yaml.Node, error) {
+	if len(blk.Labels) != 1 {
+		return nil, rangeError(blk.TypeRange, "deployment_group block must have exactly one label, the name of the group")
+	}
+	items := []hclItem{{"group", blk.TypeRange, scalarNode("!!str", blk.Labels[0], blk.LabelRanges[0])}}
+	for _, a := range sortedAttributes(blk.Body) {
+		var v *yaml.Node
+		var err error
+		if a.Name == "group_for_each" { // always an expression, even if made of literals
+			v, err = c.expression(a.Expr)
+		} else {
+			v, err = c.value(a.Expr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, hclItem{a.Name, a.NameRange, v})
+	}
+
+	mods := []*yaml.Node{}
+	var modsAt hcl.Range
+	for _, mb := range blk.Body.Blocks {
+		if mb.Type != "module" {
+			return nil, rangeError(mb.TypeRange, "unexpected block %q, only \"module\" blocks are allowed in a deployment_group", mb.Type)
+		}
+		if len(mods) == 0 {
+			modsAt = mb.TypeRange
+		}
+		m, err := c.module(mb)
+		if err != nil {
+			return nil, err
+		}
+		mods = append(mods, m)
+	}
+	items = append(items, hclItem{"modules", modsAt, sequenceNode(mods, modsAt)})
+	return mappingNode(items, blk.TypeRange), nil
+}
+
+func (c hclConverter) module(blk *hclsyntax.Block) (*yaml.Node, error) {
+	if len(blk.Labels) != 1 {
+		return nil, rangeError(blk.TypeRange, "module block must have exactly one label, the id of the module")
+	}
+	items := []hclItem{{"id", blk.TypeRange, scalarNode("!!str", blk.Labels[0], blk.LabelRanges[0])}}
+	for _, a := range sortedAttributes(blk.Body) {
+		var v *yaml.Node
+		var err error
+		if a.Name == "use" {
+			v, err = c.use(a.Expr)
+		} else {
+			v, err = c.value(a.Expr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, hclItem{a.Name, a.NameRange, v})
+	}
+	if len(blk.Body.Blocks) > 0 {
+		b := blk.Body.Blocks[0]
+		return nil, rangeError(b.TypeRange, "unexpected block %q in module, settings are set with `settings = {...}`", b.Type)
+	}
+	return mappingNode(items, blk.TypeRange), nil
+}
+
+// use accepts module ids either as bare names, `[network]`, or as strings,
+// and aliased modules as objects, `[{ id = "net1", as = "primary" }]`
+func (c hclConverter) use(e hclsyntax.Expression) (*yaml.Node, error) {
+	exprs, diags := hcl.ExprList(e)
+	if diags.HasErrors() {
+		return nil, diagsToErrors(diags)
+	}
+	ids := []*yaml.Node{}
+	for _, ie := range exprs {
+		if oe, ok := ie.(*hclsyntax.ObjectConsExpr); ok {
+			v, err := c.value(oe)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, v)
+			continue
+		}
+		if t, diags := hcl.AbsTraversalForExpr(ie); !diags.HasErrors() && len(t) == 1 {
+			ids = append(ids, scalarNode("!!str", t.RootName(), ie.Range()))
+			continue
+		}
+		v, diags := ie.Value(nil)
+		if diags.HasErrors() || v.Type() != cty.String || v.IsNull() {
+			return nil, rangeError(ie.Range(), "`use` must be a list of module ids")
+		}
+		ids = append(ids, scalarNode("!!str", v.AsString(), ie.Range()))
+	}
+	return sequenceNode(ids, e.Range()), nil
+}
+
+// value translates an expression made of literals to the equivalent YAML,
+// other expressions are kept as HCL literals, `((...))`
+func (c hclConverter) value(e hclsyntax.Expression) (*yaml.Node, error) {
+	switch te := e.(type) {
+	case *hclsyntax.ObjectConsExpr:
+		return c.object(te)
+	case *hclsyntax.TupleConsExpr:
+		elems := []*yaml.Node{}
+		for _, ee := range te.Exprs {
+			v, err := c.value(ee)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, v)
+		}
+		return sequenceNode(elems, e.Range()), nil
+	}
+
+	if len(e.Variables()) == 0 {
+		v, diags := e.Value(&hcl.EvalContext{Functions: functions()})
+		if !diags.HasErrors() && v.IsWhollyKnown() {
+			if n, ok := ctyNode(v, e.Range()); ok {
+				return n, nil
+			}
+		}
+	}
+	return c.expression(e)
+}
+
+// object translates an object made of literals to a YAML mapping, objects
+// with computed keys are kept as HCL literals
+func (c hclConverter) object(e *hclsyntax.ObjectConsExpr) (*yaml.Node, error) {
+	items := []hclItem{}
+	for _, it := range e.Items {
+		key, diags := it.KeyExpr.Value(nil)
+		if diags.HasErrors() || key.Type() != cty.String || key.IsNull() {
+			return c.expression(e) // e.g. computed keys
+		}
+		v, err := c.value(it.ValueExpr)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, hclItem{key.AsString(), it.KeyExpr.Range(), v})
+	}
+	return mappingNode(items, e.Range()), nil
+}
+
+// expression keeps the expression as a HCL literal, references to
+// `each.value` are translated to the form group_for_each substitutes
+func (c hclConverter) expression(e hclsyntax.Expression) (*yaml.Node, error) {
+	src := string(e.Range().SliceBytes(c.src))
+	toks, err := parseHcl(src)
+	if err != nil {
+		return nil, rangeError(e.Range(), "%v", err)
+	}
+	for _, t := range e.Variables() {
+		if t.RootName() == "each" {
+			ft := append(hcl.Traversal{hcl.TraverseRoot{Name: "module"}, hcl.TraverseAttr{Name: "each"}}, t[1:]...)
+			toks = replaceTokens(toks, hclwrite.TokensForTraversal(t), hclwrite.TokensForTraversal(ft))
+		}
+	}
+	return scalarNode("!!str", fmt.Sprintf("((%s))", toks.Bytes()), e.Range()), nil
+}
+
+// ctyNode translates a known value to YAML, strings are tagged as literal
+func ctyNode(v cty.Value, r hcl.Range) (*yaml.Node, bool) {
+	ty := v.Type()
+	switch {
+	case v.IsNull():
+		return scalarNode("!!null", "null", r), true
+	case ty == cty.String:
+		return scalarNode(literalStringTag, v.AsString(), r), true
+	case ty == cty.Bool:
+		return scalarNode("!!bool", fmt.Sprintf("%t", v.True()), r), true
+	case ty == cty.Number:
+		bf := v.AsBigFloat()
+		if bf.IsInt() {
+			return scalarNode("!!int", bf.Text('f', -1), r), true
+		}
+		return scalarNode("!!float", bf.Text('g', -1), r), true
+	case ty.IsObjectType() || ty.IsMapType():
+		return ctyMapping(v, r)
+	case ty.IsTupleType() || ty.IsListType() || ty.IsSetType():
+		return ctySequence(v, r)
+	default:
+		return nil, false
+	}
+}
+
+// ctyMapping translates a known object or map to a YAML mapping, sorted by key
+func ctyMapping(v cty.Value, r hcl.Range) (*yaml.Node, bool) {
+	items := []hclItem{}
+	m := v.AsValueMap()
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		n, ok := ctyNode(m[k], r)
+		if !ok {
+			return nil, false
+		}
+		items = append(items, hclItem{k, r, n})
+	}
+	return mappingNode(items, r), true
+}
+
+// ctySequence translates a known tuple, list or set to a YAML sequence
+func ctySequence(v cty.Value, r hcl.Range) (*yaml.Node, bool) {
+	elems := []*yaml.Node{}
+	for _, ev := range v.AsValueSlice() {
+		n, ok := ctyNode(ev, r)
+		if !ok {
+			return nil, false
+		}
+		elems = append(elems, n)
+	}
+	return sequenceNode(elems, r), true
+}
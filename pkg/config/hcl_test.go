@@ -0,0 +1,154 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func writeHCLBlueprint(c *C, src string) string {
+	f := filepath.Join(c.MkDir(), "blueprint.hcl")
+	c.Assert(os.WriteFile(f, []byte(strings.TrimLeft(src, "\n")), 0644), IsNil)
+	return f
+}
+
+func exprString(c *C, v cty.Value) string {
+	e, ok := IsExpressionValue(v)
+	c.Assert(ok, Equals, true, Commentf("%#v is not an expression", v))
+	return string(e.Tokenize().Bytes())
+}
+
+func (s *zeroSuite) TestImportHCLBlueprint(c *C) {
+	f := writeHCLBlueprint(c, `
+blueprint_name = "lime"
+vars = {
+  deployment_name = "green"
+  zones           = ["a", "b"]
+  size            = 3
+}
+
+deployment_group "primary" {
+  module "net" {
+    source = "modules/network/vpc"
+  }
+  module "fs" {
+    source = "modules/file-system/filestore"
+    use    = [net, "other"]
+    settings = {
+      name   = "${var.deployment_name}-fs"
+      script = "echo $(date)"
+      tiers  = { hot = var.size, cold = 1.5 }
+    }
+  }
+}
+
+deployment_group "zone-$(each.value)" {
+  group_for_each = var.zones
+  module "vm-$(each.value)" {
+    source   = "modules/compute/vm-instance"
+    settings = { zone = each.value }
+  }
+}
+`)
+	bp, ctx, err := importBlueprint(f)
+	c.Assert(err, IsNil)
+
+	c.Check(bp.BlueprintName, Equals, "lime")
+	c.Check(bp.Vars.Items(), DeepEquals, map[string]cty.Value{
+		"deployment_name": cty.StringVal("green"),
+		"zones":           cty.TupleVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b")}),
+		"size":            cty.NumberIntVal(3),
+	})
+	c.Assert(bp.DeploymentGroups, HasLen, 2)
+
+	g := bp.DeploymentGroups[0]
+	c.Check(g.Name, Equals, GroupName("primary"))
+	c.Assert(g.Modules, HasLen, 2)
+	fs := g.Modules[1]
+	c.Check(fs.ID, Equals, ModuleID("fs"))
+	c.Check(fs.Source, Equals, "modules/file-system/filestore")
+	c.Check(fs.Use, DeepEquals, ModuleIDs{"net", "other"})
+	c.Check(exprString(c, fs.Settings.Get("name")), Equals, `"${var.deployment_name}-fs"`)
+	c.Check(fs.Settings.Get("script"), DeepEquals, cty.StringVal("echo $(date)")) // HCL strings are literal
+	tiers := fs.Settings.Get("tiers")
+	c.Check(exprString(c, tiers.GetAttr("hot")), Equals, "var.size")
+	c.Check(tiers.GetAttr("cold"), DeepEquals, cty.NumberFloatVal(1.5))
+
+	tg := bp.DeploymentGroups[1]
+	c.Check(tg.Name, Equals, GroupName("zone-$(each.value)"))
+	c.Check(tg.ForEach, Equals, "((var.zones))")
+	c.Check(tg.Modules[0].ID, Equals, ModuleID("vm-$(each.value)"))
+	c.Check(exprString(c, tg.Modules[0].Settings.Get("zone")), Equals, "module.each.value")
+
+	pos, ok := ctx.Pos(Root.Groups.At(0).Modules.At(1).Settings.Dot("script"))
+	c.Check(ok, Equals, true)
+	c.Check(pos, DeepEquals, Pos{Line: 17, Column: 7})
+	c.Check(ctx.Lines[16], Equals, `      script = "echo $(date)"`)
+}
+
+func (s *zeroSuite) TestImportHCLBlueprintErrors(c *C) {
+	{ // unknown module attribute
+		f := writeHCLBlueprint(c, `
+blueprint_name = "lime"
+deployment_group "primary" {
+  module "net" {
+    source  = "modules/network/vpc"
+    sttings = {}
+  }
+}`)
+		_, _, err := importBlueprint(f)
+		c.Check(err, ErrorMatches, "(?s).*field sttings not found in type config.Module.*")
+	}
+
+	{ // unexpected block, with position
+		f := writeHCLBlueprint(c, `
+blueprint_name = "lime"
+module "net" {
+  source = "modules/network/vpc"
+}`)
+		_, _, err := importBlueprint(f)
+		c.Check(err, ErrorMatches, `.*unexpected block "module".*`)
+		c.Check(err, FitsTypeOf, PosError{})
+		c.Check(err.(PosError).Pos, DeepEquals, Pos{Line: 2, Column: 1})
+	}
+
+	{ // syntax error
+		f := writeHCLBlueprint(c, `blueprint_name = `)
+		_, _, err := importBlueprint(f)
+		c.Check(err, NotNil)
+	}
+}
+
+func (s *zeroSuite) TestImportHCLBlueprintUseAlias(c *C) {
+	f := writeHCLBlueprint(c, `
+blueprint_name = "lime"
+deployment_group "primary" {
+  module "vm" {
+    source = "modules/compute/vm-instance"
+    use    = [net0, { id = "net1", as = "primary" }]
+  }
+}
+`)
+	bp, _, err := importBlueprint(f)
+	c.Assert(err, IsNil)
+	vm := bp.DeploymentGroups[0].Modules[0]
+	c.Check(vm.Use, DeepEquals, ModuleIDs{"net0", "net1"})
+	c.Check(vm.UseAliases, DeepEquals, map[ModuleID]ModuleID{"primary": "net1"})
+}
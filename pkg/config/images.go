@@ -0,0 +1,177 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// imagesModuleID is the root of references to images of the blueprint,
+// `$(images.compute)` parses to a reference to output "compute" of module
+// "images"
+const imagesModuleID ModuleID = "images"
+
+// Image is a VM image modules of the blueprint refer to by name, either an
+// existing image, or the image family built by a Packer module
+type Image struct {
+	Family  string `yaml:"family,omitempty"`
+	Name    string `yaml:"name,omitempty"`
+	Project string `yaml:"project,omitempty"`
+	// BuiltBy is the Packer module building the image family
+	BuiltBy ModuleID `yaml:"built_by,omitempty"`
+}
+
+// IsImage tells whether the reference is to an image of the blueprint
+func (bp Blueprint) IsImage(r Reference) bool {
+	return len(bp.Images) > 0 && !r.GlobalVar && r.Module == imagesModuleID
+}
+
+// evalString evaluates the setting of the module to a string, it returns an
+// empty string if it is not set or not a string
+func (bp Blueprint) evalString(m Module, setting string) string {
+	if !m.Settings.Has(setting) {
+		return ""
+	}
+	v, err := bp.Eval(m.Settings.Get(setting))
+	if err != nil || v.IsNull() || v.Type() != cty.String {
+		return ""
+	}
+	return v.AsString()
+}
+
+// resolveImage fills in the family and project of images built by Packer
+// modules, from settings of the module, and the project of other images, from
+// deployment variable project_id
+func (bp Blueprint) resolveImage(p imagePath, img Image) (Image, error) {
+	if img.BuiltBy != "" {
+		m, err := bp.Module(img.BuiltBy)
+		if err != nil {
+			return Image{}, BpError{p.BuiltBy, err}
+		}
+		if m.Kind != PackerKind {
+			return Image{}, BpError{p.BuiltBy, fmt.Errorf("image can only be built by a Packer module, module %q is not one", m.ID)}
+		}
+		if img.Name != "" {
+			return Image{}, BpError{p.Name, errors.New("images built by Packer modules are referred to by family, name must not be set")}
+		}
+		family := bp.evalString(*m, "image_family")
+		if family == "" {
+			family = bp.evalString(Module{Settings: bp.Vars}, "deployment_name") // default of custom-image
+		}
+		switch {
+		case img.Family == "":
+			img.Family = family
+		case family != "" && img.Family != family:
+			return Image{}, BpError{p.Family, fmt.Errorf("module %q builds image family %q, not %q", m.ID, family, img.Family)}
+		}
+		if img.Project == "" {
+			img.Project = bp.evalString(*m, "project_id")
+		}
+	}
+	if (img.Family == "") == (img.Name == "") {
+		return Image{}, BpError{p, errors.New("exactly one of family and name must be set")}
+	}
+	if img.Project == "" {
+		img.Project = bp.evalString(Module{Settings: bp.Vars}, "project_id")
+	}
+	if img.Project == "" {
+		return Image{}, BpError{p.Project, errors.New("project must be set, as deployment variable project_id is not")}
+	}
+	return img, nil
+}
+
+// AsValue returns the image as set to instance_image settings of modules
+func (img Image) AsValue() cty.Value {
+	m := map[string]cty.Value{"project": cty.StringVal(img.Project)}
+	if img.Family != "" {
+		m["family"] = cty.StringVal(img.Family)
+	} else {
+		m["name"] = cty.StringVal(img.Name)
+	}
+	return cty.ObjectVal(m)
+}
+
+// checkImageRef ensures that the image referred to by a module setting is
+// defined and, if built by a Packer module, is built before the module is
+// deployed; Packer modules of a group are built before its terraform modules
+func (bp Blueprint) checkImageRef(mod Module, r Reference) error {
+	img, ok := bp.Images[r.Name]
+	if !ok {
+		return hintSpelling(r.Name, maps.Keys(bp.Images), fmt.Errorf("module %q refers to unknown image %q", mod.ID, r.Name))
+	}
+	if img.BuiltBy == "" {
+		return nil
+	}
+	bg, err := bp.ModuleGroup(img.BuiltBy)
+	if err != nil {
+		return nil // reported with the image
+	}
+	mg := bp.ModuleGroupOrDie(mod.ID)
+	bi, mi := bp.GroupIndex(bg.Name), bp.GroupIndex(mg.Name)
+	if bi > mi || (bi == mi && mod.Kind == PackerKind) {
+		return fmt.Errorf("module %q refers to image %q, which is built by module %q of a later deployment group", mod.ID, r.Name, img.BuiltBy)
+	}
+	return nil
+}
+
+// expandImages fills in images of the blueprint, and replaces references to
+// them in module settings by their family or name, and project
+func (bp *Blueprint) expandImages() error {
+	if len(bp.Images) == 0 {
+		return nil
+	}
+	if _, err := bp.Module(imagesModuleID); err == nil {
+		return BpError{Root.Images, fmt.Errorf("module id %q is reserved for references to images of the blueprint", imagesModuleID)}
+	}
+
+	names := maps.Keys(bp.Images)
+	slices.Sort(names)
+	errs := Errors{}
+	for _, n := range names {
+		img, err := bp.resolveImage(Root.Images.Dot(n), bp.Images[n])
+		if err != nil {
+			errs.Add(err)
+			continue
+		}
+		bp.Images[n] = img
+	}
+	if errs.Any() {
+		return errs
+	}
+
+	bp.WalkModulesSafe(func(p ModulePath, m *Module) {
+		for r := range valueReferences(m.Settings.AsObject()) {
+			if !bp.IsImage(r) {
+				continue
+			}
+			if err := bp.checkImageRef(*m, r); err != nil {
+				errs.At(p.Settings, err)
+				continue
+			}
+			s, err := substituteReference(m.Settings, r, bp.Images[r.Name].AsValue())
+			if err != nil {
+				errs.At(p.Settings, err)
+				continue
+			}
+			m.Settings = s
+		}
+	})
+	return errs.OrNil()
+}
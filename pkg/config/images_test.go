@@ -0,0 +1,104 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestExpandImages(c *C) {
+	imageRef := func(n string) cty.Value {
+		return ModuleRef(imagesModuleID, n).AsValue()
+	}
+	vars := NewDict(map[string]cty.Value{
+		"project_id":      cty.StringVal("p"),
+		"deployment_name": cty.StringVal("dep"),
+	})
+	bp := func(images map[string]Image, groups ...DeploymentGroup) Blueprint {
+		return Blueprint{Vars: vars, Images: images, DeploymentGroups: groups}
+	}
+	packer := Module{ID: "img", Kind: PackerKind, Settings: NewDict(map[string]cty.Value{
+		"image_family": cty.StringVal("custom")})}
+	vm := func(id ModuleID, setting cty.Value) Module {
+		return Module{ID: id, Kind: TerraformKind, Settings: NewDict(map[string]cty.Value{"instance_image": setting})}
+	}
+
+	{ // existing and built images, references are replaced
+		b := bp(map[string]Image{
+			"rocky":  {Family: "hpc-rocky-linux-8", Project: "cloud-hpc-image-public"},
+			"custom": {BuiltBy: "img"},
+		},
+			DeploymentGroup{Name: "build", Modules: []Module{packer}},
+			DeploymentGroup{Name: "cluster", Modules: []Module{
+				vm("a", imageRef("rocky")),
+				vm("b", imageRef("custom")),
+				vm("c", MustParseExpression(`"${module.images.custom.family}-x"`).AsValue()),
+			}})
+		c.Assert(b.expandImages(), IsNil)
+		c.Check(b.Images["custom"], DeepEquals, Image{Family: "custom", Project: "p", BuiltBy: "img"})
+		ms := b.DeploymentGroups[1].Modules
+		c.Check(ms[0].Settings.Get("instance_image"), DeepEquals, cty.ObjectVal(map[string]cty.Value{
+			"family": cty.StringVal("hpc-rocky-linux-8"), "project": cty.StringVal("cloud-hpc-image-public")}))
+		c.Check(ms[1].Settings.Get("instance_image"), DeepEquals, cty.ObjectVal(map[string]cty.Value{
+			"family": cty.StringVal("custom"), "project": cty.StringVal("p")}))
+		c.Check(ms[2].Settings.Get("instance_image"), DeepEquals, cty.StringVal("custom-x"))
+	}
+
+	{ // family defaults to the deployment name, project to project_id
+		b := bp(map[string]Image{"custom": {BuiltBy: "img"}},
+			DeploymentGroup{Name: "build", Modules: []Module{{ID: "img", Kind: PackerKind}}})
+		c.Assert(b.expandImages(), IsNil)
+		c.Check(b.Images["custom"], DeepEquals, Image{Family: "dep", Project: "p", BuiltBy: "img"})
+	}
+
+	{ // unknown image
+		b := bp(map[string]Image{"rocky": {Family: "hpc-rocky-linux-8"}},
+			DeploymentGroup{Name: "g", Modules: []Module{vm("a", imageRef("rocki"))}})
+		c.Check(b.expandImages(), ErrorMatches, `(?s).*unknown image "rocki".*`)
+	}
+
+	{ // image built by a later group, or by the same group for a Packer module
+		b := bp(map[string]Image{"custom": {BuiltBy: "img"}},
+			DeploymentGroup{Name: "cluster", Modules: []Module{vm("a", imageRef("custom"))}},
+			DeploymentGroup{Name: "build", Modules: []Module{packer}})
+		c.Check(b.expandImages(), ErrorMatches, `(?s).*built by module "img" of a later deployment group.*`)
+
+		p := Module{ID: "img2", Kind: PackerKind, Settings: NewDict(map[string]cty.Value{"source_image": imageRef("custom")})}
+		b = bp(map[string]Image{"custom": {BuiltBy: "img"}},
+			DeploymentGroup{Name: "build", Modules: []Module{packer, p}})
+		c.Check(b.expandImages(), ErrorMatches, `(?s).*built by module "img" of a later deployment group.*`)
+	}
+
+	{ // invalid images
+		b := bp(map[string]Image{
+			"both":     {Family: "f", Name: "n"},
+			"none":     {Project: "q"},
+			"terra":    {BuiltBy: "a"},
+			"mismatch": {BuiltBy: "img", Family: "other"},
+		},
+			DeploymentGroup{Name: "g", Modules: []Module{packer, vm("a", cty.NullVal(cty.String))}})
+		c.Check(b.expandImages(), ErrorMatches, `(?s).*exactly one of family and name.*`+
+			`builds image family "custom", not "other".*`+
+			`exactly one of family and name.*`+
+			`module "a" is not one.*`)
+	}
+
+	{ // reserved module id
+		b := bp(map[string]Image{"rocky": {Family: "f"}},
+			DeploymentGroup{Name: "g", Modules: []Module{{ID: "images"}}})
+		c.Check(b.expandImages(), ErrorMatches, `.*module id "images" is reserved.*`)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"sort"
+
+	"github.com/hashicorp/hcl/v2/ext/typeexpr"
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/slices"
+)
+
+// Input describes a deployment variable consumed by the blueprint
+type Input struct {
+	Name        string
+	Type        string
+	Default     cty.Value // NilVal if the variable has no value in the blueprint
+	Description string
+	Secret      bool
+	Modules     []ModuleID // modules referring to the variable
+}
+
+// BlueprintInputs reads and expands the blueprint and returns deployment
+// variables it consumes, sorted by name. Declared variables are always
+// included, others only if they are used.
+func BlueprintInputs(path string) ([]Input, YamlCtx, error) {
+	bp, ctx, err := NewBlueprint(path)
+	if err != nil {
+		return nil, ctx, err
+	}
+	vars := NewDict(bp.Vars.Items()) // clone, before placeholders are set
+	// variables without value are set at create time, expand with unknown values
+	for n, v := range bp.Vars.Items() {
+		if v.IsNull() {
+			bp.Vars.Set(n, cty.DynamicVal)
+		}
+	}
+	for _, n := range bp.SecretVars() {
+		if !bp.Vars.Has(n) {
+			bp.Vars.Set(n, cty.DynamicVal)
+		}
+	}
+	if err := bp.Expand(); err != nil {
+		return nil, ctx, err
+	}
+	return bp.inputs(vars), ctx, nil
+}
+
+// inputs lists variables of the expanded blueprint, vars holds variables as
+// given in the blueprint
+func (bp Blueprint) inputs(vars Dict) []Input {
+	unused := bp.ListUnusedVariables()
+	names := []string{}
+	for n := range vars.Items() {
+		if !slices.Contains(unused, n) {
+			names = append(names, n)
+		}
+	}
+	for n := range bp.VarDeclarations {
+		if !slices.Contains(names, n) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	users := map[string][]ModuleID{}
+	bp.WalkModulesSafe(func(_ ModulePath, m *Module) {
+		used := GetUsedDeploymentVars(m.Settings.AsObject())
+		if src := m.sourceExpr; src != cty.NilVal {
+			used = append(used, GetUsedDeploymentVars(src)...)
+		}
+		for _, n := range used {
+			if !slices.Contains(users[n], m.ID) {
+				users[n] = append(users[n], m.ID)
+			}
+		}
+	})
+
+	res := []Input{}
+	for _, n := range names {
+		decl := bp.VarDeclarations[n]
+		in := Input{
+			Name:        n,
+			Type:        "any",
+			Default:     cty.NilVal,
+			Description: decl.Description,
+			Secret:      decl.Type == SecretVarType,
+			Modules:     users[n],
+		}
+		if v := vars.Get(n); vars.Has(n) && !v.IsNull() && !in.Secret {
+			in.Default = v
+			if _, is := IsExpressionValue(v); !is {
+				in.Type = typeexpr.TypeString(v.Type())
+			}
+		}
+		res = append(res, in)
+	}
+	return res
+}
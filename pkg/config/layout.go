@@ -0,0 +1,58 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+)
+
+// DefaultGhpcDirName is the name of the toolkit directory within deployment
+// directory, unless configured otherwise in the blueprint
+const DefaultGhpcDirName = ".ghpc"
+
+// DeploymentLayout controls how deployment groups and toolkit files are
+// organized within the deployment directory
+type DeploymentLayout struct {
+	// Flat writes the only deployment group directly into deployment directory
+	Flat bool `yaml:"flat,omitempty"`
+	// GroupPrefix is prepended to the names of deployment group directories
+	GroupPrefix string `yaml:"group_prefix,omitempty"`
+	// NumberGroups prepends position of the group to its directory name, e.g. "01-primary"
+	NumberGroups bool `yaml:"number_groups,omitempty"`
+	// GhpcDir is the name of the toolkit directory, ".ghpc" if unset
+	GhpcDir string `yaml:"ghpc_dir,omitempty"`
+}
+
+// GhpcDirName returns the name of the toolkit directory
+func (l DeploymentLayout) GhpcDirName() string {
+	if l.GhpcDir == "" {
+		return DefaultGhpcDirName
+	}
+	return l.GhpcDir
+}
+
+// GroupDirName returns the path of the deployment group directory relative to
+// deployment directory, it is empty for flat layout
+func (bp Blueprint) GroupDirName(n GroupName) string {
+	l := bp.DeploymentLayout
+	if l.Flat {
+		return ""
+	}
+	name := l.GroupPrefix + string(n)
+	if l.NumberGroups {
+		name = fmt.Sprintf("%02d-%s", bp.GroupIndex(n)+1, name)
+	}
+	return name
+}
@@ -0,0 +1,212 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	storage "google.golang.org/api/storage/v1"
+)
+
+// LocationKind tells where a blueprint is read from
+type LocationKind int
+
+const (
+	// LocalFile is a blueprint file
+	LocalFile LocationKind = iota
+	// Stdin is a blueprint piped to ghpc, given as "-"
+	Stdin
+	// HTTPS is a blueprint served at an https:// URL
+	HTTPS
+	// GCS is a blueprint stored in Cloud Storage at gs://BUCKET/OBJECT
+	GCS
+)
+
+// BlueprintLocation is where a blueprint is read from, with the digest its
+// content must match, if any. A digest is given by appending
+// "#sha256=HEX" to the location.
+type BlueprintLocation struct {
+	Kind LocationKind
+	// Path is the file path or URL, without the digest
+	Path string
+	// SHA256 is the expected hex digest of the blueprint, empty if not given
+	SHA256 string
+}
+
+var sha256Regex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ParseBlueprintLocation parses a blueprint location given on the command line
+func ParseBlueprintLocation(s string) (BlueprintLocation, error) {
+	l := BlueprintLocation{Path: s}
+	if p, frag, ok := strings.Cut(s, "#sha256="); ok {
+		l.Path, l.SHA256 = p, strings.ToLower(frag)
+		if !sha256Regex.MatchString(l.SHA256) {
+			return BlueprintLocation{}, fmt.Errorf("digest of blueprint %s must be 64 hexadecimal digits, got %q", p, frag)
+		}
+	}
+	switch {
+	case l.Path == "-":
+		l.Kind = Stdin
+	case strings.HasPrefix(l.Path, "https://"):
+		l.Kind = HTTPS
+	case strings.HasPrefix(l.Path, "http://"):
+		return BlueprintLocation{}, fmt.Errorf("blueprint %s must be served over https://", l.Path)
+	case strings.HasPrefix(l.Path, "gs://"):
+		l.Kind = GCS
+		if b, o, ok := strings.Cut(strings.TrimPrefix(l.Path, "gs://"), "/"); !ok || b == "" || o == "" {
+			return BlueprintLocation{}, fmt.Errorf("blueprint location must be in form gs://BUCKET/OBJECT, got %q", l.Path)
+		}
+	default:
+		l.Kind = LocalFile
+	}
+	return l, nil
+}
+
+// Remote is true for blueprints not read from a local file
+func (l BlueprintLocation) Remote() bool {
+	return l.Kind != LocalFile
+}
+
+func (l BlueprintLocation) String() string {
+	if l.Kind == Stdin {
+		return "standard input"
+	}
+	return l.Path
+}
+
+// name is the file name the format of the blueprint is told from, blueprints
+// piped to ghpc are YAML
+func (l BlueprintLocation) name() string {
+	switch l.Kind {
+	case HTTPS:
+		if u, err := url.Parse(l.Path); err == nil {
+			return path.Base(u.Path)
+		}
+	case GCS:
+		return path.Base(l.Path)
+	case Stdin:
+		return "stdin.yaml"
+	}
+	return l.Path
+}
+
+// stdin is read by blueprints given as "-", it is replaced in tests
+var stdin io.Reader = os.Stdin
+
+func (l BlueprintLocation) read(ctx context.Context) ([]byte, error) {
+	switch l.Kind {
+	case Stdin:
+		return io.ReadAll(stdin)
+	case HTTPS:
+		return readHTTPS(ctx, l.Path)
+	case GCS:
+		return readGCSObject(ctx, l.Path)
+	default:
+		return os.ReadFile(l.Path)
+	}
+}
+
+// httpsClient downloads blueprints given by URL, it is replaced in tests
+var httpsClient = http.DefaultClient
+
+func readHTTPS(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpsClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// readGCSObject downloads the object at gs://BUCKET/OBJECT
+func readGCSObject(ctx context.Context, u string) ([]byte, error) {
+	bucket, object, ok := strings.Cut(strings.TrimPrefix(u, "gs://"), "/")
+	if !strings.HasPrefix(u, "gs://") || !ok || object == "" {
+		return nil, fmt.Errorf("url must be in form gs://BUCKET/OBJECT, got %q", u)
+	}
+	svc, err := storage.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := svc.Objects.Get(bucket, object).Context(ctx).Download()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// verify ensures that data matches the expected digest, if any
+func (l BlueprintLocation) verify(data []byte) error {
+	if l.SHA256 == "" {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != l.SHA256 {
+		return fmt.Errorf("blueprint %s does not match its digest, expected sha256 %s, got %s", l, l.SHA256, got)
+	}
+	return nil
+}
+
+// LoadBlueprint reads the blueprint at the location and verifies its digest.
+// Relative paths of blueprints not read from a local file, e.g. local module
+// sources, are relative to the working directory.
+func LoadBlueprint(ctx context.Context, l BlueprintLocation) (Blueprint, YamlCtx, error) {
+	data, err := l.read(ctx)
+	if err != nil {
+		return Blueprint{}, YamlCtx{}, fmt.Errorf("%s, filename=%s: %v", errMsgFileLoadError, l, err)
+	}
+	if err := l.verify(data); err != nil {
+		return Blueprint{}, YamlCtx{}, err
+	}
+	bp, yamlCtx, err := parseBlueprint(data, l.name())
+	if err != nil {
+		return Blueprint{}, yamlCtx, err
+	}
+	if !l.Remote() {
+		if bp.dir, err = filepath.Abs(filepath.Dir(l.Path)); err != nil {
+			return Blueprint{}, yamlCtx, err
+		}
+	}
+	// if the validation level has been explicitly set to an invalid value
+	// in YAML blueprint then silently default to validationError
+	if !isValidValidationLevel(bp.ValidationLevel) {
+		bp.ValidationLevel = ValidationError
+	}
+	return bp, yamlCtx, nil
+}
+
+// ErrNoDigest is returned for remote blueprints without a digest when digests
+// are required
+var ErrNoDigest = errors.New("blueprints not read from a local file must have a digest, append #sha256=HEX to their location")
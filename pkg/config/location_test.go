@@ -0,0 +1,138 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+const locationBlueprint = `
+blueprint_name: remote
+vars:
+  deployment_name: golf
+deployment_groups:
+- group: zero
+  modules:
+  - id: net
+    source: modules/network/vpc
+`
+
+func digest(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *zeroSuite) TestParseBlueprintLocation(c *C) {
+	sum := digest("anything")
+	type test struct {
+		in   string
+		want BlueprintLocation
+		err  bool
+	}
+	tests := []test{
+		{"bp.yaml", BlueprintLocation{Kind: LocalFile, Path: "bp.yaml"}, false},
+		{"-", BlueprintLocation{Kind: Stdin, Path: "-"}, false},
+		{"https://example.com/bp.yaml", BlueprintLocation{Kind: HTTPS, Path: "https://example.com/bp.yaml"}, false},
+		{"gs://bucket/dir/bp.yaml", BlueprintLocation{Kind: GCS, Path: "gs://bucket/dir/bp.yaml"}, false},
+		{"gs://bucket/bp.yaml#sha256=" + strings.ToUpper(sum), BlueprintLocation{Kind: GCS, Path: "gs://bucket/bp.yaml", SHA256: sum}, false},
+		{"-#sha256=" + sum, BlueprintLocation{Kind: Stdin, Path: "-", SHA256: sum}, false},
+		{"http://example.com/bp.yaml", BlueprintLocation{}, true},
+		{"gs://bucket", BlueprintLocation{}, true},
+		{"gs:///bp.yaml", BlueprintLocation{}, true},
+		{"bp.yaml#sha256=abc", BlueprintLocation{}, true},
+	}
+	for _, tc := range tests {
+		got, err := ParseBlueprintLocation(tc.in)
+		if tc.err {
+			c.Check(err, NotNil, Commentf("%s", tc.in))
+			continue
+		}
+		c.Check(err, IsNil, Commentf("%s", tc.in))
+		c.Check(got, DeepEquals, tc.want)
+	}
+}
+
+func (s *zeroSuite) TestLoadBlueprintStdin(c *C) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+
+	stdin = strings.NewReader(locationBlueprint)
+	bp, _, err := LoadBlueprint(context.Background(), BlueprintLocation{Kind: Stdin, Path: "-", SHA256: digest(locationBlueprint)})
+	c.Assert(err, IsNil)
+	c.Check(bp.BlueprintName, Equals, "remote")
+	c.Check(bp.dir, Equals, "") // relative paths are relative to the working directory
+
+	stdin = strings.NewReader(locationBlueprint + "# tampered\n")
+	_, _, err = LoadBlueprint(context.Background(), BlueprintLocation{Kind: Stdin, Path: "-", SHA256: digest(locationBlueprint)})
+	c.Check(err, ErrorMatches, ".*does not match its digest.*")
+}
+
+func (s *zeroSuite) TestLoadBlueprintStdinSourceBase(c *C) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+
+	data := locationBlueprint + "source_base: blueprint\n"
+	stdin = strings.NewReader(data)
+	bp, _, err := LoadBlueprint(context.Background(), BlueprintLocation{Kind: Stdin, Path: "-", SHA256: digest(data)})
+	c.Assert(err, IsNil)
+	c.Check(bp.SourceBase, Equals, SourceBaseBlueprint)
+	c.Check(bp.resolveModuleSource("./modules/x"), Equals, "./modules/x")
+	c.Check(validateSourceResolution(bp), ErrorMatches, ".*requires the blueprint to be read from a local file.*")
+}
+
+func (s *zeroSuite) TestLoadBlueprintHTTPS(c *C) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bp.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(locationBlueprint))
+	}))
+	defer srv.Close()
+	defer func(cl *http.Client) { httpsClient = cl }(httpsClient)
+	httpsClient = srv.Client()
+
+	l, err := ParseBlueprintLocation(srv.URL + "/bp.yaml#sha256=" + digest(locationBlueprint))
+	c.Assert(err, IsNil)
+	bp, _, err := LoadBlueprint(context.Background(), l)
+	c.Assert(err, IsNil)
+	c.Check(bp.BlueprintName, Equals, "remote")
+
+	l, err = ParseBlueprintLocation(srv.URL + "/missing.yaml")
+	c.Assert(err, IsNil)
+	_, _, err = LoadBlueprint(context.Background(), l)
+	c.Check(err, ErrorMatches, ".*404 Not Found.*")
+}
+
+func (s *zeroSuite) TestLoadBlueprintLocalFile(c *C) {
+	dir := c.MkDir()
+	f := filepath.Join(dir, "bp.yaml")
+	c.Assert(os.WriteFile(f, []byte(locationBlueprint), 0644), IsNil)
+
+	bp, _, err := LoadBlueprint(context.Background(), BlueprintLocation{Kind: LocalFile, Path: f, SHA256: digest(locationBlueprint)})
+	c.Assert(err, IsNil)
+	c.Check(bp.dir, Equals, dir)
+
+	_, _, err = LoadBlueprint(context.Background(), BlueprintLocation{Kind: LocalFile, Path: f, SHA256: digest("other")})
+	c.Check(err, NotNil)
+}
@@ -0,0 +1,381 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// MergeConflict is a change of the blueprint made by both sides of a merge
+// that can not be reconciled, or a merged blueprint that is inconsistent
+type MergeConflict struct {
+	// Path is the location in the blueprint, groups and modules are given by
+	// name, e.g. `deployment_groups[primary].modules[vm].settings.zone`
+	Path   string
+	Reason string
+}
+
+func (c MergeConflict) Error() string {
+	return fmt.Sprintf("%s: %s", c.Path, c.Reason)
+}
+
+// mergeKeys are fields identifying items of blueprint lists, items are merged
+// by identity rather than by position
+var mergeKeys = map[string]string{
+	"deployment_groups": "group",
+	"modules":           "id",
+}
+
+// MergeBlueprints performs a three-way merge of YAML blueprints, applying
+// changes made by `theirs` to `base` onto `ours`. Groups and modules are
+// matched by name and ID, entries of `use` lists are merged as sets. Values
+// changed differently by both sides are kept as in `ours`, annotated with a
+// comment, and reported as conflicts together with references to modules or
+// variables removed by the merge.
+func MergeBlueprints(base []byte, ours []byte, theirs []byte) ([]byte, []MergeConflict, error) {
+	docs := make([]*yaml.Node, 3)
+	for i, data := range [][]byte{base, ours, theirs} {
+		var n yaml.Node
+		if err := yaml.Unmarshal(data, &n); err != nil {
+			return nil, nil, parseYamlV3Error(err)
+		}
+		if n.Kind != yaml.DocumentNode || len(n.Content) != 1 || n.Content[0].Kind != yaml.MappingNode {
+			return nil, nil, fmt.Errorf("%s blueprint is not a YAML mapping", []string{"base", "our", "their"}[i])
+		}
+		docs[i] = &n
+	}
+
+	m := merger{}
+	root := m.value("", "", docs[0].Content[0], docs[1].Content[0], docs[2].Content[0])
+	res := *docs[1]
+	res.Content = []*yaml.Node{root}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&res); err != nil {
+		return nil, nil, err
+	}
+	enc.Close()
+
+	m.conflicts = append(m.conflicts, dangling(buf.Bytes(), base, ours, theirs)...)
+	return buf.Bytes(), m.conflicts, nil
+}
+
+type merger struct {
+	conflicts []MergeConflict
+}
+
+// value merges a value, nil nodes are absent values
+func (m *merger) value(path string, key string, b, o, t *yaml.Node) *yaml.Node {
+	if res, ok := m.oneSided(path, b, o, t); ok {
+		return res
+	}
+	if b == nil { // added by both sides, merge as if added to an empty value
+		b = &yaml.Node{Kind: o.Kind}
+	}
+	switch {
+	case o.Kind == yaml.MappingNode && t.Kind == yaml.MappingNode && b.Kind == yaml.MappingNode:
+		return m.mapping(path, b, o, t)
+	case o.Kind == yaml.SequenceNode && t.Kind == yaml.SequenceNode && b.Kind == yaml.SequenceNode:
+		if res := m.sequence(path, key, b, o, t); res != nil {
+			return res
+		}
+	}
+	return m.conflict(path, o, fmt.Sprintf("changed by both sides, theirs is %s", nodeSummary(t)))
+}
+
+// oneSided merges values changed or removed by at most one side, reports
+// false if both sides changed the value
+func (m *merger) oneSided(path string, b, o, t *yaml.Node) (*yaml.Node, bool) {
+	switch {
+	case nodesEqual(o, t) || nodesEqual(b, t):
+		return o, true
+	case nodesEqual(b, o):
+		return t, true
+	case o == nil:
+		return m.conflict(path, t, "removed by ours, modified by theirs"), true
+	case t == nil:
+		return m.conflict(path, o, "modified by ours, removed by theirs"), true
+	}
+	return nil, false
+}
+
+// sequence merges sequences of modules or of keyed items, returns nil for
+// other sequences
+func (m *merger) sequence(path string, key string, b, o, t *yaml.Node) *yaml.Node {
+	if k, ok := mergeKeys[key]; ok {
+		if res, ok := m.keyedSequence(path, k, b, o, t); ok {
+			return res
+		}
+	}
+	if key == "use" {
+		return useSequence(b, o, t)
+	}
+	return nil
+}
+
+func (m *merger) conflict(path string, keep *yaml.Node, reason string) *yaml.Node {
+	if path == "" {
+		path = "blueprint"
+	}
+	m.conflicts = append(m.conflicts, MergeConflict{Path: path, Reason: reason})
+	c := *keep
+	c.LineComment = "merge conflict: " + reason
+	return &c
+}
+
+func (m *merger) mapping(path string, b, o, t *yaml.Node) *yaml.Node {
+	res := *o
+	res.Content = nil
+	keys := mappingKeys(o)
+	for _, k := range mappingKeys(t) {
+		if mappingKey(o, k) == nil {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		kn := mappingKey(o, k)
+		if kn == nil {
+			kn = mappingKey(t, k)
+		}
+		p := k
+		if path != "" {
+			p = path + "." + k
+		}
+		if v := m.value(p, k, mappingValue(b, k), mappingValue(o, k), mappingValue(t, k)); v != nil {
+			res.Content = append(res.Content, kn, v)
+		}
+	}
+	return &res
+}
+
+// keyedSequence merges lists of mappings identified by the key field, it
+// returns false if items can not be identified
+func (m *merger) keyedSequence(path string, key string, b, o, t *yaml.Node) (*yaml.Node, bool) {
+	bi, okB := itemsByKey(b, key)
+	oi, okO := itemsByKey(o, key)
+	ti, okT := itemsByKey(t, key)
+	if !okB || !okO || !okT {
+		return nil, false
+	}
+	// items of ours first, other items of theirs follow the item preceding
+	// them in theirs
+	order := keyOrder(o, key)
+	prev := -1
+	for _, id := range keyOrder(t, key) {
+		if _, ok := oi[id]; !ok {
+			order = slices.Insert(order, prev+1, id)
+		}
+		prev = slices.Index(order, id)
+	}
+
+	res := *o
+	res.Content = nil
+	for _, id := range order {
+		if v := m.value(fmt.Sprintf("%s[%s]", path, id), "", bi[id], oi[id], ti[id]); v != nil {
+			res.Content = append(res.Content, v)
+		}
+	}
+	return &res, true
+}
+
+// useSequence merges `use` lists as sets, entries added by theirs are
+// appended and entries removed by theirs are dropped
+func useSequence(b, o, t *yaml.Node) *yaml.Node {
+	has := func(n *yaml.Node, e *yaml.Node) bool {
+		for _, c := range n.Content {
+			if nodesEqual(c, e) {
+				return true
+			}
+		}
+		return false
+	}
+	res := *o
+	res.Content = nil
+	for _, e := range o.Content {
+		if !has(b, e) || has(t, e) {
+			res.Content = append(res.Content, e)
+		}
+	}
+	for _, e := range t.Content {
+		if !has(b, e) && !has(o, e) {
+			res.Content = append(res.Content, e)
+		}
+	}
+	return &res
+}
+
+func itemsByKey(n *yaml.Node, key string) (map[string]*yaml.Node, bool) {
+	res := map[string]*yaml.Node{}
+	for _, c := range n.Content {
+		k := mappingValue(c, key)
+		if k == nil || k.Kind != yaml.ScalarNode || res[k.Value] != nil {
+			return nil, false
+		}
+		res[k.Value] = c
+	}
+	return res, true
+}
+
+func keyOrder(n *yaml.Node, key string) []string {
+	res := []string{}
+	for _, c := range n.Content {
+		res = append(res, mappingValue(c, key).Value)
+	}
+	return res
+}
+
+func mappingKeys(n *yaml.Node) []string {
+	res := []string{}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		res = append(res, n.Content[i].Value)
+	}
+	return res
+}
+
+func mappingKey(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i]
+		}
+	}
+	return nil
+}
+
+// nodesEqual compares values of nodes, ignoring comments, positions and style
+func nodesEqual(a, b *yaml.Node) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	for a.Kind == yaml.AliasNode {
+		a = a.Alias
+	}
+	for b.Kind == yaml.AliasNode {
+		b = b.Alias
+	}
+	if a.Kind != b.Kind || len(a.Content) != len(b.Content) {
+		return false
+	}
+	if a.Kind == yaml.ScalarNode && (a.Value != b.Value || a.ShortTag() != b.ShortTag()) {
+		return false
+	}
+	for i := range a.Content {
+		if !nodesEqual(a.Content[i], b.Content[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeSummary renders the node on a single line for conflict messages
+func nodeSummary(n *yaml.Node) string {
+	if n.Kind == yaml.ScalarNode {
+		return fmt.Sprintf("%q", n.Value)
+	}
+	c := *n
+	c.Style = yaml.FlowStyle
+	b, err := yaml.Marshal(&c)
+	if err != nil {
+		return "a " + n.ShortTag()
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// dangling reports module IDs defined more than once in the merged blueprint
+// and references to modules or deployment variables that exist in one of
+// the merged blueprints but were removed by the merge
+func dangling(merged []byte, inputs ...[]byte) []MergeConflict {
+	var bp Blueprint
+	if err := yaml.Unmarshal(merged, &bp); err != nil {
+		return []MergeConflict{{Path: "blueprint", Reason: fmt.Sprintf("merged blueprint is invalid: %s", err)}}
+	}
+	d := danglingCheck{bp: bp, known: map[ModuleID]bool{}, knownVars: map[string]bool{}, ids: map[ModuleID]int{}}
+	for _, data := range inputs {
+		var in Blueprint
+		if yaml.Unmarshal(data, &in) != nil {
+			continue
+		}
+		in.WalkModulesSafe(func(_ ModulePath, m *Module) { d.known[m.ID] = true })
+		for _, n := range maps.Keys(in.Vars.Items()) {
+			d.knownVars[n] = true
+		}
+	}
+	bp.WalkModulesSafe(func(_ ModulePath, m *Module) { d.ids[m.ID]++ })
+
+	res := []MergeConflict{}
+	for _, g := range bp.DeploymentGroups {
+		for _, m := range g.Modules {
+			res = append(res, d.module(fmt.Sprintf("deployment_groups[%s].modules[%s]", g.Name, m.ID), m)...)
+		}
+	}
+	return res
+}
+
+// danglingCheck holds modules and deployment variables of the merged
+// blueprint and of the blueprints it was merged from
+type danglingCheck struct {
+	bp        Blueprint
+	known     map[ModuleID]bool
+	knownVars map[string]bool
+	ids       map[ModuleID]int
+}
+
+func (d danglingCheck) module(path string, m Module) []MergeConflict {
+	res := []MergeConflict{}
+	if d.ids[m.ID] > 1 {
+		res = append(res, MergeConflict{Path: path, Reason: fmt.Sprintf("module ID %q is used by more than one module", m.ID)})
+		d.ids[m.ID] = 0 // report once
+	}
+	for _, u := range m.Use {
+		if _, ok := d.ids[u]; !ok && d.known[u] {
+			res = append(res, MergeConflict{Path: path + ".use", Reason: fmt.Sprintf("used module %q was removed", u)})
+		}
+	}
+	refs := maps.Keys(valueReferences(m.Settings.AsObject()))
+	sort.Slice(refs, func(i, j int) bool {
+		return fmt.Sprint(refs[i].Module, refs[i].Name) < fmt.Sprint(refs[j].Module, refs[j].Name)
+	})
+	for _, r := range refs {
+		if reason := d.reference(r); reason != "" {
+			res = append(res, MergeConflict{Path: path + ".settings", Reason: reason})
+		}
+	}
+	return res
+}
+
+// reference returns why the reference is dangling, empty if it is not
+func (d danglingCheck) reference(r Reference) string {
+	if r.GlobalVar {
+		if !d.bp.Vars.Has(r.Name) && d.knownVars[r.Name] {
+			return fmt.Sprintf("referenced deployment variable %q was removed", r.Name)
+		}
+		return ""
+	}
+	if _, ok := d.ids[r.Module]; !ok && d.known[r.Module] {
+		return fmt.Sprintf("referenced module %q was removed", r.Module)
+	}
+	return ""
+}
@@ -0,0 +1,189 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+const mergeBase = `blueprint_name: lime # keep me
+vars:
+  project_id: p
+  zone: us-central1-a
+deployment_groups:
+- group: primary
+  modules:
+  - id: network
+    source: modules/network/vpc
+  - id: vm
+    source: modules/compute/vm-instance
+    use: [network]
+    settings:
+      machine_type: n2-standard-2
+      instance_count: 1
+`
+
+func (s *zeroSuite) TestMergeBlueprints(c *C) {
+	ours := `blueprint_name: lime # keep me
+vars:
+  project_id: p
+  zone: us-central1-b
+deployment_groups:
+- group: primary
+  modules:
+  - id: network
+    source: modules/network/vpc
+  - id: fs
+    source: modules/file-system/filestore
+    use: [network]
+  - id: vm
+    source: modules/compute/vm-instance
+    use: [network, fs]
+    settings:
+      machine_type: n2-standard-2
+      instance_count: 1
+`
+	theirs := `blueprint_name: lime
+vars:
+  project_id: p
+  zone: us-central1-a
+deployment_groups:
+- group: primary
+  modules:
+  - id: network
+    source: modules/network/vpc
+  - id: vm
+    source: modules/compute/vm-instance
+    use: [network]
+    settings:
+      machine_type: c2-standard-60
+      instance_count: 1
+  - id: login
+    source: modules/compute/vm-instance
+    use: [network, vm]
+`
+	merged, conflicts, err := MergeBlueprints([]byte(mergeBase), []byte(ours), []byte(theirs))
+	c.Assert(err, IsNil)
+	c.Check(conflicts, HasLen, 0)
+	c.Check(string(merged), Equals, `blueprint_name: lime # keep me
+vars:
+  project_id: p
+  zone: us-central1-b
+deployment_groups:
+  - group: primary
+    modules:
+      - id: network
+        source: modules/network/vpc
+      - id: fs
+        source: modules/file-system/filestore
+        use: [network]
+      - id: vm
+        source: modules/compute/vm-instance
+        use: [network, fs]
+        settings:
+          machine_type: c2-standard-60
+          instance_count: 1
+      - id: login
+        source: modules/compute/vm-instance
+        use: [network, vm]
+`)
+}
+
+func (s *zeroSuite) TestMergeBlueprintsConflicts(c *C) {
+	ours := `blueprint_name: lime
+vars:
+  project_id: p
+deployment_groups:
+- group: primary
+  modules:
+  - id: network
+    source: modules/network/vpc
+  - id: vm
+    source: modules/compute/vm-instance
+    use: [network]
+    settings:
+      machine_type: n2-standard-4
+      instance_count: 1
+`
+	theirs := `blueprint_name: lime
+vars:
+  project_id: p
+  zone: us-central1-a
+deployment_groups:
+- group: primary
+  modules:
+  - id: vm
+    source: modules/compute/vm-instance
+    settings:
+      machine_type: c2-standard-60
+      instance_count: 1
+      zone: $(vars.zone)
+  - id: login
+    source: modules/compute/vm-instance
+    settings:
+      network_self_link: $(network.network_self_link)
+`
+	merged, conflicts, err := MergeBlueprints([]byte(mergeBase), []byte(ours), []byte(theirs))
+	c.Assert(err, IsNil)
+	c.Check(conflicts, DeepEquals, []MergeConflict{
+		{"deployment_groups[primary].modules[vm].settings.machine_type", `changed by both sides, theirs is "c2-standard-60"`},
+		{"deployment_groups[primary].modules[vm].settings", `referenced deployment variable "zone" was removed`},
+		{"deployment_groups[primary].modules[login].settings", `referenced module "network" was removed`},
+	})
+	c.Check(string(merged), Matches, `(?s).*machine_type: n2-standard-4 # merge conflict: changed by both sides.*`)
+
+	{ // module removed by ours, modified by theirs
+		ours := `blueprint_name: lime
+vars:
+  project_id: p
+  zone: us-central1-a
+deployment_groups:
+- group: primary
+  modules:
+  - id: network
+    source: modules/network/vpc
+`
+		_, conflicts, err := MergeBlueprints([]byte(mergeBase), []byte(ours), []byte(theirs))
+		c.Assert(err, IsNil)
+		c.Check(conflicts, DeepEquals, []MergeConflict{
+			{"deployment_groups[primary].modules[vm]", "removed by ours, modified by theirs"},
+			{"deployment_groups[primary].modules[login].settings", `referenced module "network" was removed`},
+		})
+	}
+
+	{ // same module ID added to different groups, groups added by theirs
+		// follow the group preceding them in theirs
+		ours := mergeBase + `- group: second
+  modules:
+  - id: extra
+    source: modules/network/vpc
+`
+		theirs := mergeBase + `- group: third
+  modules:
+  - id: extra
+    source: modules/compute/vm-instance
+`
+		_, conflicts, err := MergeBlueprints([]byte(mergeBase), []byte(ours), []byte(theirs))
+		c.Assert(err, IsNil)
+		c.Check(conflicts, DeepEquals, []MergeConflict{
+			{"deployment_groups[third].modules[extra]", `module ID "extra" is used by more than one module`},
+		})
+	}
+
+	{ // not a blueprint
+		_, _, err := MergeBlueprints([]byte(mergeBase), []byte("[1, 2]"), []byte(mergeBase))
+		c.Check(err, NotNil)
+	}
+}
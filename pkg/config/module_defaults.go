@@ -0,0 +1,92 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/modulereader"
+	"path"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+func validateModuleDefaults(bp Blueprint) error {
+	errs := Errors{}
+	for _, pattern := range moduleDefaultPatterns(bp.ModuleDefaults) {
+		if pattern == "" {
+			errs.At(Root.ModuleDefaults.Dot(pattern), errors.New("module_defaults patterns must not be empty"))
+		} else if _, err := path.Match(pattern, ""); err != nil {
+			errs.At(Root.ModuleDefaults.Dot(pattern), fmt.Errorf("invalid module source pattern %q: %w", pattern, err))
+		}
+	}
+	return errs.OrNil()
+}
+
+// moduleDefaultPatterns orders patterns from the most specific, the longest,
+// to the least specific one
+func moduleDefaultPatterns(defaults map[string]Dict) []string {
+	patterns := maps.Keys(defaults)
+	slices.SortFunc(patterns, func(a, b string) int {
+		if len(a) != len(b) {
+			return len(b) - len(a)
+		}
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+		return 0
+	})
+	return patterns
+}
+
+// applyModuleDefaults sets settings of module_defaults, whose pattern matches
+// the resolved module source, that the module does not set explicitly. When
+// several patterns match, the most specific one wins. Defaults that are
+// neither an input nor an alias of the module are skipped, so the same
+// defaults can apply to modules with different inputs.
+func (bp *Blueprint) applyModuleDefaults() {
+	if len(bp.ModuleDefaults) == 0 {
+		return
+	}
+	patterns := moduleDefaultPatterns(bp.ModuleDefaults)
+	bp.WalkModulesSafe(func(_ ModulePath, m *Module) {
+		info, err := modulereader.GetModuleInfo(m.Source, m.Kind.String())
+		if err != nil {
+			return // reported when the module is validated
+		}
+		inputs := getModuleInputMap(info.Inputs)
+		aliases := info.Metadata.Ghpc.Aliases
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, m.Source); !ok {
+				continue
+			}
+			d := bp.ModuleDefaults[pattern]
+			for _, k := range d.Keys() {
+				input := k
+				if _, isInput := inputs[k]; !isInput {
+					input = aliases[k]
+				}
+				if _, isInput := inputs[input]; !isInput || m.Settings.Has(k) || m.Settings.Has(input) {
+					continue
+				}
+				m.Settings.Set(k, d.Get(k))
+				m.recordOrigin(k, OriginModuleDefaults, pattern)
+			}
+		}
+	})
+}
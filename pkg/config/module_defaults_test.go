@@ -0,0 +1,70 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"hpc-toolkit/pkg/modulereader"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestApplyModuleDefaults(c *C) {
+	vm := Module{ID: "vm", Kind: TerraformKind, Source: c.TestName() + "/compute/vm", Settings: NewDict(map[string]cty.Value{
+		"tags": cty.StringVal("explicit"),
+	})}
+	setTestModuleInfo(vm, modulereader.ModuleInfo{
+		Inputs: []modulereader.VarInfo{{Name: "tags"}, {Name: "service_account_email"}, {Name: "machine_type"}},
+		Metadata: modulereader.Metadata{Ghpc: modulereader.MetadataGhpc{
+			Aliases: map[string]string{"instance_type": "machine_type"}}}})
+	net := Module{ID: "net", Kind: TerraformKind, Source: c.TestName() + "/network/vpc"}
+	setTestModuleInfo(net, modulereader.ModuleInfo{Inputs: []modulereader.VarInfo{{Name: "tags"}}})
+
+	bp := Blueprint{
+		ModuleDefaults: map[string]Dict{
+			c.TestName() + "/*/*": NewDict(map[string]cty.Value{
+				"tags":                  cty.StringVal("org"),
+				"service_account_email": cty.StringVal("org@example.com"),
+			}),
+			c.TestName() + "/compute/*": NewDict(map[string]cty.Value{
+				"service_account_email": cty.StringVal("compute@example.com"),
+				"instance_type":         cty.StringVal("c2-standard-8"),
+				"subnetwork":            cty.StringVal("not an input"),
+			}),
+		},
+		DeploymentGroups: []DeploymentGroup{{Name: "primary", Modules: []Module{vm, net}}},
+	}
+	bp.applyModuleDefaults()
+
+	// explicit settings win, then the most specific pattern
+	c.Check(bp.DeploymentGroups[0].Modules[0].Settings.Items(), DeepEquals, map[string]cty.Value{
+		"tags":                  cty.StringVal("explicit"),
+		"service_account_email": cty.StringVal("compute@example.com"),
+		"instance_type":         cty.StringVal("c2-standard-8"),
+	})
+	// defaults that are not inputs of the module are skipped
+	c.Check(bp.DeploymentGroups[0].Modules[1].Settings.Items(), DeepEquals, map[string]cty.Value{
+		"tags": cty.StringVal("org"),
+	})
+}
+
+func (s *zeroSuite) TestValidateModuleDefaults(c *C) {
+	c.Check(validateModuleDefaults(Blueprint{ModuleDefaults: map[string]Dict{
+		"modules/compute/*": {}}}), IsNil)
+	c.Check(validateModuleDefaults(Blueprint{ModuleDefaults: map[string]Dict{
+		"modules/[compute/*": {}}}), ErrorMatches, `.*invalid module source pattern "modules/\[compute/\*".*`)
+	c.Check(validateModuleDefaults(Blueprint{ModuleDefaults: map[string]Dict{
+		"": {}}}), ErrorMatches, `.*patterns must not be empty`)
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+// Monitoring adds a deployment group with observability modules
+type Monitoring struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Group is the name of the generated group, "monitoring" if not set
+	Group GroupName `yaml:"group,omitempty"`
+	// Use lists cluster modules the generated modules are wired to
+	Use ModuleIDs `yaml:"use,omitempty"`
+	// NotificationChannels alerts are sent to
+	NotificationChannels []string `yaml:"notification_channels,omitempty"`
+}
+
+const defaultMonitoringGroup GroupName = "monitoring"
+
+// monitoringModules are added to the generated group, in this order
+var monitoringModules = []struct {
+	id     ModuleID
+	source string
+	// whether the module uses cluster modules, others would find no
+	// matching outputs to use
+	wired bool
+}{
+	{"monitoring-dashboard", "modules/monitoring/dashboard", false},
+	{"monitoring-ops-agent", "modules/monitoring/ops-agent-policy", false},
+	{"monitoring-alerts", "modules/monitoring/alert-policy", true},
+}
+
+// expandMonitoring appends the group generated from the monitoring section.
+// The section is cleared, so the expanded blueprint holds the group instead.
+func (bp *Blueprint) expandMonitoring() error {
+	mon := bp.Monitoring
+	if !mon.Enabled {
+		return nil
+	}
+	name := mon.Group
+	if name == "" {
+		name = defaultMonitoringGroup
+	}
+	if err := bp.checkMonitoring(name); err != nil {
+		return err
+	}
+	bp.DeploymentGroups = append(bp.DeploymentGroups, monitoringGroup(name, mon))
+	bp.Monitoring = Monitoring{}
+	return nil
+}
+
+// checkMonitoring checks the generated group can be added with the name
+func (bp Blueprint) checkMonitoring(name GroupName) error {
+	p := Root.Monitoring
+	errs := Errors{}
+	if err := name.Validate(); err != nil {
+		errs.At(p.Group, err)
+	}
+	for _, g := range bp.DeploymentGroups {
+		if g.Name == name {
+			errs.At(p.Group, HintError{
+				Err:  fmt.Errorf("deployment group %q already exists", name),
+				Hint: "set monitoring.group to the name the generated group should have"})
+		}
+	}
+	for iu, u := range bp.Monitoring.Use {
+		if _, err := bp.Module(u); err != nil {
+			errs.At(p.Use.At(iu), err)
+		}
+	}
+	for _, mm := range monitoringModules {
+		if _, err := bp.Module(mm.id); err == nil {
+			errs.At(p, fmt.Errorf("module id %q is reserved for the generated monitoring group", mm.id))
+		}
+	}
+	return errs.OrNil()
+}
+
+// monitoringGroup generates the group of monitoring modules
+func monitoringGroup(name GroupName, mon Monitoring) DeploymentGroup {
+	g := DeploymentGroup{Name: name}
+	for _, mm := range monitoringModules {
+		m := Module{ID: mm.id, Source: mm.source}
+		if mm.wired {
+			m.Use = append(ModuleIDs{}, mon.Use...)
+		}
+		if mm.id == "monitoring-alerts" && len(mon.NotificationChannels) > 0 {
+			chs := []cty.Value{}
+			for _, ch := range mon.NotificationChannels {
+				chs = append(chs, cty.StringVal(ch))
+			}
+			m.Settings.Set("notification_channels", cty.TupleVal(chs))
+			m.recordOrigin("notification_channels", OriginGhpc, "monitoring")
+		}
+		g.Modules = append(g.Modules, m)
+	}
+	return g
+}
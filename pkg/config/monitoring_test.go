@@ -0,0 +1,81 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestExpandMonitoring(c *C) {
+	base := func() Blueprint {
+		return Blueprint{DeploymentGroups: []DeploymentGroup{{
+			Name:    "primary",
+			Modules: []Module{{ID: "vm", Source: "modules/compute/vm-instance"}}}}}
+	}
+
+	{ // disabled
+		bp := base()
+		bp.Monitoring = Monitoring{Use: ModuleIDs{"vm"}}
+		c.Check(bp.expandMonitoring(), IsNil)
+		c.Check(bp.DeploymentGroups, HasLen, 1)
+	}
+
+	{ // enabled
+		bp := base()
+		bp.Monitoring = Monitoring{Enabled: true, Use: ModuleIDs{"vm"}, NotificationChannels: []string{"projects/p/notificationChannels/1"}}
+		c.Assert(bp.expandMonitoring(), IsNil)
+		c.Check(bp.Monitoring, DeepEquals, Monitoring{})
+		c.Assert(bp.DeploymentGroups, HasLen, 2)
+
+		g := bp.DeploymentGroups[1]
+		c.Check(g.Name, Equals, GroupName("monitoring"))
+		c.Assert(g.Modules, HasLen, 3)
+		c.Check(g.Modules[0].Source, Equals, "modules/monitoring/dashboard")
+		c.Check(g.Modules[0].Use, HasLen, 0)
+		c.Check(g.Modules[1].Source, Equals, "modules/monitoring/ops-agent-policy")
+		alerts := g.Modules[2]
+		c.Check(alerts.ID, Equals, ModuleID("monitoring-alerts"))
+		c.Check(alerts.Use, DeepEquals, ModuleIDs{"vm"})
+		c.Check(alerts.Settings.Items(), DeepEquals, map[string]cty.Value{
+			"notification_channels": cty.TupleVal([]cty.Value{cty.StringVal("projects/p/notificationChannels/1")})})
+	}
+
+	{ // custom group name
+		bp := base()
+		bp.Monitoring = Monitoring{Enabled: true, Group: "observability"}
+		c.Assert(bp.expandMonitoring(), IsNil)
+		c.Check(bp.DeploymentGroups[1].Name, Equals, GroupName("observability"))
+	}
+
+	{ // group exists
+		bp := base()
+		bp.Monitoring = Monitoring{Enabled: true, Group: "primary"}
+		c.Check(bp.expandMonitoring(), ErrorMatches, `(?s).*deployment group "primary" already exists.*`)
+	}
+
+	{ // unknown module
+		bp := base()
+		bp.Monitoring = Monitoring{Enabled: true, Use: ModuleIDs{"vn"}}
+		c.Check(bp.expandMonitoring(), ErrorMatches, `(?s).*"vn".*`)
+	}
+
+	{ // reserved module id
+		bp := base()
+		bp.DeploymentGroups[0].Modules[0].ID = "monitoring-alerts"
+		bp.Monitoring = Monitoring{Enabled: true}
+		c.Check(bp.expandMonitoring(), ErrorMatches, `(?s).*"monitoring-alerts" is reserved.*`)
+	}
+}
@@ -17,6 +17,7 @@ package config
 import (
 	"fmt"
 	"reflect"
+	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/zclconf/go-cty/cty"
@@ -104,37 +105,162 @@ func ctyStepToString(s cty.PathStep) (string, error) {
 // -> initPath(&Root.BlueprintName, &Root, "blueprint_name")
 func initPath(p any, prev any, piece string) {
 	r := reflect.Indirect(reflect.ValueOf(p))
-	ty := reflect.TypeOf(p).Elem()
-	if !r.FieldByName("InternalPiece").IsValid() || !r.FieldByName("InternalPrev").IsValid() {
-		panic(fmt.Sprintf("%s does not embed basePath", ty.Name()))
-	}
+	l := pathLayoutOf(reflect.TypeOf(p).Elem())
 	if _, ok := prev.(Path); prev != nil && !ok {
 		panic(fmt.Sprintf("prev is not a Path: %#v", p))
 	}
 
-	r.FieldByName("InternalPiece").SetString(piece)
+	r.FieldByIndex(l.piece).SetString(piece)
 	if prev != nil {
-		r.FieldByName("InternalPrev").Set(reflect.ValueOf(prev))
+		r.FieldByIndex(l.prev).Set(reflect.ValueOf(prev))
+	}
+
+	for _, c := range l.children {
+		initPath(r.Field(c.index).Addr().Interface(), p, c.tag)
 	}
+}
+
+// pathLayout locates fields of a path type, it is computed once per type as
+// looking fields up by name is slow and paths are built for every module
+type pathLayout struct {
+	piece    []int
+	prev     []int
+	children []pathChild
+}
+
+type pathChild struct {
+	index int
+	tag   string
+}
+
+var pathLayouts sync.Map // reflect.Type -> pathLayout
 
+func pathLayoutOf(ty reflect.Type) pathLayout {
+	if l, ok := pathLayouts.Load(ty); ok {
+		return l.(pathLayout)
+	}
+	piece, okPiece := ty.FieldByName("InternalPiece")
+	prev, okPrev := ty.FieldByName("InternalPrev")
+	if !okPiece || !okPrev {
+		panic(fmt.Sprintf("%s does not embed basePath", ty.Name()))
+	}
+	l := pathLayout{piece: piece.Index, prev: prev.Index}
 	for i := 0; i < ty.NumField(); i++ {
-		tag, ok := ty.Field(i).Tag.Lookup("path")
-		if !ok {
-			continue
+		if tag, ok := ty.Field(i).Tag.Lookup("path"); ok {
+			l.children = append(l.children, pathChild{i, tag})
 		}
-		initPath(r.Field(i).Addr().Interface(), p, tag)
 	}
+	pathLayouts.Store(ty, l)
+	return l
 }
 
 type rootPath struct {
 	basePath
-	BlueprintName   basePath                    `path:"blueprint_name"`
-	GhpcVersion     basePath                    `path:"ghpc_version"`
-	Validators      arrayPath[validatorCfgPath] `path:"validators"`
-	ValidationLevel basePath                    `path:"validation_level"`
-	Vars            dictPath                    `path:"vars"`
-	Groups          arrayPath[groupPath]        `path:"deployment_groups"`
-	Backend         backendPath                 `path:"terraform_backend_defaults"`
+	BlueprintName    basePath                       `path:"blueprint_name"`
+	GhpcVersion      basePath                       `path:"ghpc_version"`
+	Validators       arrayPath[validatorCfgPath]    `path:"validators"`
+	CustomValidators arrayPath[customValidatorPath] `path:"custom_validators"`
+	ValidationLevel  basePath                       `path:"validation_level"`
+	Vars             dictPath                       `path:"vars"`
+	VarDeclarations  mapPath[varDeclPath]           `path:"var_declarations"`
+	DeprecatedVars   mapPath[basePath]              `path:"deprecated_vars"`
+	Groups           arrayPath[groupPath]           `path:"deployment_groups"`
+	Backend          backendPath                    `path:"terraform_backend_defaults"`
+	Layout           layoutPath                     `path:"deployment_layout"`
+	HealthChecks     arrayPath[healthCheckPath]     `path:"health_checks"`
+	SourceBase       basePath                       `path:"source_base"`
+	SourceRoots      mapPath[basePath]              `path:"source_roots"`
+	ModuleRegistry   basePath                       `path:"module_registry"`
+	ModuleDefaults   mapPath[dictPath]              `path:"module_defaults"`
+	SkipExpansions   arrayPath[basePath]            `path:"skip_expansions"`
+	Providers        providersPath                  `path:"terraform_providers"`
+	Monitoring       monitoringPath                 `path:"monitoring"`
+	Encryption       encryptionPath                 `path:"artifacts_encryption"`
+	StateBackups     stateBackupsPath               `path:"state_backups"`
+	Credentials      arrayPath[credentialsPath]     `path:"credentials"`
+	DataSources      arrayPath[dataSourcePath]      `path:"data_sources"`
+	Experimental     arrayPath[basePath]            `path:"experimental"`
+	ZonePolicy       mapPath[zonePolicyPath]        `path:"zone_policy"`
+	Images           mapPath[imagePath]             `path:"images"`
+}
+
+type imagePath struct {
+	basePath
+	Family  basePath `path:".family"`
+	Name    basePath `path:".name"`
+	Project basePath `path:".project"`
+	BuiltBy basePath `path:".built_by"`
+}
+
+type zonePolicyPath struct {
+	basePath
+	Zones            arrayPath[basePath] `path:".zones"`
+	RegionVar        basePath            `path:".region_var"`
+	MachineType      basePath            `path:".machine_type"`
+	AcceleratorType  basePath            `path:".accelerator_type"`
+	AcceleratorCount basePath            `path:".accelerator_count"`
+	Count            basePath            `path:".count"`
+}
+
+type dataSourcePath struct {
+	basePath
+	Name   basePath `path:".name"`
+	Type   basePath `path:".type"`
+	Inputs dictPath `path:".inputs"`
+}
+
+type credentialsPath struct {
+	basePath
+	Provider       basePath `path:".provider"`
+	TokenFile      basePath `path:".token_file"`
+	TokenEnv       basePath `path:".token_env"`
+	Audience       basePath `path:".audience"`
+	ServiceAccount basePath `path:".service_account"`
+	RoleArn        basePath `path:".role_arn"`
+	Lifetime       basePath `path:".lifetime"`
+	Variable       basePath `path:".variable"`
+}
+
+type stateBackupsPath struct {
+	basePath
+	Disabled  basePath `path:".disabled"`
+	Retain    basePath `path:".retain"`
+	GcsPrefix basePath `path:".gcs_prefix"`
+}
+
+type encryptionPath struct {
+	basePath
+	KmsKey        basePath            `path:".kms_key"`
+	AgeRecipients arrayPath[basePath] `path:".age_recipients"`
+}
+
+type monitoringPath struct {
+	basePath
+	Enabled              basePath            `path:".enabled"`
+	Group                basePath            `path:".group"`
+	Use                  arrayPath[basePath] `path:".use"`
+	NotificationChannels arrayPath[basePath] `path:".notification_channels"`
+}
+
+type providersPath struct {
+	basePath
+	LockPlatforms arrayPath[basePath] `path:".lock_platforms"`
+	NetworkMirror basePath            `path:".network_mirror"`
+}
+
+type healthCheckPath struct {
+	basePath
+	Check  basePath `path:".check"`
+	Name   basePath `path:".name"`
+	Inputs dictPath `path:".inputs"`
+}
+
+type layoutPath struct {
+	basePath
+	Flat         basePath `path:".flat"`
+	GroupPrefix  basePath `path:".group_prefix"`
+	NumberGroups basePath `path:".number_groups"`
+	GhpcDir      basePath `path:".ghpc_dir"`
 }
 
 type validatorCfgPath struct {
@@ -142,14 +268,35 @@ type validatorCfgPath struct {
 	Validator basePath `path:".validator"`
 	Inputs    dictPath `path:".inputs"`
 	Skip      basePath `path:".skip"`
+	Level     basePath `path:".level"`
+}
+
+type customValidatorPath struct {
+	basePath
+	Name      basePath `path:".name"`
+	Condition basePath `path:".condition"`
+	Message   basePath `path:".message"`
+	Level     basePath `path:".level"`
+}
+
+type varDeclPath struct {
+	basePath
+	Type        basePath `path:".type"`
+	Description basePath `path:".description"`
 }
 
 type dictPath struct{ mapPath[ctyPath] }
 
 type backendPath struct {
 	basePath
-	Type          basePath `path:".type"`
-	Configuration dictPath `path:".configuration"`
+	Type          basePath        `path:".type"`
+	Configuration dictPath        `path:".configuration"`
+	StateAccess   stateAccessPath `path:".state_access"`
+}
+
+type stateAccessPath struct {
+	basePath
+	ImpersonateServiceAccount basePath `path:".impersonate_service_account"`
 }
 
 type groupPath struct {
@@ -157,6 +304,19 @@ type groupPath struct {
 	Name    basePath              `path:".group"`
 	Backend backendPath           `path:".terraform_backend"`
 	Modules arrayPath[ModulePath] `path:".modules"`
+	Timeout basePath              `path:".timeout"`
+	ForEach basePath              `path:".group_for_each"`
+
+	Bootstrap  basePath                     `path:".bootstrap"`
+	Kind       basePath                     `path:".kind"`
+	PostDeploy arrayPath[remoteCommandPath] `path:".post_deploy"`
+}
+
+type remoteCommandPath struct {
+	basePath
+	Name    basePath `path:".name"`
+	Command basePath `path:".command"`
+	Target  dictPath `path:".target"`
 }
 
 type ModulePath struct {
@@ -167,6 +327,21 @@ type ModulePath struct {
 	Use      arrayPath[basePath]   `path:".use"`
 	Outputs  arrayPath[outputPath] `path:".outputs"`
 	Settings dictPath              `path:".settings"`
+
+	StartupScriptParts arrayPath[startupScriptPartPath] `path:".startup_script_parts"`
+	RenamedFrom        basePath                         `path:".renamed_from"`
+	Import             dictPath                         `path:".import"`
+	Distribute         basePath                         `path:".distribute"`
+	SkipExpansions     arrayPath[basePath]              `path:".skip_expansions"`
+	RequiredApis       basePath                         `path:".required_apis"`
+	WrapSettingsWith   basePath                         `path:".wrapsettingswith"`
+}
+
+type startupScriptPartPath struct {
+	basePath
+	Content  basePath `path:".content"`
+	Module   basePath `path:".module"`
+	Priority basePath `path:".priority"`
 }
 
 type outputPath struct {
@@ -174,6 +349,7 @@ type outputPath struct {
 	Name        basePath `path:".name"`
 	Description basePath `path:".description"`
 	Sensitive   basePath `path:".sensitive"`
+	Value       basePath `path:".value"`
 }
 
 // Root is a starting point for creating a Blueprint Path
@@ -15,6 +15,7 @@
 package config
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/zclconf/go-cty/cty"
@@ -36,6 +37,10 @@ func TestPath(t *testing.T) {
 		{r.Vars, "vars"},
 		{r.Groups, "deployment_groups"},
 		{r.Backend, "terraform_backend_defaults"},
+		{r.Encryption.AgeRecipients.At(1), "artifacts_encryption.age_recipients[1]"},
+		{r.StateBackups.GcsPrefix, "state_backups.gcs_prefix"},
+		{r.ZonePolicy.Dot("zone").Zones.At(1), "zone_policy.zone.zones[1]"},
+		{r.Images.Dot("rocky").BuiltBy, "images.rocky.built_by"},
 
 		{r.Validators.At(2), "validators[2]"},
 		{r.Validators.At(2).Validator, "validators[2].validator"},
@@ -54,6 +59,9 @@ func TestPath(t *testing.T) {
 		{r.Groups.At(3).Name, "deployment_groups[3].group"},
 		{r.Groups.At(3).Backend, "deployment_groups[3].terraform_backend"},
 		{r.Groups.At(3).Modules, "deployment_groups[3].modules"},
+		{r.Groups.At(3).Kind, "deployment_groups[3].kind"},
+		{r.Groups.At(3).PostDeploy.At(1).Command, "deployment_groups[3].post_deploy[1].command"},
+		{r.Groups.At(3).PostDeploy.At(1).Target.Dot("instance"), "deployment_groups[3].post_deploy[1].target.instance"},
 		{r.Groups.At(3).Modules.At(1), "deployment_groups[3].modules[1]"},
 		// m := r.Groups.At(3).Modules.At(1)
 		{m.Source, "deployment_groups[3].modules[1].source"},
@@ -72,6 +80,7 @@ func TestPath(t *testing.T) {
 		{r.Backend.Type, "terraform_backend_defaults.type"},
 		{r.Backend.Configuration, "terraform_backend_defaults.configuration"},
 		{r.Backend.Configuration.Dot("goo"), "terraform_backend_defaults.configuration.goo"},
+		{r.Backend.StateAccess.ImpersonateServiceAccount, "terraform_backend_defaults.state_access.impersonate_service_account"},
 	}
 	for _, tc := range tests {
 		t.Run(tc.want, func(t *testing.T) {
@@ -116,3 +125,16 @@ func TestPathParent(t *testing.T) {
 		})
 	}
 }
+
+func TestPathLayoutIsReused(t *testing.T) {
+	// paths built after the layout of their type is cached are the same
+	for i := 0; i < 2; i++ {
+		p := Root.Groups.At(7).Modules.At(2).Settings.Dot("zebra")
+		if got, want := p.String(), "deployment_groups[7].modules[2].settings.zebra"; got != want {
+			t.Errorf("\ngot : %q\nwant: %q", got, want)
+		}
+	}
+	if got := len(pathLayoutOf(reflect.TypeOf(groupPath{})).children); got == 0 {
+		t.Error("groupPath layout has no children")
+	}
+}
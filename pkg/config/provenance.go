@@ -0,0 +1,148 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// SettingOrigin tells where the value of a module setting of the expanded
+// blueprint comes from
+type SettingOrigin string
+
+const (
+	// OriginExplicit means the setting is set in the blueprint
+	OriginExplicit SettingOrigin = "explicit"
+	// OriginModuleDefaults means the setting is taken from module_defaults
+	// matching the module source
+	OriginModuleDefaults SettingOrigin = "module_defaults"
+	// OriginUse means the setting is set to, or appended, outputs of modules
+	// in the use field
+	OriginUse SettingOrigin = "use"
+	// OriginVar means the setting is set to the deployment variable of the
+	// same name
+	OriginVar SettingOrigin = "var"
+	// OriginCommandLine means the setting is set to a deployment variable of
+	// the same name given on the command line, overriding the blueprint
+	OriginCommandLine SettingOrigin = "command_line"
+	// OriginGhpc means the setting is generated by ghpc, e.g. the module ID
+	// or the startup script rendered from startup_script_parts
+	OriginGhpc SettingOrigin = "ghpc"
+)
+
+// SettingProvenance is where the value of a module setting comes from
+type SettingProvenance struct {
+	Origin SettingOrigin
+	// From is the used modules, the deployment variable, the module_defaults
+	// pattern, or what ghpc generated the setting from
+	From []string
+}
+
+// recordOrigin records where the value of the setting comes from, settings
+// set in the blueprint are not recorded
+func (m *Module) recordOrigin(setting string, o SettingOrigin, from string) {
+	if m.provenance == nil {
+		m.provenance = map[string]SettingProvenance{}
+	}
+	m.provenance[setting] = SettingProvenance{Origin: o, From: []string{from}}
+}
+
+// renameOrigin moves the provenance of a setting renamed by an alias
+func (m *Module) renameOrigin(from string, to string) {
+	if p, ok := m.provenance[from]; ok {
+		m.provenance[to] = p
+		delete(m.provenance, from)
+	}
+}
+
+// MarkCommandLineVars records deployment variables set on the command line,
+// so that module settings taken from them are reported as such
+func (bp *Blueprint) MarkCommandLineVars(names ...string) {
+	bp.commandLineVars = append(bp.commandLineVars, names...)
+}
+
+// varOrigin returns the origin of a module setting set to the deployment
+// variable
+func (bp Blueprint) varOrigin(name string) SettingOrigin {
+	if slices.Contains(bp.commandLineVars, name) {
+		return OriginCommandLine
+	}
+	return OriginVar
+}
+
+// Provenance returns where the value of the setting comes from, it is only
+// known for modules of blueprints expanded in this process
+func (m Module) Provenance(setting string) SettingProvenance {
+	used := []string{}
+	for _, u := range m.useReport {
+		if u.Setting == setting && (u.Outcome == UseInjected || u.Outcome == UseAppended) {
+			used = append(used, string(u.Used))
+		}
+	}
+	if len(used) > 0 {
+		return SettingProvenance{Origin: OriginUse, From: used}
+	}
+	if p, ok := m.provenance[setting]; ok {
+		return p
+	}
+	return SettingProvenance{Origin: OriginExplicit}
+}
+
+func (p SettingProvenance) String() string {
+	from := strings.Join(p.From, ", ")
+	switch p.Origin {
+	case OriginModuleDefaults:
+		return fmt.Sprintf("from module_defaults of %s", from)
+	case OriginUse:
+		return fmt.Sprintf("from use of %s", from)
+	case OriginVar:
+		return fmt.Sprintf("from deployment variable %s", from)
+	case OriginCommandLine:
+		return fmt.Sprintf("from deployment variable %s, set on the command line", from)
+	case OriginGhpc:
+		return fmt.Sprintf("set by ghpc from %s", from)
+	}
+	return "set in the blueprint"
+}
+
+// annotateSettingOrigins comments module settings of the exported blueprint
+// with their origin, settings set in the blueprint are left as they are
+func (bp Blueprint) annotateSettingOrigins(doc *yaml.Node) {
+	groups := seqItems(mappingValue(doc, "deployment_groups"))
+	for ig, g := range bp.DeploymentGroups {
+		if ig >= len(groups) {
+			return
+		}
+		mods := seqItems(mappingValue(groups[ig], "modules"))
+		for im, m := range g.Modules {
+			if im >= len(mods) {
+				break
+			}
+			settings := mappingValue(mods[im], "settings")
+			if settings == nil {
+				continue
+			}
+			for _, k := range mappingKeys(settings) {
+				if p := m.Provenance(k); p.Origin != OriginExplicit {
+					mappingKey(settings, k).LineComment = p.String()
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestProvenance(c *C) {
+	m := Module{ID: "vm", useReport: []UseInjection{
+		{Used: "net", Setting: "network_self_link", Outcome: UseInjected},
+		{Used: "fs0", Setting: "network_storage", Outcome: UseAppended},
+		{Used: "fs1", Setting: "network_storage", Outcome: UseAppended},
+		{Used: "net", Setting: "subnetwork_self_link", Outcome: UseSkipped},
+	}}
+	m.recordOrigin("zone", OriginVar, "zone")
+	m.recordOrigin("machine_type", OriginModuleDefaults, "modules/compute/*")
+	m.recordOrigin("node_count_static", OriginModuleDefaults, "modules/compute/*")
+	m.renameOrigin("node_count_static", "static_node_count")
+
+	c.Check(m.Provenance("network_self_link"), DeepEquals, SettingProvenance{OriginUse, []string{"net"}})
+	c.Check(m.Provenance("network_storage").String(), Equals, "from use of fs0, fs1")
+	c.Check(m.Provenance("subnetwork_self_link").Origin, Equals, OriginExplicit)
+	c.Check(m.Provenance("zone").String(), Equals, "from deployment variable zone")
+	c.Check(m.Provenance("machine_type").String(), Equals, "from module_defaults of modules/compute/*")
+	c.Check(m.Provenance("node_count_static").Origin, Equals, OriginExplicit)
+	c.Check(m.Provenance("static_node_count").Origin, Equals, OriginModuleDefaults)
+	c.Check(m.Provenance("name").String(), Equals, "set in the blueprint")
+
+	bp := Blueprint{}
+	bp.MarkCommandLineVars("project_id")
+	c.Check(bp.varOrigin("project_id"), Equals, OriginCommandLine)
+	c.Check(bp.varOrigin("zone"), Equals, OriginVar)
+}
+
+func (s *zeroSuite) TestExportAnnotatesSettingOrigins(c *C) {
+	m := Module{
+		ID:     "vm",
+		Source: "modules/compute/vm-instance",
+		Kind:   TerraformKind,
+		Settings: NewDict(map[string]cty.Value{
+			"name_prefix": cty.StringVal("vm"),
+			"project_id":  GlobalRef("project_id").AsValue(),
+			"zone":        GlobalRef("zone").AsValue(),
+		})}
+	m.recordOrigin("project_id", OriginCommandLine, "project_id")
+	m.recordOrigin("zone", OriginVar, "zone")
+	bp := Blueprint{
+		BlueprintName: "bp",
+		Vars: NewDict(map[string]cty.Value{
+			"project_id": cty.StringVal("p"),
+			"zone":       cty.StringVal("z"),
+		}),
+		DeploymentGroups: []DeploymentGroup{{Name: "g", Modules: []Module{m}}},
+	}
+
+	out := filepath.Join(c.MkDir(), "expanded.yaml")
+	c.Assert(bp.Export(out), IsNil)
+	b, err := os.ReadFile(out)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Matches, `(?s).*\n +name_prefix: vm\n.*`)
+	c.Check(string(b), Matches, `(?s).*\n +project_id: \(\(var.project_id\)\) # from deployment variable project_id, set on the command line\n.*`)
+	c.Check(string(b), Matches, `(?s).*\n +zone: \(\(var.zone\)\) # from deployment variable zone\n.*`)
+
+	got, _, err := NewBlueprint(out)
+	c.Assert(err, IsNil)
+	c.Check(got.DeploymentGroups[0].Modules[0].Settings.Items(), DeepEquals, m.Settings.Items())
+}
@@ -0,0 +1,272 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"gopkg.in/yaml.v3"
+)
+
+// textEdit rewrites a line of the blueprint starting at the given byte offset
+type textEdit struct {
+	line   int // 0-based
+	offset int
+	apply  func(rest string) (string, error)
+}
+
+// RenameModule renames module `from` to `to` in the blueprint YAML data. The
+// ID of the module, `use` entries and references in expressions are rewritten.
+// Lines are edited in place, so comments and formatting of the blueprint are
+// kept.
+func RenameModule(data []byte, from ModuleID, to ModuleID) ([]byte, error) {
+	if to == "" {
+		return nil, EmptyModuleID
+	}
+	if to == "vars" || !hclsyntax.ValidIdentifier(string(to)) {
+		return nil, fmt.Errorf("%q is not a valid module id", to)
+	}
+
+	var c nodeCapturer
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, parseYamlV3Error(err)
+	}
+	idNodes, useNodes := moduleIDNodes(c.n)
+	if err := checkRenamedIDs(idNodes, from, to); err != nil {
+		return nil, err
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	edits := idEdits(lines, append(idNodes, useNodes...), from, to)
+	edits = append(edits, referenceEdits(lines, c.n, from, to)...)
+	if err := applyEdits(lines, edits); err != nil {
+		return nil, err
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// checkRenamedIDs ensures that module `from` exists and module `to` does not
+func checkRenamedIDs(idNodes []*yaml.Node, from ModuleID, to ModuleID) error {
+	found := false
+	for _, n := range idNodes {
+		found = found || n.Value == string(from)
+		if n.Value == string(to) {
+			return fmt.Errorf("module %q already exists", to)
+		}
+	}
+	if !found {
+		return fmt.Errorf("module %q does not exist", from)
+	}
+	return nil
+}
+
+// idEdits rewrite module IDs and `use` entries naming module `from`
+func idEdits(lines []string, nodes []*yaml.Node, from ModuleID, to ModuleID) []textEdit {
+	edits := []textEdit{}
+	for _, n := range nodes {
+		if n.Value != string(from) {
+			continue
+		}
+		line, offset := n.Line-1, columnOffset(lines[n.Line-1], n.Column)
+		edits = append(edits, textEdit{line, offset, func(rest string) (string, error) {
+			q := strings.TrimLeft(rest, `"'`)
+			if !strings.HasPrefix(q, string(from)) {
+				return "", fmt.Errorf("can not find module id %q at line %d", from, line+1)
+			}
+			return rest[:len(rest)-len(q)] + string(to) + q[len(from):], nil
+		}})
+	}
+	return edits
+}
+
+// referenceEdits rewrite references to module `from` in expressions of
+// scalars of the document, on every line they span
+func referenceEdits(lines []string, root *yaml.Node, from ModuleID, to ModuleID) []textEdit {
+	edits := []textEdit{}
+	nodeLines := allNodeLines(root)
+	refs := referenceRenamer(from, to)
+	walkValueScalars(root, func(n *yaml.Node) {
+		hcl := isHCLLiteral(n.Value)
+		if refs(n.Value, hcl) == n.Value {
+			return
+		}
+		// multi-line scalars span lines up to the next node
+		last := n.Line
+		if strings.Contains(n.Value, "\n") {
+			last = len(lines)
+			if i := sort.SearchInts(nodeLines, n.Line+1); i < len(nodeLines) {
+				last = nodeLines[i] - 1
+			}
+		}
+		for l := n.Line; l <= last; l++ {
+			offset := 0
+			if l == n.Line {
+				offset = columnOffset(lines[l-1], n.Column)
+			}
+			edits = append(edits, textEdit{l - 1, offset, func(rest string) (string, error) {
+				return refs(rest, hcl), nil
+			}})
+		}
+	})
+	return edits
+}
+
+// applyEdits applies edits from the end of each line, so offsets of other
+// edits hold
+func applyEdits(lines []string, edits []textEdit) error {
+	sort.SliceStable(edits, func(i, j int) bool {
+		if edits[i].line != edits[j].line {
+			return edits[i].line < edits[j].line
+		}
+		return edits[i].offset > edits[j].offset
+	})
+	for _, e := range edits {
+		rest, err := e.apply(lines[e.line][e.offset:])
+		if err != nil {
+			return err
+		}
+		lines[e.line] = lines[e.line][:e.offset] + rest
+	}
+	return nil
+}
+
+// moduleIDNodes returns nodes of module IDs and of entries of `use` lists
+func moduleIDNodes(root *yaml.Node) ([]*yaml.Node, []*yaml.Node) {
+	ids, uses := []*yaml.Node{}, []*yaml.Node{}
+	for _, g := range seqItems(mappingValue(root, "deployment_groups")) {
+		for _, m := range seqItems(mappingValue(g, "modules")) {
+			if id := mappingValue(m, "id"); id != nil && id.Kind == yaml.ScalarNode {
+				ids = append(ids, id)
+			}
+			for _, u := range seqItems(mappingValue(m, "use")) {
+				if u.Kind == yaml.ScalarNode {
+					uses = append(uses, u)
+				}
+			}
+		}
+	}
+	return ids, uses
+}
+
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func seqItems(n *yaml.Node) []*yaml.Node {
+	if n == nil || n.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return n.Content
+}
+
+// walkValueScalars calls f on all scalars of the document but mapping keys
+func walkValueScalars(n *yaml.Node, f func(*yaml.Node)) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		f(n)
+	case yaml.MappingNode:
+		for i := 1; i < len(n.Content); i += 2 {
+			walkValueScalars(n.Content[i], f)
+		}
+	case yaml.SequenceNode, yaml.DocumentNode:
+		for _, c := range n.Content {
+			walkValueScalars(c, f)
+		}
+	}
+}
+
+// allNodeLines returns sorted lines where nodes of the document start
+func allNodeLines(root *yaml.Node) []int {
+	lines := []int{}
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		lines = append(lines, n.Line)
+		for _, c := range n.Content {
+			walk(c)
+		}
+	}
+	walk(root)
+	sort.Ints(lines)
+	return lines
+}
+
+// columnOffset converts 1-based column of YAML node to byte offset in line
+func columnOffset(line string, col int) int {
+	offset := 0
+	for i := 1; i < col && offset < len(line); i++ {
+		_, size := utf8.DecodeRuneInString(line[offset:])
+		offset += size
+	}
+	return offset
+}
+
+// referenceRenamer returns a function that renames references to module
+// `from` in a blueprint string, in `$(...)` expressions or in the whole
+// string if it is a HCL literal
+func referenceRenamer(from ModuleID, to ModuleID) func(s string, hcl bool) string {
+	re := regexp.MustCompile(`(^|[^\w.\-])` + regexp.QuoteMeta(string(from)) + `\.`)
+	rename := func(s string) string {
+		return re.ReplaceAllString(s, "${1}"+string(to)+".")
+	}
+
+	return func(s string, hcl bool) string {
+		if hcl {
+			return rename(s)
+		}
+		var sb strings.Builder
+		for {
+			i := strings.Index(s, "$(")
+			if i == -1 {
+				sb.WriteString(s)
+				return sb.String()
+			}
+			end := matchingParen(s, i+1)
+			sb.WriteString(s[:i])
+			sb.WriteString(rename(s[i:end]))
+			s = s[end:]
+		}
+	}
+}
+
+// matchingParen returns offset past the parenthesis closing the one at open,
+// or length of s if it is not closed
+func matchingParen(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(s)
+}
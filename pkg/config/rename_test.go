@@ -0,0 +1,98 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestRenameModule(c *C) {
+	bp := `blueprint_name: test # keep me
+
+deployment_groups:
+- group: primary
+  modules:
+  # the network
+  - id: net
+    source: modules/network/vpc
+
+  - id: "homefs"
+    source: modules/file-system/filestore
+    use: [net]
+
+- group: secondary
+  modules:
+  - id: vm
+    source: modules/compute/vm-instance
+    use:
+    - net
+    - homefs
+    settings:
+      subnet: $(net.subnetwork_self_link) # from the net
+      name: "$(vars.net.name)-$(net.network_name)"
+      other: $(network.x)
+      script: |
+        echo $(net.network_name)
+        echo net.network_name
+      hcl: ((join(",", [net.network_name, vars.net])))
+`
+	got, err := RenameModule([]byte(bp), "net", "network1")
+	c.Assert(err, IsNil)
+	c.Check(string(got), Equals, `blueprint_name: test # keep me
+
+deployment_groups:
+- group: primary
+  modules:
+  # the network
+  - id: network1
+    source: modules/network/vpc
+
+  - id: "homefs"
+    source: modules/file-system/filestore
+    use: [network1]
+
+- group: secondary
+  modules:
+  - id: vm
+    source: modules/compute/vm-instance
+    use:
+    - network1
+    - homefs
+    settings:
+      subnet: $(network1.subnetwork_self_link) # from the net
+      name: "$(vars.net.name)-$(network1.network_name)"
+      other: $(network.x)
+      script: |
+        echo $(network1.network_name)
+        echo net.network_name
+      hcl: ((join(",", [network1.network_name, vars.net])))
+`)
+
+	got, err = RenameModule([]byte(bp), "homefs", "home")
+	c.Assert(err, IsNil)
+	c.Check(string(got), Matches, `(?s).*- id: "home"\n.*    - home\n.*`)
+
+	_, err = RenameModule([]byte(bp), "nope", "other")
+	c.Check(err, ErrorMatches, `module "nope" does not exist`)
+
+	_, err = RenameModule([]byte(bp), "net", "vm")
+	c.Check(err, ErrorMatches, `module "vm" already exists`)
+
+	_, err = RenameModule([]byte(bp), "net", "vars")
+	c.Check(err, ErrorMatches, `"vars" is not a valid module id`)
+
+	_, err = RenameModule([]byte(bp), "net", "a.b")
+	c.Check(err, ErrorMatches, `"a.b" is not a valid module id`)
+}
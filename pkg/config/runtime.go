@@ -0,0 +1,76 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+// runtimeModuleID is the root of references to values only known when the
+// deployment is deployed, `$(runtime.subnet)` parses to a reference to output
+// "subnet" of module "runtime"
+const runtimeModuleID ModuleID = "runtime"
+
+// IsRuntime tells whether the reference is to a value resolved by
+// `ghpc deploy`, rather than when the blueprint is expanded
+func (r Reference) IsRuntime() bool {
+	return !r.GlobalVar && r.Module == runtimeModuleID
+}
+
+// RuntimeVarName is the name of the terraform variable of the deployment group
+// holding the runtime value
+func RuntimeVarName(name string) string {
+	return "runtime_" + name
+}
+
+// RuntimeReferences returns references to runtime values made by settings of
+// modules of the group, sorted by name
+func (dg DeploymentGroup) RuntimeReferences() []Reference {
+	seen := map[Reference]bool{}
+	res := []Reference{}
+	for _, m := range dg.Modules {
+		for r := range valueReferences(m.Settings.AsObject()) {
+			if r.IsRuntime() && !seen[r] {
+				seen[r] = true
+				res = append(res, r)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// validateRuntimeReference ensures that a runtime value is referred to by a
+// terraform module and does not clash with a deployment variable
+func validateRuntimeReference(bp Blueprint, mod Module, r Reference) error {
+	if _, err := bp.Module(runtimeModuleID); err == nil {
+		return fmt.Errorf("module id %q is reserved for references to runtime values", runtimeModuleID)
+	}
+	if mod.Kind == PackerKind {
+		return fmt.Errorf("runtime values can only be used by terraform modules, module %q is a Packer module", mod.ID)
+	}
+	if !hclsyntax.ValidIdentifier(r.Name) {
+		return fmt.Errorf("runtime value name must be a valid identifier, got %q", r.Name)
+	}
+	if n := RuntimeVarName(r.Name); bp.Vars.Has(n) {
+		return HintError{
+			Hint: fmt.Sprintf("rename deployment variable %q", n),
+			Err:  fmt.Errorf("deployment variable %q conflicts with the terraform variable of runtime value %q", n, r.Name)}
+	}
+	return nil
+}
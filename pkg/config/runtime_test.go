@@ -0,0 +1,54 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestRuntimeReferences(c *C) {
+	subnet, err := parseYamlString("$(runtime.subnet)")
+	c.Assert(err, IsNil)
+	name, err := parseYamlString("$(vars.deployment_name)-$(runtime.runner)-$(runtime.subnet)")
+	c.Assert(err, IsNil)
+
+	g := DeploymentGroup{Modules: []Module{
+		{ID: "a", Settings: NewDict(map[string]cty.Value{"subnetwork_self_link": subnet, "name": name})},
+		{ID: "b", Settings: NewDict(map[string]cty.Value{"zone": GlobalRef("zone").AsValue()})},
+	}}
+	c.Check(g.RuntimeReferences(), DeepEquals, []Reference{
+		ModuleRef("runtime", "runner"), ModuleRef("runtime", "subnet")})
+	c.Check(ModuleRef("runtime", "subnet").IsRuntime(), Equals, true)
+	c.Check(GlobalRef("runtime").IsRuntime(), Equals, false)
+	c.Check(DeploymentGroup{}.RuntimeReferences(), HasLen, 0)
+}
+
+func (s *zeroSuite) TestValidateRuntimeReference(c *C) {
+	tf := Module{ID: "vm", Kind: TerraformKind}
+	bp := Blueprint{
+		Vars:             NewDict(map[string]cty.Value{"runtime_zone": cty.StringVal("us-central1-a")}),
+		DeploymentGroups: []DeploymentGroup{{Name: "g", Modules: []Module{tf}}}}
+
+	c.Check(validateRuntimeReference(bp, tf, ModuleRef("runtime", "subnet")), IsNil)
+	c.Check(validateRuntimeReference(bp, Module{ID: "img", Kind: PackerKind}, ModuleRef("runtime", "subnet")),
+		ErrorMatches, `runtime values can only be used by terraform modules, module "img" is a Packer module`)
+	c.Check(validateRuntimeReference(bp, tf, ModuleRef("runtime", "zone")),
+		ErrorMatches, `deployment variable "runtime_zone" conflicts with .* - rename deployment variable "runtime_zone"`)
+
+	bp.DeploymentGroups[0].Modules = append(bp.DeploymentGroups[0].Modules, Module{ID: "runtime"})
+	c.Check(validateRuntimeReference(bp, tf, ModuleRef("runtime", "subnet")),
+		ErrorMatches, `module id "runtime" is reserved for references to runtime values`)
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// Implicit expansions that can be skipped with skip_expansions, either for
+// every module of the blueprint or for a single module. "vars" and "use" can
+// be narrowed to a single setting, e.g. "vars.deployment_name".
+const (
+	// SkipLabels stops merging vars.labels into module labels; skipped for the
+	// whole blueprint it also stops adding ghpc_blueprint and ghpc_deployment
+	// to vars.labels
+	SkipLabels = "labels"
+	// SkipVars stops setting module inputs to deployment variables of the same name
+	SkipVars = "vars"
+	// SkipUse stops setting module inputs to outputs of used modules
+	SkipUse = "use"
+)
+
+func validateSkipExpansion(s string) error {
+	kind, name, narrowed := strings.Cut(s, ".")
+	switch {
+	case kind == SkipLabels && !narrowed:
+		return nil
+	case (kind == SkipVars || kind == SkipUse) && (!narrowed || name != ""):
+		return nil
+	}
+	return fmt.Errorf("unknown expansion %q, expected one of %q, %q, %q, \"vars.SETTING\" or \"use.SETTING\"",
+		s, SkipLabels, SkipVars, SkipUse)
+}
+
+func validateSkipExpansions(bp Blueprint) error {
+	errs := Errors{}
+	for i, s := range bp.SkipExpansions {
+		errs.At(Root.SkipExpansions.At(i), validateSkipExpansion(s))
+	}
+	bp.WalkModulesSafe(func(p ModulePath, m *Module) {
+		for i, s := range m.SkipExpansions {
+			errs.At(p.SkipExpansions.At(i), validateSkipExpansion(s))
+		}
+	})
+	return errs.OrNil()
+}
+
+// SkipExpansion skips the implicit expansion for every module of the blueprint
+func (bp *Blueprint) SkipExpansion(s string) {
+	if !slices.Contains(bp.SkipExpansions, s) {
+		bp.SkipExpansions = append(bp.SkipExpansions, s)
+	}
+}
+
+// skipsExpansion returns whether the expansion of kind is skipped for the
+// setting of the module, by the blueprint or by the module itself
+func (bp Blueprint) skipsExpansion(m Module, kind string, setting string) bool {
+	for _, skips := range [][]string{bp.SkipExpansions, m.SkipExpansions} {
+		if slices.Contains(skips, kind) || (setting != "" && slices.Contains(skips, kind+"."+setting)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"hpc-toolkit/pkg/modulereader"
+
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/slices"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestValidateSkipExpansion(c *C) {
+	for _, ok := range []string{"labels", "vars", "use", "vars.deployment_name", "use.network_self_link"} {
+		c.Check(validateSkipExpansion(ok), IsNil, Commentf("%q", ok))
+	}
+	for _, bad := range []string{"", "label", "labels.x", "vars.", "use."} {
+		c.Check(validateSkipExpansion(bad), ErrorMatches, `unknown expansion .*`, Commentf("%q", bad))
+	}
+
+	bp := Blueprint{
+		SkipExpansions:   []string{"labels"},
+		DeploymentGroups: []DeploymentGroup{{Modules: []Module{{SkipExpansions: []string{"vars", "usage"}}}}},
+	}
+	c.Check(validateSkipExpansions(bp), ErrorMatches, `.*unknown expansion "usage".*`)
+}
+
+func (s *zeroSuite) TestSkipsExpansion(c *C) {
+	bp := Blueprint{SkipExpansions: []string{"use.network_self_link"}}
+	m := Module{SkipExpansions: []string{"vars", "labels"}}
+
+	c.Check(bp.skipsExpansion(m, SkipUse, "network_self_link"), Equals, true)
+	c.Check(bp.skipsExpansion(m, SkipUse, "subnetwork_self_link"), Equals, false)
+	c.Check(bp.skipsExpansion(m, SkipVars, "deployment_name"), Equals, true)
+	c.Check(bp.skipsExpansion(m, SkipLabels, ""), Equals, true)
+	c.Check(bp.skipsExpansion(Module{}, SkipLabels, ""), Equals, false)
+
+	bp.SkipExpansion("use.network_self_link")
+	bp.SkipExpansion("labels")
+	c.Check(bp.SkipExpansions, DeepEquals, []string{"use.network_self_link", "labels"})
+}
+
+func (s *zeroSuite) TestSkipExpansionsInModule(c *C) {
+	info := modulereader.ModuleInfo{
+		Inputs: []modulereader.VarInfo{{Name: "labels"}, {Name: "deployment_name"}, {Name: "project_id"}}}
+	mod := Module{ID: "vm", Source: c.TestName() + "/vm"}
+	setTestModuleInfo(mod, info)
+	bp := Blueprint{Vars: NewDict(map[string]cty.Value{
+		"labels":          cty.EmptyObjectVal,
+		"deployment_name": cty.StringVal("golden"),
+		"project_id":      cty.StringVal("p"),
+	})}
+	keys := func(d Dict) []string {
+		ks := d.Keys()
+		slices.Sort(ks)
+		return ks
+	}
+
+	{ // nothing skipped
+		m := mod
+		m.Settings = Dict{}
+		bp.applyGlobalVarsInModule(&m)
+		c.Check(keys(m.Settings), DeepEquals, []string{"deployment_name", "labels", "project_id"})
+	}
+
+	{ // labels and deployment_name skipped by the module
+		m := mod
+		m.Settings = Dict{}
+		m.SkipExpansions = []string{"labels", "vars.deployment_name"}
+		bp.applyGlobalVarsInModule(&m)
+		c.Check(keys(m.Settings), DeepEquals, []string{"project_id"})
+	}
+
+	{ // all deployment variables skipped by the blueprint, explicit labels are kept as is
+		m := mod
+		m.Settings = NewDict(map[string]cty.Value{"labels": cty.EmptyObjectVal})
+		bp := bp
+		bp.SkipExpansions = []string{"vars", "labels"}
+		bp.applyGlobalVarsInModule(&m)
+		c.Check(m.Settings.Items(), DeepEquals, map[string]cty.Value{"labels": cty.EmptyObjectVal})
+	}
+}
+
+func (s *zeroSuite) TestSkipGlobalLabels(c *C) {
+	bp := Blueprint{BlueprintName: "golden", SkipExpansions: []string{"labels"}}
+	bp.expandGlobalLabels()
+	c.Check(bp.Vars.Has("labels"), Equals, false)
+}
@@ -0,0 +1,213 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// StackBlueprints combines blueprints deployed into a single deployment. The
+// first blueprint is the base of the deployment, groups of other blueprints
+// are deployed after its groups. Module IDs and group names are shared by all
+// blueprints, so modules can use and reference modules of other blueprints.
+// Deployment-wide settings, e.g. terraform_backend_defaults, can only be set
+// by one of the blueprints and deployment variables set by several blueprints
+// must have the same value.
+func StackBlueprints(bps []Blueprint) (Blueprint, error) {
+	if len(bps) == 0 {
+		return Blueprint{}, fmt.Errorf("no blueprints to stack")
+	}
+	res := bps[0]
+	// clone to not modify the base blueprint
+	res.Vars = NewDict(res.Vars.Items())
+	res.VarDeclarations = maps.Clone(res.VarDeclarations)
+	res.DeploymentGroups = slices.Clone(res.DeploymentGroups)
+	res.Validators = slices.Clone(res.Validators)
+	res.CustomValidators = slices.Clone(res.CustomValidators)
+	res.HealthChecks = slices.Clone(res.HealthChecks)
+	res.Experimental = slices.Clone(res.Experimental)
+	res.warnings = slices.Clone(res.warnings)
+
+	for _, b := range bps[1:] {
+		if err := res.stack(b); err != nil {
+			return Blueprint{}, fmt.Errorf("can not stack blueprint %q on %q: %w", b.BlueprintName, res.BlueprintName, err)
+		}
+	}
+	return res, nil
+}
+
+func (bp *Blueprint) stack(b Blueprint) error {
+	if err := bp.checkStackedNames(b); err != nil {
+		return err
+	}
+	if err := bp.stackVars(b); err != nil {
+		return err
+	}
+	if err := bp.stackDeploymentWide(b); err != nil {
+		return err
+	}
+	bp.stackLists(b)
+	return nil
+}
+
+// checkStackedNames ensures that groups and modules of the stacked blueprint
+// are not defined by the blueprint already
+func (bp Blueprint) checkStackedNames(b Blueprint) error {
+	groups, ids := map[GroupName]bool{}, map[ModuleID]bool{}
+	for _, g := range bp.DeploymentGroups {
+		groups[g.Name] = true
+		for _, m := range g.Modules {
+			ids[m.ID] = true
+		}
+	}
+	for _, g := range b.DeploymentGroups {
+		if groups[g.Name] {
+			return fmt.Errorf("deployment group %q is defined by both blueprints", g.Name)
+		}
+		for _, m := range g.Modules {
+			if ids[m.ID] {
+				return fmt.Errorf("module %q is defined by both blueprints", m.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// stackVars merges deployment variables, which must be set and declared the
+// same by both blueprints
+func (bp *Blueprint) stackVars(b Blueprint) error {
+	for k, v := range b.Vars.Items() {
+		if bp.Vars.Has(k) && !bp.Vars.Get(k).RawEquals(v) {
+			return HintError{
+				Err:  fmt.Errorf("deployment variable %q is set to different values", k),
+				Hint: "set it in only one of the blueprints, or with --vars"}
+		}
+		bp.Vars.Set(k, v)
+	}
+	for k, d := range b.VarDeclarations {
+		if prev, ok := bp.VarDeclarations[k]; ok && prev != d {
+			return fmt.Errorf("deployment variable %q is declared differently", k)
+		}
+		if bp.VarDeclarations == nil {
+			bp.VarDeclarations = map[string]VarDeclaration{}
+		}
+		bp.VarDeclarations[k] = d
+	}
+	return nil
+}
+
+// stackDeploymentWide sets deployment-wide settings of the stacked blueprint,
+// which can only be set by one of the blueprints
+func (bp *Blueprint) stackDeploymentWide(b Blueprint) error {
+	deploymentWide := []struct {
+		name string
+		dst  interface{}
+		src  interface{}
+	}{
+		{"terraform_backend_defaults", &bp.TerraformBackendDefaults, b.TerraformBackendDefaults},
+		{"terraform_providers", &bp.TerraformProviders, b.TerraformProviders},
+		{"deployment_layout", &bp.DeploymentLayout, b.DeploymentLayout},
+		{"monitoring", &bp.Monitoring, b.Monitoring},
+		{"artifacts_encryption", &bp.ArtifactsEncryption, b.ArtifactsEncryption},
+		{"state_backups", &bp.StateBackups, b.StateBackups},
+		{"credentials", &bp.Credentials, b.Credentials},
+		{"module_registry", &bp.ModuleRegistry, b.ModuleRegistry},
+		{"module_defaults", &bp.ModuleDefaults, b.ModuleDefaults},
+		{"zone_policy", &bp.ZonePolicy, b.ZonePolicy},
+		{"images", &bp.Images, b.Images},
+	}
+	for _, s := range deploymentWide {
+		if reflect.ValueOf(s.src).IsZero() {
+			continue
+		}
+		dst := reflect.ValueOf(s.dst).Elem()
+		if !dst.IsZero() {
+			return fmt.Errorf("%s can only be set by one of the blueprints", s.name)
+		}
+		dst.Set(reflect.ValueOf(s.src))
+	}
+	return nil
+}
+
+// stackLists appends groups, validators and other lists of the stacked
+// blueprint
+func (bp *Blueprint) stackLists(b Blueprint) {
+	// module sources are relative to the blueprint they are declared in
+	for _, g := range b.DeploymentGroups {
+		g.Modules = append([]Module{}, g.Modules...)
+		for im := range g.Modules {
+			g.Modules[im].Source = b.stackedModuleSource(g.Modules[im].Source)
+		}
+		bp.DeploymentGroups = append(bp.DeploymentGroups, g)
+	}
+	appended := []struct {
+		dst interface{}
+		src interface{}
+	}{
+		{&bp.Validators, b.Validators},
+		{&bp.CustomValidators, b.CustomValidators},
+		{&bp.HealthChecks, b.HealthChecks},
+		{&bp.DataSources, b.DataSources},
+		{&bp.warnings, b.warnings},
+	}
+	for _, a := range appended {
+		dst := reflect.ValueOf(a.dst).Elem()
+		dst.Set(reflect.AppendSlice(dst, reflect.ValueOf(a.src)))
+	}
+	for _, f := range b.Experimental {
+		if !slices.Contains(bp.Experimental, f) {
+			bp.Experimental = append(bp.Experimental, f)
+		}
+	}
+	for _, s := range b.SkipExpansions {
+		bp.SkipExpansion(s)
+	}
+}
+
+// stackedModuleSource resolves source of module of a stacked blueprint, so it
+// is independent from source_roots and source_base of the base blueprint.
+// Sources given as expressions are resolved along with the base blueprint.
+func (bp Blueprint) stackedModuleSource(src string) string {
+	if v, err := parseYamlString(src); err != nil {
+		return src // reported when the stacked blueprint is expanded
+	} else if _, is := IsExpressionValue(v); is {
+		return src
+	}
+	src = bp.resolveModuleSource(src)
+	if strings.HasPrefix(src, "./") || strings.HasPrefix(src, "../") {
+		if abs, err := filepath.Abs(src); err == nil {
+			return abs
+		}
+	}
+	return src
+}
+
+// StackedYamlCtx returns context to render errors of stacked blueprints given
+// context of the base blueprint. Errors in other blueprints can not be pointed
+// to in the base blueprint file, so positions of sections they contribute to
+// are removed, not to point to the enclosing section of the base blueprint.
+func StackedYamlCtx(base YamlCtx) YamlCtx {
+	res := YamlCtx{pathToPos: maps.Clone(base.pathToPos), Lines: base.Lines}
+	for _, p := range []Path{Root, Root.Vars, Root.VarDeclarations, Root.Groups, Root.Validators, Root.CustomValidators, Root.HealthChecks} {
+		delete(res.pathToPos, yPath(p.String()))
+	}
+	return res
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"path/filepath"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestStackBlueprints(c *C) {
+	base := func() Blueprint {
+		return Blueprint{
+			BlueprintName: "base",
+			Vars: NewDict(map[string]cty.Value{
+				"project_id":      cty.StringVal("p"),
+				"deployment_name": cty.StringVal("d")}),
+			TerraformBackendDefaults: TerraformBackend{Type: "gcs"},
+			DeploymentGroups: []DeploymentGroup{{Name: "infra", Modules: []Module{
+				{ID: "net", Source: "modules/network/vpc"}}}},
+		}
+	}
+	workload := func() Blueprint {
+		return Blueprint{
+			BlueprintName: "workload",
+			Vars:          NewDict(map[string]cty.Value{"project_id": cty.StringVal("p")}),
+			SourceBase:    SourceBaseBlueprint,
+			dir:           "/workload",
+			DeploymentGroups: []DeploymentGroup{{Name: "jobs", Modules: []Module{
+				{ID: "vm", Source: "./modules/vm", Use: ModuleIDs{"net"}}}}},
+		}
+	}
+
+	{ // Success
+		b := base()
+		got, err := StackBlueprints([]Blueprint{b, workload()})
+		c.Assert(err, IsNil)
+		c.Check(got.BlueprintName, Equals, "base")
+		c.Check(got.TerraformBackendDefaults.Type, Equals, "gcs")
+		c.Check(got.DeploymentGroups, HasLen, 2)
+		c.Check(got.DeploymentGroups[1].Modules[0].Source, Equals, filepath.Join("/workload", "modules/vm"))
+		c.Check(got.Vars.Items(), HasLen, 2)
+		c.Check(b.DeploymentGroups, HasLen, 1) // base is not modified
+	}
+
+	{ // experimental features enabled by any blueprint are enabled
+		b, w := base(), workload()
+		b.Experimental = []string{ExperimentGroupForEach}
+		w.Experimental = []string{ExperimentGroupForEach}
+		got, err := StackBlueprints([]Blueprint{b, w})
+		c.Assert(err, IsNil)
+		c.Check(got.Experimental, DeepEquals, []string{ExperimentGroupForEach})
+	}
+
+	{ // Fail: duplicate module
+		w := workload()
+		w.DeploymentGroups[0].Modules[0].ID = "net"
+		_, err := StackBlueprints([]Blueprint{base(), w})
+		c.Check(err, ErrorMatches, `can not stack blueprint "workload" on "base": module "net" is defined by both blueprints`)
+	}
+
+	{ // Fail: duplicate group
+		w := workload()
+		w.DeploymentGroups[0].Name = "infra"
+		_, err := StackBlueprints([]Blueprint{base(), w})
+		c.Check(err, ErrorMatches, `.*deployment group "infra" is defined by both blueprints`)
+	}
+
+	{ // Fail: conflicting variable
+		w := workload()
+		w.Vars.Set("project_id", cty.StringVal("other"))
+		_, err := StackBlueprints([]Blueprint{base(), w})
+		c.Check(err, ErrorMatches, `.*deployment variable "project_id" is set to different values.*`)
+	}
+
+	{ // Fail: deployment-wide setting set by both
+		w := workload()
+		w.TerraformBackendDefaults = TerraformBackend{Type: "gcs"}
+		_, err := StackBlueprints([]Blueprint{base(), w})
+		c.Check(err, ErrorMatches, `.*terraform_backend_defaults can only be set by one of the blueprints`)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/modulereader"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/slices"
+)
+
+const startupScriptSetting = "startup_script"
+
+// MaxStartupScriptSize is the limit of a metadata value on Compute Engine
+const MaxStartupScriptSize = 256 * 1024
+
+const defaultShebang = "#!/bin/bash"
+
+// startupScriptParts returns parts of the module startup script in order of
+// execution. Used modules with a startup_script output contribute a part with
+// default priority unless listed explicitly; ties keep contributions of used
+// modules before inline parts, both in order of declaration.
+func startupScriptParts(bp Blueprint, m Module) []StartupScriptPart {
+	parts := []StartupScriptPart{}
+	for _, u := range m.Use {
+		listed := slices.ContainsFunc(m.StartupScriptParts, func(p StartupScriptPart) bool { return p.Module == u })
+		used, err := bp.Module(u)
+		if listed || err != nil || !hasStartupScriptOutput(*used) {
+			continue
+		}
+		parts = append(parts, StartupScriptPart{Module: u})
+	}
+	parts = append(parts, m.StartupScriptParts...)
+	sort.SliceStable(parts, func(i, j int) bool { return parts[i].Priority < parts[j].Priority })
+	return parts
+}
+
+func hasStartupScriptOutput(m Module) bool {
+	return slices.ContainsFunc(m.InfoOrDie().Outputs, func(o modulereader.OutputInfo) bool { return o.Name == startupScriptSetting })
+}
+
+func validateStartupScriptParts(mp ModulePath, m Module, bp Blueprint) error {
+	errs := Errors{}
+	if !slices.ContainsFunc(m.InfoOrDie().Inputs, func(i modulereader.VarInfo) bool { return i.Name == startupScriptSetting }) {
+		errs.At(mp.StartupScriptParts, fmt.Errorf("module %q does not have a %q input", m.ID, startupScriptSetting))
+	}
+	for ip, p := range m.StartupScriptParts {
+		pp := mp.StartupScriptParts.At(ip)
+		if (p.Content == "") == (p.Module == "") {
+			errs.At(pp, errors.New("exactly one of content or module must be set"))
+			continue
+		}
+		if p.Module == "" {
+			continue
+		}
+		if !slices.Contains(m.Use, p.Module) {
+			errs.At(pp.Module, fmt.Errorf("module %q must be in the use list to contribute to the startup script", p.Module))
+		} else if used, err := bp.Module(p.Module); err == nil && !hasStartupScriptOutput(*used) {
+			errs.At(pp.Module, fmt.Errorf("module %q does not have a %q output", p.Module, startupScriptSetting))
+		}
+	}
+	if errs.Any() {
+		return errs
+	}
+
+	size := 0
+	for i, p := range startupScriptParts(bp, m) {
+		size += len(p.Content)
+		if i > 0 && strings.HasPrefix(p.Content, "#!") {
+			ip := slices.IndexFunc(m.StartupScriptParts, func(o StartupScriptPart) bool { return o == p })
+			errs.At(mp.StartupScriptParts.At(ip).Content, errors.New("only the first startup script part may start with a shebang"))
+		}
+	}
+	if size > MaxStartupScriptSize {
+		errs.At(mp.StartupScriptParts, fmt.Errorf("startup script parts are %d bytes, exceeding the limit of %d bytes", size, MaxStartupScriptSize))
+	}
+	return errs.OrNil()
+}
+
+// renderStartupScript returns the value of the startup_script setting
+// assembled from the parts. The script is a string if all parts are inline,
+// otherwise an expression joining parts with outputs of used modules.
+func renderStartupScript(parts []StartupScriptPart) cty.Value {
+	vals := []cty.Value{}
+	mods := []ModuleID{}
+	if len(parts) > 0 && parts[0].Module == "" && !strings.HasPrefix(parts[0].Content, "#!") {
+		vals = append(vals, cty.StringVal(defaultShebang))
+	}
+	for _, p := range parts {
+		if p.Module != "" {
+			vals = append(vals, ModuleRef(p.Module, startupScriptSetting).AsValue())
+			mods = append(mods, p.Module)
+		} else {
+			vals = append(vals, cty.StringVal(strings.TrimSuffix(p.Content, "\n")))
+		}
+	}
+
+	if len(mods) == 0 {
+		s := make([]string, len(vals))
+		for i, v := range vals {
+			s[i] = v.AsString()
+		}
+		return cty.StringVal(strings.Join(s, "\n") + "\n")
+	}
+	join := FunctionCallExpression("join", cty.StringVal("\n"), cty.TupleVal(vals))
+	return AsProductOfModuleUse(join.AsValue(), mods...)
+}
+
+// applyStartupScriptParts sets the startup_script setting of the module to
+// the assembled script, an explicitly set startup_script is an error unless
+// it is the product of a previous expansion
+func (bp Blueprint) applyStartupScriptParts(mp ModulePath, m *Module) error {
+	if len(m.StartupScriptParts) == 0 {
+		return nil
+	}
+	if err := validateStartupScriptParts(mp, *m, bp); err != nil {
+		return err
+	}
+	script := renderStartupScript(startupScriptParts(bp, *m))
+
+	if m.Settings.Has(startupScriptSetting) {
+		cur := m.Settings.Get(startupScriptSetting)
+		explicit := len(IsProductOfModuleUse(cur)) == 0
+		same := bytes.Equal(hclwrite.Format(TokensForValue(cur).Bytes()), hclwrite.Format(TokensForValue(script).Bytes()))
+		if explicit && !same {
+			return BpError{mp.Settings.Dot(startupScriptSetting), errors.New("startup_script can not be set together with startup_script_parts")}
+		}
+	}
+	m.Settings.Set(startupScriptSetting, script)
+	m.recordOrigin(startupScriptSetting, OriginGhpc, "startup_script_parts")
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"hpc-toolkit/pkg/modulereader"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func startupScriptBlueprint(parts []StartupScriptPart) (Blueprint, *Module) {
+	fs := Module{ID: "homefs", Source: "modules/fs"}
+	net := Module{ID: "network", Source: "modules/net"}
+	vm := Module{
+		ID:                 "vm",
+		Source:             "modules/vm",
+		Use:                ModuleIDs{"network", "homefs"},
+		StartupScriptParts: parts}
+	setTestModuleInfo(fs, modulereader.ModuleInfo{
+		Outputs: []modulereader.OutputInfo{{Name: "startup_script"}}})
+	setTestModuleInfo(net, modulereader.ModuleInfo{})
+	setTestModuleInfo(vm, modulereader.ModuleInfo{
+		Inputs: []modulereader.VarInfo{{Name: "startup_script", Type: cty.String}}})
+	bp := Blueprint{DeploymentGroups: []DeploymentGroup{{
+		Name:    "primary",
+		Modules: []Module{fs, net, vm}}}}
+	return bp, &bp.DeploymentGroups[0].Modules[2]
+}
+
+func (s *zeroSuite) TestStartupScriptParts(c *C) {
+	{ // used modules contribute before inline parts of the same priority
+		bp, vm := startupScriptBlueprint([]StartupScriptPart{
+			{Content: "echo late", Priority: 10},
+			{Content: "echo early"}})
+		c.Check(startupScriptParts(bp, *vm), DeepEquals, []StartupScriptPart{
+			{Module: "homefs"},
+			{Content: "echo early"},
+			{Content: "echo late", Priority: 10}})
+	}
+
+	{ // explicitly listed module takes the declared priority
+		bp, vm := startupScriptBlueprint([]StartupScriptPart{
+			{Content: "echo first"},
+			{Module: "homefs", Priority: 5}})
+		c.Check(startupScriptParts(bp, *vm), DeepEquals, []StartupScriptPart{
+			{Content: "echo first"},
+			{Module: "homefs", Priority: 5}})
+	}
+}
+
+func (s *zeroSuite) TestRenderStartupScript(c *C) {
+	{ // inline parts only, default shebang is added
+		v := renderStartupScript([]StartupScriptPart{{Content: "echo a\n"}, {Content: "echo b"}})
+		c.Check(v, DeepEquals, cty.StringVal("#!/bin/bash\necho a\necho b\n"))
+	}
+
+	{ // module outputs are joined
+		v := renderStartupScript([]StartupScriptPart{{Module: "homefs"}, {Content: "echo a"}})
+		c.Check(IsProductOfModuleUse(v), DeepEquals, []ModuleID{"homefs"})
+		c.Check(string(hclwrite.Format(TokensForValue(v).Bytes())), Equals, `join("\n", [module.homefs.startup_script, "echo a"])`)
+	}
+}
+
+func (s *zeroSuite) TestApplyStartupScriptParts(c *C) {
+	mp := Root.Groups.At(0).Modules.At(2)
+
+	{ // Success
+		bp, vm := startupScriptBlueprint([]StartupScriptPart{{Content: "#!/bin/sh\necho hi", Priority: -1}})
+		c.Assert(bp.applyStartupScriptParts(mp, vm), IsNil)
+		c.Check(string(hclwrite.Format(TokensForValue(vm.Settings.Get("startup_script")).Bytes())), Equals,
+			`join("\n", ["#!/bin/sh\necho hi", module.homefs.startup_script])`)
+
+		// re-expansion of the expanded blueprint keeps the script
+		vm.Settings.Set("startup_script", MustParseExpression(`join("\n", ["#!/bin/sh\necho hi", module.homefs.startup_script])`).AsValue())
+		c.Check(bp.applyStartupScriptParts(mp, vm), IsNil)
+	}
+
+	{ // Fail: explicit startup_script
+		bp, vm := startupScriptBlueprint([]StartupScriptPart{{Content: "echo hi"}})
+		vm.Settings.Set("startup_script", cty.StringVal("echo bye"))
+		c.Check(bp.applyStartupScriptParts(mp, vm), ErrorMatches, ".*can not be set together.*")
+	}
+
+	{ // Fail: shebang in a later part
+		bp, vm := startupScriptBlueprint([]StartupScriptPart{{Content: "#!/bin/bash\necho hi"}})
+		c.Check(bp.applyStartupScriptParts(mp, vm), ErrorMatches, ".*only the first startup script part.*")
+	}
+
+	{ // Fail: module not used, module without output, both content and module
+		bp, vm := startupScriptBlueprint([]StartupScriptPart{
+			{Module: "vm"},
+			{Module: "network"},
+			{Module: "homefs", Content: "echo hi"}})
+		err := bp.applyStartupScriptParts(mp, vm)
+		c.Check(err, ErrorMatches, `(?s).*"vm" must be in the use list.*`)
+		c.Check(err, ErrorMatches, `(?s).*"network" does not have a "startup_script" output.*`)
+		c.Check(err, ErrorMatches, `(?s).*exactly one of content or module.*`)
+	}
+
+	{ // Fail: too large
+		bp, vm := startupScriptBlueprint([]StartupScriptPart{{Content: strings.Repeat("#", MaxStartupScriptSize+1)}})
+		c.Check(bp.applyStartupScriptParts(mp, vm), ErrorMatches, ".*exceeding the limit.*")
+	}
+}
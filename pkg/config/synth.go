@@ -0,0 +1,103 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+// SynthModuleSource is the module every module of synthetic blueprints uses,
+// its `network_name` setting refers to outputs of other modules
+const SynthModuleSource = "modules/network/pre-existing-vpc"
+
+// SynthOptions is the size of a synthetic blueprint
+type SynthOptions struct {
+	Groups     int // number of deployment groups
+	Modules    int // number of modules per group
+	References int // number of references to outputs of other modules
+}
+
+// SynthBlueprint generates a blueprint of the given size, to benchmark
+// expansion, writing and validation of large deployments. References are
+// spread evenly across modules, each one to an earlier module, of the same
+// group or of an earlier one.
+func SynthBlueprint(o SynthOptions) (Blueprint, error) {
+	if o.Groups < 1 || o.Modules < 1 {
+		return Blueprint{}, errors.New("a synthetic blueprint must have at least one group and one module per group")
+	}
+	total := o.Groups * o.Modules
+	if o.References < 0 || (o.References > 0 && total < 2) {
+		return Blueprint{}, errors.New("references require at least two modules and can not be negative")
+	}
+
+	ids := make([]ModuleID, total)
+	for i := range ids {
+		ids[i] = ModuleID(fmt.Sprintf("net_%d_%d", i/o.Modules, i%o.Modules))
+	}
+	// modules after the first one refer to earlier modules, the n-th reference
+	// made by a module is to the n-th module before it, wrapping around
+	refs := make([][]ModuleID, total)
+	for i := 0; i < o.References; i++ {
+		from := 1 + i%(total-1)
+		n := i / (total - 1)
+		refs[from] = append(refs[from], ids[from-1-n%from])
+	}
+
+	bp := Blueprint{
+		BlueprintName: fmt.Sprintf("synth-%dx%dx%d", o.Groups, o.Modules, o.References),
+		Vars: NewDict(map[string]cty.Value{
+			"project_id":      cty.StringVal("synth-project"),
+			"deployment_name": cty.StringVal("synth"),
+			"region":          cty.StringVal("us-central1"),
+		}),
+	}
+	for ig := 0; ig < o.Groups; ig++ {
+		g := DeploymentGroup{Name: GroupName(fmt.Sprintf("group_%d", ig))}
+		for im := 0; im < o.Modules; im++ {
+			i := ig*o.Modules + im
+			name, err := synthNetworkName(ids[i], refs[i])
+			if err != nil {
+				return Blueprint{}, err
+			}
+			g.Modules = append(g.Modules, Module{
+				ID:     ids[i],
+				Source: SynthModuleSource,
+				Kind:   TerraformKind,
+				Settings: NewDict(map[string]cty.Value{
+					"network_name":    name,
+					"subnetwork_name": cty.StringVal(fmt.Sprintf("%s-subnet", ids[i])),
+				}),
+			})
+		}
+		bp.DeploymentGroups = append(bp.DeploymentGroups, g)
+	}
+	return bp, nil
+}
+
+// synthNetworkName joins `network_name` outputs of referred modules
+func synthNetworkName(id ModuleID, refs []ModuleID) (cty.Value, error) {
+	if len(refs) == 0 {
+		return cty.StringVal(string(id)), nil
+	}
+	parts := make([]string, len(refs))
+	for i, r := range refs {
+		parts[i] = fmt.Sprintf("$(%s.network_name)", r)
+	}
+	return parseYamlString(strings.Join(parts, "-"))
+}
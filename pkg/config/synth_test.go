@@ -0,0 +1,86 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/modulereader"
+	"testing"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+// setSynthModuleInfo registers the inputs and outputs of the module used by
+// synthetic blueprints, so that they expand without reading modules
+func setSynthModuleInfo() {
+	setTestModuleInfo(Module{Source: SynthModuleSource, Kind: TerraformKind}, modulereader.ModuleInfo{
+		Inputs: []modulereader.VarInfo{
+			{Name: "project_id", Type: cty.String, Required: true},
+			{Name: "region", Type: cty.String, Required: true},
+			{Name: "network_name", Type: cty.String},
+			{Name: "subnetwork_name", Type: cty.String},
+		},
+		Outputs: []modulereader.OutputInfo{{Name: "network_name"}, {Name: "subnetwork_name"}},
+	})
+}
+
+func (s *zeroSuite) TestSynthBlueprint(c *C) {
+	bp, err := SynthBlueprint(SynthOptions{Groups: 2, Modules: 3, References: 7})
+	c.Assert(err, IsNil)
+	c.Check(bp.DeploymentGroups, HasLen, 2)
+	refs := 0
+	bp.WalkModulesSafe(func(_ ModulePath, m *Module) {
+		c.Check(m.Source, Equals, SynthModuleSource)
+		for _, v := range m.Settings.Items() {
+			if e, is := IsExpressionValue(v); is {
+				refs += len(e.References())
+			}
+		}
+	})
+	c.Check(refs, Equals, 7)
+
+	setSynthModuleInfo()
+	c.Check(bp.Expand(), IsNil)
+	c.Check(bp.DeploymentGroups[1].FindAllIntergroupReferences(bp), Not(HasLen), 0)
+
+	_, err = SynthBlueprint(SynthOptions{Groups: 0, Modules: 3})
+	c.Check(err, NotNil)
+	_, err = SynthBlueprint(SynthOptions{Groups: 1, Modules: 1, References: 1})
+	c.Check(err, NotNil)
+}
+
+func BenchmarkExpand(b *testing.B) {
+	setSynthModuleInfo()
+	for _, o := range []SynthOptions{
+		{Groups: 1, Modules: 10, References: 10},
+		{Groups: 5, Modules: 20, References: 200},
+		{Groups: 10, Modules: 50, References: 2000},
+	} {
+		b.Run(fmt.Sprintf("%dx%dx%d", o.Groups, o.Modules, o.References), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				bp, err := SynthBlueprint(o)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				if err := bp.Expand(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"hpc-toolkit/pkg/modulereader"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/slices"
+)
+
+// moduleMetaArguments can not be expressed in blueprints
+var moduleMetaArguments = []string{"count", "for_each", "depends_on", "providers", "version"}
+
+// tfImporter collects a blueprint out of a terraform root module
+type tfImporter struct {
+	dir string
+	// bpDir is the directory the blueprint is written to, local module
+	// sources are made relative to it
+	bpDir   string
+	vars    map[string]cty.Value
+	modules map[ModuleID]*Module
+	order   []ModuleID
+	backend TerraformBackend
+	// outputs are converted once all modules are known
+	outputs []*hclsyntax.Block
+	// skipped describes parts of the root module that were not converted
+	skipped []string
+}
+
+// ImportTerraformRoot makes a best-effort translation of a terraform root
+// module into a blueprint of a single deployment group. Module blocks become
+// blueprint modules and variables with defaults become deployment variables;
+// resources, data sources, locals and anything else the blueprint can not
+// express are left out and described by the returned notes.
+func ImportTerraformRoot(dir string, bpDir string) (Blueprint, []string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tf"))
+	if err != nil {
+		return Blueprint{}, nil, err
+	}
+	if len(files) == 0 {
+		return Blueprint{}, nil, fmt.Errorf("%s does not contain terraform files", dir)
+	}
+	sort.Strings(files)
+
+	im := tfImporter{dir: dir, bpDir: bpDir, vars: map[string]cty.Value{}, modules: map[ModuleID]*Module{}}
+	for _, f := range files {
+		if err := im.file(f); err != nil {
+			return Blueprint{}, nil, err
+		}
+	}
+	for _, blk := range im.outputs {
+		im.output(blk)
+	}
+	return im.blueprint(), im.skipped, nil
+}
+
+func (im *tfImporter) skip(f string, a ...any) {
+	im.skipped = append(im.skipped, fmt.Sprintf(f, a...))
+}
+
+func (im *tfImporter) file(f string) error {
+	src, err := os.ReadFile(f)
+	if err != nil {
+		return err
+	}
+	file, diags := hclsyntax.ParseConfig(src, f, hcl.InitialPos)
+	if diags.HasErrors() {
+		return diags
+	}
+	for _, blk := range file.Body.(*hclsyntax.Body).Blocks {
+		switch blk.Type {
+		case "variable":
+			im.variable(blk, src)
+		case "module":
+			if err := im.module(blk, src); err != nil {
+				return err
+			}
+		case "output":
+			im.outputs = append(im.outputs, blk)
+		case "terraform":
+			im.terraform(blk, src)
+		case "provider":
+			// ghpc configures google providers on its own
+			im.skip("provider %q (%s)", strings.Join(blk.Labels, "."), blk.TypeRange)
+		default:
+			im.skip("%s %q (%s)", blk.Type, strings.Join(blk.Labels, "."), blk.TypeRange)
+		}
+	}
+	return nil
+}
+
+// value converts an attribute of the root module, constant expressions become
+// plain values, others are kept as expressions
+func (im *tfImporter) value(a *hclsyntax.Attribute, src []byte) (cty.Value, error) {
+	if len(a.Expr.Variables()) == 0 {
+		if v, diags := a.Expr.Value(nil); !diags.HasErrors() {
+			return v, nil
+		}
+	}
+	r := a.Expr.Range()
+	e, err := ParseExpression(string(src[r.Start.Byte:r.End.Byte]))
+	if err != nil {
+		return cty.NilVal, err
+	}
+	return e.AsValue(), nil
+}
+
+func (im *tfImporter) variable(blk *hclsyntax.Block, src []byte) {
+	name := blk.Labels[0]
+	a, ok := blk.Body.Attributes["default"]
+	if !ok {
+		im.vars[name] = cty.NullVal(cty.DynamicPseudoType)
+		im.skip("variable %q has no default, set its value in the blueprint", name)
+		return
+	}
+	v, err := im.value(a, src)
+	if err != nil {
+		im.vars[name] = cty.NullVal(cty.DynamicPseudoType)
+		im.skip("default of variable %q (%s): %s", name, a.SrcRange, err)
+		return
+	}
+	im.vars[name] = v
+}
+
+// source returns module source as seen from the blueprint directory
+func (im *tfImporter) source(s string) (string, error) {
+	if !strings.HasPrefix(s, "./") && !strings.HasPrefix(s, "../") {
+		return s, nil
+	}
+	abs, err := filepath.Abs(filepath.Join(im.dir, s))
+	if err != nil {
+		return "", err
+	}
+	bpDir, err := filepath.Abs(im.bpDir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(bpDir, abs)
+	if err != nil {
+		return abs, nil
+	}
+	if !strings.HasPrefix(rel, "..") {
+		rel = "./" + rel
+	}
+	return rel, nil
+}
+
+func (im *tfImporter) module(blk *hclsyntax.Block, src []byte) error {
+	id := ModuleID(blk.Labels[0])
+	sa, ok := blk.Body.Attributes["source"]
+	if !ok {
+		return fmt.Errorf("%s: module %q has no source", blk.TypeRange, id)
+	}
+	sv, diags := sa.Expr.Value(nil)
+	if diags.HasErrors() || sv.Type() != cty.String {
+		return fmt.Errorf("%s: source of module %q must be a string", sa.SrcRange, id)
+	}
+	source, err := im.source(sv.AsString())
+	if err != nil {
+		return err
+	}
+
+	m := &Module{ID: id, Source: source, Kind: TerraformKind, Settings: NewDict(nil)}
+	for _, a := range sortedAttributes(blk.Body) {
+		if a.Name == "source" {
+			continue
+		}
+		if slices.Contains(moduleMetaArguments, a.Name) {
+			im.skip("%s of module %q (%s)", a.Name, id, a.SrcRange)
+			continue
+		}
+		v, err := im.value(a, src)
+		if err != nil {
+			im.skip("setting %s of module %q (%s): %s", a.Name, id, a.SrcRange, err)
+			continue
+		}
+		m.Settings.Set(a.Name, v)
+	}
+	im.modules[id] = m
+	im.order = append(im.order, id)
+	return nil
+}
+
+// output keeps outputs of the root module that are outputs of a module
+func (im *tfImporter) output(blk *hclsyntax.Block) {
+	name := blk.Labels[0]
+	a, ok := blk.Body.Attributes["value"]
+	if !ok {
+		return
+	}
+	vs := a.Expr.Variables()
+	if ta, isTraversal := a.Expr.(*hclsyntax.ScopeTraversalExpr); isTraversal && len(vs) == 1 {
+		r, err := TraversalToReference(ta.Traversal)
+		if err == nil && !r.GlobalVar && len(ta.Traversal) == 3 {
+			if m, ok := im.modules[r.Module]; ok {
+				m.Outputs = append(m.Outputs, modulereader.OutputInfo{Name: r.Name})
+				return
+			}
+		}
+	}
+	im.skip("output %q (%s), only outputs of modules can be converted", name, blk.TypeRange)
+}
+
+func (im *tfImporter) terraform(blk *hclsyntax.Block, src []byte) {
+	for _, b := range blk.Body.Blocks {
+		if b.Type != "backend" {
+			continue
+		}
+		be := TerraformBackend{Type: b.Labels[0], Configuration: NewDict(nil)}
+		for _, a := range sortedAttributes(b.Body) {
+			v, err := im.value(a, src)
+			if err != nil {
+				im.skip("backend setting %s (%s): %s", a.Name, a.SrcRange, err)
+				continue
+			}
+			be.Configuration.Set(a.Name, v)
+		}
+		im.backend = be
+	}
+}
+
+// sortedModules orders modules so that modules come after ones they refer to,
+// otherwise keeping the order of the root module
+func (im *tfImporter) sortedModules() []Module {
+	res := []Module{}
+	done := map[ModuleID]bool{}
+	var visit func(id ModuleID)
+	visit = func(id ModuleID) {
+		m, ok := im.modules[id]
+		if !ok || done[id] {
+			return
+		}
+		done[id] = true
+		refs := []ModuleID{}
+		for r := range valueReferences(m.Settings.AsObject()) {
+			if !r.GlobalVar {
+				refs = append(refs, r.Module)
+			}
+		}
+		sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+		for _, r := range refs {
+			visit(r)
+		}
+		res = append(res, *m)
+	}
+	for _, id := range im.order {
+		visit(id)
+	}
+	return res
+}
+
+func (im *tfImporter) blueprint() Blueprint {
+	name := filepath.Base(filepath.Clean(im.dir))
+	if abs, err := filepath.Abs(im.dir); err == nil {
+		name = filepath.Base(abs)
+	}
+	if _, ok := im.vars["deployment_name"]; !ok {
+		im.vars["deployment_name"] = cty.StringVal(name)
+	}
+	return Blueprint{
+		BlueprintName:            name,
+		Vars:                     NewDict(im.vars),
+		TerraformBackendDefaults: im.backend,
+		DeploymentGroups: []DeploymentGroup{{
+			Name:    "primary",
+			Modules: im.sortedModules(),
+		}},
+	}
+}
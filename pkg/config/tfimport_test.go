@@ -0,0 +1,92 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"hpc-toolkit/pkg/modulereader"
+	"os"
+	"path/filepath"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestImportTerraformRoot(c *C) {
+	dir := c.MkDir()
+	root := filepath.Join(dir, "cluster")
+	c.Assert(os.Mkdir(root, 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(root, "main.tf"), []byte(`
+terraform {
+  backend "gcs" {
+    bucket = "state-bucket"
+  }
+}
+
+module "fs" {
+  source  = "./modules/fs"
+  network = module.net.network_id
+  name    = "${var.project_id}-fs"
+  count   = 2
+}
+
+module "net" {
+  source     = "github.com/org/repo//net"
+  project_id = var.project_id
+  mtu        = 1460
+  extra      = local.extra
+}
+
+resource "google_compute_address" "ip" {}
+`), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(root, "variables.tf"), []byte(`
+variable "project_id" {}
+variable "region" { default = "us-central1" }
+output "network_id" { value = module.net.network_id }
+output "region" { value = var.region }
+`), 0644), IsNil)
+
+	bp, skipped, err := ImportTerraformRoot(root, dir)
+	c.Assert(err, IsNil)
+	c.Check(skipped, HasLen, 5) // count, local, resource, output, variable without default
+	c.Check(bp.BlueprintName, Equals, "cluster")
+	c.Check(bp.Vars.Items(), DeepEquals, map[string]cty.Value{
+		"deployment_name": cty.StringVal("cluster"),
+		"project_id":      cty.NullVal(cty.DynamicPseudoType),
+		"region":          cty.StringVal("us-central1"),
+	})
+	c.Check(bp.TerraformBackendDefaults.Type, Equals, "gcs")
+	c.Check(bp.TerraformBackendDefaults.Configuration.Get("bucket"), DeepEquals, cty.StringVal("state-bucket"))
+
+	c.Assert(bp.DeploymentGroups, HasLen, 1)
+	mods := bp.DeploymentGroups[0].Modules
+	c.Assert(mods, HasLen, 2)
+	// modules are ordered after modules they refer to
+	net, fs := mods[0], mods[1]
+	c.Check(net.ID, Equals, ModuleID("net"))
+	c.Check(net.Source, Equals, "github.com/org/repo//net")
+	c.Check(net.Outputs, DeepEquals, []modulereader.OutputInfo{{Name: "network_id"}})
+	c.Check(net.Settings.Has("project_id") && net.Settings.Has("mtu"), Equals, true)
+	c.Check(net.Settings.Items(), HasLen, 2)
+	c.Check(net.Settings.Get("project_id"), DeepEquals, GlobalRef("project_id").AsValue())
+	c.Check(net.Settings.Get("mtu").Equals(cty.NumberIntVal(1460)), Equals, cty.True)
+	c.Check(fs.Source, Equals, "./cluster/modules/fs")
+	c.Check(fs.Settings.Get("network"), DeepEquals, ModuleRef("net", "network_id").AsValue())
+	c.Check(fs.Settings.Has("count"), Equals, false)
+
+	{ // Fail: no terraform files
+		_, _, err := ImportTerraformRoot(dir, dir)
+		c.Check(err, ErrorMatches, ".*does not contain terraform files")
+	}
+}
@@ -18,6 +18,8 @@ package config
 
 import (
 	"fmt"
+	"net/url"
+	"path/filepath"
 	"regexp"
 	"strings"
 
@@ -97,6 +99,351 @@ func validateVars(bp Blueprint) error {
 			errs.At(Root.Vars.Dot(key), fmt.Errorf("deployment variable %q was not set", key))
 		}
 	}
+	return errs.Add(validateVarDeclarations(bp)).OrNil()
+}
+
+func validateVarDeclarations(bp Blueprint) error {
+	errs := Errors{}
+	for n, d := range bp.VarDeclarations {
+		p := Root.VarDeclarations.Dot(n)
+		if d.Type != "" && d.Type != SecretVarType {
+			errs.At(p.Type, fmt.Errorf("unsupported variable type %q, the only supported type is %q", d.Type, SecretVarType))
+			continue
+		}
+		if d.Type == SecretVarType && !bp.Vars.Has(n) {
+			errs.At(p, fmt.Errorf("secret variable %q was not set", n))
+		}
+	}
+	return errs.OrNil()
+}
+
+func validateDeploymentLayout(bp Blueprint) error {
+	l, p := bp.DeploymentLayout, Root.Layout
+	errs := Errors{}
+	if l.Flat {
+		if len(bp.DeploymentGroups) != 1 {
+			errs.At(p.Flat, errors.New("flat deployment layout requires exactly one deployment group"))
+		}
+		if l.GroupPrefix != "" || l.NumberGroups {
+			errs.At(p.Flat, errors.New("group_prefix and number_groups can not be used with flat deployment layout"))
+		}
+	}
+	if l.GroupPrefix != "" {
+		errs.At(p.GroupPrefix, GroupName(l.GroupPrefix+"g").Validate())
+	}
+	if l.GhpcDir != "" {
+		if l.GhpcDir == "." || l.GhpcDir == ".." || l.GhpcDir != filepath.Base(l.GhpcDir) {
+			errs.At(p.GhpcDir, fmt.Errorf("ghpc_dir must be a name of directory, got %q", l.GhpcDir))
+		}
+	}
+	ghpcDir := l.GhpcDirName()
+	for ig, g := range bp.DeploymentGroups {
+		if bp.GroupDirName(g.Name) == ghpcDir {
+			errs.At(Root.Groups.At(ig).Name, fmt.Errorf("directory of deployment group %q conflicts with ghpc_dir", g.Name))
+		}
+	}
+	return errs.OrNil()
+}
+
+var platformRegex = regexp.MustCompile(`^[a-z0-9]+_[a-z0-9]+$`)
+
+func validateTerraformProviders(tp TerraformProviders) error {
+	p := Root.Providers
+	errs := Errors{}
+	for i, pl := range tp.LockPlatforms {
+		if !platformRegex.MatchString(pl) {
+			errs.At(p.LockPlatforms.At(i), fmt.Errorf("platform must be in form OS_ARCH, e.g. \"linux_amd64\", got %q", pl))
+		}
+	}
+	if tp.NetworkMirror != "" {
+		u, err := url.Parse(tp.NetworkMirror)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			errs.At(p.NetworkMirror, fmt.Errorf("network_mirror must be an https URL, got %q", tp.NetworkMirror))
+		}
+	}
+	return errs.OrNil()
+}
+
+var serviceAccountRegex = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.gserviceaccount\.com$`)
+
+var kmsKeyRegex = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+func validateArtifactsEncryption(ae ArtifactsEncryption) error {
+	p := Root.Encryption
+	if ae.KmsKey != "" && len(ae.AgeRecipients) > 0 {
+		return BpError{p, errors.New("only one of kms_key and age_recipients can be set")}
+	}
+	errs := Errors{}
+	if ae.KmsKey != "" && !kmsKeyRegex.MatchString(ae.KmsKey) {
+		errs.At(p.KmsKey, fmt.Errorf("kms_key must be in form projects/PROJECT/locations/LOCATION/keyRings/RING/cryptoKeys/KEY, got %q", ae.KmsKey))
+	}
+	for i, r := range ae.AgeRecipients {
+		if !strings.HasPrefix(r, "age1") {
+			errs.At(p.AgeRecipients.At(i), fmt.Errorf("age recipient must be a public key starting with \"age1\", got %q", r))
+		}
+	}
+	return errs.OrNil()
+}
+
+// gcsPrefixRegex matches gs://BUCKET with an optional object prefix
+var gcsPrefixRegex = regexp.MustCompile(`^gs://[a-z0-9][a-z0-9._-]{1,220}[a-z0-9](/.*)?$`)
+
+func validateStateBackups(sb StateBackups) error {
+	p := Root.StateBackups
+	errs := Errors{}
+	if sb.Retain < 0 {
+		errs.At(p.Retain, fmt.Errorf("retain must not be negative, got %d", sb.Retain))
+	}
+	if sb.GcsPrefix != "" && !gcsPrefixRegex.MatchString(sb.GcsPrefix) {
+		errs.At(p.GcsPrefix, fmt.Errorf("gcs_prefix must be in form gs://BUCKET/PREFIX, got %q", sb.GcsPrefix))
+	}
+	return errs.OrNil()
+}
+
+var wifAudienceRegex = regexp.MustCompile(`^//iam\.googleapis\.com/projects/[0-9]+/locations/global/workloadIdentityPools/[^/]+/providers/[^/]+$`)
+
+// ValidateCredentials checks that credentials set all fields their provider
+// needs and none of the other provider. It is shared with the user config,
+// which sets credentials under the same key as blueprints.
+func ValidateCredentials(creds []Credentials) error {
+	errs := Errors{}
+	for i, c := range creds {
+		p := Root.Credentials.At(i)
+		if (c.TokenFile == "") == (c.TokenEnv == "") {
+			errs.At(p, errors.New("exactly one of token_file and token_env must be set"))
+		}
+		if _, err := c.LifetimeDuration(); err != nil {
+			errs.At(p.Lifetime, err)
+		}
+		switch c.Provider {
+		case "gcp":
+			errs.Add(validateGcpCredentials(c, p))
+		case "aws":
+			errs.Add(validateAwsCredentials(c, p))
+		default:
+			errs.At(p.Provider, fmt.Errorf("provider must be one of \"gcp\" or \"aws\", got %q", c.Provider))
+		}
+	}
+	return errs.OrNil()
+}
+
+func validateGcpCredentials(c Credentials, p credentialsPath) error {
+	errs := Errors{}
+	if !wifAudienceRegex.MatchString(c.Audience) {
+		errs.At(p.Audience, fmt.Errorf("audience must be in form //iam.googleapis.com/projects/NUMBER/locations/global/workloadIdentityPools/POOL/providers/PROVIDER, got %q", c.Audience))
+	}
+	if c.RoleArn != "" {
+		errs.At(p.RoleArn, errors.New("role_arn can only be set for provider \"aws\""))
+	}
+	if c.Lifetime != "" && c.ServiceAccount == "" {
+		errs.At(p.Lifetime, errors.New("lifetime of federated tokens can not be changed, set service_account to impersonate"))
+	}
+	return errs.OrNil()
+}
+
+func validateAwsCredentials(c Credentials, p credentialsPath) error {
+	errs := Errors{}
+	if !strings.HasPrefix(c.RoleArn, "arn:") {
+		errs.At(p.RoleArn, fmt.Errorf("role_arn must be the ARN of an AWS role, got %q", c.RoleArn))
+	}
+	if c.Audience != "" {
+		errs.At(p.Audience, errors.New("audience can only be set for provider \"gcp\""))
+	}
+	if c.ServiceAccount != "" {
+		errs.At(p.ServiceAccount, errors.New("service_account can only be set for provider \"gcp\""))
+	}
+	if c.Variable != "" {
+		errs.At(p.Variable, errors.New("variable can only be set for provider \"gcp\""))
+	}
+	return errs.OrNil()
+}
+
+func validateHealthChecks(bp Blueprint) error {
+	errs := Errors{}
+	for ih, h := range bp.HealthChecks {
+		p := Root.HealthChecks.At(ih)
+		if h.Check == "" {
+			errs.At(p.Check, errors.New("health check type must be set"))
+		}
+		errs.Add(checkOutputRefs(bp, h.Inputs, p.Inputs, "health check inputs"))
+	}
+	return errs.OrNil()
+}
+
+// validatePostDeploy ensures post_deploy commands of groups have a command and
+// refer to modules deployed by the group or by previous groups
+func validatePostDeploy(bp Blueprint) error {
+	errs := Errors{}
+	for ig, g := range bp.DeploymentGroups {
+		for ic, rc := range g.PostDeploy {
+			p := Root.Groups.At(ig).PostDeploy.At(ic)
+			if strings.TrimSpace(rc.Command) == "" {
+				errs.At(p.Command, errors.New("post_deploy command must be set"))
+			}
+			if err := checkOutputRefs(bp, rc.Target, p.Target, "post_deploy targets"); err != nil {
+				errs.Add(err)
+				continue
+			}
+			for k, v := range rc.Target.Items() {
+				for r := range valueReferences(v) {
+					if mg, err := bp.ModuleGroup(r.Module); !r.GlobalVar && err == nil && bp.GroupIndex(mg.Name) > ig {
+						errs.At(p.Target.Dot(k), fmt.Errorf("post_deploy targets of group %q can not refer to module %q of later group %q", g.Name, r.Module, mg.Name))
+					}
+				}
+			}
+		}
+	}
+	return errs.OrNil()
+}
+
+// checkOutputRefs ensures that references of values evaluated after deployment
+// are to deployment variables or to outputs of existing terraform modules
+func checkOutputRefs(bp Blueprint, d Dict, p dictPath, what string) error {
+	errs := Errors{}
+	for k, v := range d.Items() {
+		for r := range valueReferences(v) {
+			if r.GlobalVar {
+				continue
+			}
+			if r.IsRuntime() {
+				errs.At(p.Dot(k), fmt.Errorf("%s can not refer to runtime values, they are only available to module settings", what))
+				continue
+			}
+			m, err := bp.Module(r.Module)
+			if err != nil {
+				errs.At(p.Dot(k), err)
+			} else if m.Kind == PackerKind {
+				errs.At(p.Dot(k), fmt.Errorf("%s can not refer to Packer module %q, it has no outputs", what, r.Module))
+			}
+		}
+	}
+	return errs.OrNil()
+}
+
+// validateValidators ensures validator inputs can be evaluated, expressions
+// may refer to deployment variables and outputs of terraform modules
+func validateValidators(bp Blueprint) error {
+	errs := Errors{}
+	for iv, v := range bp.Validators {
+		p := Root.Validators.At(iv)
+		if _, ok := validatorLevels[strings.ToLower(v.Level)]; v.Level != "" && !ok {
+			errs.At(p.Level, fmt.Errorf("level of validator must be one of \"error\", \"warning\" or \"ignore\", got %q", v.Level))
+		}
+		errs.Add(checkOutputRefs(bp, v.Inputs, p.Inputs, "validator inputs"))
+	}
+	return errs.OrNil()
+}
+
+// validateRenamedModules ensures that renamed modules can be moved in terraform
+// state unambiguously
+func validateRenamedModules(bp Blueprint) error {
+	ids := map[ModuleID]bool{}
+	bp.WalkModulesSafe(func(_ ModulePath, m *Module) {
+		ids[m.ID] = true
+	})
+
+	errs := Errors{}
+	seen := map[ModuleID]ModuleID{}
+	bp.WalkModulesSafe(func(p ModulePath, m *Module) {
+		from := m.RenamedFrom
+		if from == "" {
+			return
+		}
+		if m.Kind == PackerKind {
+			errs.At(p.RenamedFrom, errors.New("renamed_from is not supported for packer modules"))
+		}
+		if from != m.ID && ids[from] {
+			errs.At(p.RenamedFrom, fmt.Errorf("module %q can not be renamed from %q, as it is an ID of another module", m.ID, from))
+		}
+		if other, ok := seen[from]; ok {
+			errs.At(p.RenamedFrom, fmt.Errorf("modules %q and %q can not be both renamed from %q", other, m.ID, from))
+		}
+		seen[from] = m.ID
+	})
+	return errs.OrNil()
+}
+
+// resourceAddressRegex matches addresses of managed resources relative to a
+// module, e.g. `google_compute_network.network` or
+// `module.vpc.google_compute_subnetwork.subnetwork["primary"]`
+var resourceAddressRegex = regexp.MustCompile(`^(module\.[a-zA-Z_][\w-]*(\[[^\]]+\])?\.)*[a-zA-Z_][\w-]*\.[a-zA-Z_][\w-]*(\[[^\]]+\])?$`)
+
+// validateBackendCollisions ensures that terraform groups do not store their
+// state at the same location, e.g. with a prefix set by
+// terraform_backend_defaults that does not refer to $(group.name)
+func validateBackendCollisions(bp Blueprint) error {
+	errs := Errors{}
+	seen := map[string]GroupName{}
+	for ig, g := range bp.DeploymentGroups {
+		be := g.TerraformBackend
+		if be.Type == "" || g.Kind() == PackerKind {
+			continue
+		}
+		p := Root.Groups.At(ig).Backend.Configuration
+		cfg, err := be.Configuration.Eval(bp)
+		if err != nil {
+			errs.At(p, err)
+			continue
+		}
+		key := be.Type + "\x00" + string(TokensForValue(cfg.AsObject()).Bytes())
+		if other, ok := seen[key]; ok {
+			errs.At(p, HintError{
+				Hint: "include $(group.name) in the prefix of the terraform backend",
+				Err:  fmt.Errorf("group %q stores its terraform state at the same location as group %q", g.Name, other)})
+			continue
+		}
+		seen[key] = g.Name
+	}
+	return errs.OrNil()
+}
+
+// validateImports ensures that imported resources are given by their address
+// in the module and an ID known before deployment
+func validateImports(bp Blueprint) error {
+	errs := Errors{}
+	bp.WalkModulesSafe(func(p ModulePath, m *Module) {
+		if m.Import.IsZero() {
+			return
+		}
+		if m.Kind == PackerKind {
+			errs.At(p.Import, errors.New("import is not supported for packer modules"))
+			return
+		}
+		for addr, v := range m.Import.Items() {
+			if !resourceAddressRegex.MatchString(addr) || strings.HasPrefix(addr, "data.") {
+				errs.At(p.Import.Dot(addr), fmt.Errorf("%q is not the address of a managed resource of the module, e.g. google_compute_network.network", addr))
+			}
+			for r := range valueReferences(v) {
+				if !r.GlobalVar {
+					errs.At(p.Import.Dot(addr), fmt.Errorf("IDs of imported resources can only refer to deployment variables, got reference to module %q", r.Module))
+				}
+			}
+		}
+	})
+	return errs.OrNil()
+}
+
+func validateSourceResolution(bp Blueprint) error {
+	errs := Errors{}
+	switch bp.SourceBase {
+	case "", SourceBaseCwd:
+	case SourceBaseBlueprint:
+		if bp.dir == "" {
+			errs.At(Root.SourceBase, fmt.Errorf("source_base %q requires the blueprint to be read from a local file", SourceBaseBlueprint))
+		}
+	default:
+		errs.At(Root.SourceBase, fmt.Errorf("source_base must be either %q or %q, got %q", SourceBaseCwd, SourceBaseBlueprint, bp.SourceBase))
+	}
+	for p, r := range bp.SourceRoots {
+		if p == "" || r == "" {
+			errs.At(Root.SourceRoots.Dot(p), errors.New("source_roots prefixes and their replacements must not be empty"))
+		}
+	}
+	if bp.ModuleRegistry != "" {
+		if u, err := url.Parse(bp.ModuleRegistry); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs.At(Root.ModuleRegistry, fmt.Errorf("module_registry must be an http(s) URL, got %q", bp.ModuleRegistry))
+		}
+	}
 	return errs.OrNil()
 }
 
@@ -105,6 +452,11 @@ func validateModule(p ModulePath, m Module, bp Blueprint) error {
 	if m.Source == "" {
 		return BpError{p.Source, EmptyModuleSource}
 	}
+	if v, err := parseYamlString(m.Source); err == nil {
+		if _, is := IsExpressionValue(v); is {
+			return BpError{p.Source, UnresolvedModuleSource}
+		}
+	}
 	if err := checkMovedModule(m.Source); err != nil {
 		return BpError{p.Source, err}
 	}
@@ -113,6 +465,10 @@ func validateModule(p ModulePath, m Module, bp Blueprint) error {
 	}
 	info, err := modulereader.GetModuleInfo(m.Source, m.Kind.kind)
 	if err != nil {
+		var hint HintError // suggest embedded module with similar source
+		if errors.As(checkEmbeddedSource(m.Source), &hint) {
+			err = HintError{hint.Hint, err}
+		}
 		return BpError{p.Source, err}
 	}
 
@@ -127,6 +483,7 @@ func validateModule(p ModulePath, m Module, bp Blueprint) error {
 		Add(validateSettings(p, m, info)).
 		Add(validateOutputs(p, m, info)).
 		Add(validateModuleUseReferences(p, m, bp)).
+		Add(validateUseCompatibility(p, m, info, bp)).
 		Add(validateModuleSettingReferences(p, m, bp)).
 		OrNil()
 }
@@ -135,8 +492,12 @@ func validateOutputs(p ModulePath, mod Module, info modulereader.ModuleInfo) err
 	errs := Errors{}
 	outputs := info.GetOutputsAsMap()
 
-	// Ensure output exists in the underlying modules
 	for io, output := range mod.Outputs {
+		if output.Value != "" {
+			errs.Add(validateOutputValue(p.Outputs.At(io), mod, output, outputs))
+			continue
+		}
+		// Ensure output exists in the underlying modules
 		if _, ok := outputs[output.Name]; !ok {
 			err := fmt.Errorf("%s, module: %s output: %s", errMsgInvalidOutput, mod.ID, output.Name)
 			errs.At(p.Outputs.At(io), err)
@@ -145,6 +506,28 @@ func validateOutputs(p ModulePath, mod Module, info modulereader.ModuleInfo) err
 	return errs.OrNil()
 }
 
+// validateOutputValue checks that custom output value is an expression that
+// only refers to outputs of the module itself, and that it doesn't shadow
+// output of the module with the same name
+func validateOutputValue(p outputPath, mod Module, output modulereader.OutputInfo, outputs map[string]modulereader.OutputInfo) error {
+	if _, ok := outputs[output.Name]; ok {
+		return BpError{p.Name, fmt.Errorf("output %q with custom value conflicts with output of module %q", output.Name, mod.ID)}
+	}
+	e, err := OutputValue(mod.ID, output)
+	if err != nil {
+		return BpError{p.Value, err}
+	}
+	for _, r := range e.References() {
+		if r.GlobalVar || r.Module != mod.ID {
+			return BpError{p.Value, fmt.Errorf("output value can only refer to outputs of module %q", mod.ID)}
+		}
+		if _, ok := outputs[r.Name]; !ok {
+			return BpError{p.Value, fmt.Errorf("%s, module: %s output: %s", errMsgInvalidOutput, mod.ID, r.Name)}
+		}
+	}
+	return nil
+}
+
 type moduleVariables struct {
 	Inputs  map[string]bool
 	Outputs map[string]bool
@@ -179,8 +562,8 @@ func validateSettings(
 			errs.At(sp, ModuleSettingInvalidChar)
 			continue // do not perform other validations
 		}
-		// Setting not found
-		if _, ok := cVars.Inputs[k]; !ok {
+		// Setting not found, aliases are replaced by inputs on expansion
+		if _, ok := cVars.Inputs[k]; !ok && info.Metadata.Ghpc.Aliases[k] == "" {
 			err := hintSpelling(k, maps.Keys(cVars.Inputs), UnknownModuleSetting)
 			errs.At(sp, err)
 			continue // do not perform other validations
@@ -57,6 +57,350 @@ func (s *zeroSuite) TestValidateVars(c *C) {
 	}
 }
 
+func (s *zeroSuite) TestValidateVarDeclarations(c *C) {
+	vars := NewDict(map[string]cty.Value{
+		"deployment_name": cty.StringVal("serengeti"),
+		"license":         cty.StringVal("s3cr3t"),
+	})
+
+	{ // Success
+		decl := map[string]VarDeclaration{"license": {Type: SecretVarType}}
+		c.Check(validateVars(Blueprint{Vars: vars, VarDeclarations: decl}), IsNil)
+	}
+
+	{ // Fail: unknown type
+		decl := map[string]VarDeclaration{"license": {Type: "password"}}
+		c.Check(validateVars(Blueprint{Vars: vars, VarDeclarations: decl}), ErrorMatches, ".*unsupported variable type.*")
+	}
+
+	{ // Fail: secret is not set
+		decl := map[string]VarDeclaration{"key": {Type: SecretVarType}}
+		c.Check(validateVars(Blueprint{Vars: vars, VarDeclarations: decl}), ErrorMatches, ".*secret variable \"key\" was not set.*")
+	}
+}
+
+func (s *zeroSuite) TestValidateDeploymentLayout(c *C) {
+	one := []DeploymentGroup{{Name: "primary"}}
+	two := []DeploymentGroup{{Name: "primary"}, {Name: "packer"}}
+
+	{ // Success
+		bp := Blueprint{DeploymentGroups: two, DeploymentLayout: DeploymentLayout{GroupPrefix: "tf-", NumberGroups: true, GhpcDir: "toolkit"}}
+		c.Check(validateDeploymentLayout(bp), IsNil)
+		c.Check(bp.GroupDirName("packer"), Equals, "02-tf-packer")
+	}
+
+	{ // Success: flat
+		bp := Blueprint{DeploymentGroups: one, DeploymentLayout: DeploymentLayout{Flat: true}}
+		c.Check(validateDeploymentLayout(bp), IsNil)
+		c.Check(bp.GroupDirName("primary"), Equals, "")
+	}
+
+	{ // Fail: flat with many groups
+		bp := Blueprint{DeploymentGroups: two, DeploymentLayout: DeploymentLayout{Flat: true}}
+		c.Check(validateDeploymentLayout(bp), ErrorMatches, ".*exactly one deployment group.*")
+	}
+
+	{ // Fail: flat with prefix
+		bp := Blueprint{DeploymentGroups: one, DeploymentLayout: DeploymentLayout{Flat: true, GroupPrefix: "tf-"}}
+		c.Check(validateDeploymentLayout(bp), NotNil)
+	}
+
+	{ // Fail: invalid prefix
+		bp := Blueprint{DeploymentGroups: one, DeploymentLayout: DeploymentLayout{GroupPrefix: "tf/"}}
+		c.Check(validateDeploymentLayout(bp), NotNil)
+	}
+
+	{ // Fail: ghpc_dir is a path
+		bp := Blueprint{DeploymentGroups: one, DeploymentLayout: DeploymentLayout{GhpcDir: "a/b"}}
+		c.Check(validateDeploymentLayout(bp), ErrorMatches, ".*must be a name of directory.*")
+	}
+
+	{ // Fail: ghpc_dir conflicts with group
+		bp := Blueprint{DeploymentGroups: one, DeploymentLayout: DeploymentLayout{GhpcDir: "primary"}}
+		c.Check(validateDeploymentLayout(bp), ErrorMatches, ".*conflicts with ghpc_dir.*")
+	}
+}
+
+func (s *zeroSuite) TestValidateTerraformProviders(c *C) {
+	c.Check(validateTerraformProviders(TerraformProviders{}), IsNil)
+	c.Check(validateTerraformProviders(TerraformProviders{
+		LockPlatforms: []string{"linux_amd64", "darwin_arm64"},
+		NetworkMirror: "https://artifacts.example.com/terraform/providers/"}), IsNil)
+
+	err := validateTerraformProviders(TerraformProviders{
+		LockPlatforms: []string{"linux-amd64"},
+		NetworkMirror: "http://artifacts.example.com/"})
+	c.Check(err, ErrorMatches, `(?s).*form OS_ARCH.*"linux-amd64".*`)
+	c.Check(err, ErrorMatches, `(?s).*must be an https URL.*`)
+}
+
+func (s *zeroSuite) TestValidateArtifactsEncryption(c *C) {
+	key := "projects/p/locations/global/keyRings/hpc/cryptoKeys/outputs"
+	c.Check(validateArtifactsEncryption(ArtifactsEncryption{}), IsNil)
+	c.Check(validateArtifactsEncryption(ArtifactsEncryption{KmsKey: key}), IsNil)
+	c.Check(validateArtifactsEncryption(ArtifactsEncryption{AgeRecipients: []string{"age1abc", "age1def"}}), IsNil)
+
+	c.Check(validateArtifactsEncryption(ArtifactsEncryption{KmsKey: key, AgeRecipients: []string{"age1abc"}}),
+		ErrorMatches, ".*only one of kms_key and age_recipients.*")
+	c.Check(validateArtifactsEncryption(ArtifactsEncryption{KmsKey: "projects/p/keyRings/hpc"}),
+		ErrorMatches, ".*kms_key must be in form.*")
+	c.Check(validateArtifactsEncryption(ArtifactsEncryption{AgeRecipients: []string{"ssh-ed25519 AAAA"}}),
+		ErrorMatches, `artifacts_encryption.age_recipients\[0\]: age recipient must be a public key.*`)
+}
+
+func (s *zeroSuite) TestValidateStateBackups(c *C) {
+	c.Check(validateStateBackups(StateBackups{}), IsNil)
+	c.Check(validateStateBackups(StateBackups{Retain: 3, GcsPrefix: "gs://my-bucket"}), IsNil)
+	c.Check(validateStateBackups(StateBackups{GcsPrefix: "gs://my-bucket/hpc/backups"}), IsNil)
+
+	c.Check(validateStateBackups(StateBackups{Retain: -1}),
+		ErrorMatches, `state_backups.retain: retain must not be negative.*`)
+	c.Check(validateStateBackups(StateBackups{GcsPrefix: "my-bucket/backups"}),
+		ErrorMatches, `state_backups.gcs_prefix: gcs_prefix must be in form gs://BUCKET/PREFIX.*`)
+}
+
+func (s *zeroSuite) TestStateBackupsRetained(c *C) {
+	c.Check(StateBackups{}.Retained(), Equals, DefaultStateBackupsRetain)
+	c.Check(StateBackups{Retain: 2}.Retained(), Equals, 2)
+}
+
+func (s *zeroSuite) TestValidateCredentials(c *C) {
+	gcp := Credentials{
+		Provider: "gcp",
+		TokenEnv: "CI_OIDC_TOKEN",
+		Audience: "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/ci/providers/gitlab",
+		Variable: "access_token",
+	}
+	aws := Credentials{Provider: "aws", TokenFile: "/var/run/token", RoleArn: "arn:aws:iam::123:role/ci", Lifetime: "30m"}
+	c.Check(ValidateCredentials(nil), IsNil)
+	c.Check(ValidateCredentials([]Credentials{gcp, aws}), IsNil)
+
+	{ // Fail: both token sources
+		bad := gcp
+		bad.TokenFile = "/var/run/token"
+		c.Check(ValidateCredentials([]Credentials{bad}), ErrorMatches, `credentials\[0\]: exactly one of token_file and token_env.*`)
+	}
+	{ // Fail: lifetime of federated token
+		bad := gcp
+		bad.Lifetime = "2h"
+		c.Check(ValidateCredentials([]Credentials{bad}), ErrorMatches, `credentials\[0\].lifetime: .*set service_account.*`)
+		bad.ServiceAccount = "ci@p.iam.gserviceaccount.com"
+		c.Check(ValidateCredentials([]Credentials{bad}), IsNil)
+	}
+	{ // Fail: audience
+		bad := gcp
+		bad.Audience = "projects/123/pools/ci"
+		c.Check(ValidateCredentials([]Credentials{bad}), ErrorMatches, `credentials\[0\].audience: audience must be in form.*`)
+	}
+	{ // Fail: settings of the other provider
+		bad := aws
+		bad.Variable = "token"
+		c.Check(ValidateCredentials([]Credentials{gcp, bad}), ErrorMatches, `credentials\[1\].variable: variable can only be set for provider "gcp"`)
+	}
+	{ // Fail: invalid lifetime
+		bad := aws
+		bad.Lifetime = "soon"
+		c.Check(ValidateCredentials([]Credentials{bad}), ErrorMatches, `credentials\[0\].lifetime: lifetime must be a positive duration.*`)
+	}
+	{ // Fail: unknown provider
+		c.Check(ValidateCredentials([]Credentials{{Provider: "azure", TokenEnv: "T"}}), ErrorMatches, `credentials\[0\].provider: provider must be one of.*`)
+	}
+}
+
+func (s *zeroSuite) TestValidateHealthChecks(c *C) {
+	{ // Success
+		bp := Blueprint{HealthChecks: []HealthCheck{{
+			Check:  "tcp_port",
+			Inputs: NewDict(map[string]cty.Value{"host": GlobalRef("controller_ip").AsValue()})}}}
+		c.Check(validateHealthChecks(bp), IsNil)
+	}
+
+	{ // Fail: no check type
+		bp := Blueprint{HealthChecks: []HealthCheck{{Name: "ssh"}}}
+		c.Check(validateHealthChecks(bp), ErrorMatches, ".*type must be set.*")
+	}
+
+	{ // Success: reference to module output
+		bp := Blueprint{
+			DeploymentGroups: []DeploymentGroup{{Modules: []Module{{ID: "controller"}}}},
+			HealthChecks: []HealthCheck{{
+				Check:  "tcp_port",
+				Inputs: NewDict(map[string]cty.Value{"host": ModuleRef("controller", "ip").AsValue()})}}}
+		c.Check(validateHealthChecks(bp), IsNil)
+	}
+
+	{ // Fail: reference to unknown module
+		bp := Blueprint{HealthChecks: []HealthCheck{{
+			Check:  "tcp_port",
+			Inputs: NewDict(map[string]cty.Value{"host": ModuleRef("controller", "ip").AsValue()})}}}
+		c.Check(validateHealthChecks(bp), ErrorMatches, `.*invalid module id: "controller".*`)
+	}
+
+	{ // Fail: reference to Packer module
+		bp := Blueprint{
+			DeploymentGroups: []DeploymentGroup{{Modules: []Module{{ID: "image", Kind: PackerKind}}}},
+			HealthChecks: []HealthCheck{{
+				Check:  "tcp_port",
+				Inputs: NewDict(map[string]cty.Value{"host": ModuleRef("image", "ip").AsValue()})}}}
+		c.Check(validateHealthChecks(bp), ErrorMatches, ".*health check inputs can not refer to Packer module \"image\".*")
+	}
+}
+
+func (s *zeroSuite) TestValidatePostDeploy(c *C) {
+	target := func(m ModuleID) Dict {
+		return NewDict(map[string]cty.Value{
+			"project_id": GlobalRef("project_id").AsValue(),
+			"zone":       GlobalRef("zone").AsValue(),
+			"instance":   ModuleRef(m, "controller_name").AsValue()})
+	}
+	groups := func(rc RemoteCommand) []DeploymentGroup {
+		return []DeploymentGroup{
+			{Name: "primary", Modules: []Module{{ID: "slurm"}}, PostDeploy: []RemoteCommand{rc}},
+			{Name: "later", Modules: []Module{{ID: "late"}}}}
+	}
+
+	{ // Success
+		bp := Blueprint{DeploymentGroups: groups(RemoteCommand{Command: "sinfo", Target: target("slurm")})}
+		c.Check(validatePostDeploy(bp), IsNil)
+	}
+
+	{ // Fail: no command
+		bp := Blueprint{DeploymentGroups: groups(RemoteCommand{Target: target("slurm")})}
+		c.Check(validatePostDeploy(bp), ErrorMatches, `deployment_groups\[0\].post_deploy\[0\].command: post_deploy command must be set`)
+	}
+
+	{ // Fail: reference to unknown module
+		bp := Blueprint{DeploymentGroups: groups(RemoteCommand{Command: "sinfo", Target: target("lost")})}
+		c.Check(validatePostDeploy(bp), ErrorMatches, `.*target.instance: invalid module id: "lost".*`)
+	}
+
+	{ // Fail: reference to module of later group
+		bp := Blueprint{DeploymentGroups: groups(RemoteCommand{Command: "sinfo", Target: target("late")})}
+		c.Check(validatePostDeploy(bp), ErrorMatches, `.*can not refer to module "late" of later group "later"`)
+	}
+}
+
+func (s *zeroSuite) TestValidateValidators(c *C) {
+	{ // Success: expression over deployment variables
+		zones := MustParseExpression(`flatten([var.zone, var.extra_zones])`).AsValue()
+		bp := Blueprint{Validators: []Validator{{
+			Validator: "test_zone_exists",
+			Inputs: NewDict(map[string]cty.Value{
+				"project_id": GlobalRef("project_id").AsValue(),
+				"zone":       zones})}}}
+		c.Check(validateValidators(bp), IsNil)
+	}
+
+	{ // Success: reference to output of terraform module, a post-deploy validator
+		bp := Blueprint{
+			DeploymentGroups: []DeploymentGroup{{Modules: []Module{{ID: "controller", Kind: TerraformKind}}}},
+			Validators: []Validator{{
+				Validator: "test_tcp_port_open",
+				Inputs: NewDict(map[string]cty.Value{
+					"host": ModuleRef("controller", "ip").AsValue(),
+					"port": cty.NumberIntVal(6817)})}}}
+		c.Check(validateValidators(bp), IsNil)
+		c.Check(bp.Validators[0].PostDeploy(), Equals, true)
+	}
+
+	{ // Fail: reference to unknown module
+		bp := Blueprint{Validators: []Validator{{
+			Validator: "test_zone_exists",
+			Inputs:    NewDict(map[string]cty.Value{"zone": ModuleRef("network", "zone").AsValue()})}}}
+		c.Check(validateValidators(bp), ErrorMatches, `validators\[0\].inputs.zone: .*"network".*`)
+	}
+
+	{ // Fail: reference to Packer module
+		bp := Blueprint{
+			DeploymentGroups: []DeploymentGroup{{Modules: []Module{{ID: "image", Kind: PackerKind}}}},
+			Validators: []Validator{{
+				Validator: "test_zone_exists",
+				Inputs:    NewDict(map[string]cty.Value{"zone": ModuleRef("image", "zone").AsValue()})}}}
+		c.Check(validateValidators(bp), ErrorMatches, ".*can not refer to Packer module \"image\".*")
+	}
+
+	{ // Success: level overrides
+		bp := Blueprint{Validators: []Validator{
+			{Validator: "test_project_exists", Level: "error"},
+			{Validator: "test_apis_enabled", Level: "WARNING"},
+			{Validator: "test_module_not_used", Level: "ignore"}}}
+		c.Check(validateValidators(bp), IsNil)
+	}
+
+	{ // Fail: unknown level
+		bp := Blueprint{Validators: []Validator{{Validator: "test_apis_enabled", Level: "fatal"}}}
+		c.Check(validateValidators(bp), ErrorMatches, `validators\[0\].level: level of validator must be one of .*, got "fatal"`)
+	}
+}
+
+func (s *zeroSuite) TestValidatorValidationLevel(c *C) {
+	c.Check(Validator{}.ValidationLevel(ValidationWarning), Equals, ValidationWarning)
+	c.Check(Validator{Level: "error"}.ValidationLevel(ValidationWarning), Equals, ValidationError)
+	c.Check(Validator{Level: "Ignore"}.ValidationLevel(ValidationError), Equals, ValidationIgnore)
+	c.Check(Validator{Level: "warning"}.ValidationLevel(ValidationIgnore), Equals, ValidationWarning)
+}
+
+func (s *zeroSuite) TestValidateRenamedModules(c *C) {
+	bp := func(mods ...Module) Blueprint {
+		return Blueprint{DeploymentGroups: []DeploymentGroup{{Name: "primary", Modules: mods}}}
+	}
+
+	{ // Success: renamed and moved to another group under the same ID
+		c.Check(validateRenamedModules(bp(
+			Module{ID: "network", RenamedFrom: "vpc", Kind: TerraformKind},
+			Module{ID: "vm", RenamedFrom: "vm", Kind: TerraformKind})), IsNil)
+	}
+
+	{ // Fail: renamed from ID of another module
+		c.Check(validateRenamedModules(bp(
+			Module{ID: "network", RenamedFrom: "vm", Kind: TerraformKind},
+			Module{ID: "vm", Kind: TerraformKind})), ErrorMatches, ".*is an ID of another module.*")
+	}
+
+	{ // Fail: renamed from the same ID twice
+		c.Check(validateRenamedModules(bp(
+			Module{ID: "a", RenamedFrom: "old", Kind: TerraformKind},
+			Module{ID: "b", RenamedFrom: "old", Kind: TerraformKind})), ErrorMatches, ".*can not be both renamed from \"old\".*")
+	}
+
+	{ // Fail: packer
+		c.Check(validateRenamedModules(bp(
+			Module{ID: "image", RenamedFrom: "img", Kind: PackerKind})), ErrorMatches, ".*not supported for packer.*")
+	}
+}
+
+func (s *zeroSuite) TestValidateImports(c *C) {
+	bp := func(kind ModuleKind, imp map[string]cty.Value) Blueprint {
+		return Blueprint{DeploymentGroups: []DeploymentGroup{{Name: "primary", Modules: []Module{
+			{ID: "network", Kind: kind, Import: NewDict(imp)}}}}}
+	}
+	id := MustParseExpression(`"projects/${var.project_id}/global/networks/hpc"`).AsValue()
+
+	{ // Success
+		c.Check(validateImports(bp(TerraformKind, map[string]cty.Value{
+			"google_compute_network.network":                                        id,
+			`module.vpc.module.subnets.google_compute_subnetwork.subnetwork["hpc"]`: cty.StringVal("hpc")})), IsNil)
+	}
+
+	{ // Fail: not a resource address
+		c.Check(validateImports(bp(TerraformKind, map[string]cty.Value{"network": id})),
+			ErrorMatches, `.*"network" is not the address of a managed resource.*`)
+		c.Check(validateImports(bp(TerraformKind, map[string]cty.Value{"data.google_compute_network.network": id})),
+			ErrorMatches, `.*is not the address of a managed resource.*`)
+	}
+
+	{ // Fail: reference to module
+		c.Check(validateImports(bp(TerraformKind, map[string]cty.Value{
+			"google_compute_network.network": ModuleRef("vpc", "network_id").AsValue()})),
+			ErrorMatches, `.*can only refer to deployment variables.*`)
+	}
+
+	{ // Fail: packer
+		c.Check(validateImports(bp(PackerKind, map[string]cty.Value{"google_compute_network.network": id})),
+			ErrorMatches, ".*not supported for packer.*")
+	}
+}
+
 func (s *zeroSuite) TestValidateSettings(c *C) {
 	path := Root.Groups.At(7).Modules.At(2)
 	testSettingName := "TestSetting"
@@ -99,6 +443,11 @@ func (s *zeroSuite) TestValidateSettings(c *C) {
 		c.Assert(err, IsNil)
 	}
 
+	// Succeeds: Alias of an input
+	info.Inputs = []modulereader.VarInfo{{Name: "machine_type"}}
+	info.Metadata.Ghpc.Aliases = map[string]string{"instance_type": "machine_type"}
+	mod.Settings = NewDict(map[string]cty.Value{"instance_type": testSettingValue})
+	c.Check(validateSettings(path, mod, info), IsNil)
 }
 
 func (s *zeroSuite) TestValidateModule(c *C) {
@@ -180,4 +529,89 @@ func (s *zeroSuite) TestValidateOutputs(c *C) {
 			Outputs: []modulereader.OutputInfo{out}}
 		c.Check(validateOutputs(p, mod, info), NotNil)
 	}
+
+	info := modulereader.ModuleInfo{
+		Outputs: []modulereader.OutputInfo{{Name: "velvet"}}}
+
+	{ // Custom value refers to module output
+		out := modulereader.OutputInfo{Name: "waldo", Value: "$(bond.velvet.id)"}
+		mod := Module{ID: "bond", Outputs: []modulereader.OutputInfo{out}}
+		c.Check(validateOutputs(p, mod, info), IsNil)
+	}
+
+	{ // Custom value refers to unknown module output
+		out := modulereader.OutputInfo{Name: "waldo", Value: "$(bond.silk.id)"}
+		mod := Module{ID: "bond", Outputs: []modulereader.OutputInfo{out}}
+		c.Check(validateOutputs(p, mod, info), ErrorMatches, ".*output: silk.*")
+	}
+
+	{ // Custom value refers to other module
+		out := modulereader.OutputInfo{Name: "waldo", Value: "$(james.velvet)"}
+		mod := Module{ID: "bond", Outputs: []modulereader.OutputInfo{out}}
+		c.Check(validateOutputs(p, mod, info), ErrorMatches, ".*can only refer to outputs of module \"bond\".*")
+	}
+
+	{ // Custom value shadows module output
+		out := modulereader.OutputInfo{Name: "velvet", Value: "$(bond.velvet.id)"}
+		mod := Module{ID: "bond", Outputs: []modulereader.OutputInfo{out}}
+		c.Check(validateOutputs(p, mod, info), ErrorMatches, ".*conflicts with output of module.*")
+	}
+}
+
+func (s *zeroSuite) TestValidateCustomValidators(c *C) {
+	ok := CustomValidator{Condition: `length(blueprint.deployment_groups) <= 3 && var.region != ""`, Message: "too many groups"}
+	c.Check(validateCustomValidators(Blueprint{CustomValidators: []CustomValidator{ok}}), IsNil)
+
+	{ // Fail: reference to module
+		v := ok
+		v.Condition = `module.net.self_link != ""`
+		c.Check(validateCustomValidators(Blueprint{CustomValidators: []CustomValidator{v}}), ErrorMatches,
+			`custom_validators\[0\].condition: condition can only refer to blueprint and var, got "module"`)
+	}
+	{ // Fail: syntax error
+		v := ok
+		v.Condition = `length(`
+		c.Check(validateCustomValidators(Blueprint{CustomValidators: []CustomValidator{v}}), ErrorMatches, `custom_validators\[0\].condition: .*`)
+	}
+	{ // Fail: missing message and bad level
+		v := ok
+		v.Message, v.Level = "", "fatal"
+		c.Check(validateCustomValidators(Blueprint{CustomValidators: []CustomValidator{v}}), ErrorMatches,
+			`(?s).*level of validator must be one of.*must set a message.*`)
+	}
+}
+
+func (s *zeroSuite) TestValidateBackendCollisions(c *C) {
+	gcs := func(prefix string) TerraformBackend {
+		return TerraformBackend{Type: "gcs", Configuration: NewDict(map[string]cty.Value{
+			"bucket": cty.StringVal("states"),
+			"prefix": MustParseExpression(prefix).AsValue()})}
+	}
+	group := func(name string, kind ModuleKind, be TerraformBackend) DeploymentGroup {
+		return DeploymentGroup{Name: GroupName(name), TerraformBackend: be, Modules: []Module{{ID: ModuleID(name), Kind: kind}}}
+	}
+	bp := Blueprint{Vars: NewDict(map[string]cty.Value{"deployment_name": cty.StringVal("golf")})}
+
+	{ // Success: distinct prefixes, no backend
+		bp.DeploymentGroups = []DeploymentGroup{
+			group("net", TerraformKind, gcs(`"${var.deployment_name}/net"`)),
+			group("vm", TerraformKind, gcs(`"golf/vm"`)),
+			group("local", TerraformKind, TerraformBackend{}),
+			group("other", TerraformKind, TerraformBackend{})}
+		c.Check(validateBackendCollisions(bp), IsNil)
+	}
+
+	{ // Success: packer groups do not use their backend
+		bp.DeploymentGroups = []DeploymentGroup{
+			group("net", TerraformKind, gcs(`"state"`)),
+			group("image", PackerKind, gcs(`"state"`))}
+		c.Check(validateBackendCollisions(bp), IsNil)
+	}
+
+	{ // Fail: same evaluated prefix
+		bp.DeploymentGroups = []DeploymentGroup{
+			group("net", TerraformKind, gcs(`"${var.deployment_name}/state"`)),
+			group("vm", TerraformKind, gcs(`"golf/state"`))}
+		c.Check(validateBackendCollisions(bp), ErrorMatches, `.*group "vm" stores its terraform state at the same location as group "net".*`)
+	}
 }
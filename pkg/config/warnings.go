@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// WarningCategory groups warnings of the same nature in reports
+type WarningCategory string
+
+const (
+	// WarningDeprecated is used for fields that are still accepted but ignored
+	WarningDeprecated WarningCategory = "deprecated"
+	// WarningUnused is used for definitions nothing refers to
+	WarningUnused WarningCategory = "unused"
+	// WarningImplicitDefault is used when a default was applied on behalf of the user
+	WarningImplicitDefault WarningCategory = "implicit_default"
+)
+
+// WarningCategories lists categories in the order they are reported
+var WarningCategories = []WarningCategory{WarningDeprecated, WarningUnused, WarningImplicitDefault}
+
+// Warning is a non-fatal issue found in the blueprint
+type Warning struct {
+	Category WarningCategory
+	// Path to the offending part of the blueprint, may be nil
+	Path    Path
+	Message string
+	// Removal is the release a deprecated field is removed in, if any
+	Removal string
+	// Upgrade rewrites the blueprint to resolve the warning, nil if it has to
+	// be resolved by hand
+	Upgrade *Upgrade
+}
+
+// MarshalJSON renders the path as a string, e.g. "vars.zone"
+func (w Warning) MarshalJSON() ([]byte, error) {
+	path := ""
+	if w.Path != nil {
+		path = w.Path.String()
+	}
+	return json.Marshal(struct {
+		Category WarningCategory `json:"category"`
+		Path     string          `json:"path,omitempty"`
+		Message  string          `json:"message"`
+		Removal  string          `json:"removal,omitempty"`
+		Upgrade  *Upgrade        `json:"upgrade,omitempty"`
+	}{w.Category, path, w.Message, w.Removal, w.Upgrade})
+}
+
+// Warn records a warning to be reported once the blueprint is processed
+func (bp *Blueprint) Warn(c WarningCategory, p Path, f string, a ...any) {
+	bp.warnings = append(bp.warnings, Warning{Category: c, Path: p, Message: fmt.Sprintf(f, a...)})
+}
+
+// Warnings returns warnings collected so far, in the order they were found
+func (bp Blueprint) Warnings() []Warning {
+	return bp.warnings
+}
+
+// collectWarnings inspects the expanded blueprint for unused variables and
+// defaults applied implicitly, deprecations are reported by WarnDeprecations
+func (bp *Blueprint) collectWarnings() {
+	for _, v := range bp.ListUnusedVariables() {
+		bp.Warn(WarningUnused, Root.Vars.Dot(v), "the variable %q is not used in this blueprint", v)
+	}
+
+	for ig, g := range bp.DeploymentGroups {
+		if g.Kind() == TerraformKind && g.TerraformBackend.Type == "" {
+			bp.Warn(WarningImplicitDefault, Root.Groups.At(ig).Name,
+				"no terraform_backend is set for group %q, its state will be stored locally in the deployment directory", g.Name)
+		}
+	}
+}
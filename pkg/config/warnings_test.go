@@ -0,0 +1,61 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestCollectWarnings(c *C) {
+	bp := Blueprint{
+		Vars: NewDict(map[string]cty.Value{
+			"deployment_name": cty.StringVal("green"),
+			"zone":            cty.StringVal("us-central1-a"),
+		}),
+		DeploymentGroups: []DeploymentGroup{
+			{Name: "local", Modules: []Module{{ID: "net", Kind: TerraformKind}}},
+			{Name: "remote", TerraformBackend: TerraformBackend{Type: "gcs"}, Modules: []Module{{ID: "vm", Kind: TerraformKind}}},
+			{Name: "image", Modules: []Module{{ID: "img", Kind: PackerKind}}},
+		}}
+	bp.collectWarnings()
+
+	c.Check(bp.Warnings(), DeepEquals, []Warning{
+		{
+			Category: WarningUnused,
+			Path:     Root.Vars.Dot("zone"),
+			Message:  `the variable "zone" is not used in this blueprint`,
+		}, {
+			Category: WarningImplicitDefault,
+			Path:     Root.Groups.At(0).Name,
+			Message:  `no terraform_backend is set for group "local", its state will be stored locally in the deployment directory`,
+		}})
+}
+
+func (s *zeroSuite) TestWarningMarshalJSON(c *C) {
+	bp := Blueprint{}
+	bp.Warn(WarningUnused, Root.Vars.Dot("zone"), "unused %q", "zone")
+	bp.Warn(WarningDeprecated, nil, "gone")
+	bp.GhpcVersion = "v1"
+	bp.WarnDeprecations()
+
+	got, err := json.Marshal(bp.Warnings())
+	c.Assert(err, IsNil)
+	c.Check(string(got), Equals,
+		`[{"category":"unused","path":"vars.zone","message":"unused \"zone\""},{"category":"deprecated","message":"gone"},`+
+			`{"category":"deprecated","path":"ghpc_version","message":"ghpc_version setting is ignored","upgrade":{"action":"remove"}}]`)
+}
@@ -24,6 +24,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/hashicorp/hcl/v2/hclsyntax"
 	"github.com/hashicorp/hcl/v2/hclwrite"
 	"github.com/pkg/errors"
 	"github.com/zclconf/go-cty/cty"
@@ -59,6 +60,10 @@ func readYaml(f string) (*yaml.Decoder, YamlCtx, error) {
 	if err != nil {
 		return &yaml.Decoder{}, YamlCtx{}, fmt.Errorf("%s, filename=%s: %v", errMsgFileLoadError, f, err)
 	}
+	return yamlDecoder(data)
+}
+
+func yamlDecoder(data []byte) (*yaml.Decoder, YamlCtx, error) {
 	decoder := yaml.NewDecoder(bytes.NewReader(data))
 	decoder.KnownFields(true)
 
@@ -70,15 +75,36 @@ func readYaml(f string) (*yaml.Decoder, YamlCtx, error) {
 }
 
 func importBlueprint(f string) (Blueprint, YamlCtx, error) {
-	decoder, yamlCtx, err := readYaml(f)
+	data, err := os.ReadFile(f)
 	if err != nil {
-		return Blueprint{}, YamlCtx{}, err
+		return Blueprint{}, YamlCtx{}, fmt.Errorf("%s, filename=%s: %v", errMsgFileLoadError, f, err)
 	}
+	return parseBlueprint(data, f)
+}
 
+// parseBlueprint parses blueprint data, f names it and tells its format
+func parseBlueprint(data []byte, f string) (Blueprint, YamlCtx, error) {
+	if isHCLBlueprint(f) {
+		return parseHCLBlueprint(data, f)
+	}
+	if isEvaluatedBlueprint(f) {
+		return parseEvaluatedBlueprint(data, f)
+	}
+	decoder, yamlCtx, err := yamlDecoder(data)
+	if err != nil {
+		return Blueprint{}, YamlCtx{}, err
+	}
 	var bp Blueprint
 	if err = decoder.Decode(&bp); err != nil {
 		return Blueprint{}, yamlCtx, parseYamlV3Error(err)
 	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return Blueprint{}, yamlCtx, parseYamlV3Error(err)
+	}
+	if err := bp.setUseAliases(&root); err != nil {
+		return Blueprint{}, yamlCtx, err
+	}
 	return bp, yamlCtx, nil
 }
 
@@ -129,6 +155,9 @@ func syntheticOutputsNode(name string, ln int, col int) *yaml.Node {
 	}
 }
 
+// outputsNodePathRegex matches paths of outputs of modules given by name only
+var outputsNodePathRegex = regexp.MustCompile(`^deployment_groups\[\d+\]\.modules\[\d+\]\.outputs\[\d+\]$`)
+
 // normalizeNode is treating variadic YAML syntax, ensuring that
 // there is only one (canonical) way to refer to a piece of blueprint.
 // Handled cases:
@@ -140,7 +169,7 @@ func syntheticOutputsNode(name string, ln int, col int) *yaml.Node {
 // ```
 func normalizeYamlNode(p yPath, n *yaml.Node) *yaml.Node {
 	switch {
-	case n.Kind == yaml.ScalarNode && regexp.MustCompile(`^deployment_groups\[\d+\]\.modules\[\d+\]\.outputs\[\d+\]$`).MatchString(string(p)):
+	case n.Kind == yaml.ScalarNode && outputsNodePathRegex.MatchString(string(p)):
 		return syntheticOutputsNode(n.Value, n.Line, n.Column)
 	default:
 		return n
@@ -151,20 +180,29 @@ func normalizeYamlNode(p yPath, n *yaml.Node) *yaml.Node {
 // NOTE: The data should be a valid blueprint YAML (previously used to parse Blueprint),
 // this function will panic if it's not valid YAML and doesn't validate Blueprint structure.
 func NewYamlCtx(data []byte) (YamlCtx, error) {
+	lines := splitLines(data)
+
+	var c nodeCapturer
+	// error may happen if YAML is not valid, regardless of Blueprint schema
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return YamlCtx{map[yPath]Pos{}, lines}, parseYamlV3Error(err)
+	}
+	return newYamlCtx(c.n, lines), nil
+}
+
+func splitLines(data []byte) []string {
 	var lines []string
 	sc := bufio.NewScanner(bytes.NewReader(data))
 	for sc.Scan() {
 		lines = append(lines, sc.Text())
 	}
+	return lines
+}
 
-	var c nodeCapturer
+// newYamlCtx maps paths of all nodes under root to their positions
+func newYamlCtx(root *yaml.Node, lines []string) YamlCtx {
 	m := map[yPath]Pos{}
 
-	// error may happen if YAML is not valid, regardless of Blueprint schema
-	if err := yaml.Unmarshal(data, &c); err != nil {
-		return YamlCtx{m, lines}, parseYamlV3Error(err)
-	}
-
 	var walk func(n *yaml.Node, p yPath, posOf *yaml.Node)
 	walk = func(n *yaml.Node, p yPath, posOf *yaml.Node) {
 		n = normalizeYamlNode(p, n)
@@ -184,10 +222,10 @@ func NewYamlCtx(data []byte) (YamlCtx, error) {
 			}
 		}
 	}
-	if c.n != nil {
-		walk(c.n, "", nil)
+	if root != nil {
+		walk(root, "", nil)
 	}
-	return YamlCtx{m, lines}, nil
+	return YamlCtx{m, lines}
 }
 
 type nodeCapturer struct{ n *yaml.Node }
@@ -218,15 +256,92 @@ func (mk ModuleKind) MarshalYAML() (interface{}, error) {
 }
 
 // UnmarshalYAML is a custom unmarshaler for Module.Use, that will print nice error message.
+// Entries may be given as `{id: ID, as: ALIAS}`, only the ID is kept, aliases
+// are collected by setUseAliases.
 func (ms *ModuleIDs) UnmarshalYAML(n *yaml.Node) error {
-	var ids []ModuleID
-	if err := n.Decode(&ids); err != nil {
+	if n.Kind != yaml.SequenceNode {
 		return nodeToPosErr(n, errors.New("`use` must be a list of module ids"))
 	}
+	ids := make([]ModuleID, len(n.Content))
+	for i, e := range n.Content {
+		if e.Kind == yaml.MappingNode {
+			ua, err := decodeUseAlias(e)
+			if err != nil {
+				return err
+			}
+			ids[i] = ua.ID
+		} else if err := e.Decode(&ids[i]); err != nil {
+			return nodeToPosErr(n, errors.New("`use` must be a list of module ids"))
+		}
+	}
 	*ms = ids
 	return nil
 }
 
+// useAlias is an entry of `use` naming the used module, `{id: ID, as: ALIAS}`
+type useAlias struct {
+	ID ModuleID `yaml:"id"`
+	As ModuleID `yaml:"as"`
+}
+
+func decodeUseAlias(n *yaml.Node) (useAlias, error) {
+	var ua useAlias
+	if err := n.Decode(&ua); err != nil || ua.ID == "" || ua.As == "" || len(n.Content) != 4 {
+		return useAlias{}, nodeToPosErr(n, errors.New("aliased `use` entries must be `{id: ID, as: ALIAS}`"))
+	}
+	if !hclsyntax.ValidIdentifier(string(ua.As)) || ua.As == "vars" {
+		return useAlias{}, nodeToPosErr(n, fmt.Errorf("alias %q of module %q must be a valid identifier other than \"vars\"", ua.As, ua.ID))
+	}
+	return ua, nil
+}
+
+// setUseAliases sets UseAliases of modules of the blueprint decoded from
+// the root node, from entries of their `use` given as `{id: ID, as: ALIAS}`
+func (bp *Blueprint) setUseAliases(root *yaml.Node) error {
+	if root != nil && root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	groups := seqItems(mappingValue(root, "deployment_groups"))
+	for ig := range bp.DeploymentGroups {
+		if ig >= len(groups) {
+			break
+		}
+		mods := seqItems(mappingValue(groups[ig], "modules"))
+		for im := range bp.DeploymentGroups[ig].Modules {
+			if im >= len(mods) {
+				break
+			}
+			use := seqItems(mappingValue(mods[im], "use"))
+			if err := bp.DeploymentGroups[ig].Modules[im].setUseAliases(use); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setUseAliases sets UseAliases of the module from nodes of its `use`
+// entries, entries not given as mappings are not aliased
+func (m *Module) setUseAliases(use []*yaml.Node) error {
+	for _, e := range use {
+		if e.Kind != yaml.MappingNode {
+			continue
+		}
+		ua, err := decodeUseAlias(e)
+		if err != nil {
+			return err
+		}
+		if _, ok := m.UseAliases[ua.As]; ok {
+			return nodeToPosErr(e, fmt.Errorf("alias %q is given to more than one used module", ua.As))
+		}
+		if m.UseAliases == nil {
+			m.UseAliases = map[ModuleID]ModuleID{}
+		}
+		m.UseAliases[ua.As] = ua.ID
+	}
+	return nil
+}
+
 // YamlValue is wrapper around cty.Value to handle YAML unmarshal.
 type YamlValue struct {
 	v cty.Value // do not use this field directly, use Wrap() and Unwrap() instead
@@ -263,6 +378,10 @@ func (y *YamlValue) UnmarshalYAML(n *yaml.Node) error {
 }
 
 func (y *YamlValue) unmarshalScalar(n *yaml.Node) error {
+	if n.Tag == literalStringTag {
+		y.Wrap(cty.StringVal(n.Value))
+		return nil
+	}
 	var s interface{}
 	if err := n.Decode(&s); err != nil {
 		return err
@@ -415,5 +534,11 @@ func parseYamlV3ErrorString(s string) error {
 	}
 	lns, errMsg := match[3], match[4]
 	ln, _ := strconv.Atoi(lns) // Atoi returns 0 on error, which is fine here
-	return PosError{Pos{Line: ln}, errors.New(errMsg)}
+	var err error = errors.New(errMsg)
+	if errMsg == "mapping values are not allowed in this context" {
+		err = HintError{
+			Hint: `values containing ": " must be quoted, e.g. '$(vars.gpus ? "a2" : "c2")'`,
+			Err:  err}
+	}
+	return PosError{Pos{Line: ln}, err}
 }
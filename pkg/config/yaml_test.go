@@ -16,6 +16,7 @@ package config
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -265,6 +266,29 @@ func TestDictWrongTypeUnmarshalYAML(t *testing.T) {
 	}
 }
 
+func TestUnquotedConditionalYamlError(t *testing.T) {
+	yml := `
+vars:
+  machine_type: $(vars.gpus ? "a2" : "c2")
+`
+	var bp Blueprint
+	errs, _ := parseYamlV3Error(yaml.Unmarshal([]byte(yml), &bp)).(Errors)
+	if len(errs.Errors) != 1 {
+		t.Fatalf("expected single error, got %#v", errs)
+	}
+	pe, ok := errs.Errors[0].(PosError)
+	if !ok {
+		t.Fatalf("expected PosError, got %#v", errs.Errors[0])
+	}
+	if pe.Pos.Line != 3 {
+		t.Errorf("expected error at line 3, got %d", pe.Pos.Line)
+	}
+	var he HintError
+	if !errors.As(pe.Err, &he) {
+		t.Errorf("expected hint to quote the value, got %#v", pe.Err)
+	}
+}
+
 func TestDictMarshalYAML(t *testing.T) {
 	d := Dict{}
 	d.
@@ -353,3 +377,44 @@ d: "null"
 		t.Errorf("diff (-want +got):\n%s", diff)
 	}
 }
+
+func TestUseAliasesUnmarshalYAML(t *testing.T) {
+	yml := `
+blueprint_name: lime
+deployment_groups:
+- group: primary
+  modules:
+  - id: vm
+    source: modules/compute/vm-instance
+    use:
+    - net0
+    - {id: net1, as: primary}
+    - id: net2
+      as: secondary
+`
+	bp, _, err := parseBlueprint([]byte(yml), "bp.yaml")
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	m := bp.DeploymentGroups[0].Modules[0]
+	if diff := cmp.Diff(ModuleIDs{"net0", "net1", "net2"}, m.Use); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+	want := map[ModuleID]ModuleID{"primary": "net1", "secondary": "net2"}
+	if diff := cmp.Diff(want, m.UseAliases); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+
+	for _, bad := range []string{
+		"[{id: net1}]",
+		"[{id: net1, as: 1st}]",
+		"[{id: net1, as: vars}]",
+		"[{id: net1, as: primary, at: 3}]",
+		"[{id: net1, as: primary}, {id: net2, as: primary}]",
+	} {
+		yml := "blueprint_name: lime\ndeployment_groups:\n- group: g\n  modules:\n  - id: vm\n    source: s\n    use: " + bad + "\n"
+		if _, _, err := parseBlueprint([]byte(yml), "bp.yaml"); err == nil {
+			t.Errorf("expected error parsing use: %s", bad)
+		}
+	}
+}
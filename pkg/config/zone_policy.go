@@ -0,0 +1,197 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// ZonePolicy lists zones a deployment variable may be set to, in order of
+// preference. `ghpc deploy` sets the variable to the first zone where VMs of
+// the policy can be created.
+type ZonePolicy struct {
+	Zones []string `yaml:"zones"`
+	// RegionVar is a deployment variable set to the region of the zone
+	RegionVar        string `yaml:"region_var,omitempty"`
+	MachineType      string `yaml:"machine_type,omitempty"`
+	AcceleratorType  string `yaml:"accelerator_type,omitempty"`
+	AcceleratorCount int    `yaml:"accelerator_count,omitempty"`
+	// Count is the number of VMs quotas of the region must allow for
+	Count int `yaml:"count,omitempty"`
+}
+
+var zoneRegex = regexp.MustCompile(`^[a-z]+-[a-z]+[0-9]+-[a-z]$`)
+
+// ZoneRegion returns the region of the zone
+func ZoneRegion(zone string) string {
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return zone
+}
+
+// ZonePolicyVars returns deployment variables set by zone policies, zones
+// and regions, sorted
+func (bp Blueprint) ZonePolicyVars() []string {
+	res := []string{}
+	for v, p := range bp.ZonePolicy {
+		res = append(res, v)
+		if p.RegionVar != "" {
+			res = append(res, p.RegionVar)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// ZonePolicyVarsOf returns deployment variables set by zone policies that are
+// used by modules of the group, sorted
+func (bp Blueprint) ZonePolicyVarsOf(g DeploymentGroup) []string {
+	used := map[string]bool{}
+	for _, m := range g.Modules {
+		for _, v := range GetUsedDeploymentVars(m.Settings.AsObject()) {
+			used[v] = true
+		}
+	}
+	res := []string{}
+	for _, v := range bp.ZonePolicyVars() {
+		if used[v] {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func validateZonePolicy(bp Blueprint, name string, zp ZonePolicy) error {
+	p := Root.ZonePolicy.Dot(name)
+	errs := Errors{}
+	if !hclsyntax.ValidIdentifier(name) {
+		errs.At(p, fmt.Errorf("zone policy must be keyed by the name of a deployment variable, got %q", name))
+	}
+	errs.Add(validateZonePolicyZones(name, zp, p))
+	switch rv := zp.RegionVar; {
+	case rv == "":
+	case !hclsyntax.ValidIdentifier(rv):
+		errs.At(p.RegionVar, fmt.Errorf("region_var must be the name of a deployment variable, got %q", rv))
+	case rv == name || bp.ZonePolicy[rv].Zones != nil:
+		errs.At(p.RegionVar, fmt.Errorf("region_var %q is set by a zone policy", rv))
+	}
+	errs.Add(validateZonePolicyCounts(zp, p))
+	return errs.OrNil()
+}
+
+func validateZonePolicyZones(name string, zp ZonePolicy, p zonePolicyPath) error {
+	errs := Errors{}
+	if len(zp.Zones) == 0 {
+		errs.At(p.Zones, fmt.Errorf("zone policy of %q must list at least one zone", name))
+	}
+	for i, z := range zp.Zones {
+		if !zoneRegex.MatchString(z) {
+			errs.At(p.Zones.At(i), fmt.Errorf("%q is not a zone, e.g. us-central1-a", z))
+		} else if slices.Index(zp.Zones, z) < i {
+			errs.At(p.Zones.At(i), fmt.Errorf("zone %q is listed more than once", z))
+		}
+	}
+	return errs.OrNil()
+}
+
+func validateZonePolicyCounts(zp ZonePolicy, p zonePolicyPath) error {
+	errs := Errors{}
+	if zp.Count < 0 {
+		errs.At(p.Count, fmt.Errorf("count must not be negative, got %d", zp.Count))
+	}
+	if zp.AcceleratorCount < 0 {
+		errs.At(p.AcceleratorCount, fmt.Errorf("accelerator_count must not be negative, got %d", zp.AcceleratorCount))
+	}
+	if zp.AcceleratorCount > 0 && zp.AcceleratorType == "" {
+		errs.At(p.AcceleratorCount, fmt.Errorf("accelerator_count requires accelerator_type"))
+	}
+	if zp.Count > 0 && zp.MachineType == "" {
+		errs.At(p.Count, fmt.Errorf("count requires machine_type, quotas are checked for VMs of the machine type"))
+	}
+	return errs.OrNil()
+}
+
+// checkZonePolicyVarUses ensures that deployment variables set by zone
+// policies are only used where their value can change when deploying,
+// by settings of terraform modules
+func checkZonePolicyVarUses(bp Blueprint) error {
+	errs := Errors{}
+	picked := bp.ZonePolicyVars()
+	for n, v := range bp.Vars.Items() {
+		for _, u := range GetUsedDeploymentVars(v) {
+			if slices.Contains(picked, u) {
+				errs.At(Root.Vars.Dot(n), HintError{
+					Hint: fmt.Sprintf("use %q in module settings instead", u),
+					Err:  fmt.Errorf("deployment variable %q refers to %q, which is set by a zone policy when deploying", n, u)})
+			}
+		}
+	}
+	bp.WalkModulesSafe(func(p ModulePath, m *Module) {
+		if m.Kind != PackerKind {
+			return
+		}
+		for _, u := range GetUsedDeploymentVars(m.Settings.AsObject()) {
+			if slices.Contains(picked, u) {
+				errs.At(p.Settings, fmt.Errorf("deployment variable %q is set by a zone policy when deploying, it can only be used by terraform modules, module %q is a Packer module", u, m.ID))
+			}
+		}
+	})
+	return errs.OrNil()
+}
+
+// expandZonePolicy validates zone policies and sets deployment variables they
+// pick, that are not set, to the most preferred zone and its region. These
+// values are used until `ghpc deploy` picks a zone.
+func (bp *Blueprint) expandZonePolicy() error {
+	names := maps.Keys(bp.ZonePolicy)
+	slices.Sort(names)
+	errs := Errors{}
+	for _, name := range names {
+		errs.Add(validateZonePolicy(*bp, name, bp.ZonePolicy[name]))
+	}
+	if errs.Any() {
+		return errs
+	}
+	for _, name := range names {
+		zp := bp.ZonePolicy[name]
+		p := Root.Vars.Dot(name)
+		if !bp.Vars.Has(name) {
+			bp.Vars.Set(name, cty.StringVal(zp.Zones[0]))
+		}
+		v := bp.Vars.Get(name)
+		if v.Type() != cty.String || !slices.Contains(zp.Zones, v.AsString()) {
+			errs.At(p, HintError{
+				Hint: fmt.Sprintf("set it to one of %s, or leave it unset", strings.Join(zp.Zones, ", ")),
+				Err:  fmt.Errorf("deployment variable %q is not one of the zones of its zone policy", name)})
+			continue
+		}
+		if zp.RegionVar != "" && !bp.Vars.Has(zp.RegionVar) {
+			bp.Vars.Set(zp.RegionVar, cty.StringVal(ZoneRegion(v.AsString())))
+		}
+	}
+	if errs.Any() {
+		return errs
+	}
+	return checkZonePolicyVarUses(*bp)
+}
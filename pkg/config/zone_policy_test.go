@@ -0,0 +1,95 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestZoneRegion(c *C) {
+	c.Check(ZoneRegion("us-central1-a"), Equals, "us-central1")
+	c.Check(ZoneRegion("europe-west4-b"), Equals, "europe-west4")
+}
+
+func (s *zeroSuite) TestValidateZonePolicy(c *C) {
+	bp := Blueprint{}
+	ok := ZonePolicy{Zones: []string{"us-central1-a", "us-east4-b"}, RegionVar: "region", MachineType: "a2-highgpu-1g", Count: 2}
+	c.Check(validateZonePolicy(bp, "zone", ok), IsNil)
+
+	c.Check(validateZonePolicy(bp, "zone", ZonePolicy{}), ErrorMatches, `.*must list at least one zone`)
+	c.Check(validateZonePolicy(bp, "zone", ZonePolicy{Zones: []string{"us-central1"}}),
+		ErrorMatches, `.*"us-central1" is not a zone.*`)
+	c.Check(validateZonePolicy(bp, "zone", ZonePolicy{Zones: []string{"us-central1-a", "us-central1-a"}}),
+		ErrorMatches, `.*zone "us-central1-a" is listed more than once`)
+	c.Check(validateZonePolicy(bp, "zone", ZonePolicy{Zones: ok.Zones, RegionVar: "zone"}),
+		ErrorMatches, `.*region_var "zone" is set by a zone policy`)
+	c.Check(validateZonePolicy(bp, "zone", ZonePolicy{Zones: ok.Zones, AcceleratorCount: 4}),
+		ErrorMatches, `.*accelerator_count requires accelerator_type`)
+	c.Check(validateZonePolicy(bp, "zone", ZonePolicy{Zones: ok.Zones, Count: 4}),
+		ErrorMatches, `.*count requires machine_type.*`)
+}
+
+func (s *zeroSuite) TestExpandZonePolicy(c *C) {
+	policy := map[string]ZonePolicy{
+		"zone": {Zones: []string{"us-east4-b", "us-central1-a"}, RegionVar: "region"}}
+
+	{ // unset variables are set to the most preferred zone
+		bp := Blueprint{ZonePolicy: policy}
+		c.Assert(bp.expandZonePolicy(), IsNil)
+		c.Check(bp.Vars.Get("zone"), DeepEquals, cty.StringVal("us-east4-b"))
+		c.Check(bp.Vars.Get("region"), DeepEquals, cty.StringVal("us-east4"))
+		c.Check(bp.ZonePolicyVars(), DeepEquals, []string{"region", "zone"})
+	}
+
+	{ // set variables are kept
+		bp := Blueprint{ZonePolicy: policy, Vars: NewDict(map[string]cty.Value{
+			"zone": cty.StringVal("us-central1-a")})}
+		c.Assert(bp.expandZonePolicy(), IsNil)
+		c.Check(bp.Vars.Get("zone"), DeepEquals, cty.StringVal("us-central1-a"))
+		c.Check(bp.Vars.Get("region"), DeepEquals, cty.StringVal("us-central1"))
+	}
+
+	{ // zone not listed
+		bp := Blueprint{ZonePolicy: policy, Vars: NewDict(map[string]cty.Value{
+			"zone": cty.StringVal("us-west1-a")})}
+		c.Check(bp.expandZonePolicy(), ErrorMatches, `(?s).*"zone" is not one of the zones of its zone policy.*`)
+	}
+
+	{ // used by other variables
+		bp := Blueprint{ZonePolicy: policy, Vars: NewDict(map[string]cty.Value{
+			"subnet_region": GlobalRef("region").AsValue()})}
+		c.Check(bp.expandZonePolicy(), ErrorMatches, `(?s).*"subnet_region" refers to "region", which is set by a zone policy.*`)
+	}
+
+	{ // used by Packer modules
+		bp := Blueprint{ZonePolicy: policy, DeploymentGroups: []DeploymentGroup{{Name: "g", Modules: []Module{
+			{ID: "img", Kind: PackerKind, Settings: NewDict(map[string]cty.Value{"zone": GlobalRef("zone").AsValue()})},
+		}}}}
+		c.Check(bp.expandZonePolicy(), ErrorMatches, `(?s).*can only be used by terraform modules, module "img" is a Packer module`)
+	}
+}
+
+func (s *zeroSuite) TestZonePolicyVarsOf(c *C) {
+	bp := Blueprint{ZonePolicy: map[string]ZonePolicy{
+		"zone": {Zones: []string{"us-central1-a"}, RegionVar: "region"}}}
+	g := DeploymentGroup{Modules: []Module{
+		{ID: "vm", Settings: NewDict(map[string]cty.Value{
+			"zone":       GlobalRef("zone").AsValue(),
+			"project_id": GlobalRef("project_id").AsValue()})},
+	}}
+	c.Check(bp.ZonePolicyVarsOf(g), DeepEquals, []string{"zone"})
+	c.Check(bp.ZonePolicyVarsOf(DeploymentGroup{}), HasLen, 0)
+}
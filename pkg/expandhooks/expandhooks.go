@@ -0,0 +1,181 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package expandhooks runs site-specific transforms of blueprints, after the
+// standard expansion and before the deployment is written, e.g. to add
+// mandatory audit modules to every group.
+//
+// Transforms are either Go hooks compiled into ghpc, registered from an init
+// function of a site package:
+//
+//	func init() {
+//		expandhooks.Register("audit", expandhooks.HookFunc(func(bp *config.Blueprint) error {
+//			for _, g := range bp.DeploymentGroups {
+//				...
+//			}
+//		}))
+//	}
+//
+// or external binaries listed under `expand_hooks` of the config file, see Exec.
+// Hooks run in order of registration, external ones last.
+package expandhooks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// Hook transforms an expanded blueprint in place. Settings are expressions as
+// in the blueprint; modules must be added with config.Blueprint.AppendModule for
+// them to be expanded too. The blueprint is validated once all hooks ran.
+type Hook interface {
+	Apply(bp *config.Blueprint) error
+}
+
+// HookFunc adapts a function to a Hook
+type HookFunc func(bp *config.Blueprint) error
+
+// Apply calls f(bp)
+func (f HookFunc) Apply(bp *config.Blueprint) error {
+	return f(bp)
+}
+
+type namedHook struct {
+	name string
+	hook Hook
+}
+
+var registered []namedHook
+
+// Register adds a hook applied to every blueprint. It panics if a hook of the
+// same name is already registered.
+func Register(name string, h Hook) {
+	if slices.ContainsFunc(registered, func(n namedHook) bool { return n.name == name }) {
+		panic(fmt.Sprintf("expand hook %q is registered twice", name))
+	}
+	registered = append(registered, namedHook{name, h})
+}
+
+// Registered returns names of registered hooks, in order of registration
+func Registered() []string {
+	res := []string{}
+	for _, n := range registered {
+		res = append(res, n.name)
+	}
+	return res
+}
+
+// Apply applies registered hooks, then the external ones, to the expanded
+// blueprint
+func Apply(bp *config.Blueprint, execs []Exec) error {
+	hooks := slices.Clone(registered)
+	for _, e := range execs {
+		hooks = append(hooks, namedHook{e.Name, e})
+	}
+	for _, h := range hooks {
+		logging.Info("Applying expand hook %s", h.name)
+		if err := h.hook.Apply(bp); err != nil {
+			return fmt.Errorf("expand hook %s failed: %w", h.name, err)
+		}
+	}
+	return nil
+}
+
+// Exec is a hook running an external binary. The expanded blueprint, without
+// values of secret variables, is given as YAML on standard input; the binary
+// writes the changes to make as YAML on standard output:
+//
+//	add_modules:
+//	- group: primary
+//	  module:
+//	    id: audit-primary
+//	    source: /opt/site/modules/audit
+//	    settings:
+//	      sink: $(vars.audit_sink)
+//
+// Standard error is passed through to the user.
+type Exec struct {
+	Name    string   `yaml:"name"`
+	Command []string `yaml:"command"`
+}
+
+// execOutput holds changes an external binary makes to the blueprint
+type execOutput struct {
+	AddModules []struct {
+		Group  config.GroupName `yaml:"group"`
+		Module config.Module    `yaml:"module"`
+	} `yaml:"add_modules"`
+}
+
+// Validate ensures the hook is named and has a command
+func (e Exec) Validate() error {
+	if e.Name == "" {
+		return errors.New("expand hook must have a name")
+	}
+	if len(e.Command) == 0 || e.Command[0] == "" {
+		return fmt.Errorf("expand hook %s must have a command", e.Name)
+	}
+	return nil
+}
+
+// Apply runs the binary and applies the changes it outputs
+func (e Exec) Apply(bp *config.Blueprint) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "ghpc-expand-hook-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "expanded.yaml")
+	if err := bp.Export(in); err != nil {
+		return err
+	}
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(e.Command[0], e.Command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = f, &stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	var out execOutput
+	dec := yaml.NewDecoder(&stdout)
+	dec.KnownFields(true)
+	if err := dec.Decode(&out); err != nil && !errors.Is(err, io.EOF) { // no output, no changes
+		return fmt.Errorf("invalid output: %w", err)
+	}
+	for _, a := range out.AddModules {
+		if err := bp.AppendModule(a.Group, a.Module); err != nil {
+			return fmt.Errorf("failed to add module %q to group %q: %w", a.Module.ID, a.Group, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expandhooks
+
+import (
+	"errors"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/modulereader"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func testBlueprint(c *C) config.Blueprint {
+	net := config.Module{ID: "net", Kind: config.TerraformKind, Source: c.TestName() + "/net"}
+	modulereader.SetModuleInfo(net.Source, "terraform", modulereader.ModuleInfo{})
+	modulereader.SetModuleInfo(c.TestName()+"/audit", "terraform", modulereader.ModuleInfo{
+		Inputs: []modulereader.VarInfo{{Name: "sink"}}})
+	return config.Blueprint{
+		BlueprintName:    "test",
+		Vars:             config.NewDict(map[string]cty.Value{"deployment_name": cty.StringVal("green")}),
+		DeploymentGroups: []config.DeploymentGroup{{Name: "primary", Modules: []config.Module{net}}}}
+}
+
+func (s *MySuite) TestApply(c *C) {
+	defer func(r []namedHook) { registered = r }(registered)
+	registered = nil
+
+	order := []string{}
+	Register("first", HookFunc(func(bp *config.Blueprint) error {
+		order = append(order, "first")
+		return nil
+	}))
+	Register("second", HookFunc(func(bp *config.Blueprint) error {
+		order = append(order, "second")
+		return nil
+	}))
+	c.Check(Registered(), DeepEquals, []string{"first", "second"})
+	c.Check(func() { Register("first", HookFunc(nil)) }, PanicMatches, `expand hook "first" is registered twice`)
+
+	bp := testBlueprint(c)
+	c.Check(Apply(&bp, nil), IsNil)
+	c.Check(order, DeepEquals, []string{"first", "second"})
+
+	Register("failing", HookFunc(func(bp *config.Blueprint) error { return errors.New("no audit sink") }))
+	c.Check(Apply(&bp, nil), ErrorMatches, "expand hook failing failed: no audit sink")
+}
+
+func (s *MySuite) TestExec(c *C) {
+	dir := c.MkDir()
+	script := func(name string, body string) []string {
+		p := filepath.Join(dir, name)
+		c.Assert(os.WriteFile(p, []byte("#!/bin/sh\n"+body), 0755), IsNil)
+		return []string{p}
+	}
+
+	{ // Success, the blueprint is given on standard input
+		bp := testBlueprint(c)
+		e := Exec{Name: "audit", Command: script("audit.sh", `
+grep -q "blueprint_name: test" || exit 1
+cat <<EOF
+add_modules:
+- group: primary
+  module:
+    id: audit
+    source: `+c.TestName()+`/audit
+    settings:
+      sink: logs
+EOF
+`)}
+		c.Assert(e.Apply(&bp), IsNil)
+		m, err := bp.Module("audit")
+		c.Assert(err, IsNil)
+		c.Check(m.Settings.Get("sink"), DeepEquals, cty.StringVal("logs"))
+	}
+
+	{ // No output, no changes
+		bp := testBlueprint(c)
+		c.Check(Exec{Name: "noop", Command: script("noop.sh", "cat > /dev/null")}.Apply(&bp), IsNil)
+		c.Check(bp.DeploymentGroups[0].Modules, HasLen, 1)
+	}
+
+	{ // Fail: command fails
+		bp := testBlueprint(c)
+		c.Check(Exec{Name: "fail", Command: script("fail.sh", "exit 3")}.Apply(&bp), ErrorMatches, "exit status 3")
+	}
+
+	{ // Fail: unknown field in output
+		bp := testBlueprint(c)
+		e := Exec{Name: "bad", Command: script("bad.sh", "echo 'remove_modules: [net]'")}
+		c.Check(e.Apply(&bp), ErrorMatches, "(?s)invalid output: .*field remove_modules not found.*")
+	}
+
+	{ // Fail: module added to absent group
+		bp := testBlueprint(c)
+		e := Exec{Name: "absent", Command: script("absent.sh", "echo 'add_modules: [{group: secondary, module: {id: audit, source: x}}]'")}
+		c.Check(e.Apply(&bp), ErrorMatches, `failed to add module "audit" to group "secondary": .*does not exist`)
+	}
+}
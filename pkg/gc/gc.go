@@ -0,0 +1,219 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gc finds cloud resources labeled as part of a deployment that are
+// not in terraform state of any of its groups, e.g. instances created by an
+// autoscaler, which destroying the deployment leaves behind
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/gcpauth"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// DeploymentLabel is the label set by ghpc to the name of the deployment,
+// resources are only collected by it
+const DeploymentLabel = "ghpc_deployment"
+
+// Kinds of resources collected
+const (
+	Instance = "instance"
+	Disk     = "disk"
+)
+
+// Resource is a Compute Engine resource labeled as part of the deployment
+type Resource struct {
+	Kind    string
+	Project string
+	// Location is the zone of the resource, or the region of regional disks
+	Location string
+	Regional bool
+	Name     string
+	SelfLink string
+	Created  string
+}
+
+// Client lists and deletes resources with the Compute Engine API
+type Client interface {
+	Instances(ctx context.Context, project string, filter string) ([]*compute.Instance, error)
+	Disks(ctx context.Context, project string, filter string) ([]*compute.Disk, error)
+	// Delete deletes the resource and waits for it to be gone, resources
+	// already gone are not an error
+	Delete(ctx context.Context, r Resource) error
+}
+
+type computeClient struct {
+	s *compute.Service
+}
+
+// NewClient returns a client using application default credentials
+func NewClient(ctx context.Context) (Client, error) {
+	s, err := compute.NewService(ctx, gcpauth.ClientOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	return computeClient{s}, nil
+}
+
+func (c computeClient) Instances(ctx context.Context, project string, filter string) ([]*compute.Instance, error) {
+	res := []*compute.Instance{}
+	err := c.s.Instances.AggregatedList(project).Filter(filter).Pages(ctx, func(l *compute.InstanceAggregatedList) error {
+		for _, sl := range l.Items {
+			res = append(res, sl.Instances...)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (c computeClient) Disks(ctx context.Context, project string, filter string) ([]*compute.Disk, error) {
+	res := []*compute.Disk{}
+	err := c.s.Disks.AggregatedList(project).Filter(filter).Pages(ctx, func(l *compute.DiskAggregatedList) error {
+		for _, sl := range l.Items {
+			res = append(res, sl.Disks...)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (c computeClient) Delete(ctx context.Context, r Resource) error {
+	var op *compute.Operation
+	var err error
+	switch {
+	case r.Kind == Instance:
+		op, err = c.s.Instances.Delete(r.Project, r.Location, r.Name).Context(ctx).Do()
+	case r.Regional:
+		op, err = c.s.RegionDisks.Delete(r.Project, r.Location, r.Name).Context(ctx).Do()
+	default:
+		op, err = c.s.Disks.Delete(r.Project, r.Location, r.Name).Context(ctx).Do()
+	}
+	var herr *googleapi.Error
+	if errors.As(err, &herr) && herr.Code == http.StatusNotFound {
+		return nil // e.g. boot disk deleted with its instance
+	}
+	for err == nil && op.Status != "DONE" {
+		if r.Regional {
+			op, err = c.s.RegionOperations.Wait(r.Project, r.Location, op.Name).Context(ctx).Do()
+		} else {
+			op, err = c.s.ZoneOperations.Wait(r.Project, r.Location, op.Name).Context(ctx).Do()
+		}
+	}
+	if err == nil && op.Error != nil && len(op.Error.Errors) > 0 {
+		err = errors.New(op.Error.Errors[0].Message)
+	}
+	return err
+}
+
+// Filter returns the Compute Engine list filter matching resources having all
+// the labels
+func Filter(labels map[string]string) string {
+	keys := maps.Keys(labels)
+	slices.Sort(keys)
+	exprs := []string{}
+	for _, k := range keys {
+		exprs = append(exprs, fmt.Sprintf("(labels.%s = %q)", k, labels[k]))
+	}
+	return strings.Join(exprs, " ")
+}
+
+// createdByManager tells whether the instance was created by an instance group
+// manager, which deletes it when it is deleted itself
+func createdByManager(i *compute.Instance) bool {
+	if i.Metadata == nil {
+		return false
+	}
+	return slices.ContainsFunc(i.Metadata.Items, func(m *compute.MetadataItems) bool {
+		return m.Key == "created-by" && m.Value != nil && strings.Contains(*m.Value, "/instanceGroupManagers/")
+	})
+}
+
+// Find returns instances and disks of the project having all the labels, but
+// whose self links are not in terraform state. Labels must include a non-empty
+// DeploymentLabel, so that resources of other deployments are never collected. Instances created by instance
+// group managers are left to their manager, and disks attached to instances
+// that are kept are kept as well. Instances come first, so that deleting
+// resources in order frees disks attached to them.
+func Find(ctx context.Context, c Client, project string, labels map[string]string, managed []string) ([]Resource, error) {
+	if labels[DeploymentLabel] == "" {
+		return nil, fmt.Errorf("resources of the deployment can not be found without the %s label", DeploymentLabel)
+	}
+	filter := Filter(labels)
+	res := []Resource{}
+
+	instances, err := c.Instances(ctx, project, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instances in project %s: %w", project, err)
+	}
+	collected := []string{}
+	for _, i := range instances {
+		if slices.Contains(managed, i.SelfLink) || createdByManager(i) {
+			continue
+		}
+		collected = append(collected, i.SelfLink)
+		res = append(res, Resource{
+			Kind: Instance, Project: project, Location: path.Base(i.Zone),
+			Name: i.Name, SelfLink: i.SelfLink, Created: i.CreationTimestamp})
+	}
+
+	disks, err := c.Disks(ctx, project, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list disks in project %s: %w", project, err)
+	}
+	for _, d := range disks {
+		kept := slices.ContainsFunc(d.Users, func(u string) bool { return !slices.Contains(collected, u) })
+		if slices.Contains(managed, d.SelfLink) || kept {
+			continue
+		}
+		r := Resource{Kind: Disk, Project: project, Location: path.Base(d.Zone),
+			Name: d.Name, SelfLink: d.SelfLink, Created: d.CreationTimestamp}
+		if d.Zone == "" {
+			r.Location, r.Regional = path.Base(d.Region), true
+		}
+		res = append(res, r)
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.Kind != b.Kind {
+			return a.Kind == Instance
+		}
+		if a.Location != b.Location {
+			return a.Location < b.Location
+		}
+		return a.Name < b.Name
+	})
+	return res, nil
+}
+
+// Delete deletes the resources in order
+func Delete(ctx context.Context, c Client, rs []Resource) error {
+	for _, r := range rs {
+		if err := c.Delete(ctx, r); err != nil {
+			return fmt.Errorf("failed to delete %s %s in %s: %w", r.Kind, r.Name, r.Location, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gc
+
+import (
+	"context"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+	. "gopkg.in/check.v1"
+)
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type fakeClient struct {
+	instances []*compute.Instance
+	disks     []*compute.Disk
+	filters   []string
+	deleted   []string
+}
+
+func (f *fakeClient) Instances(ctx context.Context, project string, filter string) ([]*compute.Instance, error) {
+	f.filters = append(f.filters, filter)
+	return f.instances, nil
+}
+
+func (f *fakeClient) Disks(ctx context.Context, project string, filter string) ([]*compute.Disk, error) {
+	f.filters = append(f.filters, filter)
+	return f.disks, nil
+}
+
+func (f *fakeClient) Delete(ctx context.Context, r Resource) error {
+	f.deleted = append(f.deleted, r.Kind+"/"+r.Name)
+	return nil
+}
+
+const zone = "https://www.googleapis.com/compute/v1/projects/p/zones/us-central1-a"
+
+func instance(name string) *compute.Instance {
+	return &compute.Instance{Name: name, Zone: zone, SelfLink: zone + "/instances/" + name}
+}
+
+func disk(name string, users ...string) *compute.Disk {
+	return &compute.Disk{Name: name, Zone: zone, SelfLink: zone + "/disks/" + name, Users: users}
+}
+
+func (s *MySuite) TestFilter(c *C) {
+	c.Check(Filter(map[string]string{"ghpc_deployment": "dep", "ghpc_blueprint": "bp"}), Equals,
+		`(labels.ghpc_blueprint = "bp") (labels.ghpc_deployment = "dep")`)
+}
+
+func (s *MySuite) TestFind(c *C) {
+	ctx := context.Background()
+	labels := map[string]string{"ghpc_deployment": "dep"}
+
+	controller, node, migVM := instance("controller"), instance("node-0"), instance("mig-vm")
+	created := "projects/1/zones/us-central1-a/instanceGroupManagers/mig"
+	migVM.Metadata = &compute.Metadata{Items: []*compute.MetadataItems{{Key: "created-by", Value: &created}}}
+	f := &fakeClient{
+		instances: []*compute.Instance{node, controller, migVM},
+		disks: []*compute.Disk{
+			disk("controller", controller.SelfLink),
+			disk("node-0", node.SelfLink),
+			disk("scratch"),
+			{Name: "shared", Region: "https://www.googleapis.com/compute/v1/projects/p/regions/us-central1"},
+		},
+	}
+
+	got, err := Find(ctx, f, "p", labels, []string{controller.SelfLink, zone + "/disks/controller"})
+	c.Assert(err, IsNil)
+	c.Check(f.filters, DeepEquals, []string{`(labels.ghpc_deployment = "dep")`, `(labels.ghpc_deployment = "dep")`})
+	names := []string{}
+	for _, r := range got {
+		names = append(names, r.Kind+"/"+r.Location+"/"+r.Name)
+	}
+	c.Check(names, DeepEquals, []string{
+		"instance/us-central1-a/node-0",
+		"disk/us-central1/shared",
+		"disk/us-central1-a/node-0",
+		"disk/us-central1-a/scratch",
+	})
+	c.Check(got[1].Regional, Equals, true)
+
+	c.Assert(Delete(ctx, f, got), IsNil)
+	c.Check(f.deleted, DeepEquals, []string{"instance/node-0", "disk/shared", "disk/node-0", "disk/scratch"})
+
+	{ // disks attached to kept instances are kept
+		f := &fakeClient{disks: []*compute.Disk{disk("data", controller.SelfLink)}}
+		got, err := Find(ctx, f, "p", labels, nil)
+		c.Assert(err, IsNil)
+		c.Check(got, HasLen, 0)
+	}
+
+	_, err = Find(ctx, f, "p", nil, nil)
+	c.Check(err, ErrorMatches, ".*without the ghpc_deployment label")
+	_, err = Find(ctx, f, "p", map[string]string{"owner": "me", DeploymentLabel: ""}, nil)
+	c.Check(err, ErrorMatches, ".*without the ghpc_deployment label")
+}
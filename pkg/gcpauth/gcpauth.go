@@ -0,0 +1,49 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gcpauth holds the credentials Google API clients of ghpc run with
+package gcpauth
+
+import (
+	"sync"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+var (
+	mu          sync.Mutex
+	tokenSource oauth2.TokenSource
+)
+
+// SetTokenSource makes Google API clients authenticate with the token source,
+// e.g. of credentials minted for the deployment, instead of application
+// default credentials
+func SetTokenSource(ts oauth2.TokenSource) {
+	mu.Lock()
+	defer mu.Unlock()
+	tokenSource = ts
+}
+
+// ClientOptions returns opts, along with the token source set by
+// SetTokenSource if any; clients use application default credentials
+// otherwise
+func ClientOptions(opts ...option.ClientOption) []option.ClientOption {
+	mu.Lock()
+	defer mu.Unlock()
+	if tokenSource == nil {
+		return opts
+	}
+	return append(opts, option.WithTokenSource(tokenSource))
+}
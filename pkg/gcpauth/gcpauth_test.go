@@ -0,0 +1,43 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpauth
+
+import (
+	"testing"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+	. "gopkg.in/check.v1"
+)
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *MySuite) TestClientOptions(c *C) {
+	defer SetTokenSource(nil)
+	quota := option.WithQuotaProject("p")
+
+	c.Check(ClientOptions(), HasLen, 0)
+	c.Check(ClientOptions(quota), HasLen, 1)
+
+	SetTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "minted"}))
+	c.Check(ClientOptions(), HasLen, 1)
+	c.Check(ClientOptions(quota), HasLen, 2)
+}
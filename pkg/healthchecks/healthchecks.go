@@ -0,0 +1,199 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package healthchecks implements verification of deployed clusters
+package healthchecks
+
+import (
+	"context"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/remote"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	tcpPortName    = "tcp_port"
+	slurmNodesName = "slurm_nodes"
+	mountName      = "mount"
+)
+
+const dialTimeout = 10 * time.Second
+
+type implementation struct {
+	inputs   []string
+	optional []string
+	run      func(context.Context, map[string]string) error
+}
+
+func implementations() map[string]implementation {
+	ssh := remote.TargetInputs
+	return map[string]implementation{
+		tcpPortName:    {[]string{"host", "port"}, nil, checkTCPPort},
+		slurmNodesName: {append(slices.Clone(ssh), "nodes"), remote.OptionalTargetInputs, checkSlurmNodes},
+		mountName:      {append(slices.Clone(ssh), "path"), remote.OptionalTargetInputs, checkMount},
+	}
+}
+
+// Outcome is the result of a single health check
+type Outcome struct {
+	Name string
+	Err  error
+}
+
+// Passed returns true if the health check succeeded
+func (r Outcome) Passed() bool {
+	return r.Err == nil
+}
+
+func checkName(h config.HealthCheck) string {
+	if h.Name != "" {
+		return h.Name
+	}
+	return h.Check
+}
+
+// Validate ensures that all health checks of the blueprint are known and
+// given exactly the inputs they require
+func Validate(bp config.Blueprint) error {
+	impl := implementations()
+	errs := config.Errors{}
+	for ih, h := range bp.HealthChecks {
+		p := config.Root.HealthChecks.At(ih)
+		i, ok := impl[h.Check]
+		if !ok {
+			errs.At(p.Check, fmt.Errorf("unknown health check %q, expected one of %q", h.Check, sortedKeys(impl)))
+			continue
+		}
+		for _, inp := range i.inputs {
+			if !h.Inputs.Has(inp) {
+				errs.At(p.Inputs, fmt.Errorf("a required input %q was not provided", inp))
+			}
+		}
+		for k := range h.Inputs.Items() {
+			if !slices.Contains(i.inputs, k) && !slices.Contains(i.optional, k) {
+				errs.At(p.Inputs.Dot(k), fmt.Errorf("unexpected input %q, health check %q accepts %q", k, h.Check, append(slices.Clone(i.inputs), i.optional...)))
+			}
+		}
+	}
+	return errs.OrNil()
+}
+
+// Execute runs all health checks of the blueprint and returns their results in
+// order of declaration. Inputs referring to module outputs are evaluated with
+// outputs of deployed modules. Checks run on deployed VMs stop when ctx is
+// cancelled.
+func Execute(ctx context.Context, bp config.Blueprint, outputs map[config.ModuleID]map[string]cty.Value) []Outcome {
+	impl := implementations()
+	res := []Outcome{}
+	for _, h := range bp.HealthChecks {
+		r := Outcome{Name: checkName(h)}
+		if i, ok := impl[h.Check]; !ok {
+			r.Err = fmt.Errorf("unknown health check %q", h.Check)
+		} else if inp, err := inputsAsStrings(bp, h.Inputs, outputs); err != nil {
+			r.Err = err
+		} else {
+			r.Err = i.run(ctx, inp)
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+func sortedKeys(m map[string]implementation) []string {
+	ks := maps.Keys(m)
+	slices.Sort(ks)
+	return ks
+}
+
+func inputsAsStrings(bp config.Blueprint, inputs config.Dict, outputs map[config.ModuleID]map[string]cty.Value) (map[string]string, error) {
+	ev, err := bp.EvalWithOutputs(inputs.AsObject(), outputs)
+	if err != nil {
+		return nil, err
+	}
+	ms := map[string]string{}
+	for k, v := range ev.AsValueMap() {
+		s, err := convert.Convert(v, cty.String)
+		if err != nil || s.IsNull() {
+			return nil, fmt.Errorf("health check input %q must be a string or a number, got %s", k, v.Type().FriendlyName())
+		}
+		ms[k] = s.AsString()
+	}
+	return ms, nil
+}
+
+func checkTCPPort(ctx context.Context, inp map[string]string) error {
+	addr := net.JoinHostPort(inp["host"], inp["port"])
+	d := net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("port %s is not open: %w", addr, err)
+	}
+	return conn.Close()
+}
+
+func checkSlurmNodes(ctx context.Context, inp map[string]string) error {
+	want, err := strconv.Atoi(inp["nodes"])
+	if err != nil {
+		return fmt.Errorf("input \"nodes\" must be an integer, got %q", inp["nodes"])
+	}
+	out, err := runSSH(ctx, inp, "sinfo --noheader --Node --format=%N")
+	if err != nil {
+		return err
+	}
+	nodes := map[string]bool{}
+	for _, n := range strings.Fields(out) {
+		nodes[n] = true
+	}
+	if len(nodes) < want {
+		return fmt.Errorf("sinfo on %s reported %d nodes, expected at least %d", inp["instance"], len(nodes), want)
+	}
+	return nil
+}
+
+func checkMount(ctx context.Context, inp map[string]string) error {
+	if _, err := runSSH(ctx, inp, "mountpoint -q "+shellQuote(inp["path"])); err != nil {
+		return fmt.Errorf("%s is not mounted on %s: %w", inp["path"], inp["instance"], err)
+	}
+	return nil
+}
+
+// shellQuote quotes s as a single word of the remote shell, nothing in it is
+// expanded
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// runSSH runs the command on the VM given by inputs of the health check
+func runSSH(ctx context.Context, inp map[string]string, command string) (string, error) {
+	ti := map[string]string{}
+	for k, v := range inp {
+		if slices.Contains(remote.TargetInputs, k) || slices.Contains(remote.OptionalTargetInputs, k) {
+			ti[k] = v
+		}
+	}
+	t, err := remote.NewTarget(ti)
+	if err != nil {
+		return "", err
+	}
+	return remote.RunOn(ctx, t, command)
+}
@@ -0,0 +1,160 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthchecks
+
+import (
+	"context"
+	"errors"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/remote"
+	"net"
+	"os/exec"
+	"testing"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func sshInputs(extra map[string]cty.Value) config.Dict {
+	d := config.NewDict(map[string]cty.Value{
+		"project_id": config.GlobalRef("project_id").AsValue(),
+		"zone":       cty.StringVal("us-central1-a"),
+		"instance":   cty.StringVal("hpc-controller"),
+	})
+	for k, v := range extra {
+		d.Set(k, v)
+	}
+	return d
+}
+
+func stubCommand(c *C, out string, err error) func() {
+	orig := remote.RunOn
+	remote.RunOn = func(_ context.Context, t remote.Target, command string) (string, error) {
+		c.Check(t, Equals, remote.Target{Project: "test-project", Zone: "us-central1-a", Instance: "hpc-controller"})
+		return out, err
+	}
+	return func() { remote.RunOn = orig }
+}
+
+func (s *MySuite) TestValidate(c *C) {
+	{ // Success
+		bp := config.Blueprint{HealthChecks: []config.HealthCheck{
+			{Check: "tcp_port", Inputs: config.NewDict(map[string]cty.Value{
+				"host": cty.StringVal("10.0.0.2"),
+				"port": cty.NumberIntVal(6817)})},
+			{Check: "mount", Inputs: sshInputs(map[string]cty.Value{"path": cty.StringVal("/home")})},
+		}}
+		c.Check(Validate(bp), IsNil)
+	}
+
+	{ // Fail: unknown check
+		bp := config.Blueprint{HealthChecks: []config.HealthCheck{{Check: "ping"}}}
+		c.Check(Validate(bp), ErrorMatches, ".*unknown health check \"ping\".*")
+	}
+
+	{ // Fail: missing and unexpected inputs
+		bp := config.Blueprint{HealthChecks: []config.HealthCheck{
+			{Check: "tcp_port", Inputs: config.NewDict(map[string]cty.Value{
+				"address": cty.StringVal("10.0.0.2"),
+				"port":    cty.NumberIntVal(6817)})},
+		}}
+		err := Validate(bp)
+		c.Check(err, ErrorMatches, "(?s).*required input \"host\".*")
+		c.Check(err, ErrorMatches, "(?s).*unexpected input \"address\".*")
+	}
+}
+
+func (s *MySuite) TestTCPPort(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	c.Check(checkTCPPort(context.Background(), map[string]string{"host": host, "port": port}), IsNil)
+
+	l.Close()
+	c.Check(checkTCPPort(context.Background(), map[string]string{"host": host, "port": port}), ErrorMatches, ".*is not open.*")
+}
+
+func (s *MySuite) TestExecute(c *C) {
+	bp := config.Blueprint{
+		Vars: config.NewDict(map[string]cty.Value{"project_id": cty.StringVal("test-project")}),
+		HealthChecks: []config.HealthCheck{
+			{Check: "slurm_nodes", Name: "compute nodes", Inputs: sshInputs(map[string]cty.Value{"nodes": cty.NumberIntVal(2)})},
+			{Check: "slurm_nodes", Inputs: sshInputs(map[string]cty.Value{"nodes": cty.NumberIntVal(4)})},
+			{Check: "slurm_nodes", Name: "by output", Inputs: sshInputs(map[string]cty.Value{
+				"instance": config.ModuleRef("slurm", "controller_name").AsValue(),
+				"nodes":    cty.NumberIntVal(1)})},
+		}}
+	outputs := map[config.ModuleID]map[string]cty.Value{
+		"slurm": {"controller_name": cty.StringVal("hpc-controller")}}
+
+	defer stubCommand(c, "hpc-node-0\nhpc-node-1\nhpc-node-1\nhpc-node-2\n", nil)()
+	res := Execute(context.Background(), bp, outputs)
+	c.Assert(res, HasLen, 3)
+	c.Check(res[0].Name, Equals, "compute nodes")
+	c.Check(res[0].Passed(), Equals, true)
+	c.Check(res[1].Name, Equals, "slurm_nodes")
+	c.Check(res[1].Err, ErrorMatches, ".*reported 3 nodes, expected at least 4.*")
+	c.Check(res[2].Passed(), Equals, true)
+
+	{ // Fail: group of the module was not deployed
+		res := Execute(context.Background(), bp, nil)
+		c.Check(res[2].Err, ErrorMatches, `.*output "controller_name" of module "slurm" is not known.*`)
+	}
+}
+
+func (s *MySuite) TestMount(c *C) {
+	inp := map[string]string{
+		"project_id": "test-project",
+		"zone":       "us-central1-a",
+		"instance":   "hpc-controller",
+		"path":       "/home"}
+
+	{ // Success
+		defer stubCommand(c, "", nil)()
+		c.Check(checkMount(context.Background(), inp), IsNil)
+	}
+
+	{ // Fail: not a mountpoint
+		defer stubCommand(c, "", errors.New("exit status 1"))()
+		c.Check(checkMount(context.Background(), inp), ErrorMatches, "/home is not mounted on hpc-controller.*")
+	}
+
+	{ // Success: path is not expanded by the remote shell
+		orig := remote.RunOn
+		defer func() { remote.RunOn = orig }()
+		var got string
+		remote.RunOn = func(_ context.Context, t remote.Target, command string) (string, error) {
+			got = command
+			return "", nil
+		}
+		inp["path"] = "/mnt/$(touch /tmp/pwned)/it's"
+		c.Check(checkMount(context.Background(), inp), IsNil)
+		c.Check(got, Equals, `mountpoint -q '/mnt/$(touch /tmp/pwned)/it'\''s'`)
+
+		out, err := exec.Command("sh", "-c", "printf %s "+shellQuote(inp["path"])).Output()
+		c.Assert(err, IsNil)
+		c.Check(string(out), Equals, inp["path"])
+	}
+}
@@ -0,0 +1,384 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package images manages VM images built by Packer deployment groups
+package images
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/modulewriter"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/slices"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// defaultManifestFile is the default of manifest_file of the custom-image module
+const defaultManifestFile = "packer-manifest.json"
+
+// Image is a VM image of a family built by a Packer deployment group
+type Image struct {
+	Project string
+	Name    string
+	Family  string
+	Created time.Time
+	// Deprecated images are not picked when instances refer to their family
+	Deprecated bool
+	// BuiltBy is the deployment whose Packer group builds the family
+	BuiltBy string
+	// UsedBy are deployments referring to the image in instance_image settings
+	UsedBy []string
+}
+
+// Deployment is a deployment directory and its expanded blueprint
+type Deployment struct {
+	Dir       string
+	Blueprint config.Blueprint
+}
+
+// Client reads and deletes images with the Compute Engine API
+type Client interface {
+	FamilyImages(ctx context.Context, project string, family string) ([]*compute.Image, error)
+	// Image returns nil if the image does not exist
+	Image(ctx context.Context, project string, name string) (*compute.Image, error)
+	Delete(ctx context.Context, project string, name string) error
+}
+
+type computeClient struct {
+	s *compute.Service
+}
+
+// NewClient returns a client using application default credentials
+func NewClient(ctx context.Context) (Client, error) {
+	s, err := compute.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return computeClient{s}, nil
+}
+
+func (c computeClient) FamilyImages(ctx context.Context, project string, family string) ([]*compute.Image, error) {
+	res := []*compute.Image{}
+	err := c.s.Images.List(project).Filter(fmt.Sprintf("family = %q", family)).Pages(ctx, func(l *compute.ImageList) error {
+		res = append(res, l.Items...)
+		return nil
+	})
+	return res, err
+}
+
+func (c computeClient) Image(ctx context.Context, project string, name string) (*compute.Image, error) {
+	img, err := c.s.Images.Get(project, name).Context(ctx).Do()
+	var herr *googleapi.Error
+	if errors.As(err, &herr) && herr.Code == http.StatusNotFound {
+		return nil, nil
+	}
+	return img, err
+}
+
+func (c computeClient) Delete(ctx context.Context, project string, name string) error {
+	_, err := c.s.Images.Delete(project, name).Context(ctx).Do()
+	return err
+}
+
+// builder is a Packer module of a deployment and the images it built
+type builder struct {
+	deployment string
+	project    string
+	family     string
+	// manifested are names of images recorded in the Packer build manifest
+	manifested []string
+}
+
+// reference is an instance_image setting, either of an image or a family
+type reference struct {
+	deployment string
+	project    string
+	name       string
+	family     string
+}
+
+func knownString(bp config.Blueprint, m config.Module, name string) (string, bool) {
+	if !m.Settings.Has(name) {
+		return "", false
+	}
+	v, err := bp.Eval(m.Settings.Get(name))
+	if err != nil || v.IsNull() || !v.IsKnown() || v.Type() != cty.String {
+		return "", false
+	}
+	return v.AsString(), true
+}
+
+// builders returns Packer modules of the deployment building images of a
+// family in a known project
+func builders(d Deployment) ([]builder, error) {
+	bp := d.Blueprint
+	res := []builder{}
+	for _, g := range bp.DeploymentGroups {
+		for _, m := range g.Modules {
+			if m.Kind != config.PackerKind {
+				continue
+			}
+			project, ok := knownString(bp, m, "project_id")
+			if !ok {
+				continue
+			}
+			family, ok := knownString(bp, m, "image_family")
+			if !ok {
+				family = bp.DeploymentName() // default of the custom-image module
+			}
+			manifest, ok := knownString(bp, m, "manifest_file")
+			if !ok {
+				manifest = defaultManifestFile
+			}
+			subPath, err := modulewriter.DeploymentSource(m)
+			if err != nil {
+				return nil, err
+			}
+			names, err := readManifest(filepath.Join(modulewriter.GroupDir(d.Dir, bp, g.Name), subPath, manifest))
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, builder{bp.DeploymentName(), project, family, names})
+		}
+	}
+	return res, nil
+}
+
+type packerManifest struct {
+	Builds []struct {
+		ArtifactID string `json:"artifact_id"`
+	} `json:"builds"`
+}
+
+// readManifest returns names of images recorded in the Packer build manifest,
+// none if the image was never built
+func readManifest(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pm packerManifest
+	if err := json.Unmarshal(b, &pm); err != nil {
+		return nil, fmt.Errorf("failed to parse Packer manifest %s: %w", path, err)
+	}
+	names := []string{}
+	for _, b := range pm.Builds {
+		// artifact ID of some builders is prefixed with the region or project
+		id := b.ArtifactID[strings.LastIndex(b.ArtifactID, ":")+1:]
+		if id != "" && !slices.Contains(names, id) {
+			names = append(names, id)
+		}
+	}
+	return names, nil
+}
+
+// references returns instance_image settings of modules of the deployment
+func references(d Deployment) []reference {
+	bp := d.Blueprint
+	res := []reference{}
+	bp.WalkModulesSafe(func(_ config.ModulePath, m *config.Module) {
+		if !m.Settings.Has("instance_image") {
+			return
+		}
+		v, err := bp.Eval(m.Settings.Get("instance_image"))
+		if err != nil || v.IsNull() || !v.IsWhollyKnown() || !(v.Type().IsObjectType() || v.Type().IsMapType()) {
+			return
+		}
+		r := reference{deployment: bp.DeploymentName()}
+		for k, f := range map[string]*string{"project": &r.project, "name": &r.name, "family": &r.family} {
+			if e, ok := v.AsValueMap()[k]; ok && !e.IsNull() && e.Type() == cty.String {
+				*f = e.AsString()
+			}
+		}
+		res = append(res, r)
+	})
+	return res
+}
+
+func newImage(img *compute.Image, project string, builtBy string) (Image, error) {
+	created, err := time.Parse(time.RFC3339, img.CreationTimestamp)
+	if err != nil {
+		return Image{}, fmt.Errorf("image %s has invalid creation time %q: %w", img.Name, img.CreationTimestamp, err)
+	}
+	return Image{
+		Project:    project,
+		Name:       img.Name,
+		Family:     img.Family,
+		Created:    created,
+		Deprecated: img.Deprecated != nil && img.Deprecated.State != "" && img.Deprecated.State != "ACTIVE",
+		BuiltBy:    builtBy,
+	}, nil
+}
+
+// Find returns images of families built by Packer groups of the deployments,
+// and images recorded in their build manifests that still exist. Images are
+// sorted by family, newest first, and annotated with deployments using them.
+func Find(ctx context.Context, c Client, deployments []Deployment) ([]Image, error) {
+	f := imageFinder{c: c, res: []Image{}, seen: map[string]bool{}}
+	refs := []reference{}
+	for _, d := range deployments {
+		bs, err := builders(d)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range bs {
+			if err := f.builder(ctx, b); err != nil {
+				return nil, err
+			}
+		}
+		refs = append(refs, references(d)...)
+	}
+
+	res := f.res
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Project != res[j].Project || res[i].Family != res[j].Family {
+			return res[i].Project+"/"+res[i].Family < res[j].Project+"/"+res[j].Family
+		}
+		return res[i].Created.After(res[j].Created)
+	})
+	markUsed(res, refs)
+	return res, nil
+}
+
+// imageFinder collects images built by Packer groups, each once
+type imageFinder struct {
+	c    Client
+	res  []Image
+	seen map[string]bool
+}
+
+func (f *imageFinder) add(img *compute.Image, project string, builtBy string) error {
+	if f.seen[project+"/"+img.Name] {
+		return nil
+	}
+	f.seen[project+"/"+img.Name] = true
+	i, err := newImage(img, project, builtBy)
+	if err != nil {
+		return err
+	}
+	f.res = append(f.res, i)
+	return nil
+}
+
+// builder collects images of the family the builder builds, and images of
+// its build manifest that still exist
+func (f *imageFinder) builder(ctx context.Context, b builder) error {
+	imgs, err := f.c.FamilyImages(ctx, b.project, b.family)
+	if err != nil {
+		return fmt.Errorf("failed to list images of family %s in project %s: %w", b.family, b.project, err)
+	}
+	for _, img := range imgs {
+		if err := f.add(img, b.project, b.deployment); err != nil {
+			return err
+		}
+	}
+	for _, n := range b.manifested {
+		if f.seen[b.project+"/"+n] {
+			continue
+		}
+		img, err := f.c.Image(ctx, b.project, n)
+		if err != nil {
+			return fmt.Errorf("failed to get image %s in project %s: %w", n, b.project, err)
+		}
+		if img == nil { // deleted since it was built
+			continue
+		}
+		if err := f.add(img, b.project, b.deployment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markUsed records deployments referring to each image, a reference to a
+// family uses its newest image that is not deprecated
+func markUsed(imgs []Image, refs []reference) {
+	for _, r := range refs {
+		for i := range imgs {
+			img := &imgs[i]
+			if r.project != "" && r.project != img.Project {
+				continue
+			}
+			used := r.name != "" && r.name == img.Name
+			if r.name == "" && r.family != "" && r.family == img.Family {
+				used = latestInFamily(imgs, *img) == img.Name
+			}
+			if used && !slices.Contains(img.UsedBy, r.deployment) {
+				img.UsedBy = append(img.UsedBy, r.deployment)
+			}
+		}
+	}
+}
+
+func latestInFamily(imgs []Image, of Image) string {
+	latest := Image{}
+	for _, img := range imgs {
+		if img.Project == of.Project && img.Family == of.Family && !img.Deprecated && img.Created.After(latest.Created) {
+			latest = img
+		}
+	}
+	return latest.Name
+}
+
+// PrunePolicy selects images to delete. The newest Keep images of each family
+// and images used by deployments are always kept.
+type PrunePolicy struct {
+	Keep int
+	// OlderThan keeps images created less than this long ago
+	OlderThan time.Duration
+}
+
+// Select returns images to delete among imgs as returned by Find
+func (p PrunePolicy) Select(imgs []Image, now time.Time) []Image {
+	byFamily := map[string][]Image{}
+	for _, img := range imgs {
+		f := img.Project + "/" + img.Family
+		byFamily[f] = append(byFamily[f], img)
+	}
+	res := []Image{}
+	for _, img := range imgs {
+		fam := byFamily[img.Project+"/"+img.Family]
+		rank := slices.IndexFunc(fam, func(o Image) bool { return o.Name == img.Name })
+		// images of families are sorted newest first by Find
+		if rank < p.Keep || len(img.UsedBy) > 0 || now.Sub(img.Created) < p.OlderThan {
+			continue
+		}
+		res = append(res, img)
+	}
+	return res
+}
+
+// Delete deletes the images, it stops at the first failure
+func Delete(ctx context.Context, c Client, imgs []Image) error {
+	for _, img := range imgs {
+		if err := c.Delete(ctx, img.Project, img.Name); err != nil {
+			return fmt.Errorf("failed to delete image %s in project %s: %w", img.Name, img.Project, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"context"
+	"hpc-toolkit/pkg/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zclconf/go-cty/cty"
+	compute "google.golang.org/api/compute/v1"
+	. "gopkg.in/check.v1"
+)
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type fakeClient struct {
+	images  map[string][]*compute.Image // by project
+	deleted []string
+}
+
+func (f *fakeClient) FamilyImages(ctx context.Context, project string, family string) ([]*compute.Image, error) {
+	res := []*compute.Image{}
+	for _, img := range f.images[project] {
+		if img.Family == family {
+			res = append(res, img)
+		}
+	}
+	return res, nil
+}
+
+func (f *fakeClient) Image(ctx context.Context, project string, name string) (*compute.Image, error) {
+	for _, img := range f.images[project] {
+		if img.Name == name {
+			return img, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeClient) Delete(ctx context.Context, project string, name string) error {
+	f.deleted = append(f.deleted, project+"/"+name)
+	return nil
+}
+
+func image(name string, family string, created string) *compute.Image {
+	return &compute.Image{Name: name, Family: family, CreationTimestamp: created}
+}
+
+func deployment(c *C, name string, groups ...config.DeploymentGroup) Deployment {
+	return Deployment{
+		Dir: c.MkDir(),
+		Blueprint: config.Blueprint{
+			Vars:             config.NewDict(map[string]cty.Value{"deployment_name": cty.StringVal(name)}),
+			DeploymentGroups: groups,
+		},
+	}
+}
+
+func packerGroup(settings map[string]cty.Value) config.DeploymentGroup {
+	return config.DeploymentGroup{Name: "packer", Modules: []config.Module{{
+		ID:       "image",
+		Kind:     config.PackerKind,
+		Source:   "modules/packer/custom-image",
+		Settings: config.NewDict(settings)}}}
+}
+
+func instanceGroup(image cty.Value) config.DeploymentGroup {
+	return config.DeploymentGroup{Name: "cluster", Modules: []config.Module{{
+		ID:       "compute",
+		Kind:     config.TerraformKind,
+		Source:   "modules/compute/vm-instance",
+		Settings: config.NewDict(map[string]cty.Value{"instance_image": image})}}}
+}
+
+func (s *MySuite) TestReadManifest(c *C) {
+	dir := c.MkDir()
+	got, err := readManifest(filepath.Join(dir, "absent.json"))
+	c.Assert(err, IsNil)
+	c.Check(got, DeepEquals, []string{})
+
+	p := filepath.Join(dir, "packer-manifest.json")
+	c.Assert(os.WriteFile(p, []byte(`{"builds": [
+		{"artifact_id": "hpc-20240101t000000z"},
+		{"artifact_id": "us-central1:hpc-20240201t000000z"},
+		{"artifact_id": "hpc-20240101t000000z"}]}`), 0644), IsNil)
+	got, err = readManifest(p)
+	c.Assert(err, IsNil)
+	c.Check(got, DeepEquals, []string{"hpc-20240101t000000z", "hpc-20240201t000000z"})
+
+	c.Assert(os.WriteFile(p, []byte(`{`), 0644), IsNil)
+	_, err = readManifest(p)
+	c.Check(err, ErrorMatches, "failed to parse Packer manifest.*")
+}
+
+func (s *MySuite) TestFind(c *C) {
+	fc := &fakeClient{images: map[string][]*compute.Image{"img-project": {
+		image("hpc-1", "hpc", "2024-01-01T00:00:00Z"),
+		image("hpc-3", "hpc", "2024-03-01T00:00:00Z"),
+		image("hpc-2", "hpc", "2024-02-01T00:00:00Z"),
+		image("old-family-1", "old", "2023-01-01T00:00:00Z"),
+		image("other-1", "other", "2023-01-01T00:00:00Z"),
+	}}}
+	builds := deployment(c, "images", packerGroup(map[string]cty.Value{
+		"project_id":   cty.StringVal("img-project"),
+		"image_family": cty.StringVal("hpc"),
+	}))
+	// image of a previous family, only known from the build manifest
+	manifestDir := filepath.Join(builds.Dir, "packer", "image")
+	c.Assert(os.MkdirAll(manifestDir, 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(manifestDir, "packer-manifest.json"),
+		[]byte(`{"builds": [{"artifact_id": "old-family-1"}, {"artifact_id": "deleted-1"}]}`), 0644), IsNil)
+
+	byFamily := deployment(c, "cluster-a", instanceGroup(cty.ObjectVal(map[string]cty.Value{
+		"project": cty.StringVal("img-project"),
+		"family":  cty.StringVal("hpc"),
+	})))
+	byName := deployment(c, "cluster-b", instanceGroup(cty.ObjectVal(map[string]cty.Value{
+		"project": cty.StringVal("img-project"),
+		"name":    cty.StringVal("hpc-1"),
+	})))
+
+	got, err := Find(context.Background(), fc, []Deployment{builds, byFamily, byName})
+	c.Assert(err, IsNil)
+	names := []string{}
+	for _, img := range got {
+		names = append(names, img.Name)
+		c.Check(img.BuiltBy, Equals, "images")
+	}
+	c.Check(names, DeepEquals, []string{"hpc-3", "hpc-2", "hpc-1", "old-family-1"})
+	c.Check(got[0].UsedBy, DeepEquals, []string{"cluster-a"})
+	c.Check(got[1].UsedBy, IsNil)
+	c.Check(got[2].UsedBy, DeepEquals, []string{"cluster-b"})
+
+	{ // family refers to the newest image that is not deprecated
+		fc.images["img-project"][1].Deprecated = &compute.DeprecationStatus{State: "DEPRECATED"}
+		got, err := Find(context.Background(), fc, []Deployment{builds, byFamily})
+		c.Assert(err, IsNil)
+		c.Check(got[0].Deprecated, Equals, true)
+		c.Check(got[0].UsedBy, IsNil)
+		c.Check(got[1].UsedBy, DeepEquals, []string{"cluster-a"})
+	}
+}
+
+func (s *MySuite) TestPruneSelect(c *C) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	img := func(name string, family string, age time.Duration, usedBy ...string) Image {
+		return Image{Project: "p", Name: name, Family: family, Created: now.Add(-age), UsedBy: usedBy}
+	}
+	day := 24 * time.Hour
+	// sorted as returned by Find
+	imgs := []Image{
+		img("a-4", "a", 1*day),
+		img("a-3", "a", 10*day),
+		img("a-2", "a", 40*day),
+		img("a-1", "a", 50*day, "cluster"),
+		img("a-0", "a", 60*day),
+		img("b-0", "b", 60*day),
+	}
+	names := func(imgs []Image) []string {
+		res := []string{}
+		for _, i := range imgs {
+			res = append(res, i.Name)
+		}
+		return res
+	}
+
+	c.Check(names(PrunePolicy{Keep: 1}.Select(imgs, now)), DeepEquals, []string{"a-3", "a-2", "a-0"})
+	c.Check(names(PrunePolicy{Keep: 1, OlderThan: 30 * day}.Select(imgs, now)), DeepEquals, []string{"a-2", "a-0"})
+	c.Check(names(PrunePolicy{Keep: 3}.Select(imgs, now)), DeepEquals, []string{"a-0"})
+
+	fc := &fakeClient{}
+	c.Check(Delete(context.Background(), fc, PrunePolicy{Keep: 3}.Select(imgs, now)), IsNil)
+	c.Check(fc.deleted, DeepEquals, []string{"p/a-0"})
+}
@@ -16,8 +16,10 @@ package logging
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sync"
 )
 
 var (
@@ -32,6 +34,26 @@ func init() {
 	fatallog = log.New(os.Stderr, "", 0)
 }
 
+// lockedWriter serializes writes of the loggers, which may log concurrently
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// CopyTo also writes all messages to w, e.g. to keep them in a support bundle
+func CopyTo(w io.Writer) {
+	lw := &lockedWriter{w: w}
+	infolog.SetOutput(io.MultiWriter(os.Stdout, lw))
+	errorlog.SetOutput(io.MultiWriter(os.Stderr, lw))
+	fatallog.SetOutput(io.MultiWriter(os.Stderr, lw))
+}
+
 // Info prints info to stdout
 func Info(f string, a ...any) {
 	msg := fmt.Sprintf(f, a...)
@@ -44,9 +66,22 @@ func Error(f string, a ...any) {
 	errorlog.Println(msg)
 }
 
+// exitHooks are run by Fatal before the program ends
+var exitHooks []func()
+
+// AtExit registers a function run by Fatal before it ends the program
+func AtExit(f func()) {
+	exitHooks = append(exitHooks, f)
+}
+
 // Fatal prints info to stderr and ends the program
 func Fatal(f string, a ...any) {
 	msg := fmt.Sprintf(f, a...)
 	fatallog.Println(msg)
+	hooks := exitHooks
+	exitHooks = nil // hooks calling Fatal end the program
+	for _, h := range hooks {
+		h()
+	}
 	os.Exit(1)
 }
@@ -0,0 +1,193 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulereader
+
+import (
+	"errors"
+	"hpc-toolkit/pkg/sourcereader"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// CatalogEntry is a module embedded in ghpc
+type CatalogEntry struct {
+	Source      string
+	Description string
+	// Kind is "terraform" or "packer"
+	Kind     string
+	Category string
+	Icon     string
+}
+
+// catalogRoots are the directories of embedded modules
+var catalogRoots = []string{"modules", "community/modules"}
+
+// catalogIndex lists modules with short descriptions, paths of modules are
+// relative to its directory
+const catalogIndex = "modules/README.md"
+
+var (
+	indexEntryRe = regexp.MustCompile(`^\* \*\*\[([^\]]+)\]\*\*[^:]*:\s*(.*)$`)
+	indexLinkRe  = regexp.MustCompile(`^\[([^\]]+)\]: (\S+)/README\.md$`)
+	// link definitions end entries, unlike links continuing descriptions
+	indexLinkDefRe = regexp.MustCompile(`^\[[^\]]+\]:`)
+	mdLinkRe       = regexp.MustCompile(`\[([^\]]+)\](\[[^\]]*\]|\([^)]*\))?`)
+)
+
+// EmbeddedCatalog lists modules embedded in ghpc, sorted by source. Modules are
+// described as in the modules index, or by the first sentence of the
+// description in their README if the index does not list them.
+func EmbeddedCatalog() ([]CatalogEntry, error) {
+	if sourcereader.ModuleFS == nil {
+		return nil, errors.New("embedded file system is not initialized")
+	}
+	index := readCatalogIndex()
+	entries := []CatalogEntry{}
+	for _, root := range catalogRoots {
+		err := fs.WalkDir(sourcereader.ModuleFS, root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if p == root && errors.Is(err, fs.ErrNotExist) {
+					return fs.SkipDir
+				}
+				return err
+			}
+			if !d.IsDir() {
+				return nil
+			}
+			if p != root && strings.HasPrefix(d.Name(), ".") {
+				return fs.SkipDir
+			}
+			kind := moduleDirKind(p)
+			if kind == "" {
+				return nil
+			}
+			desc, ok := index[p]
+			if !ok {
+				desc = readmeDescription(p)
+			}
+			mtd := GetMetadataSafe(p)
+			entries = append(entries, CatalogEntry{
+				Source:      p,
+				Description: desc,
+				Kind:        kind,
+				Category:    ModuleCategory(p, mtd),
+				Icon:        mtd.Ghpc.Display.Icon,
+			})
+			return fs.SkipDir // submodules are not meant to be used directly
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Source < entries[j].Source })
+	return entries, nil
+}
+
+// moduleDirKind returns the kind of the module in the directory, empty if the
+// directory has no module
+func moduleDirKind(dir string) string {
+	files, err := sourcereader.ModuleFS.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	kind := ""
+	for _, f := range files {
+		switch {
+		case f.IsDir():
+		case strings.HasSuffix(f.Name(), ".pkr.hcl"):
+			return "packer"
+		case strings.HasSuffix(f.Name(), ".tf"):
+			kind = "terraform"
+		}
+	}
+	return kind
+}
+
+// readCatalogIndex returns descriptions of modules of the index by source,
+// entries may continue on following lines, indented or not
+func readCatalogIndex() map[string]string {
+	data, err := sourcereader.ModuleFS.ReadFile(catalogIndex)
+	if err != nil {
+		return map[string]string{}
+	}
+	descs, links := map[string]string{}, map[string]string{}
+	name := ""
+	for _, l := range strings.Split(string(data), "\n") {
+		if m := indexEntryRe.FindStringSubmatch(l); m != nil {
+			name = m[1]
+			descs[name] = m[2]
+			continue
+		}
+		if t := strings.TrimSpace(l); name != "" && t != "" && !strings.HasPrefix(t, "* ") && !indexLinkDefRe.MatchString(t) && !strings.HasPrefix(t, "#") {
+			descs[name] += " " + t
+			continue
+		}
+		name = ""
+		if m := indexLinkRe.FindStringSubmatch(l); m != nil {
+			links[m[1]] = path.Join(path.Dir(catalogIndex), m[2])
+		}
+	}
+	res := map[string]string{}
+	for n, d := range descs {
+		if src, ok := links[n]; ok {
+			res[src] = plainText(d)
+		}
+	}
+	return res
+}
+
+// readmeDescription returns the first sentence of the "Description" section of
+// README of the module, if any
+func readmeDescription(dir string) string {
+	data, err := sourcereader.ModuleFS.ReadFile(path.Join(dir, "README.md"))
+	if err != nil {
+		return ""
+	}
+	para, in := []string{}, false
+	for _, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimSpace(l)
+		if strings.HasPrefix(l, "## ") {
+			if len(para) > 0 {
+				break
+			}
+			in = strings.EqualFold(strings.TrimPrefix(l, "## "), "description")
+			continue
+		}
+		if !in {
+			continue
+		}
+		// paragraphs end at blank lines, headings, code blocks, notes and comments
+		if l == "" || strings.HasPrefix(l, "#") || strings.HasPrefix(l, "```") || strings.HasPrefix(l, ">") || strings.HasPrefix(l, "<") {
+			if len(para) > 0 {
+				break
+			}
+			continue
+		}
+		para = append(para, l)
+	}
+	text := plainText(strings.Join(para, " "))
+	if i := strings.Index(text, ". "); i >= 0 {
+		text = text[:i+1]
+	}
+	return text
+}
+
+// plainText strips links of markdown text
+func plainText(s string) string {
+	return strings.TrimSpace(mdLinkRe.ReplaceAllString(s, "$1"))
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulereader
+
+import (
+	"hpc-toolkit/pkg/sourcereader"
+	"testing/fstest"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestEmbeddedCatalog(c *C) {
+	prev := sourcereader.ModuleFS
+	defer func() { sourcereader.ModuleFS = prev }()
+
+	index := `# Modules
+
+* **[vpc]** ![core-badge] : Creates a
+  [Virtual Private Cloud (VPC)] network with regional subnetworks.
+* **[new-project]** ![community-badge] : Creates a
+Google Cloud Project.
+
+[vpc]: network/vpc/README.md
+[new-project]: ../community/modules/project/new-project/README.md
+[Virtual Private Cloud (VPC)]: https://cloud.google.com/vpc
+`
+	readme := `## Description
+
+> **_NOTE:_** experimental
+
+This module creates a [pool](https://example.com) of images. It is long.
+
+## Usage
+`
+	sourcereader.ModuleFS = fstest.MapFS{
+		"modules/README.md":                                  {Data: []byte(index)},
+		"modules/network/vpc/main.tf":                        {},
+		"modules/network/vpc/metadata.yaml":                  {Data: []byte("ghpc:\n  display:\n    category: connectivity\n    icon: lan\n")},
+		"modules/network/vpc/modules/subnet/main.tf":         {},
+		"modules/packer/images/image.pkr.hcl":                {},
+		"modules/packer/images/README.md":                    {Data: []byte(readme)},
+		"modules/templates/script.sh":                        {},
+		"community/modules/project/new-project/variables.tf": {},
+	}
+	got, err := EmbeddedCatalog()
+	c.Assert(err, IsNil)
+	c.Check(got, DeepEquals, []CatalogEntry{
+		{Source: "community/modules/project/new-project", Description: "Creates a Google Cloud Project.", Kind: "terraform", Category: "project"},
+		{Source: "modules/network/vpc", Description: "Creates a Virtual Private Cloud (VPC) network with regional subnetworks.", Kind: "terraform", Category: "connectivity", Icon: "lan"},
+		{Source: "modules/packer/images", Description: "This module creates a pool of images.", Kind: "packer", Category: "packer"},
+	})
+
+	sourcereader.ModuleFS = nil
+	_, err = EmbeddedCatalog()
+	c.Check(err, NotNil)
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulereader
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// OtherSettingsTitle is the title of the group of settings not listed by
+// setting groups of the metadata
+const OtherSettingsTitle = "Other settings"
+
+// SettingGroup is a titled group of inputs of a module
+type SettingGroup struct {
+	Title  string
+	Inputs []VarInfo
+}
+
+// ModuleCategory returns the category of the module set by its metadata, or
+// the directory the module is in, e.g. "network" for modules/network/vpc
+func ModuleCategory(source string, mtd Metadata) string {
+	if c := mtd.Ghpc.Display.Category; c != "" {
+		return c
+	}
+	dir := path.Base(path.Dir(strings.TrimSuffix(path.Clean(source), "/")))
+	if dir == "." || dir == "/" {
+		return ""
+	}
+	return dir
+}
+
+// SettingGroups groups inputs of the module as set by its metadata, inputs no
+// group lists come last, in order, under OtherSettingsTitle
+func (i ModuleInfo) SettingGroups() ([]SettingGroup, error) {
+	byName := map[string]VarInfo{}
+	for _, in := range i.Inputs {
+		byName[in.Name] = in
+	}
+	grouped := map[string]bool{}
+	res := []SettingGroup{}
+	for _, mg := range i.Metadata.Ghpc.Display.SettingGroups {
+		if mg.Title == "" {
+			return nil, errors.New("setting groups must have a title")
+		}
+		g := SettingGroup{Title: mg.Title, Inputs: []VarInfo{}}
+		for _, s := range mg.Settings {
+			in, ok := byName[s]
+			if !ok {
+				return nil, fmt.Errorf("setting group %q lists %q, which is not an input of the module", mg.Title, s)
+			}
+			if grouped[s] {
+				return nil, fmt.Errorf("setting %q is listed by more than one setting group", s)
+			}
+			grouped[s] = true
+			g.Inputs = append(g.Inputs, in)
+		}
+		res = append(res, g)
+	}
+	other := SettingGroup{Title: OtherSettingsTitle, Inputs: []VarInfo{}}
+	for _, in := range i.Inputs {
+		if !grouped[in.Name] {
+			other.Inputs = append(other.Inputs, in)
+		}
+	}
+	if len(other.Inputs) > 0 || len(res) == 0 {
+		res = append(res, other)
+	}
+	return res, nil
+}
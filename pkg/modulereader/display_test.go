@@ -0,0 +1,69 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulereader
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestModuleCategory(c *C) {
+	c.Check(ModuleCategory("modules/network/vpc", Metadata{}), Equals, "network")
+	c.Check(ModuleCategory("./community/modules/scheduler/slurm/", Metadata{}), Equals, "scheduler")
+	c.Check(ModuleCategory("vpc", Metadata{}), Equals, "")
+
+	mtd := Metadata{Ghpc: MetadataGhpc{Display: MetadataDisplay{Category: "connectivity"}}}
+	c.Check(ModuleCategory("modules/network/vpc", mtd), Equals, "connectivity")
+}
+
+func (s *zeroSuite) TestSettingGroups(c *C) {
+	a, b, d := VarInfo{Name: "a"}, VarInfo{Name: "b"}, VarInfo{Name: "d"}
+	withGroups := func(gs ...MetadataSettingGroup) ModuleInfo {
+		return ModuleInfo{
+			Inputs:   []VarInfo{a, b, d},
+			Metadata: Metadata{Ghpc: MetadataGhpc{Display: MetadataDisplay{SettingGroups: gs}}}}
+	}
+
+	{ // no groups
+		got, err := withGroups().SettingGroups()
+		c.Assert(err, IsNil)
+		c.Check(got, DeepEquals, []SettingGroup{{OtherSettingsTitle, []VarInfo{a, b, d}}})
+	}
+	{ // grouped in order, others last
+		got, err := withGroups(MetadataSettingGroup{"Network", []string{"d", "a"}}).SettingGroups()
+		c.Assert(err, IsNil)
+		c.Check(got, DeepEquals, []SettingGroup{
+			{"Network", []VarInfo{d, a}},
+			{OtherSettingsTitle, []VarInfo{b}}})
+	}
+	{ // all grouped
+		got, err := withGroups(MetadataSettingGroup{"All", []string{"a", "b", "d"}}).SettingGroups()
+		c.Assert(err, IsNil)
+		c.Check(got, DeepEquals, []SettingGroup{{"All", []VarInfo{a, b, d}}})
+	}
+	{ // unknown setting
+		_, err := withGroups(MetadataSettingGroup{"Network", []string{"zone"}}).SettingGroups()
+		c.Check(err, ErrorMatches, `.*"zone", which is not an input.*`)
+	}
+	{ // listed twice
+		_, err := withGroups(
+			MetadataSettingGroup{"Network", []string{"a"}},
+			MetadataSettingGroup{"Compute", []string{"a"}}).SettingGroups()
+		c.Check(err, ErrorMatches, `.*"a" is listed by more than one.*`)
+	}
+	{ // no title
+		_, err := withGroups(MetadataSettingGroup{"", []string{"a"}}).SettingGroups()
+		c.Check(err, NotNil)
+	}
+}
@@ -34,13 +34,14 @@ import (
 func getHCLInfo(source string) (ModuleInfo, error) {
 	var module *tfconfig.Module
 	ret := ModuleInfo{}
+	fs := tfconfig.NewOsFs()
 
 	if sourcereader.IsEmbeddedPath(source) {
-		wrapFS := tfconfig.WrapFS(sourcereader.ModuleFS)
-		if !tfconfig.IsModuleDirOnFilesystem(wrapFS, source) {
+		fs = tfconfig.WrapFS(sourcereader.ModuleFS)
+		if !tfconfig.IsModuleDirOnFilesystem(fs, source) {
 			return ret, fmt.Errorf("source is not a terraform or packer module: %s", source)
 		}
-		module, _ = tfconfig.LoadModuleFromFilesystem(wrapFS, source)
+		module, _ = tfconfig.LoadModuleFromFilesystem(fs, source)
 	} else {
 		fileInfo, err := os.Stat(source)
 		if os.IsNotExist(err) {
@@ -58,19 +59,29 @@ func getHCLInfo(source string) (ModuleInfo, error) {
 		module, _ = tfconfig.LoadModule(source)
 	}
 
+	tfVars, err := readTfVariables(fs, source)
+	if err != nil {
+		return ModuleInfo{}, err
+	}
+
 	var vars []VarInfo
 	var outs []OutputInfo
 	for _, v := range module.Variables {
-		ty, err := GetCtyType(v.Type)
-		if err != nil {
-			return ModuleInfo{}, fmt.Errorf("failed to parse type of variable %q: %w", v.Name, err)
-		}
 		vInfo := VarInfo{
 			Name:        v.Name,
-			Type:        ty,
 			Description: v.Description,
 			Default:     v.Default,
 			Required:    v.Required,
+			Sensitive:   v.Sensitive,
+		}
+		if tv, ok := tfVars[v.Name]; ok {
+			vInfo.Type, vInfo.TypeDefaults, vInfo.DefaultValue = tv.Type, tv.Defaults, tv.typedDefault()
+		} else { // declared in JSON
+			ty, err := GetCtyType(v.Type)
+			if err != nil {
+				return ModuleInfo{}, fmt.Errorf("failed to parse type of variable %q: %w", v.Name, err)
+			}
+			vInfo.Type = ty
 		}
 		vars = append(vars, vInfo)
 	}
@@ -96,15 +107,7 @@ func GetCtyType(hclType string) (cty.Type, error) {
 	if diags.HasErrors() {
 		return cty.NilType, diags
 	}
-
-	switch hcl.ExprAsKeyword(expr) {
-	case "list":
-		return cty.List(cty.DynamicPseudoType), nil
-	case "map":
-		return cty.Map(cty.DynamicPseudoType), nil
-	}
-
-	typ, _, diags := typeexpr.TypeConstraintWithDefaults(expr)
+	typ, _, diags := typeConstraint(expr)
 	if diags.HasErrors() {
 		return cty.NilType, diags
 	}
@@ -132,6 +135,17 @@ func NormalizeType(hclType string) string {
 // it will error if any of the Values are not statically defined
 func ReadHclAttributes(file string) (map[string]cty.Value, error) {
 	f, diags := hclparse.NewParser().ParseHCLFile(file)
+	return hclFileAttributes(f, diags)
+}
+
+// ParseHclAttributes is ReadHclAttributes for content not read from a file,
+// e.g. decrypted in memory, filename is only used in error messages
+func ParseHclAttributes(src []byte, filename string) (map[string]cty.Value, error) {
+	f, diags := hclparse.NewParser().ParseHCL(src, filename)
+	return hclFileAttributes(f, diags)
+}
+
+func hclFileAttributes(f *hcl.File, diags hcl.Diagnostics) (map[string]cty.Value, error) {
 	if diags.HasErrors() {
 		// work around ugly <nil> in error message missing d.Subject
 		// https://github.com/hashicorp/hcl2/blob/fb75b3253c80b3bc7ca99c4bfa2ad6743841b1af/hcl/diagnostic.go#L76-L78
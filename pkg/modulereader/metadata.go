@@ -40,6 +40,16 @@ type MetadataSpec struct {
 // See https://github.com/GoogleCloudPlatform/cloud-foundation-toolkit/blob/master/cli/bpmetadata/schema/gcp-blueprint-metadata.json#L416
 type MetadataRequirements struct {
 	Services []string `yaml:"services"`
+	// Roles the identity deploying the module needs
+	Roles []MetadataRoles `yaml:"roles"`
+}
+
+// MetadataRoles corresponds to BlueprintRoles in CFT schema
+// See https://github.com/GoogleCloudPlatform/cloud-foundation-toolkit/blob/master/cli/bpmetadata/schema/gcp-blueprint-metadata.json
+type MetadataRoles struct {
+	// Level the roles are granted at, e.g. "Project".
+	Level string   `yaml:"level"`
+	Roles []string `yaml:"roles"`
 }
 
 // GHPC-specific addition to CFT schema
@@ -49,6 +59,88 @@ type MetadataGhpc struct {
 	InjectModuleId string `yaml:"inject_module_id"`
 	// If set to true, the creation will fail if the module is not used.
 	HasToBeUsed bool `yaml:"has_to_be_used"`
+	// Optional, constraints on modules in the `use` list of this module.
+	UseRules []MetadataUseRule `yaml:"use_rules"`
+	// Optional, generic setting names, e.g. "instance_type", mapped to the
+	// module variables they stand for, e.g. "machine_type".
+	Aliases map[string]string `yaml:"aliases"`
+	// Optional, blocks of the module fanned out per zone or region, by value
+	// of the `distribute` field of the blueprint module, e.g. "per_zone".
+	Distribute map[string]MetadataDistribution `yaml:"distribute"`
+	// Optional, hints for front-ends rendering catalogs of modules.
+	Display MetadataDisplay `yaml:"display"`
+	// Optional, software the module installs or runs, listed in the software
+	// inventory of deployments.
+	Software []MetadataSoftware `yaml:"software"`
+	// Optional, Terraform types of module outputs, e.g. "list(string)", by
+	// output name. References to outputs not listed are not type checked.
+	OutputTypes map[string]string `yaml:"output_types"`
+}
+
+// MetadataSoftware is software the module installs, either a single package
+// of a known name or packages listed by a setting of the module
+type MetadataSoftware struct {
+	// Name of the software, e.g. "slurm-gcp".
+	Name string `yaml:"name"`
+	// Optional version installed, e.g. "6.4.2".
+	Version string `yaml:"version"`
+	// Optional setting holding the version, e.g. "condor_version". Its
+	// default is used if the blueprint does not set it.
+	VersionSetting string `yaml:"version_setting"`
+	// Optional setting listing packages instead of Name, parsed as Format.
+	Setting string `yaml:"setting"`
+	// Format of Setting, either "image", container image references such as
+	// "ubuntu:22.04", or "spack", shell commands running `spack install`.
+	Format string `yaml:"format"`
+}
+
+// MetadataDisplay describes how front-ends present the module and its settings
+type MetadataDisplay struct {
+	// Category of the module, e.g. "network". Defaults to the directory the
+	// module is in, see ModuleCategory.
+	Category string `yaml:"category"`
+	// Optional name of an icon, e.g. "lan".
+	Icon string `yaml:"icon"`
+	// Optional groups of settings presented together, in order. Settings not
+	// listed are presented after all groups.
+	SettingGroups []MetadataSettingGroup `yaml:"setting_groups"`
+}
+
+// MetadataSettingGroup is a titled group of settings of the module
+type MetadataSettingGroup struct {
+	Title    string   `yaml:"title"`
+	Settings []string `yaml:"settings"`
+}
+
+// MetadataDistribution describes a setting holding a list of blocks, e.g. node
+// pools, copied for every zone or region listed by another setting
+type MetadataDistribution struct {
+	// Setting listing zones or regions, e.g. "zones". It is taken from the
+	// deployment variable of the same name if the module does not set it.
+	Over string `yaml:"over"`
+	// Setting holding the list of blocks, e.g. "nodeset_tpu".
+	Setting string `yaml:"setting"`
+	// Attribute of the blocks set to the zone or region, e.g. "zone".
+	Field string `yaml:"field"`
+	// Optional attribute of the blocks suffixed with the zone or region to keep
+	// copies unique, e.g. "nodeset_name".
+	NameField string `yaml:"name_field"`
+	// Optional separator of names and suffixes.
+	NameSeparator string `yaml:"name_separator"`
+}
+
+// MetadataUseRule describes a module this module is known not to work with,
+// or to work with only if some of its settings have particular values
+type MetadataUseRule struct {
+	// Source of the used module, e.g. "modules/file-system/filestore".
+	Source string `yaml:"source"`
+	// If set to true, the module can not be used at all.
+	Incompatible bool `yaml:"incompatible"`
+	// Settings of the used module mapped to values that work, attributes of
+	// object settings are given as "setting.attribute".
+	Settings map[string][]string `yaml:"settings"`
+	// Explanation presented to the user when the rule is violated.
+	Hint string `yaml:"hint"`
 }
 
 // GetMetadata reads and parses `metadata.yaml` from module root.
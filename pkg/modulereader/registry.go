@@ -0,0 +1,321 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulereader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-getter"
+	"github.com/hashicorp/go-version"
+	"gopkg.in/yaml.v3"
+)
+
+// RegistryScheme prefixes module sources resolved against a module registry,
+// e.g. "registry://terraform-google-modules/network/google@~> 9.0"
+const RegistryScheme = "registry://"
+
+// DefaultRegistry is the module registry sources are resolved against, unless
+// the blueprint sets another one
+const DefaultRegistry = "https://registry.terraform.io"
+
+// DefaultRegistrySystem is the system of registry sources that only give a
+// namespace and a name
+const DefaultRegistrySystem = "google"
+
+// ModuleLockFileName is the name of the file recording versions registry
+// sources were resolved to, kept next to the blueprint
+const ModuleLockFileName = ".ghpc-modules.lock.yaml"
+
+// IsRegistrySource checks if a source is resolved against a module registry
+func IsRegistrySource(source string) bool {
+	return strings.HasPrefix(source, RegistryScheme)
+}
+
+// RegistrySource is a module source of a module registry, the module is
+// NAMESPACE/NAME/SYSTEM and the version is picked by Constraint
+type RegistrySource struct {
+	Namespace  string
+	Name       string
+	System     string
+	Subdir     string
+	Constraint version.Constraints
+}
+
+// ParseRegistrySource parses sources in form
+// registry://NAMESPACE/NAME[/SYSTEM][//SUBDIR][@CONSTRAINT]. The constraint
+// uses terraform syntax, "~1.2" is a shorthand for "~> 1.2"; the latest
+// version is picked without one.
+func ParseRegistrySource(source string) (RegistrySource, error) {
+	rest, ok := strings.CutPrefix(source, RegistryScheme)
+	if !ok {
+		return RegistrySource{}, fmt.Errorf("registry source must start with %q, got %q", RegistryScheme, source)
+	}
+	rest, cs, _ := strings.Cut(rest, "@")
+	addr, subdir, _ := strings.Cut(rest, "//")
+
+	parts := strings.Split(addr, "/")
+	if len(parts) == 2 {
+		parts = append(parts, DefaultRegistrySystem)
+	}
+	if len(parts) != 3 || slicesContainEmpty(parts) {
+		return RegistrySource{}, fmt.Errorf("registry source must be in form %sNAMESPACE/NAME[/SYSTEM][//SUBDIR][@CONSTRAINT], got %q", RegistryScheme, source)
+	}
+
+	cs = strings.TrimSpace(cs)
+	if strings.HasPrefix(cs, "~") && !strings.HasPrefix(cs, "~>") {
+		cs = "~> " + strings.TrimPrefix(cs, "~")
+	}
+	if cs == "" {
+		cs = ">= 0"
+	}
+	c, err := version.NewConstraint(cs)
+	if err != nil {
+		return RegistrySource{}, fmt.Errorf("invalid version constraint of registry source %q: %w", source, err)
+	}
+	return RegistrySource{Namespace: parts[0], Name: parts[1], System: parts[2], Subdir: subdir, Constraint: c}, nil
+}
+
+func slicesContainEmpty(s []string) bool {
+	for _, e := range s {
+		if e == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Address returns the module address in the registry
+func (s RegistrySource) Address() string {
+	return path.Join(s.Namespace, s.Name, s.System)
+}
+
+// LockedModule is the version a registry module was resolved to, and the
+// address it is downloaded from
+type LockedModule struct {
+	Version string `yaml:"version"`
+	Source  string `yaml:"source"`
+}
+
+// ModuleLock records versions registry sources were resolved to, by registry
+// and module address. A locked version is used as long as it satisfies the
+// constraint of the source, so that deployments are reproducible until the
+// constraint changes or the lock file is removed.
+type ModuleLock struct {
+	Modules map[string]LockedModule `yaml:"modules"`
+	changed bool
+}
+
+// ReadModuleLock reads the lock file, an absent file or empty path is an
+// empty lock
+func ReadModuleLock(path string) (*ModuleLock, error) {
+	lock := &ModuleLock{Modules: map[string]LockedModule{}}
+	if path == "" {
+		return lock, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return lock, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, lock); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if lock.Modules == nil {
+		lock.Modules = map[string]LockedModule{}
+	}
+	return lock, nil
+}
+
+// Write writes the lock file if registry sources were resolved to new versions
+func (l *ModuleLock) Write(path string) error {
+	if !l.changed {
+		return nil
+	}
+	b, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+	header := "# Versions of registry modules, written by ghpc. Remove entries to upgrade them.\n"
+	return os.WriteFile(path, append([]byte(header), b...), 0644)
+}
+
+// registryClient is the HTTP client of module registries, replaced in tests
+var registryClient = http.DefaultClient
+
+// resolvedSources caches resolutions of the process by registry and source
+var resolvedSources = map[string]LockedModule{}
+
+// ResolveRegistrySource resolves a registry source to the address the module
+// is downloaded from, picking the latest version satisfying its constraint
+// unless the lock has a version that does. The lock is updated with the
+// resolved version, it can be nil.
+func ResolveRegistrySource(registry string, source string, lock *ModuleLock) (string, error) {
+	rs, err := ParseRegistrySource(source)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSuffix(registry, "/") + "/" + rs.Address()
+
+	if lock != nil {
+		if lm, ok := lock.Modules[key]; ok {
+			if v, err := version.NewVersion(lm.Version); err == nil && rs.Constraint.Check(v) {
+				return withSubdir(lm.Source, rs.Subdir), nil
+			}
+		}
+	}
+
+	lm, ok := resolvedSources[key+"@"+rs.Constraint.String()]
+	if !ok {
+		if lm, err = resolveInRegistry(registry, rs); err != nil {
+			return "", err
+		}
+		resolvedSources[key+"@"+rs.Constraint.String()] = lm
+	}
+	if lock != nil && lock.Modules[key] != lm {
+		lock.Modules[key] = lm
+		lock.changed = true
+	}
+	return withSubdir(lm.Source, rs.Subdir), nil
+}
+
+func resolveInRegistry(registry string, rs RegistrySource) (LockedModule, error) {
+	base, err := modulesEndpoint(registry)
+	if err != nil {
+		return LockedModule{}, err
+	}
+	modURL := base.JoinPath(rs.Address())
+	latest, err := latestVersion(registry, modURL, rs)
+	if err != nil {
+		return LockedModule{}, err
+	}
+
+	dlURL := modURL.JoinPath(latest.Original(), "download")
+	header := http.Header{}
+	if err := registryGet(dlURL.String(), nil, header); err != nil {
+		return LockedModule{}, err
+	}
+	get := header.Get("X-Terraform-Get")
+	if get == "" {
+		return LockedModule{}, fmt.Errorf("registry %s did not return the download address of module %s %s", registry, rs.Address(), latest.Original())
+	}
+	return LockedModule{Version: latest.Original(), Source: resolveDownload(dlURL, get)}, nil
+}
+
+// latestVersion returns the latest release of the module satisfying the
+// version constraint
+func latestVersion(registry string, modURL *url.URL, rs RegistrySource) (*version.Version, error) {
+	var versions struct {
+		Modules []struct {
+			Versions []struct {
+				Version string `json:"version"`
+			} `json:"versions"`
+		} `json:"modules"`
+	}
+	if err := registryGet(modURL.JoinPath("versions").String(), &versions, nil); err != nil {
+		return nil, err
+	}
+	candidates := version.Collection{}
+	for _, m := range versions.Modules {
+		for _, v := range m.Versions {
+			if pv, err := version.NewVersion(v.Version); err == nil && pv.Prerelease() == "" && rs.Constraint.Check(pv) {
+				candidates = append(candidates, pv)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no version of module %s in %s satisfies %q", rs.Address(), registry, rs.Constraint)
+	}
+	sort.Sort(candidates)
+	return candidates[len(candidates)-1], nil
+}
+
+// resolveDownload resolves download addresses relative to the download URL
+func resolveDownload(dlURL *url.URL, get string) string {
+	if u, err := url.Parse(get); err == nil && u.Scheme == "" && (strings.HasPrefix(get, "/") || strings.HasPrefix(get, "./") || strings.HasPrefix(get, "../")) {
+		return dlURL.ResolveReference(u).String()
+	}
+	return get
+}
+
+// modulesEndpoint discovers the base URL of the modules API of the registry
+// following the service discovery protocol of terraform
+func modulesEndpoint(registry string) (*url.URL, error) {
+	base, err := url.Parse(registry)
+	if err != nil {
+		return nil, err
+	}
+	var services map[string]interface{}
+	if err := registryGet(base.JoinPath(".well-known", "terraform.json").String(), &services, nil); err != nil {
+		return nil, err
+	}
+	m, ok := services["modules.v1"].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a module registry, it does not provide modules.v1", registry)
+	}
+	u, err := url.Parse(m)
+	if err != nil {
+		return nil, err
+	}
+	return base.ResolveReference(u), nil
+}
+
+// registryGet gets the URL, decoding the JSON body into out if set and
+// copying response headers to header if set
+func registryGet(u string, out interface{}, header http.Header) error {
+	resp, err := registryClient.Get(u)
+	if err != nil {
+		return fmt.Errorf("failed to query module registry: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("module registry returned %s for %s", resp.Status, u)
+	}
+	for k, v := range resp.Header {
+		if header != nil {
+			header[k] = v
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to parse response of module registry for %s: %w", u, err)
+	}
+	return nil
+}
+
+// withSubdir appends a subdirectory to a go-getter address, keeping its query
+func withSubdir(source string, subdir string) string {
+	if subdir == "" {
+		return source
+	}
+	addr, sub := getter.SourceDirSubdir(source)
+	addr, query, _ := strings.Cut(addr, "?")
+	res := addr + "//" + path.Join(sub, subdir)
+	if query != "" {
+		res += "?" + query
+	}
+	return res
+}
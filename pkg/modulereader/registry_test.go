@@ -0,0 +1,160 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulereader
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeRegistry serves modules "hpc/vpc/google" and "hpc/relative/google",
+// counting version listings in queries
+func fakeRegistry(queries *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch p := r.URL.Path; {
+		case p == "/.well-known/terraform.json":
+			fmt.Fprint(w, `{"modules.v1": "/api/modules/"}`)
+		case p == "/api/modules/hpc/vpc/google/versions":
+			*queries++
+			fmt.Fprint(w, `{"modules": [{"versions": [
+				{"version": "1.1.0"}, {"version": "1.2.3"}, {"version": "1.10.0"},
+				{"version": "2.0.0"}, {"version": "2.1.0-beta"}]}]}`)
+		case p == "/api/modules/hpc/relative/google/versions":
+			fmt.Fprint(w, `{"modules": [{"versions": [{"version": "0.1.0"}]}]}`)
+		case strings.HasPrefix(p, "/api/modules/hpc/vpc/google/"):
+			v := strings.Split(p, "/")[6]
+			w.Header().Set("X-Terraform-Get", "git::https://example.com/vpc.git?ref=v"+v)
+			w.WriteHeader(http.StatusNoContent)
+		case p == "/api/modules/hpc/relative/google/0.1.0/download":
+			w.Header().Set("X-Terraform-Get", "./archive.tar.gz")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func (s *zeroSuite) TestParseRegistrySource(c *C) {
+	{
+		rs, err := ParseRegistrySource("registry://hpc/vpc@~1.2")
+		c.Assert(err, IsNil)
+		c.Check(rs.Address(), Equals, "hpc/vpc/google")
+		c.Check(rs.Subdir, Equals, "")
+		c.Check(rs.Constraint.String(), Equals, "~> 1.2")
+	}
+	{
+		rs, err := ParseRegistrySource("registry://hpc/vpc/aws//modules/subnet@>= 1.0, < 3")
+		c.Assert(err, IsNil)
+		c.Check(rs.Address(), Equals, "hpc/vpc/aws")
+		c.Check(rs.Subdir, Equals, "modules/subnet")
+		c.Check(rs.Constraint.String(), Equals, ">= 1.0, < 3")
+	}
+	{ // no constraint
+		rs, err := ParseRegistrySource("registry://hpc/vpc")
+		c.Assert(err, IsNil)
+		c.Check(rs.Constraint.String(), Equals, ">= 0")
+	}
+
+	_, err := ParseRegistrySource("registry://vpc@1.0")
+	c.Check(err, ErrorMatches, ".*must be in form.*")
+	_, err = ParseRegistrySource("registry://hpc//vpc@1.0")
+	c.Check(err, ErrorMatches, ".*must be in form.*")
+	_, err = ParseRegistrySource("registry://hpc/vpc@latest")
+	c.Check(err, ErrorMatches, ".*invalid version constraint.*")
+	_, err = ParseRegistrySource("hpc/vpc@1.0")
+	c.Check(err, ErrorMatches, ".*must start with.*")
+}
+
+func (s *zeroSuite) TestResolveRegistrySource(c *C) {
+	queries := 0
+	srv := fakeRegistry(&queries)
+	defer srv.Close()
+	defer func() { resolvedSources = map[string]LockedModule{} }()
+	vpc := srv.URL + "/hpc/vpc/google"
+
+	{ // latest matching version, pre-releases are ignored
+		lock, _ := ReadModuleLock("")
+		src, err := ResolveRegistrySource(srv.URL, "registry://hpc/vpc@>= 1.0", lock)
+		c.Assert(err, IsNil)
+		c.Check(src, Equals, "git::https://example.com/vpc.git?ref=v2.0.0")
+		c.Check(lock.Modules[vpc], DeepEquals, LockedModule{Version: "2.0.0", Source: src})
+	}
+	{ // pessimistic constraint and subdirectory
+		src, err := ResolveRegistrySource(srv.URL, "registry://hpc/vpc//modules/subnet@~1.2", nil)
+		c.Assert(err, IsNil)
+		c.Check(src, Equals, "git::https://example.com/vpc.git//modules/subnet?ref=v1.10.0")
+	}
+	{ // resolutions are cached
+		before := queries
+		_, err := ResolveRegistrySource(srv.URL, "registry://hpc/vpc@~1.2", nil)
+		c.Assert(err, IsNil)
+		c.Check(queries, Equals, before)
+	}
+	{ // relative download address
+		src, err := ResolveRegistrySource(srv.URL, "registry://hpc/relative", nil)
+		c.Assert(err, IsNil)
+		c.Check(src, Equals, srv.URL+"/api/modules/hpc/relative/google/0.1.0/archive.tar.gz")
+	}
+	{ // no matching version
+		_, err := ResolveRegistrySource(srv.URL, "registry://hpc/vpc@~3.0", nil)
+		c.Check(err, ErrorMatches, `no version of module hpc/vpc/google .* satisfies "~> 3.0"`)
+	}
+	{ // unknown module
+		_, err := ResolveRegistrySource(srv.URL, "registry://hpc/nope@1.0", nil)
+		c.Check(err, ErrorMatches, "module registry returned 404 .*")
+	}
+}
+
+func (s *zeroSuite) TestModuleLock(c *C) {
+	queries := 0
+	srv := fakeRegistry(&queries)
+	defer srv.Close()
+	defer func() { resolvedSources = map[string]LockedModule{} }()
+	path := filepath.Join(c.MkDir(), ModuleLockFileName)
+	vpc := srv.URL + "/hpc/vpc/google"
+
+	lock, err := ReadModuleLock(path)
+	c.Assert(err, IsNil)
+	lock.Modules[vpc] = LockedModule{Version: "1.1.0", Source: "git::https://example.com/vpc.git?ref=v1.1.0"}
+	lock.changed = true
+	c.Assert(lock.Write(path), IsNil)
+
+	{ // locked version satisfying the constraint is kept
+		lock, err := ReadModuleLock(path)
+		c.Assert(err, IsNil)
+		src, err := ResolveRegistrySource(srv.URL, "registry://hpc/vpc@~1.0", lock)
+		c.Assert(err, IsNil)
+		c.Check(src, Equals, "git::https://example.com/vpc.git?ref=v1.1.0")
+		c.Check(queries, Equals, 0)
+		c.Check(lock.changed, Equals, false)
+	}
+	{ // locked version is upgraded once the constraint excludes it
+		lock, err := ReadModuleLock(path)
+		c.Assert(err, IsNil)
+		src, err := ResolveRegistrySource(srv.URL, "registry://hpc/vpc@~1.2", lock)
+		c.Assert(err, IsNil)
+		c.Check(src, Equals, "git::https://example.com/vpc.git?ref=v1.10.0")
+		c.Assert(lock.Write(path), IsNil)
+
+		reread, err := ReadModuleLock(path)
+		c.Assert(err, IsNil)
+		c.Check(reread.Modules[vpc].Version, Equals, "1.10.0")
+	}
+}
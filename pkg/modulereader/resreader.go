@@ -25,7 +25,9 @@ import (
 	"path"
 
 	"github.com/hashicorp/go-getter"
+	"github.com/hashicorp/hcl/v2/ext/typeexpr"
 	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
 	"gopkg.in/yaml.v3"
 )
 
@@ -36,6 +38,21 @@ type VarInfo struct {
 	Description string
 	Default     interface{}
 	Required    bool
+	Sensitive   bool
+	// TypeDefaults are defaults of optional attributes of objects of Type
+	TypeDefaults *typeexpr.Defaults
+	// DefaultValue is Default as terraform sees it, of Type, with TypeDefaults
+	// applied; cty.NilVal if the variable has no default or it is not known
+	DefaultValue cty.Value
+}
+
+// Coerce converts the value to the type of the variable, as terraform does,
+// with defaults of optional attributes applied
+func (i VarInfo) Coerce(v cty.Value) (cty.Value, error) {
+	if i.TypeDefaults != nil {
+		v = i.TypeDefaults.Apply(v)
+	}
+	return convert.Convert(v, i.Type)
 }
 
 // OutputInfo stores information about module output values
@@ -43,6 +60,12 @@ type OutputInfo struct {
 	Name        string
 	Description string `yaml:",omitempty"`
 	Sensitive   bool   `yaml:",omitempty"`
+	// Value is an optional blueprint expression that replaces the module output
+	// of the same name, e.g. to expose an attribute of a nested object
+	Value string `yaml:",omitempty"`
+	// Type is the type of the output declared in the module metadata,
+	// cty.NilType if not declared
+	Type cty.Type `yaml:"-"`
 	// DependsOn   []string `yaml:"depends_on,omitempty"`
 }
 
@@ -62,11 +85,11 @@ func (mo *OutputInfo) UnmarshalYAML(value *yaml.Node) error {
 	var fields map[string]interface{}
 	err = value.Decode(&fields)
 	if err != nil {
-		return fmt.Errorf(yamlErrorMsg, value.Line, "outputs must each be a string or a map{name: string, description: string, sensitive: bool}; "+err.Error())
+		return fmt.Errorf(yamlErrorMsg, value.Line, "outputs must each be a string or a map{name: string, description: string, sensitive: bool, value: string}; "+err.Error())
 	}
 
 	err = enforceMapKeys(fields, map[string]bool{
-		"name": true, "description": false, "sensitive": false},
+		"name": true, "description": false, "sensitive": false, "value": false},
 	)
 	if err != nil {
 		return fmt.Errorf(yamlErrorMsg, value.Line, err)
@@ -158,10 +181,30 @@ func GetModuleInfo(source string, kind string) (ModuleInfo, error) {
 		return ModuleInfo{}, err
 	}
 	mi.Metadata = GetMetadataSafe(modPath)
+	if err := setOutputTypes(&mi); err != nil {
+		return ModuleInfo{}, fmt.Errorf("invalid metadata of module %s: %w", source, err)
+	}
 	modInfoCache[key] = mi
 	return mi, nil
 }
 
+// setOutputTypes sets types of outputs listed in `ghpc.output_types` of the
+// module metadata
+func setOutputTypes(mi *ModuleInfo) error {
+	for i, o := range mi.Outputs {
+		ts, ok := mi.Metadata.Ghpc.OutputTypes[o.Name]
+		if !ok {
+			continue
+		}
+		ty, err := GetCtyType(ts)
+		if err != nil {
+			return fmt.Errorf("failed to parse type of output %q: %w", o.Name, err)
+		}
+		mi.Outputs[i].Type = ty
+	}
+	return nil
+}
+
 // SetModuleInfo sets the ModuleInfo for a given source and kind
 // NOTE: This is only used for testing
 func SetModuleInfo(source string, kind string, info ModuleInfo) {
@@ -77,6 +77,20 @@ func (s *zeroSuite) TestGetOutputsAsMap(c *C) {
 	}
 }
 
+func (s *zeroSuite) TestSetOutputTypes(c *C) {
+	mi := ModuleInfo{
+		Outputs: []OutputInfo{{Name: "subnets"}, {Name: "name"}},
+		Metadata: Metadata{Ghpc: MetadataGhpc{OutputTypes: map[string]string{
+			"subnets": "list(string)"}}}}
+	c.Assert(setOutputTypes(&mi), IsNil)
+	c.Check(mi.Outputs, DeepEquals, []OutputInfo{
+		{Name: "subnets", Type: cty.List(cty.String)},
+		{Name: "name"}})
+
+	mi.Metadata.Ghpc.OutputTypes["name"] = "strang"
+	c.Check(setOutputTypes(&mi), ErrorMatches, `failed to parse type of output "name": .*`)
+}
+
 func (s *zeroSuite) TestFactory(c *C) {
 	c.Check(Factory(pkrKindString), FitsTypeOf, PackerReader{})
 	c.Check(Factory(tfKindString), FitsTypeOf, TFReader{})
@@ -228,7 +242,7 @@ func (s *zeroSuite) TestGetInfo_MetaReader(c *C) {
 }
 
 // module outputs can be specified as a simple string for the output name or as
-// a YAML mapping of name/description/sensitive (str,str,bool)
+// a YAML mapping of name/description/sensitive/value (str,str,bool,str)
 func (s *zeroSuite) TestUnmarshalOutputInfo(c *C) {
 	var oinfo OutputInfo
 	var y string
@@ -249,6 +263,11 @@ func (s *zeroSuite) TestUnmarshalOutputInfo(c *C) {
 	c.Check(yaml.Unmarshal([]byte(y), &oinfo), IsNil)
 	c.Check(oinfo, DeepEquals, OutputInfo{Name: "foo", Description: "bar", Sensitive: true})
 
+	y = "{ name: foo, value: '$(foo.bar[0].id)' }"
+	oinfo = OutputInfo{}
+	c.Check(yaml.Unmarshal([]byte(y), &oinfo), IsNil)
+	c.Check(oinfo, DeepEquals, OutputInfo{Name: "foo", Value: "$(foo.bar[0].id)"})
+
 	// extra key should generate error
 	y = "{ name: foo, description: bar, sensitive: true, extrakey: extraval }"
 	c.Check(yaml.Unmarshal([]byte(y), &oinfo), NotNil)
@@ -0,0 +1,143 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulereader
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/typeexpr"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/terraform-config-inspect/tfconfig"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// tfVariable is what is read from the variable block of a terraform module
+// beyond what tfconfig gives: the type constraint and the default as values
+type tfVariable struct {
+	Type     cty.Type
+	Defaults *typeexpr.Defaults
+	Default  cty.Value // cty.NilVal if there is none
+}
+
+var variableSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{{Type: "variable", LabelNames: []string{"name"}}},
+}
+
+var variableBodySchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{{Name: "type"}, {Name: "default"}},
+}
+
+// typeConstraint reads a terraform type constraint, including optional
+// attributes of objects and their defaults. The legacy `list` and `map`
+// keywords are read as lists and maps of any type.
+func typeConstraint(expr hcl.Expression) (cty.Type, *typeexpr.Defaults, hcl.Diagnostics) {
+	switch hcl.ExprAsKeyword(expr) {
+	case "list":
+		return cty.List(cty.DynamicPseudoType), nil, nil
+	case "map":
+		return cty.Map(cty.DynamicPseudoType), nil, nil
+	}
+	return typeexpr.TypeConstraintWithDefaults(expr)
+}
+
+// readTfVariables parses variable blocks of the .tf files of the module in
+// dir. Override files are read last, their attributes replace those read
+// before, as terraform does.
+func readTfVariables(fs tfconfig.FS, dir string) (map[string]tfVariable, error) {
+	infos, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var primary, override []string
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, ".tf") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if base := strings.TrimSuffix(name, ".tf"); base == "override" || strings.HasSuffix(base, "_override") {
+			override = append(override, name)
+		} else {
+			primary = append(primary, name)
+		}
+	}
+	sort.Strings(primary)
+	sort.Strings(override)
+
+	res := map[string]tfVariable{}
+	for _, name := range append(primary, override...) {
+		path := filepath.Join(dir, name)
+		src, err := fs.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		f, diags := hclsyntax.ParseConfig(src, path, hcl.Pos{Line: 1, Column: 1})
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		content, _, _ := f.Body.PartialContent(variableSchema)
+		for _, b := range content.Blocks {
+			if err := readTfVariable(b, res); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
+
+func readTfVariable(b *hcl.Block, vars map[string]tfVariable) error {
+	name := b.Labels[0]
+	v, ok := vars[name]
+	if !ok {
+		v = tfVariable{Type: cty.DynamicPseudoType}
+	}
+	attrs, _, _ := b.Body.PartialContent(variableBodySchema)
+	if a, ok := attrs.Attributes["type"]; ok {
+		ty, defaults, diags := typeConstraint(a.Expr)
+		if diags.HasErrors() {
+			return fmt.Errorf("failed to parse type of variable %q: %w", name, diags)
+		}
+		v.Type, v.Defaults = ty, defaults
+	}
+	if a, ok := attrs.Attributes["default"]; ok {
+		d, diags := a.Expr.Value(nil)
+		if diags.HasErrors() {
+			return fmt.Errorf("failed to read default of variable %q: %w", name, diags)
+		}
+		v.Default = d
+	}
+	vars[name] = v
+	return nil
+}
+
+// typedDefault returns the default of the variable as terraform sees it,
+// with defaults of optional attributes applied and converted to its type
+func (v tfVariable) typedDefault() cty.Value {
+	if v.Default == cty.NilVal || v.Default.IsNull() {
+		return v.Default
+	}
+	d := v.Default
+	if v.Defaults != nil {
+		d = v.Defaults.Apply(d)
+	}
+	if cd, err := convert.Convert(d, v.Type); err == nil {
+		return cd
+	}
+	return v.Default // terraform rejects the module, not ghpc
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulereader
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestGetHCLInfo_TypeFidelity(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "variables.tf"), []byte(`
+variable "nodeset" {
+  type = object({
+    name = string
+    # comments are fine
+    node_count = optional(number, 1)
+    disk = optional(object({
+      size = optional(number, 50)
+      type = optional(string)
+    }), {})
+  })
+  default = { name = "compute" }
+}
+
+variable "zones" {
+  type    = list
+  default = ["us-central1-a"]
+}
+
+variable "overridden" {
+  type = string
+}
+`), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(dir, "override.tf"), []byte(`
+variable "overridden" {
+  type = number
+}
+`), 0644), IsNil)
+
+	info, err := getHCLInfo(dir)
+	c.Assert(err, IsNil)
+	vars := map[string]VarInfo{}
+	for _, v := range info.Inputs {
+		vars[v.Name] = v
+	}
+
+	ns := vars["nodeset"]
+	c.Check(ns.Type.IsObjectType(), Equals, true)
+	c.Check(ns.Type.AttributeOptional("node_count"), Equals, true)
+	c.Check(ns.TypeDefaults, NotNil)
+	c.Check(ns.DefaultValue.GetAttr("node_count").Equals(cty.NumberIntVal(1)).True(), Equals, true)
+	c.Check(ns.DefaultValue.GetAttr("disk").GetAttr("size").Equals(cty.NumberIntVal(50)).True(), Equals, true)
+	c.Check(ns.DefaultValue.GetAttr("disk").GetAttr("type"), DeepEquals, cty.NullVal(cty.String))
+	c.Check(ns.Default, DeepEquals, map[string]interface{}{"name": "compute"})
+
+	got, err := ns.Coerce(cty.ObjectVal(map[string]cty.Value{
+		"name": cty.StringVal("gpu"),
+		"disk": cty.ObjectVal(map[string]cty.Value{"type": cty.StringVal("pd-ssd")})}))
+	c.Assert(err, IsNil)
+	c.Check(got.GetAttr("node_count").Equals(cty.NumberIntVal(1)).True(), Equals, true)
+	c.Check(got.GetAttr("disk").GetAttr("size").Equals(cty.NumberIntVal(50)).True(), Equals, true)
+
+	_, err = ns.Coerce(cty.ObjectVal(map[string]cty.Value{
+		"name": cty.StringVal("gpu"),
+		"disk": cty.ObjectVal(map[string]cty.Value{"size": cty.StringVal("big")})}))
+	c.Check(err, ErrorMatches, `.*a number is required`)
+
+	c.Check(vars["zones"].Type, DeepEquals, cty.List(cty.DynamicPseudoType))
+	c.Check(vars["zones"].DefaultValue, DeepEquals, cty.ListVal([]cty.Value{cty.StringVal("us-central1-a")}))
+	c.Check(vars["overridden"].Type, DeepEquals, cty.Number)
+	c.Check(vars["overridden"].DefaultValue, Equals, cty.NilVal)
+}
@@ -0,0 +1,205 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulewriter
+
+import (
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/sourcereader"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/exp/slices"
+)
+
+// Sizes above which written artifacts are reported, copies of module sources
+// and generated files, e.g. terraform files inlining startup scripts
+const (
+	maxSourceCopySize    int64 = 64 << 20
+	maxGeneratedFileSize int64 = 1 << 20
+)
+
+// ManifestFile is a file written to the deployment directory, copies of module
+// sources are recorded as whole directories
+type ManifestFile struct {
+	Path string `yaml:"path"` // relative to the deployment directory, slash separated
+	Size int64  `yaml:"size"`
+	Dir  bool   `yaml:"dir,omitempty"`
+}
+
+// writtenFiles lists files the deployment was written with, terraform state
+// and working directories are not part of it
+func writtenFiles(bp config.Blueprint, deploymentDir string) ([]ManifestFile, error) {
+	l := fileLister{deploymentDir: deploymentDir, res: []ManifestFile{}}
+	for _, p := range []string{InstructionsPath(deploymentDir), filepath.Join(deploymentDir, ".gitignore")} {
+		if info, err := os.Stat(p); err == nil {
+			l.res = append(l.res, ManifestFile{Path: filepath.Base(p), Size: info.Size()})
+		}
+	}
+	for _, g := range bp.DeploymentGroups {
+		if err := l.addGroup(bp, g); err != nil {
+			return nil, fmt.Errorf("failed to list files of deployment group %s: %w", g.Name, err)
+		}
+	}
+	sort.Slice(l.res, func(i, j int) bool { return l.res[i].Path < l.res[j].Path })
+	return l.res, nil
+}
+
+// fileLister lists files written to the deployment directory
+type fileLister struct {
+	deploymentDir string
+	res           []ManifestFile
+}
+
+func (l *fileLister) add(p string, size int64, dir bool) error {
+	drel, err := filepath.Rel(l.deploymentDir, p)
+	if err != nil {
+		return err
+	}
+	l.res = append(l.res, ManifestFile{Path: filepath.ToSlash(drel), Size: size, Dir: dir})
+	return nil
+}
+
+// addGroup lists files of the group directory, copies of module sources as
+// whole directories
+func (l *fileLister) addGroup(bp config.Blueprint, g config.DeploymentGroup) error {
+	gPath := GroupDir(l.deploymentDir, bp, g.Name)
+	sources, err := sourceCopyDirs(g)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(gPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(gPath, p)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return l.addDir(bp, p, rel, d, sources)
+		}
+		if slices.Contains([]string{tfStateFileName, tfStateBackupFileName, EncryptedStateFileName}, d.Name()) {
+			return nil
+		}
+		if gPath == l.deploymentDir && slices.ContainsFunc(l.res, func(f ManifestFile) bool { return f.Path == rel }) {
+			return nil // deployment files, already listed with flat layout
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return l.add(p, info.Size(), false)
+	})
+}
+
+// addDir lists copies of module sources, skipping ghpc and terraform working
+// directories; files of other directories are listed one by one
+func (l *fileLister) addDir(bp config.Blueprint, p string, rel string, d fs.DirEntry, sources map[string]bool) error {
+	switch {
+	case rel == bp.DeploymentLayout.GhpcDirName() || d.Name() == ".terraform":
+		return filepath.SkipDir
+	case sources[rel]:
+		size, err := dirSize(p)
+		if err != nil {
+			return err
+		}
+		if err := l.add(p, size, true); err != nil {
+			return err
+		}
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// sourceCopyDirs returns directories, relative to the group directory, that
+// module sources are copied to
+func sourceCopyDirs(g config.DeploymentGroup) (map[string]bool, error) {
+	res := map[string]bool{}
+	for _, m := range g.Modules {
+		ds, err := DeploymentSource(m)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case m.Kind == config.PackerKind:
+			res[string(m.ID)] = true
+		case sourcereader.IsEmbeddedPath(m.Source): // all embedded modules are copied at once
+			res[filepath.Join("modules", "embedded")] = true
+		case sourcereader.IsLocalPath(m.Source):
+			res[filepath.Clean(ds)] = true
+		}
+	}
+	return res, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// warnOversizedFiles reports copies of module sources and generated files that
+// make the deployment directory unexpectedly large
+func warnOversizedFiles(files []ManifestFile) {
+	for _, f := range files {
+		switch {
+		case f.Dir && f.Size > maxSourceCopySize:
+			logging.Error("WARNING: copy of module sources %s is %d MiB, larger than %d MiB; exclude unneeded files from the module directory",
+				f.Path, f.Size>>20, maxSourceCopySize>>20)
+		case !f.Dir && f.Size > maxGeneratedFileSize:
+			logging.Error("WARNING: generated file %s is %d KiB, larger than %d KiB; consider moving embedded scripts to files or buckets",
+				f.Path, f.Size>>10, maxGeneratedFileSize>>10)
+		}
+	}
+}
+
+// pruneStaleFiles removes files written by the previous deployment that are
+// no longer generated, files not written by ghpc are left untouched
+func pruneStaleFiles(deploymentDir string, prev []ManifestFile, cur []ManifestFile) error {
+	written := map[string]bool{}
+	for _, f := range cur {
+		written[f.Path] = true
+	}
+	for _, f := range prev {
+		rel := filepath.FromSlash(f.Path)
+		if written[f.Path] || !filepath.IsLocal(rel) {
+			continue
+		}
+		p := filepath.Join(deploymentDir, rel)
+		if _, err := os.Lstat(p); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		logging.Info("Removing %s, it is no longer generated for the deployment", p)
+		if err := os.RemoveAll(p); err != nil {
+			return fmt.Errorf("failed to remove stale file %s: %w", p, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulewriter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// StaleFile is a file or directory of the deployment that is no longer needed
+type StaleFile struct {
+	Path   string
+	Reason string
+}
+
+// StaleFiles returns files of the deployment that can be removed:
+//   - backups of deployment groups removed from the blueprint,
+//   - .terraform directories of backups of deployment groups,
+//   - terraform plan files and logs larger than maxLogSize in deployment groups.
+//
+// Backups of removed groups that may still have resources are returned as kept.
+func StaleFiles(bp config.Blueprint, deploymentDir string, maxLogSize int64) (stale []StaleFile, kept []StaleFile, err error) {
+	m, err := ReadManifest(ArtifactsDir(deploymentDir))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prevDir := PrevDeploymentGroupsDir(deploymentDir)
+	for _, d := range m.RemovedGroups {
+		p := filepath.Join(prevDir, d)
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+		if reason, has := mayHaveResources(p); has {
+			kept = append(kept, StaleFile{p, reason})
+		} else {
+			stale = append(stale, StaleFile{p, "backup of a deployment group removed from the blueprint"})
+		}
+	}
+
+	backups, err := os.ReadDir(prevDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+	for _, b := range backups {
+		if !b.IsDir() || slices.Contains(m.RemovedGroups, b.Name()) {
+			continue
+		}
+		p := filepath.Join(prevDir, b.Name(), ".terraform")
+		if _, err := os.Stat(p); err == nil {
+			stale = append(stale, StaleFile{p, "terraform working directory of a deployment group backup"})
+		}
+	}
+
+	for _, g := range bp.DeploymentGroups {
+		fs, err := groupLeftovers(GroupDir(deploymentDir, bp, g.Name), maxLogSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		stale = append(stale, fs...)
+	}
+	return stale, kept, nil
+}
+
+// mayHaveResources tells if the terraform state of the group directory may
+// still track resources, explaining why
+func mayHaveResources(groupDir string) (string, bool) {
+	b, err := os.ReadFile(filepath.Join(groupDir, tfStateFileName))
+	if err == nil {
+		var st struct {
+			Resources []json.RawMessage `json:"resources"`
+		}
+		if json.Unmarshal(b, &st) != nil || len(st.Resources) > 0 {
+			return "terraform state of the removed deployment group has resources, destroy them first", true
+		}
+		return "", false
+	}
+	if _, err := os.Stat(filepath.Join(groupDir, EncryptedStateFileName)); err == nil {
+		return "encrypted terraform state of the removed deployment group may have resources, destroy them first", true
+	}
+	// local copy of the backend configuration, state is stored remotely
+	if _, err := os.Stat(filepath.Join(groupDir, ".terraform", tfStateFileName)); err == nil {
+		return "removed deployment group uses a remote terraform backend, destroy its resources first", true
+	}
+	return "", false
+}
+
+// groupLeftovers returns plan files and oversized logs in the group directory
+func groupLeftovers(groupDir string, maxLogSize int64) ([]StaleFile, error) {
+	entries, err := os.ReadDir(groupDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fs := []StaleFile{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		n, p := e.Name(), filepath.Join(groupDir, e.Name())
+		switch {
+		case n == "tfplan" || strings.HasSuffix(n, ".tfplan"):
+			fs = append(fs, StaleFile{p, "terraform plan file"})
+		case strings.HasSuffix(n, ".log"):
+			info, err := e.Info()
+			if err != nil {
+				return nil, err
+			}
+			if info.Size() > maxLogSize {
+				fs = append(fs, StaleFile{p, fmt.Sprintf("log of %d bytes, larger than %d bytes", info.Size(), maxLogSize)})
+			}
+		}
+	}
+	return fs, nil
+}
@@ -15,7 +15,9 @@
 package modulewriter
 
 import (
+	"errors"
 	"hpc-toolkit/pkg/config"
+	"os"
 
 	"github.com/hashicorp/hcl/v2/hclwrite"
 	"github.com/zclconf/go-cty/cty"
@@ -23,6 +25,25 @@ import (
 
 // WriteHclAttributes writes tfvars/pkvars.hcl files
 func WriteHclAttributes(vars map[string]cty.Value, dst string) error {
+	return writeHclFile(dst, hclAttributesFile(vars))
+}
+
+// WriteSecretHclAttributes writes tfvars/pkvars.hcl files only the user can
+// read, the file is never readable by others, not even while being written
+func WriteSecretHclAttributes(vars map[string]cty.Value, dst string) error {
+	// mode of an existing file is kept by os.WriteFile
+	if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.WriteFile(dst, FormatHclAttributes(vars), 0600)
+}
+
+// FormatHclAttributes returns the content WriteHclAttributes writes to a file
+func FormatHclAttributes(vars map[string]cty.Value) []byte {
+	return append([]byte(license), hclwrite.Format(hclAttributesFile(vars).Bytes())...)
+}
+
+func hclAttributesFile(vars map[string]cty.Value) *hclwrite.File {
 	hclFile := hclwrite.NewEmptyFile()
 	hclBody := hclFile.Body()
 	for _, k := range orderKeys(vars) {
@@ -30,5 +51,5 @@ func WriteHclAttributes(vars map[string]cty.Value, dst string) error {
 		toks := config.TokensForValue(vars[k])
 		hclBody.SetAttributeRaw(k, toks)
 	}
-	return writeHclFile(dst, hclFile)
+	return hclFile
 }
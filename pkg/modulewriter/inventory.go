@@ -0,0 +1,231 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulewriter
+
+import (
+	"encoding/json"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/modulereader"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+// InventoryName is the name of the software inventory in the artifacts directory
+const InventoryName = "software_inventory.cdx.json"
+
+// Inventory lists software the deployment installs, as declared in metadata of
+// its modules. It is a subset of the CycloneDX format, so it can be consumed
+// by tools reviewing software bills of materials.
+type Inventory struct {
+	BomFormat   string               `json:"bomFormat"`
+	SpecVersion string               `json:"specVersion"`
+	Version     int                  `json:"version"`
+	Metadata    InventoryMetadata    `json:"metadata"`
+	Components  []InventoryComponent `json:"components"`
+}
+
+// InventoryMetadata describes the deployment the inventory is of
+type InventoryMetadata struct {
+	Component InventoryComponent `json:"component"`
+}
+
+// InventoryComponent is a piece of software installed by a module
+type InventoryComponent struct {
+	Type    string `json:"type"` // "application" or "container"
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	// Properties name the module installing the software, as "ghpc:module",
+	// "ghpc:group" and "ghpc:source"
+	Properties []InventoryProperty `json:"properties,omitempty"`
+}
+
+// InventoryProperty is a name-value pair describing a component
+type InventoryProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// NewInventory returns the inventory of software installed by the blueprint.
+// Settings referring to module outputs or secret variables are not known
+// before deployment, software they list is left out and versions they hold
+// are left empty.
+func NewInventory(bp config.Blueprint) (Inventory, error) {
+	res, err := bp.Resolved()
+	if err != nil {
+		return Inventory{}, err
+	}
+	inv := Inventory{
+		BomFormat:   "CycloneDX",
+		SpecVersion: "1.5",
+		Version:     1,
+		Metadata: InventoryMetadata{Component: InventoryComponent{
+			Type: "application", Name: bp.BlueprintName}},
+		Components: []InventoryComponent{},
+	}
+	for _, g := range res.DeploymentGroups {
+		for _, m := range g.Modules {
+			info, err := modulereader.GetModuleInfo(m.Source, m.Kind.String())
+			if err != nil {
+				continue // modules ghpc can not read declare no software
+			}
+			props := []InventoryProperty{
+				{"ghpc:module", string(m.ID)}, {"ghpc:group", string(g.Name)}, {"ghpc:source", m.Source}}
+			for _, sw := range info.Metadata.Ghpc.Software {
+				cs, err := softwareComponents(sw, m, info)
+				if err != nil {
+					return Inventory{}, fmt.Errorf("failed to list software of module %q: %w", m.ID, err)
+				}
+				for _, c := range cs {
+					c.Properties = props
+					inv.Components = append(inv.Components, c)
+				}
+			}
+		}
+	}
+	return inv, nil
+}
+
+func softwareComponents(sw modulereader.MetadataSoftware, m config.Module, info modulereader.ModuleInfo) ([]InventoryComponent, error) {
+	if sw.Setting == "" {
+		c := InventoryComponent{Type: "application", Name: sw.Name, Version: sw.Version}
+		if sw.VersionSetting != "" {
+			vs := settingStrings(m, info, sw.VersionSetting)
+			c.Version = ""
+			if len(vs) == 1 {
+				c.Version = vs[0]
+			}
+		}
+		return []InventoryComponent{c}, nil
+	}
+
+	res := []InventoryComponent{}
+	for _, s := range settingStrings(m, info, sw.Setting) {
+		switch sw.Format {
+		case "image":
+			name, version := splitImageReference(s)
+			res = append(res, InventoryComponent{Type: "container", Name: name, Version: version})
+		case "spack":
+			for _, spec := range spackInstallSpecs(s) {
+				name, version, _ := strings.Cut(spec, "@")
+				res = append(res, InventoryComponent{Type: "application", Name: name, Version: version})
+			}
+		default:
+			return nil, fmt.Errorf("unknown format %q of software listed by setting %q", sw.Format, sw.Setting)
+		}
+	}
+	return res, nil
+}
+
+// settingStrings are strings held by the resolved module setting, or by the
+// default of the module input if the blueprint does not set it
+func settingStrings(m config.Module, info modulereader.ModuleInfo, name string) []string {
+	if m.Settings.Has(name) {
+		return knownStrings(m.Settings.Get(name))
+	}
+	for _, in := range info.Inputs {
+		if in.Name != name {
+			continue
+		}
+		switch d := in.Default.(type) {
+		case string:
+			return []string{d}
+		case []interface{}:
+			res := []string{}
+			for _, e := range d {
+				if s, ok := e.(string); ok {
+					res = append(res, s)
+				}
+			}
+			return res
+		}
+	}
+	return nil
+}
+
+// knownStrings returns the value if it is a string, or its string elements if
+// it is a list; expressions, resolved once deployed, are skipped
+func knownStrings(v cty.Value) []string {
+	if v.IsNull() || !v.IsWhollyKnown() {
+		return nil
+	}
+	if _, is := config.IsExpressionValue(v); is {
+		return nil
+	}
+	ty := v.Type()
+	switch {
+	case ty == cty.String:
+		return []string{v.AsString()}
+	case ty.IsListType() || ty.IsTupleType() || ty.IsSetType():
+		res := []string{}
+		for _, e := range v.AsValueSlice() {
+			res = append(res, knownStrings(e)...)
+		}
+		return res
+	}
+	return nil
+}
+
+// splitImageReference splits a container image reference into the image name
+// and its tag or digest, e.g. "nvcr.io/nvidia/pytorch:24.01-py3"
+func splitImageReference(ref string) (string, string) {
+	if name, digest, found := strings.Cut(ref, "@"); found {
+		return name, digest
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// spackInstallSpecs returns root specs of packages installed by `spack install`
+// commands of the script, without compilers, variants and dependencies
+func spackInstallSpecs(script string) []string {
+	res := []string{}
+	for _, line := range strings.Split(script, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, cmd := range strings.FieldsFunc(line, func(r rune) bool { return r == ';' || r == '&' || r == '|' }) {
+			fields := strings.Fields(cmd)
+			if len(fields) < 2 || fields[0] != "spack" || fields[1] != "install" {
+				continue
+			}
+			for _, f := range fields[2:] {
+				// skip options, their numeric arguments, and parts of the spec
+				if strings.ContainsAny(f[:1], "-%^+~0123456789") || strings.Contains(f, "=") {
+					continue
+				}
+				res = append(res, f)
+			}
+		}
+	}
+	return res
+}
+
+func writeInventory(artifactsDir string, bp config.Blueprint) error {
+	inv, err := NewInventory(bp)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(artifactsDir, InventoryName), append(data, '\n'), 0644)
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulewriter
+
+import (
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/modulereader"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestNewInventory(c *C) {
+	condor := config.Module{ID: "condor", Kind: config.TerraformKind, Source: c.TestName() + "/htcondor-install"}
+	modulereader.SetModuleInfo(condor.Source, condor.Kind.String(), modulereader.ModuleInfo{
+		Inputs: []modulereader.VarInfo{{Name: "condor_version", Default: "23.*"}},
+		Metadata: modulereader.Metadata{Ghpc: modulereader.MetadataGhpc{Software: []modulereader.MetadataSoftware{
+			{Name: "htcondor", VersionSetting: "condor_version"}}}}})
+	spack := config.Module{ID: "spack", Kind: config.TerraformKind, Source: c.TestName() + "/spack-execute",
+		Settings: config.NewDict(map[string]cty.Value{
+			"commands": cty.StringVal("spack install -j 8 gromacs@2023.1 %gcc@10.3.0 +cuda\nspack load gromacs && spack install lammps # md"),
+		})}
+	modulereader.SetModuleInfo(spack.Source, spack.Kind.String(), modulereader.ModuleInfo{
+		Metadata: modulereader.Metadata{Ghpc: modulereader.MetadataGhpc{Software: []modulereader.MetadataSoftware{
+			{Setting: "commands", Format: "spack"}}}}})
+	job := config.Module{ID: "job", Kind: config.TerraformKind, Source: c.TestName() + "/gke-job-template",
+		Settings: config.NewDict(map[string]cty.Value{
+			"image": config.GlobalRef("image").AsValue(),
+		})}
+	modulereader.SetModuleInfo(job.Source, job.Kind.String(), modulereader.ModuleInfo{
+		Metadata: modulereader.Metadata{Ghpc: modulereader.MetadataGhpc{Software: []modulereader.MetadataSoftware{
+			{Setting: "image", Format: "image"}}}}})
+
+	bp := config.Blueprint{
+		BlueprintName: "hpc",
+		Vars:          config.NewDict(map[string]cty.Value{"image": cty.StringVal("nvcr.io/nvidia/pytorch:24.01-py3")}),
+		DeploymentGroups: []config.DeploymentGroup{
+			{Name: "primary", Modules: []config.Module{condor, spack}},
+			{Name: "jobs", Modules: []config.Module{job}}},
+	}
+	inv, err := NewInventory(bp)
+	c.Assert(err, IsNil)
+	c.Check(inv.BomFormat, Equals, "CycloneDX")
+	c.Check(inv.Metadata.Component.Name, Equals, "hpc")
+
+	got := [][]string{}
+	for _, comp := range inv.Components {
+		got = append(got, []string{comp.Type, comp.Name, comp.Version, comp.Properties[0].Value})
+	}
+	c.Check(got, DeepEquals, [][]string{
+		{"application", "htcondor", "23.*", "condor"},
+		{"application", "gromacs", "2023.1", "spack"},
+		{"application", "lammps", "", "spack"},
+		{"container", "nvcr.io/nvidia/pytorch", "24.01-py3", "job"},
+	})
+}
+
+func (s *zeroSuite) TestSplitImageReference(c *C) {
+	for _, tc := range []struct{ ref, name, version string }{
+		{"ubuntu", "ubuntu", ""},
+		{"ubuntu:22.04", "ubuntu", "22.04"},
+		{"localhost:5000/app", "localhost:5000/app", ""},
+		{"gcr.io/p/app@sha256:abc", "gcr.io/p/app", "sha256:abc"},
+	} {
+		name, version := splitImageReference(tc.ref)
+		c.Check([]string{name, version}, DeepEquals, []string{tc.name, tc.version}, Commentf("%s", tc.ref))
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulewriter
+
+import (
+	"errors"
+	"hpc-toolkit/pkg/config"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StateEncryptionFileName is the file configuring encryption of the local
+// state of deployment groups with a local-encrypted backend
+const StateEncryptionFileName = "state_encryption.yaml"
+
+// EncryptedStateFileName is the encrypted terraform state of deployment groups
+// with a local-encrypted backend
+const EncryptedStateFileName = tfStateFileName + ".enc"
+
+// writeStateEncryption writes how the local state of the group is encrypted,
+// the file is removed from groups with other backends
+func writeStateEncryption(be config.TerraformBackend, groupPath string) error {
+	p := filepath.Join(groupPath, StateEncryptionFileName)
+	enc, ok := be.LocalStateEncryption()
+	if !ok {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	b, err := yaml.Marshal(enc)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, b, 0644)
+}
+
+// StateEncryption returns how the local state of the deployment group is
+// encrypted, if the group has a local-encrypted backend
+func StateEncryption(groupDir string) (config.LocalStateEncryption, bool, error) {
+	b, err := os.ReadFile(filepath.Join(groupDir, StateEncryptionFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return config.LocalStateEncryption{}, false, nil
+	}
+	if err != nil {
+		return config.LocalStateEncryption{}, false, err
+	}
+	var enc config.LocalStateEncryption
+	if err := yaml.Unmarshal(b, &enc); err != nil {
+		return config.LocalStateEncryption{}, false, err
+	}
+	return enc, true, nil
+}
@@ -0,0 +1,40 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulewriter
+
+import (
+	"hpc-toolkit/pkg/config"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestWriteStateEncryption(c *C) {
+	dir := c.MkDir()
+	be := config.TerraformBackend{Type: config.LocalEncryptedBackend}
+	be.Configuration.Set("kms_key", cty.StringVal("projects/p/locations/l/keyRings/r/cryptoKeys/k"))
+
+	c.Assert(writeStateEncryption(be, dir), IsNil)
+	enc, ok, err := StateEncryption(dir)
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, true)
+	c.Check(enc, DeepEquals, config.LocalStateEncryption{KmsKey: "projects/p/locations/l/keyRings/r/cryptoKeys/k"})
+
+	// switching to another backend removes the file
+	c.Assert(writeStateEncryption(config.TerraformBackend{Type: "gcs"}, dir), IsNil)
+	_, ok, err = StateEncryption(dir)
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, false)
+}
@@ -0,0 +1,195 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulewriter
+
+import (
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/modulereader"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// ManifestName is the name of the manifest file in the artifacts directory
+const ManifestName = "manifest.yaml"
+
+// ManifestSchemaVersion is the version of deployment directory format written
+// by this binary; it is incremented on every incompatible change of the format
+const ManifestSchemaVersion = 1
+
+// Deployment features that require support from the binary operating on it
+const (
+	FeatureSecretVars          = "secret_vars"
+	FeatureCustomOutputs       = "custom_output_values"
+	FeatureLayout              = "deployment_layout"
+	FeatureStartupScript       = "startup_script_parts"
+	FeatureRenamedFrom         = "renamed_from"
+	FeatureNetMirror           = "provider_network_mirror"
+	FeatureImport              = "import"
+	FeatureEncryptedState      = "local_encrypted_state"
+	FeatureStateAccess         = "state_access"
+	FeatureZonePolicy          = "zone_policy"
+	FeatureArtifactsEncryption = "artifacts_encryption"
+	FeatureMixedGroups         = "mixed_groups"
+	FeatureRuntimeValues       = "runtime_values"
+	FeatureCredentials         = "credentials"
+	FeaturePostDeploy          = "post_deploy"
+	FeatureHealthChecks        = "health_checks"
+	FeatureBootstrap           = "bootstrap_groups"
+)
+
+var supportedFeatures = []string{FeatureSecretVars, FeatureCustomOutputs, FeatureLayout, FeatureStartupScript, FeatureRenamedFrom, FeatureNetMirror, FeatureImport, FeatureEncryptedState, FeatureStateAccess, FeatureZonePolicy, FeatureArtifactsEncryption, FeatureMixedGroups, FeatureRuntimeValues, FeatureCredentials, FeaturePostDeploy, FeatureHealthChecks, FeatureBootstrap}
+
+// Manifest describes the deployment, so a binary can check it is capable of
+// operating on the deployment before reading any of it
+type Manifest struct {
+	SchemaVersion int      `yaml:"schema_version"`
+	GhpcVersion   string   `yaml:"ghpc_version,omitempty"`
+	Features      []string `yaml:"features,omitempty"`
+	// RemovedGroups are directories of deployment groups removed from the
+	// blueprint since the previous deployment, their backups are kept among
+	// previous deployment groups
+	RemovedGroups []string `yaml:"removed_groups,omitempty"`
+	// Files are written by ghpc, those no longer generated are removed when
+	// the deployment is overwritten
+	Files []ManifestFile `yaml:"files,omitempty"`
+}
+
+// NewManifest returns manifest for the blueprint
+func NewManifest(bp config.Blueprint) Manifest {
+	return Manifest{
+		SchemaVersion: ManifestSchemaVersion,
+		GhpcVersion:   bp.GhpcVersion,
+		Features:      usedFeatures(bp),
+	}
+}
+
+// features are features deployments may use, with whether the blueprint
+// uses them, in the order they are listed by manifests
+var features = []struct {
+	name string
+	used func(bp config.Blueprint) bool
+}{
+	{FeatureSecretVars, func(bp config.Blueprint) bool { return len(bp.SecretVars()) > 0 }},
+	{FeatureLayout, func(bp config.Blueprint) bool { return bp.DeploymentLayout != (config.DeploymentLayout{}) }},
+	{FeatureNetMirror, func(bp config.Blueprint) bool { return bp.TerraformProviders.NetworkMirror != "" }},
+	{FeatureZonePolicy, func(bp config.Blueprint) bool { return len(bp.ZonePolicy) > 0 }},
+	{FeatureArtifactsEncryption, func(bp config.Blueprint) bool { return bp.ArtifactsEncryption.Enabled() }},
+	{FeatureCredentials, func(bp config.Blueprint) bool { return len(bp.Credentials) > 0 }},
+	{FeatureHealthChecks, func(bp config.Blueprint) bool { return len(bp.HealthChecks) > 0 }},
+	{FeatureEncryptedState, anyGroup(func(g config.DeploymentGroup) bool {
+		_, ok := g.TerraformBackend.LocalStateEncryption()
+		return ok
+	})},
+	{FeatureStateAccess, anyGroup(func(g config.DeploymentGroup) bool {
+		return g.TerraformBackend.StateAccess != (config.StateAccess{})
+	})},
+	{FeatureMixedGroups, anyGroup(config.DeploymentGroup.Mixed)},
+	{FeatureRuntimeValues, anyGroup(func(g config.DeploymentGroup) bool { return len(g.RuntimeReferences()) > 0 })},
+	{FeaturePostDeploy, anyGroup(func(g config.DeploymentGroup) bool { return len(g.PostDeploy) > 0 })},
+	{FeatureBootstrap, anyGroup(func(g config.DeploymentGroup) bool { return g.Bootstrap })},
+	{FeatureCustomOutputs, anyModule(func(m config.Module) bool {
+		return slices.ContainsFunc(m.Outputs, func(o modulereader.OutputInfo) bool { return o.Value != "" })
+	})},
+	{FeatureStartupScript, anyModule(func(m config.Module) bool { return len(m.StartupScriptParts) > 0 })},
+	{FeatureRenamedFrom, anyModule(func(m config.Module) bool { return m.RenamedFrom != "" })},
+	{FeatureImport, anyModule(func(m config.Module) bool { return !m.Import.IsZero() })},
+}
+
+func anyGroup(f func(config.DeploymentGroup) bool) func(config.Blueprint) bool {
+	return func(bp config.Blueprint) bool { return slices.ContainsFunc(bp.DeploymentGroups, f) }
+}
+
+func anyModule(f func(config.Module) bool) func(config.Blueprint) bool {
+	return func(bp config.Blueprint) bool {
+		used := false
+		bp.WalkModulesSafe(func(_ config.ModulePath, m *config.Module) {
+			used = used || f(*m)
+		})
+		return used
+	}
+}
+
+func usedFeatures(bp config.Blueprint) []string {
+	fs := []string{}
+	for _, f := range features {
+		if f.used(bp) {
+			fs = append(fs, f.name)
+		}
+	}
+	return fs
+}
+
+func writeManifest(artifactsDir string, m Manifest) error {
+	b, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(artifactsDir, ManifestName), b, 0644)
+}
+
+// ReadManifest reads manifest of the deployment, it returns an empty manifest
+// for deployments written before the manifest was introduced
+func ReadManifest(artifactsDir string) (Manifest, error) {
+	b, err := os.ReadFile(filepath.Join(artifactsDir, ManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return Manifest{}, nil
+	}
+	if err != nil {
+		return Manifest{}, err
+	}
+	var m Manifest
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return Manifest{}, fmt.Errorf("failed to read deployment manifest: %w", err)
+	}
+	return m, nil
+}
+
+// CheckManifest verifies that this binary supports the deployment, it returns
+// an error with upgrade guidance otherwise. Deployments written before the
+// manifest was introduced are considered compatible.
+func CheckManifest(artifactsDir string) error {
+	m, err := ReadManifest(artifactsDir)
+	if err != nil {
+		return err
+	}
+
+	hint := "upgrade ghpc to a newer version"
+	if m.GhpcVersion != "" {
+		hint = fmt.Sprintf("upgrade ghpc to the version the deployment was created with (%s) or newer", m.GhpcVersion)
+	}
+	if m.SchemaVersion > ManifestSchemaVersion {
+		return config.HintError{
+			Err:  fmt.Errorf("deployment format version %d is not supported, this ghpc supports versions up to %d", m.SchemaVersion, ManifestSchemaVersion),
+			Hint: hint}
+	}
+	unsupported := []string{}
+	for _, f := range m.Features {
+		if !slices.Contains(supportedFeatures, f) {
+			unsupported = append(unsupported, f)
+		}
+	}
+	if len(unsupported) > 0 {
+		return config.HintError{
+			Err:  fmt.Errorf("deployment uses features not supported by this ghpc: %s", strings.Join(unsupported, ", ")),
+			Hint: hint}
+	}
+	return nil
+}
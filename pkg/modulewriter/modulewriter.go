@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"hpc-toolkit/pkg/config"
 	"hpc-toolkit/pkg/deploymentio"
+	"hpc-toolkit/pkg/logging"
 	"hpc-toolkit/pkg/sourcereader"
 	"io"
 	"os"
@@ -32,26 +33,77 @@ import (
 	"path/filepath"
 
 	"github.com/hashicorp/go-getter"
+	"golang.org/x/exp/slices"
 )
 
 // strings that get re-used throughout this package and others
 const (
-	HiddenGhpcDirName          = ".ghpc"
-	ArtifactsDirName           = "artifacts"
-	ExpandedBlueprintName      = "expanded_blueprint.yaml"
+	HiddenGhpcDirName     = config.DefaultGhpcDirName
+	ArtifactsDirName      = "artifacts"
+	ExpandedBlueprintName = "expanded_blueprint.yaml"
+	// ResolvedBlueprintName is the expanded blueprint with module settings
+	// evaluated where possible, for tools that do not evaluate expressions
+	ResolvedBlueprintName      = "resolved_blueprint.yaml"
 	prevDeploymentGroupDirName = "previous_deployment_groups"
 	gitignoreTemplate          = "deployment.gitignore.tmpl"
 	artifactsWarningFilename   = "DO_NOT_MODIFY_THIS_DIRECTORY"
 )
 
+// HiddenGhpcDir returns the toolkit directory of an existing deployment. Its
+// name can be changed in the blueprint, so if the default one is absent, the
+// deployment is searched for a directory holding toolkit artifacts.
 func HiddenGhpcDir(deplDir string) string {
-	return filepath.Join(filepath.Clean(deplDir), HiddenGhpcDirName)
+	def := filepath.Join(filepath.Clean(deplDir), HiddenGhpcDirName)
+	if _, err := os.Stat(def); err == nil {
+		return def
+	}
+	marker := filepath.Join(filepath.Clean(deplDir), "*", ArtifactsDirName, artifactsWarningFilename)
+	if found, _ := filepath.Glob(marker); len(found) == 1 {
+		return filepath.Dir(filepath.Dir(found[0]))
+	}
+	return def
 }
 
 func ArtifactsDir(deplDir string) string {
 	return filepath.Join(HiddenGhpcDir(deplDir), ArtifactsDirName)
 }
 
+// PrevDeploymentGroupsDir returns the directory that holds deployment groups
+// of the deployment as they were before the latest overwrite
+func PrevDeploymentGroupsDir(deplDir string) string {
+	return filepath.Join(HiddenGhpcDir(deplDir), prevDeploymentGroupDirName)
+}
+
+// GroupDir returns the directory of the deployment group
+func GroupDir(deplDir string, bp config.Blueprint, g config.GroupName) string {
+	return filepath.Join(deplDir, bp.GroupDirName(g))
+}
+
+// PrevGroupDir returns the directory that holds the deployment group as it was
+// before the latest overwrite
+func PrevGroupDir(deplDir string, bp config.Blueprint, g config.GroupName) string {
+	name := bp.GroupDirName(g)
+	if name == "" { // flat layout, group is backed up under its own name
+		name = string(g)
+	}
+	return filepath.Join(PrevDeploymentGroupsDir(deplDir), name)
+}
+
+// DeploymentGroupOfDir returns the deployment group written to the directory
+// and the deployment directory it belongs to
+func DeploymentGroupOfDir(bp config.Blueprint, groupDir string) (config.DeploymentGroup, string, error) {
+	groupDir = filepath.Clean(groupDir)
+	// try flat layout first, group directory is deployment directory itself
+	for _, deplDir := range []string{groupDir, filepath.Dir(groupDir)} {
+		for _, g := range bp.DeploymentGroups {
+			if GroupDir(deplDir, bp, g.Name) == groupDir {
+				return g, deplDir, nil
+			}
+		}
+	}
+	return config.DeploymentGroup{}, "", fmt.Errorf("directory %s does not correspond to any deployment group", groupDir)
+}
+
 // ModuleWriter interface for writing modules to a deployment
 type ModuleWriter interface {
 	writeDeploymentGroup(
@@ -60,7 +112,7 @@ type ModuleWriter interface {
 		groupPath string,
 		instructionsFile io.Writer,
 	) error
-	restoreState(deploymentDir string) error
+	restoreState(bp config.Blueprint, deploymentDir string) error
 	kind() config.ModuleKind
 }
 
@@ -74,7 +126,23 @@ var templatesFS embed.FS
 
 // WriteDeployment writes a deployment directory using modules defined the environment blueprint.
 func WriteDeployment(bp config.Blueprint, deploymentDir string) error {
-	if err := prepDepDir(deploymentDir); err != nil {
+	prev, _, prevErr := config.NewBlueprint(filepath.Join(ArtifactsDir(deploymentDir), ExpandedBlueprintName))
+	prevManifest, _ := ReadManifest(ArtifactsDir(deploymentDir))
+	bp, overrides, err := withOverrides(bp, deploymentDir)
+	if err != nil {
+		return err
+	}
+	// backups of groups removed earlier are kept until they are destroyed
+	removed := []string{}
+	for _, d := range prevManifest.RemovedGroups {
+		if prevErr == nil && slices.Contains(groupDirNames(prev), d) {
+			continue // group was added back before this overwrite
+		}
+		if _, err := os.Stat(filepath.Join(PrevDeploymentGroupsDir(deploymentDir), d)); err == nil {
+			removed = append(removed, d)
+		}
+	}
+	if err := prepDepDir(deploymentDir, bp, removed...); err != nil {
 		return err
 	}
 
@@ -91,24 +159,94 @@ func WriteDeployment(bp config.Blueprint, deploymentDir string) error {
 			return err
 		}
 	}
+	if err := restoreOverrides(bp, deploymentDir, overrides); err != nil {
+		return err
+	}
 
+	if prevErr == nil {
+		if moves := CrossGroupMoves(prev, bp); len(moves) > 0 {
+			logging.Info("Modules were moved between deployment groups, move their state following %s before deploying", InstructionsPath(deploymentDir))
+			writeMoveInstructions(instructions, moves, bp, deploymentDir)
+		}
+	}
 	writeDestroyInstructions(instructions, bp, deploymentDir)
 
-	if err := writeExpandedBlueprint(deploymentDir, bp); err != nil {
+	for _, writer := range kinds {
+		if err := writer.restoreState(bp, deploymentDir); err != nil {
+			return fmt.Errorf("error trying to restore terraform state: %w", err)
+		}
+	}
+	if err := writeLockFiles(bp, deploymentDir); err != nil {
 		return err
 	}
 
-	for _, writer := range kinds {
-		if err := writer.restoreState(deploymentDir); err != nil {
-			return fmt.Errorf("error trying to restore terraform state: %w", err)
+	m := NewManifest(bp)
+	if prevErr == nil {
+		removed = append(removed, removedGroupDirs(prev, bp)...)
+	}
+	for _, d := range removed {
+		if !slices.Contains(groupDirNames(bp), d) && !slices.Contains(m.RemovedGroups, d) {
+			m.RemovedGroups = append(m.RemovedGroups, d)
 		}
 	}
-	return nil
+	return finishManifest(deploymentDir, bp, m, prevManifest.Files)
+}
+
+// finishManifest lists files the deployment was written with in the manifest,
+// prunes files of the previous manifest that were not written again, then
+// writes the manifest with the expanded blueprint
+func finishManifest(deploymentDir string, bp config.Blueprint, m Manifest, prevFiles []ManifestFile) error {
+	var err error
+	if m.Files, err = writtenFiles(bp, deploymentDir); err != nil {
+		return err
+	}
+	if err := pruneStaleFiles(deploymentDir, prevFiles, m.Files); err != nil {
+		return err
+	}
+	warnOversizedFiles(m.Files)
+	return writeExpandedBlueprint(deploymentDir, bp, m)
+}
+
+// AdoptDeployment writes toolkit metadata to a deployment directory that was
+// not written by this version of the toolkit, e.g. produced by an older version
+// or modified by hand. Deployment groups are left untouched; every group of the
+// blueprint must already have a directory in the deployment.
+func AdoptDeployment(bp config.Blueprint, deploymentDir string) error {
+	if _, err := os.Stat(filepath.Join(ArtifactsDir(deploymentDir), ExpandedBlueprintName)); err == nil {
+		return fmt.Errorf("%s is already a GHPC deployment folder, use `ghpc create -w` to update it", deploymentDir)
+	}
+
+	missing := []string{}
+	for _, g := range bp.DeploymentGroups {
+		if _, err := os.Stat(GroupDir(deploymentDir, bp, g.Name)); err != nil {
+			missing = append(missing, string(g.Name))
+		}
+	}
+	if len(missing) > 0 {
+		return config.HintError{
+			Err:  fmt.Errorf("deployment groups %q do not have a directory in %s", missing, deploymentDir),
+			Hint: "ensure that deployment_name, group names and deployment_layout of the blueprint match the existing deployment"}
+	}
+
+	ghpcDir := filepath.Join(deploymentDir, bp.DeploymentLayout.GhpcDirName())
+	if err := os.MkdirAll(filepath.Join(ghpcDir, prevDeploymentGroupDirName), 0755); err != nil {
+		return fmt.Errorf("failed to create directory at %s: %w", ghpcDir, err)
+	}
+	gitignoreFile := filepath.Join(deploymentDir, ".gitignore")
+	if _, err := os.Stat(gitignoreFile); os.IsNotExist(err) {
+		if err := deploymentio.GetDeploymentioLocal().CopyFromFS(templatesFS, gitignoreTemplate, gitignoreFile); err != nil {
+			return fmt.Errorf("failed to copy template.gitignore file to %s: err=%w", gitignoreFile, err)
+		}
+	}
+	if err := prepArtifactsDir(filepath.Join(ghpcDir, ArtifactsDirName)); err != nil {
+		return err
+	}
+	return writeExpandedBlueprint(deploymentDir, bp, NewManifest(bp))
 }
 
 func writeGroup(deplPath string, bp config.Blueprint, gIdx int, instructions io.Writer) error {
 	g := bp.DeploymentGroups[gIdx]
-	gPath, err := createGroupDir(deplPath, g)
+	gPath, err := createGroupDir(GroupDir(deplPath, bp, g.Name), g)
 	if err != nil {
 		return err
 	}
@@ -117,24 +255,52 @@ func writeGroup(deplPath string, bp config.Blueprint, gIdx int, instructions io.
 		return err
 	}
 
-	writer, ok := kinds[g.Kind()]
-	if !ok {
-		return fmt.Errorf("invalid kind in deployment group %q, got %q", g.Name, g.Kind())
+	// groups mixing Packer and terraform modules are written by both writers,
+	// in the order their stages are deployed
+	for _, k := range stageKinds(g) {
+		writer, ok := kinds[k]
+		if !ok {
+			return fmt.Errorf("invalid kind in deployment group %q, got %q", g.Name, k)
+		}
+		if err := writer.writeDeploymentGroup(bp, gIdx, gPath, instructions); err != nil {
+			return fmt.Errorf("error writing deployment group %s: %w", g.Name, err)
+		}
 	}
-
-	if err := writer.writeDeploymentGroup(bp, gIdx, gPath, instructions); err != nil {
-		return fmt.Errorf("error writing deployment group %s: %w", g.Name, err)
+	if err := writeGroupReadme(bp, gIdx, deplPath, gPath); err != nil {
+		return fmt.Errorf("error writing %s file for deployment group %s: %w", GroupReadmeName, g.Name, err)
 	}
 	return nil
 }
 
+// stageKinds returns distinct kinds of the stages of the group, in order
+func stageKinds(g config.DeploymentGroup) []config.ModuleKind {
+	res := []config.ModuleKind{}
+	for _, s := range g.Stages() {
+		if !slices.Contains(res, s.Kind()) {
+			res = append(res, s.Kind())
+		}
+	}
+	return res
+}
+
+// modulesOfKind returns the group keeping only modules of the given kind
+func modulesOfKind(g config.DeploymentGroup, k config.ModuleKind) config.DeploymentGroup {
+	res := g
+	res.Modules = nil
+	for _, m := range g.Modules {
+		if m.Kind == k {
+			res.Modules = append(res.Modules, m)
+		}
+	}
+	return res
+}
+
 // InstructionsPath returns the path to the instructions file for a deployment
 func InstructionsPath(deploymentDir string) string {
 	return filepath.Join(deploymentDir, "instructions.txt")
 }
 
-func createGroupDir(deplPath string, g config.DeploymentGroup) (string, error) {
-	gPath := filepath.Join(deplPath, string(g.Name))
+func createGroupDir(gPath string, g config.DeploymentGroup) (string, error) {
 	// Create the deployment group directory if not already created.
 	if _, err := os.Stat(gPath); errors.Is(err, os.ErrNotExist) {
 		if err := os.Mkdir(gPath, 0755); err != nil {
@@ -263,57 +429,127 @@ func copyGroupSources(gPath string, g config.DeploymentGroup) error {
 	return nil
 }
 
-// Prepares a deployment directory to be written to.
-func prepDepDir(depDir string) error {
+// Prepares a deployment directory to be written to. Backups of previous
+// deployment groups are replaced, but for the kept ones.
+func prepDepDir(depDir string, bp config.Blueprint, keep ...string) error {
+	ghpcDirName := bp.DeploymentLayout.GhpcDirName()
+	ghpcDir := filepath.Join(depDir, ghpcDirName)
+	if err := createDepDir(depDir, ghpcDirName); err != nil {
+		return err
+	}
+
+	if err := prepArtifactsDir(filepath.Join(ghpcDir, ArtifactsDirName)); err != nil {
+		return err
+	}
+
+	// remove existing backups of deployment groups
+	prevGroupDir := filepath.Join(ghpcDir, prevDeploymentGroupDirName)
+	if err := removeBackups(prevGroupDir, keep); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(prevGroupDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory to save previous deployment groups at %s: %w", prevGroupDir, err)
+	}
+
+	// with flat layout the only deployment group occupies deployment directory
+	// itself, back it up under the name of the group
+	if bp.DeploymentLayout.Flat {
+		return backupFlatGroup(depDir, ghpcDirName, PrevGroupDir(depDir, bp, bp.DeploymentGroups[0].Name))
+	}
+	return backupGroupDirs(depDir, ghpcDirName, prevGroupDir)
+}
+
+// removeBackups removes backups of deployment groups but for the kept ones
+func removeBackups(prevGroupDir string, keep []string) error {
+	entries, err := os.ReadDir(prevGroupDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if slices.Contains(keep, e.Name()) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(prevGroupDir, e.Name())); err != nil {
+			return fmt.Errorf("failed to remove previous deployment group %s: %w", e.Name(), err)
+		}
+	}
+	return nil
+}
+
+// createDepDir creates the deployment directory, or confirms an existing one
+// was previously written by ghpc
+func createDepDir(depDir string, ghpcDirName string) error {
 	deploymentio := deploymentio.GetDeploymentioLocal()
-	ghpcDir := HiddenGhpcDir(depDir)
+	ghpcDir := filepath.Join(depDir, ghpcDirName)
 
-	// create deployment directory
 	if err := deploymentio.CreateDirectory(depDir); err != nil {
 		// Confirm we have a previously written deployment dir before overwriting.
-		if _, err := os.Stat(ghpcDir); os.IsNotExist(err) {
-			return fmt.Errorf("while trying to update the deployment directory at %s, the '.ghpc/' dir could not be found", depDir)
-		}
-	} else {
-		if err := deploymentio.CreateDirectory(ghpcDir); err != nil {
-			return fmt.Errorf("failed to create directory at %s: err=%w", ghpcDir, err)
+		prevGhpcDir := HiddenGhpcDir(depDir)
+		if _, err := os.Stat(prevGhpcDir); os.IsNotExist(err) {
+			return fmt.Errorf("while trying to update the deployment directory at %s, the '%s/' dir could not be found", depDir, ghpcDirName)
 		}
-
-		gitignoreFile := filepath.Join(depDir, ".gitignore")
-		if err := deploymentio.CopyFromFS(templatesFS, gitignoreTemplate, gitignoreFile); err != nil {
-			return fmt.Errorf("failed to copy template.gitignore file to %s: err=%w", gitignoreFile, err)
+		// ghpc_dir was changed in the blueprint, keep the content of the old one
+		if prevGhpcDir != ghpcDir {
+			if err := os.Rename(prevGhpcDir, ghpcDir); err != nil {
+				return fmt.Errorf("failed to move %s to %s: %w", prevGhpcDir, ghpcDir, err)
+			}
 		}
+		return nil
 	}
 
-	if err := prepArtifactsDir(ArtifactsDir(depDir)); err != nil {
-		return err
+	if err := deploymentio.CreateDirectory(ghpcDir); err != nil {
+		return fmt.Errorf("failed to create directory at %s: err=%w", ghpcDir, err)
 	}
-
-	// remove any existing backups of deployment group
-	prevGroupDir := filepath.Join(ghpcDir, prevDeploymentGroupDirName)
-	os.RemoveAll(prevGroupDir)
-	if err := os.MkdirAll(prevGroupDir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory to save previous deployment groups at %s: %w", prevGroupDir, err)
+	gitignoreFile := filepath.Join(depDir, ".gitignore")
+	if err := deploymentio.CopyFromFS(templatesFS, gitignoreTemplate, gitignoreFile); err != nil {
+		return fmt.Errorf("failed to copy template.gitignore file to %s: err=%w", gitignoreFile, err)
 	}
+	return nil
+}
 
-	// create new backup of deployment group directory
+// backupGroupDirs moves directories of deployment groups to dest
+func backupGroupDirs(depDir string, ghpcDirName string, dest string) error {
 	files, err := os.ReadDir(depDir)
 	if err != nil {
 		return fmt.Errorf("error trying to read directories in %s, %w", depDir, err)
 	}
 	for _, f := range files {
-		if !f.IsDir() || f.Name() == HiddenGhpcDirName {
+		if !f.IsDir() || f.Name() == ghpcDirName {
 			continue
 		}
 		src := filepath.Join(depDir, f.Name())
-		dest := filepath.Join(prevGroupDir, f.Name())
-		if err := os.Rename(src, dest); err != nil {
+		if err := os.Rename(src, filepath.Join(dest, f.Name())); err != nil {
 			return fmt.Errorf("error while moving previous deployment groups: failed on %s: %w", f.Name(), err)
 		}
 	}
 	return nil
 }
 
+// backupFlatGroup moves everything but toolkit files of the deployment to dest
+func backupFlatGroup(depDir string, ghpcDirName string, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("failed to create directory to save previous deployment group at %s: %w", dest, err)
+	}
+	files, err := os.ReadDir(depDir)
+	if err != nil {
+		return fmt.Errorf("error trying to read directories in %s, %w", depDir, err)
+	}
+	keep := []string{ghpcDirName, ".gitignore", filepath.Base(InstructionsPath(depDir))}
+	for _, f := range files {
+		if slices.Contains(keep, f.Name()) {
+			continue
+		}
+		src := filepath.Join(depDir, f.Name())
+		if err := os.Rename(src, filepath.Join(dest, f.Name())); err != nil {
+			return fmt.Errorf("error while moving previous deployment group: failed on %s: %w", f.Name(), err)
+		}
+	}
+	return nil
+}
+
 func prepArtifactsDir(artifactsDir string) error {
 	// cleanup previous artifacts on every write
 	if err := os.RemoveAll(artifactsDir); err != nil {
@@ -336,8 +572,104 @@ func prepArtifactsDir(artifactsDir string) error {
 	return err
 }
 
-func writeExpandedBlueprint(depDir string, bp config.Blueprint) error {
-	return bp.Export(filepath.Join(ArtifactsDir(depDir), ExpandedBlueprintName))
+func writeExpandedBlueprint(depDir string, bp config.Blueprint, m Manifest) error {
+	artifactsDir := filepath.Join(depDir, bp.DeploymentLayout.GhpcDirName(), ArtifactsDirName)
+	if err := writeManifest(artifactsDir, m); err != nil {
+		return err
+	}
+	if err := bp.Export(filepath.Join(artifactsDir, ExpandedBlueprintName)); err != nil {
+		return err
+	}
+	if err := writeInventory(artifactsDir, bp); err != nil {
+		return err
+	}
+	return bp.ExportResolved(filepath.Join(artifactsDir, ResolvedBlueprintName))
+}
+
+// groupDirNames returns directories of groups of the deployment
+func groupDirNames(bp config.Blueprint) []string {
+	res := []string{}
+	for _, g := range bp.DeploymentGroups {
+		res = append(res, bp.GroupDirName(g.Name))
+	}
+	return res
+}
+
+// removedGroupDirs returns directories of groups of the previous deployment
+// that are not written by the current one
+func removedGroupDirs(prev config.Blueprint, bp config.Blueprint) []string {
+	if prev.DeploymentLayout.Flat || bp.DeploymentLayout.Flat {
+		return nil
+	}
+	current := map[string]bool{}
+	for _, g := range bp.DeploymentGroups {
+		current[bp.GroupDirName(g.Name)] = true
+	}
+	removed := []string{}
+	for _, g := range prev.DeploymentGroups {
+		if d := prev.GroupDirName(g.Name); !current[d] {
+			removed = append(removed, d)
+		}
+	}
+	return removed
+}
+
+// ModuleMove is a module that was moved to another deployment group
+type ModuleMove struct {
+	ID        config.ModuleID // ID of the module in the previous deployment
+	FromGroup config.GroupName
+	ToGroup   config.GroupName
+}
+
+// CrossGroupMoves returns modules that were moved between deployment groups
+// since the previous deployment, modules are matched by renamed_from or by ID
+func CrossGroupMoves(prev config.Blueprint, bp config.Blueprint) []ModuleMove {
+	prevGroups := map[config.ModuleID]config.GroupName{}
+	for _, g := range prev.DeploymentGroups {
+		for _, m := range g.Modules {
+			prevGroups[m.ID] = g.Name
+		}
+	}
+
+	moves := []ModuleMove{}
+	for _, g := range bp.DeploymentGroups {
+		for _, m := range g.Modules {
+			id := m.ID
+			if m.RenamedFrom != "" {
+				id = m.RenamedFrom
+			}
+			if from, ok := prevGroups[id]; ok && from != g.Name && m.Kind == config.TerraformKind {
+				moves = append(moves, ModuleMove{ID: id, FromGroup: from, ToGroup: g.Name})
+			}
+		}
+	}
+	return moves
+}
+
+// writeMoveInstructions explains how to transfer state of modules moved
+// between deployment groups, as terraform can not move resources across states
+func writeMoveInstructions(w io.Writer, moves []ModuleMove, bp config.Blueprint, deploymentDir string) {
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Moving modules between deployment groups")
+	fmt.Fprintln(w, "========================================")
+	fmt.Fprintln(w, "Run the following commands before deploying, otherwise resources of moved")
+	fmt.Fprintln(w, "modules are destroyed and recreated:")
+	for _, mv := range moves {
+		from := GroupDir(deploymentDir, bp, mv.FromGroup)
+		to := GroupDir(deploymentDir, bp, mv.ToGroup)
+		fromState := fmt.Sprintf("%s.tfstate", mv.FromGroup)
+		toState := fmt.Sprintf("%s.tfstate", mv.ToGroup)
+		addr := fmt.Sprintf("module.%s", mv.ID)
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "# module %q moved from group %q to %q\n", mv.ID, mv.FromGroup, mv.ToGroup)
+		fmt.Fprintf(w, "terraform -chdir=%s init\n", from)
+		fmt.Fprintf(w, "terraform -chdir=%s init\n", to)
+		fmt.Fprintf(w, "terraform -chdir=%s state pull > %s\n", from, fromState)
+		fmt.Fprintf(w, "terraform -chdir=%s state pull > %s\n", to, toState)
+		fmt.Fprintf(w, "terraform state mv -state=%s -state-out=%s %s %s\n", fromState, toState, addr, addr)
+		fmt.Fprintf(w, "terraform -chdir=%s state push - < %s\n", to, toState)
+		fmt.Fprintf(w, "terraform -chdir=%s state push - < %s\n", from, fromState)
+	}
 }
 
 func writeDestroyInstructions(w io.Writer, bp config.Blueprint, deploymentDir string) {
@@ -357,12 +689,12 @@ func writeDestroyInstructions(w io.Writer, bp config.Blueprint, deploymentDir st
 	fmt.Fprintln(w)
 	for grpIdx := len(bp.DeploymentGroups) - 1; grpIdx >= 0; grpIdx-- {
 		grp := bp.DeploymentGroups[grpIdx]
-		grpPath := filepath.Join(deploymentDir, string(grp.Name))
+		grpPath := GroupDir(deploymentDir, bp, grp.Name)
 		if grp.Kind() == config.TerraformKind {
 			fmt.Fprintf(w, "terraform -chdir=%s destroy\n", grpPath)
 		}
-		if grp.Kind() == config.PackerKind {
-			packerManifests = append(packerManifests, filepath.Join(grpPath, string(grp.Modules[0].ID), "packer-manifest.json"))
+		for _, mod := range modulesOfKind(grp, config.PackerKind).Modules {
+			packerManifests = append(packerManifests, filepath.Join(grpPath, string(mod.ID), "packer-manifest.json"))
 		}
 	}
 
@@ -17,12 +17,14 @@ limitations under the License.
 package modulewriter
 
 import (
+	"bytes"
 	"fmt"
 	"hpc-toolkit/pkg/config"
 	"hpc-toolkit/pkg/deploymentio"
 	"hpc-toolkit/pkg/modulereader"
 	"hpc-toolkit/pkg/sourcereader"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -34,6 +36,7 @@ import (
 	"github.com/zclconf/go-cty/cty"
 
 	. "gopkg.in/check.v1"
+	"gopkg.in/yaml.v3"
 )
 
 type MySuite struct {
@@ -127,11 +130,11 @@ func (s *MySuite) TestPrepDepDir(c *C) {
 	depDir := filepath.Join(s.testDir, "dep_prep_test_dir")
 
 	// Prep a dir that does not yet exist
-	c.Check(prepDepDir(depDir), IsNil)
+	c.Check(prepDepDir(depDir, config.Blueprint{}), IsNil)
 	c.Check(isDeploymentDirPrepped(depDir), IsNil)
 
 	// Prep of existing dir succeeds
-	c.Check(prepDepDir(depDir), IsNil)
+	c.Check(prepDepDir(depDir, config.Blueprint{}), IsNil)
 	c.Check(isDeploymentDirPrepped(depDir), IsNil)
 }
 
@@ -148,7 +151,7 @@ func (s *MySuite) TestPrepDepDir_OverwriteRealDep(c *C) {
 	files, _ := os.ReadDir(depDir)
 	c.Check(len(files) > 1, Equals, true)
 
-	err := prepDepDir(depDir)
+	err := prepDepDir(depDir, bp)
 	c.Check(err, IsNil)
 	c.Check(isDeploymentDirPrepped(depDir), IsNil)
 
@@ -161,6 +164,27 @@ func (s *MySuite) TestPrepDepDir_OverwriteRealDep(c *C) {
 	c.Check(files2, HasLen, 3) // .ghpc, .gitignore, and instructions file
 }
 
+func (s *MySuite) TestWriteDeploymentKeepsRemovedGroups(c *C) {
+	bp := s.getBlueprintForTest()
+	depDir := filepath.Join(c.MkDir(), "dep")
+	c.Assert(WriteDeployment(bp, depDir), IsNil)
+
+	// group removed by an earlier overwrite, not destroyed yet
+	gone := filepath.Join(PrevDeploymentGroupsDir(depDir), "gone")
+	c.Assert(os.MkdirAll(gone, 0755), IsNil)
+	m, err := ReadManifest(ArtifactsDir(depDir))
+	c.Assert(err, IsNil)
+	m.RemovedGroups = []string{"gone", "destroyed"}
+	c.Assert(writeManifest(ArtifactsDir(depDir), m), IsNil)
+
+	c.Assert(WriteDeployment(bp, depDir), IsNil)
+	c.Check(pathExists(gone), Equals, true)
+	c.Check(pathExists(filepath.Join(PrevDeploymentGroupsDir(depDir), "test_resource_group")), Equals, true)
+	m, err = ReadManifest(ArtifactsDir(depDir))
+	c.Assert(err, IsNil)
+	c.Check(m.RemovedGroups, DeepEquals, []string{"gone"})
+}
+
 // modulewriter.go
 func (s *MySuite) TestWriteDeployment(c *C) {
 	aferoFS := afero.NewMemMapFs()
@@ -178,11 +202,223 @@ func (s *MySuite) TestWriteDeployment(c *C) {
 	c.Check(WriteDeployment(bp, dir), IsNil)
 }
 
+func (s *MySuite) TestWriteDeployment_MixedGroup(c *C) {
+	bp := s.getBlueprintForTest()
+	image := config.Module{
+		Source:   s.terraformModuleDir,
+		Kind:     config.PackerKind,
+		ID:       "image",
+		Settings: config.NewDict(map[string]cty.Value{"zebra": cty.StringVal("checker")}),
+	}
+	g := &bp.DeploymentGroups[0]
+	g.Modules = append(g.Modules, image)
+	dir := filepath.Join(s.testDir, "test_write_deployment_mixed")
+	c.Assert(WriteDeployment(bp, dir), IsNil)
+
+	gDir := filepath.Join(dir, string(g.Name))
+	c.Check(pathExists(filepath.Join(gDir, "main.tf")), Equals, true)
+	c.Check(pathExists(filepath.Join(gDir, "image", packerAutoVarFilename)), Equals, true)
+	// Packer module is not part of the terraform root module
+	exists, err := stringExistsInFile("module \"image\"", filepath.Join(gDir, "main.tf"))
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, false)
+
+	instructions, err := os.ReadFile(InstructionsPath(dir))
+	c.Assert(err, IsNil)
+	c.Check(strings.Index(string(instructions), "packer build") < strings.Index(string(instructions), "terraform -chdir"), Equals, true)
+	c.Check(string(instructions), Matches, "(?s).*"+filepath.Join(gDir, "image", "packer-manifest.json")+".*")
+}
+
+func (s *MySuite) TestWriteDeployment_Files(c *C) {
+	bp := s.getBlueprintForTest()
+	dir := filepath.Join(s.testDir, "test_write_deployment_files")
+	c.Assert(WriteDeployment(bp, dir), IsNil)
+
+	m, err := ReadManifest(ArtifactsDir(dir))
+	c.Assert(err, IsNil)
+	paths := map[string]bool{}
+	for _, f := range m.Files {
+		paths[f.Path] = f.Dir
+	}
+	src, err := DeploymentSource(bp.DeploymentGroups[0].Modules[0])
+	c.Assert(err, IsNil)
+	c.Check(paths, DeepEquals, map[string]bool{
+		".gitignore":                                      false,
+		"instructions.txt":                                false,
+		"test_resource_group/README.md":                   false,
+		"test_resource_group/main.tf":                     false,
+		"test_resource_group/outputs.tf":                  false,
+		"test_resource_group/providers.tf":                false,
+		"test_resource_group/terraform.tfvars":            false,
+		"test_resource_group/variables.tf":                false,
+		"test_resource_group/versions.tf":                 false,
+		path.Join("test_resource_group", path.Clean(src)): true,
+	})
+}
+
+func (s *zeroSuite) TestPruneStaleFiles(c *C) {
+	dir := c.MkDir()
+	for _, f := range []string{"stale.txt", "kept.txt", "user.txt"} {
+		c.Assert(os.WriteFile(filepath.Join(dir, f), []byte("x"), 0644), IsNil)
+	}
+	c.Assert(os.MkdirAll(filepath.Join(dir, "modules", "stale"), 0755), IsNil)
+	outside := filepath.Join(filepath.Dir(dir), "outside.txt")
+	c.Assert(os.WriteFile(outside, []byte("x"), 0644), IsNil)
+
+	prev := []ManifestFile{{Path: "stale.txt"}, {Path: "kept.txt"}, {Path: "modules/stale", Dir: true}, {Path: "../outside.txt"}, {Path: "gone.txt"}}
+	cur := []ManifestFile{{Path: "kept.txt"}}
+	c.Assert(pruneStaleFiles(dir, prev, cur), IsNil)
+
+	c.Check(pathExists(filepath.Join(dir, "stale.txt")), Equals, false)
+	c.Check(pathExists(filepath.Join(dir, "modules", "stale")), Equals, false)
+	c.Check(pathExists(filepath.Join(dir, "kept.txt")), Equals, true)
+	c.Check(pathExists(filepath.Join(dir, "user.txt")), Equals, true)
+	c.Check(pathExists(outside), Equals, true)
+}
+
+func pathExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+func (s *MySuite) TestWriteDeployment_Layout(c *C) {
+	bp := s.getBlueprintForTest()
+
+	{ // numbered and prefixed groups, custom toolkit directory
+		dir := filepath.Join(s.testDir, "test_layout_grouped")
+		bp.DeploymentLayout = config.DeploymentLayout{GroupPrefix: "tf-", NumberGroups: true, GhpcDir: "toolkit"}
+		c.Assert(WriteDeployment(bp, dir), IsNil)
+		c.Check(pathExists(filepath.Join(dir, "01-tf-test_resource_group", "main.tf")), Equals, true)
+		c.Check(pathExists(filepath.Join(dir, "toolkit", ArtifactsDirName, ExpandedBlueprintName)), Equals, true)
+		c.Check(HiddenGhpcDir(dir), Equals, filepath.Join(dir, "toolkit"))
+
+		// toolkit directory is moved if changed
+		bp.DeploymentLayout.GhpcDir = ""
+		c.Assert(WriteDeployment(bp, dir), IsNil)
+		c.Check(HiddenGhpcDir(dir), Equals, filepath.Join(dir, HiddenGhpcDirName))
+		_, err := os.Stat(filepath.Join(dir, "toolkit"))
+		c.Check(os.IsNotExist(err), Equals, true)
+	}
+
+	{ // flat
+		dir := filepath.Join(s.testDir, "test_layout_flat")
+		bp.DeploymentLayout = config.DeploymentLayout{Flat: true}
+		c.Assert(WriteDeployment(bp, dir), IsNil)
+		c.Check(pathExists(filepath.Join(dir, "main.tf")), Equals, true)
+		c.Assert(os.WriteFile(filepath.Join(dir, tfStateFileName), []byte("{}"), 0644), IsNil)
+
+		// state is restored after overwrite
+		c.Assert(WriteDeployment(bp, dir), IsNil)
+		c.Check(pathExists(filepath.Join(dir, "main.tf")), Equals, true)
+		c.Check(pathExists(filepath.Join(dir, tfStateFileName)), Equals, true)
+		c.Check(pathExists(filepath.Join(PrevDeploymentGroupsDir(dir), "test_resource_group", "main.tf")), Equals, true)
+	}
+}
+
+func (s *MySuite) TestDeploymentGroupOfDir(c *C) {
+	bp := config.Blueprint{DeploymentGroups: []config.DeploymentGroup{{Name: "zero"}, {Name: "one"}}}
+
+	{ // grouped
+		g, root, err := DeploymentGroupOfDir(bp, "/depl/one/")
+		c.Check(err, IsNil)
+		c.Check(g.Name, Equals, config.GroupName("one"))
+		c.Check(root, Equals, "/depl")
+	}
+
+	{ // numbered
+		bp.DeploymentLayout = config.DeploymentLayout{NumberGroups: true}
+		g, root, err := DeploymentGroupOfDir(bp, "/depl/02-one")
+		c.Check(err, IsNil)
+		c.Check(g.Name, Equals, config.GroupName("one"))
+		c.Check(root, Equals, "/depl")
+
+		_, _, err = DeploymentGroupOfDir(bp, "/depl/one")
+		c.Check(err, NotNil)
+	}
+
+	{ // flat
+		bp := config.Blueprint{
+			DeploymentGroups: []config.DeploymentGroup{{Name: "zero"}},
+			DeploymentLayout: config.DeploymentLayout{Flat: true}}
+		g, root, err := DeploymentGroupOfDir(bp, "/depl")
+		c.Check(err, IsNil)
+		c.Check(g.Name, Equals, config.GroupName("zero"))
+		c.Check(root, Equals, "/depl")
+	}
+}
+
+func (s *MySuite) TestCheckManifest(c *C) {
+	dir := c.MkDir()
+	write := func(m Manifest) {
+		b, err := yaml.Marshal(m)
+		c.Assert(err, IsNil)
+		c.Assert(os.WriteFile(filepath.Join(dir, ManifestName), b, 0644), IsNil)
+	}
+
+	// no manifest, deployment predates it
+	c.Check(CheckManifest(dir), IsNil)
+
+	bp := s.getBlueprintForTest()
+	c.Assert(writeManifest(dir, NewManifest(bp)), IsNil)
+	c.Check(CheckManifest(dir), IsNil)
+
+	write(Manifest{SchemaVersion: ManifestSchemaVersion + 1, GhpcVersion: "v9.9.9"})
+	c.Check(CheckManifest(dir), ErrorMatches, ".*format version.*not supported.*v9.9.9.*")
+
+	write(Manifest{SchemaVersion: ManifestSchemaVersion, Features: []string{FeatureLayout, "teleportation"}})
+	c.Check(CheckManifest(dir), ErrorMatches, ".*not supported by this ghpc: teleportation.*")
+}
+
+func (s *MySuite) TestUsedFeatures(c *C) {
+	bp := s.getBlueprintForTest()
+	c.Check(usedFeatures(bp), DeepEquals, []string{})
+
+	bp.DeploymentLayout.GroupPrefix = "tf-"
+	bp.DeploymentGroups[0].Modules[0].Outputs = append(bp.DeploymentGroups[0].Modules[0].Outputs,
+		modulereader.OutputInfo{Name: "id", Value: "$(testModule.instance.id)"})
+	c.Check(usedFeatures(bp), DeepEquals, []string{FeatureLayout, FeatureCustomOutputs})
+
+	bp.DeploymentGroups[0].Modules[0].StartupScriptParts = []config.StartupScriptPart{{Content: "echo hi"}}
+	c.Check(usedFeatures(bp), DeepEquals, []string{FeatureLayout, FeatureCustomOutputs, FeatureStartupScript})
+
+	bp.DeploymentGroups[0].Modules[0].RenamedFrom = "oldModule"
+	c.Check(usedFeatures(bp), DeepEquals, []string{FeatureLayout, FeatureCustomOutputs, FeatureStartupScript, FeatureRenamedFrom})
+
+	bp.TerraformProviders.NetworkMirror = "https://mirror.example.com/"
+	c.Check(usedFeatures(bp), DeepEquals, []string{FeatureLayout, FeatureNetMirror, FeatureCustomOutputs, FeatureStartupScript, FeatureRenamedFrom})
+
+	bp.DeploymentGroups[0].Modules[0].Import = config.NewDict(map[string]cty.Value{"google_storage_bucket.bucket": cty.StringVal("data")})
+	c.Check(usedFeatures(bp), DeepEquals, []string{FeatureLayout, FeatureNetMirror, FeatureCustomOutputs, FeatureStartupScript, FeatureRenamedFrom, FeatureImport})
+
+	bp.DeploymentGroups[0].TerraformBackend = config.TerraformBackend{Type: config.LocalEncryptedBackend}
+	c.Check(usedFeatures(bp), DeepEquals, []string{FeatureLayout, FeatureNetMirror, FeatureEncryptedState, FeatureCustomOutputs, FeatureStartupScript, FeatureRenamedFrom, FeatureImport})
+
+	bp.DeploymentGroups[0].TerraformBackend = config.TerraformBackend{Type: "gcs", StateAccess: config.StateAccess{ImpersonateServiceAccount: "state@central.iam.gserviceaccount.com"}}
+	c.Check(usedFeatures(bp), DeepEquals, []string{FeatureLayout, FeatureNetMirror, FeatureStateAccess, FeatureCustomOutputs, FeatureStartupScript, FeatureRenamedFrom, FeatureImport})
+
+	bp.ZonePolicy = map[string]config.ZonePolicy{"zone": {Zones: []string{"us-central1-a"}}}
+	c.Check(usedFeatures(bp), DeepEquals, []string{FeatureLayout, FeatureNetMirror, FeatureZonePolicy, FeatureStateAccess, FeatureCustomOutputs, FeatureStartupScript, FeatureRenamedFrom, FeatureImport})
+
+	bp.ArtifactsEncryption = config.ArtifactsEncryption{KmsKey: "projects/p/locations/global/keyRings/r/cryptoKeys/k"}
+	c.Check(usedFeatures(bp), DeepEquals, []string{FeatureLayout, FeatureNetMirror, FeatureZonePolicy, FeatureArtifactsEncryption, FeatureStateAccess, FeatureCustomOutputs, FeatureStartupScript, FeatureRenamedFrom, FeatureImport})
+
+	bp.DeploymentGroups[0].Modules = append(bp.DeploymentGroups[0].Modules, config.Module{ID: "image", Kind: config.PackerKind})
+	c.Check(usedFeatures(bp), DeepEquals, []string{FeatureLayout, FeatureNetMirror, FeatureZonePolicy, FeatureArtifactsEncryption, FeatureStateAccess, FeatureMixedGroups, FeatureCustomOutputs, FeatureStartupScript, FeatureRenamedFrom, FeatureImport})
+
+	bp = s.getBlueprintForTest()
+	bp.Credentials = []config.Credentials{{Provider: "gcp"}}
+	bp.HealthChecks = []config.HealthCheck{{Name: "ping"}}
+	bp.DeploymentGroups[0].Bootstrap = true
+	bp.DeploymentGroups[0].PostDeploy = []config.RemoteCommand{{Command: "true"}}
+	bp.DeploymentGroups[0].Modules[0].Settings.Set("subnet", config.ModuleRef("runtime", "subnet").AsValue())
+	c.Check(usedFeatures(bp), DeepEquals, []string{FeatureCredentials, FeatureHealthChecks, FeatureRuntimeValues, FeaturePostDeploy, FeatureBootstrap})
+}
+
 func (s *MySuite) TestCreateGroupDir(c *C) {
 	deplDir := c.MkDir()
 
 	{ // Ok
-		got, err := createGroupDir(deplDir, config.DeploymentGroup{Name: "ukulele"})
+		got, err := createGroupDir(filepath.Join(deplDir, "ukulele"), config.DeploymentGroup{Name: "ukulele"})
 		c.Check(err, IsNil)
 		c.Check(got, Equals, filepath.Join(deplDir, "ukulele"))
 		stat, err := os.Stat(got)
@@ -193,7 +429,7 @@ func (s *MySuite) TestCreateGroupDir(c *C) {
 	{ // Dir already exists
 		dir := filepath.Join(deplDir, "guitar")
 		c.Assert(os.Mkdir(dir, 0755), IsNil)
-		got, err := createGroupDir(deplDir, config.DeploymentGroup{Name: "guitar"})
+		got, err := createGroupDir(dir, config.DeploymentGroup{Name: "guitar"})
 		c.Check(err, IsNil)
 		c.Check(got, Equals, dir)
 	}
@@ -215,15 +451,19 @@ func (s *MySuite) TestRestoreTfState(c *C) {
 	curDeploymentGroup := filepath.Join(depDir, deploymentGroupName)
 	prevStateFile := filepath.Join(prevDeploymentGroup, tfStateFileName)
 	prevBuStateFile := filepath.Join(prevDeploymentGroup, tfStateBackupFileName)
+	prevLockFile := filepath.Join(prevDeploymentGroup, tfLockFileName)
 	os.MkdirAll(prevDeploymentGroup, 0755)
 	os.MkdirAll(curDeploymentGroup, 0755)
 	emptyFile, _ := os.Create(prevStateFile)
 	emptyFile.Close()
 	emptyFile, _ = os.Create(prevBuStateFile)
 	emptyFile.Close()
+	emptyFile, _ = os.Create(prevLockFile)
+	emptyFile.Close()
 
 	testWriter := TFWriter{}
-	testWriter.restoreState(depDir)
+	bp := config.Blueprint{DeploymentGroups: []config.DeploymentGroup{{Name: config.GroupName(deploymentGroupName)}}}
+	testWriter.restoreState(bp, depDir)
 
 	// check state file was moved to current resource group dir
 	curStateFile := filepath.Join(curDeploymentGroup, tfStateFileName)
@@ -232,6 +472,55 @@ func (s *MySuite) TestRestoreTfState(c *C) {
 	c.Check(err, IsNil)
 	_, err = os.Stat(curBuStateFile)
 	c.Check(err, IsNil)
+	_, err = os.Stat(filepath.Join(curDeploymentGroup, tfLockFileName))
+	c.Check(err, IsNil)
+}
+
+func (s *MySuite) TestWriteCLIConfig(c *C) {
+	dir := c.MkDir()
+
+	{ // no mirror, no config
+		c.Assert(writeCLIConfig(config.TerraformProviders{}, dir), IsNil)
+		_, ok := CLIConfigFile(dir)
+		c.Check(ok, Equals, false)
+		_, ok, err := TerraformEnv(dir)
+		c.Assert(err, IsNil)
+		c.Check(ok, Equals, false)
+	}
+
+	{ // mirror
+		c.Assert(writeCLIConfig(config.TerraformProviders{NetworkMirror: "https://mirror.example.com/tf/"}, dir), IsNil)
+		p, ok := CLIConfigFile(dir)
+		c.Assert(ok, Equals, true)
+		c.Check(p, Equals, filepath.Join(dir, CLIConfigFileName))
+		b, err := os.ReadFile(p)
+		c.Assert(err, IsNil)
+		c.Check(string(b), Matches, `(?s).*provider_installation \{\s*network_mirror \{\s*url = "https://mirror.example.com/tf/".*`)
+
+		env, ok, err := TerraformEnv(dir)
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, true)
+		c.Check(env["TF_CLI_CONFIG_FILE"], Equals, p)
+	}
+}
+
+func (s *MySuite) TestWriteLockFiles(c *C) {
+	locked := []string{}
+	orig := lockProviders
+	lockProviders = func(groupDir string, tp config.TerraformProviders) error {
+		c.Check(tp.LockPlatforms, DeepEquals, []string{"linux_amd64", "darwin_arm64"})
+		locked = append(locked, filepath.Base(groupDir))
+		return nil
+	}
+	defer func() { lockProviders = orig }()
+
+	bp := s.getBlueprintForTest()
+	c.Assert(writeLockFiles(bp, "dep"), IsNil)
+	c.Check(locked, HasLen, 0) // not configured
+
+	bp.TerraformProviders.LockPlatforms = []string{"linux_amd64", "darwin_arm64"}
+	c.Assert(writeLockFiles(bp, "dep"), IsNil)
+	c.Check(locked, DeepEquals, []string{string(bp.DeploymentGroups[0].Name)})
 }
 
 func TestGetTypeTokensRelaxed(t *testing.T) {
@@ -341,6 +630,54 @@ func (s *MySuite) TestWriteMain(c *C) {
 	exists, err = stringExistsInFile("a_bucket", mainFilePath)
 	c.Assert(err, IsNil)
 	c.Assert(exists, Equals, true)
+
+	// Test with local-encrypted backend, state is local
+	encBackend := config.TerraformBackend{Type: config.LocalEncryptedBackend}
+	encBackend.Configuration.Set("passphrase_env", cty.StringVal("STATE_PASSPHRASE"))
+	c.Assert(writeMain(testModules, encBackend, testMainDir), IsNil)
+	exists, err = stringExistsInFile("backend", mainFilePath)
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, false)
+
+	// Test with renamed module
+	testModules[0].RenamedFrom = "old_module"
+	c.Assert(writeMain(testModules, testBackend, testMainDir), IsNil)
+	b, err := os.ReadFile(mainFilePath)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Matches, `(?s).*moved {\s*from = module.old_module\s*to\s*= module.test_module\s*}.*`)
+
+	// Test with imported resources
+	c.Check(requiredTerraformVersion(testModules), Equals, ">= 1.2")
+	testModules[0].Import = config.NewDict(map[string]cty.Value{
+		"google_storage_bucket.bucket": config.GlobalRef("bucket").AsValue()})
+	bp := config.Blueprint{Vars: config.NewDict(map[string]cty.Value{"bucket": cty.StringVal("hpc-data")})}
+	c.Check(requiredTerraformVersion(testModules), Equals, ">= 1.5")
+	imported, err := evalImports(bp, testModules)
+	c.Assert(err, IsNil)
+	c.Assert(writeMain(imported, testBackend, testMainDir), IsNil)
+	b, err = os.ReadFile(mainFilePath)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Matches, `(?s).*import {\s*to = module.test_module.google_storage_bucket.bucket\s*id = "hpc-data"\s*}.*`)
+}
+
+func (s *zeroSuite) TestCrossGroupMoves(c *C) {
+	mod := func(id config.ModuleID, from config.ModuleID) config.Module {
+		return config.Module{ID: id, Kind: config.TerraformKind, RenamedFrom: from}
+	}
+	prev := config.Blueprint{DeploymentGroups: []config.DeploymentGroup{
+		{Name: "net", Modules: []config.Module{mod("vpc", ""), mod("fs", "")}},
+		{Name: "cluster", Modules: []config.Module{mod("vm", "")}}}}
+
+	bp := config.Blueprint{DeploymentGroups: []config.DeploymentGroup{
+		{Name: "net", Modules: []config.Module{mod("network", "vpc")}},
+		{Name: "cluster", Modules: []config.Module{mod("homefs", "fs"), mod("vm", "")}}}}
+	c.Check(CrossGroupMoves(prev, bp), DeepEquals, []ModuleMove{
+		{ID: "fs", FromGroup: "net", ToGroup: "cluster"}})
+
+	var buf bytes.Buffer
+	writeMoveInstructions(&buf, CrossGroupMoves(prev, bp), bp, "depl")
+	c.Check(buf.String(), Matches, `(?s).*terraform state mv -state=net.tfstate -state-out=cluster.tfstate module.fs module.fs.*`)
+	c.Check(buf.String(), Matches, `(?s).*terraform -chdir=depl/cluster state push - < cluster.tfstate.*`)
 }
 
 func (s *MySuite) TestWriteOutputs(c *C) {
@@ -376,6 +713,21 @@ func (s *MySuite) TestWriteOutputs(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(exists, Equals, true)
 
+	// Success: Output with custom value
+	custom := modulereader.OutputInfo{Name: "first_id", Value: "$(testMod.instances[0].id)"}
+	customModules := []config.Module{{Outputs: []modulereader.OutputInfo{custom}, ID: "testMod"}}
+	err = writeOutputs(customModules, testOutputsDir)
+	c.Assert(err, IsNil)
+	exists, err = stringExistsInFile("module.testMod.instances[0].id", outputsFilePath)
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, true)
+
+	// Failure: Custom value is not an expression
+	custom.Value = "just a string"
+	customModules[0].Outputs[0] = custom
+	err = writeOutputs(customModules, testOutputsDir)
+	c.Assert(err, ErrorMatches, ".*must be an expression.*")
+
 	// Failure: Bad path
 	err = writeOutputs(testModules, "not/a/real/path")
 	c.Assert(err, ErrorMatches, ".*outputs.tf.*")
@@ -394,17 +746,17 @@ func (s *MySuite) TestWriteVariables(c *C) {
 
 	// Simple success, empty vars
 	testVars := make(map[string]cty.Value)
-	err := writeVariables(testVars, noIntergroupVars, testVarDir)
+	err := writeVariables(testVars, nil, noIntergroupVars, testVarDir)
 	c.Assert(err, IsNil)
 
 	// Failure: Bad path
-	err = writeVariables(testVars, noIntergroupVars, "not/a/real/path")
+	err = writeVariables(testVars, nil, noIntergroupVars, "not/a/real/path")
 	c.Assert(err, NotNil)
 
 	// Success, common vars
 	testVars["deployment_name"] = cty.StringVal("test_deployment")
 	testVars["project_id"] = cty.StringVal("test_project")
-	err = writeVariables(testVars, noIntergroupVars, testVarDir)
+	err = writeVariables(testVars, nil, noIntergroupVars, testVarDir)
 	c.Assert(err, IsNil)
 	exists, err := stringExistsInFile("\"deployment_name\"", varsFilePath)
 	c.Assert(err, IsNil)
@@ -413,8 +765,75 @@ func (s *MySuite) TestWriteVariables(c *C) {
 	// Success, "dynamic type"
 	testVars = make(map[string]cty.Value)
 	testVars["project_id"] = cty.NullVal(cty.DynamicPseudoType)
-	err = writeVariables(testVars, noIntergroupVars, testVarDir)
+	err = writeVariables(testVars, nil, noIntergroupVars, testVarDir)
+	c.Assert(err, IsNil)
+
+	// Success, secret variable
+	testVars = map[string]cty.Value{"license": cty.StringVal("s3cr3t")}
+	err = writeVariables(testVars, []string{"license"}, noIntergroupVars, testVarDir)
+	c.Assert(err, IsNil)
+	exists, err = stringExistsInFile("sensitive   = true", varsFilePath)
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, true)
+}
+
+func (s *MySuite) TestWriteTfvarsSecret(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "terraform.tfvars")
+	vars := map[string]cty.Value{"zone": cty.StringVal("us-central1-a")}
+
+	c.Assert(writeTfvars(vars, []string{"license"}, dir), IsNil)
+	info, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Check(info.Mode().Perm()&0077 != 0, Equals, true) // no secrets, default permissions
+
+	vars["license"] = cty.StringVal("s3cr3t")
+	c.Assert(writeTfvars(vars, []string{"license"}, dir), IsNil)
+	info, err = os.Stat(path)
 	c.Assert(err, IsNil)
+	c.Check(info.Mode().Perm(), Equals, os.FileMode(0600))
+}
+
+func (s *zeroSuite) TestGroupReadme(c *C) {
+	net := config.Module{ID: "net", Source: "modules/network/vpc", Kind: config.TerraformKind}
+	vm := config.Module{
+		ID:     "vm",
+		Source: "modules/compute/vm-instance",
+		Kind:   config.TerraformKind,
+		Settings: config.NewDict(map[string]cty.Value{
+			"network": config.ModuleRef("net", "network_self_link").AsValue(),
+			"license": config.GlobalRef("license").AsValue(),
+		})}
+	bp := config.Blueprint{
+		BlueprintName: "lime",
+		Vars: config.NewDict(map[string]cty.Value{
+			"deployment_name": cty.StringVal("green"),
+			"license":         cty.StringVal("s3cr3t"),
+		}),
+		VarDeclarations: map[string]config.VarDeclaration{"license": {Type: config.SecretVarType}},
+		DeploymentGroups: []config.DeploymentGroup{
+			{Name: "zero", Modules: []config.Module{net}},
+			{Name: "one", Modules: []config.Module{vm}}},
+	}
+	dir := c.MkDir()
+
+	{ // group whose outputs are used
+		got, err := groupReadme(bp, 0, dir, filepath.Join(dir, "zero"))
+		c.Assert(err, IsNil)
+		c.Check(got, Matches, "(?s)# Deployment group `zero`.*\\| net \\| `modules/network/vpc` \\| terraform \\|.*")
+		c.Check(got, Matches, "(?s).*used by the groups below, deploy them after it:\n\n\\* `one`\n.*")
+		c.Check(got, Matches, "(?s).*terraform -chdir=zero apply\nghpc export-outputs zero\n.*")
+		c.Check(got, Matches, "(?s).*terraform -chdir=zero destroy.*")
+	}
+
+	{ // group using outputs, secret redacted
+		got, err := groupReadme(bp, 1, dir, filepath.Join(dir, "one"))
+		c.Assert(err, IsNil)
+		c.Check(got, Matches, "(?s).*\\* `zero`: `net.network_self_link`\n.*")
+		c.Check(got, Matches, "(?s).*license += \"\\(sensitive\\)\".*")
+		c.Check(strings.Contains(got, "s3cr3t"), Equals, false)
+		c.Check(got, Matches, "(?s).*ghpc import-inputs one\nterraform -chdir=one init\n.*")
+	}
 }
 
 func (s *MySuite) TestWriteProviders(c *C) {
@@ -424,7 +843,7 @@ func (s *MySuite) TestWriteProviders(c *C) {
 
 	// Simple success, empty vars
 	testVars := make(map[string]cty.Value)
-	err := writeProviders(testVars, testProvDir)
+	err := writeProviders(testVars, providerProjectVar(testVars), testProvDir)
 	c.Assert(err, IsNil)
 	exists, err := stringExistsInFile("google-beta", provFilePath)
 	c.Assert(err, IsNil)
@@ -434,17 +853,24 @@ func (s *MySuite) TestWriteProviders(c *C) {
 	c.Assert(exists, Equals, false)
 
 	// Failure: Bad Path
-	c.Assert(writeProviders(testVars, "not/a/real/path"), NotNil)
+	c.Assert(writeProviders(testVars, "", "not/a/real/path"), NotNil)
 
 	// Success: All vars
 	testVars["project_id"] = cty.StringVal("test_project")
 	testVars["zone"] = cty.StringVal("test_zone")
 	testVars["region"] = cty.StringVal("test_region")
-	err = writeProviders(testVars, testProvDir)
+	err = writeProviders(testVars, providerProjectVar(testVars), testProvDir)
 	c.Assert(err, IsNil)
 	exists, err = stringExistsInFile("var.region", provFilePath)
 	c.Assert(err, IsNil)
 	c.Assert(exists, Equals, true)
+
+	// Success: project created by bootstrap group
+	err = writeProviders(testVars, "project_id_project", testProvDir)
+	c.Assert(err, IsNil)
+	exists, err = stringExistsInFile("var.project_id_project", provFilePath)
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, true)
 }
 
 func (s *zeroSuite) TestKind(c *C) {
@@ -500,12 +926,12 @@ func (s *MySuite) TestWritePackerAutoVars(c *C) {
 
 	// fail writing to a bad path
 	badDestPath := "not/a/real/path"
-	err := writePackerAutovars(vars.Items(), badDestPath)
+	err := writePackerAutovars(vars.Items(), nil, badDestPath)
 	expErr := fmt.Sprintf(".*%s.*", packerAutoVarFilename)
 	c.Assert(err, ErrorMatches, expErr)
 
 	// success
-	err = writePackerAutovars(vars.Items(), c.MkDir())
+	err = writePackerAutovars(vars.Items(), nil, c.MkDir())
 	c.Assert(err, IsNil)
 
 }
@@ -588,6 +1014,27 @@ func (s *zeroSuite) TestSubstituteIgcReferencesInModule(c *C) {
 	})})
 }
 
+func (s *zeroSuite) TestFindRuntimeVariables(c *C) {
+	d := config.Dict{}
+	d.Set("subnetwork_self_link", config.MustParseExpression(`module.runtime.subnet`).AsValue())
+	d.Set("name", config.MustParseExpression(`"${var.deployment_name}-${module.runtime.runner}"`).AsValue())
+	g := config.DeploymentGroup{Name: "primary", Modules: []config.Module{{ID: "vm", Settings: d}}}
+
+	vars := FindRuntimeVariables(g)
+	c.Check(vars, HasLen, 2)
+	subnet := vars[config.ModuleRef("runtime", "subnet")]
+	c.Check(subnet.Name, Equals, "runtime_subnet")
+	c.Check(subnet.Type, Equals, cty.String)
+	c.Check(subnet.Required, Equals, true)
+
+	m, err := SubstituteIgcReferencesInModule(g.Modules[0], vars)
+	c.Assert(err, IsNil)
+	c.Check(m.Settings.Items(), DeepEquals, map[string]cty.Value{
+		"subnetwork_self_link": config.MustParseExpression(`var.runtime_subnet`).AsValue(),
+		"name":                 config.MustParseExpression(`"${var.deployment_name}-${var.runtime_runner}"`).AsValue(),
+	})
+}
+
 func (s *zeroSuite) TestWritePackerDestroyInstructions(c *C) {
 	{ // no manifest
 		b := new(strings.Builder)
@@ -601,3 +1048,148 @@ func (s *zeroSuite) TestWritePackerDestroyInstructions(c *C) {
 		c.Check(got, Matches, ".*Aldebaran.*Betelgeuse.*")
 	}
 }
+
+func (s *MySuite) TestAdoptDeployment(c *C) {
+	bp := s.getBlueprintForTest()
+	dir := filepath.Join(s.testDir, "test_adopt_deployment")
+	groupDir := GroupDir(dir, bp, "test_resource_group")
+
+	// Fail: deployment group is missing
+	c.Check(AdoptDeployment(bp, dir), ErrorMatches, ".*\"test_resource_group\".* do not have a directory.*")
+
+	c.Assert(os.MkdirAll(groupDir, 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(groupDir, "main.tf"), []byte("hand-made"), 0644), IsNil)
+	c.Assert(AdoptDeployment(bp, dir), IsNil)
+
+	c.Check(pathExists(filepath.Join(ArtifactsDir(dir), ExpandedBlueprintName)), Equals, true)
+	c.Check(pathExists(filepath.Join(ArtifactsDir(dir), ManifestName)), Equals, true)
+	c.Check(pathExists(filepath.Join(dir, ".gitignore")), Equals, true)
+	main, err := os.ReadFile(filepath.Join(groupDir, "main.tf"))
+	c.Assert(err, IsNil)
+	c.Check(string(main), Equals, "hand-made") // group is left untouched
+
+	// Fail: already adopted
+	c.Check(AdoptDeployment(bp, dir), ErrorMatches, ".*already a GHPC deployment folder.*")
+}
+
+func (s *MySuite) TestStaleFiles(c *C) {
+	bp := s.getBlueprintForTest() // group "test_resource_group"
+	prev := s.getBlueprintForTest()
+	prev.DeploymentGroups = append(prev.DeploymentGroups,
+		config.DeploymentGroup{Name: "gone"}, config.DeploymentGroup{Name: "applied"})
+	c.Check(removedGroupDirs(prev, bp), DeepEquals, []string{"gone", "applied"})
+
+	dep := c.MkDir()
+	write := func(p string, size int) {
+		c.Assert(os.MkdirAll(filepath.Dir(p), 0755), IsNil)
+		c.Assert(os.WriteFile(p, make([]byte, size), 0644), IsNil)
+	}
+	prevDir := filepath.Join(dep, HiddenGhpcDirName, prevDeploymentGroupDirName)
+	c.Assert(os.MkdirAll(filepath.Join(dep, HiddenGhpcDirName, ArtifactsDirName), 0755), IsNil)
+	m := NewManifest(bp)
+	m.RemovedGroups = removedGroupDirs(prev, bp)
+	c.Assert(writeManifest(ArtifactsDir(dep), m), IsNil)
+
+	write(filepath.Join(prevDir, "gone", "main.tf"), 1)
+	c.Assert(os.MkdirAll(filepath.Join(prevDir, "applied"), 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(prevDir, "applied", tfStateFileName), []byte(`{"resources": [{"type": "google_compute_network"}]}`), 0644), IsNil)
+	write(filepath.Join(prevDir, "test_resource_group", ".terraform", "modules", "modules.json"), 1)
+	group := filepath.Join(dep, "test_resource_group")
+	write(filepath.Join(group, "main.tf"), 1)
+	write(filepath.Join(group, "tfplan"), 1)
+	write(filepath.Join(group, "crash.log"), 2048)
+	write(filepath.Join(group, "small.log"), 10)
+
+	stale, kept, err := StaleFiles(bp, dep, 1024)
+	c.Assert(err, IsNil)
+	paths := []string{}
+	for _, f := range stale {
+		paths = append(paths, f.Path)
+	}
+	c.Check(paths, DeepEquals, []string{
+		filepath.Join(prevDir, "gone"),
+		filepath.Join(prevDir, "test_resource_group", ".terraform"),
+		filepath.Join(group, "crash.log"),
+		filepath.Join(group, "tfplan"),
+	})
+	c.Assert(kept, HasLen, 1)
+	c.Check(kept[0].Path, Equals, filepath.Join(prevDir, "applied"))
+	c.Check(kept[0].Reason, Matches, ".*has resources.*")
+}
+
+func (s *MySuite) TestWriteTerraformRoot(c *C) {
+	bp := s.getBlueprintForTest()
+	consumer := config.Module{
+		Source: s.terraformModuleDir,
+		Kind:   config.TerraformKind,
+		ID:     "consumer",
+		Settings: config.NewDict(map[string]cty.Value{
+			"input": config.ModuleRef("testModule", "test-output").AsValue(),
+		}),
+	}
+	image := config.Module{Source: s.terraformModuleDir, Kind: config.PackerKind, ID: "image"}
+	bp.DeploymentGroups = append(bp.DeploymentGroups,
+		config.DeploymentGroup{Name: "consumers", Modules: []config.Module{consumer}},
+		config.DeploymentGroup{Name: "images", Modules: []config.Module{image}})
+	dir := filepath.Join(s.testDir, "test_write_terraform_root")
+
+	skipped, err := WriteTerraformRoot(bp, dir)
+	c.Assert(err, IsNil)
+	c.Check(skipped, DeepEquals, []config.ModuleID{"image"})
+	for _, f := range []string{"main.tf", "variables.tf", "outputs.tf", "terraform.tfvars", "providers.tf", "versions.tf"} {
+		c.Check(pathExists(filepath.Join(dir, f)), Equals, true)
+	}
+	// intergroup reference is a plain module reference within the root module
+	exists, err := stringExistsInFile("module.testModule.test-output", filepath.Join(dir, "main.tf"))
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, true)
+	exists, err = stringExistsInFile("module \"image\"", filepath.Join(dir, "main.tf"))
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, false)
+
+	// Fail: directory exists
+	_, err = WriteTerraformRoot(bp, dir)
+	c.Check(err, ErrorMatches, ".*already exists.*")
+
+	// Fail: no terraform modules
+	bp.DeploymentGroups = bp.DeploymentGroups[2:]
+	_, err = WriteTerraformRoot(bp, filepath.Join(s.testDir, "test_write_terraform_root_packer"))
+	c.Check(err, ErrorMatches, ".*no terraform modules.*")
+}
+
+func BenchmarkWriteDeployment(b *testing.B) {
+	aferoFS := afero.NewMemMapFs()
+	aferoFS.MkdirAll(config.SynthModuleSource, 0755)
+	afero.WriteFile(aferoFS, filepath.Join(config.SynthModuleSource, "main.tf"), []byte("vpc"), 0644)
+	aferoFS.MkdirAll("community/modules", 0755)
+	sourcereader.ModuleFS = afero.NewIOFS(aferoFS)
+	modulereader.SetModuleInfo(config.SynthModuleSource, config.TerraformKind.String(), modulereader.ModuleInfo{
+		Inputs: []modulereader.VarInfo{
+			{Name: "project_id", Type: cty.String, Required: true},
+			{Name: "region", Type: cty.String, Required: true},
+			{Name: "network_name", Type: cty.String},
+			{Name: "subnetwork_name", Type: cty.String},
+		},
+		Outputs: []modulereader.OutputInfo{{Name: "network_name"}, {Name: "subnetwork_name"}},
+	})
+
+	for _, o := range []config.SynthOptions{
+		{Groups: 1, Modules: 10, References: 10},
+		{Groups: 5, Modules: 20, References: 200},
+	} {
+		bp, err := config.SynthBlueprint(o)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := bp.Expand(); err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("%dx%dx%d", o.Groups, o.Modules, o.References), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := WriteDeployment(bp, filepath.Join(b.TempDir(), "synth")); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulewriter
+
+import (
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// OverridesFileName is the file of a deployment group directory overriding
+// settings of its modules. It is kept and applied whenever the deployment is
+// written again, unlike manual edits of the generated files.
+const OverridesFileName = "overrides.yaml"
+
+// groupOverrides are settings of overrides.yaml, by module ID, e.g.
+//
+//	compute_nodeset:
+//	  machine_type: c2-standard-60
+type groupOverrides map[config.ModuleID]config.Dict
+
+func readOverrides(path string) ([]byte, groupOverrides, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	o := groupOverrides{}
+	if err := yaml.Unmarshal(b, &o); err != nil {
+		return nil, nil, fmt.Errorf("failed to read overrides %s: %w", path, err)
+	}
+	return b, o, nil
+}
+
+// checkOverride verifies that expressions of the overriding value only refer
+// to deployment variables, references to modules are only resolved while the
+// blueprint is expanded
+func checkOverride(bp config.Blueprint, v cty.Value) error {
+	var err error
+	cty.Walk(v, func(_ cty.Path, v cty.Value) (bool, error) {
+		e, is := config.IsExpressionValue(v)
+		if !is {
+			return true, nil
+		}
+		for _, r := range e.References() {
+			if !r.GlobalVar {
+				err = fmt.Errorf("overrides may only refer to deployment variables, got a reference to module %s", r.Module)
+			} else if !bp.Vars.Has(r.Name) {
+				err = fmt.Errorf("deployment variable %s is not defined", r.Name)
+			}
+		}
+		return err == nil, nil
+	})
+	return err
+}
+
+// applyOverrides returns a copy of the blueprint where settings of modules of
+// the group are replaced by the overrides read from path
+func applyOverrides(bp config.Blueprint, g config.GroupName, o groupOverrides, path string) (config.Blueprint, error) {
+	bp.DeploymentGroups = slices.Clone(bp.DeploymentGroups)
+	gi := slices.IndexFunc(bp.DeploymentGroups, func(dg config.DeploymentGroup) bool { return dg.Name == g })
+	group := &bp.DeploymentGroups[gi]
+	group.Modules = slices.Clone(group.Modules)
+
+	ids := []string{}
+	for id := range o {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		mi := slices.IndexFunc(group.Modules, func(m config.Module) bool { return string(m.ID) == id })
+		if mi < 0 {
+			return config.Blueprint{}, fmt.Errorf("overrides %s: module %s is not part of deployment group %s", path, id, g)
+		}
+		mod := &group.Modules[mi]
+		mod.Settings = config.NewDict(mod.Settings.Items()) // clone to not modify original
+		settings := o[config.ModuleID(id)]
+		keys := settings.Keys()
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := checkOverride(bp, settings.Get(k)); err != nil {
+				return config.Blueprint{}, fmt.Errorf("overrides %s: setting %s of module %s: %w", path, k, id, err)
+			}
+			mod.Settings.Set(k, settings.Get(k))
+		}
+		logging.Info("Overriding settings %s of module %s with %s", strings.Join(keys, ", "), id, path)
+	}
+	return bp, nil
+}
+
+// withOverrides applies overrides.yaml files of deployment groups of the
+// existing deployment directory, before it is written again. It returns the
+// blueprint to write and the content of the files to restore.
+func withOverrides(bp config.Blueprint, deploymentDir string) (config.Blueprint, map[config.GroupName][]byte, error) {
+	files := map[config.GroupName][]byte{}
+	for _, g := range bp.DeploymentGroups {
+		path := filepath.Join(GroupDir(deploymentDir, bp, g.Name), OverridesFileName)
+		b, o, err := readOverrides(path)
+		if err != nil {
+			return config.Blueprint{}, nil, err
+		}
+		if b == nil {
+			continue
+		}
+		if bp, err = applyOverrides(bp, g.Name, o, path); err != nil {
+			return config.Blueprint{}, nil, err
+		}
+		files[g.Name] = b
+	}
+	return bp, files, nil
+}
+
+// restoreOverrides writes overrides.yaml files back to deployment groups
+func restoreOverrides(bp config.Blueprint, deploymentDir string, files map[config.GroupName][]byte) error {
+	for g, b := range files {
+		if err := os.WriteFile(filepath.Join(GroupDir(deploymentDir, bp, g), OverridesFileName), b, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulewriter
+
+import (
+	"hpc-toolkit/pkg/config"
+	"os"
+	"path/filepath"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestWriteDeployment_Overrides(c *C) {
+	bp := s.getBlueprintForTest()
+	dir := filepath.Join(s.testDir, "test_write_deployment_overrides")
+	c.Assert(WriteDeployment(bp, dir), IsNil)
+
+	gDir := filepath.Join(dir, "test_resource_group")
+	overrides := []byte("testModuleWithLabels:\n  moduleLabel: overridden\n  zone: $(vars.project_id)-a\n")
+	c.Assert(os.WriteFile(filepath.Join(gDir, OverridesFileName), overrides, 0644), IsNil)
+
+	// regenerating the deployment keeps and applies overrides
+	for i := 0; i < 2; i++ {
+		c.Assert(WriteDeployment(bp, dir), IsNil)
+		got, err := os.ReadFile(filepath.Join(gDir, OverridesFileName))
+		c.Assert(err, IsNil)
+		c.Check(got, DeepEquals, overrides)
+
+		main, err := os.ReadFile(filepath.Join(gDir, "main.tf"))
+		c.Assert(err, IsNil)
+		c.Check(string(main), Matches, `(?s).*moduleLabel += "overridden".*`)
+		c.Check(string(main), Matches, `(?s).*zone += "\${var.project_id}-a".*`)
+	}
+	// the blueprint given is not modified
+	c.Check(bp.DeploymentGroups[0].Modules[1].Settings.Get("moduleLabel"), DeepEquals, cty.StringVal("moduleLabelValue"))
+
+	exp, _, err := config.NewBlueprint(filepath.Join(ArtifactsDir(dir), ExpandedBlueprintName))
+	c.Assert(err, IsNil)
+	c.Check(exp.DeploymentGroups[0].Modules[1].Settings.Get("moduleLabel"), DeepEquals, cty.StringVal("overridden"))
+}
+
+func (s *zeroSuite) TestApplyOverrides(c *C) {
+	bp := config.Blueprint{
+		Vars: config.NewDict(map[string]cty.Value{"zone": cty.StringVal("us-central1-a")}),
+		DeploymentGroups: []config.DeploymentGroup{{Name: "primary", Modules: []config.Module{
+			{ID: "net"},
+			{ID: "vm", Settings: config.NewDict(map[string]cty.Value{"machine_type": cty.StringVal("n2-standard-2")})},
+		}}}}
+
+	{ // ok
+		got, err := applyOverrides(bp, "primary", groupOverrides{
+			"vm": config.NewDict(map[string]cty.Value{"machine_type": cty.StringVal("c2-standard-60")}),
+		}, "overrides.yaml")
+		c.Assert(err, IsNil)
+		c.Check(got.DeploymentGroups[0].Modules[1].Settings.Get("machine_type"), DeepEquals, cty.StringVal("c2-standard-60"))
+		c.Check(bp.DeploymentGroups[0].Modules[1].Settings.Get("machine_type"), DeepEquals, cty.StringVal("n2-standard-2"))
+	}
+
+	{ // unknown module
+		_, err := applyOverrides(bp, "primary", groupOverrides{"login": config.Dict{}}, "overrides.yaml")
+		c.Check(err, ErrorMatches, `overrides overrides.yaml: module login is not part of deployment group primary`)
+	}
+
+	{ // reference to a module
+		ref := config.ModuleRef("net", "subnetwork_self_link").AsValue()
+		_, err := applyOverrides(bp, "primary", groupOverrides{
+			"vm": config.NewDict(map[string]cty.Value{"subnetwork_self_link": ref}),
+		}, "overrides.yaml")
+		c.Check(err, ErrorMatches, `.*setting subnetwork_self_link of module vm: overrides may only refer to deployment variables.*`)
+	}
+
+	{ // undefined variable
+		_, err := applyOverrides(bp, "primary", groupOverrides{
+			"vm": config.NewDict(map[string]cty.Value{"zone": config.GlobalRef("region").AsValue()}),
+		}, "overrides.yaml")
+		c.Check(err, ErrorMatches, `.*deployment variable region is not defined`)
+	}
+}
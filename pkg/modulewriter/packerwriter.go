@@ -24,6 +24,7 @@ import (
 	"hpc-toolkit/pkg/config"
 
 	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/slices"
 )
 
 const packerAutoVarFilename = "defaults.auto.pkrvars.hcl"
@@ -36,18 +37,27 @@ func printPackerInstructions(w io.Writer, groupPath string, subPath string, prin
 	fmt.Fprintf(w, "Packer group was successfully created in directory %s\n", groupPath)
 	fmt.Fprintln(w, "To deploy, run the following commands:")
 	fmt.Fprintln(w)
+	for _, cmd := range packerCommands(groupPath, subPath, printImportInputs) {
+		fmt.Fprintln(w, cmd)
+	}
+}
+
+// packerCommands returns the commands building a Packer module by hand
+func packerCommands(groupPath string, subPath string, printImportInputs bool) []string {
+	cmds := []string{}
 	if printImportInputs {
-		fmt.Fprintf(w, "ghpc import-inputs %s\n", groupPath)
+		cmds = append(cmds, fmt.Sprintf("ghpc import-inputs %s", groupPath))
 	}
-	fmt.Fprintf(w, "cd %s\n", filepath.Join(groupPath, subPath))
-	fmt.Fprintln(w, "packer init .")
-	fmt.Fprintln(w, "packer validate .")
-	fmt.Fprintln(w, "packer build .")
-	fmt.Fprintln(w, "cd -")
+	return append(cmds,
+		fmt.Sprintf("cd %s", filepath.Join(groupPath, subPath)),
+		"packer init .",
+		"packer validate .",
+		"packer build .",
+		"cd -")
 }
 
-func writePackerAutovars(vars map[string]cty.Value, dst string) error {
-	return WriteHclAttributes(vars, filepath.Join(dst, packerAutoVarFilename))
+func writePackerAutovars(vars map[string]cty.Value, secrets []string, dst string) error {
+	return writeVarsFile(vars, secrets, filepath.Join(dst, packerAutoVarFilename))
 }
 
 // writeDeploymentGroup writes any needed files to the top and module levels
@@ -58,16 +68,10 @@ func (w PackerWriter) writeDeploymentGroup(
 	groupPath string,
 	instructionsFile io.Writer,
 ) error {
-	depGroup := bp.DeploymentGroups[grpIdx]
+	depGroup := modulesOfKind(bp.DeploymentGroups[grpIdx], config.PackerKind)
 
 	for _, mod := range depGroup.Modules {
-		pure := config.Dict{}
-		for setting, v := range mod.Settings.Items() {
-			if len(config.FindIntergroupReferences(v, mod, bp)) == 0 {
-				pure.Set(setting, v)
-			}
-		}
-		av, err := pure.Eval(bp)
+		av, hasIgc, err := packerAutovars(mod, bp)
 		if err != nil {
 			return err
 		}
@@ -77,17 +81,47 @@ func (w PackerWriter) writeDeploymentGroup(
 			return err
 		}
 		modPath := filepath.Join(groupPath, ds)
-		if err = writePackerAutovars(av.Items(), modPath); err != nil {
+		if err = writePackerAutovars(av.Items(), usedSecrets(mod, bp), modPath); err != nil {
 			return err
 		}
-		hasIgc := len(pure.Items()) < len(mod.Settings.Items())
 		printPackerInstructions(instructionsFile, groupPath, ds, hasIgc)
 	}
 
 	return nil
 }
 
-func (w PackerWriter) restoreState(deploymentDir string) error {
+// packerAutovars evaluates settings of the Packer module that do not refer to
+// outputs of other groups or of terraform modules of its group, those are set
+// by ghpc import-inputs. Returns true if any setting refers to such outputs.
+func packerAutovars(mod config.Module, bp config.Blueprint) (config.Dict, bool, error) {
+	pure := config.Dict{}
+	for setting, v := range mod.Settings.Items() {
+		if len(config.FindIntergroupReferences(v, mod, bp)) == 0 {
+			pure.Set(setting, v)
+		}
+	}
+	av, err := pure.Eval(bp)
+	if err != nil {
+		return config.Dict{}, false, err
+	}
+	return av, len(pure.Items()) < len(mod.Settings.Items()), nil
+}
+
+// usedSecrets returns names of settings that refer to secret variables
+func usedSecrets(mod config.Module, bp config.Blueprint) []string {
+	secrets := bp.SecretVars()
+	res := []string{}
+	for setting, v := range mod.Settings.Items() {
+		for _, u := range config.GetUsedDeploymentVars(v) {
+			if slices.Contains(secrets, u) {
+				res = append(res, setting)
+			}
+		}
+	}
+	return res
+}
+
+func (w PackerWriter) restoreState(bp config.Blueprint, deploymentDir string) error {
 	// TODO: restore packer-manifest.json if it exists
 	return nil
 }
@@ -0,0 +1,145 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulewriter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/hashicorp/terraform-exec/tfexec"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// CLIConfigFileName is the name of the terraform CLI configuration file
+// written to deployment groups installing providers from a network mirror
+const CLIConfigFileName = "terraform.tfrc"
+
+// writeCLIConfig writes the CLI configuration installing providers from the
+// network mirror, if one is configured
+func writeCLIConfig(tp config.TerraformProviders, groupPath string) error {
+	if tp.NetworkMirror == "" {
+		return nil
+	}
+	f := hclwrite.NewEmptyFile()
+	pi := f.Body().AppendNewBlock("provider_installation", []string{}).Body()
+	nm := pi.AppendNewBlock("network_mirror", []string{}).Body()
+	nm.SetAttributeValue("url", cty.StringVal(tp.NetworkMirror))
+	return writeHclFile(filepath.Join(groupPath, CLIConfigFileName), f)
+}
+
+// CLIConfigFile returns absolute path of the CLI configuration file of the
+// deployment group, if it has one
+func CLIConfigFile(groupDir string) (string, bool) {
+	p, err := filepath.Abs(filepath.Join(groupDir, CLIConfigFileName))
+	if err != nil {
+		return "", false
+	}
+	if _, err := os.Stat(p); err != nil {
+		return "", false
+	}
+	return p, true
+}
+
+// TerraformEnv returns the environment terraform should run with in the
+// deployment group, it is only needed if the group has a CLI configuration
+// or accesses its state with other credentials than its providers.
+// Variables tfexec refuses to pass through are left out.
+func TerraformEnv(groupDir string) (map[string]string, bool, error) {
+	cfg, hasCfg := CLIConfigFile(groupDir)
+	sa, hasSa, err := StateAccess(groupDir)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read %s: %w", StateAccessFileName, err)
+	}
+	if !hasCfg && !hasSa {
+		return nil, false, nil
+	}
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		if k, v, found := strings.Cut(kv, "="); found {
+			env[k] = v
+		}
+	}
+	for _, k := range tfexec.ProhibitedEnv(env) {
+		delete(env, k)
+	}
+	if hasCfg {
+		env["TF_CLI_CONFIG_FILE"] = cfg
+	}
+	if sa.ImpersonateServiceAccount != "" {
+		env[backendImpersonationEnv] = sa.ImpersonateServiceAccount
+	}
+	return env, true, nil
+}
+
+// writeLockFiles generates .terraform.lock.hcl of every terraform group with
+// checksums for the configured platforms
+func writeLockFiles(bp config.Blueprint, deploymentDir string) error {
+	tp := bp.TerraformProviders
+	if len(tp.LockPlatforms) == 0 {
+		return nil
+	}
+	for _, g := range bp.DeploymentGroups {
+		if g.Kind() != config.TerraformKind {
+			continue
+		}
+		logging.Info("Generating provider lock file for deployment group %s", g.Name)
+		if err := lockProviders(GroupDir(deploymentDir, bp, g.Name), tp); err != nil {
+			return fmt.Errorf("failed to generate %s for deployment group %s: %w", tfLockFileName, g.Name, err)
+		}
+	}
+	return nil
+}
+
+// lockProviders runs `terraform providers lock` in the group directory, it is
+// replaced in tests
+var lockProviders = func(groupDir string, tp config.TerraformProviders) error {
+	path, err := exec.LookPath("terraform")
+	if err != nil {
+		return fmt.Errorf("terraform must be installed in PATH to generate lock files: %w", err)
+	}
+	tf, err := tfexec.NewTerraform(groupDir, path)
+	if err != nil {
+		return err
+	}
+	if env, ok, err := TerraformEnv(groupDir); err != nil {
+		return err
+	} else if ok {
+		if err := tf.SetEnv(env); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	// modules have to be installed for providers they require to be known
+	if err := tf.Init(ctx, tfexec.Backend(false)); err != nil {
+		return err
+	}
+	opts := []tfexec.ProvidersLockOption{}
+	for _, p := range tp.LockPlatforms {
+		opts = append(opts, tfexec.Platform(p))
+	}
+	if tp.NetworkMirror != "" {
+		opts = append(opts, tfexec.NetMirror(tp.NetworkMirror))
+	}
+	return tf.ProvidersLock(ctx, opts...)
+}
@@ -0,0 +1,210 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulewriter
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/slices"
+)
+
+// GroupReadmeName is the file describing a deployment group to operators
+// that deploy it without ghpc
+const GroupReadmeName = "README.md"
+
+// redacted replaces values of secret variables in the README
+const redacted = "(sensitive)"
+
+// groupDependencies returns groups whose outputs the group uses, with the
+// outputs used, and groups that use outputs of the group
+func groupDependencies(bp config.Blueprint, g config.DeploymentGroup) (map[config.GroupName][]config.Reference, []config.GroupName) {
+	uses := map[config.GroupName][]config.Reference{}
+	for _, r := range g.FindAllIntergroupReferences(bp) {
+		if og := bp.ModuleGroupOrDie(r.Module).Name; og != g.Name {
+			uses[og] = append(uses[og], r)
+		}
+	}
+	usedBy := []config.GroupName{}
+	for _, og := range bp.DeploymentGroups {
+		if og.Name == g.Name {
+			continue
+		}
+		for _, r := range og.FindAllIntergroupReferences(bp) {
+			if bp.ModuleGroupOrDie(r.Module).Name == g.Name {
+				usedBy = append(usedBy, og.Name)
+				break
+			}
+		}
+	}
+	return uses, usedBy
+}
+
+// formatRedactedVars formats variables as written to variable files, with
+// values of secrets redacted
+func formatRedactedVars(vars map[string]cty.Value, secrets []string) string {
+	shown := map[string]cty.Value{}
+	for k, v := range vars {
+		if slices.Contains(secrets, k) {
+			v = cty.StringVal(redacted)
+		}
+		shown[k] = v
+	}
+	return strings.TrimSpace(string(hclwrite.Format(hclAttributesFile(shown).Bytes())))
+}
+
+// groupReadme describes the group written in groupPath, commands are relative
+// to the deployment directory deplPath
+func groupReadme(bp config.Blueprint, gIdx int, deplPath string, groupPath string) (string, error) {
+	g := bp.DeploymentGroups[gIdx]
+	rel, err := filepath.Rel(deplPath, groupPath)
+	if err != nil {
+		return "", err
+	}
+	uses, usedBy := groupDependencies(bp, g)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Deployment group `%s`\n\n", g.Name)
+	fmt.Fprintf(&sb, "This file was generated by ghpc from blueprint `%s` for deployment `%s`.\n", bp.BlueprintName, bp.DeploymentName())
+	sb.WriteString("It is overwritten when the deployment is written again, do not modify it.\n")
+	readmeModules(&sb, g)
+	readmeDependencies(&sb, bp, uses, usedBy)
+	cmds, destroy, err := readmeVariables(&sb, bp, g, rel, groupPath, len(usedBy) > 0)
+	if err != nil {
+		return "", err
+	}
+	readmeDeploying(&sb, cmds, destroy)
+	return sb.String(), nil
+}
+
+// readmeModules writes the Modules section of the group readme
+func readmeModules(sb *strings.Builder, g config.DeploymentGroup) {
+	sb.WriteString("\n## Modules\n\n")
+	sb.WriteString("| ID | Source | Kind |\n")
+	sb.WriteString("|----|--------|------|\n")
+	for _, m := range g.Modules {
+		fmt.Fprintf(sb, "| %s | `%s` | %s |\n", m.ID, m.Source, m.Kind)
+	}
+}
+
+// readmeDependencies writes the Dependencies section of the group readme
+func readmeDependencies(sb *strings.Builder, bp config.Blueprint, uses map[config.GroupName][]config.Reference, usedBy []config.GroupName) {
+	sb.WriteString("\n## Dependencies\n\n")
+	if len(uses) == 0 && len(usedBy) == 0 {
+		sb.WriteString("This group does not depend on other groups.\n")
+	}
+	if len(uses) > 0 {
+		sb.WriteString("This group uses outputs of the groups below, deploy them first:\n\n")
+		for _, og := range bp.DeploymentGroups {
+			refs, ok := uses[og.Name]
+			if !ok {
+				continue
+			}
+			outs := []string{}
+			for _, r := range refs {
+				outs = append(outs, fmt.Sprintf("`%s.%s`", r.Module, r.Name))
+			}
+			slices.Sort(outs)
+			fmt.Fprintf(sb, "* `%s`: %s\n", og.Name, strings.Join(outs, ", "))
+		}
+	}
+	if len(usedBy) > 0 {
+		if len(uses) > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString("Outputs of this group are used by the groups below, deploy them after it:\n\n")
+		for _, n := range usedBy {
+			fmt.Fprintf(sb, "* `%s`\n", n)
+		}
+	}
+}
+
+// readmeVariables writes the Variables section of the group readme, it
+// returns commands deploying and destroying stages of the group
+func readmeVariables(sb *strings.Builder, bp config.Blueprint, g config.DeploymentGroup, rel string, groupPath string, exportsOutputs bool) ([]string, []string, error) {
+	sb.WriteString("\n## Variables\n\n")
+	sb.WriteString("Values of the variable files of the group, values of sensitive variables are\nredacted.\n")
+	cmds := []string{}
+	destroy := []string{}
+	for _, k := range stageKinds(g) {
+		switch k {
+		case config.TerraformKind:
+			tg := modulesOfKind(g, config.TerraformKind)
+			vars, err := getUsedDeploymentVars(tg, bp)
+			if err != nil {
+				return nil, nil, err
+			}
+			fmt.Fprintf(sb, "\n### terraform.tfvars\n\n```hcl\n%s\n```\n", formatRedactedVars(vars, bp.SecretVars()))
+
+			cliConfig := ""
+			if _, ok := CLIConfigFile(groupPath); ok {
+				cliConfig = filepath.Join("$PWD", rel, CLIConfigFileName)
+			}
+			cmds = append(cmds, terraformCommands(rel, exportsOutputs, len(FindIntergroupVariables(tg, bp))+len(FindRuntimeVariables(tg)) > 0, cliConfig)...)
+			destroy = append(destroy, fmt.Sprintf("terraform -chdir=%s destroy", rel))
+		case config.PackerKind:
+			pc, err := readmePackerVariables(sb, bp, g, rel)
+			if err != nil {
+				return nil, nil, err
+			}
+			cmds = append(cmds, pc...)
+		}
+	}
+	return cmds, destroy, nil
+}
+
+// readmePackerVariables writes variable files of Packer modules of the group,
+// it returns commands building their images
+func readmePackerVariables(sb *strings.Builder, bp config.Blueprint, g config.DeploymentGroup, rel string) ([]string, error) {
+	cmds := []string{}
+	for _, m := range modulesOfKind(g, config.PackerKind).Modules {
+		av, hasIgc, err := packerAutovars(m, bp)
+		if err != nil {
+			return nil, err
+		}
+		ds, err := DeploymentSource(m)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(sb, "\n### %s\n\n```hcl\n%s\n```\n",
+			filepath.Join(ds, packerAutoVarFilename), formatRedactedVars(av.Items(), usedSecrets(m, bp)))
+		cmds = append(cmds, packerCommands(rel, ds, hasIgc)...)
+	}
+	return cmds, nil
+}
+
+// readmeDeploying writes the Deploying without ghpc section of the group readme
+func readmeDeploying(sb *strings.Builder, cmds []string, destroy []string) {
+	sb.WriteString("\n## Deploying without ghpc\n\n")
+	sb.WriteString("Run the commands below from the deployment directory, `ghpc deploy` runs the\nsame steps:\n\n")
+	fmt.Fprintf(sb, "```shell\n%s\n```\n", strings.Join(cmds, "\n"))
+	if len(destroy) > 0 {
+		sb.WriteString("\nTo destroy resources of the group, once groups using its outputs are destroyed:\n\n")
+		fmt.Fprintf(sb, "```shell\n%s\n```\n", strings.Join(destroy, "\n"))
+	}
+}
+
+func writeGroupReadme(bp config.Blueprint, gIdx int, deplPath string, groupPath string) error {
+	readme, err := groupReadme(bp, gIdx, deplPath, groupPath)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(groupPath, GroupReadmeName), []byte(readme), 0644)
+}
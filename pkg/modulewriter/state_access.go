@@ -0,0 +1,66 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulewriter
+
+import (
+	"errors"
+	"hpc-toolkit/pkg/config"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StateAccessFileName is the file configuring credentials the terraform state
+// of deployment groups is accessed with
+const StateAccessFileName = "state_access.yaml"
+
+// backendImpersonationEnv is read by the gcs backend only, providers keep
+// the credentials of the environment
+const backendImpersonationEnv = "GOOGLE_BACKEND_IMPERSONATE_SERVICE_ACCOUNT"
+
+// writeStateAccess writes the state access of the group, the file is removed
+// from groups without one
+func writeStateAccess(be config.TerraformBackend, groupPath string) error {
+	p := filepath.Join(groupPath, StateAccessFileName)
+	if be.StateAccess == (config.StateAccess{}) {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	b, err := yaml.Marshal(be.StateAccess)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, b, 0644)
+}
+
+// StateAccess returns credentials the terraform state of the deployment group
+// is accessed with, if the group sets them apart
+func StateAccess(groupDir string) (config.StateAccess, bool, error) {
+	b, err := os.ReadFile(filepath.Join(groupDir, StateAccessFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return config.StateAccess{}, false, nil
+	}
+	if err != nil {
+		return config.StateAccess{}, false, err
+	}
+	var sa config.StateAccess
+	if err := yaml.Unmarshal(b, &sa); err != nil {
+		return config.StateAccess{}, false, err
+	}
+	return sa, true, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modulewriter
+
+import (
+	"hpc-toolkit/pkg/config"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *zeroSuite) TestWriteStateAccess(c *C) {
+	dir := c.MkDir()
+	sa := "state@central.iam.gserviceaccount.com"
+	be := config.TerraformBackend{Type: "gcs", StateAccess: config.StateAccess{ImpersonateServiceAccount: sa}}
+
+	c.Assert(writeStateAccess(be, dir), IsNil)
+	got, ok, err := StateAccess(dir)
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, true)
+	c.Check(got, DeepEquals, config.StateAccess{ImpersonateServiceAccount: sa})
+
+	// only the backend impersonates the service account
+	env, ok, err := TerraformEnv(dir)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	c.Check(env[backendImpersonationEnv], Equals, sa)
+	_, hasCfg := env["TF_CLI_CONFIG_FILE"]
+	c.Check(hasCfg, Equals, false)
+
+	// removing state access removes the file
+	c.Assert(writeStateAccess(config.TerraformBackend{Type: "gcs"}, dir), IsNil)
+	_, ok, err = StateAccess(dir)
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, false)
+	_, ok, err = TerraformEnv(dir)
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, false)
+}
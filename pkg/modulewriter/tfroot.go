@@ -0,0 +1,130 @@
+/**
+* Copyright 2024 Google LLC
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package modulewriter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"hpc-toolkit/pkg/config"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+// rootModuleGroup merges terraform modules of the blueprint into one group,
+// references between groups become plain references between modules.
+// IDs of skipped Packer modules are returned along.
+func rootModuleGroup(bp config.Blueprint) (config.DeploymentGroup, []config.ModuleID, error) {
+	root := config.DeploymentGroup{}
+	skipped := []config.ModuleID{}
+	for _, g := range bp.DeploymentGroups {
+		for _, m := range modulesOfKind(g, config.PackerKind).Modules {
+			skipped = append(skipped, m.ID)
+		}
+		tf := modulesOfKind(g, config.TerraformKind)
+		if len(tf.Modules) == 0 {
+			continue
+		}
+		if root.Name == "" { // backend of the first group is kept
+			root.Name = g.Name
+			root.TerraformBackend = g.TerraformBackend
+		}
+		root.Modules = append(root.Modules, tf.Modules...)
+	}
+	if root.Name == "" {
+		return config.DeploymentGroup{}, nil, errors.New("blueprint has no terraform modules")
+	}
+	return root, skipped, nil
+}
+
+// WriteTerraformRoot writes terraform modules of the blueprint as a standalone
+// terraform root module, that can be applied with terraform alone. Module
+// sources are copied to the root module and all terraform groups are merged,
+// so outputs no longer need to be passed between groups by ghpc. Packer modules
+// can not be part of a root module, their IDs are returned to be reported.
+func WriteTerraformRoot(bp config.Blueprint, dir string) ([]config.ModuleID, error) {
+	g, skipped, err := rootModuleGroup(bp)
+	if err != nil {
+		return nil, err
+	}
+	if err := createRootDir(dir); err != nil {
+		return nil, err
+	}
+	if err := copyGroupSources(dir, g); err != nil {
+		return nil, err
+	}
+
+	vars, err := getUsedDeploymentVars(g, bp)
+	if err != nil {
+		return nil, err
+	}
+	be := g.TerraformBackend
+	if be.Configuration, err = be.Configuration.Eval(bp); err != nil {
+		return nil, err
+	}
+	// no ghpc runs terraform in the root module to set the state access
+	if sa := be.StateAccess.ImpersonateServiceAccount; sa != "" && !be.Configuration.Has("impersonate_service_account") {
+		be.Configuration.Set("impersonate_service_account", cty.StringVal(sa))
+	}
+
+	mods, err := evalImports(bp, g.Modules)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeRootFiles(bp, g, mods, vars, be, dir); err != nil {
+		return nil, err
+	}
+	return skipped, nil
+}
+
+// createRootDir creates the directory of the root module, it must not exist
+func createRootDir(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("%s already exists, choose another output directory", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory at %s: %w", dir, err)
+	}
+	return nil
+}
+
+// writeRootFiles writes terraform files of the root module
+func writeRootFiles(bp config.Blueprint, g config.DeploymentGroup, mods []config.Module, vars map[string]cty.Value, be config.TerraformBackend, dir string) error {
+	if err := writeMain(mods, be, dir); err != nil {
+		return fmt.Errorf("error writing main.tf file: %w", err)
+	}
+	if err := writeVariables(vars, bp.SecretVars(), nil, dir); err != nil {
+		return fmt.Errorf("error writing variables.tf file: %w", err)
+	}
+	if err := writeOutputs(g.Modules, dir); err != nil {
+		return fmt.Errorf("error writing outputs.tf file: %w", err)
+	}
+	if err := writeTfvars(vars, bp.SecretVars(), dir); err != nil {
+		return fmt.Errorf("error writing terraform.tfvars file: %w", err)
+	}
+	if err := writeProviders(vars, providerProjectVar(vars), dir); err != nil {
+		return fmt.Errorf("error writing providers.tf file: %w", err)
+	}
+	if err := writeVersions(dir, requiredTerraformVersion(g.Modules)); err != nil {
+		return fmt.Errorf("error writing versions.tf file: %w", err)
+	}
+	if err := writeCLIConfig(bp.TerraformProviders, dir); err != nil {
+		return fmt.Errorf("error writing %s file: %w", CLIConfigFileName, err)
+	}
+	return nil
+}
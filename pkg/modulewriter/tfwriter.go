@@ -27,6 +27,7 @@ import (
 	"github.com/hashicorp/hcl/v2/ext/typeexpr"
 	"github.com/hashicorp/hcl/v2/hclwrite"
 	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
 	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 
@@ -37,6 +38,7 @@ import (
 const (
 	tfStateFileName       = "terraform.tfstate"
 	tfStateBackupFileName = "terraform.tfstate.backup"
+	tfLockFileName        = ".terraform.lock.hcl"
 )
 
 // TFWriter writes terraform to the blueprint folder
@@ -81,8 +83,11 @@ func writeOutputs(
 				desc = fmt.Sprintf("Generated output from module '%s'", mod.ID)
 			}
 			blockBody.SetAttributeValue("description", cty.StringVal(desc))
-			value := fmt.Sprintf("module.%s.%s", mod.ID, output.Name)
-			blockBody.SetAttributeRaw("value", simpleTokens(value))
+			value, err := config.OutputValue(mod.ID, output)
+			if err != nil {
+				return err
+			}
+			blockBody.SetAttributeRaw("value", value.Tokenize())
 			if output.Sensitive {
 				blockBody.SetAttributeValue("sensitive", cty.BoolVal(output.Sensitive))
 			}
@@ -95,8 +100,19 @@ func writeOutputs(
 	return writeHclFile(filepath.Join(dst, "outputs.tf"), hclFile)
 }
 
-func writeTfvars(vars map[string]cty.Value, dst string) error {
-	return WriteHclAttributes(vars, filepath.Join(dst, "terraform.tfvars"))
+func writeTfvars(vars map[string]cty.Value, secrets []string, dst string) error {
+	return writeVarsFile(vars, secrets, filepath.Join(dst, "terraform.tfvars"))
+}
+
+// writeVarsFile writes vars to path, only the user can read it if any of vars
+// is secret
+func writeVarsFile(vars map[string]cty.Value, secrets []string, path string) error {
+	for _, s := range secrets {
+		if _, ok := vars[s]; ok {
+			return WriteSecretHclAttributes(vars, path)
+		}
+	}
+	return WriteHclAttributes(vars, path)
 }
 
 func relaxVarType(t cty.Type) cty.Type {
@@ -113,13 +129,14 @@ func getTypeTokens(ty cty.Type) hclwrite.Tokens {
 	return simpleTokens(typeexpr.TypeString(ty))
 }
 
-func writeVariables(vars map[string]cty.Value, extraVars []modulereader.VarInfo, dst string) error {
+func writeVariables(vars map[string]cty.Value, secrets []string, extraVars []modulereader.VarInfo, dst string) error {
 	var inputs []modulereader.VarInfo
 	for k, v := range vars {
 		inputs = append(inputs, modulereader.VarInfo{
 			Name:        k,
 			Type:        relaxVarType(v.Type()),
 			Description: fmt.Sprintf("Toolkit deployment variable: %s", k),
+			Sensitive:   slices.Contains(secrets, k),
 		})
 	}
 	inputs = append(inputs, extraVars...)
@@ -136,6 +153,9 @@ func writeVariables(vars map[string]cty.Value, extraVars []modulereader.VarInfo,
 		blockBody := hclBlock.Body()
 		blockBody.SetAttributeValue("description", cty.StringVal(k.Description))
 		blockBody.SetAttributeRaw("type", getTypeTokens(k.Type))
+		if k.Sensitive {
+			blockBody.SetAttributeValue("sensitive", cty.True)
+		}
 	}
 
 	return writeHclFile(filepath.Join(dst, "variables.tf"), hclFile)
@@ -148,19 +168,34 @@ func writeMain(
 ) error {
 	hclFile := hclwrite.NewEmptyFile()
 	hclBody := hclFile.Body()
+	appendBackend(hclBody, tfBackend)
+	if err := appendModules(hclBody, modules); err != nil {
+		return err
+	}
+	appendMoves(hclBody, modules)
+	if err := appendImports(hclBody, modules); err != nil {
+		return err
+	}
+	return writeHclFile(filepath.Join(dst, "main.tf"), hclFile)
+}
 
-	// Write Terraform backend if needed
-	if tfBackend.Type != "" {
-		hclBody.AppendNewline()
-		tfBody := hclBody.AppendNewBlock("terraform", []string{}).Body()
-		backendBlock := tfBody.AppendNewBlock("backend", []string{tfBackend.Type})
-		backendBody := backendBlock.Body()
-		vals := tfBackend.Configuration.Items()
-		for _, setting := range orderKeys(vals) {
-			backendBody.SetAttributeValue(setting, vals[setting])
-		}
+// appendBackend writes the Terraform backend if needed, local-encrypted is
+// local state encrypted by ghpc
+func appendBackend(hclBody *hclwrite.Body, tfBackend config.TerraformBackend) {
+	if tfBackend.Type == "" || tfBackend.Type == config.LocalEncryptedBackend {
+		return
+	}
+	hclBody.AppendNewline()
+	tfBody := hclBody.AppendNewBlock("terraform", []string{}).Body()
+	backendBlock := tfBody.AppendNewBlock("backend", []string{tfBackend.Type})
+	backendBody := backendBlock.Body()
+	vals := tfBackend.Configuration.Items()
+	for _, setting := range orderKeys(vals) {
+		backendBody.SetAttributeValue(setting, vals[setting])
 	}
+}
 
+func appendModules(hclBody *hclwrite.Body, modules []config.Module) error {
 	for _, mod := range modules {
 		hclBody.AppendNewline()
 		// Add block
@@ -180,13 +215,54 @@ func writeMain(
 			moduleBody.SetAttributeRaw(setting, config.TokensForValue(value))
 		}
 	}
+	return nil
+}
 
-	return writeHclFile(filepath.Join(dst, "main.tf"), hclFile)
+// appendMoves moves resources of renamed modules, terraform ignores moves of
+// modules absent in the state, so blocks can be kept after the rename was
+// applied
+func appendMoves(hclBody *hclwrite.Body, modules []config.Module) {
+	for _, mod := range modules {
+		if mod.RenamedFrom == "" || mod.RenamedFrom == mod.ID {
+			continue
+		}
+		hclBody.AppendNewline()
+		movedBody := hclBody.AppendNewBlock("moved", []string{}).Body()
+		movedBody.SetAttributeRaw("from", simpleTokens("module."+string(mod.RenamedFrom)))
+		movedBody.SetAttributeRaw("to", simpleTokens("module."+string(mod.ID)))
+	}
+}
+
+// appendImports adopts existing resources, terraform ignores imports of
+// resources already in the state
+func appendImports(hclBody *hclwrite.Body, modules []config.Module) error {
+	for _, mod := range modules {
+		imports := mod.Import.Items()
+		for _, addr := range orderKeys(imports) {
+			id, err := convert.Convert(imports[addr], cty.String)
+			if err != nil || id.IsNull() || !id.IsKnown() {
+				return fmt.Errorf("ID of resource %s imported by module %s must be a string", addr, mod.ID)
+			}
+			hclBody.AppendNewline()
+			importBody := hclBody.AppendNewBlock("import", []string{}).Body()
+			importBody.SetAttributeRaw("to", simpleTokens(fmt.Sprintf("module.%s.%s", mod.ID, addr)))
+			importBody.SetAttributeValue("id", id)
+		}
+	}
+	return nil
 }
 
 var simpleTokens = hclwrite.TokensForIdentifier
 
-func writeProviders(vars map[string]cty.Value, dst string) error {
+// providerProjectVar is the variable providers take the project from, if any
+func providerProjectVar(vars map[string]cty.Value) string {
+	if _, ok := vars["project_id"]; ok {
+		return "project_id"
+	}
+	return ""
+}
+
+func writeProviders(vars map[string]cty.Value, projectVar string, dst string) error {
 	hclFile := hclwrite.NewEmptyFile()
 	hclBody := hclFile.Body()
 
@@ -194,8 +270,8 @@ func writeProviders(vars map[string]cty.Value, dst string) error {
 		hclBody.AppendNewline()
 		provBlock := hclBody.AppendNewBlock("provider", []string{prov})
 		provBody := provBlock.Body()
-		if _, ok := vars["project_id"]; ok {
-			provBody.SetAttributeRaw("project", simpleTokens("var.project_id"))
+		if projectVar != "" {
+			provBody.SetAttributeRaw("project", simpleTokens("var."+projectVar))
 		}
 		if _, ok := vars["zone"]; ok {
 			provBody.SetAttributeRaw("zone", simpleTokens("var.zone"))
@@ -207,12 +283,38 @@ func writeProviders(vars map[string]cty.Value, dst string) error {
 	return writeHclFile(filepath.Join(dst, "providers.tf"), hclFile)
 }
 
-func writeVersions(dst string) error {
+// evalImports returns copies of modules with IDs of imported resources
+// evaluated, import blocks only accept literal IDs before terraform 1.6
+func evalImports(bp config.Blueprint, mods []config.Module) ([]config.Module, error) {
+	res := make([]config.Module, len(mods))
+	for i, m := range mods {
+		imp, err := m.Import.Eval(bp)
+		if err != nil {
+			return nil, err
+		}
+		m.Import = imp
+		res[i] = m
+	}
+	return res, nil
+}
+
+// requiredTerraformVersion is the constraint on the terraform version of a
+// group, import blocks were introduced in terraform 1.5
+func requiredTerraformVersion(mods []config.Module) string {
+	for _, m := range mods {
+		if !m.Import.IsZero() {
+			return ">= 1.5"
+		}
+	}
+	return ">= 1.2"
+}
+
+func writeVersions(dst string, tfVersion string) error {
 	f := hclwrite.NewEmptyFile()
 	body := f.Body()
 	body.AppendNewline()
 	tfb := body.AppendNewBlock("terraform", []string{}).Body()
-	tfb.SetAttributeValue("required_version", cty.StringVal(">= 1.2"))
+	tfb.SetAttributeValue("required_version", cty.StringVal(tfVersion))
 	tfb.AppendNewline()
 
 	type provider struct {
@@ -236,101 +338,142 @@ func writeVersions(dst string) error {
 	return writeHclFile(filepath.Join(dst, "versions.tf"), f)
 }
 
-func writeTerraformInstructions(w io.Writer, grpPath string, n config.GroupName, printExportOutputs bool, printImportInputs bool) {
+func writeTerraformInstructions(w io.Writer, grpPath string, n config.GroupName, printExportOutputs bool, printImportInputs bool, cliConfig string) {
 	fmt.Fprintln(w)
 	fmt.Fprintf(w, "Terraform group '%s' was successfully created in directory %s\n", n, grpPath)
 	fmt.Fprintln(w, "To deploy, run the following commands:")
 	fmt.Fprintln(w)
+	for _, cmd := range terraformCommands(grpPath, printExportOutputs, printImportInputs, cliConfig) {
+		fmt.Fprintln(w, cmd)
+	}
+}
+
+// terraformCommands returns the commands deploying a terraform group by hand
+func terraformCommands(grpPath string, printExportOutputs bool, printImportInputs bool, cliConfig string) []string {
+	cmds := []string{}
 	if printImportInputs {
-		fmt.Fprintf(w, "ghpc import-inputs %s\n", grpPath)
+		cmds = append(cmds, fmt.Sprintf("ghpc import-inputs %s", grpPath))
+	}
+	if cliConfig != "" {
+		cmds = append(cmds, fmt.Sprintf("export TF_CLI_CONFIG_FILE=%s", cliConfig))
 	}
-	fmt.Fprintf(w, "terraform -chdir=%s init\n", grpPath)
-	fmt.Fprintf(w, "terraform -chdir=%s validate\n", grpPath)
-	fmt.Fprintf(w, "terraform -chdir=%s apply\n", grpPath)
+	cmds = append(cmds,
+		fmt.Sprintf("terraform -chdir=%s init", grpPath),
+		fmt.Sprintf("terraform -chdir=%s validate", grpPath),
+		fmt.Sprintf("terraform -chdir=%s apply", grpPath))
 	if printExportOutputs {
-		fmt.Fprintf(w, "ghpc export-outputs %s\n", grpPath)
+		cmds = append(cmds, fmt.Sprintf("ghpc export-outputs %s", grpPath))
 	}
+	return cmds
 }
 
-// writeDeploymentGroup creates and sets up the terraform deployment group
-func (w TFWriter) writeDeploymentGroup(
-	bp config.Blueprint,
-	groupIndex int,
-	groupPath string,
-	instructions io.Writer,
-) error {
-	g := bp.DeploymentGroups[groupIndex]
-	deploymentVars, err := getUsedDeploymentVars(g, bp)
-	if err != nil {
-		return err
-	}
-	intergroupVars := FindIntergroupVariables(g, bp)
-	intergroupInputs := make(map[string]bool)
-	for _, igVar := range intergroupVars {
-		intergroupInputs[igVar.Name] = true
-	}
+// tfGroup is what files of a terraform deployment group are written from
+type tfGroup struct {
+	bp             config.Blueprint
+	index          int
+	g              config.DeploymentGroup // terraform modules of the group
+	path           string
+	be             config.TerraformBackend // evaluated
+	deploymentVars map[string]cty.Value
+	intergroupVars map[config.Reference]modulereader.VarInfo
+	runtimeVars    map[config.Reference]modulereader.VarInfo
+	// modules with intergroup and runtime references substituted, and imports
+	// evaluated
+	modules []config.Module
+}
 
-	be := g.TerraformBackend
-	if be.Configuration, err = be.Configuration.Eval(bp); err != nil {
-		return err
-	}
+// tfGroupFiles are the files of a terraform deployment group, written in order
+var tfGroupFiles = []struct {
+	name  string
+	write func(tg tfGroup) error
+}{
+	{"main.tf", func(tg tfGroup) error { return writeMain(tg.modules, tg.be, tg.path) }},
+	{"variables.tf", func(tg tfGroup) error {
+		extraVars := append(maps.Values(tg.intergroupVars), maps.Values(tg.runtimeVars)...)
+		return writeVariables(tg.deploymentVars, tg.bp.SecretVars(), extraVars, tg.path)
+	}},
+	{"outputs.tf", func(tg tfGroup) error { return writeOutputs(tg.g.Modules, tg.path) }},
+	{"terraform.tfvars", func(tg tfGroup) error { return writeTfvars(tg.deploymentVars, tg.bp.SecretVars(), tg.path) }},
+	{"providers.tf", func(tg tfGroup) error {
+		// groups following the bootstrap group use the project it created
+		projectVar := providerProjectVar(tg.deploymentVars)
+		if ref, ib, ok := tg.bp.BootstrapProject(); ok && tg.index > ib {
+			if iv, ok := tg.intergroupVars[ref]; ok {
+				projectVar = iv.Name
+			}
+		}
+		return writeProviders(tg.deploymentVars, projectVar, tg.path)
+	}},
+	{"versions.tf", func(tg tfGroup) error { return writeVersions(tg.path, requiredTerraformVersion(tg.g.Modules)) }},
+	{CLIConfigFileName, func(tg tfGroup) error { return writeCLIConfig(tg.bp.TerraformProviders, tg.path) }},
+	{StateEncryptionFileName, func(tg tfGroup) error { return writeStateEncryption(tg.be, tg.path) }},
+	{StateAccessFileName, func(tg tfGroup) error { return writeStateAccess(tg.be, tg.path) }},
+}
 
-	// Write main.tf file
-	doctoredModules, err := substituteIgcReferences(g.Modules, intergroupVars)
-	if err != nil {
-		return fmt.Errorf("error substituting intergroup references in deployment group %s: %w", g.Name, err)
+// newTFGroup gathers what files of the terraform modules of the group are
+// written from
+func newTFGroup(bp config.Blueprint, groupIndex int, groupPath string) (tfGroup, error) {
+	// Packer modules of mixed groups are written by PackerWriter
+	g := modulesOfKind(bp.DeploymentGroups[groupIndex], config.TerraformKind)
+	tg := tfGroup{bp: bp, index: groupIndex, g: g, path: groupPath, be: g.TerraformBackend}
+	var err error
+	if tg.deploymentVars, err = getUsedDeploymentVars(g, bp); err != nil {
+		return tfGroup{}, err
 	}
-	if err := writeMain(doctoredModules, be, groupPath); err != nil {
-		return fmt.Errorf("error writing main.tf file for deployment group %s: %w", g.Name, err)
+	tg.intergroupVars = FindIntergroupVariables(g, bp)
+	tg.runtimeVars = FindRuntimeVariables(g)
+	if tg.be.Configuration, err = tg.be.Configuration.Eval(bp); err != nil {
+		return tfGroup{}, err
 	}
 
-	// Write variables.tf file
-	if err := writeVariables(deploymentVars, maps.Values(intergroupVars), groupPath); err != nil {
-		return fmt.Errorf("error writing variables.tf file for deployment group %s: %w", g.Name, err)
+	if tg.modules, err = substituteIgcReferences(g.Modules, tg.intergroupVars); err != nil {
+		return tfGroup{}, fmt.Errorf("error substituting intergroup references in deployment group %s: %w", g.Name, err)
 	}
-
-	// Write outputs.tf file
-	if err := writeOutputs(g.Modules, groupPath); err != nil {
-		return fmt.Errorf("error writing outputs.tf file for deployment group %s: %w", g.Name, err)
+	if tg.modules, err = substituteIgcReferences(tg.modules, tg.runtimeVars); err != nil {
+		return tfGroup{}, fmt.Errorf("error substituting runtime references in deployment group %s: %w", g.Name, err)
 	}
-
-	// Write terraform.tfvars file
-	if err := writeTfvars(deploymentVars, groupPath); err != nil {
-		return fmt.Errorf("error writing terraform.tfvars file for deployment group %s: %w", g.Name, err)
+	if tg.modules, err = evalImports(bp, tg.modules); err != nil {
+		return tfGroup{}, fmt.Errorf("error evaluating imports of deployment group %s: %w", g.Name, err)
 	}
+	return tg, nil
+}
 
-	// Write providers.tf file
-	if err := writeProviders(deploymentVars, groupPath); err != nil {
-		return fmt.Errorf("error writing providers.tf file for deployment group %s: %w", g.Name, err)
+// writeDeploymentGroup creates and sets up the terraform deployment group
+func (w TFWriter) writeDeploymentGroup(
+	bp config.Blueprint,
+	groupIndex int,
+	groupPath string,
+	instructions io.Writer,
+) error {
+	tg, err := newTFGroup(bp, groupIndex, groupPath)
+	if err != nil {
+		return err
 	}
-
-	// Write versions.tf file
-	if err := writeVersions(groupPath); err != nil {
-		return fmt.Errorf("error writing versions.tf file for deployment group %s: %v", g.Name, err)
+	for _, f := range tfGroupFiles {
+		if err := f.write(tg); err != nil {
+			return fmt.Errorf("error writing %s file for deployment group %s: %w", f.name, tg.g.Name, err)
+		}
 	}
 
 	multiGroupDeployment := len(bp.DeploymentGroups) > 1
-	printImportInputs := multiGroupDeployment && groupIndex > 0
+	printImportInputs := (multiGroupDeployment && groupIndex > 0) || len(tg.runtimeVars) > 0 || len(bp.ZonePolicyVarsOf(tg.g)) > 0
 	printExportOutputs := multiGroupDeployment && groupIndex < len(bp.DeploymentGroups)-1
 
-	writeTerraformInstructions(instructions, groupPath, g.Name, printExportOutputs, printImportInputs)
+	cliConfig, _ := CLIConfigFile(groupPath)
+	writeTerraformInstructions(instructions, groupPath, tg.g.Name, printExportOutputs, printImportInputs, cliConfig)
 
 	return nil
 }
 
 // Transfers state files from previous resource groups (in .ghpc/) to a newly written blueprint
-func (w TFWriter) restoreState(deploymentDir string) error {
-	prevDeploymentGroupPath := filepath.Join(HiddenGhpcDir(deploymentDir), prevDeploymentGroupDirName)
-	files, err := os.ReadDir(prevDeploymentGroupPath)
-	if err != nil {
-		return fmt.Errorf("error trying to read previous modules in %s, %w", prevDeploymentGroupPath, err)
-	}
-
-	for _, f := range files {
-		var tfStateFiles = []string{tfStateFileName, tfStateBackupFileName}
+func (w TFWriter) restoreState(bp config.Blueprint, deploymentDir string) error {
+	for _, g := range bp.DeploymentGroups {
+		prevGroupPath := PrevGroupDir(deploymentDir, bp, g.Name)
+		// keep provider selections of the previous deployment unless regenerated
+		var tfStateFiles = []string{tfStateFileName, tfStateBackupFileName, EncryptedStateFileName, tfLockFileName}
 		for _, stateFile := range tfStateFiles {
-			src := filepath.Join(prevDeploymentGroupPath, f.Name(), stateFile)
-			dest := filepath.Join(deploymentDir, f.Name(), stateFile)
+			src := filepath.Join(prevGroupPath, stateFile)
+			dest := filepath.Join(GroupDir(deploymentDir, bp, g.Name), stateFile)
 
 			if bytesRead, err := os.ReadFile(src); err == nil {
 				err = os.WriteFile(dest, bytesRead, 0644)
@@ -429,6 +572,21 @@ func FindIntergroupVariables(group config.DeploymentGroup, bp config.Blueprint)
 	return res
 }
 
+// FindRuntimeVariables returns variables of the group holding runtime values,
+// they are set by `ghpc import-inputs` before the group is applied
+func FindRuntimeVariables(group config.DeploymentGroup) map[config.Reference]modulereader.VarInfo {
+	res := map[config.Reference]modulereader.VarInfo{}
+	for _, r := range group.RuntimeReferences() {
+		res[r] = modulereader.VarInfo{
+			Name:        config.RuntimeVarName(r.Name),
+			Type:        cty.String,
+			Description: fmt.Sprintf("Runtime value %s, resolved when the group is deployed (ghpc import-inputs --help)", r.Name),
+			Required:    true,
+		}
+	}
+	return res
+}
+
 func (w TFWriter) kind() config.ModuleKind {
 	return config.TerraformKind
 }
@@ -0,0 +1,130 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Email sends events to recipients, through an SMTP server or SendGrid.
+// Secrets are read from environment variables, not kept in the config file.
+type Email struct {
+	From string   `yaml:"from"`
+	To   []string `yaml:"to"`
+	SMTP *SMTP    `yaml:"smtp,omitempty"`
+	// SendGridKeyEnv is the environment variable holding the SendGrid API key
+	SendGridKeyEnv string `yaml:"sendgrid_api_key_env,omitempty"`
+}
+
+// SMTP is a mail server, authentication is skipped without Username
+type SMTP struct {
+	Host        string `yaml:"host"`
+	Port        int    `yaml:"port,omitempty"` // 587 by default
+	Username    string `yaml:"username,omitempty"`
+	PasswordEnv string `yaml:"password_env,omitempty"`
+}
+
+func (m Email) validate() error {
+	if m.From == "" || len(m.To) == 0 {
+		return errors.New("email from and to must be set")
+	}
+	if (m.SMTP == nil) == (m.SendGridKeyEnv == "") {
+		return errors.New("email must set exactly one of smtp or sendgrid_api_key_env")
+	}
+	if m.SMTP != nil && m.SMTP.Host == "" {
+		return errors.New("email smtp host must be set")
+	}
+	return nil
+}
+
+func (m Email) send(e Event) error {
+	if m.SMTP != nil {
+		return m.sendSMTP(e)
+	}
+	return m.sendSendGrid(e)
+}
+
+// sendMail sends a message through an SMTP server, it is replaced in tests
+var sendMail = smtp.SendMail
+
+func (m Email) sendSMTP(e Event) error {
+	port := m.SMTP.Port
+	if port == 0 {
+		port = 587
+	}
+	var auth smtp.Auth
+	if m.SMTP.Username != "" {
+		auth = smtp.PlainAuth("", m.SMTP.Username, os.Getenv(m.SMTP.PasswordEnv), m.SMTP.Host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\n", m.From, strings.Join(m.To, ", "), e.Subject())
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(e.Text(), "\n", "\r\n"))
+	addr := net.JoinHostPort(m.SMTP.Host, strconv.Itoa(port))
+	return sendMail(addr, auth, m.From, m.To, msg.Bytes())
+}
+
+// sendGridURL is the endpoint of the SendGrid mail API, it is replaced in tests
+var sendGridURL = "https://api.sendgrid.com/v3/mail/send"
+
+func (m Email) sendSendGrid(e Event) error {
+	key := os.Getenv(m.SendGridKeyEnv)
+	if key == "" {
+		return fmt.Errorf("environment variable %s holding the SendGrid API key is not set", m.SendGridKeyEnv)
+	}
+	type address struct {
+		Email string `json:"email"`
+	}
+	to := []address{}
+	for _, t := range m.To {
+		to = append(to, address{t})
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"personalizations": []interface{}{map[string]interface{}{"to": to}},
+		"from":             address{m.From},
+		"subject":          e.Subject(),
+		"content":          []interface{}{map[string]string{"type": "text/plain", "value": e.Text()}},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sendGridURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("SendGrid responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package notifications posts deployment lifecycle events to endpoints
+// configured by the user
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/logging"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// Types of events
+const (
+	DeploymentCreated = "deployment_created"
+	GroupApplied      = "group_applied"
+	DeployCompleted   = "deploy_completed"
+	DeployFailed      = "deploy_failed"
+	DestroyCompleted  = "destroy_completed"
+	DestroyFailed     = "destroy_failed"
+	ValidationFailed  = "validation_failed"
+)
+
+var eventTypes = []string{DeploymentCreated, GroupApplied, DeployCompleted, DeployFailed, DestroyCompleted, DestroyFailed, ValidationFailed}
+
+// Formats of webhooks
+const (
+	FormatJSON  = "json"  // the event as is
+	FormatSlack = "slack" // a message of Slack incoming webhooks
+)
+
+const sendTimeout = 10 * time.Second
+
+// maxErrorLength bounds errors sent with events, only the end of longer errors,
+// e.g. of terraform, is kept
+const maxErrorLength = 2000
+
+// Event describes a change in the lifecycle of a deployment
+type Event struct {
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	Deployment  string    `json:"deployment"`
+	Blueprint   string    `json:"blueprint,omitempty"`
+	GhpcVersion string    `json:"ghpc_version,omitempty"`
+	Group       string    `json:"group,omitempty"`
+	// Duration of the deploy or destroy, e.g. "1h2m3s"
+	Duration string         `json:"duration,omitempty"`
+	Groups   []GroupSummary `json:"groups,omitempty"`
+	Errors   []string       `json:"errors,omitempty"`
+}
+
+// Group statuses of deploys and destroys
+const (
+	GroupStatusApplied   = "applied"
+	GroupStatusSkipped   = "skipped" // deployed before the deploy was resumed
+	GroupStatusDestroyed = "destroyed"
+	GroupStatusFailed    = "failed"
+)
+
+// GroupSummary is the outcome of a deployment group in a deploy or destroy
+type GroupSummary struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// Webhook is an HTTP endpoint events are posted to, as JSON or as a Slack
+// message
+type Webhook struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+	Format  string            `yaml:"format,omitempty"` // json by default
+}
+
+// Config lists endpoints to notify and the types of events to send,
+// all events are sent if Events is empty
+type Config struct {
+	Webhooks     []Webhook `yaml:"webhooks,omitempty"`
+	PubSubTopics []string  `yaml:"pubsub_topics,omitempty"` // in form projects/PROJECT/topics/TOPIC
+	Emails       []Email   `yaml:"emails,omitempty"`
+	Events       []string  `yaml:"events,omitempty"`
+}
+
+// Validate ensures that endpoints are set and event types are known
+func (c Config) Validate() error {
+	for _, w := range c.Webhooks {
+		if w.URL == "" {
+			return errors.New("webhook url must be set")
+		}
+		if w.Format != "" && w.Format != FormatJSON && w.Format != FormatSlack {
+			return fmt.Errorf("unknown webhook format %q, expected %q or %q", w.Format, FormatJSON, FormatSlack)
+		}
+	}
+	for _, m := range c.Emails {
+		if err := m.validate(); err != nil {
+			return err
+		}
+	}
+	for _, t := range c.PubSubTopics {
+		if t == "" {
+			return errors.New("pubsub topic must not be empty")
+		}
+	}
+	for _, e := range c.Events {
+		if !slices.Contains(eventTypes, e) {
+			return fmt.Errorf("unknown event type %q, expected one of %q", e, eventTypes)
+		}
+	}
+	return nil
+}
+
+func (c Config) wants(e Event) bool {
+	return len(c.Events) == 0 || slices.Contains(c.Events, e.Type)
+}
+
+// Notify sends the event to endpoints of the config. Notifications must not
+// interrupt operations on the deployment, so failures are only reported.
+func Notify(c Config, e Event) {
+	if err := Send(c, e); err != nil {
+		logging.Error("failed to send %s notification: %v", e.Type, err)
+	}
+}
+
+// Send delivers the event to all endpoints of the config
+func Send(c Config, e Event) error {
+	if !c.wants(e) {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	e.Errors = slices.Clone(e.Errors)
+	for i, err := range e.Errors {
+		e.Errors[i] = errorExcerpt(err)
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, w := range c.Webhooks {
+		body := b
+		if w.Format == FormatSlack {
+			if body, err = json.Marshal(map[string]string{"text": e.Subject() + "\n" + e.Text()}); err != nil {
+				return err
+			}
+		}
+		errs = append(errs, postWebhook(w, body))
+	}
+	for _, t := range c.PubSubTopics {
+		errs = append(errs, publish(t, e, b))
+	}
+	for _, m := range c.Emails {
+		errs = append(errs, m.send(e))
+	}
+	return errors.Join(errs...)
+}
+
+// errorExcerpt keeps the end of long errors, where terraform reports the cause
+func errorExcerpt(err string) string {
+	if len(err) <= maxErrorLength {
+		return err
+	}
+	return "..." + err[len(err)-maxErrorLength:]
+}
+
+// Subject summarizes the event on a line, e.g. for emails
+func (e Event) Subject() string {
+	what := map[string]string{
+		DeploymentCreated: "created",
+		GroupApplied:      fmt.Sprintf("deployment group %s applied", e.Group),
+		DeployCompleted:   "deployed",
+		DeployFailed:      "failed to deploy",
+		DestroyCompleted:  "destroyed",
+		DestroyFailed:     "failed to destroy",
+		ValidationFailed:  "failed validation",
+	}[e.Type]
+	return fmt.Sprintf("ghpc: deployment %s %s", e.Deployment, what)
+}
+
+// Text describes the event for people, as the body of emails and messages
+func (e Event) Text() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Deployment: %s\n", e.Deployment)
+	if e.Blueprint != "" {
+		fmt.Fprintf(&sb, "Blueprint: %s\n", e.Blueprint)
+	}
+	if e.Duration != "" {
+		fmt.Fprintf(&sb, "Duration: %s\n", e.Duration)
+	}
+	if len(e.Groups) > 0 {
+		sb.WriteString("Groups:\n")
+	}
+	for _, g := range e.Groups {
+		if g.Duration != "" {
+			fmt.Fprintf(&sb, "  %s: %s in %s\n", g.Name, g.Status, g.Duration)
+		} else {
+			fmt.Fprintf(&sb, "  %s: %s\n", g.Name, g.Status)
+		}
+	}
+	for _, err := range e.Errors {
+		fmt.Fprintf(&sb, "Error:\n%s\n", err)
+	}
+	return sb.String()
+}
+
+// webhookHost identifies the webhook in errors by scheme and host, the path
+// and query of webhook URLs often hold their secret token
+func webhookHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "with invalid URL"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func postWebhook(w Webhook, body []byte) error {
+	host := webhookHost(w.URL)
+	err := doPostWebhook(w, body)
+	var ue *url.Error
+	if errors.As(err, &ue) { // it quotes the full URL
+		return fmt.Errorf("webhook %s: %s failed: %w", host, ue.Op, ue.Err)
+	}
+	if err != nil {
+		return fmt.Errorf("webhook %s: %w", host, err)
+	}
+	return nil
+}
+
+func doPostWebhook(w Webhook, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// publish sends the event to the Pub/Sub topic using application default
+// credentials, it is replaced in tests
+var publish = func(topic string, e Event, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	s, err := pubsub.NewService(ctx)
+	if err != nil {
+		return err
+	}
+	msg := &pubsub.PubsubMessage{
+		Data:       base64.StdEncoding.EncodeToString(body),
+		Attributes: map[string]string{"type": e.Type, "deployment": e.Deployment},
+	}
+	_, err = s.Projects.Topics.Publish(topic, &pubsub.PublishRequest{Messages: []*pubsub.PubsubMessage{msg}}).Context(ctx).Do()
+	return err
+}
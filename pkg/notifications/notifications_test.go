@@ -0,0 +1,168 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifications
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *MySuite) TestValidate(c *C) {
+	c.Check(Config{}.Validate(), IsNil)
+	c.Check(Config{Webhooks: []Webhook{{URL: "https://hooks.example.com/ghpc", Format: FormatSlack}}}.Validate(), IsNil)
+	c.Check(Config{Webhooks: []Webhook{{}}}.Validate(), ErrorMatches, "webhook url must be set")
+	c.Check(Config{Events: []string{"cluster_exploded"}}.Validate(), ErrorMatches, `unknown event type "cluster_exploded".*`)
+}
+
+func (s *MySuite) TestSend(c *C) {
+	received := []Event{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("X-Team"), Equals, "hpc")
+		var e Event
+		c.Check(json.NewDecoder(r.Body).Decode(&e), IsNil)
+		received = append(received, e)
+	}))
+	defer srv.Close()
+
+	published := []string{}
+	orig := publish
+	publish = func(topic string, e Event, _ []byte) error {
+		published = append(published, topic+":"+e.Type)
+		return nil
+	}
+	defer func() { publish = orig }()
+
+	cfg := Config{
+		Webhooks:     []Webhook{{URL: srv.URL, Headers: map[string]string{"X-Team": "hpc"}}},
+		PubSubTopics: []string{"projects/p/topics/t"},
+		Events:       []string{GroupApplied}}
+
+	c.Check(Send(cfg, Event{Type: GroupApplied, Deployment: "hpc-small", Group: "primary"}), IsNil)
+	c.Check(Send(cfg, Event{Type: DeploymentCreated, Deployment: "hpc-small"}), IsNil) // filtered out
+
+	c.Assert(received, HasLen, 1)
+	c.Check(received[0].Deployment, Equals, "hpc-small")
+	c.Check(received[0].Group, Equals, "primary")
+	c.Check(received[0].Time.IsZero(), Equals, false)
+	c.Check(published, DeepEquals, []string{"projects/p/topics/t:group_applied"})
+
+	{ // Fail: endpoint errors are reported
+		publish = func(string, Event, []byte) error { return errors.New("permission denied") }
+		cfg.Webhooks[0].URL = srv.URL + "/missing"
+		srv.Config.Handler = http.NotFoundHandler()
+		err := Send(cfg, Event{Type: GroupApplied})
+		c.Check(err, ErrorMatches, "(?s)webhook http://127.0.0.1:[0-9]+: responded with 404 Not Found.*permission denied.*")
+	}
+
+	{ // Fail: secret paths and queries of webhook URLs are not reported
+		publish = func(string, Event, []byte) error { return nil }
+		srv.Close()
+		cfg.Webhooks[0].URL = srv.URL + "/hooks/s3cr3t?token=s3cr3t"
+		err := Send(cfg, Event{Type: GroupApplied})
+		c.Check(err, ErrorMatches, "webhook http://127.0.0.1:[0-9]+: Post failed: .*")
+		c.Check(strings.Contains(err.Error(), "s3cr3t"), Equals, false)
+
+		cfg.Webhooks[0].URL = "http://[::1/s3cr3t"
+		err = Send(cfg, Event{Type: GroupApplied})
+		c.Check(err, ErrorMatches, "webhook with invalid URL: parse failed: .*")
+		c.Check(strings.Contains(err.Error(), "s3cr3t"), Equals, false)
+	}
+}
+
+func (s *MySuite) TestSendFormats(c *C) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(json.NewDecoder(r.Body).Decode(&body), IsNil)
+	}))
+	defer srv.Close()
+
+	e := Event{
+		Type:       DeployFailed,
+		Deployment: "hpc-small",
+		Duration:   "1h2m3s",
+		Groups: []GroupSummary{
+			{Name: "primary", Status: GroupStatusApplied, Duration: "2m0s"},
+			{Name: "cluster", Status: GroupStatusFailed, Duration: "1h0m3s"}},
+		Errors: []string{strings.Repeat("x", 3*maxErrorLength) + "quota exceeded"}}
+
+	{ // Slack message
+		cfg := Config{Webhooks: []Webhook{{URL: srv.URL, Format: FormatSlack}}}
+		c.Assert(Send(cfg, e), IsNil)
+		text, _ := body["text"].(string)
+		c.Check(text, Matches, `(?s)ghpc: deployment hpc-small failed to deploy
+Deployment: hpc-small
+Duration: 1h2m3s
+Groups:
+  primary: applied in 2m0s
+  cluster: failed in 1h0m3s
+Error:
+\.\.\.x+quota exceeded
+`)
+		c.Check(len(text) < 3*maxErrorLength, Equals, true)
+	}
+
+	{ // SendGrid
+		orig := sendGridURL
+		sendGridURL = srv.URL
+		defer func() { sendGridURL = orig }()
+		os.Setenv("TEST_SENDGRID_KEY", "key")
+		defer os.Unsetenv("TEST_SENDGRID_KEY")
+		cfg := Config{Emails: []Email{{From: "ghpc@example.com", To: []string{"ops@example.com"}, SendGridKeyEnv: "TEST_SENDGRID_KEY"}}}
+		c.Assert(Send(cfg, e), IsNil)
+		c.Check(body["subject"], Equals, "ghpc: deployment hpc-small failed to deploy")
+		c.Check(body["from"], DeepEquals, map[string]interface{}{"email": "ghpc@example.com"})
+
+		os.Unsetenv("TEST_SENDGRID_KEY")
+		c.Check(Send(cfg, e), ErrorMatches, ".*TEST_SENDGRID_KEY.*is not set")
+	}
+
+	{ // SMTP
+		orig := sendMail
+		defer func() { sendMail = orig }()
+		var addr string
+		var msg []byte
+		sendMail = func(a string, _ smtp.Auth, from string, to []string, m []byte) error {
+			addr, msg = a, m
+			return nil
+		}
+		cfg := Config{Emails: []Email{{From: "ghpc@example.com", To: []string{"ops@example.com"}, SMTP: &SMTP{Host: "smtp.example.com"}}}}
+		c.Assert(Send(cfg, e), IsNil)
+		c.Check(addr, Equals, "smtp.example.com:587")
+		c.Check(string(msg), Matches, "(?s)From: ghpc@example.com\r\nTo: ops@example.com\r\nSubject: ghpc: deployment hpc-small failed to deploy\r\n.*Duration: 1h2m3s\r\n.*")
+	}
+}
+
+func (s *MySuite) TestValidateEndpoints(c *C) {
+	c.Check(Config{Webhooks: []Webhook{{URL: "https://x", Format: "teams"}}}.Validate(), ErrorMatches, `unknown webhook format "teams".*`)
+	c.Check(Config{Emails: []Email{{From: "a@example.com", To: []string{"b@example.com"}}}}.Validate(), ErrorMatches, "email must set exactly one of smtp or sendgrid_api_key_env")
+	c.Check(Config{Emails: []Email{{From: "a@example.com", SendGridKeyEnv: "K"}}}.Validate(), ErrorMatches, "email from and to must be set")
+	c.Check(Config{Emails: []Email{{From: "a@example.com", To: []string{"b@example.com"}, SMTP: &SMTP{Port: 25}}}}.Validate(), ErrorMatches, "email smtp host must be set")
+}
@@ -0,0 +1,181 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pricing estimates monthly costs of cloud resources from a catalog
+// of list prices embedded in ghpc
+package pricing
+
+import (
+	_ "embed"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// HoursPerMonth is the number of hours VMs are billed for in a month
+const HoursPerMonth = 730
+
+//go:embed catalog.yaml
+var catalogYaml []byte
+
+// MachineFamily prices VMs of a machine family by vCPU and memory
+type MachineFamily struct {
+	VCPU          float64            `yaml:"vcpu"`
+	MemoryGB      float64            `yaml:"memory_gb"`
+	MemoryPerVCPU map[string]float64 `yaml:"memory_per_vcpu"`
+}
+
+// Catalog holds list prices in USD, see catalog.yaml
+type Catalog struct {
+	MachineFamilies map[string]MachineFamily `yaml:"machine_families"`
+	// MachineTypes are hourly prices of machine types
+	MachineTypes map[string]float64 `yaml:"machine_types"`
+	// GPUs are hourly prices of guest accelerators
+	GPUs map[string]float64 `yaml:"gpus"`
+	// Disks are monthly prices of a GB of persistent disk, by disk type
+	Disks map[string]float64 `yaml:"disks"`
+	// Filestore are monthly prices of a GB of capacity, by tier
+	Filestore  map[string]float64 `yaml:"filestore"`
+	SpotFactor float64            `yaml:"spot_factor"`
+}
+
+// DefaultCatalog returns the catalog embedded in ghpc
+func DefaultCatalog() (Catalog, error) {
+	var c Catalog
+	if err := yaml.Unmarshal(catalogYaml, &c); err != nil {
+		return Catalog{}, fmt.Errorf("invalid pricing catalog: %w", err)
+	}
+	return c, nil
+}
+
+// MachineHourly returns the hourly price of a machine type, given by name or
+// URL, including predefined and custom types of families of the catalog
+func (c Catalog) MachineHourly(machineType string) (float64, bool) {
+	mt := path.Base(machineType)
+	if p, ok := c.MachineTypes[mt]; ok {
+		return p, true
+	}
+	parts := strings.Split(strings.TrimSuffix(mt, "-ext"), "-")
+
+	// custom machine types are named [FAMILY-]custom-VCPUS-MEMORY_MB
+	if i := slices.Index(parts, "custom"); i >= 0 && i <= 1 && len(parts) == i+3 {
+		family := "n1"
+		if i == 1 {
+			family = parts[0]
+		}
+		f, ok := c.MachineFamilies[family]
+		vcpus, errC := strconv.Atoi(parts[i+1])
+		mem, errM := strconv.Atoi(parts[i+2])
+		if !ok || errC != nil || errM != nil {
+			return 0, false
+		}
+		return f.VCPU*float64(vcpus) + f.MemoryGB*float64(mem)/1024, true
+	}
+
+	if len(parts) != 3 {
+		return 0, false
+	}
+	f, ok := c.MachineFamilies[parts[0]]
+	if !ok {
+		return 0, false
+	}
+	ratio, ok := f.MemoryPerVCPU[parts[1]]
+	vcpus, err := strconv.Atoi(parts[2])
+	if !ok || err != nil {
+		return 0, false
+	}
+	return (f.VCPU + f.MemoryGB*ratio) * float64(vcpus), true
+}
+
+// Monthly returns the estimated monthly cost of a terraform resource given its
+// attribute values, as in terraform plans. It returns false for resources the
+// catalog does not price, many of them, e.g. networks, are free.
+func (c Catalog) Monthly(resourceType string, values map[string]interface{}) (float64, bool) {
+	switch resourceType {
+	case "google_compute_instance":
+		return c.instanceMonthly(values)
+	case "google_compute_disk", "google_compute_region_disk":
+		return c.diskMonthly(str(values, "type"), num(values, "size"))
+	case "google_filestore_instance":
+		p, ok := c.Filestore[str(values, "tier")]
+		return p * num(block(values, "file_shares"), "capacity_gb"), ok
+	default:
+		return 0, false
+	}
+}
+
+func (c Catalog) instanceMonthly(values map[string]interface{}) (float64, bool) {
+	hourly, ok := c.MachineHourly(str(values, "machine_type"))
+	if !ok {
+		return 0, false
+	}
+	for _, g := range blocks(values, "guest_accelerator") {
+		p, ok := c.GPUs[path.Base(str(g, "type"))]
+		if !ok {
+			return 0, false
+		}
+		hourly += p * num(g, "count")
+	}
+	sched := block(values, "scheduling")
+	if str(sched, "provisioning_model") == "SPOT" || sched["preemptible"] == true {
+		hourly *= c.SpotFactor
+	}
+
+	params := block(block(values, "boot_disk"), "initialize_params")
+	disk, _ := c.diskMonthly(str(params, "type"), num(params, "size"))
+	return hourly*HoursPerMonth + disk, true
+}
+
+func (c Catalog) diskMonthly(diskType string, sizeGB float64) (float64, bool) {
+	if diskType == "" {
+		diskType = "pd-standard"
+	}
+	p, ok := c.Disks[path.Base(diskType)]
+	return p * sizeGB, ok
+}
+
+// values of resources are decoded from JSON, unknown values are missing
+
+func str(values map[string]interface{}, key string) string {
+	s, _ := values[key].(string)
+	return s
+}
+
+func num(values map[string]interface{}, key string) float64 {
+	n, _ := values[key].(float64)
+	return n
+}
+
+func blocks(values map[string]interface{}, key string) []map[string]interface{} {
+	l, _ := values[key].([]interface{})
+	res := []map[string]interface{}{}
+	for _, i := range l {
+		if m, ok := i.(map[string]interface{}); ok {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// block returns the first nested block, blocks limited to one item are lists
+func block(values map[string]interface{}, key string) map[string]interface{} {
+	if bs := blocks(values, key); len(bs) > 0 {
+		return bs[0]
+	}
+	return map[string]interface{}{}
+}
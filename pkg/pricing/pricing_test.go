@@ -0,0 +1,131 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pricing
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func testCatalog() Catalog {
+	return Catalog{
+		MachineFamilies: map[string]MachineFamily{
+			"n1": {VCPU: 0.03, MemoryGB: 0.004, MemoryPerVCPU: map[string]float64{"standard": 3.75}},
+			"n2": {VCPU: 0.03, MemoryGB: 0.004, MemoryPerVCPU: map[string]float64{"standard": 4, "highmem": 8}}},
+		MachineTypes: map[string]float64{"a2-highgpu-1g": 3.5},
+		GPUs:         map[string]float64{"nvidia-tesla-t4": 0.35},
+		Disks:        map[string]float64{"pd-standard": 0.04, "pd-ssd": 0.17},
+		Filestore:    map[string]float64{"BASIC_HDD": 0.16},
+		SpotFactor:   0.5,
+	}
+}
+
+func (s *MySuite) TestDefaultCatalog(c *C) {
+	cat, err := DefaultCatalog()
+	c.Assert(err, IsNil)
+	for _, mt := range []string{"n2-standard-8", "c2-standard-60", "h3-standard-88", "a2-highgpu-8g", "n1-custom-4-8192"} {
+		p, ok := cat.MachineHourly(mt)
+		c.Check(ok, Equals, true, Commentf("%s", mt))
+		c.Check(p > 0, Equals, true, Commentf("%s", mt))
+	}
+	c.Check(cat.SpotFactor > 0 && cat.SpotFactor < 1, Equals, true)
+}
+
+func (s *MySuite) TestMachineHourly(c *C) {
+	cat := testCatalog()
+	type test struct {
+		machineType string
+		price       float64
+		ok          bool
+	}
+	for _, t := range []test{
+		{"n2-standard-8", (0.03 + 0.004*4) * 8, true},
+		{"n2-highmem-2", (0.03 + 0.004*8) * 2, true},
+		{"zones/us-central1-a/machineTypes/n2-standard-8", (0.03 + 0.004*4) * 8, true},
+		{"n2-custom-4-8192", 0.03*4 + 0.004*8, true},
+		{"n2-custom-4-8192-ext", 0.03*4 + 0.004*8, true},
+		{"custom-2-4096", 0.03*2 + 0.004*4, true},
+		{"a2-highgpu-1g", 3.5, true},
+		{"n2-highcpu-8", 0, false},
+		{"m3-ultramem-32", 0, false},
+		{"", 0, false},
+	} {
+		p, ok := cat.MachineHourly(t.machineType)
+		c.Check(ok, Equals, t.ok, Commentf("%s", t.machineType))
+		c.Check(p, Equals, t.price, Commentf("%s", t.machineType))
+	}
+}
+
+func (s *MySuite) TestMonthly(c *C) {
+	cat := testCatalog()
+	vm := func() map[string]interface{} {
+		return map[string]interface{}{
+			"machine_type": "n1-standard-4",
+			"boot_disk": []interface{}{map[string]interface{}{
+				"initialize_params": []interface{}{map[string]interface{}{"size": 50.0, "type": "pd-ssd"}}}}}
+	}
+	hourly := (0.03 + 0.004*3.75) * 4
+	disk := 50 * 0.17
+
+	{ // VM with boot disk
+		p, ok := cat.Monthly("google_compute_instance", vm())
+		c.Check(ok, Equals, true)
+		c.Check(p, Equals, hourly*HoursPerMonth+disk)
+	}
+
+	{ // Spot VM with GPUs
+		v := vm()
+		v["guest_accelerator"] = []interface{}{map[string]interface{}{"type": "nvidia-tesla-t4", "count": 2.0}}
+		v["scheduling"] = []interface{}{map[string]interface{}{"provisioning_model": "SPOT"}}
+		p, ok := cat.Monthly("google_compute_instance", v)
+		c.Check(ok, Equals, true)
+		c.Check(p, Equals, (hourly+0.7)*0.5*HoursPerMonth+disk)
+	}
+
+	{ // Unknown GPU
+		v := vm()
+		v["guest_accelerator"] = []interface{}{map[string]interface{}{"type": "nvidia-h100-80gb", "count": 8.0}}
+		_, ok := cat.Monthly("google_compute_instance", v)
+		c.Check(ok, Equals, false)
+	}
+
+	{ // Disk, of the default type
+		p, ok := cat.Monthly("google_compute_disk", map[string]interface{}{"size": 100.0})
+		c.Check(ok, Equals, true)
+		c.Check(p, Equals, 4.0)
+	}
+
+	{ // Filestore
+		p, ok := cat.Monthly("google_filestore_instance", map[string]interface{}{
+			"tier":        "BASIC_HDD",
+			"file_shares": []interface{}{map[string]interface{}{"capacity_gb": 1024.0}}})
+		c.Check(ok, Equals, true)
+		c.Check(p, Equals, 0.16*1024)
+	}
+
+	{ // Not priced
+		_, ok := cat.Monthly("google_compute_network", map[string]interface{}{"name": "vpc"})
+		c.Check(ok, Equals, false)
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package providers reports terraform providers required by deployment groups
+package providers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/terraform-config-inspect/tfconfig"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Requirement is a provider required by a module of a deployment group
+type Requirement struct {
+	Provider string // source address, e.g. hashicorp/google
+	Group    config.GroupName
+	// Module is the path of the module call in the group, e.g. "network" or
+	// "network.vpc", empty for the root module of the group
+	Module string
+	// Constraints on the version of the provider, none if any version is
+	// accepted
+	Constraints []string
+	// Locked is the version selected by `terraform init`, if the group was
+	// initialized
+	Locked string
+}
+
+// Conflict is a provider whose version constraints can not be met at once by
+// modules of a deployment group
+type Conflict struct {
+	Provider string
+	Group    config.GroupName
+	// Requirements of modules of the group constraining the version
+	Requirements []Requirement
+}
+
+func (c Conflict) Error() string {
+	reqs := []string{}
+	for _, r := range c.Requirements {
+		reqs = append(reqs, fmt.Sprintf("%s requires %s", ModuleName(r.Module), strings.Join(r.Constraints, ", ")))
+	}
+	return fmt.Sprintf("no version of provider %s meets the constraints of all modules of deployment group %s: %s",
+		c.Provider, c.Group, strings.Join(reqs, "; "))
+}
+
+// ModuleName returns the module path of a requirement for display
+func ModuleName(module string) string {
+	if module == "" {
+		return "(root)"
+	}
+	return module
+}
+
+// Report is the providers required by terraform deployment groups
+type Report struct {
+	Requirements []Requirement
+	Conflicts    []Conflict
+	// Uninspected are module calls, as GROUP/MODULE, whose source is neither
+	// local nor installed by `terraform init`
+	Uninspected []string
+}
+
+// Group is the root directory of a terraform deployment group
+type Group struct {
+	Name config.GroupName
+	Dir  string
+}
+
+const defaultRegistry = "registry.terraform.io/"
+
+// providerAddress returns the source address of the provider, registry
+// providers without a namespace are from hashicorp
+func providerAddress(name string, source string) string {
+	if source == "" {
+		source = name
+	}
+	source = strings.TrimPrefix(strings.ToLower(source), defaultRegistry)
+	if !strings.Contains(source, "/") {
+		source = "hashicorp/" + source
+	}
+	return source
+}
+
+// installedModules returns directories of module calls installed by
+// `terraform init`, keyed by module path, e.g. "network.vpc"
+func installedModules(groupDir string) (map[string]string, error) {
+	b, err := os.ReadFile(filepath.Join(groupDir, ".terraform", "modules", "modules.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Modules []struct {
+			Key string
+			Dir string
+		}
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to read installed modules of %s: %w", groupDir, err)
+	}
+	res := map[string]string{}
+	for _, m := range manifest.Modules {
+		res[m.Key] = filepath.Join(groupDir, m.Dir)
+	}
+	return res, nil
+}
+
+// lockedVersions returns versions of providers selected in the dependency
+// lock file of the group, keyed by source address
+func lockedVersions(groupDir string) (map[string]string, error) {
+	path := filepath.Join(groupDir, ".terraform.lock.hcl")
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	f, diags := hclparse.NewParser().ParseHCLFile(path)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	content, diags := f.Body.Content(&hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{{Type: "provider", LabelNames: []string{"address"}}},
+	})
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	res := map[string]string{}
+	for _, b := range content.Blocks {
+		attrs, diags := b.Body.JustAttributes()
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		v := ""
+		if a, ok := attrs["version"]; ok {
+			if diags := gohcl.DecodeExpression(a.Expr, nil, &v); diags.HasErrors() {
+				return nil, diags
+			}
+		}
+		res[providerAddress(b.Labels[0], b.Labels[0])] = v
+	}
+	return res, nil
+}
+
+// isLocalSource tells whether the module source is a path relative to the
+// calling module, as written for embedded and local modules
+func isLocalSource(source string) bool {
+	return strings.HasPrefix(source, "./") || strings.HasPrefix(source, "../")
+}
+
+// inspectGroup appends providers required by modules of the group, starting
+// from its root module, to the report
+func (r *Report) inspectGroup(g Group) error {
+	installed, err := installedModules(g.Dir)
+	if err != nil {
+		return err
+	}
+	locked, err := lockedVersions(g.Dir)
+	if err != nil {
+		return err
+	}
+
+	var walk func(key string, dir string) error
+	walk = func(key string, dir string) error {
+		mod, diags := tfconfig.LoadModule(dir)
+		if diags.HasErrors() {
+			return fmt.Errorf("failed to read module %s of deployment group %s: %w", dir, g.Name, diags.Err())
+		}
+		for _, name := range sortedKeys(mod.RequiredProviders) {
+			req := mod.RequiredProviders[name]
+			addr := providerAddress(name, req.Source)
+			r.Requirements = append(r.Requirements, Requirement{
+				Provider:    addr,
+				Group:       g.Name,
+				Module:      key,
+				Constraints: req.VersionConstraints,
+				Locked:      locked[addr],
+			})
+		}
+		for _, name := range sortedKeys(mod.ModuleCalls) {
+			call := mod.ModuleCalls[name]
+			callKey := name
+			if key != "" {
+				callKey = key + "." + name
+			}
+			callDir, ok := installed[callKey]
+			if !ok && isLocalSource(call.Source) {
+				callDir, ok = filepath.Join(dir, call.Source), true
+			}
+			if !ok {
+				r.Uninspected = append(r.Uninspected, fmt.Sprintf("%s/%s", g.Name, callKey))
+				continue
+			}
+			if err := walk(callKey, callDir); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk("", g.Dir)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	ks := maps.Keys(m)
+	sort.Strings(ks)
+	return ks
+}
+
+// candidateVersions returns versions bounding the ranges allowed by the
+// constraints, with the versions following them. If any version meets all
+// constraints, one of these does.
+func candidateVersions(cs version.Constraints) []*version.Version {
+	res := []*version.Version{}
+	for _, c := range cs {
+		v, err := version.NewVersion(strings.TrimLeft(c.String(), "=!<>~ "))
+		if err != nil {
+			continue
+		}
+		s := append(v.Segments(), 0, 0, 0)[:3]
+		for _, n := range [][]int{
+			{s[0], s[1], s[2]},
+			{s[0], s[1], s[2] + 1},
+			{s[0], s[1] + 1, 0},
+			{s[0] + 1, 0, 0},
+		} {
+			res = append(res, version.Must(version.NewVersion(fmt.Sprintf("%d.%d.%d", n[0], n[1], n[2]))))
+		}
+	}
+	return res
+}
+
+// satisfiable tells whether a version of the provider meets all constraints
+func satisfiable(constraints []string) (bool, error) {
+	all := version.Constraints{}
+	for _, c := range constraints {
+		cs, err := version.NewConstraint(c)
+		if err != nil {
+			return false, err
+		}
+		all = append(all, cs...)
+	}
+	if len(all) == 0 {
+		return true, nil
+	}
+	return slices.ContainsFunc(candidateVersions(all), all.Check), nil
+}
+
+// findConflicts reports providers of a group whose constraints, gathered from
+// all its modules, can not be met at once
+func (r *Report) findConflicts() error {
+	type key struct {
+		provider string
+		group    config.GroupName
+	}
+	constraints := map[key][]string{}
+	keys := []key{}
+	for _, req := range r.Requirements {
+		k := key{req.Provider, req.Group}
+		if _, ok := constraints[k]; !ok {
+			keys = append(keys, k)
+		}
+		constraints[k] = append(constraints[k], req.Constraints...)
+	}
+	for _, k := range keys {
+		ok, err := satisfiable(constraints[k])
+		if err != nil {
+			return fmt.Errorf("invalid version constraint of provider %s in deployment group %s: %w", k.provider, k.group, err)
+		}
+		if ok {
+			continue
+		}
+		c := Conflict{Provider: k.provider, Group: k.group}
+		for _, req := range r.Requirements {
+			if req.Provider == k.provider && req.Group == k.group && len(req.Constraints) > 0 {
+				c.Requirements = append(c.Requirements, req)
+			}
+		}
+		r.Conflicts = append(r.Conflicts, c)
+	}
+	return nil
+}
+
+// Find reports providers required by modules of the terraform deployment
+// groups, sorted by provider, in order of the groups. Modules called by the
+// root module of a group are inspected if they are local, as embedded
+// modules are, or installed by `terraform init`.
+func Find(groups []Group) (Report, error) {
+	r := Report{}
+	for _, g := range groups {
+		if err := r.inspectGroup(g); err != nil {
+			return Report{}, err
+		}
+	}
+	sort.SliceStable(r.Requirements, func(i, j int) bool {
+		return r.Requirements[i].Provider < r.Requirements[j].Provider
+	})
+	if err := r.findConflicts(); err != nil {
+		return Report{}, err
+	}
+	return r, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func writeFiles(c *C, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+		c.Assert(os.WriteFile(path, []byte(content), 0644), IsNil)
+	}
+}
+
+func (s *MySuite) TestProviderAddress(c *C) {
+	c.Check(providerAddress("google", ""), Equals, "hashicorp/google")
+	c.Check(providerAddress("google", "hashicorp/google"), Equals, "hashicorp/google")
+	c.Check(providerAddress("x", "registry.terraform.io/hashicorp/google-beta"), Equals, "hashicorp/google-beta")
+	c.Check(providerAddress("x", "example.com/acme/x"), Equals, "example.com/acme/x")
+}
+
+func (s *MySuite) TestSatisfiable(c *C) {
+	check := func(cs ...string) bool {
+		ok, err := satisfiable(cs)
+		c.Assert(err, IsNil)
+		return ok
+	}
+	c.Check(check(), Equals, true)
+	c.Check(check("~> 4.84.0", ">= 3.83"), Equals, true)
+	c.Check(check(">= 4.0, < 5.0", "> 4.99.9"), Equals, true)
+	c.Check(check("~> 4.84.0", ">= 5.0"), Equals, false)
+	c.Check(check("= 4.1.0", "!= 4.1.0"), Equals, false)
+
+	_, err := satisfiable([]string{"latest"})
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestFind(c *C) {
+	dir := c.MkDir()
+	writeFiles(c, dir, map[string]string{
+		"versions.tf": `terraform {
+  required_providers {
+    google = {
+      source  = "hashicorp/google"
+      version = "~> 4.84.0"
+    }
+  }
+}`,
+		"main.tf": `
+module "network" {
+  source = "./modules/network"
+}
+module "remote" {
+  source = "github.com/example/remote"
+}
+module "uninstalled" {
+  source = "github.com/example/uninstalled"
+}`,
+		"modules/network/main.tf": `
+terraform {
+  required_providers {
+    google = {
+      version = ">= 3.83"
+    }
+  }
+}
+resource "random_id" "suffix" {}`,
+		".terraform/modules/modules.json": `{"Modules":[{"Key":"remote","Source":"github.com/example/remote","Dir":".terraform/modules/remote"}]}`,
+		".terraform/modules/remote/main.tf": `
+terraform {
+  required_providers {
+    google = {
+      version = ">= 5.0"
+    }
+  }
+}`,
+		".terraform.lock.hcl": `
+provider "registry.terraform.io/hashicorp/google" {
+  version     = "4.84.0"
+  constraints = "~> 4.84.0"
+  hashes      = ["h1:abc"]
+}`,
+	})
+
+	r, err := Find([]Group{{Name: "primary", Dir: dir}})
+	c.Assert(err, IsNil)
+	c.Check(r.Requirements, DeepEquals, []Requirement{
+		{Provider: "hashicorp/google", Group: "primary", Module: "", Constraints: []string{"~> 4.84.0"}, Locked: "4.84.0"},
+		{Provider: "hashicorp/google", Group: "primary", Module: "network", Constraints: []string{">= 3.83"}, Locked: "4.84.0"},
+		{Provider: "hashicorp/google", Group: "primary", Module: "remote", Constraints: []string{">= 5.0"}, Locked: "4.84.0"},
+		{Provider: "hashicorp/random", Group: "primary", Module: "network"},
+	})
+	c.Check(r.Uninspected, DeepEquals, []string{"primary/uninstalled"})
+	c.Assert(r.Conflicts, HasLen, 1)
+	c.Check(r.Conflicts[0], ErrorMatches,
+		`no version of provider hashicorp/google meets the constraints of all modules of deployment group primary: `+
+			`\(root\) requires ~> 4.84.0; network requires >= 3.83; remote requires >= 5.0`)
+}
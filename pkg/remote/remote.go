@@ -0,0 +1,168 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package remote runs commands on deployed VMs over SSH, tunneled through
+// Identity-Aware Proxy so that VMs do not need an external IP address
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"os/exec"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"golang.org/x/exp/slices"
+)
+
+// TargetInputs are the inputs required to reach a VM
+var TargetInputs = []string{"project_id", "zone", "instance"}
+
+// OptionalTargetInputs may be given to log in as another user or with another
+// key than those gcloud uses by default
+var OptionalTargetInputs = []string{"user", "ssh_key_file"}
+
+// Target is a deployed VM commands are run on
+type Target struct {
+	Project  string
+	Zone     string
+	Instance string
+	// User to log in as, the user of gcloud credentials if empty
+	User string
+	// KeyFile is the private SSH key, gcloud manages its own key if empty
+	KeyFile string
+}
+
+// NewTarget builds the target from inputs, usually evaluated from the
+// blueprint and outputs of deployed modules, e.g. the name of a controller
+func NewTarget(inputs map[string]string) (Target, error) {
+	for _, k := range TargetInputs {
+		if inputs[k] == "" {
+			return Target{}, fmt.Errorf("input %q must be set to reach the VM", k)
+		}
+	}
+	for k := range inputs {
+		if !slices.Contains(TargetInputs, k) && !slices.Contains(OptionalTargetInputs, k) {
+			return Target{}, fmt.Errorf("unexpected input %q, accepted inputs are %q", k, append(slices.Clone(TargetInputs), OptionalTargetInputs...))
+		}
+	}
+	return Target{
+		Project:  inputs["project_id"],
+		Zone:     inputs["zone"],
+		Instance: inputs["instance"],
+		User:     inputs["user"],
+		KeyFile:  inputs["ssh_key_file"],
+	}, nil
+}
+
+// Validate ensures that post_deploy commands of the blueprint are given exactly
+// the target inputs they accept, before values are known
+func Validate(bp config.Blueprint) error {
+	errs := config.Errors{}
+	for ig, g := range bp.DeploymentGroups {
+		for ic, rc := range g.PostDeploy {
+			p := config.Root.Groups.At(ig).PostDeploy.At(ic).Target
+			for _, k := range TargetInputs {
+				if !rc.Target.Has(k) {
+					errs.At(p, fmt.Errorf("a required input %q was not provided", k))
+				}
+			}
+			for k := range rc.Target.Items() {
+				if !slices.Contains(TargetInputs, k) && !slices.Contains(OptionalTargetInputs, k) {
+					errs.At(p.Dot(k), fmt.Errorf("unexpected input %q, accepted inputs are %q", k, append(slices.Clone(TargetInputs), OptionalTargetInputs...)))
+				}
+			}
+		}
+	}
+	return errs.OrNil()
+}
+
+// EvalTarget builds the target given by a blueprint, e.g. by post_deploy
+// commands of a group, values referring to module outputs are evaluated with
+// outputs of deployed modules
+func EvalTarget(bp config.Blueprint, d config.Dict, outputs map[config.ModuleID]map[string]cty.Value) (Target, error) {
+	ev, err := bp.EvalWithOutputs(d.AsObject(), outputs)
+	if err != nil {
+		return Target{}, err
+	}
+	inputs := map[string]string{}
+	for k, v := range ev.AsValueMap() {
+		s, err := convert.Convert(v, cty.String)
+		if err != nil || s.IsNull() {
+			return Target{}, fmt.Errorf("target input %q must be a string, got %s", k, v.Type().FriendlyName())
+		}
+		inputs[k] = s.AsString()
+	}
+	return NewTarget(inputs)
+}
+
+func (t Target) String() string {
+	return fmt.Sprintf("%s (zone %s, project %s)", t.Instance, t.Zone, t.Project)
+}
+
+// sshArgs are the arguments of gcloud running the command on the target
+func (t Target) sshArgs(command string) []string {
+	host := t.Instance
+	if t.User != "" {
+		host = t.User + "@" + host
+	}
+	args := []string{"compute", "ssh", host,
+		"--project=" + t.Project,
+		"--zone=" + t.Zone,
+		"--tunnel-through-iap",
+		"--quiet"}
+	if t.KeyFile != "" {
+		args = append(args, "--ssh-key-file="+t.KeyFile)
+	}
+	return append(args, "--command="+command)
+}
+
+// Run runs the command on the target and returns its standard output
+func (t Target) Run(ctx context.Context, command string) (string, error) {
+	out, err := runCommand(ctx, "gcloud", t.sshArgs(command)...)
+	if err != nil {
+		return out, fmt.Errorf("command %q failed on %s: %w", command, t, err)
+	}
+	return out, nil
+}
+
+// RunOn runs the command on the target until done or ctx is cancelled, it is
+// replaced in tests of packages running commands on deployed VMs
+var RunOn = func(ctx context.Context, t Target, command string) (string, error) {
+	return t.Run(ctx, command)
+}
+
+// runCommand executes the command and returns its standard output, it is
+// replaced in tests
+var runCommand = func(ctx context.Context, name string, args ...string) (string, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return "", config.HintError{
+			Hint: fmt.Sprintf("must have a copy of %s installed in PATH", name),
+			Err:  err}
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = errors.Join(err, ctx.Err())
+		}
+		return stdout.String(), fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
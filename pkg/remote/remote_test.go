@@ -0,0 +1,124 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"hpc-toolkit/pkg/config"
+	"testing"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *MySuite) TestNewTarget(c *C) {
+	inp := map[string]string{"project_id": "test-project", "zone": "us-central1-a", "instance": "hpc-login"}
+	{ // Success
+		t, err := NewTarget(inp)
+		c.Check(err, IsNil)
+		c.Check(t, Equals, Target{Project: "test-project", Zone: "us-central1-a", Instance: "hpc-login"})
+	}
+
+	{ // Fail: missing input
+		_, err := NewTarget(map[string]string{"project_id": "test-project", "zone": "us-central1-a"})
+		c.Check(err, ErrorMatches, `input "instance" must be set.*`)
+	}
+
+	{ // Fail: unexpected input
+		_, err := NewTarget(map[string]string{"project_id": "test-project", "zone": "us-central1-a", "instance": "hpc-login", "host": "10.0.0.2"})
+		c.Check(err, ErrorMatches, `unexpected input "host".*`)
+	}
+}
+
+func (s *MySuite) TestSSHArgs(c *C) {
+	t := Target{Project: "test-project", Zone: "us-central1-a", Instance: "hpc-login"}
+	c.Check(t.sshArgs("sinfo"), DeepEquals, []string{
+		"compute", "ssh", "hpc-login", "--project=test-project", "--zone=us-central1-a",
+		"--tunnel-through-iap", "--quiet", "--command=sinfo"})
+
+	t.User, t.KeyFile = "admin", "/keys/admin"
+	c.Check(t.sshArgs("sinfo"), DeepEquals, []string{
+		"compute", "ssh", "admin@hpc-login", "--project=test-project", "--zone=us-central1-a",
+		"--tunnel-through-iap", "--quiet", "--ssh-key-file=/keys/admin", "--command=sinfo"})
+}
+
+func (s *MySuite) TestRun(c *C) {
+	defer func(f func(context.Context, string, ...string) (string, error)) { runCommand = f }(runCommand)
+	t := Target{Project: "test-project", Zone: "us-central1-a", Instance: "hpc-login"}
+
+	{ // Success
+		runCommand = func(_ context.Context, name string, args ...string) (string, error) {
+			c.Check(name, Equals, "gcloud")
+			c.Check(args, DeepEquals, t.sshArgs("hostname"))
+			return "hpc-login\n", nil
+		}
+		out, err := t.Run(context.Background(), "hostname")
+		c.Check(err, IsNil)
+		c.Check(out, Equals, "hpc-login\n")
+	}
+
+	{ // Fail: command fails
+		runCommand = func(context.Context, string, ...string) (string, error) {
+			return "", errors.New("exit status 1")
+		}
+		_, err := t.Run(context.Background(), "false")
+		c.Check(err, ErrorMatches, `command "false" failed on hpc-login \(zone us-central1-a, project test-project\): exit status 1`)
+	}
+
+	{ // Fail: cancelled by the caller
+		runCommand = func(ctx context.Context, _ string, _ ...string) (string, error) {
+			return "", ctx.Err()
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := RunOn(ctx, t, "sleep 60")
+		c.Check(errors.Is(err, context.Canceled), Equals, true)
+	}
+}
+
+func (s *MySuite) TestValidateAndEvalTarget(c *C) {
+	target := config.NewDict(map[string]cty.Value{
+		"project_id": config.GlobalRef("project_id").AsValue(),
+		"zone":       cty.StringVal("us-central1-a"),
+		"instance":   config.ModuleRef("slurm", "login_name").AsValue(),
+		"user":       cty.StringVal("admin")})
+	bp := config.Blueprint{
+		Vars: config.NewDict(map[string]cty.Value{"project_id": cty.StringVal("test-project")}),
+		DeploymentGroups: []config.DeploymentGroup{{
+			Name:       "primary",
+			PostDeploy: []config.RemoteCommand{{Command: "sinfo", Target: target}}}}}
+
+	c.Check(Validate(bp), IsNil)
+	{
+		t, err := EvalTarget(bp, target, map[config.ModuleID]map[string]cty.Value{
+			"slurm": {"login_name": cty.StringVal("hpc-login")}})
+		c.Check(err, IsNil)
+		c.Check(t, Equals, Target{Project: "test-project", Zone: "us-central1-a", Instance: "hpc-login", User: "admin"})
+	}
+
+	{ // Fail: unexpected input
+		bp.DeploymentGroups[0].PostDeploy[0].Target.Set("port", cty.NumberIntVal(22))
+		c.Check(Validate(bp), ErrorMatches, `deployment_groups\[0\].post_deploy\[0\].target.port: unexpected input "port".*`)
+	}
+}
@@ -0,0 +1,401 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/gcpauth"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// stateBackupsDirName is the directory in the artifacts directory holding
+// snapshots of terraform state of deployment groups
+const stateBackupsDirName = "state-backups"
+
+const snapshotSuffix = ".tfstate"
+
+// snapshotTimeFormat sorts lexically in chronological order
+const snapshotTimeFormat = "20060102T150405Z"
+
+// snapshotStore keeps state snapshots of a single deployment group
+type snapshotStore interface {
+	// list returns names of snapshots, oldest first
+	list(ctx context.Context) ([]string, error)
+	read(ctx context.Context, name string) ([]byte, error)
+	write(ctx context.Context, name string, data []byte) error
+	remove(ctx context.Context, name string) error
+	// location describes where the snapshot is stored, for messages
+	location(name string) string
+}
+
+type localSnapshotStore struct {
+	dir string
+}
+
+func (s localSnapshotStore) list(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && isSnapshotName(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s localSnapshotStore) read(ctx context.Context, name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.dir, name))
+}
+
+func (s localSnapshotStore) write(ctx context.Context, name string, data []byte) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	// state holds secrets of resources, e.g. generated passwords
+	return os.WriteFile(filepath.Join(s.dir, name), data, 0600)
+}
+
+func (s localSnapshotStore) remove(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(s.dir, name))
+}
+
+func (s localSnapshotStore) location(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+type gcsSnapshotStore struct {
+	bucket string
+	prefix string // ends with "/"
+}
+
+func (s gcsSnapshotStore) service(ctx context.Context) (*storage.Service, error) {
+	svc, err := storage.NewService(ctx, gcpauth.ClientOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access state backups at gs://%s/%s: %w", s.bucket, s.prefix, err)
+	}
+	return svc, nil
+}
+
+func (s gcsSnapshotStore) list(ctx context.Context) ([]string, error) {
+	svc, err := s.service(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	err = svc.Objects.List(s.bucket).Prefix(s.prefix).Pages(ctx, func(objs *storage.Objects) error {
+		for _, o := range objs.Items {
+			if n := strings.TrimPrefix(o.Name, s.prefix); isSnapshotName(n) {
+				names = append(names, n)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s gcsSnapshotStore) read(ctx context.Context, name string) ([]byte, error) {
+	svc, err := s.service(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := svc.Objects.Get(s.bucket, s.prefix+name).Context(ctx).Download()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s gcsSnapshotStore) write(ctx context.Context, name string, data []byte) error {
+	svc, err := s.service(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = svc.Objects.Insert(s.bucket, &storage.Object{Name: s.prefix + name}).Media(bytes.NewReader(data)).Context(ctx).Do()
+	return err
+}
+
+func (s gcsSnapshotStore) remove(ctx context.Context, name string) error {
+	svc, err := s.service(ctx)
+	if err != nil {
+		return err
+	}
+	return svc.Objects.Delete(s.bucket, s.prefix+name).Context(ctx).Do()
+}
+
+func (s gcsSnapshotStore) location(name string) string {
+	return fmt.Sprintf("gs://%s/%s%s", s.bucket, s.prefix, name)
+}
+
+// snapshotName returns name of the snapshot of state taken at the given time,
+// the checksum tells apart snapshots of different states
+func snapshotName(state []byte, t time.Time, encrypted bool) string {
+	h := sha256.Sum256(state)
+	name := fmt.Sprintf("%s-%s%s", t.UTC().Format(snapshotTimeFormat), hex.EncodeToString(h[:4]), snapshotSuffix)
+	if encrypted {
+		name += encryptedSuffix
+	}
+	return name
+}
+
+func isSnapshotName(name string) bool {
+	return strings.HasSuffix(name, snapshotSuffix) || strings.HasSuffix(name, snapshotSuffix+encryptedSuffix)
+}
+
+// snapshotChecksum returns the checksum part of the snapshot name
+func snapshotChecksum(name string) string {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, encryptedSuffix), snapshotSuffix)
+	if i := strings.LastIndex(name, "-"); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// stateBackups returns settings and the store of state snapshots of the
+// deployment group
+func stateBackups(artifactsDir string, group config.GroupName) (config.StateBackups, config.ArtifactsEncryption, snapshotStore, error) {
+	bp, err := expandedBlueprint(artifactsDir)
+	if err != nil {
+		return config.StateBackups{}, config.ArtifactsEncryption{}, nil, err
+	}
+	sb := bp.StateBackups
+	if sb.GcsPrefix == "" {
+		return sb, bp.ArtifactsEncryption, localSnapshotStore{filepath.Join(artifactsDir, stateBackupsDirName, string(group))}, nil
+	}
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(sb.GcsPrefix, "gs://"), "/")
+	// deployments sharing the prefix are told apart by their names
+	deployment := "unnamed"
+	if bp.Vars.Has("deployment_name") {
+		deployment = bp.DeploymentName()
+	}
+	prefix = path.Join(prefix, deployment, string(group)) + "/"
+	return sb, bp.ArtifactsEncryption, gcsSnapshotStore{bucket, strings.TrimPrefix(prefix, "/")}, nil
+}
+
+// snapshotEncryption tells how snapshots of a deployment group are encrypted.
+// Snapshots of groups with a local-encrypted backend are encrypted as their
+// local state, so they are not less protected than the state itself. With a
+// Cloud KMS key, snapshots are encrypted with a data key wrapped by KMS, as
+// local state is, since states often exceed the size KMS encrypts.
+type snapshotEncryption struct {
+	state     *config.LocalStateEncryption
+	artifacts config.ArtifactsEncryption
+}
+
+// groupSnapshotEncryption returns encryption of snapshots of the group in
+// groupDir, given encryption of artifacts of the deployment
+func groupSnapshotEncryption(groupDir string, ae config.ArtifactsEncryption) (snapshotEncryption, error) {
+	enc, ok, err := modulewriter.StateEncryption(groupDir)
+	if err != nil {
+		return snapshotEncryption{}, err
+	}
+	if ok {
+		return snapshotEncryption{state: &enc}, nil
+	}
+	return snapshotEncryption{artifacts: ae}, nil
+}
+
+func (e snapshotEncryption) enabled() bool {
+	return e.state != nil || e.artifacts.Enabled()
+}
+
+func (e snapshotEncryption) encrypt(ctx context.Context, state []byte) ([]byte, error) {
+	if e.state != nil {
+		return encryptState(ctx, *e.state, state)
+	}
+	if e.artifacts.KmsKey != "" {
+		return encryptState(ctx, config.LocalStateEncryption{KmsKey: e.artifacts.KmsKey}, state)
+	}
+	return encryptArtifact(ctx, e.artifacts, state)
+}
+
+func (e snapshotEncryption) decrypt(ctx context.Context, name string, data []byte) ([]byte, error) {
+	if e.state != nil {
+		return decryptState(ctx, *e.state, data)
+	}
+	if !e.artifacts.Enabled() {
+		return nil, fmt.Errorf("snapshot %s is encrypted, but artifacts_encryption is no longer set in the blueprint", name)
+	}
+	if e.artifacts.KmsKey != "" {
+		return decryptState(ctx, config.LocalStateEncryption{KmsKey: e.artifacts.KmsKey}, data)
+	}
+	return decryptArtifact(ctx, e.artifacts, data)
+}
+
+// saveSnapshot stores a snapshot of state, unless the latest snapshot is of
+// the same state, and removes the oldest snapshots beyond retain
+func saveSnapshot(ctx context.Context, s snapshotStore, enc snapshotEncryption, retain int, state []byte, now time.Time) (string, bool, error) {
+	names, err := s.list(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	name := snapshotName(state, now, enc.enabled())
+	if len(names) > 0 && snapshotChecksum(names[len(names)-1]) == snapshotChecksum(name) {
+		return names[len(names)-1], false, nil
+	}
+
+	data := state
+	if enc.enabled() {
+		if data, err = enc.encrypt(ctx, state); err != nil {
+			return "", false, err
+		}
+	}
+	if err := s.write(ctx, name, data); err != nil {
+		return "", false, err
+	}
+	names = append(names, name)
+	sort.Strings(names)
+	for len(names) > retain {
+		if err := s.remove(ctx, names[0]); err != nil {
+			return "", false, err
+		}
+		names = names[1:]
+	}
+	return name, true, nil
+}
+
+// readSnapshot returns the state of the snapshot, decrypted if needed
+func readSnapshot(ctx context.Context, s snapshotStore, enc snapshotEncryption, name string) ([]byte, error) {
+	data, err := s.read(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(name, encryptedSuffix) {
+		return data, nil
+	}
+	return enc.decrypt(ctx, name, data)
+}
+
+// BackupState stores a snapshot of the terraform state of the deployment group
+// before it is changed, as configured by state_backups of the blueprint.
+// Snapshots are encrypted as the local state of the group, if encrypted, or
+// else as artifacts of the deployment.
+// Groups that were never applied have no state to back up.
+func BackupState(ctx context.Context, tf *tfexec.Terraform, group config.GroupName, artifactsDir string) error {
+	sb, ae, s, err := stateBackups(artifactsDir, group)
+	if err != nil || sb.Disabled {
+		return err
+	}
+	enc, err := groupSnapshotEncryption(tf.WorkingDir(), ae)
+	if err != nil {
+		return err
+	}
+	if err := initModule(ctx, tf); err != nil {
+		return err
+	}
+	state, err := tf.StatePull(ctx)
+	if err != nil {
+		return &TfError{
+			help: fmt.Sprintf("reading terraform state of deployment group %s failed; manually resolve errors below", tf.WorkingDir()),
+			err:  err,
+		}
+	}
+	if strings.TrimSpace(state) == "" {
+		return nil
+	}
+	name, saved, err := saveSnapshot(ctx, s, enc, sb.Retained(), []byte(state), time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to back up terraform state of deployment group %s: %w", group, err)
+	}
+	if saved {
+		logging.Info("Saved snapshot of terraform state of deployment group %s to %s", group, s.location(name))
+	}
+	return nil
+}
+
+// StateSnapshots returns names of state snapshots of the deployment group,
+// oldest first
+func StateSnapshots(ctx context.Context, group config.GroupName, artifactsDir string) ([]string, error) {
+	_, _, s, err := stateBackups(artifactsDir, group)
+	if err != nil {
+		return nil, err
+	}
+	return s.list(ctx)
+}
+
+// RestoreState replaces the terraform state of the deployment group with the
+// given snapshot. The current state is backed up first, so restoring can be
+// undone.
+func RestoreState(ctx context.Context, tf *tfexec.Terraform, group config.GroupName, artifactsDir string, name string) error {
+	_, ae, s, err := stateBackups(artifactsDir, group)
+	if err != nil {
+		return err
+	}
+	enc, err := groupSnapshotEncryption(tf.WorkingDir(), ae)
+	if err != nil {
+		return err
+	}
+	state, err := readSnapshot(ctx, s, enc, name)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot %s: %w", s.location(name), err)
+	}
+	if err := BackupState(ctx, tf, group, artifactsDir); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp("", "restore-*.tfstate")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(state); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	logging.Info("Restoring terraform state of deployment group %s from %s", group, s.location(name))
+	// snapshots are older than the current state, terraform refuses to push
+	// them unless forced
+	if err := tf.StatePush(ctx, f.Name(), tfexec.Force(true)); err != nil {
+		return &TfError{
+			help: fmt.Sprintf("restoring terraform state of deployment group %s failed; manually resolve errors below", tf.WorkingDir()),
+			err:  err,
+		}
+	}
+	return nil
+}
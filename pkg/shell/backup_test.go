@@ -0,0 +1,178 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shell
+
+import (
+	"context"
+	"encoding/base64"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/modulewriter"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestSaveSnapshot(c *C) {
+	ctx := context.Background()
+	store := localSnapshotStore{filepath.Join(c.MkDir(), "zero")}
+	t0 := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	noEnc := snapshotEncryption{}
+
+	names, err := store.list(ctx)
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{})
+
+	first, saved, err := saveSnapshot(ctx, store, noEnc, 2, []byte(`{"serial": 1}`), t0)
+	c.Assert(err, IsNil)
+	c.Check(saved, Equals, true)
+	c.Check(first, Matches, `20241001T120000Z-[0-9a-f]{8}\.tfstate`)
+	info, err := os.Stat(store.location(first))
+	c.Assert(err, IsNil)
+	c.Check(info.Mode().Perm(), Equals, os.FileMode(0600))
+
+	{ // same state is not saved again
+		got, saved, err := saveSnapshot(ctx, store, noEnc, 2, []byte(`{"serial": 1}`), t0.Add(time.Hour))
+		c.Assert(err, IsNil)
+		c.Check(saved, Equals, false)
+		c.Check(got, Equals, first)
+	}
+
+	_, _, err = saveSnapshot(ctx, store, noEnc, 2, []byte(`{"serial": 2}`), t0.Add(time.Hour))
+	c.Assert(err, IsNil)
+	last, _, err := saveSnapshot(ctx, store, noEnc, 2, []byte(`{"serial": 3}`), t0.Add(2*time.Hour))
+	c.Assert(err, IsNil)
+
+	// oldest snapshot is removed
+	names, err = store.list(ctx)
+	c.Assert(err, IsNil)
+	c.Check(names, HasLen, 2)
+	c.Check(names[0], Matches, `20241001T130000Z-.*`)
+	c.Check(names[1], Equals, last)
+
+	got, err := readSnapshot(ctx, store, noEnc, last)
+	c.Assert(err, IsNil)
+	c.Check(string(got), Equals, `{"serial": 3}`)
+}
+
+func (s *MySuite) TestSaveSnapshotEncrypted(c *C) {
+	pathEnv := os.Getenv("PATH")
+	defer os.Setenv("PATH", pathEnv)
+	fakeAge(c)
+	defer os.Unsetenv(AgeIdentityEnvVar)
+	os.Setenv(AgeIdentityEnvVar, "/keys/age.txt")
+
+	ctx := context.Background()
+	store := localSnapshotStore{c.MkDir()}
+	ae := snapshotEncryption{artifacts: config.ArtifactsEncryption{AgeRecipients: []string{"age1xyz"}}}
+	state := `{"password": "hunter2"}`
+
+	name, _, err := saveSnapshot(ctx, store, ae, 5, []byte(state), time.Now())
+	c.Assert(err, IsNil)
+	c.Check(strings.HasSuffix(name, ".tfstate.enc"), Equals, true)
+	b, err := os.ReadFile(store.location(name))
+	c.Assert(err, IsNil)
+	c.Check(strings.Contains(string(b), "hunter2"), Equals, false)
+
+	got, err := readSnapshot(ctx, store, ae, name)
+	c.Assert(err, IsNil)
+	c.Check(string(got), Equals, state)
+
+	_, err = readSnapshot(ctx, store, snapshotEncryption{}, name)
+	c.Check(err, ErrorMatches, ".*is encrypted, but artifacts_encryption is no longer set.*")
+}
+
+func (s *MySuite) TestSaveSnapshotKms(c *C) {
+	defer func(w, u interface{}) {
+		kmsWrapKey = w.(func(context.Context, string, []byte) (string, error))
+		kmsUnwrapKey = u.(func(context.Context, string, string) ([]byte, error))
+	}(kmsWrapKey, kmsUnwrapKey)
+	kmsWrapKey = func(_ context.Context, _ string, key []byte) (string, error) {
+		c.Check(key, HasLen, 32) // only the data key is sent to KMS
+		return base64.StdEncoding.EncodeToString(key), nil
+	}
+	kmsUnwrapKey = func(_ context.Context, _ string, wrapped string) ([]byte, error) {
+		return base64.StdEncoding.DecodeString(wrapped)
+	}
+
+	ctx := context.Background()
+	store := localSnapshotStore{c.MkDir()}
+	enc := snapshotEncryption{artifacts: config.ArtifactsEncryption{KmsKey: "projects/p/locations/l/keyRings/r/cryptoKeys/k"}}
+	// larger than the 64 KiB KMS encrypts
+	state := `{"password": "hunter2", "padding": "` + strings.Repeat("x", 100<<10) + `"}`
+
+	name, _, err := saveSnapshot(ctx, store, enc, 5, []byte(state), time.Now())
+	c.Assert(err, IsNil)
+	c.Check(strings.HasSuffix(name, ".tfstate.enc"), Equals, true)
+	b, err := os.ReadFile(store.location(name))
+	c.Assert(err, IsNil)
+	c.Check(strings.Contains(string(b), "hunter2"), Equals, false)
+
+	got, err := readSnapshot(ctx, store, enc, name)
+	c.Assert(err, IsNil)
+	c.Check(string(got), Equals, state)
+}
+
+func (s *MySuite) TestSaveSnapshotLocalEncryptedState(c *C) {
+	ctx := context.Background()
+	os.Setenv("TEST_STATE_PASSPHRASE", "correct horse")
+	defer os.Unsetenv("TEST_STATE_PASSPHRASE")
+	groupDir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(groupDir, modulewriter.StateEncryptionFileName), []byte("passphrase_env: TEST_STATE_PASSPHRASE\n"), 0644), IsNil)
+
+	// local state encryption wins over artifacts encryption
+	enc, err := groupSnapshotEncryption(groupDir, config.ArtifactsEncryption{AgeRecipients: []string{"age1xyz"}})
+	c.Assert(err, IsNil)
+	c.Check(enc, DeepEquals, snapshotEncryption{state: &config.LocalStateEncryption{PassphraseEnv: "TEST_STATE_PASSPHRASE"}})
+
+	store := localSnapshotStore{c.MkDir()}
+	state := `{"password": "hunter2"}`
+	name, _, err := saveSnapshot(ctx, store, enc, 5, []byte(state), time.Now())
+	c.Assert(err, IsNil)
+	c.Check(strings.HasSuffix(name, ".tfstate.enc"), Equals, true)
+
+	// no plaintext state is written
+	entries, err := os.ReadDir(store.dir)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Check(strings.HasSuffix(entries[0].Name(), ".tfstate"), Equals, false)
+	b, err := os.ReadFile(store.location(name))
+	c.Assert(err, IsNil)
+	c.Check(strings.Contains(string(b), "hunter2"), Equals, false)
+
+	got, err := readSnapshot(ctx, store, enc, name)
+	c.Assert(err, IsNil)
+	c.Check(string(got), Equals, state)
+
+	// groups without local-encrypted backend are encrypted as artifacts
+	enc, err = groupSnapshotEncryption(c.MkDir(), config.ArtifactsEncryption{})
+	c.Assert(err, IsNil)
+	c.Check(enc, DeepEquals, snapshotEncryption{})
+}
+
+func (s *MySuite) TestStateBackupsStore(c *C) {
+	dir := c.MkDir()
+	_, _, st, err := stateBackups(dir, "zero")
+	c.Assert(err, IsNil)
+	c.Check(st, DeepEquals, localSnapshotStore{filepath.Join(dir, "state-backups", "zero")})
+
+	c.Check(snapshotChecksum("20241001T120000Z-0a1b2c3d.tfstate.enc"), Equals, "0a1b2c3d")
+	c.Check(isSnapshotName("20241001T120000Z-0a1b2c3d.tfstate"), Equals, true)
+	c.Check(isSnapshotName("notes.txt"), Equals, false)
+}
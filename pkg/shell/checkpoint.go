@@ -0,0 +1,88 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hpc-toolkit/pkg/config"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CheckpointName is the name of the file in the artifacts directory recording
+// progress of an interrupted deployment
+const CheckpointName = "deploy_checkpoint.yaml"
+
+// Checkpoint records progress of an interrupted or failed deployment, so it
+// can be resumed from the interrupted deployment group
+type Checkpoint struct {
+	// BlueprintHash identifies the expanded blueprint the deployment was started with
+	BlueprintHash string             `yaml:"blueprint_hash"`
+	Completed     []config.GroupName `yaml:"completed_groups"`
+	Interrupted   config.GroupName   `yaml:"interrupted_group,omitempty"`
+	// FailedResources are addresses of resources of the interrupted group that
+	// terraform failed to apply, set if the deployment failed
+	FailedResources []string `yaml:"failed_resources,omitempty"`
+}
+
+// BlueprintHash returns the hash of the expanded blueprint file
+func BlueprintHash(expandedBlueprintFile string) (string, error) {
+	b, err := os.ReadFile(expandedBlueprintFile)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// ReadCheckpoint returns the checkpoint of the deployment, if any
+func ReadCheckpoint(artifactsDir string) (Checkpoint, bool, error) {
+	b, err := os.ReadFile(filepath.Join(artifactsDir, CheckpointName))
+	if errors.Is(err, os.ErrNotExist) {
+		return Checkpoint{}, false, nil
+	}
+	if err != nil {
+		return Checkpoint{}, false, err
+	}
+	var c Checkpoint
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return Checkpoint{}, false, err
+	}
+	return c, true, nil
+}
+
+// WriteCheckpoint writes the checkpoint to the artifacts directory
+func WriteCheckpoint(artifactsDir string, c Checkpoint) error {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(artifactsDir, CheckpointName), b, 0644)
+}
+
+// RemoveCheckpoint removes the checkpoint once the deployment has completed
+func RemoveCheckpoint(artifactsDir string) error {
+	err := os.Remove(filepath.Join(artifactsDir, CheckpointName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
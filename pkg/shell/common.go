@@ -18,13 +18,20 @@ package shell
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"hpc-toolkit/pkg/config"
 	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
 	"os"
-	"path/filepath"
+	"os/exec"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 	"golang.org/x/sys/unix"
 )
 
@@ -38,9 +45,9 @@ type ProposedChanges struct {
 // ValidateDeploymentDirectory ensures that the deployment directory structure
 // appears valid given a mapping of group names to module kinds
 // TODO: verify kind fully by auto-detecting type from group directory
-func ValidateDeploymentDirectory(groups []config.DeploymentGroup, deploymentRoot string) error {
-	for _, group := range groups {
-		groupPath := filepath.Join(deploymentRoot, string(group.Name))
+func ValidateDeploymentDirectory(bp config.Blueprint, deploymentRoot string) error {
+	for _, group := range bp.DeploymentGroups {
+		groupPath := modulewriter.GroupDir(deploymentRoot, bp, group.Name)
 		if isDir, _ := DirInfo(groupPath); !isDir {
 			return fmt.Errorf("improper deployment: %s is not a directory for group %s", groupPath, group.Name)
 		}
@@ -68,6 +75,85 @@ func mergeMapsWithoutLoss[K comparable, V any](to map[K]V, from map[K]V) error {
 	return nil
 }
 
+// interruptGracePeriod is how long a cancelled command is given to exit after
+// it was interrupted, before it is killed
+const interruptGracePeriod = 5 * time.Minute
+
+// killWait is how long KillInterruptedCommands waits for killed commands to
+// be gone
+const killWait = 5 * time.Second
+
+// interrupted are process groups of commands interrupted by commandContext,
+// which may still be running, by command; waitCommand forgets them
+var interrupted struct {
+	sync.Mutex
+	pgids map[*exec.Cmd]int
+}
+
+// commandContext is like exec.CommandContext, but the command is interrupted
+// rather than killed once ctx is done, so it can persist its state and release
+// locks. The command runs in its own process group, so Ctrl-C in terminal only
+// reaches it through ctx and is not delivered twice. Commands must be waited
+// for with waitCommand or runCommand.
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		interrupted.Lock()
+		if interrupted.pgids == nil {
+			interrupted.pgids = map[*exec.Cmd]int{}
+		}
+		interrupted.pgids[cmd] = cmd.Process.Pid
+		interrupted.Unlock()
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = interruptGracePeriod
+	return cmd
+}
+
+// waitCommand is cmd.Wait for commands of commandContext, once it returns the
+// process group of the command is no longer killed by KillInterruptedCommands,
+// its ID may be reused
+func waitCommand(cmd *exec.Cmd) error {
+	defer func() {
+		interrupted.Lock()
+		delete(interrupted.pgids, cmd)
+		interrupted.Unlock()
+	}()
+	return cmd.Wait()
+}
+
+// runCommand is cmd.Run for commands of commandContext
+func runCommand(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return waitCommand(cmd)
+}
+
+// KillInterruptedCommands kills the process groups of commands that were
+// interrupted but did not exit yet, e.g. when the user interrupts ghpc again,
+// and waits briefly for them to be gone. Running in their own process group,
+// they would otherwise outlive ghpc and keep holding the state lock.
+func KillInterruptedCommands() {
+	interrupted.Lock()
+	pgids := maps.Values(interrupted.pgids)
+	interrupted.pgids = nil
+	interrupted.Unlock()
+
+	alive := []int{}
+	for _, pgid := range pgids {
+		if unix.Kill(-pgid, unix.SIGKILL) == nil {
+			alive = append(alive, pgid)
+		}
+	}
+	deadline := time.Now().Add(killWait)
+	for len(alive) > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		alive = slices.DeleteFunc(alive, func(pgid int) bool { return unix.Kill(-pgid, 0) != nil })
+	}
+}
+
 // DirInfo reports if path is a directory and new files can be written in it
 func DirInfo(path string) (isDir bool, isWritable bool) {
 	p, err := os.Lstat(path)
@@ -17,9 +17,12 @@ limitations under the License.
 package shell
 
 import (
+	"context"
 	"hpc-toolkit/pkg/config"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"time"
 
 	. "gopkg.in/check.v1"
 )
@@ -100,6 +103,8 @@ func (s *MySuite) TestValidateDeploymentDirectory(c *C) {
 		},
 	}
 
+	bp := config.Blueprint{DeploymentGroups: groups}
+
 	for _, g := range groups {
 		err := os.Mkdir(filepath.Join(dir, string(g.Name)), 0755)
 		if err != nil {
@@ -108,15 +113,67 @@ func (s *MySuite) TestValidateDeploymentDirectory(c *C) {
 	}
 
 	// do not fail if exactly matching directories
-	c.Assert(ValidateDeploymentDirectory(groups, dir), IsNil)
+	c.Assert(ValidateDeploymentDirectory(bp, dir), IsNil)
 
 	// do not fail for extra directories
 	badGroupDir := filepath.Join(dir, "not-a-group-name")
 	os.Mkdir(badGroupDir, 0755)
-	c.Assert(ValidateDeploymentDirectory(groups, dir), IsNil)
+	c.Assert(ValidateDeploymentDirectory(bp, dir), IsNil)
 	os.Remove(badGroupDir)
 
 	// do fail if missing directories
 	os.Remove(filepath.Join(dir, string(groups[0].Name)))
-	c.Assert(ValidateDeploymentDirectory(groups, dir), NotNil)
+	c.Assert(ValidateDeploymentDirectory(bp, dir), NotNil)
+
+	// respect group directory names of deployment layout
+	bp.DeploymentLayout = config.DeploymentLayout{GroupPrefix: "tf-"}
+	c.Assert(ValidateDeploymentDirectory(bp, dir), NotNil)
+	for _, g := range groups {
+		if err := os.Mkdir(filepath.Join(dir, "tf-"+string(g.Name)), 0755); err != nil {
+			c.Fatal(err)
+		}
+	}
+	c.Assert(ValidateDeploymentDirectory(bp, dir), IsNil)
+}
+
+func (s *MySuite) TestCommandContextInterrupts(c *C) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	// the command exits with distinct status once interrupted
+	cmd := commandContext(ctx, "sh", "-c", "trap 'exit 3' INT; sleep 10 & wait")
+	start := time.Now()
+	err := runCommand(cmd)
+
+	var ee *exec.ExitError
+	c.Assert(err, FitsTypeOf, ee)
+	c.Check(err.(*exec.ExitError).ExitCode(), Equals, 3)
+	c.Check(time.Since(start) < 5*time.Second, Equals, true)
+
+	// the process group is forgotten once the command was waited for
+	interrupted.Lock()
+	defer interrupted.Unlock()
+	c.Check(interrupted.pgids, HasLen, 0)
+}
+
+func (s *MySuite) TestKillInterruptedCommands(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// the command and its child ignore interrupts
+	cmd := commandContext(ctx, "sh", "-c", "trap '' INT; sleep 30 & wait")
+	c.Assert(cmd.Start(), IsNil)
+	done := make(chan error)
+	go func() { done <- waitCommand(cmd) }()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	KillInterruptedCommands()
+	select {
+	case err := <-done:
+		c.Check(err, ErrorMatches, "signal: killed")
+	case <-time.After(5 * time.Second):
+		c.Fatal("interrupted command was not killed")
+	}
+	c.Check(time.Since(start) < killWait, Equals, true)
+	KillInterruptedCommands() // nothing left to kill
 }
@@ -0,0 +1,137 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"context"
+	"fmt"
+	"hpc-toolkit/pkg/pricing"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// maxCostLines is the number of resources listed in a cost report, the most
+// expensive changes first
+const maxCostLines = 10
+
+// CostChange is the estimated change of the monthly cost of a resource
+type CostChange struct {
+	Address string
+	// Symbol is "+" for created, "-" for deleted and "~" for updated or
+	// replaced resources
+	Symbol string
+	Delta  float64
+}
+
+// CostDelta is the estimated change of the monthly cost of a plan, resources
+// the pricing catalog has no price for are left out
+type CostDelta struct {
+	Changes []CostChange
+}
+
+// Total returns the change of the monthly cost of all resources
+func (d CostDelta) Total() float64 {
+	t := 0.0
+	for _, c := range d.Changes {
+		t += c.Delta
+	}
+	return t
+}
+
+// Short summarizes the change in a sentence
+func (d CostDelta) Short() string {
+	return fmt.Sprintf("Estimated monthly cost change: %s.", usd(d.Total()))
+}
+
+// String lists changed resources with their cost, under the summary
+func (d CostDelta) String() string {
+	var sb strings.Builder
+	sb.WriteString(d.Short())
+	sb.WriteString(" List prices of changed resources the toolkit can price:")
+	for i, c := range d.Changes {
+		if i == maxCostLines {
+			fmt.Fprintf(&sb, "\n  ... and %d more", len(d.Changes)-maxCostLines)
+			break
+		}
+		fmt.Fprintf(&sb, "\n  %s %s: %s", c.Symbol, c.Address, usd(c.Delta))
+	}
+	return sb.String()
+}
+
+func usd(v float64) string {
+	return fmt.Sprintf("%+.2f USD", v)
+}
+
+// planCostDelta estimates the change of the monthly cost of resources changed
+// by the plan
+func planCostDelta(plan *tfjson.Plan, catalog pricing.Catalog) CostDelta {
+	d := CostDelta{Changes: []CostChange{}}
+	for _, rc := range plan.ResourceChanges {
+		if rc.Change == nil || rc.Mode != tfjson.ManagedResourceMode {
+			continue
+		}
+		a := rc.Change.Actions
+		if a.NoOp() || a.Read() {
+			continue
+		}
+		before, okB := resourceMonthly(catalog, rc.Type, rc.Change.Before)
+		after, okA := resourceMonthly(catalog, rc.Type, rc.Change.After)
+		if !okB && !okA {
+			continue
+		}
+		delta := after - before
+		switch {
+		case a.Create():
+			d.Changes = append(d.Changes, CostChange{rc.Address, "+", delta})
+		case a.Delete():
+			d.Changes = append(d.Changes, CostChange{rc.Address, "-", delta})
+		case math.Abs(delta) >= 0.005: // updated or replaced at another price
+			d.Changes = append(d.Changes, CostChange{rc.Address, "~", delta})
+		}
+	}
+	sort.SliceStable(d.Changes, func(i, j int) bool {
+		return math.Abs(d.Changes[i].Delta) > math.Abs(d.Changes[j].Delta)
+	})
+	return d
+}
+
+// resourceMonthly prices values of the resource, missing for created or
+// deleted resources, as free
+func resourceMonthly(catalog pricing.Catalog, resourceType string, values interface{}) (float64, bool) {
+	m, ok := values.(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	return catalog.Monthly(resourceType, m)
+}
+
+// planCost estimates the change of the monthly cost of the plan file
+func planCost(ctx context.Context, tf *tfexec.Terraform, path string) (CostDelta, error) {
+	catalog, err := pricing.DefaultCatalog()
+	if err != nil {
+		return CostDelta{}, err
+	}
+	plan, err := tf.ShowPlanFile(ctx, path)
+	if err != nil {
+		return CostDelta{}, err
+	}
+	return planCostDelta(plan, catalog), nil
+}
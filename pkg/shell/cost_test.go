@@ -0,0 +1,73 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/pricing"
+
+	tfjson "github.com/hashicorp/terraform-json"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestPlanCostDelta(c *C) {
+	catalog := pricing.Catalog{
+		MachineTypes: map[string]float64{"small": 0.1, "large": 1},
+		Disks:        map[string]float64{"pd-standard": 0.04}}
+	vm := func(mt string) map[string]interface{} {
+		return map[string]interface{}{"machine_type": mt}
+	}
+	change := func(addr string, before, after interface{}, actions ...tfjson.Action) *tfjson.ResourceChange {
+		return &tfjson.ResourceChange{
+			Address: addr,
+			Mode:    tfjson.ManagedResourceMode,
+			Type:    "google_compute_instance",
+			Change:  &tfjson.Change{Actions: actions, Before: before, After: after}}
+	}
+
+	plan := tfjson.Plan{ResourceChanges: []*tfjson.ResourceChange{
+		change("vm[0]", vm("small"), vm("small"), tfjson.ActionNoop),
+		change("vm[1]", nil, vm("small"), tfjson.ActionCreate),
+		change("vm[2]", vm("small"), vm("large"), tfjson.ActionUpdate),
+		change("vm[3]", vm("large"), nil, tfjson.ActionDelete),
+		change("vm[4]", vm("small"), vm("small"), tfjson.ActionDelete, tfjson.ActionCreate),
+		change("vm[5]", nil, vm("unknown"), tfjson.ActionCreate),
+		{Address: "google_compute_network.vpc", Mode: tfjson.ManagedResourceMode, Type: "google_compute_network",
+			Change: &tfjson.Change{Actions: tfjson.Actions{tfjson.ActionCreate}, After: map[string]interface{}{}}},
+	}}
+	d := planCostDelta(&plan, catalog)
+	c.Check(d.Changes, DeepEquals, []CostChange{
+		{"vm[3]", "-", -730},
+		{"vm[2]", "~", 657},
+		{"vm[1]", "+", 73},
+	})
+	c.Check(d.Short(), Equals, "Estimated monthly cost change: +0.00 USD.")
+	c.Check(d.String(), Equals, `Estimated monthly cost change: +0.00 USD. List prices of changed resources the toolkit can price:
+  - vm[3]: -730.00 USD
+  ~ vm[2]: +657.00 USD
+  + vm[1]: +73.00 USD`)
+
+	{ // long lists are cut
+		plan := tfjson.Plan{}
+		for i := 0; i < 12; i++ {
+			plan.ResourceChanges = append(plan.ResourceChanges, change(fmt.Sprintf("vm[%d]", i), nil, vm("small"), tfjson.ActionCreate))
+		}
+		d := planCostDelta(&plan, catalog)
+		c.Check(d.Total(), Equals, 12*73.0)
+		c.Check(d.String(), Matches, `(?s)Estimated monthly cost change: \+876.00 USD.*vm\[9\]: \+73.00 USD\n  ... and 2 more`)
+	}
+}
@@ -0,0 +1,260 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/gcpauth"
+	"hpc-toolkit/pkg/logging"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+	gcpsts "google.golang.org/api/sts/v1"
+)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// gcpAccessTokenEnvVar passes the minted access token to terraform google
+// providers
+const gcpAccessTokenEnvVar = "GOOGLE_OAUTH_ACCESS_TOKEN"
+
+// credentialsRefreshMargin is how long before their expiry credentials are
+// minted again, so that no terraform or packer run starts with credentials
+// about to expire
+const credentialsRefreshMargin = 15 * time.Minute
+
+// credentialsEndpoints of the token services, replaced in tests
+var credentialsEndpoints = struct {
+	gcpSts            string
+	gcpIamCredentials string
+	awsSts            string
+}{}
+
+// tfVarEnvPrefix is the prefix of environment variables setting terraform
+// variables, tfexec leaves them out of environments set for terraform
+const tfVarEnvPrefix = "TF_VAR_"
+
+// mintedCredentials are the credentials set in the environment by this process
+var mintedCredentials struct {
+	expiry time.Time
+	// vars are terraform variables set to credentials, passed to plans in a
+	// variable file
+	vars map[string]string
+}
+
+// SetCredentials mints short-lived credentials and sets them in the
+// environment of the process, so that terraform and packer run with them.
+// Google API clients of ghpc itself run with minted gcp credentials too.
+// Terraform variables set to credentials are passed to terraform plans by
+// credentialsVarFile instead. Credentials are minted again only when close to
+// expiry, it is called before running each deployment group.
+func SetCredentials(ctx context.Context, creds []config.Credentials) error {
+	if len(creds) == 0 || time.Until(mintedCredentials.expiry) > credentialsRefreshMargin {
+		return nil
+	}
+	env := map[string]string{}
+	var expiry time.Time
+	for _, c := range creds {
+		e, exp, err := mintCredentials(ctx, c)
+		if err != nil {
+			return fmt.Errorf("failed to mint %s credentials: %w", c.Provider, err)
+		}
+		for k, v := range e {
+			env[k] = v
+		}
+		if expiry.IsZero() || exp.Before(expiry) {
+			expiry = exp
+		}
+	}
+	vars := map[string]string{}
+	for k, v := range env {
+		if name, ok := strings.CutPrefix(k, tfVarEnvPrefix); ok {
+			vars[name] = v
+			continue
+		}
+		if err := os.Setenv(k, v); err != nil {
+			return err
+		}
+	}
+	if at, ok := env[gcpAccessTokenEnvVar]; ok {
+		gcpauth.SetTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: at, Expiry: expiry}))
+	}
+	mintedCredentials.expiry, mintedCredentials.vars = expiry, vars
+	logging.Info("Minted short-lived credentials valid until %s", expiry.Local().Format(time.RFC3339))
+	return nil
+}
+
+// mintCredentials returns environment variables passing credentials to
+// terraform and packer, and their expiry
+func mintCredentials(ctx context.Context, c config.Credentials) (map[string]string, time.Time, error) {
+	token, err := oidcToken(c)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	lifetime, err := c.LifetimeDuration()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	switch c.Provider {
+	case "gcp":
+		at, expiry, err := gcpAccessToken(ctx, c, token, lifetime)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		env := map[string]string{
+			gcpAccessTokenEnvVar:         at, // terraform google providers
+			"CLOUDSDK_AUTH_ACCESS_TOKEN": at, // gcloud, e.g. in local-exec provisioners
+		}
+		if c.Variable != "" {
+			env[tfVarEnvPrefix+c.Variable] = at
+		}
+		return env, expiry, nil
+	case "aws":
+		return awsCredentials(ctx, c, token, lifetime)
+	default:
+		return nil, time.Time{}, fmt.Errorf("unknown credentials provider %q", c.Provider)
+	}
+}
+
+// credentialsVarFile writes terraform variables set to credentials to a
+// variable file only the user can read, for a plan. It returns "" if there
+// are none; the caller removes the file once the plan is made.
+func credentialsVarFile() (string, error) {
+	if len(mintedCredentials.vars) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(mintedCredentials.vars)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp("", "ghpc-credentials-*.tfvars.json") // mode 0600
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// oidcToken reads the OIDC token of the CI system
+func oidcToken(c config.Credentials) (string, error) {
+	if c.TokenEnv != "" {
+		t, ok := os.LookupEnv(c.TokenEnv)
+		if !ok || t == "" {
+			return "", fmt.Errorf("environment variable %s holding the OIDC token is not set", c.TokenEnv)
+		}
+		return t, nil
+	}
+	b, err := os.ReadFile(c.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read OIDC token: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func gcpOptions(endpoint string, opts ...option.ClientOption) []option.ClientOption {
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+	return opts
+}
+
+// gcpAccessToken exchanges the OIDC token for a federated access token with
+// the Security Token Service, then impersonates the service account with it
+// if one is set
+func gcpAccessToken(ctx context.Context, c config.Credentials, token string, lifetime time.Duration) (string, time.Time, error) {
+	s, err := gcpsts.NewService(ctx, gcpOptions(credentialsEndpoints.gcpSts, option.WithoutAuthentication())...)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	resp, err := s.V1.Token(&gcpsts.GoogleIdentityStsV1ExchangeTokenRequest{
+		GrantType:          "urn:ietf:params:oauth:grant-type:token-exchange",
+		Audience:           c.Audience,
+		Scope:              cloudPlatformScope,
+		RequestedTokenType: "urn:ietf:params:oauth:token-type:access_token",
+		SubjectToken:       token,
+		SubjectTokenType:   "urn:ietf:params:oauth:token-type:jwt",
+	}).Context(ctx).Do()
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to exchange OIDC token with %s: %w", c.Audience, err)
+	}
+	expiry := time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	if c.ServiceAccount == "" {
+		return resp.AccessToken, expiry, nil
+	}
+
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: resp.AccessToken})
+	ic, err := iamcredentials.NewService(ctx, gcpOptions(credentialsEndpoints.gcpIamCredentials, option.WithTokenSource(ts))...)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	name := fmt.Sprintf("projects/-/serviceAccounts/%s", c.ServiceAccount)
+	ir, err := ic.Projects.ServiceAccounts.GenerateAccessToken(name, &iamcredentials.GenerateAccessTokenRequest{
+		Scope:    []string{cloudPlatformScope},
+		Lifetime: fmt.Sprintf("%ds", int64(lifetime.Seconds())),
+	}).Context(ctx).Do()
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to impersonate %s: %w", c.ServiceAccount, err)
+	}
+	expiry, err = time.Parse(time.RFC3339, ir.ExpireTime)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return ir.AccessToken, expiry, nil
+}
+
+// awsCredentials assumes the role with the OIDC token
+func awsCredentials(ctx context.Context, c config.Credentials, token string, lifetime time.Duration) (map[string]string, time.Time, error) {
+	cfg := aws.NewConfig().WithCredentials(credentials.AnonymousCredentials).WithRegion("us-east-1")
+	if credentialsEndpoints.awsSts != "" {
+		cfg = cfg.WithEndpoint(credentialsEndpoints.awsSts)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	out, err := sts.New(sess).AssumeRoleWithWebIdentityWithContext(ctx, &sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(c.RoleArn),
+		RoleSessionName:  aws.String("ghpc"),
+		WebIdentityToken: aws.String(token),
+		DurationSeconds:  aws.Int64(int64(lifetime.Seconds())),
+	})
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to assume role %s: %w", c.RoleArn, err)
+	}
+	cr := out.Credentials
+	env := map[string]string{
+		"AWS_ACCESS_KEY_ID":     aws.StringValue(cr.AccessKeyId),
+		"AWS_SECRET_ACCESS_KEY": aws.StringValue(cr.SecretAccessKey),
+		"AWS_SESSION_TOKEN":     aws.StringValue(cr.SessionToken),
+	}
+	return env, aws.TimeValue(cr.Expiration), nil
+}
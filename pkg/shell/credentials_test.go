@@ -0,0 +1,207 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/gcpauth"
+	"hpc-toolkit/pkg/modulewriter"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeTokenServices serves the token exchanges of GCP and AWS, expecting
+// "oidc-token" as the OIDC token
+func fakeTokenServices(c *C) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/v1/token"):
+			var req map[string]string
+			c.Check(json.Unmarshal(body, &req), IsNil)
+			if req["subjectToken"] != "oidc-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"access_token": "federated", "expires_in": 3600}`)
+		case strings.HasSuffix(r.URL.Path, ":generateAccessToken"):
+			c.Check(r.Header.Get("Authorization"), Equals, "Bearer federated")
+			c.Check(r.URL.Path, Matches, ".*/serviceAccounts/ci@p.iam.gserviceaccount.com:generateAccessToken")
+			fmt.Fprint(w, `{"accessToken": "impersonated", "expireTime": "2030-01-01T00:00:00Z"}`)
+		default: // AWS STS
+			q, _ := url.ParseQuery(string(body))
+			c.Check(q.Get("Action"), Equals, "AssumeRoleWithWebIdentity")
+			c.Check(q.Get("WebIdentityToken"), Equals, "oidc-token")
+			c.Check(q.Get("DurationSeconds"), Equals, "1800")
+			fmt.Fprint(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>AKID</AccessKeyId>
+      <SecretAccessKey>SECRET</SecretAccessKey>
+      <SessionToken>SESSION</SessionToken>
+      <Expiration>2030-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`)
+		}
+	}))
+	credentialsEndpoints.gcpSts = srv.URL + "/"
+	credentialsEndpoints.gcpIamCredentials = srv.URL + "/"
+	credentialsEndpoints.awsSts = srv.URL
+	return srv
+}
+
+func (s *MySuite) TestMintCredentials(c *C) {
+	srv := fakeTokenServices(c)
+	defer srv.Close()
+	ctx := context.Background()
+	tokenFile := filepath.Join(c.MkDir(), "token")
+	c.Assert(os.WriteFile(tokenFile, []byte("oidc-token\n"), 0600), IsNil)
+
+	gcp := config.Credentials{
+		Provider:  "gcp",
+		TokenFile: tokenFile,
+		Audience:  "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/ci/providers/gitlab",
+		Variable:  "access_token",
+	}
+	{ // federated token
+		env, expiry, err := mintCredentials(ctx, gcp)
+		c.Assert(err, IsNil)
+		c.Check(env, DeepEquals, map[string]string{
+			"GOOGLE_OAUTH_ACCESS_TOKEN":  "federated",
+			"CLOUDSDK_AUTH_ACCESS_TOKEN": "federated",
+			"TF_VAR_access_token":        "federated",
+		})
+		c.Check(time.Until(expiry) > 59*time.Minute, Equals, true)
+	}
+	{ // impersonated service account
+		sa := gcp
+		sa.ServiceAccount = "ci@p.iam.gserviceaccount.com"
+		env, expiry, err := mintCredentials(ctx, sa)
+		c.Assert(err, IsNil)
+		c.Check(env["GOOGLE_OAUTH_ACCESS_TOKEN"], Equals, "impersonated")
+		c.Check(expiry, Equals, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	}
+	{ // AWS role
+		c.Assert(os.Setenv("GHPC_TEST_OIDC_TOKEN", "oidc-token"), IsNil)
+		defer os.Unsetenv("GHPC_TEST_OIDC_TOKEN")
+		aws := config.Credentials{Provider: "aws", TokenEnv: "GHPC_TEST_OIDC_TOKEN", RoleArn: "arn:aws:iam::123:role/ci", Lifetime: "30m"}
+		env, expiry, err := mintCredentials(ctx, aws)
+		c.Assert(err, IsNil)
+		c.Check(env, DeepEquals, map[string]string{
+			"AWS_ACCESS_KEY_ID":     "AKID",
+			"AWS_SECRET_ACCESS_KEY": "SECRET",
+			"AWS_SESSION_TOKEN":     "SESSION",
+		})
+		c.Check(expiry.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)), Equals, true)
+	}
+	{ // Fail: token not set
+		unset := config.Credentials{Provider: "aws", TokenEnv: "GHPC_TEST_UNSET_TOKEN", RoleArn: "arn:aws:iam::123:role/ci"}
+		_, _, err := mintCredentials(ctx, unset)
+		c.Check(err, ErrorMatches, "environment variable GHPC_TEST_UNSET_TOKEN holding the OIDC token is not set")
+	}
+	{ // Fail: token rejected
+		c.Assert(os.WriteFile(tokenFile, []byte("forged"), 0600), IsNil)
+		_, _, err := mintCredentials(ctx, gcp)
+		c.Check(err, ErrorMatches, "failed to exchange OIDC token .*")
+	}
+}
+
+func (s *MySuite) TestSetCredentials(c *C) {
+	srv := fakeTokenServices(c)
+	defer srv.Close()
+	ctx := context.Background()
+	c.Assert(os.Setenv("GHPC_TEST_OIDC_TOKEN", "oidc-token"), IsNil)
+	defer os.Unsetenv("GHPC_TEST_OIDC_TOKEN")
+	defer func() {
+		mintedCredentials.expiry = time.Time{}
+		for _, k := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"} {
+			os.Unsetenv(k)
+		}
+	}()
+	creds := []config.Credentials{{Provider: "aws", TokenEnv: "GHPC_TEST_OIDC_TOKEN", RoleArn: "arn:aws:iam::123:role/ci", Lifetime: "30m"}}
+
+	c.Check(SetCredentials(ctx, nil), IsNil)
+	c.Check(os.Getenv("AWS_SESSION_TOKEN"), Equals, "")
+
+	c.Assert(SetCredentials(ctx, creds), IsNil)
+	c.Check(os.Getenv("AWS_SESSION_TOKEN"), Equals, "SESSION")
+
+	// credentials far from expiry are not minted again
+	os.Setenv("AWS_SESSION_TOKEN", "kept")
+	c.Assert(SetCredentials(ctx, creds), IsNil)
+	c.Check(os.Getenv("AWS_SESSION_TOKEN"), Equals, "kept")
+}
+
+func (s *MySuite) TestCredentialsVariable(c *C) {
+	srv := fakeTokenServices(c)
+	defer srv.Close()
+	rec, restore := fakeTerraform(c)
+	defer restore()
+	ctx := context.Background()
+	c.Assert(os.Setenv("GHPC_TEST_OIDC_TOKEN", "oidc-token"), IsNil)
+	defer os.Unsetenv("GHPC_TEST_OIDC_TOKEN")
+	defer func() {
+		mintedCredentials.expiry, mintedCredentials.vars = time.Time{}, nil
+		gcpauth.SetTokenSource(nil)
+		os.Unsetenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+		os.Unsetenv("CLOUDSDK_AUTH_ACCESS_TOKEN")
+	}()
+	creds := []config.Credentials{{
+		Provider: "gcp",
+		TokenEnv: "GHPC_TEST_OIDC_TOKEN",
+		Audience: "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/ci/providers/gitlab",
+		Variable: "access_token",
+	}}
+	c.Assert(SetCredentials(ctx, creds), IsNil)
+	c.Check(os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"), Equals, "federated")
+	c.Check(gcpauth.ClientOptions(), HasLen, 1) // ghpc clients use the minted token too
+	_, set := os.LookupEnv("TF_VAR_access_token")
+	c.Check(set, Equals, false)
+
+	// the variable reaches terraform run with the environment of the group
+	group := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(group, modulewriter.StateAccessFileName),
+		[]byte("impersonate_service_account: state@p.iam.gserviceaccount.com\n"), 0644), IsNil)
+	tf, err := ConfigureTerraform(group)
+	c.Assert(err, IsNil)
+	_, err = planModule(ctx, tf, filepath.Join(c.MkDir(), "plan.out"))
+	c.Assert(err, IsNil)
+
+	env := recordedEnv(c, rec, "plan")
+	c.Check(env["GOOGLE_BACKEND_IMPERSONATE_SERVICE_ACCOUNT"], Equals, "state@p.iam.gserviceaccount.com")
+	b, err := os.ReadFile(filepath.Join(rec, "plan.tfvars"))
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, `{"access_token":"federated"}`)
+	args, err := os.ReadFile(filepath.Join(rec, "plan.args"))
+	c.Assert(err, IsNil)
+	fields := strings.Fields(string(args))
+	vf := strings.TrimPrefix(fields[len(fields)-1], "-var-file=")
+	_, err = os.Stat(vf) // removed once the plan is made
+	c.Check(os.IsNotExist(err), Equals, true)
+}
@@ -0,0 +1,162 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/gcpauth"
+	"hpc-toolkit/pkg/modulereader"
+	"hpc-toolkit/pkg/modulewriter"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	cloudkms "google.golang.org/api/cloudkms/v1"
+)
+
+// AgeIdentityEnvVar is the environment variable naming the file with the age
+// identity used to decrypt outputs encrypted for age recipients
+const AgeIdentityEnvVar = "GHPC_AGE_IDENTITY_FILE"
+
+// encryptedSuffix is appended to the name of encrypted outputs files
+const encryptedSuffix = ".enc"
+
+// expandedBlueprint returns the expanded blueprint in artifactsDir, or an
+// empty blueprint if there is none
+func expandedBlueprint(artifactsDir string) (config.Blueprint, error) {
+	path := filepath.Join(artifactsDir, modulewriter.ExpandedBlueprintName)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return config.Blueprint{}, nil
+	}
+	bp, _, err := config.NewBlueprint(path)
+	return bp, err
+}
+
+// writeOutputsFile writes output values to path, encrypted if enabled, and
+// removes the file in the other format so stale values are never read
+func writeOutputsFile(ctx context.Context, ae config.ArtifactsEncryption, vals map[string]cty.Value, path string) error {
+	if !ae.Enabled() {
+		if err := removeIfExists(path + encryptedSuffix); err != nil {
+			return err
+		}
+		return modulewriter.WriteHclAttributes(vals, path)
+	}
+	ct, err := encryptArtifact(ctx, ae, modulewriter.FormatHclAttributes(vals))
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+encryptedSuffix, ct, 0600); err != nil {
+		return err
+	}
+	return removeIfExists(path)
+}
+
+// readOutputsFile reads output values written by writeOutputsFile
+func readOutputsFile(ctx context.Context, ae config.ArtifactsEncryption, path string) (map[string]cty.Value, error) {
+	if !ae.Enabled() {
+		return modulereader.ReadHclAttributes(path)
+	}
+	ct, err := os.ReadFile(path + encryptedSuffix)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := decryptArtifact(ctx, ae, ct)
+	if err != nil {
+		return nil, err
+	}
+	return modulereader.ParseHclAttributes(pt, path)
+}
+
+// writeInputsFile writes input values imported from outputs to path, only the
+// user can read it if the outputs are encrypted
+func writeInputsFile(ae config.ArtifactsEncryption, vals map[string]cty.Value, path string) error {
+	if !ae.Enabled() {
+		return modulewriter.WriteHclAttributes(vals, path)
+	}
+	return modulewriter.WriteSecretHclAttributes(vals, path)
+}
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func encryptArtifact(ctx context.Context, ae config.ArtifactsEncryption, pt []byte) ([]byte, error) {
+	if ae.KmsKey != "" {
+		s, err := cloudkms.NewService(ctx, gcpauth.ClientOptions()...)
+		if err != nil {
+			return nil, err
+		}
+		req := &cloudkms.EncryptRequest{Plaintext: base64.StdEncoding.EncodeToString(pt)}
+		resp, err := s.Projects.Locations.KeyRings.CryptoKeys.Encrypt(ae.KmsKey, req).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt outputs with %s: %w", ae.KmsKey, err)
+		}
+		return []byte(resp.Ciphertext + "\n"), nil
+	}
+	args := []string{"--encrypt", "--armor"}
+	for _, r := range ae.AgeRecipients {
+		args = append(args, "--recipient", r)
+	}
+	return execAge(ctx, pt, args...)
+}
+
+func decryptArtifact(ctx context.Context, ae config.ArtifactsEncryption, ct []byte) ([]byte, error) {
+	if ae.KmsKey != "" {
+		s, err := cloudkms.NewService(ctx, gcpauth.ClientOptions()...)
+		if err != nil {
+			return nil, err
+		}
+		req := &cloudkms.DecryptRequest{Ciphertext: strings.TrimSpace(string(ct))}
+		resp, err := s.Projects.Locations.KeyRings.CryptoKeys.Decrypt(ae.KmsKey, req).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt outputs with %s: %w", ae.KmsKey, err)
+		}
+		return base64.StdEncoding.DecodeString(resp.Plaintext)
+	}
+	identity := os.Getenv(AgeIdentityEnvVar)
+	if identity == "" {
+		return nil, fmt.Errorf("outputs are encrypted for age recipients, set %s to the file with the age identity to decrypt them", AgeIdentityEnvVar)
+	}
+	return execAge(ctx, ct, "--decrypt", "--identity", identity)
+}
+
+// execAge runs the age command line tool, passing in as its input
+func execAge(ctx context.Context, in []byte, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath("age"); err != nil {
+		return nil, &TfError{
+			help: "must have a copy of age installed in PATH to use age_recipients of artifacts_encryption (obtain at https://age-encryption.org)",
+			err:  err,
+		}
+	}
+	cmd := commandContext(ctx, "age", args...)
+	var out, stderr bytes.Buffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(in), &out, &stderr
+	if err := runCommand(cmd); err != nil {
+		return nil, fmt.Errorf("age failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out.Bytes(), nil
+}
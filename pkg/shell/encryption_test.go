@@ -0,0 +1,101 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shell
+
+import (
+	"context"
+	"hpc-toolkit/pkg/config"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+// fakeAge puts an "age" script in PATH that base64-encodes its input, or
+// decodes it with --decrypt
+func fakeAge(c *C) {
+	bin := c.MkDir()
+	script := "#!/bin/sh\ncase \"$1\" in --decrypt) base64 -d ;; *) base64 ;; esac\n"
+	c.Assert(os.WriteFile(filepath.Join(bin, "age"), []byte(script), 0755), IsNil)
+	c.Assert(os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH")), IsNil)
+}
+
+func (s *MySuite) TestOutputsFileEncryption(c *C) {
+	pathEnv := os.Getenv("PATH")
+	defer os.Setenv("PATH", pathEnv)
+	fakeAge(c)
+
+	ctx := context.Background()
+	path := filepath.Join(c.MkDir(), "zero_outputs.tfvars")
+	vals := map[string]cty.Value{"password": cty.StringVal("hunter2")}
+	ae := config.ArtifactsEncryption{AgeRecipients: []string{"age1xyz"}}
+
+	{ // plaintext
+		c.Assert(writeOutputsFile(ctx, config.ArtifactsEncryption{}, vals, path), IsNil)
+		got, err := readOutputsFile(ctx, config.ArtifactsEncryption{}, path)
+		c.Assert(err, IsNil)
+		c.Check(got, DeepEquals, vals)
+	}
+
+	{ // encrypted, plaintext file is removed
+		c.Assert(writeOutputsFile(ctx, ae, vals, path), IsNil)
+		_, err := os.Stat(path)
+		c.Check(os.IsNotExist(err), Equals, true)
+		b, err := os.ReadFile(path + encryptedSuffix)
+		c.Assert(err, IsNil)
+		c.Check(strings.Contains(string(b), "hunter2"), Equals, false)
+
+		os.Setenv(AgeIdentityEnvVar, "/keys/age.txt")
+		got, err := readOutputsFile(ctx, ae, path)
+		c.Assert(err, IsNil)
+		c.Check(got, DeepEquals, vals)
+
+		os.Unsetenv(AgeIdentityEnvVar)
+		_, err = readOutputsFile(ctx, ae, path)
+		c.Check(err, ErrorMatches, ".*set GHPC_AGE_IDENTITY_FILE.*")
+	}
+
+	{ // back to plaintext, encrypted file is removed
+		c.Assert(writeOutputsFile(ctx, config.ArtifactsEncryption{}, vals, path), IsNil)
+		_, err := os.Stat(path + encryptedSuffix)
+		c.Check(os.IsNotExist(err), Equals, true)
+	}
+}
+
+func (s *MySuite) TestInputsFileMode(c *C) {
+	path := filepath.Join(c.MkDir(), "one_inputs.auto.tfvars")
+	vals := map[string]cty.Value{"password": cty.StringVal("hunter2")}
+	ae := config.ArtifactsEncryption{AgeRecipients: []string{"age1xyz"}}
+
+	c.Assert(os.WriteFile(path, nil, 0644), IsNil)
+	// decrypted inputs are only readable by the user, even over an existing file
+	c.Assert(writeInputsFile(ae, vals, path), IsNil)
+	st, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Check(st.Mode().Perm(), Equals, os.FileMode(0600))
+}
+
+func (s *MySuite) TestExecAgeMissing(c *C) {
+	pathEnv := os.Getenv("PATH")
+	defer os.Setenv("PATH", pathEnv)
+	os.Setenv("PATH", "")
+
+	_, err := execAge(context.Background(), nil, "--decrypt")
+	c.Check(err, ErrorMatches, "(?s)must have a copy of age installed in PATH.*")
+}
@@ -0,0 +1,317 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/gcpauth"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/exp/maps"
+	cloudkms "google.golang.org/api/cloudkms/v1"
+)
+
+const (
+	plainStateName       = "terraform.tfstate"
+	plainStateBackupName = "terraform.tfstate.backup"
+)
+
+// encryptedState is the content of the encrypted state file. The state is
+// encrypted with AES-256-GCM, the key is either wrapped with a Cloud KMS key,
+// as state may exceed the size KMS encrypts, or derived from a passphrase.
+type encryptedState struct {
+	KmsKey     string `json:"kms_key,omitempty"`
+	WrappedKey string `json:"wrapped_key,omitempty"`
+	Salt       []byte `json:"salt,omitempty"` // of the key derived from the passphrase
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+var (
+	openStatesMu sync.Mutex
+	// openStates are group directories whose state is decrypted for terraform
+	openStates = map[string]config.LocalStateEncryption{}
+)
+
+// OpenLocalState decrypts the state of the deployment group of tf, if it has a
+// local-encrypted backend, for terraform to use it as local state. The
+// returned function encrypts it back and removes the plaintext copies; it is
+// called once terraform commands of the group are done, so that only the
+// group operated on is decrypted, and only meanwhile.
+//
+// If ghpc exits in between, SealLocalStates encrypts the state. If it
+// crashes or is killed, the plaintext state is left in the group directory
+// until the next command on the group adopts it, provided it is not older
+// than the encrypted state.
+func OpenLocalState(ctx context.Context, tf *tfexec.Terraform) (func(), error) {
+	dir := tf.WorkingDir()
+	if err := openLocalState(ctx, dir); err != nil {
+		return nil, err
+	}
+	return func() {
+		// states are encrypted back even if the command was interrupted
+		if err := sealOpenState(context.WithoutCancel(ctx), dir); err != nil {
+			logging.Error("%s", err)
+		}
+	}, nil
+}
+
+// openLocalState decrypts the state of a group with a local-encrypted backend,
+// unless it is already open. A plaintext state left by a crashed run is kept
+// if it is the latest one.
+func openLocalState(ctx context.Context, groupDir string) error {
+	enc, ok, err := modulewriter.StateEncryption(groupDir)
+	if err != nil || !ok {
+		return err
+	}
+	openStatesMu.Lock()
+	defer openStatesMu.Unlock()
+	if _, open := openStates[groupDir]; open {
+		return nil
+	}
+
+	plain := filepath.Join(groupDir, plainStateName)
+	ct, err := os.ReadFile(filepath.Join(groupDir, modulewriter.EncryptedStateFileName))
+	if errors.Is(err, os.ErrNotExist) { // not deployed yet
+		ct, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	left, err := os.ReadFile(plain)
+	switch {
+	case err == nil: // left by a crashed run
+		if err := checkLeftoverState(ctx, enc, groupDir, left, ct); err != nil {
+			return err
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	case ct != nil:
+		pt, err := decryptState(ctx, enc, ct)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(plain, pt, 0600); err != nil {
+			return err
+		}
+	}
+	openStates[groupDir] = enc
+	return nil
+}
+
+// tfStateVersion identifies versions of a terraform state
+type tfStateVersion struct {
+	Lineage string `json:"lineage"`
+	Serial  int64  `json:"serial"`
+}
+
+// checkLeftoverState checks that the plaintext state left in groupDir is not
+// older than the encrypted state ct, if any, so no change is lost by adopting
+// it
+func checkLeftoverState(ctx context.Context, enc config.LocalStateEncryption, groupDir string, left []byte, ct []byte) error {
+	if ct == nil {
+		return nil
+	}
+	sealed, err := decryptState(ctx, enc, ct)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(left, sealed) {
+		return nil
+	}
+	var lv, sv tfStateVersion
+	if json.Unmarshal(left, &lv) == nil && json.Unmarshal(sealed, &sv) == nil && lv.Lineage == sv.Lineage && lv.Serial >= sv.Serial {
+		return nil
+	}
+	return fmt.Errorf("terraform state %s left in plaintext by a crashed run is older than, or unrelated to, the encrypted state %s; "+
+		"remove the one that is out of date", filepath.Join(groupDir, plainStateName), filepath.Join(groupDir, modulewriter.EncryptedStateFileName))
+}
+
+// SealLocalStates encrypts states decrypted for terraform and removes their
+// plaintext copies. It must be called before ghpc exits.
+func SealLocalStates(ctx context.Context) error {
+	openStatesMu.Lock()
+	dirs := maps.Keys(openStates)
+	openStatesMu.Unlock()
+	errs := config.Errors{}
+	for _, dir := range dirs {
+		errs.Add(sealOpenState(ctx, dir))
+	}
+	return errs.OrNil()
+}
+
+// sealOpenState encrypts the state of the group if it is open
+func sealOpenState(ctx context.Context, groupDir string) error {
+	openStatesMu.Lock()
+	defer openStatesMu.Unlock()
+	enc, open := openStates[groupDir]
+	if !open {
+		return nil
+	}
+	if err := sealLocalState(ctx, groupDir, enc); err != nil {
+		return fmt.Errorf("failed to encrypt terraform state in %s, it is left in plaintext: %w", groupDir, err)
+	}
+	delete(openStates, groupDir)
+	return nil
+}
+
+func sealLocalState(ctx context.Context, groupDir string, enc config.LocalStateEncryption) error {
+	plain := filepath.Join(groupDir, plainStateName)
+	pt, err := os.ReadFile(plain)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ct, err := encryptState(ctx, enc, pt)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(groupDir, modulewriter.EncryptedStateFileName)
+	if err := os.WriteFile(dst+".tmp", ct, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(dst+".tmp", dst); err != nil {
+		return err
+	}
+	for _, p := range []string{plain, filepath.Join(groupDir, plainStateBackupName)} {
+		if err := removeIfExists(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encryptState(ctx context.Context, enc config.LocalStateEncryption, pt []byte) ([]byte, error) {
+	es := encryptedState{KmsKey: enc.KmsKey}
+	key := make([]byte, 32)
+	if enc.KmsKey != "" {
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		wrapped, err := kmsWrapKey(ctx, enc.KmsKey, key)
+		if err != nil {
+			return nil, err
+		}
+		es.WrappedKey = wrapped
+	} else {
+		es.Salt = make([]byte, 16)
+		if _, err := rand.Read(es.Salt); err != nil {
+			return nil, err
+		}
+		var err error
+		if key, err = passphraseKey(enc.PassphraseEnv, es.Salt); err != nil {
+			return nil, err
+		}
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	es.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(es.Nonce); err != nil {
+		return nil, err
+	}
+	es.Ciphertext = gcm.Seal(nil, es.Nonce, pt, nil)
+	return json.MarshalIndent(es, "", "  ")
+}
+
+func decryptState(ctx context.Context, enc config.LocalStateEncryption, data []byte) ([]byte, error) {
+	var es encryptedState
+	if err := json.Unmarshal(data, &es); err != nil {
+		return nil, fmt.Errorf("failed to read encrypted terraform state: %w", err)
+	}
+	var key []byte
+	var err error
+	if es.KmsKey != "" {
+		key, err = kmsUnwrapKey(ctx, es.KmsKey, es.WrappedKey)
+	} else {
+		key, err = passphraseKey(enc.PassphraseEnv, es.Salt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := gcm.Open(nil, es.Nonce, es.Ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt terraform state, the key or passphrase is wrong or the state is corrupted")
+	}
+	return pt, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func passphraseKey(env string, salt []byte) ([]byte, error) {
+	pass := os.Getenv(env)
+	if pass == "" {
+		return nil, fmt.Errorf("terraform state is encrypted with a passphrase, set it in environment variable %s", env)
+	}
+	return scrypt.Key([]byte(pass), salt, 1<<15, 8, 1, 32)
+}
+
+// kmsWrapKey encrypts the state key with the Cloud KMS key, it is replaced in tests
+var kmsWrapKey = func(ctx context.Context, kmsKey string, key []byte) (string, error) {
+	s, err := cloudkms.NewService(ctx, gcpauth.ClientOptions()...)
+	if err != nil {
+		return "", err
+	}
+	req := &cloudkms.EncryptRequest{Plaintext: base64.StdEncoding.EncodeToString(key)}
+	resp, err := s.Projects.Locations.KeyRings.CryptoKeys.Encrypt(kmsKey, req).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt terraform state key with %s: %w", kmsKey, err)
+	}
+	return resp.Ciphertext, nil
+}
+
+// kmsUnwrapKey decrypts the state key with the Cloud KMS key, it is replaced in tests
+var kmsUnwrapKey = func(ctx context.Context, kmsKey string, wrapped string) ([]byte, error) {
+	s, err := cloudkms.NewService(ctx, gcpauth.ClientOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	req := &cloudkms.DecryptRequest{Ciphertext: wrapped}
+	resp, err := s.Projects.Locations.KeyRings.CryptoKeys.Decrypt(kmsKey, req).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt terraform state key with %s: %w", kmsKey, err)
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shell
+
+import (
+	"context"
+	"encoding/base64"
+	"hpc-toolkit/pkg/modulewriter"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestLocalState(c *C) {
+	ctx := context.Background()
+	state := []byte(`{"version": 4, "resources": [{"name": "secret"}]}`)
+
+	{ // Passphrase
+		dir := c.MkDir()
+		c.Assert(os.WriteFile(filepath.Join(dir, modulewriter.StateEncryptionFileName), []byte("passphrase_env: TEST_STATE_PASSPHRASE\n"), 0644), IsNil)
+		os.Setenv("TEST_STATE_PASSPHRASE", "correct horse")
+		defer os.Unsetenv("TEST_STATE_PASSPHRASE")
+
+		// not deployed yet, terraform writes the plaintext state
+		c.Assert(openLocalState(ctx, dir), IsNil)
+		c.Assert(os.WriteFile(filepath.Join(dir, plainStateName), state, 0600), IsNil)
+		c.Assert(os.WriteFile(filepath.Join(dir, plainStateBackupName), state, 0600), IsNil)
+		c.Assert(SealLocalStates(ctx), IsNil)
+
+		enc, err := os.ReadFile(filepath.Join(dir, modulewriter.EncryptedStateFileName))
+		c.Assert(err, IsNil)
+		c.Check(string(enc), Not(Matches), "(?s).*secret.*")
+		for _, n := range []string{plainStateName, plainStateBackupName} {
+			_, err := os.Stat(filepath.Join(dir, n))
+			c.Check(os.IsNotExist(err), Equals, true)
+		}
+
+		c.Assert(openLocalState(ctx, dir), IsNil)
+		got, err := os.ReadFile(filepath.Join(dir, plainStateName))
+		c.Assert(err, IsNil)
+		c.Check(got, DeepEquals, state)
+		c.Assert(SealLocalStates(ctx), IsNil)
+
+		os.Setenv("TEST_STATE_PASSPHRASE", "wrong")
+		c.Check(openLocalState(ctx, dir), ErrorMatches, "failed to decrypt terraform state.*")
+		os.Unsetenv("TEST_STATE_PASSPHRASE")
+		c.Check(openLocalState(ctx, dir), ErrorMatches, ".*set it in environment variable TEST_STATE_PASSPHRASE")
+	}
+
+	{ // KMS key
+		defer func(w, u interface{}) {
+			kmsWrapKey = w.(func(context.Context, string, []byte) (string, error))
+			kmsUnwrapKey = u.(func(context.Context, string, string) ([]byte, error))
+		}(kmsWrapKey, kmsUnwrapKey)
+		kmsWrapKey = func(_ context.Context, _ string, key []byte) (string, error) {
+			return base64.StdEncoding.EncodeToString(key), nil
+		}
+		kmsUnwrapKey = func(_ context.Context, _ string, wrapped string) ([]byte, error) {
+			return base64.StdEncoding.DecodeString(wrapped)
+		}
+
+		dir := c.MkDir()
+		c.Assert(os.WriteFile(filepath.Join(dir, modulewriter.StateEncryptionFileName), []byte("kms_key: projects/p/locations/l/keyRings/r/cryptoKeys/k\n"), 0644), IsNil)
+		c.Assert(openLocalState(ctx, dir), IsNil)
+		c.Assert(os.WriteFile(filepath.Join(dir, plainStateName), state, 0600), IsNil)
+		c.Assert(SealLocalStates(ctx), IsNil)
+		c.Assert(openLocalState(ctx, dir), IsNil)
+		got, err := os.ReadFile(filepath.Join(dir, plainStateName))
+		c.Assert(err, IsNil)
+		c.Check(got, DeepEquals, state)
+		c.Assert(SealLocalStates(ctx), IsNil)
+	}
+
+	{ // Plaintext state left by a crashed run
+		dir := c.MkDir()
+		c.Assert(os.WriteFile(filepath.Join(dir, modulewriter.StateEncryptionFileName), []byte("passphrase_env: TEST_STATE_PASSPHRASE\n"), 0644), IsNil)
+		os.Setenv("TEST_STATE_PASSPHRASE", "correct horse")
+		defer os.Unsetenv("TEST_STATE_PASSPHRASE")
+		v1 := []byte(`{"version": 4, "lineage": "l", "serial": 1}`)
+		v2 := []byte(`{"version": 4, "lineage": "l", "serial": 2}`)
+
+		c.Assert(openLocalState(ctx, dir), IsNil)
+		c.Assert(os.WriteFile(filepath.Join(dir, plainStateName), v2, 0600), IsNil)
+		c.Assert(SealLocalStates(ctx), IsNil)
+
+		// older than the encrypted state
+		c.Assert(os.WriteFile(filepath.Join(dir, plainStateName), v1, 0600), IsNil)
+		c.Check(openLocalState(ctx, dir), ErrorMatches, ".*left in plaintext by a crashed run is older than.*")
+
+		// newer, it is adopted
+		v3 := []byte(`{"version": 4, "lineage": "l", "serial": 3}`)
+		c.Assert(os.WriteFile(filepath.Join(dir, plainStateName), v3, 0600), IsNil)
+		c.Assert(openLocalState(ctx, dir), IsNil)
+		got, err := os.ReadFile(filepath.Join(dir, plainStateName))
+		c.Assert(err, IsNil)
+		c.Check(got, DeepEquals, v3)
+		c.Assert(SealLocalStates(ctx), IsNil)
+	}
+
+	{ // Only the group operated on is decrypted, while it is
+		tfPath, err := exec.LookPath("true")
+		c.Assert(err, IsNil)
+		os.Setenv("TEST_STATE_PASSPHRASE", "correct horse")
+		defer os.Unsetenv("TEST_STATE_PASSPHRASE")
+		dirs := []string{c.MkDir(), c.MkDir()}
+		for _, dir := range dirs {
+			c.Assert(os.WriteFile(filepath.Join(dir, modulewriter.StateEncryptionFileName), []byte("passphrase_env: TEST_STATE_PASSPHRASE\n"), 0644), IsNil)
+			c.Assert(openLocalState(ctx, dir), IsNil)
+			c.Assert(os.WriteFile(filepath.Join(dir, plainStateName), state, 0600), IsNil)
+		}
+		c.Assert(SealLocalStates(ctx), IsNil)
+
+		tf, err := tfexec.NewTerraform(dirs[0], tfPath)
+		c.Assert(err, IsNil)
+		seal, err := OpenLocalState(ctx, tf)
+		c.Assert(err, IsNil)
+		_, err = os.Stat(filepath.Join(dirs[0], plainStateName))
+		c.Check(err, IsNil)
+		_, err = os.Stat(filepath.Join(dirs[1], plainStateName))
+		c.Check(os.IsNotExist(err), Equals, true)
+
+		seal()
+		_, err = os.Stat(filepath.Join(dirs[0], plainStateName))
+		c.Check(os.IsNotExist(err), Equals, true)
+	}
+
+	{ // Other backends are left alone
+		dir := c.MkDir()
+		c.Assert(os.WriteFile(filepath.Join(dir, plainStateName), state, 0600), IsNil)
+		c.Assert(openLocalState(ctx, dir), IsNil)
+		c.Assert(SealLocalStates(ctx), IsNil)
+		_, err := os.Stat(filepath.Join(dir, plainStateName))
+		c.Check(err, IsNil)
+	}
+}
@@ -18,10 +18,22 @@ package shell
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
+
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/zclconf/go-cty/cty"
 )
 
 // ConfigurePacker errors if packer is not in the user PATH
@@ -37,9 +49,9 @@ func ConfigurePacker() error {
 }
 
 // ExecPackerCmd runs packer with arguments in the given working directory
-// optionally prints to stdout/stderr
-func ExecPackerCmd(workingDir string, printToScreen bool, args ...string) error {
-	cmd := exec.Command("packer", args...)
+// optionally prints to stdout/stderr; packer is interrupted once ctx is done
+func ExecPackerCmd(ctx context.Context, workingDir string, printToScreen bool, args ...string) error {
+	cmd := commandContext(ctx, "packer", args...)
 	cmd.Dir = workingDir
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -77,7 +89,7 @@ func ExecPackerCmd(workingDir string, printToScreen bool, args ...string) error
 	}()
 	wg.Wait()
 
-	if err := cmd.Wait(); err != nil {
+	if err := waitCommand(cmd); err != nil {
 		if !printToScreen {
 			io.Copy(os.Stdout, outBuf)
 			io.Copy(os.Stderr, errBuf)
@@ -86,3 +98,228 @@ func ExecPackerCmd(workingDir string, printToScreen bool, args ...string) error
 	}
 	return nil
 }
+
+// PackerPlugin is a plugin required by a packer module in its
+// packer.required_plugins block
+type PackerPlugin struct {
+	Name       string
+	Source     string
+	Constraint string
+}
+
+func (p PackerPlugin) String() string {
+	return fmt.Sprintf("%s (%s %s)", p.Name, p.Source, p.Constraint)
+}
+
+// packerRequirements are the required_version of packer and the plugins
+// declared in the packer blocks of a module
+type packerRequirements struct {
+	version string
+	plugins []PackerPlugin
+}
+
+// packerOutput runs packer and returns its stdout, replaced in tests
+var packerOutput = func(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := commandContext(ctx, "packer", args...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := runCommand(cmd)
+	return out.Bytes(), err
+}
+
+// readPackerRequirements reads the packer blocks of the HCL files of the module
+func readPackerRequirements(moduleDir string) (packerRequirements, error) {
+	req := packerRequirements{}
+	files, err := filepath.Glob(filepath.Join(moduleDir, "*.pkr.hcl"))
+	if err != nil {
+		return req, err
+	}
+	parser := hclparse.NewParser()
+	for _, file := range files {
+		f, diags := parser.ParseHCLFile(file)
+		if diags.HasErrors() {
+			return req, diags
+		}
+		content, _, diags := f.Body.PartialContent(&hcl.BodySchema{Blocks: []hcl.BlockHeaderSchema{{Type: "packer"}}})
+		if diags.HasErrors() {
+			return req, diags
+		}
+		for _, block := range content.Blocks {
+			pc, _, diags := block.Body.PartialContent(&hcl.BodySchema{
+				Attributes: []hcl.AttributeSchema{{Name: "required_version"}},
+				Blocks:     []hcl.BlockHeaderSchema{{Type: "required_plugins"}},
+			})
+			if diags.HasErrors() {
+				return req, diags
+			}
+			if a, ok := pc.Attributes["required_version"]; ok {
+				v, diags := a.Expr.Value(nil)
+				if diags.HasErrors() {
+					return req, diags
+				}
+				if v.Type() != cty.String {
+					return req, fmt.Errorf("%s: required_version must be a string", a.Range)
+				}
+				req.version = v.AsString()
+			}
+			for _, rp := range pc.Blocks {
+				plugins, err := requiredPlugins(rp.Body)
+				if err != nil {
+					return req, err
+				}
+				req.plugins = append(req.plugins, plugins...)
+			}
+		}
+	}
+	sort.Slice(req.plugins, func(i, j int) bool { return req.plugins[i].Name < req.plugins[j].Name })
+	return req, nil
+}
+
+func requiredPlugins(body hcl.Body) ([]PackerPlugin, error) {
+	attrs, diags := body.JustAttributes()
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	plugins := []PackerPlugin{}
+	for name, a := range attrs {
+		v, diags := a.Expr.Value(nil)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		p := PackerPlugin{Name: name}
+		if v.Type().IsObjectType() {
+			for k, f := range map[string]*string{"source": &p.Source, "version": &p.Constraint} {
+				if v.Type().HasAttribute(k) && v.GetAttr(k).Type() == cty.String && !v.GetAttr(k).IsNull() {
+					*f = v.GetAttr(k).AsString()
+				}
+			}
+		}
+		if p.Source == "" {
+			return nil, fmt.Errorf("%s: required plugin %q must set a source", a.Range, name)
+		}
+		if p.Constraint == "" {
+			p.Constraint = ">= 0"
+		}
+		plugins = append(plugins, p)
+	}
+	return plugins, nil
+}
+
+// pluginFileRe matches binaries of installed plugins, e.g.
+// packer-plugin-googlecompute_v1.1.4_x5.0_linux_amd64
+var pluginFileRe = regexp.MustCompile(`^packer-plugin-[^_]+_v([^_]+)_x[^_]+_`)
+
+// installedPackerPlugins reads the output of `packer plugins installed`, a
+// path per plugin binary ending in SOURCE/BINARY, into versions by source
+func installedPackerPlugins(out string) map[string][]*version.Version {
+	installed := map[string][]*version.Version{}
+	for _, line := range strings.Split(out, "\n") {
+		line = filepath.ToSlash(strings.TrimSpace(line))
+		m := pluginFileRe.FindStringSubmatch(path.Base(line))
+		if m == nil {
+			continue
+		}
+		v, err := version.NewVersion(m[1])
+		if err != nil {
+			continue
+		}
+		parts := strings.Split(path.Dir(line), "/")
+		if len(parts) < 3 {
+			continue
+		}
+		source := strings.ToLower(strings.Join(parts[len(parts)-3:], "/"))
+		installed[source] = append(installed[source], v)
+	}
+	return installed
+}
+
+var packerVersionRe = regexp.MustCompile(`v?(\d+\.\d+\.\d+\S*)`)
+
+// CheckPackerRequirements errors if the installed packer does not satisfy the
+// required_version of the module in moduleDir, and returns the plugins the
+// module requires that are not installed at a version satisfying their
+// constraint, which `packer init` installs
+func CheckPackerRequirements(ctx context.Context, moduleDir string) ([]PackerPlugin, error) {
+	req, err := readPackerRequirements(moduleDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read packer requirements of %s: %w", moduleDir, err)
+	}
+	if req.version != "" {
+		if err := checkPackerVersion(ctx, moduleDir, req.version); err != nil {
+			return nil, err
+		}
+	}
+	if len(req.plugins) == 0 {
+		return nil, nil
+	}
+	return missingPackerPlugins(ctx, moduleDir, req.plugins)
+}
+
+// checkPackerVersion errors if the installed packer does not satisfy the
+// required version
+func checkPackerVersion(ctx context.Context, moduleDir string, required string) error {
+	c, err := version.NewConstraint(required)
+	if err != nil {
+		return fmt.Errorf("invalid required_version of packer module %s: %w", moduleDir, err)
+	}
+	out, err := packerOutput(ctx, "version")
+	if err != nil {
+		return fmt.Errorf("failed to get version of packer: %w", err)
+	}
+	m := packerVersionRe.FindStringSubmatch(string(out))
+	if m == nil {
+		return fmt.Errorf("failed to parse version of packer from %q", strings.TrimSpace(string(out)))
+	}
+	v, err := version.NewVersion(m[1])
+	if err != nil {
+		return err
+	}
+	if !c.Check(v) {
+		return &TfError{
+			help: fmt.Sprintf("packer module %s requires packer %s, install a matching version (obtain at https://packer.io)", moduleDir, required),
+			err:  fmt.Errorf("installed version of packer is %s", v),
+		}
+	}
+	return nil
+}
+
+// missingPackerPlugins returns the plugins that are not installed at a
+// version satisfying their constraint
+func missingPackerPlugins(ctx context.Context, moduleDir string, plugins []PackerPlugin) ([]PackerPlugin, error) {
+	out, err := packerOutput(ctx, "plugins", "installed")
+	if err != nil {
+		return nil, &TfError{
+			help: "failed to list installed packer plugins, packer may be too old to support `packer plugins installed`",
+			err:  err,
+		}
+	}
+	installed := installedPackerPlugins(string(out))
+	missing := []PackerPlugin{}
+	for _, p := range plugins {
+		c, err := version.NewConstraint(p.Constraint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version of packer plugin %s in %s: %w", p.Name, moduleDir, err)
+		}
+		found := false
+		for _, v := range installed[strings.ToLower(p.Source)] {
+			found = found || c.Check(v)
+		}
+		if !found {
+			missing = append(missing, p)
+		}
+	}
+	return missing, nil
+}
+
+// MissingPackerPluginsError is the error of a packer module whose required
+// plugins are not installed
+func MissingPackerPluginsError(moduleDir string, missing []PackerPlugin) error {
+	names := []string{}
+	for _, p := range missing {
+		names = append(names, p.String())
+	}
+	return &TfError{
+		help: fmt.Sprintf("packer module %s requires plugins that are not installed, install them by running: packer init %s", moduleDir, moduleDir),
+		err:  fmt.Errorf("missing plugins: %s", strings.Join(names, ", ")),
+	}
+}
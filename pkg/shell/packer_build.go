@@ -0,0 +1,138 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// packerLogsDirName is the directory of artifacts keeping output of packer
+// builds, one file per build
+const packerLogsDirName = "packer_logs"
+
+// PackerLogPath is the log file of a build of the packer module started at t
+func PackerLogPath(artifactsDir string, group config.GroupName, id config.ModuleID, t time.Time) string {
+	name := fmt.Sprintf("%s_%s_%s.log", group, id, t.UTC().Format("20060102T150405Z"))
+	return filepath.Join(artifactsDir, packerLogsDirName, name)
+}
+
+// PackerImage is an image created by a packer build
+type PackerImage struct {
+	Build   string // e.g. "googlecompute.toolkit_image"
+	Project string
+	Name    string
+}
+
+// PackerBuildSummary is what a packer build created and the errors it
+// reported, parsed from its output
+type PackerBuildSummary struct {
+	Images []PackerImage
+	// Artifacts are other artifacts of successful builds, as packer describes them
+	Artifacts []string
+	Errors    []string
+}
+
+// PackerBuild runs `packer build` in the module directory, its output is
+// printed and written to the log file
+func PackerBuild(ctx context.Context, moduleDir string, logPath string) (PackerBuildSummary, error) {
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		return PackerBuildSummary{}, err
+	}
+	f, err := os.Create(logPath)
+	if err != nil {
+		return PackerBuildSummary{}, err
+	}
+	defer f.Close()
+
+	cmd := commandContext(ctx, "packer", "build", "-color=false", ".")
+	cmd.Dir = moduleDir
+	cmd.Stdout, cmd.Stderr = io.MultiWriter(os.Stdout, f), io.MultiWriter(os.Stderr, f)
+	runErr := runCommand(cmd)
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return PackerBuildSummary{}, err
+	}
+	s, err := parsePackerBuildOutput(f)
+	if err != nil {
+		return PackerBuildSummary{}, err
+	}
+	return s, runErr
+}
+
+var (
+	// packer lists artifacts and errors of builds at the end of its output
+	packerArtifactsHeader = "==> Builds finished. The artifacts of successful builds are:"
+	packerErrorsHeader    = "==> Some builds didn't complete successfully and had errors:"
+	packerListItemRe      = regexp.MustCompile(`^--> ([^:]+): (.*)$`)
+	packerBuildErrorRe    = regexp.MustCompile(`^Build '([^']+)' errored(?: after [^:]+)?: (.*)$`)
+	// googlecompute describes the image it created, older versions without project
+	packerImageRe = regexp.MustCompile(`^A disk image was created(?: in the '([^']+)' project)?: (\S+)$`)
+)
+
+// parsePackerBuildOutput finds images created by the build and its errors in
+// the console output of packer
+func parsePackerBuildOutput(r io.Reader) (PackerBuildSummary, error) {
+	s := PackerBuildSummary{}
+	section := ""
+	addError := func(e string) {
+		if !slices.Contains(s.Errors, e) {
+			s.Errors = append(s.Errors, e)
+		}
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == packerArtifactsHeader || line == packerErrorsHeader:
+			section = line
+			continue
+		case strings.HasPrefix(line, "==> "):
+			section = ""
+		}
+		if m := packerBuildErrorRe.FindStringSubmatch(line); m != nil {
+			addError(fmt.Sprintf("%s: %s", m[1], m[2]))
+			continue
+		}
+		m := packerListItemRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		switch section {
+		case packerErrorsHeader:
+			addError(fmt.Sprintf("%s: %s", m[1], m[2]))
+		case packerArtifactsHeader:
+			if im := packerImageRe.FindStringSubmatch(m[2]); im != nil {
+				s.Images = append(s.Images, PackerImage{Build: m[1], Project: im[1], Name: im[2]})
+			} else {
+				s.Artifacts = append(s.Artifacts, fmt.Sprintf("%s: %s", m[1], m[2]))
+			}
+		}
+	}
+	return s, sc.Err()
+}
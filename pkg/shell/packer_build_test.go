@@ -0,0 +1,92 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shell
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+const packerBuildOutput = `googlecompute.toolkit_image: output will be in this color.
+
+==> googlecompute.toolkit_image: Checking image does not exist...
+==> googlecompute.toolkit_image: Creating temporary RSA SSH key for instance...
+==> googlecompute.toolkit_image: Creating image...
+Build 'googlecompute.toolkit_image' finished after 9 minutes 12 seconds.
+
+==> Wait completed after 9 minutes 12 seconds
+
+==> Builds finished. The artifacts of successful builds are:
+--> googlecompute.toolkit_image: A disk image was created in the 'my-project' project: hpc-image-20240102t030405z
+--> googlecompute.toolkit_image: Packer manifest written to packer-manifest.json
+`
+
+const packerFailedOutput = `==> googlecompute.toolkit_image: Error waiting for SSH: ssh: handshake failed
+Build 'googlecompute.toolkit_image' errored after 5 minutes 1 second: Error waiting for SSH: ssh: handshake failed
+
+==> Wait completed after 5 minutes 1 second
+
+==> Some builds didn't complete successfully and had errors:
+--> googlecompute.toolkit_image: Error waiting for SSH: ssh: handshake failed
+
+==> Builds finished but no artifacts were created.
+`
+
+func (s *MySuite) TestParsePackerBuildOutput(c *C) {
+	{ // Success
+		got, err := parsePackerBuildOutput(strings.NewReader(packerBuildOutput))
+		c.Assert(err, IsNil)
+		c.Check(got, DeepEquals, PackerBuildSummary{
+			Images:    []PackerImage{{Build: "googlecompute.toolkit_image", Project: "my-project", Name: "hpc-image-20240102t030405z"}},
+			Artifacts: []string{"googlecompute.toolkit_image: Packer manifest written to packer-manifest.json"},
+		})
+	}
+
+	{ // Failure, errors are reported once
+		got, err := parsePackerBuildOutput(strings.NewReader(packerFailedOutput))
+		c.Assert(err, IsNil)
+		c.Check(got, DeepEquals, PackerBuildSummary{
+			Errors: []string{"googlecompute.toolkit_image: Error waiting for SSH: ssh: handshake failed"},
+		})
+	}
+}
+
+func (s *MySuite) TestPackerBuild(c *C) {
+	bin := c.MkDir()
+	out := filepath.Join(c.MkDir(), "out.txt")
+	c.Assert(os.WriteFile(out, []byte(packerBuildOutput), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(bin, "packer"), []byte("#!/bin/sh\ncat "+out+"\n[ \"$1 $2 $3\" = \"build -color=false .\" ]\n"), 0755), IsNil)
+	pathEnv := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+pathEnv)
+	defer os.Setenv("PATH", pathEnv)
+
+	artifacts := c.MkDir()
+	logPath := PackerLogPath(artifacts, "images", "image", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	c.Check(logPath, Equals, filepath.Join(artifacts, "packer_logs", "images_image_20240102T030405Z.log"))
+
+	got, err := PackerBuild(context.Background(), c.MkDir(), logPath)
+	c.Assert(err, IsNil)
+	c.Check(got.Images, HasLen, 1)
+	log, err := os.ReadFile(logPath)
+	c.Assert(err, IsNil)
+	c.Check(string(log), Equals, packerBuildOutput)
+}
@@ -17,9 +17,13 @@ limitations under the License.
 package shell
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 
 	. "gopkg.in/check.v1"
 )
@@ -45,9 +49,74 @@ func (s *MySuite) TestPacker(c *C) {
 	c.Assert(errors.As(err, &tfe), Equals, true)
 
 	// executing with help argument (safe against RedHat binary named packer)
-	err = ExecPackerCmd(".", true, "-h")
+	err = ExecPackerCmd(context.Background(), ".", true, "-h")
 	c.Assert(err, IsNil)
 	// executing with arguments will error
-	err = ExecPackerCmd(".", false)
+	err = ExecPackerCmd(context.Background(), ".", false)
 	c.Assert(err, NotNil)
 }
+
+const packerVersions = `
+packer {
+  required_version = ">= 1.7.9"
+  required_plugins {
+    googlecompute = {
+      version = "~> 1.1.0"
+      source  = "github.com/hashicorp/googlecompute"
+    }
+    ansible = {
+      version = ">= 1.0.0"
+      source  = "github.com/hashicorp/ansible"
+    }
+  }
+}
+`
+
+// fakePacker answers `packer version` and `packer plugins installed`
+func fakePacker(packerVersion string, plugins ...string) func(context.Context, ...string) ([]byte, error) {
+	return func(_ context.Context, args ...string) ([]byte, error) {
+		switch strings.Join(args, " ") {
+		case "version":
+			return []byte(fmt.Sprintf("Packer v%s\n", packerVersion)), nil
+		case "plugins installed":
+			return []byte(strings.Join(plugins, "\n")), nil
+		}
+		return nil, fmt.Errorf("unexpected packer %v", args)
+	}
+}
+
+func (s *MySuite) TestCheckPackerRequirements(c *C) {
+	defer func(f func(context.Context, ...string) ([]byte, error)) { packerOutput = f }(packerOutput)
+	ctx := context.Background()
+	dir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "versions.pkr.hcl"), []byte(packerVersions), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(dir, "image.pkr.hcl"), []byte(`source "null" "x" {}`), 0644), IsNil)
+	gce := "/root/.config/packer/plugins/github.com/hashicorp/googlecompute/packer-plugin-googlecompute_v%s_x5.0_linux_amd64"
+	ansible := "/root/.config/packer/plugins/github.com/hashicorp/ansible/packer-plugin-ansible_v1.1.1_x5.0_linux_amd64"
+
+	{ // all plugins installed
+		packerOutput = fakePacker("1.10.0", fmt.Sprintf(gce, "1.1.4"), ansible)
+		missing, err := CheckPackerRequirements(ctx, dir)
+		c.Assert(err, IsNil)
+		c.Check(missing, HasLen, 0)
+	}
+	{ // installed version does not satisfy the constraint
+		packerOutput = fakePacker("1.10.0", fmt.Sprintf(gce, "1.0.16"), ansible)
+		missing, err := CheckPackerRequirements(ctx, dir)
+		c.Assert(err, IsNil)
+		c.Check(missing, DeepEquals, []PackerPlugin{{Name: "googlecompute", Source: "github.com/hashicorp/googlecompute", Constraint: "~> 1.1.0"}})
+		c.Check(MissingPackerPluginsError(dir, missing), ErrorMatches,
+			`(?s).*install them by running: packer init .*missing plugins: googlecompute \(github.com/hashicorp/googlecompute ~> 1.1.0\)`)
+	}
+	{ // Fail: packer too old
+		packerOutput = fakePacker("1.7.0")
+		_, err := CheckPackerRequirements(ctx, dir)
+		c.Check(err, ErrorMatches, `(?s).*requires packer >= 1.7.9.*installed version of packer is 1.7.0`)
+	}
+	{ // no requirements
+		packerOutput = fakePacker("1.7.0")
+		missing, err := CheckPackerRequirements(ctx, c.MkDir())
+		c.Assert(err, IsNil)
+		c.Check(missing, HasLen, 0)
+	}
+}
@@ -0,0 +1,231 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+	"gopkg.in/yaml.v3"
+)
+
+// savedPlansDirName is the directory in the artifacts directory holding plans
+// saved for later approval
+const savedPlansDirName = "plans"
+
+// SavedPlansManifestName is the name of the file summarizing saved plans
+const SavedPlansManifestName = "plans.yaml"
+
+// SavedPlan describes a terraform plan of a deployment group saved to a file
+type SavedPlan struct {
+	Group config.GroupName `yaml:"group"`
+	// File is the name of the binary plan file in the directory of saved plans
+	File     string `yaml:"file"`
+	Checksum string `yaml:"sha256"`
+	Changes  bool   `yaml:"changes"`
+	Summary  string `yaml:"summary,omitempty"`
+	// StateSerial and StateLineage identify the terraform state the plan was made against
+	StateSerial  int    `yaml:"state_serial"`
+	StateLineage string `yaml:"state_lineage,omitempty"`
+}
+
+// SavedPlans is the manifest of plans saved by `ghpc plan --save`
+type SavedPlans struct {
+	// BlueprintHash identifies the expanded blueprint the plans were made for
+	BlueprintHash string      `yaml:"blueprint_hash"`
+	Plans         []SavedPlan `yaml:"plans"`
+}
+
+// Plan returns the saved plan of the deployment group, if any
+func (sp SavedPlans) Plan(group config.GroupName) (SavedPlan, bool) {
+	for _, p := range sp.Plans {
+		if p.Group == group {
+			return p, true
+		}
+	}
+	return SavedPlan{}, false
+}
+
+// SavedPlansDir returns the directory of saved plans in artifactsDir
+func SavedPlansDir(artifactsDir string) string {
+	return filepath.Join(artifactsDir, savedPlansDirName)
+}
+
+// ReadSavedPlans returns the manifest of saved plans, if any
+func ReadSavedPlans(artifactsDir string) (SavedPlans, bool, error) {
+	b, err := os.ReadFile(filepath.Join(SavedPlansDir(artifactsDir), SavedPlansManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return SavedPlans{}, false, nil
+	}
+	if err != nil {
+		return SavedPlans{}, false, err
+	}
+	var sp SavedPlans
+	if err := yaml.Unmarshal(b, &sp); err != nil {
+		return SavedPlans{}, false, err
+	}
+	return sp, true, nil
+}
+
+// WriteSavedPlans writes the manifest of saved plans to the artifacts directory
+func WriteSavedPlans(artifactsDir string, sp SavedPlans) error {
+	b, err := yaml.Marshal(sp)
+	if err != nil {
+		return err
+	}
+	dir := SavedPlansDir(artifactsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, SavedPlansManifestName), b, 0644)
+}
+
+// RemoveSavedPlans removes saved plans once they have been applied
+func RemoveSavedPlans(artifactsDir string) error {
+	return os.RemoveAll(SavedPlansDir(artifactsDir))
+}
+
+type stateFingerprint struct {
+	Serial  int    `json:"serial"`
+	Lineage string `json:"lineage"`
+}
+
+// readStateFingerprint returns serial and lineage of the terraform state,
+// both are zero if the deployment group was never applied
+func readStateFingerprint(ctx context.Context, tf *tfexec.Terraform) (stateFingerprint, error) {
+	raw, err := tf.StatePull(ctx)
+	if err != nil {
+		return stateFingerprint{}, &TfError{
+			help: fmt.Sprintf("reading terraform state of deployment group %s failed; manually resolve errors below", tf.WorkingDir()),
+			err:  err,
+		}
+	}
+	var fp stateFingerprint
+	if raw == "" {
+		return fp, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &fp); err != nil {
+		return stateFingerprint{}, err
+	}
+	return fp, nil
+}
+
+func fileChecksum(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+func planSummary(plan string) string {
+	re := regexp.MustCompile(`Plan: .*`)
+	return re.FindString(plan)
+}
+
+// SavePlan plans changes to the deployment group, shows the plan to the user
+// and saves it to planDir
+func SavePlan(ctx context.Context, tf *tfexec.Terraform, group config.GroupName, planDir string) (SavedPlan, error) {
+	if err := initModule(ctx, tf); err != nil {
+		return SavedPlan{}, err
+	}
+	fp, err := readStateFingerprint(ctx, tf)
+	if err != nil {
+		return SavedPlan{}, err
+	}
+
+	sp := SavedPlan{
+		Group:        group,
+		File:         fmt.Sprintf("%s.tfplan", group),
+		StateSerial:  fp.Serial,
+		StateLineage: fp.Lineage,
+	}
+	path := filepath.Join(planDir, sp.File)
+
+	logging.Info("Planning changes to deployment group %s", tf.WorkingDir())
+	if sp.Changes, err = planModule(ctx, tf, path); err != nil {
+		return SavedPlan{}, err
+	}
+	plan, err := tf.ShowPlanFileRaw(ctx, path)
+	if err != nil {
+		return SavedPlan{}, err
+	}
+	logging.Info("%s", plan)
+	if sp.Changes {
+		sp.Summary = planSummary(plan)
+		if d, err := planCost(ctx, tf, path); err != nil {
+			logging.Info("Cost of planned changes could not be estimated: %v", err)
+		} else if len(d.Changes) > 0 {
+			logging.Info("%s", d)
+			sp.Summary += " " + d.Short()
+		}
+	}
+	if sp.Checksum, err = fileChecksum(path); err != nil {
+		return SavedPlan{}, err
+	}
+	return sp, nil
+}
+
+// ApplySavedPlan applies the saved plan of the deployment group and exports
+// its outputs. It refuses to apply the plan if the plan file was modified or
+// the terraform state has changed since the plan was made.
+func ApplySavedPlan(ctx context.Context, tf *tfexec.Terraform, sp SavedPlan, artifactsDir string, ae config.ArtifactsEncryption) error {
+	path := filepath.Join(SavedPlansDir(artifactsDir), sp.File)
+	sum, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+	if sum != sp.Checksum {
+		return fmt.Errorf("saved plan %s of deployment group %s was modified after it was made", path, sp.Group)
+	}
+
+	if err := initModule(ctx, tf); err != nil {
+		return err
+	}
+	fp, err := readStateFingerprint(ctx, tf)
+	if err != nil {
+		return err
+	}
+	if fp.Serial != sp.StateSerial || fp.Lineage != sp.StateLineage {
+		return fmt.Errorf("terraform state of deployment group %s has changed since the plan was saved; run \"ghpc plan --save\" again", sp.Group)
+	}
+
+	if sp.Changes {
+		if err := applyPlanConsoleOutput(ctx, tf, path); err != nil {
+			return err
+		}
+	} else {
+		logging.Info("Cloud infrastructure in deployment group %s is already applied", tf.WorkingDir())
+	}
+
+	outputValues, err := outputModule(ctx, tf)
+	if err != nil {
+		return err
+	}
+	return writeOutputs(ctx, outputValues, sp.Group, artifactsDir, ae)
+}
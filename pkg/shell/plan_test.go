@@ -0,0 +1,77 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shell
+
+import (
+	"context"
+	"hpc-toolkit/pkg/config"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestSavedPlans(c *C) {
+	dir := c.MkDir()
+
+	_, found, err := ReadSavedPlans(dir)
+	c.Assert(err, IsNil)
+	c.Check(found, Equals, false)
+
+	sp := SavedPlans{
+		BlueprintHash: "abc",
+		Plans: []SavedPlan{
+			{Group: "zero", File: "zero.tfplan", Checksum: "123", Changes: true, Summary: "Plan: 1 to add, 0 to change, 0 to destroy.", StateSerial: 3, StateLineage: "xyz"},
+			{Group: "one", File: "one.tfplan", Checksum: "456"},
+		}}
+	c.Assert(WriteSavedPlans(dir, sp), IsNil)
+
+	got, found, err := ReadSavedPlans(dir)
+	c.Assert(err, IsNil)
+	c.Check(found, Equals, true)
+	c.Check(got, DeepEquals, sp)
+
+	p, ok := got.Plan("one")
+	c.Check(ok, Equals, true)
+	c.Check(p, DeepEquals, sp.Plans[1])
+	_, ok = got.Plan("two")
+	c.Check(ok, Equals, false)
+
+	c.Assert(RemoveSavedPlans(dir), IsNil)
+	_, found, err = ReadSavedPlans(dir)
+	c.Assert(err, IsNil)
+	c.Check(found, Equals, false)
+}
+
+func (s *MySuite) TestPlanSummary(c *C) {
+	plan := "  # google_compute_network.vpc will be created\n\nPlan: 1 to add, 0 to change, 0 to destroy.\n"
+	c.Check(planSummary(plan), Equals, "Plan: 1 to add, 0 to change, 0 to destroy.")
+	c.Check(planSummary("No changes."), Equals, "")
+}
+
+func (s *MySuite) TestApplySavedPlanModified(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.MkdirAll(SavedPlansDir(dir), 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(SavedPlansDir(dir), "zero.tfplan"), []byte("tampered"), 0644), IsNil)
+
+	sp := SavedPlan{Group: "zero", File: "zero.tfplan", Checksum: "123"}
+	err := ApplySavedPlan(context.Background(), nil, sp, dir, config.ArtifactsEncryption{})
+	c.Check(err, ErrorMatches, "saved plan .* of deployment group zero was modified after it was made")
+
+	sp.File = "one.tfplan"
+	c.Check(ApplySavedPlan(context.Background(), nil, sp, dir, config.ArtifactsEncryption{}), NotNil)
+}
@@ -0,0 +1,100 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"context"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"os"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// Drift is a resource that changed outside of terraform
+type Drift struct {
+	Address string
+	// Change is "changed" or "deleted"
+	Change string
+}
+
+func (d Drift) String() string {
+	return fmt.Sprintf("%s was %s outside of terraform", d.Address, d.Change)
+}
+
+// resourceDrift returns resources of the plan that changed outside of terraform
+func resourceDrift(plan *tfjson.Plan) []Drift {
+	res := []Drift{}
+	for _, rc := range plan.ResourceDrift {
+		if rc.Change == nil {
+			continue
+		}
+		change := "changed"
+		if rc.Change.Actions.Delete() {
+			change = "deleted"
+		}
+		res = append(res, Drift{Address: rc.Address, Change: change})
+	}
+	return res
+}
+
+// RefreshOnly updates the terraform state of the deployment group to match
+// the real infrastructure, without changing the infrastructure, and exports
+// outputs of the group for subsequent groups. It returns resources that
+// changed outside of terraform.
+func RefreshOnly(ctx context.Context, tf *tfexec.Terraform, group config.GroupName, artifactsDir string, ae config.ArtifactsEncryption, b ApplyBehavior) ([]Drift, error) {
+	if err := initModule(ctx, tf); err != nil {
+		return nil, err
+	}
+
+	logging.Info("Refreshing terraform state of deployment group %s", tf.WorkingDir())
+	f, err := os.CreateTemp("", "plan-")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	wantsChange, err := planModule(ctx, tf, f.Name(), tfexec.RefreshOnly(true))
+	if err != nil {
+		return nil, err
+	}
+	plan, err := tf.ShowPlanFile(ctx, f.Name())
+	if err != nil {
+		return nil, err
+	}
+	drift := resourceDrift(plan)
+	for _, d := range drift {
+		logging.Info("%s", d)
+	}
+
+	if !wantsChange {
+		logging.Info("Terraform state of deployment group %s matches the cloud infrastructure", tf.WorkingDir())
+	} else if b == AutomaticApply || promptForApply(ctx, tf, f.Name(), b) {
+		// applying a refresh-only plan only updates the state
+		if err := applyPlanConsoleOutput(ctx, tf, f.Name()); err != nil {
+			return nil, err
+		}
+	}
+
+	outputValues, err := outputModule(ctx, tf)
+	if err != nil {
+		return nil, err
+	}
+	return drift, writeOutputs(ctx, outputValues, group, artifactsDir, ae)
+}
@@ -0,0 +1,38 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shell
+
+import (
+	tfjson "github.com/hashicorp/terraform-json"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestResourceDrift(c *C) {
+	plan := tfjson.Plan{ResourceDrift: []*tfjson.ResourceChange{
+		{Address: "module.vm.google_compute_instance.vm[0]", Change: &tfjson.Change{Actions: tfjson.Actions{tfjson.ActionUpdate}}},
+		{Address: "module.fs.google_filestore_instance.fs", Change: &tfjson.Change{Actions: tfjson.Actions{tfjson.ActionDelete}}},
+		{Address: "module.net.google_compute_network.vpc"},
+	}}
+	drift := resourceDrift(&plan)
+	c.Check(drift, DeepEquals, []Drift{
+		{Address: "module.vm.google_compute_instance.vm[0]", Change: "changed"},
+		{Address: "module.fs.google_filestore_instance.fs", Change: "deleted"},
+	})
+	c.Check(drift[1].String(), Equals, "module.fs.google_filestore_instance.fs was deleted outside of terraform")
+
+	c.Check(resourceDrift(&tfjson.Plan{}), DeepEquals, []Drift{})
+}
@@ -0,0 +1,454 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
+)
+
+// shimmedCommands are the external commands recorded and replayed
+var shimmedCommands = []string{"terraform", "packer"}
+
+// environment of shims, set by StartRecording and StartReplay
+const (
+	shimNameEnv = "GHPC_SHIM"           // command the shim stands for
+	shimRealEnv = "GHPC_SHIM_REAL"      // path of the command, when recording
+	shimModeEnv = "GHPC_SHIM_MODE"      // record or replay
+	shimFileEnv = "GHPC_SHIM_RECORDING" // path of the recording
+	shimRootEnv = "GHPC_SHIM_ROOT"      // directory of commands are relative to
+	shimDirEnv  = "GHPC_SHIM_DIR"       // directory of shims and replay state
+)
+
+const (
+	recordMode = "record"
+	replayMode = "replay"
+)
+
+// RecordedCommand is an invocation of an external command, a recording is a
+// file of one JSON RecordedCommand per line
+type RecordedCommand struct {
+	Name string   `json:"name"`
+	Args []string `json:"args"`
+	// Dir is the working directory, relative to the deployment directory
+	Dir string `json:"dir"`
+	// Env are terraform settings of the environment, other variables are left
+	// out as they may hold credentials
+	Env      map[string]string `json:"env,omitempty"`
+	Stdout   string            `json:"stdout"`
+	Stderr   string            `json:"stderr"`
+	ExitCode int               `json:"exit_code"`
+	// Files are written by the command to paths given by flags, by flag, e.g.
+	// the plan file of `-out`
+	Files map[string][]byte `json:"files,omitempty"`
+}
+
+// outputFileFlags are flags of paths commands write to
+var outputFileFlags = []string{"-out"}
+
+// subcommand is the leading arguments of the command before any flag, e.g.
+// "state pull"; invocations are replayed in order by subcommand
+func (rc RecordedCommand) subcommand() string {
+	sub := []string{}
+	for _, a := range rc.Args {
+		if strings.HasPrefix(a, "-") {
+			break
+		}
+		sub = append(sub, a)
+	}
+	return strings.Join(sub, " ")
+}
+
+func (rc RecordedCommand) matches(o RecordedCommand) bool {
+	return rc.Name == o.Name && rc.Dir == o.Dir && rc.subcommand() == o.subcommand()
+}
+
+// commandShims is the directory of shims in PATH and the environment it
+// replaced, if recording or replaying
+var commandShims struct {
+	dir string
+	env map[string]string // previous values, "" if unset
+}
+
+// StartRecording records every invocation of terraform and packer to the
+// recording file, with its output, until StopCommandShims is called. The
+// commands still run, through shims put first in PATH.
+func StartRecording(recording string, deploymentRoot string) error {
+	if err := os.WriteFile(recording, nil, 0600); err != nil {
+		return err
+	}
+	real := map[string]string{}
+	for _, n := range shimmedCommands {
+		if p, err := exec.LookPath(n); err == nil {
+			real[n] = p
+		}
+	}
+	return startCommandShims(recordMode, recording, deploymentRoot, real)
+}
+
+// StartReplay replays invocations of terraform and packer from the recording
+// file instead of running them, until StopCommandShims is called. Invocations
+// are replayed in the order they were recorded, by command, working directory
+// and subcommand; a command that was not recorded fails.
+func StartReplay(recording string, deploymentRoot string) error {
+	if _, err := os.Stat(recording); err != nil {
+		return err
+	}
+	commands := map[string]string{}
+	for _, n := range shimmedCommands {
+		commands[n] = "" // not run
+	}
+	return startCommandShims(replayMode, recording, deploymentRoot, commands)
+}
+
+// shimExecutable is the binary shims run, ghpc itself, which runs the
+// command once CommandShim finds it was started as a shim
+var shimExecutable = os.Executable
+
+func startCommandShims(mode string, recording string, deploymentRoot string, commands map[string]string) error {
+	StopCommandShims()
+	self, err := shimExecutable()
+	if err != nil {
+		return err
+	}
+	recording, err = filepath.Abs(recording)
+	if err != nil {
+		return err
+	}
+	root, err := filepath.Abs(deploymentRoot)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "ghpc-shims-*")
+	if err != nil {
+		return err
+	}
+	for n, real := range commands {
+		script := fmt.Sprintf("#!/bin/sh\n%s=%s %s=%s exec %s \"$@\"\n",
+			shimNameEnv, shellQuote(n), shimRealEnv, shellQuote(real), shellQuote(self))
+		if err := os.WriteFile(filepath.Join(dir, n), []byte(script), 0755); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+
+	env := map[string]string{
+		shimModeEnv: mode,
+		shimFileEnv: recording,
+		shimRootEnv: root,
+		shimDirEnv:  dir,
+		"PATH":      dir + string(os.PathListSeparator) + os.Getenv("PATH"),
+	}
+	commandShims.dir, commandShims.env = dir, map[string]string{}
+	for k, v := range env {
+		commandShims.env[k] = os.Getenv(k)
+		if err := os.Setenv(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StopCommandShims stops recording or replaying commands
+func StopCommandShims() {
+	if commandShims.dir == "" {
+		return
+	}
+	for k, v := range commandShims.env {
+		if v == "" {
+			os.Unsetenv(k)
+		} else {
+			os.Setenv(k, v)
+		}
+	}
+	os.RemoveAll(commandShims.dir)
+	commandShims.dir, commandShims.env = "", nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// CommandShim runs the recorded or replayed command if this process was
+// started as a shim, it returns the exit code of the command and whether it
+// ran. It must be called before anything else by the main function.
+func CommandShim() (int, bool) {
+	name := os.Getenv(shimNameEnv)
+	if name == "" {
+		return 0, false
+	}
+	mode := os.Getenv(shimModeEnv)
+	rc := RecordedCommand{Name: name, Args: os.Args[1:]}
+	wd, err := os.Getwd()
+	if err == nil {
+		rc.Dir, err = filepath.Rel(os.Getenv(shimRootEnv), wd)
+	}
+
+	code := 0
+	if err == nil {
+		switch mode {
+		case recordMode:
+			code, err = recordCommand(rc)
+		case replayMode:
+			code, err = replayCommand(rc)
+		default:
+			err = fmt.Errorf("unknown mode %q", mode)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ghpc %s of %s %s: %v\n", mode, name, rc.subcommand(), err)
+		return 1, true
+	}
+	return code, true
+}
+
+func recordCommand(rc RecordedCommand) (int, error) {
+	real := os.Getenv(shimRealEnv)
+	if real == "" {
+		return 0, fmt.Errorf("%s is not installed", rc.Name)
+	}
+	code, stdout, stderr, err := runRealCommand(real, rc.Args)
+	if err != nil {
+		return 0, err
+	}
+	rc.ExitCode, rc.Stdout, rc.Stderr = code, stdout, stderr
+	rc.Env = terraformSettings()
+	if rc.Files, err = writtenOutputFiles(rc.Args); err != nil {
+		return 0, err
+	}
+	if err := appendRecording(rc); err != nil {
+		return 0, err
+	}
+	return rc.ExitCode, nil
+}
+
+// runRealCommand runs the command, forwarding its output and interrupts, and
+// returns its exit code and output
+func runRealCommand(real string, args []string) (int, string, string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(real, args...)
+	cmd.Env = slices.DeleteFunc(os.Environ(), func(kv string) bool {
+		return strings.HasPrefix(kv, shimNameEnv+"=") || strings.HasPrefix(kv, shimRealEnv+"=")
+	})
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = io.MultiWriter(os.Stdout, &stdout)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+
+	// ghpc interrupts the shim, not the command
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	defer signal.Stop(sigs)
+	if err := cmd.Start(); err != nil {
+		return 0, "", "", err
+	}
+	go func() {
+		for s := range sigs {
+			cmd.Process.Signal(s)
+		}
+	}()
+	code := 0
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		return 0, "", "", err
+	}
+	return code, stdout.String(), stderr.String(), nil
+}
+
+// terraformSettings returns TF_ variables of the environment, but terraform
+// variables, which may hold credentials
+func terraformSettings() map[string]string {
+	var res map[string]string
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(k, "TF_") && !strings.HasPrefix(k, "TF_VAR_") {
+			if res == nil {
+				res = map[string]string{}
+			}
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// writtenOutputFiles reads files the command wrote to paths given by flags
+func writtenOutputFiles(args []string) (map[string][]byte, error) {
+	var res map[string][]byte
+	for f, p := range outputFilePaths(args) {
+		b, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if res == nil {
+			res = map[string][]byte{}
+		}
+		res[f] = b
+	}
+	return res, nil
+}
+
+// appendRecording appends the invocation to the recording
+func appendRecording(rc RecordedCommand) error {
+	b, err := json.Marshal(rc)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockShims()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.OpenFile(os.Getenv(shimFileEnv), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+func replayCommand(rc RecordedCommand) (int, error) {
+	r, err := nextReplayed(rc)
+	if err != nil {
+		return 0, err
+	}
+	paths := outputFilePaths(rc.Args)
+	for f, data := range r.Files {
+		if p, ok := paths[f]; ok {
+			if err := os.WriteFile(p, data, 0600); err != nil {
+				return 0, err
+			}
+		}
+	}
+	os.Stdout.WriteString(r.Stdout)
+	os.Stderr.WriteString(r.Stderr)
+	return r.ExitCode, nil
+}
+
+// nextReplayed returns the first recorded invocation matching the command
+// that was not replayed yet, and marks it replayed
+func nextReplayed(rc RecordedCommand) (RecordedCommand, error) {
+	unlock, err := lockShims()
+	if err != nil {
+		return RecordedCommand{}, err
+	}
+	defer unlock()
+
+	recorded, err := ReadRecording(os.Getenv(shimFileEnv))
+	if err != nil {
+		return RecordedCommand{}, err
+	}
+	statePath := filepath.Join(os.Getenv(shimDirEnv), "replayed.json")
+	replayed := []int{}
+	if b, err := os.ReadFile(statePath); err == nil {
+		if err := json.Unmarshal(b, &replayed); err != nil {
+			return RecordedCommand{}, err
+		}
+	}
+	i := slices.IndexFunc(recorded, func(r RecordedCommand) bool { return r.matches(rc) })
+	for i >= 0 && slices.Contains(replayed, i) {
+		j := slices.IndexFunc(recorded[i+1:], func(r RecordedCommand) bool { return r.matches(rc) })
+		if j < 0 {
+			i = -1
+		} else {
+			i += j + 1
+		}
+	}
+	if i < 0 {
+		return RecordedCommand{}, fmt.Errorf("no invocation in %s left to replay", rc.Dir)
+	}
+	replayed = append(replayed, i)
+	sort.Ints(replayed)
+	b, err := json.Marshal(replayed)
+	if err != nil {
+		return RecordedCommand{}, err
+	}
+	if err := os.WriteFile(statePath, b, 0600); err != nil {
+		return RecordedCommand{}, err
+	}
+	return recorded[i], nil
+}
+
+// outputFilePaths returns paths of files the command writes, by flag
+func outputFilePaths(args []string) map[string]string {
+	res := map[string]string{}
+	for _, a := range args {
+		f, p, ok := strings.Cut(a, "=")
+		if ok && slices.Contains(outputFileFlags, f) {
+			res[f] = p
+		}
+	}
+	return res
+}
+
+// lockShims serializes access to the recording and the replay state by
+// commands run concurrently
+func lockShims() (func(), error) {
+	f, err := os.OpenFile(filepath.Join(os.Getenv(shimDirEnv), "lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// ReadRecording reads invocations of a recording in the order they were made
+func ReadRecording(path string) ([]RecordedCommand, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res := []RecordedCommand{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 256<<20) // outputs of plans can be large
+	for sc.Scan() {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var rc RecordedCommand
+		if err := json.Unmarshal(sc.Bytes(), &rc); err != nil {
+			return nil, fmt.Errorf("failed to read recording %s: %w", path, err)
+		}
+		res = append(res, rc)
+	}
+	return res, sc.Err()
+}
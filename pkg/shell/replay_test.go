@@ -0,0 +1,119 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shell
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+// TestMain runs the test binary as a command shim, as ghpc does
+func TestMain(m *testing.M) {
+	if code, ok := CommandShim(); ok {
+		os.Exit(code)
+	}
+	os.Exit(m.Run())
+}
+
+func runShimmed(c *C, dir string, args ...string) (string, int) {
+	cmd := commandContext(context.Background(), "terraform", args...)
+	cmd.Dir = dir
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := runCommand(cmd)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return out.String(), exitErr.ExitCode()
+	}
+	c.Assert(err, IsNil)
+	return out.String(), 0
+}
+
+func (s *MySuite) TestRecordAndReplay(c *C) {
+	bin := c.MkDir()
+	script := "#!/bin/sh\necho \"planned $*\"\nfor a; do case \"$a\" in -out=*) echo plan > \"${a#-out=}\";; esac; done\nexit 2\n"
+	c.Assert(os.WriteFile(filepath.Join(bin, "terraform"), []byte(script), 0755), IsNil)
+	pathEnv := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+pathEnv)
+
+	root := c.MkDir()
+	group := filepath.Join(root, "primary")
+	c.Assert(os.Mkdir(group, 0755), IsNil)
+	recording := filepath.Join(c.MkDir(), "recording.jsonl")
+	planFile := filepath.Join(c.MkDir(), "plan.out")
+
+	c.Assert(StartRecording(recording, root), IsNil)
+	out, code := runShimmed(c, group, "plan", "-out="+planFile)
+	StopCommandShims()
+	os.Setenv("PATH", pathEnv)
+	c.Check(out, Equals, "planned plan -out="+planFile+"\n")
+	c.Check(code, Equals, 2)
+
+	got, err := ReadRecording(recording)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 1)
+	c.Check(got[0].Name, Equals, "terraform")
+	c.Check(got[0].Dir, Equals, "primary")
+	c.Check(got[0].Args, DeepEquals, []string{"plan", "-out=" + planFile})
+	c.Check(got[0].ExitCode, Equals, 2)
+	c.Check(string(got[0].Files["-out"]), Equals, "plan\n")
+
+	// replayed without terraform, the plan file is written again
+	c.Assert(os.Remove(planFile), IsNil)
+	c.Assert(StartReplay(recording, root), IsNil)
+	defer StopCommandShims()
+	out, code = runShimmed(c, group, "plan", "-out="+planFile)
+	c.Check(out, Equals, "planned plan -out="+planFile+"\n")
+	c.Check(code, Equals, 2)
+	b, err := os.ReadFile(planFile)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, "plan\n")
+
+	// each invocation is replayed once
+	_, code = runShimmed(c, group, "plan", "-out="+planFile)
+	c.Check(code, Equals, 1)
+	// and only in the directory it was recorded in
+	_, code = runShimmed(c, root, "plan", "-out="+planFile)
+	c.Check(code, Equals, 1)
+}
+
+func (s *MySuite) TestReplayOutputs(c *C) {
+	root := c.MkDir()
+	group := filepath.Join(root, "primary")
+	c.Assert(os.Mkdir(group, 0755), IsNil)
+	recording := filepath.Join(c.MkDir(), "recording.jsonl")
+	c.Assert(os.WriteFile(recording, []byte(`
+{"name":"terraform","args":["version","-json"],"dir":"primary","stdout":"{\"terraform_version\":\"1.5.7\",\"platform\":\"linux_amd64\",\"provider_selections\":{}}","stderr":"","exit_code":0}
+{"name":"terraform","args":["output","-no-color","-json"],"dir":"primary","stdout":"{\"network_name\":{\"sensitive\":false,\"type\":\"string\",\"value\":\"net\"}}","stderr":"","exit_code":0}
+`), 0644), IsNil)
+
+	c.Assert(StartReplay(recording, root), IsNil)
+	defer StopCommandShims()
+	tf, err := ConfigureTerraform(group)
+	c.Assert(err, IsNil)
+	got, err := outputModule(context.Background(), tf)
+	c.Assert(err, IsNil)
+	c.Check(got, DeepEquals, map[string]cty.Value{"network_name": cty.StringVal("net")})
+}
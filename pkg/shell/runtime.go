@@ -0,0 +1,91 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// RuntimeEnvVar is the environment variable holding the runtime value
+func RuntimeEnvVar(name string) string {
+	return "GHPC_RUNTIME_" + strings.ToUpper(name)
+}
+
+// runtimeFromMetadata reads the runtime value from the custom metadata of the
+// VM running ghpc, it is replaced in tests
+var runtimeFromMetadata = func(name string) (string, bool, error) {
+	if !metadata.OnGCE() {
+		return "", false, nil
+	}
+	v, err := metadata.InstanceAttributeValue(name)
+	var notDefined metadata.NotDefinedError
+	if errors.As(err, &notDefined) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return v, true, nil
+}
+
+// resolveRuntimeValue reads the runtime value from the environment of ghpc,
+// or from the metadata server if ghpc runs on a VM
+func resolveRuntimeValue(name string) (string, error) {
+	if v, ok := os.LookupEnv(RuntimeEnvVar(name)); ok {
+		return v, nil
+	}
+	v, ok, err := runtimeFromMetadata(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to read runtime value %q from the metadata server: %w", name, err)
+	}
+	if !ok {
+		return "", config.HintError{
+			Hint: fmt.Sprintf("set environment variable %s or custom metadata %q of the VM running ghpc", RuntimeEnvVar(name), name),
+			Err:  fmt.Errorf("runtime value %q is not set", name)}
+	}
+	return v, nil
+}
+
+// importRuntimeValues writes runtime values used by the terraform stage to a
+// file of the deployment group read by terraform after terraform.tfvars
+func importRuntimeValues(deploymentGroupDir string, g config.DeploymentGroup) error {
+	refs := g.RuntimeReferences()
+	if len(refs) == 0 {
+		return nil
+	}
+	vals := map[string]cty.Value{}
+	for _, r := range refs {
+		v, err := resolveRuntimeValue(r.Name)
+		if err != nil {
+			return err
+		}
+		vals[config.RuntimeVarName(r.Name)] = cty.StringVal(v)
+	}
+	outPath := filepath.Join(deploymentGroupDir, fmt.Sprintf("%s_runtime.auto.tfvars", g.Name))
+	logging.Info("Writing runtime values for deployment group %s to file %s", g.Name, outPath)
+	return modulewriter.WriteHclAttributes(vals, outPath)
+}
@@ -0,0 +1,68 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"hpc-toolkit/pkg/config"
+	"os"
+	"path/filepath"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestImportRuntimeValues(c *C) {
+	defer func(f func(string) (string, bool, error)) { runtimeFromMetadata = f }(runtimeFromMetadata)
+	runtimeFromMetadata = func(name string) (string, bool, error) {
+		if name == "runner" {
+			return "runner-7", true, nil
+		}
+		return "", false, nil
+	}
+	c.Assert(os.Setenv("GHPC_RUNTIME_SUBNET", "ci-subnet"), IsNil)
+	defer os.Unsetenv("GHPC_RUNTIME_SUBNET")
+
+	ref := func(n string) cty.Value { return config.ModuleRef("runtime", n).AsValue() }
+	g := func(refs ...string) config.DeploymentGroup {
+		settings := config.Dict{}
+		for _, r := range refs {
+			settings.Set(r, ref(r))
+		}
+		return config.DeploymentGroup{Name: "primary", Modules: []config.Module{{ID: "vm", Settings: settings}}}
+	}
+
+	{ // no runtime values, no file
+		dir := c.MkDir()
+		c.Check(importRuntimeValues(dir, g()), IsNil)
+		_, err := os.Stat(filepath.Join(dir, "primary_runtime.auto.tfvars"))
+		c.Check(os.IsNotExist(err), Equals, true)
+	}
+
+	{ // from environment and metadata server
+		dir := c.MkDir()
+		c.Assert(importRuntimeValues(dir, g("subnet", "runner")), IsNil)
+		b, err := os.ReadFile(filepath.Join(dir, "primary_runtime.auto.tfvars"))
+		c.Assert(err, IsNil)
+		c.Check(string(b), Matches, `(?s).*runtime_runner += "runner-7".*`)
+		c.Check(string(b), Matches, `(?s).*runtime_subnet += "ci-subnet".*`)
+	}
+
+	{ // not set
+		err := importRuntimeValues(c.MkDir(), g("zone"))
+		c.Check(err, ErrorMatches, `runtime value "zone" is not set - set environment variable GHPC_RUNTIME_ZONE or custom metadata "zone" .*`)
+	}
+}
@@ -0,0 +1,189 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/logging"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+)
+
+// staleLockAge is the age below which a state lock is assumed to be held by a
+// terraform command still running, and is not offered to be force-unlocked
+const staleLockAge = 15 * time.Minute
+
+const stateLockSummary = "Error acquiring the state lock"
+
+// StateLock is the lock of the terraform state of a deployment group, as
+// reported by terraform when it fails to acquire it
+type StateLock struct {
+	ID        string
+	Path      string
+	Operation string
+	Who       string // user@host running the operation holding the lock
+	Version   string // of terraform
+	Created   time.Time
+}
+
+var lockInfoLine = regexp.MustCompile(`(?m)^\s+(ID|Path|Operation|Who|Version|Created):\s*(.*?)\s*$`)
+
+// parseStateLock parses the lock info of a terraform lock conflict error, it
+// returns false if the text does not report one
+func parseStateLock(s string) (StateLock, bool) {
+	_, info, found := strings.Cut(s, "Lock Info:")
+	if !found {
+		return StateLock{}, false
+	}
+	l := StateLock{}
+	for _, m := range lockInfoLine.FindAllStringSubmatch(info, -1) {
+		switch m[1] {
+		case "ID":
+			l.ID = m[2]
+		case "Path":
+			l.Path = m[2]
+		case "Operation":
+			l.Operation = strings.TrimPrefix(m[2], "OperationType")
+		case "Who":
+			l.Who = m[2]
+		case "Version":
+			l.Version = m[2]
+		case "Created":
+			// as formatted by time.Time.String
+			l.Created, _ = time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", m[2])
+		}
+	}
+	return l, l.ID != ""
+}
+
+// stateLockOf returns the lock reported by terraform messages, or by its
+// human-readable error output
+func stateLockOf(msgs []JsonMessage, err error) (StateLock, bool) {
+	for _, msg := range msgs {
+		if msg.Diagnostic.Summary == stateLockSummary {
+			if l, ok := parseStateLock(msg.Diagnostic.Detail); ok {
+				return l, true
+			}
+		}
+	}
+	if err == nil {
+		return StateLock{}, false
+	}
+	return parseStateLock(err.Error())
+}
+
+// Age of the lock, zero if terraform did not report when it was created
+func (l StateLock) Age(now time.Time) time.Duration {
+	if l.Created.IsZero() {
+		return 0
+	}
+	return now.Sub(l.Created).Truncate(time.Second)
+}
+
+// Describe tells who holds the lock, for which operation and since when
+func (l StateLock) Describe(now time.Time) string {
+	op := strings.ToLower(l.Operation)
+	if op == "" {
+		op = "an operation"
+	}
+	s := fmt.Sprintf("locked by %s for %s", l.Who, op)
+	if !l.Created.IsZero() {
+		s += fmt.Sprintf(" since %s (%s ago)", l.Created.Local().Format(time.RFC1123), l.Age(now))
+	}
+	return s
+}
+
+// StateLockError is returned when the terraform state of a deployment group is
+// locked by another terraform command, or one that was interrupted
+type StateLockError struct {
+	Dir  string // of the deployment group
+	Lock StateLock
+	err  error
+}
+
+func (e *StateLockError) Error() string {
+	return fmt.Sprintf("terraform state of deployment group %s is %s; "+
+		"if no terraform command is running on it, unlock it with `terraform -chdir=%s force-unlock %s`\n%s",
+		e.Dir, e.Lock.Describe(time.Now()), e.Dir, e.Lock.ID, e.err)
+}
+
+func (e *StateLockError) Unwrap() error {
+	return e.err
+}
+
+// unlockRefusal tells why force-unlocking the lock is not offered, it returns
+// an empty string if it is
+func unlockRefusal(l StateLock, now time.Time) string {
+	switch {
+	case l.Created.IsZero():
+		return "terraform did not report when the lock was taken"
+	case l.Age(now) < staleLockAge:
+		return fmt.Sprintf("the lock was taken %s ago, a terraform command is likely still running; wait for it to complete", l.Age(now))
+	}
+	return ""
+}
+
+// confirmForceUnlock warns about the lock and requires the user to type its ID
+func confirmForceUnlock(in io.Reader, out io.Writer, dir string, l StateLock, now time.Time) error {
+	fmt.Fprintf(out, "Terraform state of deployment group %s is %s.\n", dir, l.Describe(now))
+	if why := unlockRefusal(l, now); why != "" {
+		return fmt.Errorf("not offering to force-unlock terraform state of deployment group %s: %s", dir, why)
+	}
+	fmt.Fprintln(out, "Force-unlocking state held by a running terraform command may corrupt it.")
+	if l.Operation == "Apply" {
+		fmt.Fprintln(out, "The interrupted apply may have created resources missing from the state; review the next plan carefully.")
+	}
+	fmt.Fprintf(out, "Type the lock ID %q to force-unlock, or anything else to stop: ", l.ID)
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return fmt.Errorf("failed to read confirmation: %w", err)
+	}
+	if strings.TrimSpace(line) != l.ID {
+		return fmt.Errorf("force-unlock cancelled, %q does not match the lock ID %q", strings.TrimSpace(line), l.ID)
+	}
+	return nil
+}
+
+// recoverStateLock offers to force-unlock a stale state lock of the
+// deployment group, it returns true if the lock was removed and the command
+// can be retried. Locks are only removed after the user confirms.
+func recoverStateLock(ctx context.Context, tf *tfexec.Terraform, b ApplyBehavior, err error) (bool, error) {
+	var lerr *StateLockError
+	if !errors.As(err, &lerr) || b != PromptBeforeApply {
+		return false, err
+	}
+	if cerr := confirmForceUnlock(os.Stdin, os.Stdout, tf.WorkingDir(), lerr.Lock, time.Now()); cerr != nil {
+		logging.Error("%v", cerr)
+		return false, err
+	}
+	if uerr := tf.ForceUnlock(ctx, lerr.Lock.ID); uerr != nil {
+		return false, &TfError{
+			help: fmt.Sprintf("failed to force-unlock terraform state of deployment group %s", tf.WorkingDir()),
+			err:  uerr,
+		}
+	}
+	logging.Info("Unlocked terraform state of deployment group %s", tf.WorkingDir())
+	return true, nil
+}
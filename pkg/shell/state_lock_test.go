@@ -0,0 +1,103 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shell
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+const lockDetail = `Error message: writing "gs://b/dep/primary/default.tflock" failed: googleapi: Error 412: At least one of the pre-conditions you specified did not hold., conditionNotMet
+Lock Info:
+  ID:        1718019383442431
+  Path:      gs://b/dep/primary/default.tflock
+  Operation: OperationTypeApply
+  Who:       alice@workstation
+  Version:   1.5.7
+  Created:   2024-06-10 11:36:23.306534 +0000 UTC
+  Info:      
+
+
+Terraform acquires a state lock to protect the state from being written
+by multiple users at the same time.`
+
+func (s *MySuite) TestParseStateLock(c *C) {
+	l, ok := parseStateLock(lockDetail)
+	c.Assert(ok, Equals, true)
+	c.Check(l, DeepEquals, StateLock{
+		ID:        "1718019383442431",
+		Path:      "gs://b/dep/primary/default.tflock",
+		Operation: "Apply",
+		Who:       "alice@workstation",
+		Version:   "1.5.7",
+		Created:   time.Date(2024, 6, 10, 11, 36, 23, 306534000, time.UTC),
+	})
+
+	_, ok = parseStateLock("Error: Invalid reference")
+	c.Check(ok, Equals, false)
+}
+
+func (s *MySuite) TestStateLockOf(c *C) {
+	b, err := json.Marshal(JsonMessage{Type: "diagnostic", Diagnostic: Diagnostic{
+		Severity: "error", Summary: stateLockSummary, Detail: lockDetail}})
+	c.Assert(err, IsNil)
+
+	l, ok := stateLockOf(parseJsonMessages(string(b)), nil)
+	c.Check(ok, Equals, true)
+	c.Check(l.ID, Equals, "1718019383442431")
+
+	l, ok = stateLockOf(nil, errors.New("exit status 1\n\nError: "+stateLockSummary+"\n\n"+lockDetail))
+	c.Check(ok, Equals, true)
+	c.Check(l.Who, Equals, "alice@workstation")
+
+	_, ok = stateLockOf(nil, errors.New("exit status 1"))
+	c.Check(ok, Equals, false)
+}
+
+func (s *MySuite) TestStateLockDescribe(c *C) {
+	l, _ := parseStateLock(lockDetail)
+	now := l.Created.Add(2*time.Hour + 500*time.Millisecond)
+	c.Check(l.Age(now), Equals, 2*time.Hour)
+	c.Check(l.Describe(now), Matches, `locked by alice@workstation for apply since .* \(2h0m0s ago\)`)
+	c.Check(StateLock{Who: "bob@host"}.Describe(now), Equals, "locked by bob@host for an operation")
+}
+
+func (s *MySuite) TestConfirmForceUnlock(c *C) {
+	l, _ := parseStateLock(lockDetail)
+	stale := l.Created.Add(time.Hour)
+	out := &strings.Builder{}
+
+	c.Check(confirmForceUnlock(strings.NewReader("1718019383442431\n"), out, "dep/primary", l, stale), IsNil)
+	c.Check(out.String(), Matches, `(?s).*locked by alice@workstation.*interrupted apply.*Type the lock ID.*`)
+
+	c.Check(confirmForceUnlock(strings.NewReader("yes\n"), out, "dep/primary", l, stale),
+		ErrorMatches, `force-unlock cancelled, "yes" does not match the lock ID "1718019383442431"`)
+
+	{ // recent locks are not offered to be unlocked
+		err := confirmForceUnlock(strings.NewReader("1718019383442431\n"), out, "dep/primary", l, l.Created.Add(time.Minute))
+		c.Check(err, ErrorMatches, `.*taken 1m0s ago, a terraform command is likely still running.*`)
+	}
+
+	{ // nor locks of unknown age
+		err := confirmForceUnlock(strings.NewReader("1718019383442431\n"), out, "dep/primary", StateLock{ID: "x"}, stale)
+		c.Check(err, ErrorMatches, `.*did not report when the lock was taken`)
+	}
+}
@@ -0,0 +1,417 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/modulewriter"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/slices"
+)
+
+// terraformLogsDirName is the directory of artifacts keeping trace logs of
+// terraform, one file per deployment group, while they are enabled
+const terraformLogsDirName = "terraform_logs"
+
+// redacted replaces sensitive values in support bundles
+const redacted = "<redacted>"
+
+// terraformLogDir is where terraform commands write trace logs, if set
+var terraformLogDir string
+
+// EnableTerraformLogs makes terraform commands of deployment groups write
+// trace logs to the artifacts directory, replacing logs of previous runs
+func EnableTerraformLogs(artifactsDir string) error {
+	dir := filepath.Join(artifactsDir, terraformLogsDirName)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	terraformLogDir = dir
+	return nil
+}
+
+// terraformLogPath returns the trace log of terraform run in workingDir, if
+// logs are enabled
+func terraformLogPath(workingDir string) string {
+	if terraformLogDir == "" {
+		return ""
+	}
+	return filepath.Join(terraformLogDir, filepath.Base(workingDir)+".log")
+}
+
+// setTerraformLog points terraform run in workingDir to its trace log
+func setTerraformLog(tf *tfexec.Terraform, workingDir string) error {
+	if p := terraformLogPath(workingDir); p != "" {
+		return tf.SetLogPath(p)
+	}
+	return nil
+}
+
+// SupportBundle describes the failed command a support bundle is made for
+type SupportBundle struct {
+	Command     string // e.g. "deploy"
+	GhpcVersion string
+	Err         error
+	Log         []byte // output of ghpc during the command
+}
+
+// SupportSummary is summary.json of a support bundle
+type SupportSummary struct {
+	Command     string             `json:"command"`
+	Error       string             `json:"error"`
+	Time        time.Time          `json:"time"`
+	GhpcVersion string             `json:"ghpc_version"`
+	Blueprint   string             `json:"blueprint_name"`
+	Deployment  string             `json:"deployment_name"`
+	Environment SupportEnvironment `json:"environment"`
+	Files       []string           `json:"files"`
+}
+
+// SupportEnvironment describes where the failed command ran
+type SupportEnvironment struct {
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	GoVersion string `json:"go_version"`
+	Terraform string `json:"terraform_version,omitempty"`
+	Packer    string `json:"packer_version,omitempty"`
+	// Providers are versions of terraform providers selected by deployment groups
+	Providers map[string]string `json:"providers,omitempty"`
+	// EnvVars are names of environment variables set that affect ghpc,
+	// terraform, packer or gcloud; their values are not collected
+	EnvVars []string `json:"env_vars"`
+	// Diagnostics are failures to collect parts of the environment
+	Diagnostics []string `json:"diagnostics,omitempty"`
+}
+
+var supportEnvPrefixes = []string{"GOOGLE_", "CLOUDSDK_", "TF_", "PACKER_", "GHPC_", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"}
+
+// supportEnvironment collects versions of the tools used by the deployment,
+// it is replaced in tests
+var supportEnvironment = func(ctx context.Context, bp config.Blueprint, deploymentRoot string) SupportEnvironment {
+	env := SupportEnvironment{OS: runtime.GOOS, Arch: runtime.GOARCH, GoVersion: runtime.Version(), EnvVars: []string{}}
+	for _, kv := range os.Environ() {
+		n, _, _ := strings.Cut(kv, "=")
+		for _, p := range supportEnvPrefixes {
+			if strings.HasPrefix(strings.ToUpper(n), p) {
+				env.EnvVars = append(env.EnvVars, n)
+				break
+			}
+		}
+	}
+	sort.Strings(env.EnvVars)
+
+	for _, g := range bp.DeploymentGroups {
+		switch g.Kind() {
+		case config.TerraformKind:
+			tfPath, err := exec.LookPath("terraform")
+			if err != nil {
+				env.Diagnostics = append(env.Diagnostics, err.Error())
+				continue
+			}
+			tf, err := tfexec.NewTerraform(modulewriter.GroupDir(deploymentRoot, bp, g.Name), tfPath)
+			if err != nil {
+				env.Diagnostics = append(env.Diagnostics, err.Error())
+				continue
+			}
+			v, providers, err := tf.Version(ctx, true)
+			if err != nil {
+				env.Diagnostics = append(env.Diagnostics, fmt.Sprintf("deployment group %s: %v", g.Name, err))
+				continue
+			}
+			env.Terraform = v.String()
+			for p, pv := range providers {
+				if env.Providers == nil {
+					env.Providers = map[string]string{}
+				}
+				env.Providers[p] = pv.String()
+			}
+		case config.PackerKind:
+			if env.Packer != "" {
+				continue
+			}
+			out, err := packerOutput(ctx, "version")
+			if err != nil {
+				env.Diagnostics = append(env.Diagnostics, err.Error())
+				continue
+			}
+			if m := packerVersionRe.FindStringSubmatch(string(out)); m != nil {
+				env.Packer = m[1]
+			}
+		}
+	}
+	return env
+}
+
+// sensitiveVarRe matches names of deployment variables likely to hold
+// sensitive values, even if not declared as secret
+var sensitiveVarRe = regexp.MustCompile(`(?i)password|passwd|secret|token|credential|private_key|api_key`)
+
+// redactBlueprint returns the blueprint with values of secret and sensitive
+// looking deployment variables and module settings replaced, and the replaced
+// string values
+func redactBlueprint(bp config.Blueprint) (config.Blueprint, []string) {
+	secrets := bp.SecretVars()
+	values := []string{}
+	bp.Vars = redactDict(bp.Vars, func(n string) bool {
+		return slices.Contains(secrets, n) || sensitiveVarRe.MatchString(n)
+	}, &values)
+	// clone groups and modules to not modify original
+	bp.DeploymentGroups = slices.Clone(bp.DeploymentGroups)
+	for ig := range bp.DeploymentGroups {
+		g := &bp.DeploymentGroups[ig]
+		g.Modules = slices.Clone(g.Modules)
+		for im := range g.Modules {
+			g.Modules[im].Settings = redactDict(g.Modules[im].Settings, sensitiveVarRe.MatchString, &values)
+		}
+	}
+	// longer values first, in case one contains another
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	return bp, values
+}
+
+// redactDict returns a copy of the dict with values of the sensitive keys
+// replaced, it appends replaced string values to values
+func redactDict(d config.Dict, sensitive func(string) bool, values *[]string) config.Dict {
+	res := config.NewDict(d.Items())
+	for n, v := range d.Items() {
+		if !sensitive(n) {
+			continue
+		}
+		if v.Type() == cty.String && v.IsKnown() && !v.IsNull() && len(v.AsString()) >= 4 {
+			*values = append(*values, v.AsString())
+		}
+		res.Set(n, cty.StringVal(redacted))
+	}
+	return res
+}
+
+// tfLogHeaderRe matches HTTP headers carrying credentials in terraform trace
+// logs
+var tfLogHeaderRe = regexp.MustCompile(`(?im)\b((?:proxy-)?authorization|x-goog-iam-authorization-token|x-goog-api-key|(?:set-)?cookie):.*$`)
+
+// sanitizeTerraformLog strips credentials headers and bodies of HTTP requests
+// and responses providers dump to terraform trace logs, between
+// "---[ REQUEST ]---" or "---[ RESPONSE ]---" and a line of dashes; bodies
+// follow the first empty line of a dump
+func sanitizeTerraformLog(b []byte) []byte {
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	res := make([]byte, 0, len(b))
+	inDump, inBody := false, false
+	for _, l := range lines {
+		trimmed := bytes.TrimSpace(l)
+		switch {
+		case bytes.Contains(l, []byte("---[ REQUEST ]---")) || bytes.Contains(l, []byte("---[ RESPONSE ]---")):
+			inDump, inBody = true, false
+		case inDump && len(trimmed) > 0 && len(bytes.Trim(trimmed, "-")) == 0:
+			if inBody {
+				res = append(res, redacted+"\n"...)
+			}
+			inDump, inBody = false, false
+		case inBody:
+			continue
+		case inDump && len(trimmed) == 0:
+			inBody = true
+		default:
+			l = tfLogHeaderRe.ReplaceAll(l, []byte("$1: "+redacted))
+		}
+		res = append(res, l...)
+	}
+	return res
+}
+
+// supportFile is a file of a support bundle
+type supportFile struct {
+	name string
+	data []byte
+}
+
+// WriteSupportBundle writes a tarball of diagnostics of the failed command to
+// the artifacts directory and returns its path: the expanded blueprint, with
+// values of secret and sensitive looking variables redacted, the output of
+// ghpc, terraform and packer logs, terraform lock files of deployment groups
+// and summary.json describing the failure and the environment. Redacted
+// values are also removed from every other file of the bundle.
+func WriteSupportBundle(ctx context.Context, bp config.Blueprint, deploymentRoot string, artifactsDir string, sb SupportBundle) (string, error) {
+	now := time.Now().UTC()
+	rbp, secrets := redactBlueprint(bp)
+	bpFile, err := supportBlueprintFile(rbp)
+	if err != nil {
+		return "", err
+	}
+	files := []supportFile{bpFile, {"ghpc.log", sb.Log}}
+	fs, err := supportArtifactFiles(bp, deploymentRoot, artifactsDir)
+	if err != nil {
+		return "", err
+	}
+	files = append(files, fs...)
+	summary, err := supportSummaryFile(ctx, bp, deploymentRoot, sb, now, files)
+	if err != nil {
+		return "", err
+	}
+	files = append([]supportFile{summary}, files...)
+
+	name := fmt.Sprintf("support-bundle-%s", now.Format("20060102T150405Z"))
+	var buf bytes.Buffer
+	if err := writeTarball(&buf, name, files, secrets, now); err != nil {
+		return "", err
+	}
+	p := filepath.Join(artifactsDir, name+".tar.gz")
+	if err := os.WriteFile(p, buf.Bytes(), 0600); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// supportBlueprintFile returns the expanded blueprint file of the redacted
+// blueprint
+func supportBlueprintFile(rbp config.Blueprint) (supportFile, error) {
+	tmp, err := os.CreateTemp("", "expanded_blueprint-*.yaml")
+	if err != nil {
+		return supportFile{}, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := rbp.Export(tmp.Name()); err != nil {
+		return supportFile{}, err
+	}
+	b, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return supportFile{}, err
+	}
+	return supportFile{modulewriter.ExpandedBlueprintName, b}, nil
+}
+
+// supportArtifactFiles returns terraform and packer logs of the artifacts
+// directory and terraform lock files of deployment groups
+func supportArtifactFiles(bp config.Blueprint, deploymentRoot string, artifactsDir string) ([]supportFile, error) {
+	files := []supportFile{}
+	for _, dir := range []string{terraformLogsDirName, packerLogsDirName} {
+		fs, err := supportDirFiles(filepath.Join(artifactsDir, dir), dir)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fs...)
+	}
+	for i, f := range files {
+		if strings.HasPrefix(f.name, terraformLogsDirName+"/") {
+			files[i].data = sanitizeTerraformLog(f.data)
+		}
+	}
+	for _, g := range bp.DeploymentGroups {
+		b, err := os.ReadFile(filepath.Join(modulewriter.GroupDir(deploymentRoot, bp, g.Name), ".terraform.lock.hcl"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, supportFile{path.Join("groups", string(g.Name), ".terraform.lock.hcl"), b})
+	}
+	return files, nil
+}
+
+// supportSummaryFile returns summary.json of the bundle holding files
+func supportSummaryFile(ctx context.Context, bp config.Blueprint, deploymentRoot string, sb SupportBundle, now time.Time, files []supportFile) (supportFile, error) {
+	summary := SupportSummary{
+		Command:     sb.Command,
+		Time:        now,
+		GhpcVersion: sb.GhpcVersion,
+		Blueprint:   bp.BlueprintName,
+		Deployment:  bp.DeploymentName(),
+		Environment: supportEnvironment(ctx, bp, deploymentRoot),
+		Files:       []string{"summary.json"},
+	}
+	if sb.Err != nil {
+		summary.Error = sb.Err.Error()
+	}
+	for _, f := range files {
+		summary.Files = append(summary.Files, f.name)
+	}
+	b, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return supportFile{}, err
+	}
+	return supportFile{"summary.json", b}, nil
+}
+
+// supportDirFiles returns files of the directory, named under prefix
+func supportDirFiles(dir string, prefix string) ([]supportFile, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := []supportFile{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, supportFile{path.Join(prefix, e.Name()), b})
+	}
+	return res, nil
+}
+
+// writeTarball writes the files, with secrets redacted, to a gzipped tarball
+// under the root directory
+func writeTarball(buf *bytes.Buffer, root string, files []supportFile, secrets []string, t time.Time) error {
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		data := f.data
+		for _, s := range secrets {
+			data = bytes.ReplaceAll(data, []byte(s), []byte(redacted))
+		}
+		hdr := &tar.Header{Name: path.Join(root, f.name), Mode: 0600, Size: int64(len(data)), ModTime: t}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shell
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/modulewriter"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func readTarball(c *C, p string) map[string]string {
+	f, err := os.Open(p)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	c.Assert(err, IsNil)
+	tr := tar.NewReader(gz)
+	res := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		b, err := io.ReadAll(tr)
+		c.Assert(err, IsNil)
+		_, name, _ := strings.Cut(hdr.Name, "/") // files are under the directory of the bundle
+		res[name] = string(b)
+	}
+	return res
+}
+
+func (s *MySuite) TestWriteSupportBundle(c *C) {
+	defer func(f func(context.Context, config.Blueprint, string) SupportEnvironment) { supportEnvironment = f }(supportEnvironment)
+	supportEnvironment = func(context.Context, config.Blueprint, string) SupportEnvironment {
+		return SupportEnvironment{OS: "linux", Terraform: "1.5.7", Providers: map[string]string{"registry.terraform.io/hashicorp/google": "5.10.0"}}
+	}
+
+	deplDir := c.MkDir()
+	artifacts := modulewriter.ArtifactsDir(deplDir)
+	c.Assert(os.MkdirAll(filepath.Join(artifacts, terraformLogsDirName), 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(artifacts, terraformLogsDirName, "primary.log"), []byte("TRACE db_password=hunter2hunter2\n"), 0644), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(deplDir, "primary"), 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(deplDir, "primary", ".terraform.lock.hcl"), []byte(`provider "registry.terraform.io/hashicorp/google" {}`), 0644), IsNil)
+
+	bp := config.Blueprint{
+		BlueprintName: "bp",
+		Vars: config.NewDict(map[string]cty.Value{
+			"deployment_name": cty.StringVal("dep"),
+			"db_password":     cty.StringVal("hunter2hunter2"),
+			"api":             cty.StringVal("s3cr3t-value"),
+			"region":          cty.StringVal("us-central1"),
+		}),
+		VarDeclarations: map[string]config.VarDeclaration{"api": {Type: config.SecretVarType}},
+		DeploymentGroups: []config.DeploymentGroup{{Name: "primary", Modules: []config.Module{{
+			ID:     "db",
+			Source: "modules/db",
+			Settings: config.NewDict(map[string]cty.Value{
+				"admin_password": cty.StringVal("0p3n-s3same"),
+				"tier":           cty.StringVal("small"),
+			}),
+		}}}},
+	}
+	p, err := WriteSupportBundle(context.Background(), bp, deplDir, artifacts, SupportBundle{
+		Command:     "deploy dep",
+		GhpcVersion: "v1.28.1",
+		Err:         errors.New("apply failed with s3cr3t-value"),
+		Log:         []byte("Applying deployment group primary\n"),
+	})
+	c.Assert(err, IsNil)
+	c.Check(filepath.Dir(p), Equals, artifacts)
+
+	files := readTarball(c, p)
+	c.Check(files, HasLen, 5)
+	for n, f := range files {
+		c.Check(f, Not(Matches), "(?s).*(hunter2|s3cr3t|0p3n-s3same).*", Commentf("file %s", n))
+	}
+	c.Check(files["ghpc.log"], Equals, "Applying deployment group primary\n")
+	c.Check(files["terraform_logs/primary.log"], Equals, "TRACE db_password=<redacted>\n")
+	c.Check(files["groups/primary/.terraform.lock.hcl"], Equals, `provider "registry.terraform.io/hashicorp/google" {}`)
+	c.Check(files[modulewriter.ExpandedBlueprintName], Matches, "(?s).*region: us-central1.*tier: small.*")
+	// the original blueprint is left as is
+	c.Check(bp.DeploymentGroups[0].Modules[0].Settings.Get("admin_password"), DeepEquals, cty.StringVal("0p3n-s3same"))
+
+	var sum SupportSummary
+	c.Assert(json.Unmarshal([]byte(files["summary.json"]), &sum), IsNil)
+	c.Check(sum.Command, Equals, "deploy dep")
+	c.Check(sum.Error, Equals, "apply failed with <redacted>")
+	c.Check(sum.Deployment, Equals, "dep")
+	c.Check(sum.Environment.Providers["registry.terraform.io/hashicorp/google"], Equals, "5.10.0")
+	c.Check(sum.Files, DeepEquals, []string{
+		"summary.json", modulewriter.ExpandedBlueprintName, "ghpc.log",
+		"terraform_logs/primary.log", "groups/primary/.terraform.lock.hcl"})
+}
+
+func (s *MySuite) TestSanitizeTerraformLog(c *C) {
+	log := `2024-01-02T03:04:05.000Z [DEBUG] provider.terraform-provider-google: Google API Request Details:
+---[ REQUEST ]---------------------------------------
+POST /compute/v1/projects/p/global/networks?alt=json HTTP/1.1
+Host: compute.googleapis.com
+Authorization: Bearer ya29.secret
+Content-Type: application/json
+
+{
+ "name": "net",
+ "password": "hunter2"
+}
+
+-----------------------------------------------------
+2024-01-02T03:04:06.000Z [TRACE] provider: x-goog-api-key: AIzaSecret
+2024-01-02T03:04:07.000Z [INFO]  Terraform version: 1.5.7
+`
+	c.Check(string(sanitizeTerraformLog([]byte(log))), Equals, `2024-01-02T03:04:05.000Z [DEBUG] provider.terraform-provider-google: Google API Request Details:
+---[ REQUEST ]---------------------------------------
+POST /compute/v1/projects/p/global/networks?alt=json HTTP/1.1
+Host: compute.googleapis.com
+Authorization: <redacted>
+Content-Type: application/json
+
+<redacted>
+-----------------------------------------------------
+2024-01-02T03:04:06.000Z [TRACE] provider: x-goog-api-key: <redacted>
+2024-01-02T03:04:07.000Z [INFO]  Terraform version: 1.5.7
+`)
+}
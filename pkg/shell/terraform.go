@@ -23,8 +23,8 @@ import (
 	"fmt"
 	"hpc-toolkit/pkg/config"
 	"hpc-toolkit/pkg/logging"
-	"hpc-toolkit/pkg/modulereader"
 	"hpc-toolkit/pkg/modulewriter"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -32,8 +32,11 @@ import (
 	"strings"
 
 	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
 	"github.com/zclconf/go-cty/cty"
 	"github.com/zclconf/go-cty/cty/gocty"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 )
 
 // ApplyBehavior abstracts behaviors for making changes to cloud infrastructure
@@ -73,7 +76,24 @@ func ConfigureTerraform(workingDir string) (*tfexec.Terraform, error) {
 			err:  err,
 		}
 	}
-	return tfexec.NewTerraform(workingDir, path)
+	tf, err := tfexec.NewTerraform(workingDir, path)
+	if err != nil {
+		return nil, err
+	}
+	// install providers as configured by terraform_providers of the blueprint
+	// and access the state as configured by state_access of the backend, from
+	// init on, while providers keep credentials of the environment
+	if env, ok, err := modulewriter.TerraformEnv(workingDir); err != nil {
+		return nil, err
+	} else if ok {
+		if err := tf.SetEnv(env); err != nil {
+			return nil, err
+		}
+	}
+	if err := setTerraformLog(tf, workingDir); err != nil {
+		return nil, err
+	}
+	return tf, nil
 }
 
 // this function executes a lightweight "terraform init" that is designed to
@@ -82,21 +102,24 @@ func ConfigureTerraform(workingDir string) (*tfexec.Terraform, error) {
 // will download plugins (e.g. google provider) as needed; no reliable mechanism
 // has been found (e.g. tfexec.PluginDir("/dev/null")) that avoids erroring on
 // properly-initialized root modules
-func needsInit(tf *tfexec.Terraform) bool {
+func needsInit(ctx context.Context, tf *tfexec.Terraform) bool {
 	getOpt := tfexec.Get(false)
 	backendOpt := tfexec.Backend(false)
-	e := tf.Init(context.Background(), getOpt, backendOpt)
+	e := tf.Init(ctx, getOpt, backendOpt)
 
 	return e != nil
 }
 
-func initModule(tf *tfexec.Terraform) error {
+func initModule(ctx context.Context, tf *tfexec.Terraform) error {
 	var err error
-	if needsInit(tf) {
+	if needsInit(ctx, tf) {
 		logging.Info("Initializing deployment group %s", tf.WorkingDir())
-		err = tf.Init(context.Background())
+		err = tf.Init(ctx)
 	}
 
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if err != nil {
 		return &TfError{
 			help: fmt.Sprintf("initialization of deployment group %s failed; manually resolve errors below", tf.WorkingDir()),
@@ -107,9 +130,9 @@ func initModule(tf *tfexec.Terraform) error {
 	return err
 }
 
-func outputModule(tf *tfexec.Terraform) (map[string]cty.Value, error) {
+func outputModule(ctx context.Context, tf *tfexec.Terraform) (map[string]cty.Value, error) {
 	logging.Info("Collecting terraform outputs from %s", tf.WorkingDir())
-	output, err := tf.Output(context.Background())
+	output, err := tf.Output(ctx)
 	if err != nil {
 		return map[string]cty.Value{}, &TfError{
 			help: fmt.Sprintf("collecting terraform outputs from deployment group %s failed; manually resolve errors below", tf.WorkingDir()),
@@ -142,11 +165,19 @@ type Diagnostic struct {
 	Severity string `json:"severity"`
 	Summary  string `json:"summary"`
 	Detail   string `json:"detail"`
+	Address  string `json:"address"`
 }
 
 type JsonMessage struct {
 	Level      string     `json:"@level"`
+	Message    string     `json:"@message"`
+	Type       string     `json:"type"`
 	Diagnostic Diagnostic `json:"diagnostic"`
+	Hook       struct {
+		Resource struct {
+			Addr string `json:"addr"`
+		} `json:"resource"`
+	} `json:"hook"`
 }
 
 func parseJsonMessages(data string) []JsonMessage {
@@ -177,21 +208,36 @@ func helpOnPlanError(msgs []JsonMessage) string {
 	}
 }
 
-func planModule(tf *tfexec.Terraform, path string, destroy bool) (bool, error) {
-	outOpt := tfexec.Out(path)
+// planModule saves the plan to path, it returns true if the plan makes changes
+func planModule(ctx context.Context, tf *tfexec.Terraform, path string, opts ...tfexec.PlanOption) (bool, error) {
+	vf, err := credentialsVarFile()
+	if err != nil {
+		return false, err
+	}
+	if vf != "" {
+		defer os.Remove(vf)
+		opts = append(opts, tfexec.VarFile(vf))
+	}
 	var jsonOut strings.Builder
-	wantsChange, err := tf.PlanJSON(context.Background(), &jsonOut, outOpt, tfexec.Destroy(destroy))
+	wantsChange, err := tf.PlanJSON(ctx, &jsonOut, append([]tfexec.PlanOption{tfexec.Out(path)}, opts...)...)
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
 	if err != nil {
 		// Invoke `Plan` to get human-readable error.
 		// TODO: implement rendering to avoid double-call.
 		// Note planned deprecration of Plan in favor of JSON-only format
 		// https://github.com/hashicorp/terraform-exec/blob/1b7714111a94813e92936051fb3014fec81218d5/tfexec/plan.go#L128-L129
-		_, plainError := tf.Plan(context.Background(), tfexec.Destroy(destroy))
+		_, plainError := tf.Plan(ctx, opts...)
 		if plainError == nil { // shouldn't happen
 			plainError = err // fallback to original error (simple `exit status 1`)
 		}
+		msgs := parseJsonMessages(jsonOut.String())
+		if l, ok := stateLockOf(msgs, plainError); ok {
+			return false, &StateLockError{Dir: tf.WorkingDir(), Lock: l, err: plainError}
+		}
 		msg := fmt.Sprintf("terraform plan for deployment group %s failed", tf.WorkingDir())
-		help := helpOnPlanError(parseJsonMessages(jsonOut.String()))
+		help := helpOnPlanError(msgs)
 		if len(help) > 0 {
 			msg = fmt.Sprintf("%s; %s", msg, help)
 		}
@@ -201,12 +247,12 @@ func planModule(tf *tfexec.Terraform, path string, destroy bool) (bool, error) {
 	return wantsChange, nil
 }
 
-func promptForApply(tf *tfexec.Terraform, path string, b ApplyBehavior) bool {
+func promptForApply(ctx context.Context, tf *tfexec.Terraform, path string, b ApplyBehavior) bool {
 	switch b {
 	case AutomaticApply:
 		return true
 	case PromptBeforeApply:
-		plan, err := tf.ShowPlanFileRaw(context.Background(), path)
+		plan, err := tf.ShowPlanFileRaw(ctx, path)
 		if err != nil {
 			return false
 		}
@@ -217,6 +263,11 @@ func promptForApply(tf *tfexec.Terraform, path string, b ApplyBehavior) bool {
 		if summary == "" {
 			summary = fmt.Sprintf("Please review full proposed changes for deployment group %s", tf.WorkingDir())
 		}
+		if d, err := planCost(ctx, tf, path); err != nil {
+			logging.Info("Cost of proposed changes could not be estimated: %v", err)
+		} else if len(d.Changes) > 0 {
+			summary = strings.TrimSpace(summary) + "\n" + d.String()
+		}
 
 		changes := ProposedChanges{
 			Summary: summary,
@@ -229,23 +280,137 @@ func promptForApply(tf *tfexec.Terraform, path string, b ApplyBehavior) bool {
 	}
 }
 
-func applyPlanConsoleOutput(tf *tfexec.Terraform, path string) error {
-	planFileOpt := tfexec.DirOrPlan(path)
+// ApplyError is returned when terraform apply fails partway, Resources are
+// addresses of the resources terraform failed to apply
+type ApplyError struct {
+	Resources []string
+	err       error
+}
+
+func (e *ApplyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.err
+}
+
+// renderJsonMessages prints the human-readable part of machine-readable
+// terraform output as it is produced, and returns the parsed messages
+func renderJsonMessages(r io.Reader, w io.Writer) []JsonMessage {
+	res := []JsonMessage{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var msg JsonMessage
+		if err := json.Unmarshal(sc.Bytes(), &msg); err != nil {
+			fmt.Fprintln(w, sc.Text())
+			continue
+		}
+		res = append(res, msg)
+		if msg.Type == "version" {
+			continue
+		}
+		fmt.Fprintln(w, msg.Message)
+		if msg.Type == "diagnostic" && msg.Diagnostic.Detail != "" {
+			fmt.Fprintln(w, msg.Diagnostic.Detail)
+		}
+	}
+	return res
+}
+
+// failedResources returns sorted addresses of resources that failed to apply
+func failedResources(msgs []JsonMessage) []string {
+	failed := map[string]bool{}
+	for _, msg := range msgs {
+		if msg.Type == "apply_errored" && msg.Hook.Resource.Addr != "" {
+			failed[msg.Hook.Resource.Addr] = true
+		}
+		if msg.Type == "diagnostic" && msg.Diagnostic.Severity == "error" && msg.Diagnostic.Address != "" {
+			failed[msg.Diagnostic.Address] = true
+		}
+	}
+	res := maps.Keys(failed)
+	slices.Sort(res)
+	return res
+}
+
+// terraformCommand is commandContext running terraform in the working
+// directory of tf, with the environment tfexec runs it with: that of the
+// deployment group, e.g. with state_access, its trace log, and settings for
+// running in automation
+func terraformCommand(ctx context.Context, tf *tfexec.Terraform, args ...string) (*exec.Cmd, error) {
+	env, ok, err := modulewriter.TerraformEnv(tf.WorkingDir())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		env = map[string]string{}
+		for _, kv := range os.Environ() {
+			if k, v, found := strings.Cut(kv, "="); found {
+				env[k] = v
+			}
+		}
+	}
+	env["TF_IN_AUTOMATION"], env["TF_INPUT"] = "1", "0"
+	env["TF_LOG"], env["TF_LOG_PATH"] = "", "" // so logging can't pollute the output
+	if p := terraformLogPath(tf.WorkingDir()); p != "" {
+		env["TF_LOG"], env["TF_LOG_PATH"] = "TRACE", p
+	}
+	delete(env, "TF_WORKSPACE")
+
+	cmd := commandContext(ctx, tf.ExecPath(), args...)
+	cmd.Dir = tf.WorkingDir()
+	keys := maps.Keys(env)
+	slices.Sort(keys)
+	for _, k := range keys {
+		cmd.Env = append(cmd.Env, k+"="+env[k])
+	}
+	return cmd, nil
+}
+
+// applyPlanConsoleOutput applies the plan, unlike tfexec it interrupts
+// terraform on cancellation, so terraform can persist the partial state.
+// Resources that failed to apply are reported with ApplyError.
+func applyPlanConsoleOutput(ctx context.Context, tf *tfexec.Terraform, path string) error {
 	logging.Info("Running terraform apply on deployment group %s", tf.WorkingDir())
-	tf.SetStdout(os.Stdout)
-	tf.SetStderr(os.Stderr)
-	if err := tf.Apply(context.Background(), planFileOpt); err != nil {
+	cmd, err := terraformCommand(ctx, tf, "apply", "-input=false", "-json", path)
+	if err != nil {
 		return err
 	}
-	tf.SetStdout(nil)
-	tf.SetStderr(nil)
-	return nil
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	msgs := renderJsonMessages(stdout, os.Stdout)
+	err = waitCommand(cmd)
+	if ctx.Err() != nil {
+		return &TfError{
+			help: fmt.Sprintf("terraform apply on deployment group %s was interrupted; resources created so far are recorded in its terraform state", tf.WorkingDir()),
+			err:  ctx.Err(),
+		}
+	}
+	if failed := failedResources(msgs); err != nil && len(failed) > 0 {
+		return &ApplyError{
+			Resources: failed,
+			err: &TfError{
+				help: fmt.Sprintf("terraform apply on deployment group %s failed for: %s", tf.WorkingDir(), strings.Join(failed, ", ")),
+				err:  err,
+			},
+		}
+	}
+	return err
 }
 
 // generate a Terraform plan to apply or destroy a module
 // recall "destroy" is just an alias for "apply -destroy"!
 // apply the plan automatically or after prompting the user
-func applyOrDestroy(tf *tfexec.Terraform, b ApplyBehavior, destroy bool) error {
+// if targets are not empty, the plan is limited to the given resource addresses
+func applyOrDestroy(ctx context.Context, tf *tfexec.Terraform, b ApplyBehavior, destroy bool, targets ...string) error {
 	action := "adding or changing"
 	pastTense := "applied"
 	if destroy {
@@ -253,7 +418,7 @@ func applyOrDestroy(tf *tfexec.Terraform, b ApplyBehavior, destroy bool) error {
 		pastTense = "destroyed"
 	}
 
-	if err := initModule(tf); err != nil {
+	if err := initModule(ctx, tf); err != nil {
 		return err
 	}
 
@@ -263,8 +428,18 @@ func applyOrDestroy(tf *tfexec.Terraform, b ApplyBehavior, destroy bool) error {
 	if err != nil {
 		return err
 	}
+	f.Close()
 	defer os.Remove(f.Name())
-	wantsChange, err := planModule(tf, f.Name(), destroy)
+	opts := []tfexec.PlanOption{tfexec.Destroy(destroy)}
+	for _, t := range targets {
+		opts = append(opts, tfexec.Target(t))
+	}
+	wantsChange, err := planModule(ctx, tf, f.Name(), opts...)
+	if retry, rerr := recoverStateLock(ctx, tf, b, err); retry {
+		wantsChange, err = planModule(ctx, tf, f.Name(), opts...)
+	} else {
+		err = rerr
+	}
 	if err != nil {
 		return err
 	}
@@ -272,7 +447,7 @@ func applyOrDestroy(tf *tfexec.Terraform, b ApplyBehavior, destroy bool) error {
 	var apply bool
 	if wantsChange {
 		logging.Info("Deployment group %s requires %s cloud infrastructure", tf.WorkingDir(), action)
-		apply = b == AutomaticApply || promptForApply(tf, f.Name(), b)
+		apply = b == AutomaticApply || promptForApply(ctx, tf, f.Name(), b)
 	} else {
 		logging.Info("Cloud infrastructure in deployment group %s is already %s", tf.WorkingDir(), pastTense)
 	}
@@ -281,20 +456,20 @@ func applyOrDestroy(tf *tfexec.Terraform, b ApplyBehavior, destroy bool) error {
 		return nil
 	}
 
-	if err := applyPlanConsoleOutput(tf, f.Name()); err != nil {
+	if err := applyPlanConsoleOutput(ctx, tf, f.Name()); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func getOutputs(tf *tfexec.Terraform, b ApplyBehavior) (map[string]cty.Value, error) {
-	err := applyOrDestroy(tf, b, false)
+func getOutputs(ctx context.Context, tf *tfexec.Terraform, b ApplyBehavior) (map[string]cty.Value, error) {
+	err := applyOrDestroy(ctx, tf, b, false)
 	if err != nil {
 		return nil, err
 	}
 
-	outputValues, err := outputModule(tf)
+	outputValues, err := outputModule(ctx, tf)
 	if err != nil {
 		return nil, err
 	}
@@ -305,16 +480,44 @@ func outputsFile(artifactsDir string, group config.GroupName) string {
 	return filepath.Join(artifactsDir, fmt.Sprintf("%s_outputs.tfvars", string(group)))
 }
 
+// ApplyTargets plans and applies changes to the given resources only, and
+// to resources they depend on
+func ApplyTargets(ctx context.Context, tf *tfexec.Terraform, b ApplyBehavior, targets []string) error {
+	return applyOrDestroy(ctx, tf, b, false, targets...)
+}
+
 // ExportOutputs will run terraform output and capture data needed for
 // subsequent deployment groups
-func ExportOutputs(tf *tfexec.Terraform, artifactsDir string, applyBehavior ApplyBehavior) error {
-	thisGroup := config.GroupName(filepath.Base(tf.WorkingDir()))
-	filepath := outputsFile(artifactsDir, thisGroup)
+func ExportOutputs(ctx context.Context, tf *tfexec.Terraform, thisGroup config.GroupName, artifactsDir string, ae config.ArtifactsEncryption, applyBehavior ApplyBehavior) error {
+	outputValues, err := getOutputs(ctx, tf, applyBehavior)
+	if err != nil {
+		return err
+	}
+	return writeOutputs(ctx, outputValues, thisGroup, artifactsDir, ae)
+}
 
-	outputValues, err := getOutputs(tf, applyBehavior)
+// ExportStageOutputs applies changes to the given modules of the group only,
+// and to modules they depend on, then exports outputs of the group, for later
+// stages of the group to use
+func ExportStageOutputs(ctx context.Context, tf *tfexec.Terraform, thisGroup config.GroupName, modules []config.ModuleID, artifactsDir string, ae config.ArtifactsEncryption, applyBehavior ApplyBehavior) error {
+	targets := make([]string, len(modules))
+	for i, m := range modules {
+		targets[i] = "module." + string(m)
+	}
+	if err := applyOrDestroy(ctx, tf, applyBehavior, false, targets...); err != nil {
+		return err
+	}
+	outputValues, err := outputModule(ctx, tf)
 	if err != nil {
 		return err
 	}
+	return writeOutputs(ctx, outputValues, thisGroup, artifactsDir, ae)
+}
+
+// writeOutputs writes output values of the deployment group to the artifacts
+// directory, where they are read by ImportInputs of subsequent groups
+func writeOutputs(ctx context.Context, outputValues map[string]cty.Value, thisGroup config.GroupName, artifactsDir string, ae config.ArtifactsEncryption) error {
+	filepath := outputsFile(artifactsDir, thisGroup)
 
 	// TODO: confirm that outputValues has keys we would expect from the
 	// blueprint; edge case is that "terraform output" can be missing keys
@@ -325,7 +528,7 @@ func ExportOutputs(tf *tfexec.Terraform, artifactsDir string, applyBehavior Appl
 	}
 
 	logging.Info("Writing outputs artifact from deployment group %s to file %s", thisGroup, filepath)
-	if err := modulewriter.WriteHclAttributes(outputValues, filepath); err != nil {
+	if err := writeOutputsFile(ctx, ae, outputValues, filepath); err != nil {
 		return err
 	}
 
@@ -346,10 +549,10 @@ func gatherUpstreamOutputs(deploymentRoot string, artifactsDir string, g config.
 		}
 		logging.Info("collecting outputs for group %q from group %q", g.Name, pg)
 		filepath := outputsFile(artifactsDir, pg)
-		gVals, err := modulereader.ReadHclAttributes(filepath)
+		gVals, err := readOutputsFile(context.Background(), bp.ArtifactsEncryption, filepath)
 		if err != nil {
 			return nil, &TfError{
-				help: fmt.Sprintf("consider running \"ghpc export-outputs %s/%s\"", deploymentRoot, pg),
+				help: fmt.Sprintf("consider running \"ghpc export-outputs %s\"", modulewriter.GroupDir(deploymentRoot, bp, pg)),
 				err:  err,
 			}
 		}
@@ -362,28 +565,150 @@ func gatherUpstreamOutputs(deploymentRoot string, artifactsDir string, g config.
 
 }
 
+// HasOutputs tells whether the terraform group exported its outputs to
+// artifactsDir; groups without outputs never do
+func HasOutputs(bp config.Blueprint, artifactsDir string, group config.GroupName) bool {
+	stored := outputsFile(artifactsDir, group)
+	if bp.ArtifactsEncryption.Enabled() {
+		stored += encryptedSuffix
+	}
+	_, err := os.Stat(stored)
+	return err == nil
+}
+
+// DeployedOutputs reads outputs of modules exported to artifactsDir by deployed
+// terraform groups, by module ID and output name. Groups that were not
+// deployed yet are left out.
+func DeployedOutputs(ctx context.Context, bp config.Blueprint, artifactsDir string) (map[config.ModuleID]map[string]cty.Value, error) {
+	res := map[config.ModuleID]map[string]cty.Value{}
+	for _, g := range bp.DeploymentGroups {
+		if g.Kind() != config.TerraformKind {
+			continue
+		}
+		if !HasOutputs(bp, artifactsDir, g.Name) {
+			continue
+		}
+		vals, err := readOutputsFile(ctx, bp.ArtifactsEncryption, outputsFile(artifactsDir, g.Name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read outputs of deployment group %s: %w", g.Name, err)
+		}
+		for _, m := range g.Modules {
+			for _, o := range m.Outputs {
+				v, ok := vals[config.AutomaticOutputName(o.Name, m.ID)]
+				if !ok {
+					continue
+				}
+				if _, ok := res[m.ID]; !ok {
+					res[m.ID] = map[string]cty.Value{}
+				}
+				res[m.ID][o.Name] = v
+			}
+		}
+	}
+	return res, nil
+}
+
 // ImportInputs will search artifactsDir for files produced by ExportOutputs and
 // combine/filter them for the input values needed by the group in the Terraform
-// working directory
-func ImportInputs(deploymentGroupDir string, artifactsDir string, expandedBlueprintFile string) error {
-	deploymentRoot := filepath.Clean(filepath.Join(deploymentGroupDir, ".."))
+// working directory, runtime values and zones picked by zone policies used by
+// the group are resolved as well.
+//
+// Inputs decrypted from encrypted outputs are written to files only the user
+// can read; the returned function removes them, commands running terraform and
+// Packer call it once done. It is a no-op for unencrypted outputs.
+//
+// Inputs of Packer modules referring to terraform modules of their group are
+// imported once the group exported its outputs, see ImportStageInputs.
+func ImportInputs(ctx context.Context, deploymentGroupDir string, artifactsDir string, expandedBlueprintFile string) (func(), error) {
+	return importInputs(ctx, deploymentGroupDir, artifactsDir, expandedBlueprintFile, -1)
+}
 
+// ImportStageInputs imports input values of a single stage of the group, as
+// returned by DeploymentGroup.Stages, see ImportInputs. Stages of Packer
+// modules referring to terraform modules of their group are imported once an
+// earlier stage exported their outputs.
+func ImportStageInputs(ctx context.Context, deploymentGroupDir string, artifactsDir string, expandedBlueprintFile string, stage int) (func(), error) {
+	return importInputs(ctx, deploymentGroupDir, artifactsDir, expandedBlueprintFile, stage)
+}
+
+func importInputs(ctx context.Context, deploymentGroupDir string, artifactsDir string, expandedBlueprintFile string, only int) (func(), error) {
 	bp, _, err := config.NewBlueprint(expandedBlueprintFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	g, err := bp.Group(config.GroupName(filepath.Base(deploymentGroupDir)))
+	g, deploymentRoot, err := modulewriter.DeploymentGroupOfDir(bp, deploymentGroupDir)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	decrypted := []string{}
+	cleanup := func() {
+		for _, f := range decrypted {
+			if err := removeIfExists(f); err != nil {
+				logging.Error("failed to remove decrypted inputs %s: %v", f, err)
+			}
+		}
+	}
+	// stages of groups mixing Packer and terraform modules import their inputs
+	// to files of their own, but for terraform stages, which share the root
+	// module of the group
+	tfImported := false
+	for i, stage := range g.Stages() {
+		if only >= 0 && i != only {
+			continue
+		}
+		if stage.Kind() == config.TerraformKind {
+			if tfImported {
+				continue
+			}
+			tfImported, stage = true, terraformModules(g)
+		}
+		if only < 0 && stage.Kind() == config.PackerKind && g.Mixed() && !HasOutputs(bp, artifactsDir, g.Name) {
+			if used, err := config.OutputNamesByGroup(stage, bp); err == nil && len(used[g.Name]) > 0 {
+				logging.Info("Inputs of Packer module %s are imported once deployment group %s is applied", stage.Modules[0].ID, g.Name)
+				continue
+			}
+		}
+		f, err := importStageInputs(deploymentGroupDir, deploymentRoot, artifactsDir, stage, bp)
+		if f != "" && bp.ArtifactsEncryption.Enabled() {
+			decrypted = append(decrypted, f)
+		}
+		if err == nil && stage.Kind() == config.TerraformKind {
+			err = importRuntimeValues(deploymentGroupDir, stage)
+		}
+		if err == nil && stage.Kind() == config.TerraformKind {
+			err = importZoneSelection(ctx, deploymentGroupDir, artifactsDir, bp, stage)
+		}
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
 	}
+	return cleanup, nil
+}
+
+// terraformModules returns the group keeping only its terraform modules
+func terraformModules(g config.DeploymentGroup) config.DeploymentGroup {
+	res := g
+	res.Modules = nil
+	for _, m := range g.Modules {
+		if m.Kind == config.TerraformKind {
+			res.Modules = append(res.Modules, m)
+		}
+	}
+	return res
+}
 
+// importStageInputs writes input values of the stage, it returns the path of
+// the file it wrote, if any
+func importStageInputs(deploymentGroupDir string, deploymentRoot string, artifactsDir string, g config.DeploymentGroup, bp config.Blueprint) (string, error) {
 	inputs, err := gatherUpstreamOutputs(deploymentRoot, artifactsDir, g, bp)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if len(inputs) == 0 {
-		return nil
+		return "", nil
 	}
 
 	var outFile string
@@ -394,11 +719,11 @@ func ImportInputs(deploymentGroupDir string, artifactsDir string, expandedBluepr
 		outFile = fmt.Sprintf("%s_inputs.auto.tfvars", g.Name)
 		toImport = inputs // import all
 	case config.PackerKind:
-		// Packer groups are enforced to have length 1
+		// Packer stages are made of a single module
 		mod := g.Modules[0]
 		modPath, err := modulewriter.DeploymentSource(mod)
 		if err != nil {
-			return err
+			return "", err
 		}
 
 		// evaluate Packer settings that contain intergroup references in the
@@ -414,30 +739,179 @@ func ImportInputs(deploymentGroupDir string, artifactsDir string, expandedBluepr
 		igcVars := modulewriter.FindIntergroupVariables(g, bp)
 		newModule, err := modulewriter.SubstituteIgcReferencesInModule(config.Module{Settings: intergroupSettings}, igcVars)
 		if err != nil {
-			return err
+			return "", err
 		}
 
 		if err := mergeMapsWithoutLoss(inputs, bp.Vars.Items()); err != nil {
-			return err
+			return "", err
 		}
 
 		evaluatedSettings, err := newModule.Settings.Eval(config.Blueprint{Vars: config.NewDict(inputs)})
 		if err != nil {
-			return err
+			return "", err
 		}
 
 		outFile = filepath.Join(modPath, fmt.Sprintf("%s_inputs.auto.pkrvars.hcl", mod.ID))
 		toImport = evaluatedSettings.Items()
 	default:
-		return fmt.Errorf("unknown module kind for deployment group %s", g.Name)
+		return "", fmt.Errorf("unknown module kind for deployment group %s", g.Name)
 	}
 
 	outPath := filepath.Join(deploymentGroupDir, outFile)
 	logging.Info("Writing outputs for deployment group %s to file %s", g.Name, outPath)
-	return modulewriter.WriteHclAttributes(toImport, outPath)
+	return outPath, writeInputsFile(bp.ArtifactsEncryption, toImport, outPath)
 }
 
 // Destroy destroys all infrastructure in the module working directory
-func Destroy(tf *tfexec.Terraform, b ApplyBehavior) error {
-	return applyOrDestroy(tf, b, true)
+func Destroy(ctx context.Context, tf *tfexec.Terraform, b ApplyBehavior) error {
+	return applyOrDestroy(ctx, tf, b, true)
+}
+
+// DestroyModules destroys infrastructure of the given modules only,
+// resources of other modules are kept in the terraform state
+func DestroyModules(ctx context.Context, tf *tfexec.Terraform, b ApplyBehavior, mods []config.ModuleID) error {
+	if len(mods) == 0 {
+		logging.Info("No modules to destroy in deployment group %s", tf.WorkingDir())
+		return nil
+	}
+	targets := make([]string, len(mods))
+	for i, m := range mods {
+		targets[i] = moduleAddress(m)
+	}
+	return applyOrDestroy(ctx, tf, b, true, targets...)
+}
+
+func moduleAddress(m config.ModuleID) string {
+	return fmt.Sprintf("module.%s", m)
+}
+
+// StateModules returns IDs of the modules that have resources
+// in the terraform state of the deployment group
+func StateModules(ctx context.Context, tf *tfexec.Terraform) ([]config.ModuleID, error) {
+	root, err := stateRootModule(ctx, tf)
+	if err != nil {
+		return nil, err
+	}
+	return childModuleIDs(root), nil
+}
+
+// stateRootModule returns the root module of the terraform state of the
+// deployment group, it is empty if the group was never applied
+func stateRootModule(ctx context.Context, tf *tfexec.Terraform) (*tfjson.StateModule, error) {
+	if err := initModule(ctx, tf); err != nil {
+		return nil, err
+	}
+	state, err := tf.Show(ctx)
+	if err != nil {
+		return nil, &TfError{
+			help: fmt.Sprintf("reading terraform state of deployment group %s failed; manually resolve errors below", tf.WorkingDir()),
+			err:  err,
+		}
+	}
+	if state == nil || state.Values == nil || state.Values.RootModule == nil {
+		return &tfjson.StateModule{}, nil
+	}
+	return state.Values.RootModule, nil
+}
+
+// moduleIDOfAddress returns ID of the blueprint module the address of
+// a child module belongs to
+func moduleIDOfAddress(addr string) (config.ModuleID, bool) {
+	id, found := strings.CutPrefix(addr, "module.")
+	if !found {
+		return "", false
+	}
+	// strip index of modules that use count or for_each, e.g. `module.a[0]`
+	if i := strings.IndexAny(id, "[."); i != -1 {
+		id = id[:i]
+	}
+	return config.ModuleID(id), true
+}
+
+func childModuleIDs(root *tfjson.StateModule) []config.ModuleID {
+	res := []config.ModuleID{}
+	for _, cm := range root.ChildModules {
+		id, found := moduleIDOfAddress(cm.Address)
+		if found && !slices.Contains(res, id) {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// StateResource is a managed resource in the terraform state of a deployment
+// group, Module is empty for resources outside of blueprint modules
+type StateResource struct {
+	Address string
+	Type    string
+	Module  config.ModuleID
+	// Protected is true for resources with deletion_protection enabled,
+	// terraform fails to destroy them
+	Protected bool
+	// SelfLink is the URL of the cloud resource, for resources that have one
+	SelfLink string
+}
+
+// statefulTypes are types of resources holding data that is lost once they
+// are destroyed
+var statefulTypes = []string{
+	"google_bigquery_dataset",
+	"google_bigquery_table",
+	"google_compute_disk",
+	"google_compute_image",
+	"google_compute_region_disk",
+	"google_compute_snapshot",
+	"google_filestore_instance",
+	"google_netapp_volume",
+	"google_parallelstore_instance",
+	"google_secret_manager_secret",
+	"google_sql_database_instance",
+	"google_storage_bucket",
+}
+
+// Stateful is true for resources holding data, e.g. disks and buckets
+func (r StateResource) Stateful() bool {
+	return slices.Contains(statefulTypes, r.Type)
+}
+
+// StateResources returns managed resources in the terraform state of the
+// deployment group
+func StateResources(ctx context.Context, tf *tfexec.Terraform) ([]StateResource, error) {
+	root, err := stateRootModule(ctx, tf)
+	if err != nil {
+		return nil, err
+	}
+	return managedResources(root, ""), nil
+}
+
+func managedResources(m *tfjson.StateModule, owner config.ModuleID) []StateResource {
+	res := []StateResource{}
+	for _, r := range m.Resources {
+		if r.Mode == tfjson.ManagedResourceMode {
+			protected, _ := r.AttributeValues["deletion_protection"].(bool)
+			selfLink, _ := r.AttributeValues["self_link"].(string)
+			res = append(res, StateResource{Address: r.Address, Type: r.Type, Module: owner, Protected: protected, SelfLink: selfLink})
+		}
+	}
+	for _, cm := range m.ChildModules {
+		o := owner
+		if o == "" {
+			o, _ = moduleIDOfAddress(cm.Address)
+		}
+		res = append(res, managedResources(cm, o)...)
+	}
+	return res
+}
+
+// OrphanedModules returns modules that have resources in the terraform state,
+// but are not part of the deployment group. These are usually left behind by
+// modules removed from the blueprint.
+func OrphanedModules(stateModules []config.ModuleID, g config.DeploymentGroup) []config.ModuleID {
+	res := []config.ModuleID{}
+	for _, m := range stateModules {
+		if !slices.ContainsFunc(g.Modules, func(gm config.Module) bool { return gm.ID == m }) {
+			res = append(res, m)
+		}
+	}
+	return res
 }
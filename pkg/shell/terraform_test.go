@@ -17,11 +17,19 @@ limitations under the License.
 package shell
 
 import (
+	"context"
 	"errors"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/modulereader"
+	"hpc-toolkit/pkg/modulewriter"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/zclconf/go-cty/cty"
 	. "gopkg.in/check.v1"
 )
 
@@ -54,3 +62,164 @@ func (s *MySuite) TestFindTerraform(c *C) {
 	var tfe *TfError
 	c.Assert(errors.As(err, &tfe), Equals, true)
 }
+
+func (s *MySuite) TestOrphanedModules(c *C) {
+	root := tfjson.StateModule{
+		ChildModules: []*tfjson.StateModule{
+			{Address: "module.network"},
+			{Address: "module.old_fs[0]"},
+			{Address: "module.old_fs[1]"},
+			{Address: "module.cluster"},
+		},
+	}
+	inState := childModuleIDs(&root)
+	c.Check(inState, DeepEquals, []config.ModuleID{"network", "old_fs", "cluster"})
+
+	g := config.DeploymentGroup{Modules: []config.Module{{ID: "network"}, {ID: "cluster"}, {ID: "new_fs"}}}
+	c.Check(OrphanedModules(inState, g), DeepEquals, []config.ModuleID{"old_fs"})
+}
+
+func (s *MySuite) TestManagedResources(c *C) {
+	root := tfjson.StateModule{
+		Resources: []*tfjson.StateResource{
+			{Address: "google_storage_bucket.manual", Type: "google_storage_bucket", Mode: tfjson.ManagedResourceMode},
+			{Address: "google_sql_database_instance.db", Type: "google_sql_database_instance", Mode: tfjson.ManagedResourceMode,
+				AttributeValues: map[string]interface{}{"deletion_protection": true}},
+		},
+		ChildModules: []*tfjson.StateModule{
+			{Address: "module.network", Resources: []*tfjson.StateResource{
+				{Address: "module.network.google_compute_network.vpc", Type: "google_compute_network", Mode: tfjson.ManagedResourceMode},
+				{Address: "module.network.data.google_project.p", Type: "google_project", Mode: tfjson.DataResourceMode},
+			}},
+			{Address: "module.vm", ChildModules: []*tfjson.StateModule{
+				{Address: "module.vm.module.nested", Resources: []*tfjson.StateResource{
+					{Address: "module.vm.module.nested.google_compute_instance.i[0]", Type: "google_compute_instance", Mode: tfjson.ManagedResourceMode,
+						AttributeValues: map[string]interface{}{"self_link": "https://www.googleapis.com/compute/v1/projects/p/zones/z/instances/i-0"}},
+				}},
+			}},
+		},
+	}
+	c.Check(managedResources(&root, ""), DeepEquals, []StateResource{
+		{Address: "google_storage_bucket.manual", Type: "google_storage_bucket"},
+		{Address: "google_sql_database_instance.db", Type: "google_sql_database_instance", Protected: true},
+		{Address: "module.network.google_compute_network.vpc", Type: "google_compute_network", Module: "network"},
+		{Address: "module.vm.module.nested.google_compute_instance.i[0]", Type: "google_compute_instance", Module: "vm",
+			SelfLink: "https://www.googleapis.com/compute/v1/projects/p/zones/z/instances/i-0"},
+	})
+	c.Check(StateResource{Type: "google_storage_bucket"}.Stateful(), Equals, true)
+	c.Check(StateResource{Type: "google_compute_network"}.Stateful(), Equals, false)
+}
+
+func (s *MySuite) TestRenderJsonMessages(c *C) {
+	out := `{"@level":"info","@message":"Terraform 1.5.7","type":"version","terraform":"1.5.7"}
+{"@level":"info","@message":"module.vpc.google_compute_network.main: Creating...","type":"apply_start","hook":{"resource":{"addr":"module.vpc.google_compute_network.main"}}}
+{"@level":"info","@message":"module.vm.google_compute_instance.i[0]: Creation errored after 2s","type":"apply_errored","hook":{"resource":{"addr":"module.vm.google_compute_instance.i[0]"}}}
+not a json line
+{"@level":"error","@message":"Error: Error creating Network: googleapi: Error 403","type":"diagnostic","diagnostic":{"severity":"error","summary":"Error creating Network: googleapi: Error 403","detail":"Permission denied","address":"module.vpc.google_compute_network.main"}}
+{"@level":"warn","@message":"Warning: Deprecated attribute","type":"diagnostic","diagnostic":{"severity":"warning","summary":"Deprecated attribute","address":"module.vpc.google_compute_subnetwork.sub"}}
+`
+	var w strings.Builder
+	msgs := renderJsonMessages(strings.NewReader(out), &w)
+	c.Check(msgs, HasLen, 5)
+	c.Check(w.String(), Equals, `module.vpc.google_compute_network.main: Creating...
+module.vm.google_compute_instance.i[0]: Creation errored after 2s
+not a json line
+Error: Error creating Network: googleapi: Error 403
+Permission denied
+Warning: Deprecated attribute
+`)
+	c.Check(failedResources(msgs), DeepEquals, []string{
+		"module.vm.google_compute_instance.i[0]",
+		"module.vpc.google_compute_network.main",
+	})
+	c.Check(failedResources(nil), HasLen, 0)
+}
+
+func (s *MySuite) TestDeployedOutputs(c *C) {
+	dir := c.MkDir()
+	bp := config.Blueprint{DeploymentGroups: []config.DeploymentGroup{
+		{Name: "primary", Modules: []config.Module{{
+			ID:      "controller",
+			Kind:    config.TerraformKind,
+			Outputs: []modulereader.OutputInfo{{Name: "ip"}, {Name: "name"}}}}},
+		{Name: "later", Modules: []config.Module{{
+			ID:      "login",
+			Kind:    config.TerraformKind,
+			Outputs: []modulereader.OutputInfo{{Name: "ip"}}}}},
+	}}
+	c.Assert(modulewriter.WriteHclAttributes(map[string]cty.Value{
+		"ip_controller": cty.StringVal("10.0.0.1"),
+	}, outputsFile(dir, "primary")), IsNil)
+
+	// outputs of groups not deployed yet are left out
+	got, err := DeployedOutputs(context.Background(), bp, dir)
+	c.Assert(err, IsNil)
+	c.Check(got, DeepEquals, map[config.ModuleID]map[string]cty.Value{
+		"controller": {"ip": cty.StringVal("10.0.0.1")},
+	})
+}
+
+// fakeTerraform puts a terraform in PATH that records the environment and
+// arguments of each command to <command>.env and <command>.args of the
+// returned directory, and variable files to <command>.tfvars; the caller
+// restores PATH with the returned function
+func fakeTerraform(c *C) (string, func()) {
+	bin, rec := c.MkDir(), c.MkDir()
+	script := `#!/bin/sh
+if [ "$1" = version ]; then
+  echo '{"terraform_version":"1.5.7","platform":"linux_amd64","provider_selections":{}}'
+  exit 0
+fi
+env > "` + rec + `/$1.env"
+echo "$@" > "` + rec + `/$1.args"
+for a; do case "$a" in -var-file=*) cat "${a#-var-file=}" >> "` + rec + `/$1.tfvars";; esac; done
+`
+	c.Assert(os.WriteFile(filepath.Join(bin, "terraform"), []byte(script), 0755), IsNil)
+	pathEnv := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+pathEnv)
+	return rec, func() { os.Setenv("PATH", pathEnv) }
+}
+
+// recordedEnv returns the environment the fake terraform ran the command with
+func recordedEnv(c *C, rec string, command string) map[string]string {
+	b, err := os.ReadFile(filepath.Join(rec, command+".env"))
+	c.Assert(err, IsNil)
+	env := map[string]string{}
+	for _, l := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if k, v, ok := strings.Cut(l, "="); ok {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+func (s *MySuite) TestApplyEnv(c *C) {
+	rec, restore := fakeTerraform(c)
+	defer restore()
+	group := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(group, modulewriter.StateAccessFileName),
+		[]byte("impersonate_service_account: state@p.iam.gserviceaccount.com\n"), 0644), IsNil)
+	tf, err := ConfigureTerraform(group)
+	c.Assert(err, IsNil)
+
+	c.Assert(applyPlanConsoleOutput(context.Background(), tf, "plan.out"), IsNil)
+	env := recordedEnv(c, rec, "apply")
+	c.Check(env["GOOGLE_BACKEND_IMPERSONATE_SERVICE_ACCOUNT"], Equals, "state@p.iam.gserviceaccount.com")
+	c.Check(env["TF_IN_AUTOMATION"], Equals, "1")
+}
+
+func (s *MySuite) TestApplyTraceLog(c *C) {
+	rec, restore := fakeTerraform(c)
+	defer restore()
+	artifacts, group := c.MkDir(), filepath.Join(c.MkDir(), "primary")
+	c.Assert(os.Mkdir(group, 0755), IsNil)
+	c.Assert(EnableTerraformLogs(artifacts), IsNil)
+	defer func() { terraformLogDir = "" }()
+	tf, err := ConfigureTerraform(group)
+	c.Assert(err, IsNil)
+
+	c.Assert(applyPlanConsoleOutput(context.Background(), tf, "plan.out"), IsNil)
+	env := recordedEnv(c, rec, "apply")
+	c.Check(env["TF_LOG"], Equals, "TRACE")
+	c.Check(env["TF_LOG_PATH"], Equals, filepath.Join(artifacts, terraformLogsDirName, "primary.log"))
+}
@@ -0,0 +1,277 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/gcpauth"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/zclconf/go-cty/cty"
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// watchLeaseName is the name of the lease of `ghpc watch` next to terraform
+// state in the bucket of the gcs backend
+const watchLeaseName = "ghpc-watch.lease"
+
+// WatchLease is held by the `ghpc watch` process reconciling a deployment, so
+// that watchers started on several hosts do not apply changes concurrently
+type WatchLease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// leaseStore keeps the lease, writes are conditioned on the version of the
+// lease read before, so that only one of concurrent writers succeeds
+type leaseStore interface {
+	// read returns the lease and its version, found is false if there is none
+	read(ctx context.Context) (l WatchLease, version int64, found bool, err error)
+	// write replaces the lease of the version, 0 if there is none, ok is false
+	// if the lease was written by another holder meanwhile
+	write(ctx context.Context, l WatchLease, version int64) (newVersion int64, ok bool, err error)
+	remove(ctx context.Context, version int64) error
+	location() string
+}
+
+type localLeaseStore struct {
+	path string
+}
+
+func (s localLeaseStore) read(ctx context.Context) (WatchLease, int64, bool, error) {
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return WatchLease{}, 0, false, nil
+	}
+	if err != nil {
+		return WatchLease{}, 0, false, err
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return WatchLease{}, 0, false, err
+	}
+	var l WatchLease
+	if err := json.Unmarshal(b, &l); err != nil {
+		return WatchLease{}, 0, false, fmt.Errorf("failed to read lease %s: %w", s.path, err)
+	}
+	return l, info.ModTime().UnixNano(), true, nil
+}
+
+func (s localLeaseStore) write(ctx context.Context, l WatchLease, version int64) (int64, bool, error) {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return 0, false, err
+	}
+	if version == 0 {
+		f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		defer f.Close()
+		if _, err := f.Write(b); err != nil {
+			return 0, false, err
+		}
+	} else {
+		if _, v, found, err := s.read(ctx); err != nil || !found || v != version {
+			return 0, false, err
+		}
+		if err := os.WriteFile(s.path+".tmp", b, 0644); err != nil {
+			return 0, false, err
+		}
+		if err := os.Rename(s.path+".tmp", s.path); err != nil {
+			return 0, false, err
+		}
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return 0, false, err
+	}
+	return info.ModTime().UnixNano(), true, nil
+}
+
+func (s localLeaseStore) remove(ctx context.Context, version int64) error {
+	if _, v, found, err := s.read(ctx); err != nil || !found || v != version {
+		return err
+	}
+	return removeIfExists(s.path)
+}
+
+func (s localLeaseStore) location() string {
+	return s.path
+}
+
+type gcsLeaseStore struct {
+	bucket string
+	object string
+}
+
+func (s gcsLeaseStore) service(ctx context.Context) (*storage.Service, error) {
+	svc, err := storage.NewService(ctx, gcpauth.ClientOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access lease %s: %w", s.location(), err)
+	}
+	return svc, nil
+}
+
+func isHTTPStatus(err error, code int) bool {
+	var herr *googleapi.Error
+	return errors.As(err, &herr) && herr.Code == code
+}
+
+func (s gcsLeaseStore) read(ctx context.Context) (WatchLease, int64, bool, error) {
+	svc, err := s.service(ctx)
+	if err != nil {
+		return WatchLease{}, 0, false, err
+	}
+	resp, err := svc.Objects.Get(s.bucket, s.object).Context(ctx).Download()
+	if isHTTPStatus(err, http.StatusNotFound) {
+		return WatchLease{}, 0, false, nil
+	}
+	if err != nil {
+		return WatchLease{}, 0, false, fmt.Errorf("failed to read lease %s: %w", s.location(), err)
+	}
+	defer resp.Body.Close()
+	var l WatchLease
+	if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+		return WatchLease{}, 0, false, fmt.Errorf("failed to read lease %s: %w", s.location(), err)
+	}
+	var gen int64
+	fmt.Sscan(resp.Header.Get("X-Goog-Generation"), &gen)
+	return l, gen, true, nil
+}
+
+func (s gcsLeaseStore) write(ctx context.Context, l WatchLease, version int64) (int64, bool, error) {
+	svc, err := s.service(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return 0, false, err
+	}
+	obj, err := svc.Objects.Insert(s.bucket, &storage.Object{Name: s.object}).
+		IfGenerationMatch(version).Media(bytes.NewReader(b)).Context(ctx).Do()
+	if isHTTPStatus(err, http.StatusPreconditionFailed) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to write lease %s: %w", s.location(), err)
+	}
+	return obj.Generation, true, nil
+}
+
+func (s gcsLeaseStore) remove(ctx context.Context, version int64) error {
+	svc, err := s.service(ctx)
+	if err != nil {
+		return err
+	}
+	err = svc.Objects.Delete(s.bucket, s.object).IfGenerationMatch(version).Context(ctx).Do()
+	if isHTTPStatus(err, http.StatusPreconditionFailed) || isHTTPStatus(err, http.StatusNotFound) {
+		return nil // taken over by another watcher
+	}
+	return err
+}
+
+func (s gcsLeaseStore) location() string {
+	return fmt.Sprintf("gs://%s/%s", s.bucket, s.object)
+}
+
+// WatchLock elects the single `ghpc watch` process reconciling a deployment.
+// The lease is kept next to terraform state in the bucket of the gcs backend
+// of the blueprint, so watchers on different hosts see it, or in a local file
+// of the output directory for other backends.
+type WatchLock struct {
+	store   leaseStore
+	holder  string
+	ttl     time.Duration
+	version int64 // of the lease held, 0 if not held
+}
+
+// NewWatchLock returns the lock of the deployment of the expanded blueprint,
+// to be created in outputDir, for the holder. Leases last ttl unless renewed.
+func NewWatchLock(bp config.Blueprint, outputDir string, holder string, ttl time.Duration) (*WatchLock, error) {
+	var store leaseStore = localLeaseStore{
+		path: filepath.Join(outputDir, fmt.Sprintf(".%s.%s", bp.DeploymentName(), watchLeaseName))}
+	if be := bp.TerraformBackendDefaults; be.Type == "gcs" && be.Configuration.Has("bucket") {
+		bucket, err := bp.Eval(be.Configuration.Get("bucket"))
+		if err != nil {
+			return nil, err
+		}
+		if bucket.Type() != cty.String || bucket.IsNull() {
+			return nil, errors.New("bucket of the gcs terraform backend must be a string")
+		}
+		store = gcsLeaseStore{
+			bucket: bucket.AsString(),
+			object: fmt.Sprintf("%s/%s/%s", bp.BlueprintName, bp.DeploymentName(), watchLeaseName)}
+	}
+	return &WatchLock{store: store, holder: holder, ttl: ttl}, nil
+}
+
+// Location describes where the lease is kept, for messages
+func (l *WatchLock) Location() string {
+	return l.store.location()
+}
+
+// Acquire takes the lease, or renews it if already held. If another holder
+// has a lease that has not expired, it returns false and that lease.
+func (l *WatchLock) Acquire(ctx context.Context) (bool, WatchLease, error) {
+	cur, version, found, err := l.store.read(ctx)
+	if err != nil {
+		return false, WatchLease{}, err
+	}
+	if found && cur.Holder != l.holder && time.Now().Before(cur.Expires) {
+		l.version = 0
+		return false, cur, nil
+	}
+	if !found {
+		version = 0
+	}
+	lease := WatchLease{Holder: l.holder, Expires: time.Now().Add(l.ttl)}
+	v, ok, err := l.store.write(ctx, lease, version)
+	if err != nil {
+		return false, WatchLease{}, err
+	}
+	if !ok { // another watcher was faster
+		l.version = 0
+		cur, _, _, err := l.store.read(ctx)
+		return false, cur, err
+	}
+	l.version = v
+	return true, lease, nil
+}
+
+// Release gives up the lease, if held
+func (l *WatchLock) Release(ctx context.Context) error {
+	if l.version == 0 {
+		return nil
+	}
+	err := l.store.remove(ctx, l.version)
+	l.version = 0
+	return err
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shell
+
+import (
+	"context"
+	"encoding/json"
+	"hpc-toolkit/pkg/config"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestNewWatchLock(c *C) {
+	bp := config.Blueprint{
+		BlueprintName: "bp",
+		Vars:          config.NewDict(map[string]cty.Value{"deployment_name": cty.StringVal("dep")}),
+	}
+	l, err := NewWatchLock(bp, "out", "me", time.Minute)
+	c.Assert(err, IsNil)
+	c.Check(l.Location(), Equals, filepath.Join("out", ".dep.ghpc-watch.lease"))
+
+	bp.TerraformBackendDefaults = config.TerraformBackend{Type: "gcs", Configuration: config.NewDict(map[string]cty.Value{
+		"bucket": cty.StringVal("state")})}
+	l, err = NewWatchLock(bp, "out", "me", time.Minute)
+	c.Assert(err, IsNil)
+	c.Check(l.Location(), Equals, "gs://state/bp/dep/ghpc-watch.lease")
+}
+
+func (s *MySuite) TestWatchLock(c *C) {
+	ctx := context.Background()
+	store := localLeaseStore{path: filepath.Join(c.MkDir(), "lease")}
+	a := &WatchLock{store: store, holder: "a", ttl: time.Hour}
+	b := &WatchLock{store: store, holder: "b", ttl: time.Hour}
+
+	ok, _, err := a.Acquire(ctx)
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, true)
+
+	ok, held, err := b.Acquire(ctx)
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, false)
+	c.Check(held.Holder, Equals, "a")
+
+	// renewed by its holder
+	ok, _, err = a.Acquire(ctx)
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, true)
+
+	c.Assert(a.Release(ctx), IsNil)
+	_, err = os.Stat(store.path)
+	c.Check(os.IsNotExist(err), Equals, true)
+	ok, _, err = b.Acquire(ctx)
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, true)
+
+	// expired leases are taken over, the former holder does not remove them
+	expired, _ := json.Marshal(WatchLease{Holder: "b", Expires: time.Now().Add(-time.Minute)})
+	c.Assert(os.WriteFile(store.path, expired, 0644), IsNil)
+	ok, _, err = a.Acquire(ctx)
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, true)
+	c.Assert(b.Release(ctx), IsNil)
+	ok, held, err = b.Acquire(ctx)
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, false)
+	c.Check(held.Holder, Equals, "a")
+}
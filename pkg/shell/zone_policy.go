@@ -0,0 +1,289 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/gcpauth"
+	"hpc-toolkit/pkg/logging"
+	"hpc-toolkit/pkg/modulewriter"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"gopkg.in/yaml.v3"
+)
+
+// ZoneSelectionName is the name of the file in the artifacts directory
+// recording zones picked by zone policies, they are kept by later deployments
+const ZoneSelectionName = "zone_selection.yaml"
+
+// zoneOffer is what a zone offers to VMs of a zone policy
+type zoneOffer struct {
+	Status string // of the zone, UP or DOWN, empty if it does not exist
+	// MachineType is the machine type of the policy in the zone, nil if it is
+	// not offered
+	MachineType *compute.MachineType
+	Accelerator bool // whether the accelerator type of the policy is offered
+	// Quotas of the region of the zone
+	Quotas []*compute.Quota
+}
+
+// lookupZoneOffer queries the Compute Engine API for what the zone offers to
+// VMs of the policy, it is replaced in tests
+var lookupZoneOffer = func(ctx context.Context, project string, zone string, zp config.ZonePolicy) (zoneOffer, error) {
+	s, err := compute.NewService(ctx, gcpauth.ClientOptions()...)
+	if err != nil {
+		return zoneOffer{}, err
+	}
+	res := zoneOffer{}
+	z, err := s.Zones.Get(project, zone).Context(ctx).Do()
+	if isNotFound(err) {
+		return res, nil
+	}
+	if err != nil {
+		return zoneOffer{}, err
+	}
+	res.Status = z.Status
+
+	if zp.MachineType != "" {
+		mt, err := s.MachineTypes.Get(project, zone, zp.MachineType).Context(ctx).Do()
+		if err != nil && !isNotFound(err) {
+			return zoneOffer{}, err
+		}
+		res.MachineType = mt
+	}
+	if zp.AcceleratorType != "" {
+		_, err := s.AcceleratorTypes.Get(project, zone, zp.AcceleratorType).Context(ctx).Do()
+		if err != nil && !isNotFound(err) {
+			return zoneOffer{}, err
+		}
+		res.Accelerator = err == nil
+	}
+	if zp.Count > 0 {
+		r, err := s.Regions.Get(project, config.ZoneRegion(zone)).Context(ctx).Do()
+		if err != nil {
+			return zoneOffer{}, err
+		}
+		res.Quotas = r.Quotas
+	}
+	return res, nil
+}
+
+func isNotFound(err error) bool {
+	var herr *googleapi.Error
+	return errors.As(err, &herr) && herr.Code == http.StatusNotFound
+}
+
+// cpuQuotaMetric returns the regional quota of CPUs of the machine type,
+// older families share the CPUS quota, newer ones have a quota of their own
+func cpuQuotaMetric(machineType string) string {
+	family, _, _ := strings.Cut(machineType, "-")
+	switch family {
+	case "n1", "e2", "f1", "g1":
+		return "CPUS"
+	}
+	return strings.ToUpper(family) + "_CPUS"
+}
+
+// gpuQuotaMetric returns the regional quota of GPUs of the accelerator type,
+// e.g. NVIDIA_A100_GPUS for nvidia-tesla-a100
+func gpuQuotaMetric(acceleratorType string) string {
+	t := strings.TrimPrefix(acceleratorType, "nvidia-tesla-")
+	t = strings.TrimPrefix(t, "nvidia-")
+	return "NVIDIA_" + strings.ToUpper(strings.ReplaceAll(t, "-", "_")) + "_GPUS"
+}
+
+// unavailable tells why VMs of the policy can not be created in the zone, it
+// returns an empty string if they can. Quotas not found in the region are not
+// checked, as their names are derived from machine and accelerator types.
+func (o zoneOffer) unavailable(zp config.ZonePolicy) string {
+	switch {
+	case o.Status == "":
+		return "zone does not exist"
+	case o.Status != "UP":
+		return fmt.Sprintf("zone is %s", o.Status)
+	case zp.MachineType != "" && o.MachineType == nil:
+		return fmt.Sprintf("machine type %s is not offered", zp.MachineType)
+	case zp.AcceleratorType != "" && !o.Accelerator:
+		return fmt.Sprintf("accelerator type %s is not offered", zp.AcceleratorType)
+	}
+	if zp.Count == 0 || o.MachineType == nil {
+		return ""
+	}
+	return o.quotaShortage(o.requiredQuotas(zp))
+}
+
+// requiredQuotas returns quotas needed by VMs of the policy, by metric.
+// Accelerators built into the machine type, e.g. of a2 machine types, are
+// those of accelerator_type, they are not attached on top of them.
+func (o zoneOffer) requiredQuotas(zp config.ZonePolicy) map[string]float64 {
+	required := map[string]float64{
+		cpuQuotaMetric(zp.MachineType): float64(int64(zp.Count) * o.MachineType.GuestCpus),
+	}
+	for _, a := range o.MachineType.Accelerators {
+		required[gpuQuotaMetric(a.GuestAcceleratorType)] += float64(int64(zp.Count) * a.GuestAcceleratorCount)
+	}
+	if zp.AcceleratorType != "" && len(o.MachineType.Accelerators) == 0 {
+		required[gpuQuotaMetric(zp.AcceleratorType)] += float64(zp.Count * zp.AcceleratorCount)
+	}
+	return required
+}
+
+// quotaShortage tells which quota of the region is short of the required
+// amount, it returns an empty string if none is
+func (o zoneOffer) quotaShortage(required map[string]float64) string {
+	metrics := maps.Keys(required)
+	slices.Sort(metrics)
+	for _, m := range metrics {
+		i := slices.IndexFunc(o.Quotas, func(q *compute.Quota) bool { return q.Metric == m })
+		if i < 0 || required[m] == 0 {
+			continue
+		}
+		if q := o.Quotas[i]; q.Usage+required[m] > q.Limit {
+			return fmt.Sprintf("not enough quota %s in region, limit=%.0f < requested=%.0f + usage=%.0f", m, q.Limit, required[m], q.Usage)
+		}
+	}
+	return ""
+}
+
+// pickZone returns the first zone of the policy where its VMs can be created.
+// Compute Engine does not report capacity ahead of creating VMs, zones are
+// rather checked to be up, to offer the machine and accelerator types, and to
+// have quotas for them left in their region.
+func pickZone(ctx context.Context, project string, name string, zp config.ZonePolicy) (string, error) {
+	reasons := []string{}
+	for _, z := range zp.Zones {
+		o, err := lookupZoneOffer(ctx, project, z, zp)
+		if err != nil {
+			return "", fmt.Errorf("failed to check zone %s of zone policy %q: %w", z, name, err)
+		}
+		why := o.unavailable(zp)
+		if why == "" {
+			logging.Info("Picked zone %s for deployment variable %q", z, name)
+			return z, nil
+		}
+		logging.Info("Skipping zone %s for deployment variable %q: %s", z, name, why)
+		reasons = append(reasons, fmt.Sprintf("%s: %s", z, why))
+	}
+	return "", config.HintError{
+		Hint: strings.Join(reasons, "; "),
+		Err:  fmt.Errorf("none of the zones of zone policy %q can be used", name)}
+}
+
+// ReadZoneSelection returns zones picked by earlier deployments, keyed by
+// deployment variable
+func ReadZoneSelection(artifactsDir string) (map[string]string, error) {
+	b, err := os.ReadFile(filepath.Join(artifactsDir, ZoneSelectionName))
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]string{}
+	if err := yaml.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// RemoveZoneSelection removes zones picked by zone policies once the
+// deployment is destroyed, so the next deployment picks them again
+func RemoveZoneSelection(artifactsDir string) error {
+	err := os.Remove(filepath.Join(artifactsDir, ZoneSelectionName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// selectZones returns zones of all zone policies of the blueprint. Zones
+// picked by earlier deployments are kept as long as they are listed by their
+// policy, as moving deployed resources to another zone replaces them.
+func selectZones(ctx context.Context, bp config.Blueprint, artifactsDir string) (map[string]string, error) {
+	sel, err := ReadZoneSelection(artifactsDir)
+	if err != nil {
+		return nil, err
+	}
+	names := maps.Keys(bp.ZonePolicy)
+	slices.Sort(names)
+	changed := false
+	for _, n := range names {
+		zp := bp.ZonePolicy[n]
+		if slices.Contains(zp.Zones, sel[n]) {
+			continue
+		}
+		project, err := bp.ProjectID()
+		if err != nil {
+			return nil, err
+		}
+		if sel[n], err = pickZone(ctx, project, n, zp); err != nil {
+			return nil, err
+		}
+		changed = true
+	}
+	for n := range sel {
+		if _, ok := bp.ZonePolicy[n]; !ok {
+			delete(sel, n)
+			changed = true
+		}
+	}
+	if !changed {
+		return sel, nil
+	}
+	b, err := yaml.Marshal(sel)
+	if err != nil {
+		return nil, err
+	}
+	return sel, os.WriteFile(filepath.Join(artifactsDir, ZoneSelectionName), b, 0644)
+}
+
+// importZoneSelection writes zones picked by zone policies, and their regions,
+// used by the terraform stage to a file of the deployment group read by
+// terraform after terraform.tfvars
+func importZoneSelection(ctx context.Context, deploymentGroupDir string, artifactsDir string, bp config.Blueprint, g config.DeploymentGroup) error {
+	used := bp.ZonePolicyVarsOf(g)
+	if len(used) == 0 {
+		return nil
+	}
+	sel, err := selectZones(ctx, bp, artifactsDir)
+	if err != nil {
+		return err
+	}
+	vals := map[string]cty.Value{}
+	for n, z := range sel {
+		if slices.Contains(used, n) {
+			vals[n] = cty.StringVal(z)
+		}
+		if rv := bp.ZonePolicy[n].RegionVar; slices.Contains(used, rv) {
+			vals[rv] = cty.StringVal(config.ZoneRegion(z))
+		}
+	}
+	outPath := filepath.Join(deploymentGroupDir, fmt.Sprintf("%s_zone_policy.auto.tfvars", g.Name))
+	logging.Info("Writing zones picked by zone policies for deployment group %s to file %s", g.Name, outPath)
+	return modulewriter.WriteHclAttributes(vals, outPath)
+}
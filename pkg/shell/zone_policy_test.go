@@ -0,0 +1,127 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shell
+
+import (
+	"context"
+	"hpc-toolkit/pkg/config"
+	"os"
+	"path/filepath"
+
+	"github.com/zclconf/go-cty/cty"
+	compute "google.golang.org/api/compute/v1"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestQuotaMetrics(c *C) {
+	c.Check(cpuQuotaMetric("n1-standard-8"), Equals, "CPUS")
+	c.Check(cpuQuotaMetric("a2-highgpu-1g"), Equals, "A2_CPUS")
+	c.Check(gpuQuotaMetric("nvidia-tesla-a100"), Equals, "NVIDIA_A100_GPUS")
+	c.Check(gpuQuotaMetric("nvidia-a100-80gb"), Equals, "NVIDIA_A100_80GB_GPUS")
+	c.Check(gpuQuotaMetric("nvidia-l4"), Equals, "NVIDIA_L4_GPUS")
+}
+
+func (s *MySuite) TestZoneOfferUnavailable(c *C) {
+	zp := config.ZonePolicy{Zones: []string{"us-central1-a"}, MachineType: "a2-highgpu-2g", Count: 3}
+	a2 := &compute.MachineType{GuestCpus: 24, Accelerators: []*compute.MachineTypeAccelerators{
+		{GuestAcceleratorType: "nvidia-tesla-a100", GuestAcceleratorCount: 2}}}
+	quotas := []*compute.Quota{
+		{Metric: "A2_CPUS", Limit: 96, Usage: 12},
+		{Metric: "NVIDIA_A100_GPUS", Limit: 8, Usage: 4},
+	}
+
+	c.Check(zoneOffer{}.unavailable(zp), Equals, "zone does not exist")
+	c.Check(zoneOffer{Status: "DOWN"}.unavailable(zp), Equals, "zone is DOWN")
+	c.Check(zoneOffer{Status: "UP"}.unavailable(zp), Equals, "machine type a2-highgpu-2g is not offered")
+	c.Check(zoneOffer{Status: "UP", MachineType: a2}.unavailable(zp), Equals, "") // quotas not found
+	c.Check(zoneOffer{Status: "UP", MachineType: a2, Quotas: quotas}.unavailable(zp),
+		Equals, "not enough quota NVIDIA_A100_GPUS in region, limit=8 < requested=6 + usage=4")
+
+	quotas[1].Usage = 0
+	c.Check(zoneOffer{Status: "UP", MachineType: a2, Quotas: quotas}.unavailable(zp), Equals, "")
+
+	// accelerators built into the machine type are not counted twice
+	zp.AcceleratorType, zp.AcceleratorCount = "nvidia-tesla-a100", 2
+	c.Check(zoneOffer{Status: "UP", MachineType: a2, Accelerator: true, Quotas: quotas}.unavailable(zp), Equals, "")
+
+	zp.AcceleratorType = "nvidia-l4"
+	c.Check(zoneOffer{Status: "UP", MachineType: a2, Quotas: quotas}.unavailable(zp), Equals, "accelerator type nvidia-l4 is not offered")
+
+	n1 := &compute.MachineType{GuestCpus: 8}
+	zp = config.ZonePolicy{MachineType: "n1-standard-8", AcceleratorType: "nvidia-tesla-t4", AcceleratorCount: 2, Count: 3}
+	c.Check(zoneOffer{Status: "UP", MachineType: n1, Accelerator: true,
+		Quotas: []*compute.Quota{{Metric: "NVIDIA_T4_GPUS", Limit: 4}}}.unavailable(zp),
+		Equals, "not enough quota NVIDIA_T4_GPUS in region, limit=4 < requested=6 + usage=0")
+}
+
+func (s *MySuite) TestImportZoneSelection(c *C) {
+	defer func(f func(context.Context, string, string, config.ZonePolicy) (zoneOffer, error)) {
+		lookupZoneOffer = f
+	}(lookupZoneOffer)
+	looked := []string{}
+	lookupZoneOffer = func(_ context.Context, _ string, zone string, _ config.ZonePolicy) (zoneOffer, error) {
+		looked = append(looked, zone)
+		if zone == "us-east4-b" {
+			return zoneOffer{Status: "DOWN"}, nil
+		}
+		return zoneOffer{Status: "UP"}, nil
+	}
+
+	bp := config.Blueprint{
+		Vars: config.NewDict(map[string]cty.Value{"project_id": cty.StringVal("p")}),
+		ZonePolicy: map[string]config.ZonePolicy{
+			"zone": {Zones: []string{"us-east4-b", "us-central1-a"}, RegionVar: "region"}}}
+	g := config.DeploymentGroup{Name: "primary", Modules: []config.Module{{ID: "vm", Settings: config.NewDict(map[string]cty.Value{
+		"region": config.GlobalRef("region").AsValue(),
+		"zone":   config.GlobalRef("zone").AsValue()})}}}
+	artifacts := c.MkDir()
+
+	{ // group not using zone policies
+		dir := c.MkDir()
+		c.Check(importZoneSelection(context.Background(), dir, artifacts, bp, config.DeploymentGroup{Name: "primary"}), IsNil)
+		_, err := os.Stat(filepath.Join(dir, "primary_zone_policy.auto.tfvars"))
+		c.Check(os.IsNotExist(err), Equals, true)
+		c.Check(looked, HasLen, 0)
+	}
+
+	{ // first zone up is picked and recorded
+		dir := c.MkDir()
+		c.Assert(importZoneSelection(context.Background(), dir, artifacts, bp, g), IsNil)
+		b, err := os.ReadFile(filepath.Join(dir, "primary_zone_policy.auto.tfvars"))
+		c.Assert(err, IsNil)
+		c.Check(string(b), Matches, `(?s).*zone += "us-central1-a".*`)
+		c.Check(string(b), Matches, `(?s).*region += "us-central1".*`)
+		c.Check(looked, DeepEquals, []string{"us-east4-b", "us-central1-a"})
+
+		sel, err := ReadZoneSelection(artifacts)
+		c.Assert(err, IsNil)
+		c.Check(sel, DeepEquals, map[string]string{"zone": "us-central1-a"})
+	}
+
+	{ // recorded zone is kept
+		looked = nil
+		c.Assert(importZoneSelection(context.Background(), c.MkDir(), artifacts, bp, g), IsNil)
+		c.Check(looked, HasLen, 0)
+	}
+
+	{ // no zone can be used
+		c.Assert(RemoveZoneSelection(artifacts), IsNil)
+		bp.ZonePolicy["zone"] = config.ZonePolicy{Zones: []string{"us-east4-b"}}
+		err := importZoneSelection(context.Background(), c.MkDir(), artifacts, bp, g)
+		c.Check(err, ErrorMatches, `none of the zones of zone policy "zone" can be used - us-east4-b: zone is DOWN`)
+	}
+}
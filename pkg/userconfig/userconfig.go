@@ -0,0 +1,156 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package userconfig reads defaults for command line flags and deployment
+// settings from a per-user config file
+package userconfig
+
+import (
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/expandhooks"
+	"hpc-toolkit/pkg/notifications"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigEnvVar is the environment variable overriding location of the config file
+const ConfigEnvVar = "GHPC_CONFIG"
+
+// flags that can not be given defaults, as their values are merged with
+// deployment files, use `vars` and `terraform_backend_defaults` instead
+var reservedFlags = []string{"vars", "var", "var-json", "backend-config", "deployment-file"}
+
+// Config holds defaults of the user. Flags maps names of command line flags
+// to their default values, lists are given for flags that can be repeated.
+// Vars and backend defaults take precedence over the blueprint, but not over
+// deployment files and command line flags. Credentials replace those of the
+// blueprint when set. ExpandHooks transform every blueprint once expanded.
+// Notifications are sent to the endpoints of the user, if any.
+type Config struct {
+	Flags         map[string]interface{} `yaml:"flags,omitempty"`
+	Credentials   []config.Credentials   `yaml:"credentials,omitempty"`
+	ExpandHooks   []expandhooks.Exec     `yaml:"expand_hooks,omitempty"`
+	Notifications notifications.Config   `yaml:"notifications,omitempty"`
+
+	config.DeploymentSettings `yaml:",inline"`
+}
+
+// Validate ensures that flag defaults are scalars or lists of scalars and
+// do not set reserved flags, and that credentials, expand hooks and
+// notifications are complete
+func (c Config) Validate() error {
+	names := maps.Keys(c.Flags)
+	slices.Sort(names)
+	for _, n := range names {
+		if slices.Contains(reservedFlags, n) {
+			return fmt.Errorf("flag %q can not be given a default, use \"vars\" or \"terraform_backend_defaults\" instead", n)
+		}
+		if _, err := c.FlagValues(n); err != nil {
+			return err
+		}
+	}
+	seen := map[string]bool{}
+	for _, h := range c.ExpandHooks {
+		if err := h.Validate(); err != nil {
+			return err
+		}
+		if seen[h.Name] {
+			return fmt.Errorf("expand hook %s is given more than once", h.Name)
+		}
+		seen[h.Name] = true
+	}
+	if err := c.Notifications.Validate(); err != nil {
+		return fmt.Errorf("notifications: %w", err)
+	}
+	return config.ValidateCredentials(c.Credentials)
+}
+
+// FlagValues returns the default of the flag as a list of strings, a flag
+// that can be repeated is set once per value. Paths starting with "~/" are
+// expanded to the home directory of the user.
+func (c Config) FlagValues(name string) ([]string, error) {
+	v, ok := c.Flags[name]
+	if !ok {
+		return nil, nil
+	}
+	items, isList := v.([]interface{})
+	if !isList {
+		items = []interface{}{v}
+	}
+	res := []string{}
+	for _, i := range items {
+		switch i.(type) {
+		case string, bool, int, float64:
+			res = append(res, expandHome(fmt.Sprint(i)))
+		default:
+			return nil, fmt.Errorf("default of flag %q must be a scalar or a list of scalars", name)
+		}
+	}
+	return res, nil
+}
+
+func expandHome(s string) string {
+	rest, found := strings.CutPrefix(s, "~/")
+	if !found {
+		return s
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return s
+	}
+	return filepath.Join(home, rest)
+}
+
+// ConfigPath returns location of the config file, no defaults are applied
+// unless it exists
+func ConfigPath() string {
+	if p := os.Getenv(ConfigEnvVar); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "ghpc", "config.yaml")
+}
+
+// LoadConfig reads the config file, it returns an empty config if the file
+// does not exist
+func LoadConfig(path string) (Config, error) {
+	if path == "" {
+		return Config{}, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Config{}, nil
+	}
+	if err != nil {
+		return Config{}, err
+	}
+	var c Config
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return Config{}, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if err := c.Validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return c, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package userconfig
+
+import (
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/expandhooks"
+	"hpc-toolkit/pkg/notifications"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *MySuite) TestLoadConfig(c *C) {
+	dir := c.MkDir()
+
+	{ // absent config applies no defaults
+		cfg, err := LoadConfig(filepath.Join(dir, "absent.yaml"))
+		c.Check(err, IsNil)
+		c.Check(cfg.Flags, IsNil)
+		c.Check(cfg.Vars.Items(), DeepEquals, map[string]cty.Value{})
+	}
+
+	{ // Success
+		p := filepath.Join(dir, "ok.yaml")
+		c.Assert(os.WriteFile(p, []byte(`
+flags:
+  out: /deployments
+  validation-level: ERROR
+  skip-validators: [test_apis_enabled, test_region_exists]
+  auto-approve: true
+vars:
+  project_id: my-project
+terraform_backend_defaults:
+  type: gcs
+  configuration:
+    bucket: my-bucket
+`), 0644), IsNil)
+		cfg, err := LoadConfig(p)
+		c.Assert(err, IsNil)
+		c.Check(cfg.Vars.Items(), DeepEquals, map[string]cty.Value{"project_id": cty.StringVal("my-project")})
+		c.Check(cfg.TerraformBackendDefaults.Type, Equals, "gcs")
+		c.Check(cfg.TerraformBackendDefaults.Configuration.Get("bucket"), DeepEquals, cty.StringVal("my-bucket"))
+
+		for flag, want := range map[string][]string{
+			"out":              {"/deployments"},
+			"validation-level": {"ERROR"},
+			"skip-validators":  {"test_apis_enabled", "test_region_exists"},
+			"auto-approve":     {"true"},
+			"absent":           nil,
+		} {
+			got, err := cfg.FlagValues(flag)
+			c.Check(err, IsNil)
+			c.Check(got, DeepEquals, want, Commentf("flag %q", flag))
+		}
+	}
+
+	{ // Fail: reserved flag
+		p := filepath.Join(dir, "reserved.yaml")
+		c.Assert(os.WriteFile(p, []byte("flags: {vars: [project_id=p]}"), 0644), IsNil)
+		_, err := LoadConfig(p)
+		c.Check(err, ErrorMatches, `.*flag "vars" can not be given a default.*`)
+	}
+
+	{ // Credentials
+		p := filepath.Join(dir, "credentials.yaml")
+		c.Assert(os.WriteFile(p, []byte(`
+credentials:
+- provider: aws
+  token_env: CI_OIDC_TOKEN
+  role_arn: arn:aws:iam::123:role/ci
+`), 0644), IsNil)
+		cfg, err := LoadConfig(p)
+		c.Assert(err, IsNil)
+		c.Check(cfg.Credentials, DeepEquals, []config.Credentials{{Provider: "aws", TokenEnv: "CI_OIDC_TOKEN", RoleArn: "arn:aws:iam::123:role/ci"}})
+	}
+
+	{ // Fail: incomplete credentials
+		p := filepath.Join(dir, "bad-credentials.yaml")
+		c.Assert(os.WriteFile(p, []byte("credentials: [{provider: gcp, token_env: CI_OIDC_TOKEN}]"), 0644), IsNil)
+		_, err := LoadConfig(p)
+		c.Check(err, ErrorMatches, `.*credentials\[0\].audience: audience must be in form.*`)
+	}
+
+	{ // Expand hooks
+		p := filepath.Join(dir, "hooks.yaml")
+		c.Assert(os.WriteFile(p, []byte("expand_hooks: [{name: audit, command: [/opt/audit, -v]}]"), 0644), IsNil)
+		cfg, err := LoadConfig(p)
+		c.Assert(err, IsNil)
+		c.Check(cfg.ExpandHooks, DeepEquals, []expandhooks.Exec{{Name: "audit", Command: []string{"/opt/audit", "-v"}}})
+	}
+
+	{ // Fail: expand hook without command, duplicate hook
+		p := filepath.Join(dir, "bad-hooks.yaml")
+		c.Assert(os.WriteFile(p, []byte("expand_hooks: [{name: audit}]"), 0644), IsNil)
+		_, err := LoadConfig(p)
+		c.Check(err, ErrorMatches, `.*expand hook audit must have a command`)
+
+		c.Assert(os.WriteFile(p, []byte("expand_hooks: [{name: audit, command: [a]}, {name: audit, command: [b]}]"), 0644), IsNil)
+		_, err = LoadConfig(p)
+		c.Check(err, ErrorMatches, `.*expand hook audit is given more than once`)
+	}
+
+	{ // Notifications
+		p := filepath.Join(dir, "notifications.yaml")
+		c.Assert(os.WriteFile(p, []byte(`
+notifications:
+  webhooks:
+  - url: https://hooks.example.com/ghpc
+    headers: {Authorization: Bearer token}
+  pubsub_topics: [projects/platform/topics/clusters]
+  events: [deployment_created, destroy_completed]
+`), 0644), IsNil)
+		cfg, err := LoadConfig(p)
+		c.Assert(err, IsNil)
+		c.Check(cfg.Notifications, DeepEquals, notifications.Config{
+			Webhooks:     []notifications.Webhook{{URL: "https://hooks.example.com/ghpc", Headers: map[string]string{"Authorization": "Bearer token"}}},
+			PubSubTopics: []string{"projects/platform/topics/clusters"},
+			Events:       []string{notifications.DeploymentCreated, notifications.DestroyCompleted}})
+	}
+
+	{ // Fail: unknown event
+		p := filepath.Join(dir, "bad-notifications.yaml")
+		c.Assert(os.WriteFile(p, []byte("notifications: {events: [cluster_exploded]}"), 0644), IsNil)
+		_, err := LoadConfig(p)
+		c.Check(err, ErrorMatches, `.*notifications: unknown event type "cluster_exploded".*`)
+	}
+
+	{ // Fail: nested default
+		p := filepath.Join(dir, "nested.yaml")
+		c.Assert(os.WriteFile(p, []byte("flags: {out: {dir: /deployments}}"), 0644), IsNil)
+		_, err := LoadConfig(p)
+		c.Check(err, ErrorMatches, `.*default of flag "out" must be a scalar or a list of scalars`)
+	}
+}
+
+func (s *MySuite) TestExpandHome(c *C) {
+	home, err := os.UserHomeDir()
+	c.Assert(err, IsNil)
+	c.Check(expandHome("~/deployments"), Equals, filepath.Join(home, "deployments"))
+	c.Check(expandHome("/deployments"), Equals, "/deployments")
+	c.Check(expandHome("a~/b"), Equals, "a~/b")
+}
@@ -0,0 +1,213 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validators
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/gcpauth"
+	"hpc-toolkit/pkg/modulereader"
+	"hpc-toolkit/pkg/pricing"
+	"sort"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	ctyJson "github.com/zclconf/go-cty/cty/json"
+	budgets "google.golang.org/api/billingbudgets/v1"
+)
+
+// maxBudgetLines is the number of modules listed when the budget is exceeded,
+// the most expensive first
+const maxBudgetLines = 5
+
+// moduleCost is the estimated monthly cost of a module
+type moduleCost struct {
+	id      config.ModuleID
+	monthly float64
+}
+
+func testBudget(bp config.Blueprint, inputs config.Dict) error {
+	budget, err := monthlyBudget(inputs)
+	if err != nil {
+		return err
+	}
+	catalog, err := pricing.DefaultCatalog()
+	if err != nil {
+		return err
+	}
+
+	costs, total := []moduleCost{}, 0.0
+	bp.WalkModulesSafe(func(_ config.ModulePath, m *config.Module) {
+		if v, ok := moduleMonthly(bp, *m, catalog); ok && v > 0 {
+			costs = append(costs, moduleCost{m.ID, v})
+			total += v
+		}
+	})
+	if total <= budget {
+		return nil
+	}
+
+	sort.SliceStable(costs, func(i, j int) bool { return costs[i].monthly > costs[j].monthly })
+	lines := []string{}
+	for i, c := range costs {
+		if i == maxBudgetLines {
+			lines = append(lines, fmt.Sprintf("... and %d more", len(costs)-maxBudgetLines))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%s: %.2f USD", c.id, c.monthly))
+	}
+	return config.HintError{
+		Hint: "reduce machine types, node counts or disk sizes, or raise the budget; modules by estimated monthly cost: " + strings.Join(lines, ", "),
+		Err:  fmt.Errorf("estimated monthly cost of the deployment, %.2f USD at list prices, exceeds the budget of %.2f USD", total, budget)}
+}
+
+// monthlyBudget returns the budget given either as a number of USD,
+// `monthly_budget`, or as the name of a Cloud Billing budget, `budget`
+func monthlyBudget(inputs config.Dict) (float64, error) {
+	switch {
+	case inputs.Has("monthly_budget") && len(inputs.Items()) == 1:
+		v := inputs.Get("monthly_budget")
+		if v.Type() != cty.Number || v.IsNull() {
+			return 0, fmt.Errorf("validator input monthly_budget must be a number, got %s", v.Type().FriendlyName())
+		}
+		f, _ := v.AsBigFloat().Float64()
+		return f, nil
+	case inputs.Has("budget") && len(inputs.Items()) == 1:
+		m, err := inputsAsStrings(inputs)
+		if err != nil {
+			return 0, err
+		}
+		b, err := lookupBudget(m["budget"])
+		if err != nil {
+			return 0, handleClientError(err)
+		}
+		return budgetMonthly(m["budget"], b)
+	default:
+		return 0, errors.New("exactly one of inputs monthly_budget or budget (billingAccounts/ACCOUNT/budgets/ID) should be provided")
+	}
+}
+
+// budgetMonthly converts the amount of a Cloud Billing budget to a monthly one
+func budgetMonthly(name string, b *budgets.GoogleCloudBillingBudgetsV1Budget) (float64, error) {
+	if b.Amount == nil || b.Amount.SpecifiedAmount == nil {
+		return 0, fmt.Errorf("budget %s does not specify an amount, set validator input monthly_budget instead", name)
+	}
+	amount := b.Amount.SpecifiedAmount
+	if amount.CurrencyCode != "" && amount.CurrencyCode != "USD" {
+		return 0, fmt.Errorf("budget %s is in %s, only budgets in USD can be compared to list prices", name, amount.CurrencyCode)
+	}
+	v := float64(amount.Units) + float64(amount.Nanos)/1e9
+
+	period := "MONTH"
+	if b.BudgetFilter != nil {
+		if b.BudgetFilter.CustomPeriod != nil {
+			return 0, fmt.Errorf("budget %s tracks a custom period, set validator input monthly_budget instead", name)
+		}
+		if b.BudgetFilter.CalendarPeriod != "" {
+			period = b.BudgetFilter.CalendarPeriod
+		}
+	}
+	switch period {
+	case "MONTH":
+		return v, nil
+	case "QUARTER":
+		return v / 3, nil
+	case "YEAR":
+		return v / 12, nil
+	default:
+		return 0, fmt.Errorf("budget %s tracks unsupported period %s", name, period)
+	}
+}
+
+// lookupBudget reads a Cloud Billing budget, it is replaced in tests
+var lookupBudget = func(name string) (*budgets.GoogleCloudBillingBudgetsV1Budget, error) {
+	s, err := budgets.NewService(context.Background(), gcpauth.ClientOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	return s.BillingAccounts.Budgets.Get(name).Do()
+}
+
+// moduleMonthly estimates the monthly cost of VMs and Filestore instances
+// created by the terraform module, from its settings known before deployment
+// and defaults of its inputs. Modules the catalog can not price are left out.
+func moduleMonthly(bp config.Blueprint, m config.Module, c pricing.Catalog) (float64, bool) {
+	if m.Kind != config.TerraformKind { // Packer VMs only run while building images
+		return 0, false
+	}
+	vals := moduleValues(bp, m)
+	if _, ok := vals["machine_type"]; ok {
+		spot, _ := vals["spot"].(bool)
+		enableSpot, _ := vals["enable_spot_vm"].(bool)
+		sched := map[string]interface{}{}
+		if spot || enableSpot {
+			sched["provisioning_model"] = "SPOT"
+		}
+		vm, ok := c.Monthly("google_compute_instance", map[string]interface{}{
+			"machine_type":      vals["machine_type"],
+			"guest_accelerator": vals["guest_accelerator"],
+			"scheduling":        []interface{}{sched},
+			"boot_disk": []interface{}{map[string]interface{}{
+				"initialize_params": []interface{}{map[string]interface{}{
+					"type": vals["disk_type"],
+					"size": vals["disk_size_gb"],
+				}},
+			}},
+		})
+		nodes := requestedNodes(bp, m)
+		if nodes == 0 {
+			nodes = 1
+		}
+		return vm * float64(nodes), ok
+	}
+	if _, ok := vals["filestore_tier"]; ok {
+		return c.Monthly("google_filestore_instance", map[string]interface{}{
+			"tier":        vals["filestore_tier"],
+			"file_shares": []interface{}{map[string]interface{}{"capacity_gb": vals["size_gb"]}},
+		})
+	}
+	return 0, false
+}
+
+// moduleValues returns values of settings relevant to pricing, as decoded
+// from JSON, falling back to defaults of module inputs
+func moduleValues(bp config.Blueprint, m config.Module) map[string]interface{} {
+	res := map[string]interface{}{}
+	if mi, err := modulereader.GetModuleInfo(m.Source, m.Kind.String()); err == nil {
+		for _, i := range mi.Inputs {
+			if i.Default != nil {
+				res[i.Name] = i.Default
+			}
+		}
+	}
+	for name := range m.Settings.Items() {
+		v, ok := knownSetting(bp, m, name)
+		if !ok {
+			continue
+		}
+		b, err := ctyJson.Marshal(v, v.Type())
+		if err != nil {
+			continue
+		}
+		var i interface{}
+		if json.Unmarshal(b, &i) == nil {
+			res[name] = i
+		}
+	}
+	return res
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validators
+
+import (
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/modulereader"
+	"hpc-toolkit/pkg/pricing"
+
+	"github.com/zclconf/go-cty/cty"
+	budgets "google.golang.org/api/billingbudgets/v1"
+	. "gopkg.in/check.v1"
+)
+
+// setPricedModuleInfo sets info of modules used by budget tests, boot disks of
+// nodesets default to 50 GB
+func setPricedModuleInfo(c *C) {
+	ns := nodeset("", "", "", "", 0, 0)
+	for _, k := range []config.ModuleKind{config.TerraformKind, config.PackerKind} {
+		modulereader.SetModuleInfo(ns.Source, k.String(), modulereader.ModuleInfo{
+			Inputs: []modulereader.VarInfo{{Name: "disk_size_gb", Default: float64(50)}}})
+	}
+	modulereader.SetModuleInfo(c.TestName(), config.TerraformKind.String(), modulereader.ModuleInfo{})
+}
+
+func (s *MySuite) TestModuleMonthly(c *C) {
+	setPricedModuleInfo(c)
+	catalog, err := pricing.DefaultCatalog()
+	c.Assert(err, IsNil)
+	hourly, ok := catalog.MachineHourly("c2-standard-60")
+	c.Assert(ok, Equals, true)
+	bp := config.Blueprint{}
+
+	{ // static and dynamic nodes with boot disks
+		m := nodeset("a", "", "us-central1-a", "c2-standard-60", 2, 3)
+		m.Kind = config.TerraformKind
+		m.Settings.Set("disk_size_gb", cty.NumberIntVal(100))
+		m.Settings.Set("disk_type", cty.StringVal("pd-ssd"))
+		got, ok := moduleMonthly(bp, m, catalog)
+		c.Check(ok, Equals, true)
+		c.Check(got, Equals, 5*(hourly*pricing.HoursPerMonth+100*catalog.Disks["pd-ssd"]))
+	}
+
+	{ // spot VM, default boot disk size
+		m := nodeset("a", "", "us-central1-a", "c2-standard-60", 1, 0)
+		m.Kind = config.TerraformKind
+		m.Settings.Set("spot", cty.True)
+		got, _ := moduleMonthly(bp, m, catalog)
+		c.Check(got, Equals, hourly*catalog.SpotFactor*pricing.HoursPerMonth+50*catalog.Disks["pd-standard"])
+	}
+
+	{ // filestore
+		m := config.Module{ID: "fs", Source: c.TestName(), Kind: config.TerraformKind, Settings: config.NewDict(map[string]cty.Value{
+			"filestore_tier": cty.StringVal("BASIC_SSD"),
+			"size_gb":        cty.NumberIntVal(2560),
+		})}
+		got, ok := moduleMonthly(bp, m, catalog)
+		c.Check(ok, Equals, true)
+		c.Check(got, Equals, 2560*catalog.Filestore["BASIC_SSD"])
+	}
+
+	{ // Packer modules and modules without priced resources are left out
+		m := nodeset("a", "", "us-central1-a", "c2-standard-60", 1, 0)
+		m.Kind = config.PackerKind
+		_, ok := moduleMonthly(bp, m, catalog)
+		c.Check(ok, Equals, false)
+
+		_, ok = moduleMonthly(bp, config.Module{ID: "net", Source: c.TestName(), Kind: config.TerraformKind}, catalog)
+		c.Check(ok, Equals, false)
+	}
+}
+
+func (s *MySuite) TestTestBudget(c *C) {
+	setPricedModuleInfo(c)
+	defer func(f func(string) (*budgets.GoogleCloudBillingBudgetsV1Budget, error)) { lookupBudget = f }(lookupBudget)
+	lookupBudget = func(name string) (*budgets.GoogleCloudBillingBudgetsV1Budget, error) {
+		return &budgets.GoogleCloudBillingBudgetsV1Budget{
+			Amount:       &budgets.GoogleCloudBillingBudgetsV1BudgetAmount{SpecifiedAmount: &budgets.GoogleTypeMoney{CurrencyCode: "USD", Units: 300}},
+			BudgetFilter: &budgets.GoogleCloudBillingBudgetsV1Filter{CalendarPeriod: "QUARTER"},
+		}, nil
+	}
+	m := nodeset("a", "", "us-central1-a", "n2-standard-2", 2, 0)
+	m.Kind = config.TerraformKind
+	bp := config.Blueprint{DeploymentGroups: []config.DeploymentGroup{{Name: "primary", Modules: []config.Module{m}}}}
+	catalog, err := pricing.DefaultCatalog()
+	c.Assert(err, IsNil)
+	cost, _ := moduleMonthly(bp, m, catalog)
+
+	budget := func(v float64) config.Dict {
+		return config.NewDict(map[string]cty.Value{"monthly_budget": cty.NumberFloatVal(v)})
+	}
+	c.Check(testBudget(bp, budget(cost+1)), IsNil)
+	c.Check(testBudget(bp, budget(cost-1)), ErrorMatches, ".*exceeds the budget.*")
+
+	// a quarterly budget of 300 USD is 100 USD a month, less than two VMs cost
+	c.Assert(cost > 100, Equals, true)
+	named := config.NewDict(map[string]cty.Value{"budget": cty.StringVal("billingAccounts/b/budgets/q")})
+	c.Check(testBudget(bp, named), ErrorMatches, ".*exceeds the budget of 100.00 USD.*")
+
+	c.Check(testBudget(bp, config.Dict{}), NotNil)
+	c.Check(testBudget(bp, config.NewDict(map[string]cty.Value{"monthly_budget": cty.NumberIntVal(1), "budget": cty.StringVal("b")})), NotNil)
+	c.Check(testBudget(bp, config.NewDict(map[string]cty.Value{"monthly_budget": cty.StringVal("many")})), NotNil)
+}
+
+func (s *MySuite) TestBudgetMonthly(c *C) {
+	usd := func(units int64, period string) *budgets.GoogleCloudBillingBudgetsV1Budget {
+		return &budgets.GoogleCloudBillingBudgetsV1Budget{
+			Amount:       &budgets.GoogleCloudBillingBudgetsV1BudgetAmount{SpecifiedAmount: &budgets.GoogleTypeMoney{CurrencyCode: "USD", Units: units, Nanos: 500_000_000}},
+			BudgetFilter: &budgets.GoogleCloudBillingBudgetsV1Filter{CalendarPeriod: period},
+		}
+	}
+	for _, tc := range []struct {
+		period string
+		want   float64
+	}{{"", 1200.5}, {"MONTH", 1200.5}, {"QUARTER", 1200.5 / 3}, {"YEAR", 1200.5 / 12}} {
+		got, err := budgetMonthly("b", usd(1200, tc.period))
+		c.Check(err, IsNil)
+		c.Check(got, Equals, tc.want)
+	}
+
+	eur := usd(1, "")
+	eur.Amount.SpecifiedAmount.CurrencyCode = "EUR"
+	_, err := budgetMonthly("b", eur)
+	c.Check(err, ErrorMatches, ".*EUR.*")
+
+	_, err = budgetMonthly("b", &budgets.GoogleCloudBillingBudgetsV1Budget{
+		Amount: &budgets.GoogleCloudBillingBudgetsV1BudgetAmount{LastPeriodAmount: &budgets.GoogleCloudBillingBudgetsV1LastPeriodAmount{}}})
+	c.Check(err, NotNil)
+}
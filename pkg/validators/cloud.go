@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/gcpauth"
 	"strings"
 
 	"golang.org/x/exp/maps"
@@ -80,7 +81,7 @@ func TestApisEnabled(projectID string, requiredAPIs []string) error {
 
 	ctx := context.Background()
 
-	s, err := serviceusage.NewService(ctx, option.WithQuotaProject(projectID))
+	s, err := serviceusage.NewService(ctx, gcpauth.ClientOptions(option.WithQuotaProject(projectID))...)
 	if err != nil {
 		return handleClientError(err)
 	}
@@ -107,7 +108,7 @@ func TestApisEnabled(projectID string, requiredAPIs []string) error {
 // TestProjectExists whether projectID exists / is accessible with credentials
 func TestProjectExists(projectID string) error {
 	ctx := context.Background()
-	s, err := compute.NewService(ctx)
+	s, err := compute.NewService(ctx, gcpauth.ClientOptions()...)
 	if err != nil {
 		err = handleClientError(err)
 		return err
@@ -125,7 +126,7 @@ func TestProjectExists(projectID string) error {
 
 func getRegion(projectID string, region string) (*compute.Region, error) {
 	ctx := context.Background()
-	s, err := compute.NewService(ctx)
+	s, err := compute.NewService(ctx, gcpauth.ClientOptions()...)
 	if err != nil {
 		err = handleClientError(err)
 		return nil, err
@@ -144,7 +145,7 @@ func TestRegionExists(projectID string, region string) error {
 
 func getZone(projectID string, zone string) (*compute.Zone, error) {
 	ctx := context.Background()
-	s, err := compute.NewService(ctx)
+	s, err := compute.NewService(ctx, gcpauth.ClientOptions()...)
 	if err != nil {
 		err = handleClientError(err)
 		return nil, err
@@ -223,20 +224,28 @@ func testZoneExists(bp config.Blueprint, inputs config.Dict) error {
 	if err := checkInputs(inputs, []string{"project_id", "zone"}); err != nil {
 		return err
 	}
-	m, err := inputsAsStrings(inputs)
+	zones, m, err := zonesAndInputs(inputs)
 	if err != nil {
 		return err
 	}
-	return TestZoneExists(m["project_id"], m["zone"])
+	errs := config.Errors{}
+	for _, z := range zones {
+		errs.Add(TestZoneExists(m["project_id"], z))
+	}
+	return errs.OrNil()
 }
 
 func testZoneInRegion(bp config.Blueprint, inputs config.Dict) error {
 	if err := checkInputs(inputs, []string{"project_id", "region", "zone"}); err != nil {
 		return err
 	}
-	m, err := inputsAsStrings(inputs)
+	zones, m, err := zonesAndInputs(inputs)
 	if err != nil {
 		return err
 	}
-	return TestZoneInRegion(m["project_id"], m["zone"], m["region"])
+	errs := config.Errors{}
+	for _, z := range zones {
+		errs.Add(TestZoneInRegion(m["project_id"], z, m["region"]))
+	}
+	return errs.OrNil()
 }
@@ -0,0 +1,114 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validators
+
+import (
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
+)
+
+// customFunctions are the functions available to conditions of custom
+// validators, named as in terraform
+func customFunctions() map[string]function.Function {
+	return map[string]function.Function{
+		"coalesce":  stdlib.CoalesceFunc,
+		"concat":    stdlib.ConcatFunc,
+		"contains":  stdlib.ContainsFunc,
+		"distinct":  stdlib.DistinctFunc,
+		"flatten":   stdlib.FlattenFunc,
+		"join":      stdlib.JoinFunc,
+		"keys":      stdlib.KeysFunc,
+		"length":    stdlib.LengthFunc,
+		"lookup":    stdlib.LookupFunc,
+		"lower":     stdlib.LowerFunc,
+		"max":       stdlib.MaxFunc,
+		"merge":     stdlib.MergeFunc,
+		"min":       stdlib.MinFunc,
+		"regexall":  stdlib.RegexAllFunc,
+		"setunion":  stdlib.SetUnionFunc,
+		"split":     stdlib.SplitFunc,
+		"trimspace": stdlib.TrimSpaceFunc,
+		"upper":     stdlib.UpperFunc,
+		"values":    stdlib.ValuesFunc,
+	}
+}
+
+// customValidatorName is the name failures of the validator are reported by
+func customValidatorName(i int, v config.CustomValidator) string {
+	if v.Name != "" {
+		return v.Name
+	}
+	return fmt.Sprintf("custom_validators[%d]", i)
+}
+
+// testCustomValidator evaluates the condition of the validator in the context
+// of the blueprint. Conditions that depend on module outputs are unknown
+// until deployment and pass.
+func testCustomValidator(v config.CustomValidator, ctx *hcl.EvalContext) error {
+	e, err := v.ParseCondition()
+	if err != nil {
+		return err
+	}
+	res, diags := e.Value(ctx)
+	if diags.HasErrors() {
+		return diags
+	}
+	if !res.IsKnown() {
+		return nil
+	}
+	if res.IsNull() || res.Type() != cty.Bool {
+		return fmt.Errorf("condition must evaluate to a bool, got %s", res.Type().FriendlyName())
+	}
+	if res.False() {
+		return errors.New(v.Message)
+	}
+	return nil
+}
+
+// executeCustom runs custom validators of the blueprint, adding failures to
+// errs or warnings depending on their level
+func executeCustom(bp config.Blueprint, errs *config.Errors, warnings *config.Errors) {
+	if len(bp.CustomValidators) == 0 {
+		return
+	}
+	bv, err := bp.AsValue()
+	if err != nil {
+		errs.At(config.Root.CustomValidators, err)
+		return
+	}
+	ctx := hcl.EvalContext{
+		Variables: map[string]cty.Value{"blueprint": bv, "var": bv.GetAttr("vars")},
+		Functions: customFunctions(),
+	}
+	for i, v := range bp.CustomValidators {
+		level := v.ValidationLevel(bp.ValidationLevel)
+		if level == config.ValidationIgnore {
+			continue
+		}
+		failures := errs
+		if level == config.ValidationWarning {
+			failures = warnings
+		}
+		if err := testCustomValidator(v, &ctx); err != nil {
+			failures.At(config.Root.CustomValidators.At(i).Condition, ValidatorError{customValidatorName(i, v), err})
+		}
+	}
+}
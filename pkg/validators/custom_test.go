@@ -0,0 +1,81 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validators
+
+import (
+	"hpc-toolkit/pkg/config"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestExecuteCustom(c *C) {
+	bp := config.Blueprint{
+		BlueprintName: "pine",
+		Vars: config.NewDict(map[string]cty.Value{
+			"deployment_name": cty.StringVal("pine-dev"),
+			"region":          cty.StringVal("us-central1"),
+		}),
+		DeploymentGroups: []config.DeploymentGroup{{Name: "green", Modules: []config.Module{{
+			ID:     "vm",
+			Source: "modules/compute/vm-instance",
+			Kind:   config.TerraformKind,
+			Settings: config.NewDict(map[string]cty.Value{
+				"machine_type": cty.StringVal("n2-standard-4"),
+				"network":      config.ModuleRef("net", "self_link").AsValue(),
+			}),
+		}}}},
+	}
+	run := func(vs ...config.CustomValidator) (error, error) {
+		bp.CustomValidators = vs
+		errs, warnings := config.Errors{}, config.Errors{}
+		executeCustom(bp, &errs, &warnings)
+		return errs.OrNil(), warnings.OrNil()
+	}
+
+	{ // passing conditions, unknown ones pass
+		errs, warnings := run(
+			config.CustomValidator{Condition: `length(regexall("^us-", var.region)) > 0`, Message: "m"},
+			config.CustomValidator{Condition: `length([for g in blueprint.deployment_groups : g if length(g.modules) > 5]) == 0`, Message: "m"},
+			config.CustomValidator{Condition: `blueprint.deployment_groups[0].modules[0].settings.network == "default"`, Message: "m"},
+		)
+		c.Check(errs, IsNil)
+		c.Check(warnings, IsNil)
+	}
+
+	{ // failures at error and warning level
+		errs, warnings := run(
+			config.CustomValidator{
+				Name:      "no_n2",
+				Condition: `!contains([for m in blueprint.deployment_groups[0].modules : m.settings.machine_type], "n2-standard-4")`,
+				Message:   "n2 machines are not allowed",
+			},
+			config.CustomValidator{Condition: `blueprint.blueprint_name != "pine"`, Message: "pick another name", Level: "warning"},
+			config.CustomValidator{Condition: `false`, Message: "ignored", Level: "ignore"},
+		)
+		c.Check(errs, ErrorMatches, `(?s).*validator "no_n2" failed:.*n2 machines are not allowed`)
+		c.Check(warnings, ErrorMatches, `(?s).*validator "custom_validators\[1\]" failed:.*pick another name`)
+	}
+
+	{ // Fail: unknown function
+		errs, _ := run(config.CustomValidator{Condition: `alltrue([true])`, Message: "m"})
+		c.Check(errs, ErrorMatches, `(?s).*no function named "alltrue".*`)
+	}
+
+	{ // Fail: not a bool
+		errs, _ := run(config.CustomValidator{Condition: `var.region`, Message: "m"})
+		c.Check(errs, ErrorMatches, `(?s).*condition must evaluate to a bool, got string`)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validators
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/gcpauth"
+	"hpc-toolkit/pkg/remote"
+	"net"
+	"time"
+
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// Validators below check deployed infrastructure, their inputs usually refer
+// to module outputs, e.g. the IP address of a controller.
+
+const dialTimeout = 10 * time.Second
+
+// dial opens a TCP connection, it is replaced in tests
+var dial = func(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, dialTimeout)
+}
+
+// stringInputs converts inputs to strings, unlike inputsAsStrings numbers
+// are accepted, as outputs such as ports often are numbers
+func stringInputs(inputs config.Dict) (map[string]string, error) {
+	ms := map[string]string{}
+	for k, v := range inputs.Items() {
+		s, err := convert.Convert(v, cty.String)
+		if err != nil || s.IsNull() || !s.IsKnown() {
+			return nil, fmt.Errorf("validator input %s must be a string or a number, got %s", k, v.Type().FriendlyName())
+		}
+		ms[k] = s.AsString()
+	}
+	return ms, nil
+}
+
+func testTCPPortOpen(bp config.Blueprint, inputs config.Dict) error {
+	if err := checkInputs(inputs, []string{"host", "port"}); err != nil {
+		return err
+	}
+	m, err := stringInputs(inputs)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(m["host"], m["port"])
+	conn, err := dial(addr)
+	if err != nil {
+		return fmt.Errorf("port %s is not reachable: %w", addr, err)
+	}
+	return conn.Close()
+}
+
+func testRemoteCommand(ctx context.Context, bp config.Blueprint, inputs config.Dict) error {
+	m, err := stringInputs(inputs)
+	if err != nil {
+		return err
+	}
+	command, ok := m["command"]
+	if !ok {
+		return errors.New("a required input \"command\" was not provided")
+	}
+	delete(m, "command")
+	t, err := remote.NewTarget(m)
+	if err != nil {
+		return err
+	}
+	_, err = remote.RunOn(ctx, t, command)
+	return err
+}
+
+// TestReservationActive whether the reservation exists and is ready to be consumed
+func TestReservationActive(projectID string, zone string, reservation string) error {
+	s, err := compute.NewService(context.Background(), gcpauth.ClientOptions()...)
+	if err != nil {
+		return handleClientError(err)
+	}
+	r, err := s.Reservations.Get(projectID, zone, reservation).Do()
+	if err != nil {
+		return fmt.Errorf("reservation %s does not exist in zone %s of project %s or your credentials do not have permission to access it", reservation, zone, projectID)
+	}
+	if r.Status != "READY" {
+		return fmt.Errorf("reservation %s in zone %s of project %s is %s, expected READY", reservation, zone, projectID, r.Status)
+	}
+	return nil
+}
+
+func testReservationActive(bp config.Blueprint, inputs config.Dict) error {
+	if err := checkInputs(inputs, []string{"project_id", "zone", "reservation"}); err != nil {
+		return err
+	}
+	m, err := stringInputs(inputs)
+	if err != nil {
+		return err
+	}
+	return TestReservationActive(m["project_id"], m["zone"], m["reservation"])
+}
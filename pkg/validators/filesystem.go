@@ -0,0 +1,221 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validators
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/config"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+const (
+	filestoreSource = "modules/file-system/filestore"
+	nfsServerSource = "community/modules/file-system/nfs-server"
+	// defaults of the filestore module
+	defaultFilestoreTier = "BASIC_HDD"
+	defaultFilestoreSize = 1024
+)
+
+// file system modules with the setting holding their mount points and its
+// default, the setting is either a string or a list of strings
+var fsMountSettings = []struct {
+	source  string
+	setting string
+	def     []string
+}{
+	{filestoreSource, "local_mount", []string{"/shared"}},
+	{"modules/file-system/pre-existing-network-storage", "local_mount", []string{"/mnt"}},
+	{"community/modules/file-system/cloud-storage-bucket", "local_mount", []string{"/mnt"}},
+	{"community/modules/file-system/DDN-EXAScaler", "local_mount", []string{"/shared"}},
+	{nfsServerSource, "local_mounts", []string{"/data"}},
+}
+
+// minimum capacity of Filestore instances in GiB by tier, see
+// https://cloud.google.com/filestore/docs/service-tiers
+var filestoreMinSize = map[string]int{
+	"BASIC_HDD":      1024,
+	"BASIC_SSD":      2560,
+	"HIGH_SCALE_SSD": 10240,
+	"ZONAL":          1024,
+	"REGIONAL":       1024,
+	"ENTERPRISE":     1024,
+}
+
+// number of nodes above which a file system is likely to become a bottleneck.
+// These are rules of thumb for typical HPC I/O, not limits of the services.
+var filestoreMaxNodes = map[string]int{
+	"BASIC_HDD": 32,
+	"BASIC_SSD": 128,
+}
+
+const nfsServerMaxNodes = 32
+
+// settings of modules that request VM instances that are always running,
+// autoscaled nodes are not counted as clusters rarely run all of them at once
+var staticNodeCountSettings = []string{"instance_count", "node_count_static"}
+
+func testFilesystemConfig(bp config.Blueprint, inputs config.Dict) error {
+	if err := checkInputs(inputs, []string{}); err != nil {
+		return err
+	}
+	errs := config.Errors{}
+	bp.WalkModulesSafe(func(p config.ModulePath, m *config.Module) {
+		errs.Add(checkMountCollisions(bp, p, *m))
+		switch {
+		case isSource(*m, filestoreSource):
+			errs.Add(checkFilestore(bp, p, *m))
+		case isSource(*m, nfsServerSource):
+			errs.Add(checkNodesServed(bp, *m, nfsServerMaxNodes, p.ID,
+				"consider a Filestore or Lustre file system for clusters of this size"))
+		}
+	})
+	return errs.OrNil()
+}
+
+// mountPoints returns mount points of a file system module, it returns false
+// if the module is not a known file system or its mount points are not known
+// before deployment
+func mountPoints(bp config.Blueprint, m config.Module) ([]string, bool) {
+	for _, fs := range fsMountSettings {
+		if !isSource(m, fs.source) {
+			continue
+		}
+		if !m.Settings.Has(fs.setting) {
+			return fs.def, true
+		}
+		v, ok := knownSetting(bp, m, fs.setting)
+		if !ok {
+			return nil, false
+		}
+		if v.Type() == cty.String {
+			return []string{v.AsString()}, true
+		}
+		if !v.CanIterateElements() {
+			return nil, false
+		}
+		res := []string{}
+		for _, e := range v.AsValueSlice() {
+			if e.IsNull() || !e.IsKnown() || e.Type() != cty.String {
+				return nil, false
+			}
+			res = append(res, e.AsString())
+		}
+		return res, true
+	}
+	return nil, false
+}
+
+// checkMountCollisions reports file systems used by the module that are
+// mounted at the same path
+func checkMountCollisions(bp config.Blueprint, p config.ModulePath, m config.Module) error {
+	mounted := map[string]config.ModuleID{}
+	errs := config.Errors{}
+	for iu, u := range m.Use {
+		um, err := bp.Module(u)
+		if err != nil {
+			continue
+		}
+		mps, ok := mountPoints(bp, *um)
+		if !ok {
+			continue
+		}
+		for _, mp := range mps {
+			if prev, ok := mounted[mp]; ok && prev != u {
+				errs.At(p.Use.At(iu), config.HintError{
+					Hint: "set local_mount of one of the file systems to a different path",
+					Err:  fmt.Errorf("file systems %q and %q used by module %q are both mounted at %q", prev, u, m.ID, mp)})
+				continue
+			}
+			mounted[mp] = u
+		}
+	}
+	return errs.OrNil()
+}
+
+func checkFilestore(bp config.Blueprint, p config.ModulePath, fs config.Module) error {
+	var tierPath config.Path = p.ID
+	tier := defaultFilestoreTier
+	if v, ok := knownSetting(bp, fs, "filestore_tier"); ok && v.Type() == cty.String {
+		tier, tierPath = v.AsString(), p.Settings.Dot("filestore_tier")
+	} else if fs.Settings.Has("filestore_tier") {
+		return nil // tier is not known before deployment
+	}
+
+	errs := config.Errors{}
+	var sizePath config.Path = p.ID
+	size := defaultFilestoreSize
+	if v, ok := knownSetting(bp, fs, "size_gb"); ok {
+		n, err := ctyInt(v)
+		if err != nil {
+			return config.BpError{Path: p.Settings.Dot("size_gb"), Err: err}
+		}
+		size, sizePath = n, p.Settings.Dot("size_gb")
+	}
+	if min, ok := filestoreMinSize[tier]; ok && size < min {
+		errs.At(sizePath, fmt.Errorf("filestore %q of tier %s must have a capacity of at least %d GiB, got %d GiB", fs.ID, tier, min, size))
+	}
+
+	if max, ok := filestoreMaxNodes[tier]; ok {
+		errs.Add(checkNodesServed(bp, fs, max, tierPath,
+			"consider the HIGH_SCALE_SSD, ZONAL or ENTERPRISE filestore_tier for clusters of this size"))
+	}
+	return errs.OrNil()
+}
+
+// checkNodesServed reports file systems mounted by more static nodes than they
+// can serve well, nodes are counted in modules using the file system, directly
+// or through modules they use
+func checkNodesServed(bp config.Blueprint, fs config.Module, max int, errPath config.Path, hint string) error {
+	nodes := 0
+	for _, m := range clientModules(bp, fs.ID) {
+		for _, s := range staticNodeCountSettings {
+			if v, ok := knownSetting(bp, m, s); ok {
+				if n, err := ctyInt(v); err == nil {
+					nodes += n
+				}
+			}
+		}
+	}
+	if nodes > max {
+		return config.BpError{Path: errPath, Err: config.HintError{
+			Hint: hint,
+			Err:  fmt.Errorf("file system %q is mounted by %d static nodes, more than the %d it is expected to serve well", fs.ID, nodes, max)}}
+	}
+	return nil
+}
+
+// clientModules returns modules using the file system and all modules they
+// use in turn, e.g. nodesets of a partition using the file system
+func clientModules(bp config.Blueprint, fsID config.ModuleID) []config.Module {
+	seen := map[config.ModuleID]bool{fsID: true}
+	res := []config.Module{}
+	queue := modulesUsing(bp, fsID)
+	for len(queue) > 0 {
+		m := queue[0]
+		queue = queue[1:]
+		if seen[m.ID] {
+			continue
+		}
+		seen[m.ID] = true
+		res = append(res, m)
+		for _, u := range m.Use {
+			if um, err := bp.Module(u); err == nil {
+				queue = append(queue, *um)
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,140 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validators
+
+import (
+	"hpc-toolkit/pkg/config"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func filesystemBp(modules ...config.Module) config.Blueprint {
+	return config.Blueprint{
+		DeploymentGroups: []config.DeploymentGroup{{
+			Name:    "primary",
+			Modules: modules,
+		}},
+	}
+}
+
+func filestore(id config.ModuleID, settings map[string]cty.Value) config.Module {
+	return config.Module{
+		ID:       id,
+		Source:   "modules/file-system/filestore",
+		Settings: config.NewDict(settings),
+	}
+}
+
+func computeUsing(nodes int, use ...config.ModuleID) config.Module {
+	return config.Module{
+		ID:       "compute",
+		Source:   "modules/compute/vm-instance",
+		Use:      use,
+		Settings: config.NewDict(map[string]cty.Value{"instance_count": cty.NumberIntVal(int64(nodes))}),
+	}
+}
+
+func (s *MySuite) TestFilesystemConfigMounts(c *C) {
+	home := filestore("homefs", map[string]cty.Value{"local_mount": cty.StringVal("/home")})
+
+	{ // Success: distinct mount points
+		bp := filesystemBp(home, filestore("appsfs", nil), computeUsing(1, "homefs", "appsfs"))
+		c.Check(testFilesystemConfig(bp, config.Dict{}), IsNil)
+	}
+
+	{ // Fail: collision with default mount point
+		bp := filesystemBp(filestore("appsfs", nil), filestore("datafs", nil), computeUsing(1, "appsfs", "datafs"))
+		c.Check(testFilesystemConfig(bp, config.Dict{}), ErrorMatches, `.*"appsfs" and "datafs" .* both mounted at "/shared".*`)
+	}
+
+	{ // Fail: collision with list of mount points
+		nfs := config.Module{
+			ID:     "nfs",
+			Source: "community/modules/file-system/nfs-server",
+			Settings: config.NewDict(map[string]cty.Value{
+				"local_mounts": cty.TupleVal([]cty.Value{cty.StringVal("/tools"), cty.StringVal("/home")})}),
+		}
+		bp := filesystemBp(home, nfs, computeUsing(1, "homefs", "nfs"))
+		c.Check(testFilesystemConfig(bp, config.Dict{}), ErrorMatches, `.*both mounted at "/home".*`)
+	}
+
+	{ // Success: mount point is not known before deployment
+		unknown := filestore("datafs", map[string]cty.Value{
+			"local_mount": config.MustParseExpression(`module.foo.mount`).AsValue()})
+		bp := filesystemBp(filestore("appsfs", nil), unknown, computeUsing(1, "appsfs", "datafs"))
+		c.Check(testFilesystemConfig(bp, config.Dict{}), IsNil)
+	}
+}
+
+func (s *MySuite) TestFilesystemConfigCapacity(c *C) {
+	fs := func(tier string, size int) config.Module {
+		return filestore("homefs", map[string]cty.Value{
+			"filestore_tier": cty.StringVal(tier),
+			"size_gb":        cty.NumberIntVal(int64(size))})
+	}
+
+	c.Check(testFilesystemConfig(filesystemBp(filestore("homefs", nil)), config.Dict{}), IsNil)
+	c.Check(testFilesystemConfig(filesystemBp(fs("BASIC_SSD", 2560)), config.Dict{}), IsNil)
+	c.Check(testFilesystemConfig(filesystemBp(fs("HIGH_SCALE_SSD", 10240)), config.Dict{}), IsNil)
+
+	c.Check(testFilesystemConfig(filesystemBp(fs("BASIC_HDD", 512)), config.Dict{}),
+		ErrorMatches, ".*at least 1024 GiB, got 512 GiB")
+	c.Check(testFilesystemConfig(filesystemBp(fs("HIGH_SCALE_SSD", 2560)), config.Dict{}),
+		ErrorMatches, ".*at least 10240 GiB, got 2560 GiB")
+
+	{ // Fail: default size is below minimum of tier
+		bp := filesystemBp(filestore("homefs", map[string]cty.Value{"filestore_tier": cty.StringVal("BASIC_SSD")}))
+		c.Check(testFilesystemConfig(bp, config.Dict{}), ErrorMatches, ".*at least 2560 GiB, got 1024 GiB")
+	}
+}
+
+func (s *MySuite) TestFilesystemConfigNodes(c *C) {
+	ssd := filestore("homefs", map[string]cty.Value{
+		"filestore_tier": cty.StringVal("BASIC_SSD"),
+		"size_gb":        cty.NumberIntVal(2560)})
+
+	c.Check(testFilesystemConfig(filesystemBp(filestore("homefs", nil), computeUsing(32, "homefs")), config.Dict{}), IsNil)
+	c.Check(testFilesystemConfig(filesystemBp(filestore("homefs", nil), computeUsing(33, "homefs")), config.Dict{}),
+		ErrorMatches, `.*"homefs" is mounted by 33 static nodes.*`)
+	c.Check(testFilesystemConfig(filesystemBp(ssd, computeUsing(100, "homefs")), config.Dict{}), IsNil)
+
+	{ // Fail: nodes are counted through modules used by the user of the file system
+		nodeset := config.Module{
+			ID:       "nodeset",
+			Source:   "community/modules/compute/schedmd-slurm-gcp-v6-nodeset",
+			Settings: config.NewDict(map[string]cty.Value{"node_count_static": cty.NumberIntVal(200)}),
+		}
+		partition := config.Module{
+			ID:     "partition",
+			Source: "community/modules/compute/schedmd-slurm-gcp-v6-partition",
+			Use:    []config.ModuleID{"nodeset", "homefs"},
+		}
+		bp := filesystemBp(ssd, nodeset, partition)
+		c.Check(testFilesystemConfig(bp, config.Dict{}), ErrorMatches, `.*200 static nodes, more than the 128.*`)
+	}
+
+	{ // Success: autoscaled nodes are not counted
+		dynamic := computeUsing(0, "homefs")
+		dynamic.Settings = config.NewDict(map[string]cty.Value{"node_count_dynamic_max": cty.NumberIntVal(500)})
+		c.Check(testFilesystemConfig(filesystemBp(filestore("homefs", nil), dynamic), config.Dict{}), IsNil)
+	}
+
+	{ // Fail: NFS server
+		nfs := config.Module{ID: "nfs", Source: "community/modules/file-system/nfs-server"}
+		bp := filesystemBp(nfs, computeUsing(64, "nfs"))
+		c.Check(testFilesystemConfig(bp, config.Dict{}), ErrorMatches, `.*"nfs" is mounted by 64 static nodes.*`)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validators
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/gcpauth"
+	"net/http"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// lookupImage tells whether the image, or an image of the family, exists
+var lookupImage = func(img config.Image) (bool, error) {
+	ctx := context.Background()
+	s, err := compute.NewService(ctx, gcpauth.ClientOptions()...)
+	if err != nil {
+		return false, err
+	}
+	if img.Family != "" {
+		_, err = s.Images.GetFromFamily(img.Project, img.Family).Context(ctx).Do()
+	} else {
+		_, err = s.Images.Get(img.Project, img.Name).Context(ctx).Do()
+	}
+	var herr *googleapi.Error
+	if errors.As(err, &herr) && herr.Code == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// testImagesExist checks that images of the blueprint not built by its Packer
+// modules exist
+func testImagesExist(bp config.Blueprint, inputs config.Dict) error {
+	if err := checkInputs(inputs, []string{}); err != nil {
+		return err
+	}
+	names := maps.Keys(bp.Images)
+	slices.Sort(names)
+	errs := config.Errors{}
+	for _, n := range names {
+		img := bp.Images[n]
+		if img.BuiltBy != "" {
+			continue
+		}
+		ok, err := lookupImage(img)
+		if err != nil {
+			return handleClientError(err)
+		}
+		if ok {
+			continue
+		}
+		p := config.Root.Images.Dot(n)
+		if img.Family != "" {
+			errs.At(p.Family, config.HintError{
+				Hint: fmt.Sprintf("list image families with `gcloud compute images list --project %s`", img.Project),
+				Err:  fmt.Errorf("no image of family %q exists in project %s, or your credentials do not have permission to access it", img.Family, img.Project)})
+		} else {
+			errs.At(p.Name, fmt.Errorf("image %q does not exist in project %s, or your credentials do not have permission to access it", img.Name, img.Project))
+		}
+	}
+	return errs.OrNil()
+}
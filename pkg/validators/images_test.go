@@ -0,0 +1,50 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validators
+
+import (
+	"hpc-toolkit/pkg/config"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestTestImagesExist(c *C) {
+	defer func(f func(config.Image) (bool, error)) { lookupImage = f }(lookupImage)
+	lookups := []config.Image{}
+	lookupImage = func(img config.Image) (bool, error) {
+		lookups = append(lookups, img)
+		return img.Project == "p" && (img.Family == "hpc-rocky-linux-8" || img.Name == "golden"), nil
+	}
+	noInputs := config.NewDict(nil)
+
+	{ // ok, images built by Packer modules are not looked up
+		bp := config.Blueprint{Images: map[string]config.Image{
+			"compute": {Family: "hpc-rocky-linux-8", Project: "p"},
+			"login":   {Name: "golden", Project: "p"},
+			"built":   {Family: "mine", Project: "p", BuiltBy: "img"},
+		}}
+		c.Check(testImagesExist(bp, noInputs), IsNil)
+		c.Check(lookups, HasLen, 2)
+	}
+
+	{ // missing family and image
+		bp := config.Blueprint{Images: map[string]config.Image{
+			"compute": {Family: "hpc-rocky-linux-9", Project: "p"},
+			"login":   {Name: "golden", Project: "q"},
+		}}
+		c.Check(testImagesExist(bp, noInputs), ErrorMatches,
+			`(?s).*no image of family "hpc-rocky-linux-9" exists in project p.*image "golden" does not exist in project q.*`)
+	}
+}
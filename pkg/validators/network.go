@@ -0,0 +1,483 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validators
+
+import (
+	"errors"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"math/big"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	vpcSource           = "modules/network/vpc"
+	firewallRulesSource = "modules/network/firewall-rules"
+	// defaults of the vpc module
+	defaultNetworkAddressRange = "10.0.0.0/9"
+	defaultPrimarySubnetSize   = 15
+	// Google Cloud reserves 4 addresses in the primary range of every subnet
+	reservedSubnetAddresses = 4
+)
+
+// settings of modules that request VM instances in the network they use
+var nodeCountSettings = []string{"instance_count", "node_count_static", "node_count_dynamic_max"}
+
+// ports that must be reachable within the network for schedulers to operate,
+// keyed by the source of the scheduler module
+var schedulerPorts = map[string][]int{
+	"schedmd-slurm-gcp-v5-controller": {6817, 6818},
+	"schedmd-slurm-gcp-v6-controller": {6817, 6818},
+}
+
+func testNetworkConfig(bp config.Blueprint, inputs config.Dict) error {
+	if err := checkInputs(inputs, []string{}); err != nil {
+		return err
+	}
+	errs := config.Errors{}
+	bp.WalkModulesSafe(func(p config.ModulePath, m *config.Module) {
+		if isSource(*m, vpcSource) {
+			errs.Add(checkVpc(bp, p, *m))
+		}
+	})
+	return errs.OrNil()
+}
+
+func isSource(m config.Module, source string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(m.Source, "/"), source)
+}
+
+// knownSetting evaluates setting of the module, it returns false if setting
+// is not set or its value is not known before deployment
+func knownSetting(bp config.Blueprint, m config.Module, name string) (cty.Value, bool) {
+	if !m.Settings.Has(name) {
+		return cty.NilVal, false
+	}
+	v, err := bp.Eval(m.Settings.Get(name))
+	if err != nil || v.IsNull() || !v.IsWhollyKnown() {
+		return cty.NilVal, false
+	}
+	return v, true
+}
+
+// modulesUsing returns modules that use module with given ID
+func modulesUsing(bp config.Blueprint, id config.ModuleID) []config.Module {
+	res := []config.Module{}
+	bp.WalkModulesSafe(func(_ config.ModulePath, m *config.Module) {
+		if slices.Contains(m.Use, id) {
+			res = append(res, *m)
+		}
+	})
+	return res
+}
+
+func checkVpc(bp config.Blueprint, p config.ModulePath, vpc config.Module) error {
+	subnets, err := vpcSubnets(bp, p, vpc)
+	if err != nil {
+		return err
+	}
+	errs := config.Errors{}
+	errs.Add(checkOverlaps(bp, p, vpc, subnets))
+	if len(subnets) > 0 {
+		errs.Add(checkCapacity(bp, p, vpc, subnets[0]))
+	}
+	errs.Add(checkSchedulerPorts(bp, p, vpc))
+	return errs.OrNil()
+}
+
+// vpcSubnets returns primary ranges of subnetworks created by the vpc module,
+// the first one is the primary subnetwork. Returns empty list if ranges can
+// not be known before deployment.
+func vpcSubnets(bp config.Blueprint, p config.ModulePath, vpc config.Module) ([]netip.Prefix, error) {
+	rangeStr := defaultNetworkAddressRange
+	if v, ok := knownSetting(bp, vpc, "network_address_range"); ok && v.Type() == cty.String {
+		rangeStr = v.AsString()
+	}
+	network, err := netip.ParsePrefix(rangeStr)
+	if err != nil {
+		return nil, config.BpError{Path: p.Settings, Err: fmt.Errorf("invalid network_address_range %q: %w", rangeStr, err)}
+	}
+
+	if vpc.Settings.Has("subnetworks") {
+		v, ok := knownSetting(bp, vpc, "subnetworks")
+		if !ok || !v.CanIterateElements() {
+			return nil, nil
+		}
+		return subnetworksRanges(network, v, p)
+	}
+
+	size := defaultPrimarySubnetSize
+	if v, ok := knownSetting(bp, vpc, "default_primary_subnetwork_size"); ok && v.Type() == cty.Number {
+		s, _ := v.AsBigFloat().Int64()
+		size = int(s)
+	}
+	primary, err := cidrSubnets(network, []int{size})
+	if err != nil {
+		return nil, config.BpError{Path: p.Settings, Err: fmt.Errorf("invalid default_primary_subnetwork_size: %w", err)}
+	}
+	return primary, nil
+}
+
+// subnetworksRanges parses `subnetworks` setting of the vpc module, either
+// all subnetworks set `subnet_ip` or all set `new_bits`
+func subnetworksRanges(network netip.Prefix, subnetworks cty.Value, p config.ModulePath) ([]netip.Prefix, error) {
+	sp := p.Settings.Dot("subnetworks")
+	if !isList(subnetworks) {
+		return nil, config.BpError{Path: sp, Err: fmt.Errorf("must be a list of subnetworks, got %s", subnetworks.Type().FriendlyName())}
+	}
+	errs := config.Errors{}
+	ips, bits := []netip.Prefix{}, []int{}
+	for i, s := range subnetworks.AsValueSlice() {
+		attrs, ok := ctyAttrs(s)
+		if !ok {
+			errs.At(sp.Cty(cty.IndexIntPath(i)), fmt.Errorf("subnetwork must be an object, got %s", s.Type().FriendlyName()))
+			continue
+		}
+		if ip, ok := attrs["subnet_ip"]; ok && ip.Type() == cty.String {
+			p, err := netip.ParsePrefix(ip.AsString())
+			if err != nil {
+				errs.At(sp.Cty(cty.IndexIntPath(i)), fmt.Errorf("invalid subnet_ip %q: %w", ip.AsString(), err))
+			}
+			ips = append(ips, p)
+		}
+		if nb, ok := attrs["new_bits"]; ok {
+			n, err := ctyInt(nb)
+			if err != nil {
+				errs.At(sp.Cty(cty.IndexIntPath(i)), fmt.Errorf("invalid new_bits: %w", err))
+			}
+			bits = append(bits, n)
+		}
+	}
+	if errs.Any() {
+		return nil, errs
+	}
+	if len(bits) > 0 {
+		res, err := cidrSubnets(network, bits)
+		if err != nil {
+			return nil, config.BpError{Path: sp, Err: err}
+		}
+		return res, nil
+	}
+	return ips, nil
+}
+
+// isList reports if the value is a known list, tuple or set
+func isList(v cty.Value) bool {
+	ty := v.Type()
+	return !v.IsNull() && v.IsKnown() && (ty.IsListType() || ty.IsTupleType() || ty.IsSetType())
+}
+
+// ctyAttrs returns attributes of a known object or map, reports false for
+// values of other types
+func ctyAttrs(v cty.Value) (map[string]cty.Value, bool) {
+	if v.IsNull() || !v.IsKnown() || (!v.Type().IsObjectType() && !v.Type().IsMapType()) {
+		return nil, false
+	}
+	return v.AsValueMap(), true
+}
+
+func ctyInt(v cty.Value) (int, error) {
+	switch v.Type() {
+	case cty.Number:
+		i, _ := v.AsBigFloat().Int64()
+		return int(i), nil
+	case cty.String: // subnetworks are declared as list(map(string))
+		return strconv.Atoi(v.AsString())
+	default:
+		return 0, fmt.Errorf("expected number, got %s", v.Type().FriendlyName())
+	}
+}
+
+// cidrSubnets allocates consecutive ranges within network, same as Terraform
+// `cidrsubnets` function does
+func cidrSubnets(network netip.Prefix, newBits []int) ([]netip.Prefix, error) {
+	network = network.Masked()
+	total := network.Addr().BitLen()
+	start := new(big.Int).SetBytes(network.Addr().AsSlice())
+	end := new(big.Int).Add(start, new(big.Int).Lsh(big.NewInt(1), uint(total-network.Bits())))
+
+	res := []netip.Prefix{}
+	cur := new(big.Int).Set(start)
+	for _, nb := range newBits {
+		bits := network.Bits() + nb
+		if nb < 1 || bits > total {
+			return nil, fmt.Errorf("can not extend prefix /%d by %d bits", network.Bits(), nb)
+		}
+		size := new(big.Int).Lsh(big.NewInt(1), uint(total-bits))
+		// align to the size of the range
+		rem := new(big.Int).Mod(cur, size)
+		if rem.Sign() != 0 {
+			cur.Add(cur, new(big.Int).Sub(size, rem))
+		}
+		if new(big.Int).Add(cur, size).Cmp(end) > 0 {
+			return nil, fmt.Errorf("not enough room left in %s", network)
+		}
+		b := cur.FillBytes(make([]byte, total/8))
+		addr, _ := netip.AddrFromSlice(b)
+		res = append(res, netip.PrefixFrom(addr, bits))
+		cur.Add(cur, size)
+	}
+	return res, nil
+}
+
+// secondaryRanges returns ranges from `secondary_ranges` setting of the vpc
+// module, a map of subnetwork names to lists of ranges
+func secondaryRanges(bp config.Blueprint, p config.ModulePath, vpc config.Module) ([]netip.Prefix, error) {
+	v, ok := knownSetting(bp, vpc, "secondary_ranges")
+	if !ok {
+		return nil, nil
+	}
+	sp := p.Settings.Dot("secondary_ranges")
+	subnets, ok := ctyAttrs(v)
+	if !ok {
+		return nil, config.BpError{Path: sp, Err: fmt.Errorf("must be a map of subnetwork names to lists of ranges, got %s", v.Type().FriendlyName())}
+	}
+	errs := config.Errors{}
+	res := []netip.Prefix{}
+	names := maps.Keys(subnets)
+	slices.Sort(names)
+	for _, name := range names {
+		rp := cty.IndexStringPath(name)
+		if !isList(subnets[name]) {
+			errs.At(sp.Cty(rp), fmt.Errorf("must be a list of ranges, got %s", subnets[name].Type().FriendlyName()))
+			continue
+		}
+		for i, r := range subnets[name].AsValueSlice() {
+			attrs, ok := ctyAttrs(r)
+			if !ok {
+				errs.At(sp.Cty(rp.IndexInt(i)), fmt.Errorf("range must be an object, got %s", r.Type().FriendlyName()))
+				continue
+			}
+			s, ok := attrs["ip_cidr_range"]
+			if !ok || s.Type() != cty.String {
+				continue
+			}
+			p, err := netip.ParsePrefix(s.AsString())
+			if err != nil {
+				errs.At(sp.Cty(rp.IndexInt(i)), fmt.Errorf("invalid ip_cidr_range %q: %w", s.AsString(), err))
+				continue
+			}
+			res = append(res, p)
+		}
+	}
+	return res, errs.OrNil()
+}
+
+func checkOverlaps(bp config.Blueprint, p config.ModulePath, vpc config.Module, subnets []netip.Prefix) error {
+	secondary, err := secondaryRanges(bp, p, vpc)
+	if err != nil {
+		return err
+	}
+	all := append(slices.Clone(subnets), secondary...)
+
+	errs := config.Errors{}
+	for i := range all {
+		for j := i + 1; j < len(all); j++ {
+			if all[i].Overlaps(all[j]) {
+				errs.At(p.Settings, fmt.Errorf("IP ranges %s and %s of network %q overlap", all[i], all[j], vpc.ID))
+			}
+		}
+	}
+	return errs.OrNil()
+}
+
+func checkCapacity(bp config.Blueprint, p config.ModulePath, vpc config.Module, primary netip.Prefix) error {
+	requested := 0
+	for _, m := range modulesUsing(bp, vpc.ID) {
+		for _, s := range nodeCountSettings {
+			if v, ok := knownSetting(bp, m, s); ok {
+				if n, err := ctyInt(v); err == nil {
+					requested += n
+				}
+			}
+		}
+	}
+
+	hostBits := primary.Addr().BitLen() - primary.Bits()
+	if hostBits >= 31 { // no chance to exhaust
+		return nil
+	}
+	available := (1 << hostBits) - reservedSubnetAddresses
+	if requested > available {
+		return config.BpError{Path: p.ID, Err: fmt.Errorf(
+			"modules using network %q request up to %d nodes, but its primary subnetwork %s only has %d usable addresses",
+			vpc.ID, requested, primary, available)}
+	}
+	return nil
+}
+
+func checkSchedulerPorts(bp config.Blueprint, p config.ModulePath, vpc config.Module) error {
+	if v, ok := knownSetting(bp, vpc, "enable_internal_traffic"); !ok || v.Type() != cty.Bool || v.True() {
+		return nil // internal traffic is allowed on all ports, or unknown
+	}
+	users := modulesUsing(bp, vpc.ID)
+	rules, ok := firewallRules(bp, vpc, users)
+	if !ok {
+		return nil // can't tell which ports are allowed
+	}
+	if err := checkRulePorts(rules); err != nil {
+		return config.BpError{Path: p.Settings, Err: err}
+	}
+
+	errs := config.Errors{}
+	for _, m := range users {
+		for src, ports := range schedulerPorts {
+			if !strings.Contains(m.Source, src) {
+				continue
+			}
+			if missing := missingPorts(rules, ports); len(missing) > 0 {
+				errs.At(p.Settings.Dot("enable_internal_traffic"), fmt.Errorf(
+					"module %q requires TCP ports %v to be open within network %q, but internal traffic is disabled and no firewall rule allows them",
+					m.ID, missing, vpc.ID))
+			}
+		}
+	}
+	return errs.OrNil()
+}
+
+// firewallRules returns firewall rules of the network and of firewall-rules
+// modules using it, reports false if some rules are not known
+func firewallRules(bp config.Blueprint, vpc config.Module, users []config.Module) ([]cty.Value, bool) {
+	rules := []cty.Value{}
+	if v, ok := knownSetting(bp, vpc, "firewall_rules"); ok && v.CanIterateElements() {
+		rules = append(rules, v.AsValueSlice()...)
+	}
+	for _, m := range users {
+		if !isSource(m, firewallRulesSource) {
+			continue
+		}
+		if v, ok := knownSetting(bp, m, "ingress_rules"); ok && v.CanIterateElements() {
+			rules = append(rules, v.AsValueSlice()...)
+		} else if m.Settings.Has("ingress_rules") {
+			return nil, false
+		}
+	}
+	return rules, true
+}
+
+// missingPorts returns ports no firewall rule allows TCP traffic on
+func missingPorts(rules []cty.Value, ports []int) []int {
+	missing := []int{}
+	for _, port := range ports {
+		if !portAllowed(rules, port) {
+			missing = append(missing, port)
+		}
+	}
+	return missing
+}
+
+// portAllowed checks if any of firewall rules allows TCP traffic on the port
+func portAllowed(rules []cty.Value, port int) bool {
+	for _, r := range rules {
+		for _, a := range ingressAllows(r) {
+			if allowsPort(a, port) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ingressAllows returns the `allow` entries of the firewall rule, if it is an
+// ingress rule
+func ingressAllows(rule cty.Value) []map[string]cty.Value {
+	attrs, ok := ctyAttrs(rule)
+	if !ok {
+		return nil
+	}
+	if d, ok := attrs["direction"]; ok && d.Type() == cty.String && d.AsString() != "INGRESS" {
+		return nil
+	}
+	allow, ok := attrs["allow"]
+	if !ok || !isList(allow) {
+		return nil
+	}
+	res := []map[string]cty.Value{}
+	for _, a := range allow.AsValueSlice() {
+		if aa, ok := ctyAttrs(a); ok {
+			res = append(res, aa)
+		}
+	}
+	return res
+}
+
+// checkRulePorts checks that `ports` of firewall rules are lists
+func checkRulePorts(rules []cty.Value) error {
+	errs := config.Errors{}
+	for _, r := range rules {
+		for _, a := range ingressAllows(r) {
+			if ports, ok := a["ports"]; ok && !ports.IsNull() && !isList(ports) {
+				errs.Add(fmt.Errorf("ports of firewall rules must be lists of ports and port ranges, got %s", ports.Type().FriendlyName()))
+			}
+		}
+	}
+	return errs.OrNil()
+}
+
+func allowsPort(allow map[string]cty.Value, port int) bool {
+	proto, ok := allow["protocol"]
+	if !ok || proto.Type() != cty.String || !slices.Contains([]string{"tcp", "all"}, proto.AsString()) {
+		return false
+	}
+	ports, ok := allow["ports"]
+	if !ok || ports.IsNull() {
+		return true // all ports
+	}
+	if !isList(ports) {
+		return false // reported by checkRulePorts
+	}
+	if ports.LengthInt() == 0 {
+		return true // all ports
+	}
+	return portsContain(ports, port)
+}
+
+// portsContain checks if any of ports or port ranges contains the port
+func portsContain(ports cty.Value, port int) bool {
+	for _, ps := range ports.AsValueSlice() {
+		if ps.Type() != cty.String {
+			continue
+		}
+		if lo, hi, err := parsePortRange(ps.AsString()); err == nil && lo <= port && port <= hi {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePortRange(s string) (int, int, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	l, err := strconv.Atoi(lo)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return l, l, nil
+	}
+	h, err := strconv.Atoi(hi)
+	if err != nil {
+		return 0, 0, err
+	}
+	if h < l {
+		return 0, 0, errors.New("invalid port range")
+	}
+	return l, h, nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validators
+
+import (
+	"hpc-toolkit/pkg/config"
+	"net/netip"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func networkBp(vpcSettings map[string]cty.Value, others ...config.Module) config.Blueprint {
+	vpc := config.Module{
+		ID:       "network1",
+		Source:   "modules/network/vpc",
+		Settings: config.NewDict(vpcSettings),
+	}
+	return config.Blueprint{
+		DeploymentGroups: []config.DeploymentGroup{{
+			Name:    "primary",
+			Modules: append([]config.Module{vpc}, others...),
+		}},
+	}
+}
+
+func subnet(ip string) cty.Value {
+	return cty.MapVal(map[string]cty.Value{
+		"subnet_name":   cty.StringVal("s"),
+		"subnet_region": cty.StringVal("us-central1"),
+		"subnet_ip":     cty.StringVal(ip),
+	})
+}
+
+func (s *MySuite) TestCidrSubnets(c *C) {
+	got, err := cidrSubnets(netip.MustParsePrefix("10.0.0.0/9"), []int{15})
+	c.Check(err, IsNil)
+	c.Check(got, DeepEquals, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")})
+
+	// same as Terraform cidrsubnets("10.1.0.0/16", 4, 4, 8, 4)
+	got, err = cidrSubnets(netip.MustParsePrefix("10.1.0.0/16"), []int{4, 4, 8, 4})
+	c.Check(err, IsNil)
+	c.Check(got, DeepEquals, []netip.Prefix{
+		netip.MustParsePrefix("10.1.0.0/20"),
+		netip.MustParsePrefix("10.1.16.0/20"),
+		netip.MustParsePrefix("10.1.32.0/24"),
+		netip.MustParsePrefix("10.1.48.0/20"),
+	})
+
+	_, err = cidrSubnets(netip.MustParsePrefix("10.1.0.0/16"), []int{1, 1, 1})
+	c.Check(err, ErrorMatches, ".*not enough room.*")
+}
+
+func (s *MySuite) TestNetworkConfigOverlaps(c *C) {
+	{ // Success: default network
+		c.Check(testNetworkConfig(networkBp(nil), config.Dict{}), IsNil)
+	}
+
+	{ // Success: disjoint subnetworks
+		bp := networkBp(map[string]cty.Value{
+			"subnetworks": cty.TupleVal([]cty.Value{subnet("10.0.0.0/24"), subnet("10.0.1.0/24")})})
+		c.Check(testNetworkConfig(bp, config.Dict{}), IsNil)
+	}
+
+	{ // Fail: overlapping subnetworks
+		bp := networkBp(map[string]cty.Value{
+			"subnetworks": cty.TupleVal([]cty.Value{subnet("10.0.0.0/16"), subnet("10.0.1.0/24")})})
+		c.Check(testNetworkConfig(bp, config.Dict{}), ErrorMatches, ".*10.0.0.0/16 and 10.0.1.0/24.*overlap.*")
+	}
+
+	{ // Fail: secondary range overlaps primary subnetwork
+		bp := networkBp(map[string]cty.Value{
+			"secondary_ranges": cty.ObjectVal(map[string]cty.Value{
+				"s": cty.TupleVal([]cty.Value{cty.ObjectVal(map[string]cty.Value{
+					"range_name":    cty.StringVal("pods"),
+					"ip_cidr_range": cty.StringVal("10.0.0.128/25"),
+				})})})})
+		c.Check(testNetworkConfig(bp, config.Dict{}), ErrorMatches, ".*overlap.*")
+	}
+
+	{ // Fail: subnetwork is not an object
+		bp := networkBp(map[string]cty.Value{
+			"subnetworks": cty.TupleVal([]cty.Value{subnet("10.0.0.0/24"), cty.StringVal("10.0.1.0/24")})})
+		c.Check(testNetworkConfig(bp, config.Dict{}), ErrorMatches, "(?s).*subnetwork must be an object, got string.*")
+	}
+
+	{ // Fail: secondary ranges are a list
+		bp := networkBp(map[string]cty.Value{
+			"secondary_ranges": cty.TupleVal([]cty.Value{cty.ObjectVal(map[string]cty.Value{
+				"range_name":    cty.StringVal("pods"),
+				"ip_cidr_range": cty.StringVal("10.0.0.128/25"),
+			})})})
+		c.Check(testNetworkConfig(bp, config.Dict{}), ErrorMatches, ".*must be a map of subnetwork names.*")
+	}
+
+	{ // Success: subnetworks are not known
+		bp := networkBp(map[string]cty.Value{
+			"subnetworks": config.ModuleRef("other", "subnets").AsValue()})
+		c.Check(testNetworkConfig(bp, config.Dict{}), IsNil)
+	}
+}
+
+func (s *MySuite) TestNetworkConfigCapacity(c *C) {
+	nodes := func(n int64) config.Module {
+		return config.Module{
+			ID:       "nodeset",
+			Source:   "community/modules/compute/schedmd-slurm-gcp-v6-nodeset",
+			Use:      config.ModuleIDs{"network1"},
+			Settings: config.NewDict(map[string]cty.Value{"node_count_dynamic_max": cty.NumberIntVal(n)}),
+		}
+	}
+	settings := map[string]cty.Value{"default_primary_subnetwork_size": cty.NumberIntVal(14)} // 10.0.0.0/23
+
+	c.Check(testNetworkConfig(networkBp(settings, nodes(500)), config.Dict{}), IsNil)
+	c.Check(testNetworkConfig(networkBp(settings, nodes(511)), config.Dict{}), ErrorMatches, ".*request up to 511 nodes.*508 usable addresses.*")
+}
+
+func (s *MySuite) TestNetworkConfigSchedulerPorts(c *C) {
+	ctrl := config.Module{
+		ID:     "slurm_controller",
+		Source: "community/modules/scheduler/schedmd-slurm-gcp-v6-controller",
+		Use:    config.ModuleIDs{"network1"},
+	}
+	noInternal := map[string]cty.Value{"enable_internal_traffic": cty.False}
+
+	{ // Success: internal traffic is enabled by default
+		c.Check(testNetworkConfig(networkBp(nil, ctrl), config.Dict{}), IsNil)
+	}
+
+	{ // Fail: internal traffic is disabled
+		c.Check(testNetworkConfig(networkBp(noInternal, ctrl), config.Dict{}), ErrorMatches, ".*TCP ports \\[6817 6818\\].*")
+	}
+
+	{ // Success: ports are allowed by firewall-rules module
+		fw := config.Module{
+			ID:     "firewall",
+			Source: "modules/network/firewall-rules",
+			Use:    config.ModuleIDs{"network1"},
+			Settings: config.NewDict(map[string]cty.Value{
+				"ingress_rules": cty.TupleVal([]cty.Value{cty.ObjectVal(map[string]cty.Value{
+					"name": cty.StringVal("slurm"),
+					"allow": cty.TupleVal([]cty.Value{cty.ObjectVal(map[string]cty.Value{
+						"protocol": cty.StringVal("tcp"),
+						"ports":    cty.TupleVal([]cty.Value{cty.StringVal("6817-6819")}),
+					})}),
+				})}),
+			}),
+		}
+		c.Check(testNetworkConfig(networkBp(noInternal, ctrl, fw), config.Dict{}), IsNil)
+	}
+
+	{ // Fail: ports of firewall rule are a string
+		fw := config.Module{
+			ID:     "firewall",
+			Source: "modules/network/firewall-rules",
+			Use:    config.ModuleIDs{"network1"},
+			Settings: config.NewDict(map[string]cty.Value{
+				"ingress_rules": cty.TupleVal([]cty.Value{cty.ObjectVal(map[string]cty.Value{
+					"name": cty.StringVal("slurm"),
+					"allow": cty.TupleVal([]cty.Value{cty.ObjectVal(map[string]cty.Value{
+						"protocol": cty.StringVal("tcp"),
+						"ports":    cty.StringVal("6817-6819"),
+					})}),
+				})}),
+			}),
+		}
+		c.Check(testNetworkConfig(networkBp(noInternal, ctrl, fw), config.Dict{}), ErrorMatches, "(?s).*must be lists of ports.*got string.*")
+	}
+}
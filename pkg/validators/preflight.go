@@ -0,0 +1,289 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validators
+
+import (
+	"context"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/gcpauth"
+	"regexp"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/slices"
+	compute "google.golang.org/api/compute/v1"
+	iam "google.golang.org/api/iam/v1"
+	storage "google.golang.org/api/storage/v1"
+)
+
+const (
+	networkResource        = "network"
+	subnetworkResource     = "subnetwork"
+	serviceAccountResource = "service account"
+	bucketResource         = "bucket"
+)
+
+// externalResource is a cloud resource the deployment refers to, but does not
+// create, e.g. a pre-existing VPC or a bucket named in deployment variables
+type externalResource struct {
+	Kind    string
+	Project string // unknown for buckets
+	Region  string // of subnetworks
+	Name    string
+	Path    config.Path // first setting referring to the resource
+}
+
+func (r externalResource) String() string {
+	switch {
+	case r.Region != "":
+		return fmt.Sprintf("%s %s in region %s of project %s", r.Kind, r.Name, r.Region, r.Project)
+	case r.Project != "":
+		return fmt.Sprintf("%s %s in project %s", r.Kind, r.Name, r.Project)
+	}
+	return fmt.Sprintf("%s %s", r.Kind, r.Name)
+}
+
+var (
+	serviceAccountRegex = regexp.MustCompile(`^[a-z][a-z0-9-]*@([a-z][a-z0-9-]*)\.iam\.gserviceaccount\.com$`)
+	computeAccountRegex = regexp.MustCompile(`^(\d+)-compute@developer\.gserviceaccount\.com$`)
+	bucketURLRegex      = regexp.MustCompile(`^gs://([a-z0-9][a-z0-9._-]*[a-z0-9])(/.*)?$`)
+	networkLinkRegex    = regexp.MustCompile(`(?:^|/)projects/([^/]+)/global/networks/([^/]+)$`)
+	subnetworkLinkRegex = regexp.MustCompile(`(?:^|/)projects/([^/]+)/regions/([^/]+)/subnetworks/([^/]+)$`)
+)
+
+const preExistingVpcSource = "modules/network/pre-existing-vpc"
+
+// externalResources returns resources the blueprint refers to with values
+// known before deployment; values set by module outputs refer to resources
+// of the deployment itself. They are found in settings of pre-existing-vpc
+// modules, in strings that are service account emails, bucket URLs or
+// network self links, and in variables named after buckets.
+func externalResources(bp config.Blueprint) []externalResource {
+	l := resourceList{}
+	for name, v := range bp.Vars.Items() {
+		p := config.Root.Vars.Dot(name)
+		l.add(resourcesInValue(v, p)...)
+		if isBucketVar(name) && v.Type() == cty.String && !strings.HasPrefix(v.AsString(), "gs://") && v.AsString() != "" {
+			l.add(externalResource{Kind: bucketResource, Name: v.AsString(), Path: p})
+		}
+	}
+	bp.WalkModulesSafe(func(p config.ModulePath, m *config.Module) {
+		l.add(moduleResources(bp, *m, p)...)
+	})
+	return l.res
+}
+
+// resourceList lists external resources, each once
+type resourceList struct {
+	res []externalResource
+}
+
+func (l *resourceList) add(rs ...externalResource) {
+	for _, r := range rs {
+		if !slices.ContainsFunc(l.res, func(o externalResource) bool {
+			return o.Kind == r.Kind && o.Project == r.Project && o.Region == r.Region && o.Name == r.Name
+		}) {
+			l.res = append(l.res, r)
+		}
+	}
+}
+
+// moduleResources returns external resources named by known settings of the
+// module, and the subnetwork a pre-existing-vpc module looks up
+func moduleResources(bp config.Blueprint, m config.Module, p config.ModulePath) []externalResource {
+	res := []externalResource{}
+	if strings.HasSuffix(m.Source, preExistingVpcSource) {
+		if r, ok := preExistingVpc(bp, m, p); ok {
+			res = append(res, r)
+		}
+	}
+	for name, s := range m.Settings.Items() {
+		v, err := bp.Eval(s)
+		if err != nil || v.IsNull() || !v.IsWhollyKnown() {
+			continue
+		}
+		res = append(res, resourcesInValue(v, p.Settings.Dot(name))...)
+	}
+	return res
+}
+
+// preExistingVpc returns the subnetwork the pre-existing-vpc module looks up,
+// the network of a subnetwork that exists needs no check
+func preExistingVpc(bp config.Blueprint, m config.Module, p config.ModulePath) (externalResource, bool) {
+	project := knownString(bp, m, "project_id")
+	region := knownString(bp, m, "region")
+	if project == "" || region == "" {
+		return externalResource{}, false
+	}
+	network := knownString(bp, m, "network_name")
+	if network == "" {
+		network = "default" // default of the module input
+	}
+	subnetwork := knownString(bp, m, "subnetwork_name")
+	if subnetwork == "" {
+		subnetwork = network
+	}
+	return externalResource{
+		Kind: subnetworkResource, Project: project, Region: region, Name: subnetwork, Path: p.Settings}, true
+}
+
+func isBucketVar(name string) bool {
+	return strings.HasSuffix(name, "bucket") || strings.HasSuffix(name, "bucket_name")
+}
+
+// resourcesInValue returns external resources named by strings in the value
+func resourcesInValue(v cty.Value, p config.Path) []externalResource {
+	res := []externalResource{}
+	if _, is := config.IsExpressionValue(v); is {
+		return res
+	}
+	cty.Walk(v, func(_ cty.Path, e cty.Value) (bool, error) {
+		if e.IsNull() || !e.IsKnown() || e.Type() != cty.String {
+			return true, nil
+		}
+		if r, ok := resourceInString(e.AsString()); ok {
+			r.Path = p
+			res = append(res, r)
+		}
+		return true, nil
+	})
+	return res
+}
+
+func resourceInString(s string) (externalResource, bool) {
+	if m := serviceAccountRegex.FindStringSubmatch(s); m != nil {
+		return externalResource{Kind: serviceAccountResource, Project: m[1], Name: s}, true
+	}
+	if m := computeAccountRegex.FindStringSubmatch(s); m != nil {
+		return externalResource{Kind: serviceAccountResource, Project: m[1], Name: s}, true
+	}
+	if m := bucketURLRegex.FindStringSubmatch(s); m != nil {
+		return externalResource{Kind: bucketResource, Name: m[1]}, true
+	}
+	if m := subnetworkLinkRegex.FindStringSubmatch(s); m != nil {
+		return externalResource{Kind: subnetworkResource, Project: m[1], Region: m[2], Name: m[3]}, true
+	}
+	if m := networkLinkRegex.FindStringSubmatch(s); m != nil {
+		return externalResource{Kind: networkResource, Project: m[1], Name: m[2]}, true
+	}
+	return externalResource{}, false
+}
+
+// Preflight runs validators of the blueprint, as Execute does, and checks
+// that external resources the deployment refers to exist and can be used
+// with the current credentials. Missing resources fail the preflight
+// regardless of the validation level, as deploying would fail.
+func Preflight(ctx context.Context, bp config.Blueprint) (error, error) {
+	failed, warned := Execute(ctx, bp)
+	errs := config.Errors{}
+	if multi, ok := failed.(config.Errors); ok {
+		errs.Errors = append(errs.Errors, multi.Errors...)
+	} else {
+		errs.Add(failed)
+	}
+	for _, r := range externalResources(bp) {
+		errs.At(r.Path, checkExternalResource(r))
+	}
+	return errs.OrNil(), warned
+}
+
+// CountExternalResources returns the number of resources Preflight checks
+// besides running validators
+func CountExternalResources(bp config.Blueprint) int {
+	return len(externalResources(bp))
+}
+
+// resourcePermissions are permissions deploying needs on external resources
+var resourcePermissions = map[string][]string{
+	subnetworkResource:     {"compute.subnetworks.use"},
+	serviceAccountResource: {"iam.serviceAccounts.actAs"},
+	bucketResource:         {"storage.buckets.get", "storage.objects.get"},
+}
+
+func missingPermissions(r externalResource, granted []string) error {
+	missing := []string{}
+	for _, p := range resourcePermissions[r.Kind] {
+		if !slices.Contains(granted, p) {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("your credentials lack permissions %s on %s", strings.Join(missing, ", "), r)
+	}
+	return nil
+}
+
+// checkExternalResource checks that the resource exists and that the
+// credentials hold permissions deploying needs, it is replaced in tests
+var checkExternalResource = func(r externalResource) error {
+	ctx := context.Background()
+	notFound := fmt.Errorf("%s does not exist or your credentials do not have permission to access it", r)
+	var granted []string
+
+	switch r.Kind {
+	case networkResource:
+		s, err := compute.NewService(ctx, gcpauth.ClientOptions()...)
+		if err != nil {
+			return handleClientError(err)
+		}
+		if _, err := s.Networks.Get(r.Project, r.Name).Fields("name").Do(); err != nil {
+			return notFound
+		}
+		return nil
+	case subnetworkResource:
+		s, err := compute.NewService(ctx, gcpauth.ClientOptions()...)
+		if err != nil {
+			return handleClientError(err)
+		}
+		if _, err := s.Subnetworks.Get(r.Project, r.Region, r.Name).Fields("name").Do(); err != nil {
+			return notFound
+		}
+		req := &compute.TestPermissionsRequest{Permissions: resourcePermissions[r.Kind]}
+		resp, err := s.Subnetworks.TestIamPermissions(r.Project, r.Region, r.Name, req).Do()
+		if err != nil {
+			return notFound
+		}
+		granted = resp.Permissions
+	case serviceAccountResource:
+		s, err := iam.NewService(ctx, gcpauth.ClientOptions()...)
+		if err != nil {
+			return handleClientError(err)
+		}
+		name := "projects/-/serviceAccounts/" + r.Name
+		if _, err := s.Projects.ServiceAccounts.Get(name).Do(); err != nil {
+			return notFound
+		}
+		req := &iam.TestIamPermissionsRequest{Permissions: resourcePermissions[r.Kind]}
+		resp, err := s.Projects.ServiceAccounts.TestIamPermissions(name, req).Do()
+		if err != nil {
+			return notFound
+		}
+		granted = resp.Permissions
+	case bucketResource:
+		s, err := storage.NewService(ctx, gcpauth.ClientOptions()...)
+		if err != nil {
+			return handleClientError(err)
+		}
+		resp, err := s.Buckets.TestIamPermissions(r.Name, resourcePermissions[r.Kind]).Do()
+		if err != nil {
+			return notFound
+		}
+		granted = resp.Permissions
+	default:
+		return fmt.Errorf("unknown kind of resource %q", r.Kind)
+	}
+	return missingPermissions(r, granted)
+}
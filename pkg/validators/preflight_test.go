@@ -0,0 +1,128 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validators
+
+import (
+	"context"
+	"errors"
+	"hpc-toolkit/pkg/config"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestResourceInString(c *C) {
+	type test struct {
+		s  string
+		r  externalResource
+		ok bool
+	}
+	for _, t := range []test{
+		{"sa@proj.iam.gserviceaccount.com", externalResource{Kind: serviceAccountResource, Project: "proj", Name: "sa@proj.iam.gserviceaccount.com"}, true},
+		{"12345-compute@developer.gserviceaccount.com", externalResource{Kind: serviceAccountResource, Project: "12345", Name: "12345-compute@developer.gserviceaccount.com"}, true},
+		{"gs://bkt/path/to/script.sh", externalResource{Kind: bucketResource, Name: "bkt"}, true},
+		{"gs://bkt", externalResource{Kind: bucketResource, Name: "bkt"}, true},
+		{"projects/p/global/networks/net", externalResource{Kind: networkResource, Project: "p", Name: "net"}, true},
+		{"https://www.googleapis.com/compute/v1/projects/p/regions/r/subnetworks/sub", externalResource{Kind: subnetworkResource, Project: "p", Region: "r", Name: "sub"}, true},
+		{"user@example.com", externalResource{}, false},
+		{"projects/p/global/networks", externalResource{}, false},
+		{"bkt", externalResource{}, false},
+	} {
+		r, ok := resourceInString(t.s)
+		c.Check(ok, Equals, t.ok, Commentf("%q", t.s))
+		c.Check(r, DeepEquals, t.r, Commentf("%q", t.s))
+	}
+}
+
+func (s *MySuite) TestExternalResources(c *C) {
+	sa := "sa@proj.iam.gserviceaccount.com"
+	bp := config.Blueprint{
+		Vars: config.NewDict(map[string]cty.Value{
+			"project_id":   cty.StringVal("proj"),
+			"region":       cty.StringVal("us-central1"),
+			"data_bucket":  cty.StringVal("data"),
+			"other_bucket": cty.StringVal("gs://data/inputs"),
+			"sa":           cty.StringVal(sa),
+		}),
+		DeploymentGroups: []config.DeploymentGroup{{Name: "primary", Modules: []config.Module{
+			{
+				ID:     "network",
+				Source: "modules/network/pre-existing-vpc",
+				Settings: config.NewDict(map[string]cty.Value{
+					"project_id":   config.GlobalRef("project_id").AsValue(),
+					"region":       config.GlobalRef("region").AsValue(),
+					"network_name": cty.StringVal("hpc"),
+				}),
+			},
+			{
+				ID:     "vm",
+				Source: "modules/compute/vm-instance",
+				Settings: config.NewDict(map[string]cty.Value{
+					"service_account": cty.ObjectVal(map[string]cty.Value{
+						"email":  config.GlobalRef("sa").AsValue(),
+						"scopes": cty.ListVal([]cty.Value{cty.StringVal("https://www.googleapis.com/auth/cloud-platform")}),
+					}),
+					"subnetwork_self_link": config.ModuleRef("network", "subnetwork_self_link").AsValue(),
+					"startup_script":       cty.StringVal("gs://scripts/startup.sh"),
+				}),
+			},
+		}}},
+	}
+
+	got := externalResources(bp)
+	c.Check(got, HasLen, 4)
+	want := []externalResource{
+		{Kind: bucketResource, Name: "data"},
+		{Kind: serviceAccountResource, Project: "proj", Name: sa},
+		{Kind: subnetworkResource, Project: "proj", Region: "us-central1", Name: "hpc"},
+		{Kind: bucketResource, Name: "scripts"},
+	}
+	for _, w := range want {
+		found := false
+		for _, r := range got {
+			r.Path = nil
+			found = found || r == w
+		}
+		c.Check(found, Equals, true, Commentf("%s", w))
+	}
+}
+
+func (s *MySuite) TestPreflight(c *C) {
+	defer func(f func(externalResource) error) { checkExternalResource = f }(checkExternalResource)
+	checked := []string{}
+	checkExternalResource = func(r externalResource) error {
+		checked = append(checked, r.String())
+		if r.Name == "gone" {
+			return errors.New("gone")
+		}
+		return missingPermissions(r, []string{"storage.buckets.get"})
+	}
+	// external resources are checked even if validators are ignored
+	bp := config.Blueprint{ValidationLevel: config.ValidationIgnore, Vars: config.NewDict(map[string]cty.Value{
+		"bucket":      cty.StringVal("gone"),
+		"logs_bucket": cty.StringVal("logs"),
+		"sa":          cty.StringVal("1-compute@developer.gserviceaccount.com"),
+	})}
+
+	failed, warned := Preflight(context.Background(), bp)
+	c.Check(warned, IsNil)
+	c.Check(checked, HasLen, 3)
+	c.Check(CountExternalResources(bp), Equals, 3)
+	c.Assert(failed, NotNil)
+	c.Check(failed.(config.Errors).Errors, HasLen, 3)
+	c.Check(failed, ErrorMatches, `(?s).*vars.bucket.*gone.*`)
+	c.Check(failed, ErrorMatches, `(?s).*permissions storage.objects.get on bucket logs.*`)
+	c.Check(failed, ErrorMatches, `(?s).*permissions iam.serviceAccounts.actAs on service account .* in project 1.*`)
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/gcpauth"
 	"strings"
 	"time"
 
@@ -237,7 +238,7 @@ func satisfied(requested int64, limit int64) bool {
 
 func queryMetrics(consumer string, service string) (map[string]*sub.ConsumerQuotaMetric, error) {
 	ctx := context.Background()
-	s, err := sub.NewService(ctx)
+	s, err := sub.NewService(ctx, gcpauth.ClientOptions()...)
 	if err != nil {
 		return nil, err
 	}
@@ -280,7 +281,7 @@ func (up *usageProvider) Usage(metric string, region string, zone string) int64
 }
 
 func newUsageProvider(projectID string) (usageProvider, error) {
-	s, err := cm.NewService(context.Background())
+	s, err := cm.NewService(context.Background(), gcpauth.ClientOptions()...)
 	if err != nil {
 		return usageProvider{}, err
 	}
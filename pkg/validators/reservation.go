@@ -0,0 +1,258 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validators
+
+import (
+	"context"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/gcpauth"
+	"path"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	beta "google.golang.org/api/compute/v0.beta"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// reservation is the capacity of a reservation or of a future reservation
+// in one zone
+type reservation struct {
+	Zone        string
+	MachineType string
+	Count       int64
+	InUse       int64
+	Future      bool
+	Commitment  string
+}
+
+// available is the number of VMs that can still consume the reservation
+func (r reservation) available() int64 {
+	return r.Count - r.InUse
+}
+
+func (r reservation) kind() string {
+	if r.Future {
+		return "future reservation"
+	}
+	return "reservation"
+}
+
+// reservationUse is a module consuming a reservation
+type reservationUse struct {
+	path        config.ModulePath
+	id          config.ModuleID
+	zone        string
+	machineType string
+	nodes       int64
+}
+
+// reservationKey identifies a reservation by project and name, reservations
+// shared by other projects are given as projects/PROJECT/reservations/NAME
+type reservationKey struct {
+	project string
+	name    string
+}
+
+func parseReservationName(projectID string, s string) reservationKey {
+	parts := strings.Split(s, "/")
+	if len(parts) >= 4 && parts[0] == "projects" && parts[2] == "reservations" {
+		return reservationKey{parts[1], parts[3]}
+	}
+	return reservationKey{projectID, s}
+}
+
+func testReservations(bp config.Blueprint, inputs config.Dict) error {
+	if err := checkInputs(inputs, []string{"project_id"}); err != nil {
+		return err
+	}
+	m, err := inputsAsStrings(inputs)
+	if err != nil {
+		return err
+	}
+
+	keys := []reservationKey{}
+	uses := map[reservationKey][]reservationUse{}
+	bp.WalkModulesSafe(func(p config.ModulePath, mod *config.Module) {
+		v, ok := knownSetting(bp, *mod, "reservation_name")
+		if !ok || v.Type() != cty.String || v.AsString() == "" {
+			return
+		}
+		k := parseReservationName(m["project_id"], v.AsString())
+		if _, ok := uses[k]; !ok {
+			keys = append(keys, k)
+		}
+		uses[k] = append(uses[k], reservationUse{
+			path:        p,
+			id:          mod.ID,
+			zone:        knownString(bp, *mod, "zone"),
+			machineType: knownString(bp, *mod, "machine_type"),
+			nodes:       requestedNodes(bp, *mod),
+		})
+	})
+
+	errs := config.Errors{}
+	for _, k := range keys {
+		rs, err := lookupReservations(k.project, k.name)
+		if err != nil {
+			return handleClientError(err)
+		}
+		errs.Add(checkReservation(k, rs, uses[k]))
+	}
+	return errs.OrNil()
+}
+
+// knownString returns the setting of the module, or "" if it is not a string
+// known before deployment
+func knownString(bp config.Blueprint, m config.Module, name string) string {
+	if v, ok := knownSetting(bp, m, name); ok && v.Type() == cty.String {
+		return v.AsString()
+	}
+	return ""
+}
+
+// requestedNodes is the number of VMs the module may create, autoscaled nodes
+// included, as each of them consumes the reservation while it is up
+func requestedNodes(bp config.Blueprint, m config.Module) int64 {
+	n := int64(0)
+	for _, s := range nodeCountSettings {
+		if v, ok := knownSetting(bp, m, s); ok {
+			if c, err := ctyInt(v); err == nil {
+				n += int64(c)
+			}
+		}
+	}
+	return n
+}
+
+// checkReservation checks that the reservation exists in the zones of the
+// modules consuming it, for their machine types, and that its capacity covers
+// the nodes of all of them
+func checkReservation(k reservationKey, rs []reservation, uses []reservationUse) error {
+	errs := config.Errors{}
+	nodes := map[string]int64{} // by zone
+	zones := []string{}
+	for _, u := range uses {
+		p := u.path.Settings.Dot("reservation_name")
+		if len(rs) == 0 {
+			errs.At(p, config.HintError{
+				Hint: fmt.Sprintf("list reservations with `gcloud compute reservations list --project %s`", k.project),
+				Err:  fmt.Errorf("neither a reservation nor a future reservation %q exists in project %s, or your credentials do not have permission to access it", k.name, k.project)})
+			continue
+		}
+		r, ok := reservationInZone(rs, u.zone)
+		if !ok {
+			errs.At(p, fmt.Errorf("reservation %q of project %s is in zone %s, not in zone %s used by module %q", k.name, k.project, reservationZones(rs), u.zone, u.id))
+			continue
+		}
+		if u.machineType != "" && r.MachineType != "" && u.machineType != r.MachineType {
+			errs.At(p, fmt.Errorf("%s %q reserves machine type %s, module %q uses %s", r.kind(), k.name, r.MachineType, u.id, u.machineType))
+			continue
+		}
+		if _, ok := nodes[r.Zone]; !ok {
+			zones = append(zones, r.Zone)
+		}
+		nodes[r.Zone] += u.nodes
+	}
+
+	for _, z := range zones {
+		r, _ := reservationInZone(rs, z)
+		if nodes[z] <= r.available() {
+			continue
+		}
+		hint := "reduce node counts or increase the reservation capacity"
+		if r.Commitment != "" {
+			hint = fmt.Sprintf("the reservation is attached to commitment %s, its capacity can only be increased by updating the commitment", path.Base(r.Commitment))
+		}
+		errs.At(uses[0].path.Settings.Dot("reservation_name"), config.HintError{
+			Hint: hint,
+			Err: fmt.Errorf("%s %q in zone %s has capacity for %d more VMs, modules using it request %d",
+				r.kind(), k.name, z, r.available(), nodes[z])})
+	}
+	return errs.OrNil()
+}
+
+// reservationInZone returns the reservation in the zone, or the only one if
+// the zone is not known before deployment
+func reservationInZone(rs []reservation, zone string) (reservation, bool) {
+	for _, r := range rs {
+		if r.Zone == zone || (zone == "" && len(rs) == 1) {
+			return r, true
+		}
+	}
+	return reservation{}, false
+}
+
+func reservationZones(rs []reservation) string {
+	zs := []string{}
+	for _, r := range rs {
+		zs = append(zs, r.Zone)
+	}
+	return strings.Join(zs, ", ")
+}
+
+// lookupReservations returns reservations with the name in all zones of the
+// project, or future reservations with the name if there are none, it is
+// replaced in tests
+var lookupReservations = func(project string, name string) ([]reservation, error) {
+	ctx := context.Background()
+	filter := fmt.Sprintf("name = %q", name)
+	res := []reservation{}
+
+	s, err := compute.NewService(ctx, gcpauth.ClientOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	err = s.Reservations.AggregatedList(project).Filter(filter).Pages(ctx, func(page *compute.ReservationAggregatedList) error {
+		for _, l := range page.Items {
+			for _, r := range l.Reservations {
+				rv := reservation{Zone: path.Base(r.Zone), Commitment: r.Commitment}
+				if sr := r.SpecificReservation; sr != nil {
+					rv.Count, rv.InUse = sr.Count, sr.InUseCount
+					if sr.InstanceProperties != nil {
+						rv.MachineType = sr.InstanceProperties.MachineType
+					}
+				}
+				res = append(res, rv)
+			}
+		}
+		return nil
+	})
+	if err != nil || len(res) > 0 {
+		return res, err
+	}
+
+	// future reservations are only available in the beta API
+	bs, err := beta.NewService(ctx, gcpauth.ClientOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	err = bs.FutureReservations.AggregatedList(project).Filter(filter).Pages(ctx, func(page *beta.FutureReservationsAggregatedListResponse) error {
+		for _, l := range page.Items {
+			for _, r := range l.FutureReservations {
+				rv := reservation{Zone: path.Base(r.Zone), Future: true}
+				if sp := r.SpecificSkuProperties; sp != nil {
+					rv.Count = sp.TotalCount
+					if sp.InstanceProperties != nil {
+						rv.MachineType = sp.InstanceProperties.MachineType
+					}
+				}
+				res = append(res, rv)
+			}
+		}
+		return nil
+	})
+	return res, err
+}
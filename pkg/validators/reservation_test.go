@@ -0,0 +1,108 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validators
+
+import (
+	"hpc-toolkit/pkg/config"
+
+	"github.com/zclconf/go-cty/cty"
+	. "gopkg.in/check.v1"
+)
+
+func nodeset(id string, reservation string, zone string, machineType string, static int64, dynamic int64) config.Module {
+	return config.Module{
+		ID:     config.ModuleID(id),
+		Source: "community/modules/compute/schedmd-slurm-gcp-v6-nodeset",
+		Settings: config.NewDict(map[string]cty.Value{
+			"reservation_name":       cty.StringVal(reservation),
+			"zone":                   cty.StringVal(zone),
+			"machine_type":           cty.StringVal(machineType),
+			"node_count_static":      cty.NumberIntVal(static),
+			"node_count_dynamic_max": cty.NumberIntVal(dynamic),
+		}),
+	}
+}
+
+func (s *MySuite) TestParseReservationName(c *C) {
+	c.Check(parseReservationName("p", "r"), Equals, reservationKey{"p", "r"})
+	c.Check(parseReservationName("p", "projects/owner/reservations/r"), Equals, reservationKey{"owner", "r"})
+}
+
+func (s *MySuite) TestTestReservations(c *C) {
+	defer func(f func(string, string) ([]reservation, error)) { lookupReservations = f }(lookupReservations)
+	known := map[reservationKey][]reservation{
+		{"p", "gold"}:      {{Zone: "us-central1-a", MachineType: "c2-standard-60", Count: 10, InUse: 2}},
+		{"p", "committed"}: {{Zone: "us-central1-a", MachineType: "c2-standard-60", Count: 4, Commitment: "projects/p/regions/us-central1/commitments/cud"}},
+		{"p", "soon"}:      {{Zone: "us-central1-a", MachineType: "a3-highgpu-8g", Count: 16, Future: true}},
+		{"owner", "shared"}: {
+			{Zone: "us-central1-a", MachineType: "c2-standard-60", Count: 4},
+			{Zone: "us-central1-b", MachineType: "c2-standard-60", Count: 4}},
+	}
+	lookups := 0
+	lookupReservations = func(project string, name string) ([]reservation, error) {
+		lookups++
+		return known[reservationKey{project, name}], nil
+	}
+	inputs := config.NewDict(map[string]cty.Value{"project_id": cty.StringVal("p")})
+	bp := func(ms ...config.Module) config.Blueprint {
+		return config.Blueprint{DeploymentGroups: []config.DeploymentGroup{{Name: "primary", Modules: ms}}}
+	}
+
+	{ // no reservations used, no lookups
+		c.Check(testReservations(bp(config.Module{ID: "vm"}), inputs), IsNil)
+		c.Check(lookups, Equals, 0)
+	}
+
+	{ // ok, nodes of modules sharing a reservation add up
+		c.Check(testReservations(bp(
+			nodeset("a", "gold", "us-central1-a", "c2-standard-60", 2, 2),
+			nodeset("b", "gold", "us-central1-a", "c2-standard-60", 4, 0)), inputs), IsNil)
+		c.Check(lookups, Equals, 1)
+	}
+
+	{ // ok, future reservation and shared reservation in several zones
+		c.Check(testReservations(bp(
+			nodeset("a", "soon", "us-central1-a", "a3-highgpu-8g", 0, 16),
+			nodeset("b", "projects/owner/reservations/shared", "us-central1-a", "c2-standard-60", 4, 0),
+			nodeset("c", "projects/owner/reservations/shared", "us-central1-b", "c2-standard-60", 4, 0)), inputs), IsNil)
+	}
+
+	{ // typo
+		err := testReservations(bp(nodeset("a", "glod", "us-central1-a", "c2-standard-60", 1, 0)), inputs)
+		c.Check(err, ErrorMatches, `.*neither a reservation nor a future reservation "glod" exists in project p.*`)
+	}
+
+	{ // wrong zone
+		err := testReservations(bp(nodeset("a", "gold", "us-central1-f", "c2-standard-60", 1, 0)), inputs)
+		c.Check(err, ErrorMatches, `.*reservation "gold" of project p is in zone us-central1-a, not in zone us-central1-f used by module "a"`)
+	}
+
+	{ // wrong machine type
+		err := testReservations(bp(nodeset("a", "soon", "us-central1-a", "a2-highgpu-8g", 1, 0)), inputs)
+		c.Check(err, ErrorMatches, `.*future reservation "soon" reserves machine type a3-highgpu-8g, module "a" uses a2-highgpu-8g`)
+	}
+
+	{ // not enough capacity
+		err := testReservations(bp(
+			nodeset("a", "gold", "us-central1-a", "c2-standard-60", 4, 0),
+			nodeset("b", "gold", "us-central1-a", "c2-standard-60", 0, 6)), inputs)
+		c.Check(err, ErrorMatches, `.*reservation "gold" in zone us-central1-a has capacity for 8 more VMs, modules using it request 10 - .*`)
+	}
+
+	{ // not enough capacity, reservation attached to a commitment
+		err := testReservations(bp(nodeset("a", "committed", "us-central1-a", "c2-standard-60", 5, 0)), inputs)
+		c.Check(err, ErrorMatches, `.*modules using it request 5 - the reservation is attached to commitment cud.*`)
+	}
+}
@@ -15,12 +15,15 @@
 package validators
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"hpc-toolkit/pkg/config"
 	"strings"
+	"time"
 
 	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/slices"
 )
 
 const projectError = "project ID %s does not exist or your credentials do not have permission to access it"
@@ -32,6 +35,16 @@ const credentialsHint = "load application default credentials following instruct
 
 var ErrNoDefaultCredentials = errors.New("could not find application default credentials")
 
+// ObserveLatency, if set, is called with the name and run time of each
+// validator, e.g. to export it as a metric
+var ObserveLatency func(validator string, d time.Duration)
+
+func observeLatency(validator string, start time.Time) {
+	if ObserveLatency != nil {
+		ObserveLatency(validator, time.Since(start))
+	}
+}
+
 func handleClientError(e error) error {
 	if strings.Contains(e.Error(), "could not find default credentials") {
 		return config.HintError{Hint: credentialsHint, Err: ErrNoDefaultCredentials}
@@ -48,9 +61,18 @@ const (
 	testModuleNotUsedName             = "test_module_not_used"
 	testDeploymentVariableNotUsedName = "test_deployment_variable_not_used"
 	testResourceRequirementsName      = "test_resource_requirements"
+	testNetworkConfigName             = "test_network_config"
+	testFilesystemConfigName          = "test_filesystem_config"
+	testTCPPortOpenName               = "test_tcp_port_open"
+	testReservationActiveName         = "test_reservation_active"
+	testReservationsName              = "test_reservations"
+	testRemoteCommandName             = "test_remote_command"
+	testBudgetName                    = "test_budget"
+	testImagesExistName               = "test_images_exist"
 )
 
-func implementations() map[string]func(config.Blueprint, config.Dict) error {
+// implementations of validators, remote commands run until ctx is cancelled
+func implementations(ctx context.Context) map[string]func(config.Blueprint, config.Dict) error {
 	return map[string]func(config.Blueprint, config.Dict) error{
 		testApisEnabledName:               testApisEnabled,
 		testProjectExistsName:             testProjectExists,
@@ -60,6 +82,16 @@ func implementations() map[string]func(config.Blueprint, config.Dict) error {
 		testModuleNotUsedName:             testModuleNotUsed,
 		testDeploymentVariableNotUsedName: testDeploymentVariableNotUsed,
 		testResourceRequirementsName:      testResourceRequirements,
+		testNetworkConfigName:             testNetworkConfig,
+		testFilesystemConfigName:          testFilesystemConfig,
+		testTCPPortOpenName:               testTCPPortOpen,
+		testReservationActiveName:         testReservationActive,
+		testReservationsName:              testReservations,
+		testRemoteCommandName: func(bp config.Blueprint, inputs config.Dict) error {
+			return testRemoteCommand(ctx, bp, inputs)
+		},
+		testBudgetName:      testBudget,
+		testImagesExistName: testImagesExist,
 	}
 }
 
@@ -77,40 +109,71 @@ func (e ValidatorError) Error() string {
 	return fmt.Sprintf("validator %q failed:\n%v", e.Validator, e.Err)
 }
 
-// Execute runs all validators on the blueprint
-func Execute(bp config.Blueprint) error {
-	if bp.ValidationLevel == config.ValidationIgnore {
-		return nil
-	}
-	impl := implementations()
-	errs := config.Errors{}
+// Execute runs all validators on the blueprint, including its custom
+// validators. It returns failures of
+// validators at the error level and, separately, failures of validators at
+// the warning level; validators at the ignore level are not run. Post-deploy
+// validators are left to Verify.
+func Execute(ctx context.Context, bp config.Blueprint) (error, error) {
+	return execute(ctx, bp, false, func(inputs config.Dict) (config.Dict, error) {
+		return inputs.Eval(bp)
+	})
+}
+
+// Verify runs post-deploy validators of the blueprint, i.e. validators whose
+// inputs refer to module outputs, given output values of deployed modules.
+// Failures are returned as by Execute.
+func Verify(ctx context.Context, bp config.Blueprint, outputs map[config.ModuleID]map[string]cty.Value) (error, error) {
+	return execute(ctx, bp, true, func(inputs config.Dict) (config.Dict, error) {
+		v, err := bp.EvalWithOutputs(inputs.AsObject(), outputs)
+		if err != nil {
+			return config.Dict{}, err
+		}
+		return config.NewDict(v.AsValueMap()), nil
+	})
+}
+
+func execute(ctx context.Context, bp config.Blueprint, postDeploy bool, eval func(config.Dict) (config.Dict, error)) (error, error) {
+	impl := implementations(ctx)
+	errs, warnings := config.Errors{}, config.Errors{}
 	for iv, v := range validators(bp) {
 		p := config.Root.Validators.At(iv)
-		if v.Skip {
+		level := v.ValidationLevel(bp.ValidationLevel)
+		if v.Skip || level == config.ValidationIgnore || v.PostDeploy() != postDeploy {
 			continue
 		}
+		failures := &errs
+		if level == config.ValidationWarning {
+			failures = &warnings
+		}
 
 		f, ok := impl[v.Validator]
 		if !ok {
-			errs.At(p.Validator, fmt.Errorf("unknown validator %q", v.Validator))
+			failures.At(p.Validator, fmt.Errorf("unknown validator %q", v.Validator))
 			continue
 		}
 
-		inp, err := v.Inputs.Eval(bp)
+		inp, err := eval(v.Inputs)
 		if err != nil {
-			errs.At(p.Inputs, err)
+			failures.At(p.Inputs, err)
 			continue
 		}
 
-		if err := f(bp, inp); err != nil {
-			errs.Add(ValidatorError{v.Validator, err})
+		start := time.Now()
+		err = f(bp, inp)
+		observeLatency(v.Validator, start)
+		if err != nil {
+			failures.Add(ValidatorError{v.Validator, err})
 			// do not bother running further validators if project ID could not be found
 			if v.Validator == "test_project_exists" {
 				break
 			}
 		}
 	}
-	return errs.OrNil()
+	if !postDeploy {
+		executeCustom(bp, &errs, &warnings)
+	}
+	return errs.OrNil(), warnings.OrNil()
 }
 
 func checkInputs(inputs config.Dict, required []string) error {
@@ -146,79 +209,112 @@ func inputsAsStrings(inputs config.Dict) (map[string]string, error) {
 	return ms, nil
 }
 
-// Creates a list of default validators for the given blueprint,
-// inspect the blueprint for global variables that exist and add an appropriate validators.
-func defaults(bp config.Blueprint) []config.Validator {
-	projectIDExists := bp.Vars.Has("project_id")
-	projectRef := config.GlobalRef("project_id").AsValue()
-
-	regionExists := bp.Vars.Has("region")
-	regionRef := config.GlobalRef("region").AsValue()
-
-	zoneExists := bp.Vars.Has("zone")
-	zoneRef := config.GlobalRef("zone").AsValue()
+// zonesAndInputs separates the "zone" input, that may be given either as
+// a string or as a list of strings, from the remaining string inputs
+func zonesAndInputs(inputs config.Dict) ([]string, map[string]string, error) {
+	others := map[string]cty.Value{}
+	for k, v := range inputs.Items() {
+		if k != "zone" {
+			others[k] = v
+		}
+	}
+	m, err := inputsAsStrings(config.NewDict(others))
+	if err != nil {
+		return nil, nil, err
+	}
 
-	defaults := []config.Validator{
-		{Validator: testModuleNotUsedName},
-		{Validator: testDeploymentVariableNotUsedName}}
+	zv := inputs.Get("zone")
+	if zv.Type() == cty.String {
+		return []string{zv.AsString()}, m, nil
+	}
+	if !zv.CanIterateElements() {
+		return nil, nil, fmt.Errorf("validator input zone must be a string or a list of strings, got %s", zv.Type().FriendlyName())
+	}
+	zones := []string{}
+	for it := zv.ElementIterator(); it.Next(); {
+		_, z := it.Element()
+		if z.Type() != cty.String || z.IsNull() {
+			return nil, nil, fmt.Errorf("validator input zone must be a string or a list of strings, got %s", zv.Type().FriendlyName())
+		}
+		zones = append(zones, z.AsString())
+	}
+	if len(zones) == 0 {
+		return nil, nil, errors.New("validator input zone must not be an empty list")
+	}
+	return zones, m, nil
+}
 
+// defaultValidators are added to every blueprint, in this order, if the
+// deployment variables they take as inputs exist
+var defaultValidators = []struct {
+	name string
+	// deployment variables passed as inputs of the same name
+	vars []string
+	// whether the validator runs in deployments with a bootstrap group, whose
+	// project does not exist yet
+	bootstrap bool
+	// nil if the validator is added whenever its variables exist
+	enabled func(bp config.Blueprint) bool
+}{
+	{name: testModuleNotUsedName, bootstrap: true},
+	{name: testDeploymentVariableNotUsedName, bootstrap: true},
+	{name: testNetworkConfigName, bootstrap: true},
+	{name: testFilesystemConfigName, bootstrap: true},
 	// always add the project ID validator before subsequent validators that can
 	// only succeed if credentials can access the project. If the project ID
 	// validator fails, all remaining validators are not executed.
-	if projectIDExists {
-		defaults = append(defaults, config.Validator{
-			Validator: testProjectExistsName,
-			Inputs:    config.NewDict(map[string]cty.Value{"project_id": projectRef}),
-		})
-	}
-
+	{name: testProjectExistsName, vars: []string{"project_id"}},
 	// it is safe to run this validator even if vars.project_id is undefined;
 	// it will likely fail but will do so helpfully to the user
-	defaults = append(defaults,
-		config.Validator{Validator: testApisEnabledName})
-
-	if projectIDExists && regionExists {
-		defaults = append(defaults, config.Validator{
-			Validator: testRegionExistsName,
-			Inputs: config.NewDict(map[string]cty.Value{
-				"project_id": projectRef,
-				"region":     regionRef,
-			},
-			)})
-	}
-
-	if projectIDExists && zoneExists {
-		defaults = append(defaults, config.Validator{
-			Validator: testZoneExistsName,
-			Inputs: config.NewDict(map[string]cty.Value{
-				"project_id": projectRef,
-				"zone":       zoneRef,
-			}),
-		})
-	}
-
-	if projectIDExists && regionExists && zoneExists {
-		defaults = append(defaults, config.Validator{
-			Validator: testZoneInRegionName,
-			Inputs: config.NewDict(map[string]cty.Value{
-				"project_id": projectRef,
-				"region":     regionRef,
-				"zone":       zoneRef,
-			}),
-		})
-	}
-	return defaults
+	{name: testApisEnabledName},
+	{name: testRegionExistsName, vars: []string{"project_id", "region"}},
+	{name: testZoneExistsName, vars: []string{"project_id", "zone"}},
+	{name: testZoneInRegionName, vars: []string{"project_id", "region", "zone"}},
+	{name: testReservationsName, vars: []string{"project_id"}},
+	{name: testImagesExistName, enabled: func(bp config.Blueprint) bool { return len(bp.Images) > 0 }},
+}
+
+// Creates a list of default validators for the given blueprint,
+// inspect the blueprint for global variables that exist and add an appropriate validators.
+func defaults(bp config.Blueprint) []config.Validator {
+	_, _, bootstrap := bp.BootstrapProject()
+	res := []config.Validator{}
+	for _, d := range defaultValidators {
+		if (bootstrap && !d.bootstrap) || (d.enabled != nil && !d.enabled(bp)) ||
+			slices.ContainsFunc(d.vars, func(n string) bool { return !bp.Vars.Has(n) }) {
+			continue
+		}
+		v := config.Validator{Validator: d.name}
+		if len(d.vars) > 0 {
+			inputs := map[string]cty.Value{}
+			for _, n := range d.vars {
+				inputs[n] = config.GlobalRef(n).AsValue()
+			}
+			v.Inputs = config.NewDict(inputs)
+		}
+		res = append(res, v)
+	}
+	return res
 }
 
 // Returns a list of validators for the given blueprint with any default validators appended.
 func validators(bp config.Blueprint) []config.Validator {
-	used := map[string]bool{}
-	for _, v := range bp.Validators {
-		used[v.Validator] = true
+	ds := defaults(bp)
+	defs := map[string]config.Validator{}
+	for _, v := range ds {
+		defs[v.Validator] = v
 	}
 	vs := append([]config.Validator{}, bp.Validators...) // clone
-	for _, v := range defaults(bp) {
-		if !used[v.Validator] {
+	for i, v := range vs {
+		// explicit validators without inputs, e.g. only setting the level of
+		// a default validator, take inputs of the default one
+		if d, ok := defs[v.Validator]; ok && len(v.Inputs.Items()) == 0 {
+			vs[i].Inputs = d.Inputs
+		}
+		delete(defs, v.Validator)
+	}
+	for _, v := range ds {
+		if _, ok := defs[v.Validator]; ok {
 			vs = append(vs, v)
 		}
 	}
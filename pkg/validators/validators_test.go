@@ -15,7 +15,12 @@
 package validators
 
 import (
+	"context"
+	"errors"
 	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/modulereader"
+	"hpc-toolkit/pkg/remote"
+	"net"
 	"testing"
 
 	"github.com/zclconf/go-cty/cty"
@@ -73,6 +78,8 @@ func (s *MySuite) TestCheckInputs(c *C) {
 func (s *MySuite) TestDefaultValidators(c *C) {
 	unusedMods := config.Validator{Validator: "test_module_not_used"}
 	unusedVars := config.Validator{Validator: "test_deployment_variable_not_used"}
+	network := config.Validator{Validator: "test_network_config"}
+	filesystem := config.Validator{Validator: "test_filesystem_config"}
 	apisEnabled := config.Validator{Validator: "test_apis_enabled"}
 
 	projectRef := config.GlobalRef("project_id").AsValue()
@@ -98,18 +105,21 @@ func (s *MySuite) TestDefaultValidators(c *C) {
 			"project_id": projectRef,
 			"region":     regionRef,
 			"zone":       zoneRef})}
+	reservations := config.Validator{
+		Validator: testReservationsName,
+		Inputs:    config.NewDict(map[string]cty.Value{"project_id": projectRef})}
 
 	{
 		bp := config.Blueprint{}
 		c.Check(defaults(bp), DeepEquals, []config.Validator{
-			unusedMods, unusedVars, apisEnabled})
+			unusedMods, unusedVars, network, filesystem, apisEnabled})
 	}
 
 	{
 		bp := config.Blueprint{}
 		bp.Vars.Set("project_id", cty.StringVal("f00b"))
 		c.Check(defaults(bp), DeepEquals, []config.Validator{
-			unusedMods, unusedVars, projectExists, apisEnabled})
+			unusedMods, unusedVars, network, filesystem, projectExists, apisEnabled, reservations})
 	}
 
 	{
@@ -119,7 +129,7 @@ func (s *MySuite) TestDefaultValidators(c *C) {
 			Set("region", cty.StringVal("narnia"))
 
 		c.Check(defaults(bp), DeepEquals, []config.Validator{
-			unusedMods, unusedVars, projectExists, apisEnabled, regionExists})
+			unusedMods, unusedVars, network, filesystem, projectExists, apisEnabled, regionExists, reservations})
 	}
 
 	{
@@ -129,7 +139,7 @@ func (s *MySuite) TestDefaultValidators(c *C) {
 			Set("zone", cty.StringVal("danger"))
 
 		c.Check(defaults(bp), DeepEquals, []config.Validator{
-			unusedMods, unusedVars, projectExists, apisEnabled, zoneExists})
+			unusedMods, unusedVars, network, filesystem, projectExists, apisEnabled, zoneExists, reservations})
 	}
 
 	{
@@ -140,6 +150,185 @@ func (s *MySuite) TestDefaultValidators(c *C) {
 			Set("zone", cty.StringVal("danger"))
 
 		c.Check(defaults(bp), DeepEquals, []config.Validator{
-			unusedMods, unusedVars, projectExists, apisEnabled, regionExists, zoneExists, zoneInRegion})
+			unusedMods, unusedVars, network, filesystem, projectExists, apisEnabled, regionExists, zoneExists, zoneInRegion, reservations})
+	}
+
+	{ // project created by bootstrap group does not exist yet
+		project := config.Module{ID: "project", Source: c.TestName() + "/new-project", Kind: config.TerraformKind}
+		modulereader.SetModuleInfo(project.Source, project.Kind.String(), modulereader.ModuleInfo{
+			Outputs: []modulereader.OutputInfo{{Name: "project_id"}}})
+		bp := config.Blueprint{DeploymentGroups: []config.DeploymentGroup{
+			{Name: "setup", Bootstrap: true, Modules: []config.Module{project}}}}
+		bp.Vars.
+			Set("project_id", cty.StringVal("f00b")).
+			Set("region", cty.StringVal("narnia"))
+
+		c.Check(defaults(bp), DeepEquals, []config.Validator{
+			unusedMods, unusedVars, network, filesystem})
+	}
+}
+
+func (s *MySuite) TestValidatorsLevelOnly(c *C) {
+	bp := config.Blueprint{Validators: []config.Validator{
+		{Validator: testProjectExistsName, Level: "error"},
+		{Validator: "test_module_not_used", Skip: true}}}
+	bp.Vars.Set("project_id", cty.StringVal("f00b"))
+
+	vs := validators(bp)
+	// explicit validator without inputs takes inputs of the default one
+	c.Check(vs[0], DeepEquals, config.Validator{
+		Validator: testProjectExistsName,
+		Level:     "error",
+		Inputs:    config.NewDict(map[string]cty.Value{"project_id": config.GlobalRef("project_id").AsValue()})})
+	c.Check(vs[1], DeepEquals, config.Validator{Validator: "test_module_not_used", Skip: true})
+	for _, v := range vs[2:] {
+		c.Check(v.Validator, Not(Equals), testProjectExistsName)
+		c.Check(v.Validator, Not(Equals), "test_module_not_used")
+	}
+}
+
+func (s *MySuite) TestExecuteLevels(c *C) {
+	offline := func(level int, unusedVars string) config.Blueprint {
+		bp := config.Blueprint{ValidationLevel: level, Validators: []config.Validator{
+			{Validator: "test_deployment_variable_not_used", Level: unusedVars},
+			{Validator: "test_apis_enabled", Skip: true}}}
+		bp.Vars.Set("unused", cty.StringVal("x"))
+		return bp
+	}
+
+	{ // blueprint level applies
+		failed, warned := Execute(context.Background(), offline(config.ValidationError, ""))
+		c.Check(failed, ErrorMatches, `(?s).*"unused" was not used.*`)
+		c.Check(warned, IsNil)
+	}
+
+	{ // validator level overrides the blueprint one
+		failed, warned := Execute(context.Background(), offline(config.ValidationError, "warning"))
+		c.Check(failed, IsNil)
+		c.Check(warned, ErrorMatches, `(?s).*"unused" was not used.*`)
+
+		failed, warned = Execute(context.Background(), offline(config.ValidationIgnore, "error"))
+		c.Check(failed, ErrorMatches, `(?s).*"unused" was not used.*`)
+		c.Check(warned, IsNil)
+
+		failed, warned = Execute(context.Background(), offline(config.ValidationError, "ignore"))
+		c.Check(failed, IsNil)
+		c.Check(warned, IsNil)
+	}
+}
+
+func (s *MySuite) TestVerify(c *C) {
+	dialed := []string{}
+	defer func(d func(string) (net.Conn, error)) { dial = d }(dial)
+	dial = func(addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if addr == "10.0.0.2:6817" {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+
+	bp := config.Blueprint{Validators: []config.Validator{
+		{Validator: "test_tcp_port_open", Inputs: config.NewDict(map[string]cty.Value{
+			"host": config.ModuleRef("controller", "ip").AsValue(),
+			"port": cty.NumberIntVal(6817)})},
+		{Validator: "test_apis_enabled", Skip: true}}}
+	outputs := func(ip string) map[config.ModuleID]map[string]cty.Value {
+		return map[config.ModuleID]map[string]cty.Value{"controller": {"ip": cty.StringVal(ip)}}
+	}
+
+	{ // post-deploy validators are not run by Execute
+		failed, warned := Execute(context.Background(), bp)
+		c.Check(failed, IsNil)
+		c.Check(warned, IsNil)
+		c.Check(dialed, HasLen, 0)
+	}
+
+	{ // Success
+		failed, warned := Verify(context.Background(), bp, outputs("10.0.0.1"))
+		c.Check(failed, IsNil)
+		c.Check(warned, IsNil)
+		c.Check(dialed, DeepEquals, []string{"10.0.0.1:6817"})
+	}
+
+	{ // Fail: port is not reachable
+		failed, _ := Verify(context.Background(), bp, outputs("10.0.0.2"))
+		c.Check(failed, ErrorMatches, `(?s).*port 10.0.0.2:6817 is not reachable.*`)
+	}
+
+	{ // Fail: group of the module was not deployed
+		failed, _ := Verify(context.Background(), bp, map[config.ModuleID]map[string]cty.Value{})
+		c.Check(failed, ErrorMatches, `(?s).*output "ip" of module "controller" is not known.*`)
+	}
+}
+
+func (s *MySuite) TestRemoteCommand(c *C) {
+	defer func(f func(context.Context, remote.Target, string) (string, error)) { remote.RunOn = f }(remote.RunOn)
+	ran := []string{}
+	remote.RunOn = func(_ context.Context, t remote.Target, command string) (string, error) {
+		ran = append(ran, t.Instance+": "+command)
+		if t.Instance == "hpc-broken" {
+			return "", errors.New("exit status 1")
+		}
+		return "", nil
+	}
+	inputs := func(instance string) map[string]cty.Value {
+		return map[string]cty.Value{
+			"project_id": cty.StringVal("test-project"),
+			"zone":       cty.StringVal("us-central1-a"),
+			"instance":   cty.StringVal(instance),
+			"command":    cty.StringVal("sinfo")}
+	}
+
+	c.Check(testRemoteCommand(context.Background(), config.Blueprint{}, config.NewDict(inputs("hpc-login"))), IsNil)
+	c.Check(testRemoteCommand(context.Background(), config.Blueprint{}, config.NewDict(inputs("hpc-broken"))), ErrorMatches, "exit status 1")
+	c.Check(ran, DeepEquals, []string{"hpc-login: sinfo", "hpc-broken: sinfo"})
+
+	{ // Fail: no command
+		inp := inputs("hpc-login")
+		delete(inp, "command")
+		c.Check(testRemoteCommand(context.Background(), config.Blueprint{}, config.NewDict(inp)), ErrorMatches, `.*required input "command".*`)
+	}
+
+	{ // Fail: unexpected input
+		inp := inputs("hpc-login")
+		inp["port"] = cty.NumberIntVal(22)
+		c.Check(testRemoteCommand(context.Background(), config.Blueprint{}, config.NewDict(inp)), ErrorMatches, `unexpected input "port".*`)
+	}
+}
+
+func (s *MySuite) TestZonesAndInputs(c *C) {
+	project := cty.StringVal("test-project")
+	{ // Single zone
+		zones, m, err := zonesAndInputs(config.NewDict(map[string]cty.Value{
+			"project_id": project,
+			"zone":       cty.StringVal("us-central1-a")}))
+		c.Assert(err, IsNil)
+		c.Check(zones, DeepEquals, []string{"us-central1-a"})
+		c.Check(m, DeepEquals, map[string]string{"project_id": "test-project"})
+	}
+
+	{ // List of zones
+		zones, _, err := zonesAndInputs(config.NewDict(map[string]cty.Value{
+			"project_id": project,
+			"zone":       cty.TupleVal([]cty.Value{cty.StringVal("us-central1-a"), cty.StringVal("us-central1-b")})}))
+		c.Assert(err, IsNil)
+		c.Check(zones, DeepEquals, []string{"us-central1-a", "us-central1-b"})
+	}
+
+	{ // Fail: empty list
+		_, _, err := zonesAndInputs(config.NewDict(map[string]cty.Value{
+			"project_id": project,
+			"zone":       cty.EmptyTupleVal}))
+		c.Check(err, ErrorMatches, ".*must not be an empty list.*")
+	}
+
+	{ // Fail: list of numbers
+		_, _, err := zonesAndInputs(config.NewDict(map[string]cty.Value{
+			"project_id": project,
+			"zone":       cty.TupleVal([]cty.Value{cty.NumberIntVal(1)})}))
+		c.Check(err, ErrorMatches, ".*must be a string or a list of strings.*")
 	}
 }
@@ -22,7 +22,7 @@ run_test() {
 	bpFile=$(basename "$bp")
 	DEPLOYMENT="golden_copy_deployment"
 	PROJECT="invalid-project"
-	VALIDATORS_TO_SKIP="test_project_exists,test_apis_enabled,test_region_exists,test_zone_exists,test_zone_in_region"
+	VALIDATORS_TO_SKIP="test_project_exists,test_apis_enabled,test_region_exists,test_zone_exists,test_zone_in_region,test_reservations"
 	GHPC_PATH="${cwd}/ghpc"
 	# Cover the three possible starting sequences for local sources: ./ ../ /
 	LOCAL_SOURCE_PATTERN='source:\s\+\(\./\|\.\./\|/\)'
@@ -68,7 +68,9 @@ run_test() {
 		rm -rf "${folder}/modules"
 	done
 	find . -name "README.md" -exec rm {} \;
-	sed -i -E 's/(ghpc_version: )(.*)/\1golden/' .ghpc/artifacts/expanded_blueprint.yaml
+	sed -i -E 's/(ghpc_version: )(.*)/\1golden/' .ghpc/artifacts/expanded_blueprint.yaml .ghpc/artifacts/resolved_blueprint.yaml .ghpc/artifacts/manifest.yaml
+	# files and their sizes change with module sources, drop them
+	sed -i '/^files:/,$d' .ghpc/artifacts/manifest.yaml
 
 	# Compare the deployment folder with the golden copy
 	diff --recursive --exclude="previous_deployment_groups" \